@@ -0,0 +1,433 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package bridge mirrors topics between two clients (e.g. connected to an
+// edge broker and a cloud broker), messages received by one client are
+// republished by the other one according to the bridge rules
+package bridge
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/goiiot/libmqtt"
+)
+
+var (
+	// ErrNilClient is returned by NewBridge if any client is nil
+	ErrNilClient = errors.New("bridge: nil client ")
+	// ErrBadDirection is returned by NewBridge if the direction of a rule
+	// is unknown
+	ErrBadDirection = errors.New("bridge: bad rule direction ")
+	// ErrBadQos is returned by NewBridge if the QoS of a rule is greater
+	// than Qos2
+	ErrBadQos = errors.New("bridge: bad rule QoS ")
+	// ErrBadPrefix is returned by NewBridge if the prefix added by a rule
+	// contains wildcards
+	ErrBadPrefix = errors.New("bridge: bad rule prefix ")
+)
+
+// MarkerKey is the key of the MQTT 5 user property added to messages
+// republished, the value is the bridge id, messages received with the
+// marker of the bridge are not republished again
+const MarkerKey = "libmqtt-bridge"
+
+const defaultQueueSize = 256
+
+// Direction of a bridge rule
+type Direction int
+
+const (
+	// SrcToDst subscribes with the source client and republishes with the
+	// destination client
+	SrcToDst Direction = iota
+	// DstToSrc subscribes with the destination client and republishes
+	// with the source client
+	DstToSrc
+	// Both directions
+	Both
+)
+
+// BridgeRule selects the messages to bridge
+type BridgeRule struct {
+	// Filter is the topic filter to subscribe
+	Filter string
+	// Qos of the subscription
+	Qos libmqtt.QosLevel
+	// Direction of the rule, SrcToDst by default
+	Direction Direction
+
+	// StripPrefix is removed from topics republished (if present)
+	StripPrefix string
+	// AddPrefix is added to topics republished (after StripPrefix removed)
+	AddPrefix string
+
+	// OverrideQos republishes messages with PubQos instead of the QoS
+	// received
+	OverrideQos bool
+	// PubQos of messages republished if OverrideQos
+	PubQos libmqtt.QosLevel
+}
+
+// rewrite the topic received to the topic to republish
+func (r *BridgeRule) rewrite(topic string) string {
+	return r.AddPrefix + strings.TrimPrefix(topic, r.StripPrefix)
+}
+
+// BridgeOption is the option of Bridge
+type BridgeOption func(b *Bridge)
+
+// WithID sets the bridge id used as the value of the marker, bridges
+// sharing the id (e.g. the same bridge restarted) detect the loops of
+// each others, a random id is generated by default
+func WithID(id string) BridgeOption {
+	return func(b *Bridge) {
+		if id != "" {
+			b.id = id
+		}
+	}
+}
+
+// WithQueueSize sets the max count of messages waiting to be republished
+// in each direction (e.g. while the client republishing is reconnecting),
+// messages received once the queue is full are dropped
+func WithQueueSize(size int) BridgeOption {
+	return func(b *Bridge) {
+		if size > 0 {
+			b.queueSize = size
+		}
+	}
+}
+
+// Stats is the snapshot of bridge statistics
+type Stats struct {
+	// BridgedMessages is the count of messages republished
+	BridgedMessages uint64
+	// DroppedMessages is the count of messages dropped because the queue
+	// was full or the bridge closed
+	DroppedMessages uint64
+	// LoopedMessages is the count of messages received with the marker of
+	// the bridge, which are not republished
+	LoopedMessages uint64
+}
+
+// route is one direction of a rule
+type route struct {
+	rule     BridgeRule
+	from, to libmqtt.Client
+	queue    chan *libmqtt.PublishPacket
+}
+
+// handlerKey is the topic filter handled by the client
+type handlerKey struct {
+	client libmqtt.Client
+	filter string
+}
+
+// Bridge republishes messages between two clients
+type Bridge struct {
+	id        string
+	queueSize int
+	routes    []*route
+	handlers  map[handlerKey][]*route
+	src, dst  libmqtt.Client
+
+	bridged uint64
+	dropped uint64
+	looped  uint64
+
+	// closed once the client connected first (see HandleConn)
+	srcReady, dstReady         chan struct{}
+	srcReadyOnce, dstReadyOnce sync.Once
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewBridge creates a bridge between the src and dst clients with rules,
+// the publish handlers of the rule filters are registered to the clients
+// subscribing (replacing handlers registered with the same filter)
+//
+// subscriptions are made once clients connected, use HandleConn as (or
+// call it in) the ConnHandleFunc of both clients, topics are subscribed
+// again once reconnected without session resumed, messages are queued
+// while the client republishing is disconnected or not connected yet (see
+// WithQueueSize)
+//
+// retained flags are propagated (with MQTT 5, topics are subscribed with
+// retain as published), and with MQTT 5, user properties are propagated
+// with the marker (MarkerKey) of the bridge added for loop prevention,
+// with MQTT 3.1.1 there is no loop prevention
+func NewBridge(src, dst libmqtt.Client, rules []BridgeRule, options ...BridgeOption) (*Bridge, error) {
+	if src == nil || dst == nil {
+		return nil, ErrNilClient
+	}
+
+	b := &Bridge{
+		queueSize: defaultQueueSize,
+		handlers:  make(map[handlerKey][]*route),
+		src:       src,
+		dst:       dst,
+		srcReady:  make(chan struct{}),
+		dstReady:  make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	for _, setOption := range options {
+		setOption(b)
+	}
+
+	if b.id == "" {
+		id := make([]byte, 8)
+		if _, err := rand.Read(id); err != nil {
+			return nil, err
+		}
+		b.id = hex.EncodeToString(id)
+	}
+
+	toDst := make(chan *libmqtt.PublishPacket, b.queueSize)
+	toSrc := make(chan *libmqtt.PublishPacket, b.queueSize)
+	for _, rule := range rules {
+		if err := libmqtt.ValidateTopicFilter(rule.Filter); err != nil {
+			return nil, err
+		}
+
+		if rule.Qos > libmqtt.Qos2 || (rule.OverrideQos && rule.PubQos > libmqtt.Qos2) {
+			return nil, ErrBadQos
+		}
+
+		if strings.ContainsAny(rule.AddPrefix, "+#") {
+			return nil, ErrBadPrefix
+		}
+
+		switch rule.Direction {
+		case SrcToDst:
+			b.routes = append(b.routes, &route{rule: rule, from: src, to: dst, queue: toDst})
+		case DstToSrc:
+			b.routes = append(b.routes, &route{rule: rule, from: dst, to: src, queue: toSrc})
+		case Both:
+			b.routes = append(b.routes,
+				&route{rule: rule, from: src, to: dst, queue: toDst},
+				&route{rule: rule, from: dst, to: src, queue: toSrc},
+			)
+		default:
+			return nil, ErrBadDirection
+		}
+	}
+
+	for _, r := range b.routes {
+		key := handlerKey{client: r.from, filter: r.rule.Filter}
+		b.handlers[key] = append(b.handlers[key], r)
+	}
+
+	for key, routes := range b.handlers {
+		routes := routes
+		key.client.HandlePublish(key.filter, func(client libmqtt.Client, p *libmqtt.PublishPacket) {
+			for _, r := range routes {
+				b.forward(r, p)
+			}
+			// handed to the queues (or dropped), ack it in manual ack mode
+			client.Ack(p)
+		})
+	}
+
+	go b.republish(dst, b.dstReady, toDst)
+	go b.republish(src, b.srcReady, toSrc)
+	return b, nil
+}
+
+// ID returns the bridge id used as the value of the marker
+func (b *Bridge) ID() string {
+	return b.id
+}
+
+// HandleConn subscribes the topic filters of rules once the client
+// connected to the server, filters already subscribed (session resumed)
+// are skipped, connections of other clients and failed connections are
+// ignored
+func (b *Bridge) HandleConn(client libmqtt.Client, server string, code byte, err error) {
+	if err != nil || code != libmqtt.CodeSuccess || b.isClosed() {
+		return
+	}
+
+	switch client {
+	case b.src:
+		b.srcReadyOnce.Do(func() { close(b.srcReady) })
+	case b.dst:
+		b.dstReadyOnce.Do(func() { close(b.dstReady) })
+	}
+
+	subscribed := make(map[string]struct{})
+	for _, sub := range client.Subscriptions() {
+		if sub.Server == server {
+			subscribed[sub.Topic] = struct{}{}
+		}
+	}
+
+	var options byte
+	if info, ok := client.ConnInfo(server); ok && info.Version >= libmqtt.V5 {
+		options = libmqtt.SubRetainAsPublished
+	}
+
+	var topics []*libmqtt.Topic
+	for key, routes := range b.handlers {
+		if key.client != client {
+			continue
+		}
+
+		if _, ok := subscribed[key.filter]; ok {
+			continue
+		}
+
+		var qos libmqtt.QosLevel
+		for _, r := range routes {
+			if r.rule.Qos > qos {
+				qos = r.rule.Qos
+			}
+		}
+		topics = append(topics, &libmqtt.Topic{Name: key.filter, Qos: qos | options})
+	}
+
+	if len(topics) > 0 {
+		client.Subscribe(topics...)
+	}
+}
+
+// Stats returns the snapshot of bridge statistics
+func (b *Bridge) Stats() Stats {
+	return Stats{
+		BridgedMessages: atomic.LoadUint64(&b.bridged),
+		DroppedMessages: atomic.LoadUint64(&b.dropped),
+		LoopedMessages:  atomic.LoadUint64(&b.looped),
+	}
+}
+
+// Close the bridge, handlers registered are removed and messages queued
+// are dropped, subscriptions are kept (unsubscribe with clients if
+// required)
+func (b *Bridge) Close() {
+	b.closeOnce.Do(func() {
+		close(b.done)
+		for key := range b.handlers {
+			key.client.RemoveTopic(key.filter)
+		}
+	})
+}
+
+func (b *Bridge) isClosed() bool {
+	select {
+	case <-b.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// forward queues the message received to be republished, messages with
+// the marker of the bridge are skipped
+func (b *Bridge) forward(r *route, p *libmqtt.PublishPacket) {
+	if p.Props != nil {
+		for _, v := range p.Props.UserProps.Values(MarkerKey) {
+			if v == b.id {
+				atomic.AddUint64(&b.looped, 1)
+				return
+			}
+		}
+	}
+
+	topic := r.rule.rewrite(p.TopicName)
+	if topic == "" {
+		atomic.AddUint64(&b.dropped, 1)
+		return
+	}
+
+	qos := p.Qos
+	if r.rule.OverrideQos {
+		qos = r.rule.PubQos
+	}
+
+	// the received packet is reused once handled, copy the payload
+	pub := &libmqtt.PublishPacket{
+		TopicName: topic,
+		Qos:       qos,
+		IsRetain:  p.IsRetain,
+		Payload:   append([]byte(nil), p.Payload...),
+		Props:     &libmqtt.PublishProps{},
+	}
+	if p.Props != nil {
+		// topic alias and subscription identifiers are specific to the
+		// connection received
+		pub.Props = &libmqtt.PublishProps{
+			PayloadFormat:         p.Props.PayloadFormat,
+			MessageExpiryInterval: p.Props.MessageExpiryInterval,
+			RespTopic:             p.Props.RespTopic,
+			CorrelationData:       append([]byte(nil), p.Props.CorrelationData...),
+			UserProps:             append(libmqtt.UserProps(nil), p.Props.UserProps...),
+			ContentType:           p.Props.ContentType,
+		}
+	}
+	pub.Props.UserProps.Add(MarkerKey, b.id)
+
+	if b.isClosed() {
+		atomic.AddUint64(&b.dropped, 1)
+		return
+	}
+
+	select {
+	case r.queue <- pub:
+	default:
+		atomic.AddUint64(&b.dropped, 1)
+	}
+}
+
+// republish messages queued with the client until the bridge closed,
+// messages wait in the queue until the client connected first (instead of
+// the pre-connect queue of the client), and Publish blocks while the client
+// is disconnected and its send buffer is full
+func (b *Bridge) republish(client libmqtt.Client, ready <-chan struct{}, queue chan *libmqtt.PublishPacket) {
+	select {
+	case <-b.done:
+		b.drop(queue)
+		return
+	case <-ready:
+	}
+
+	for {
+		select {
+		case <-b.done:
+			b.drop(queue)
+			return
+		case p := <-queue:
+			client.Publish(p)
+			atomic.AddUint64(&b.bridged, 1)
+		}
+	}
+}
+
+// drop messages queued once the bridge closed
+func (b *Bridge) drop(queue chan *libmqtt.PublishPacket) {
+	for {
+		select {
+		case <-queue:
+			atomic.AddUint64(&b.dropped, 1)
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,308 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bridge
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/goiiot/libmqtt"
+	"github.com/goiiot/libmqtt/mqtttest"
+)
+
+const testTimeout = 5 * time.Second
+
+// testSide is a client connected to a test broker
+type testSide struct {
+	broker     *mqtttest.TestBroker
+	client     libmqtt.Client
+	connected  chan error
+	subscribed chan error
+
+	mu   sync.Mutex
+	conn net.Conn // last connection
+}
+
+func newTestSide(t *testing.T, bridge **Bridge, options ...libmqtt.Option) *testSide {
+	t.Helper()
+
+	s := &testSide{
+		broker:     mqtttest.NewTestBroker(),
+		connected:  make(chan error, 10),
+		subscribed: make(chan error, 10),
+	}
+
+	connector := s.broker.Connector()
+	client, err := libmqtt.NewClient(append([]libmqtt.Option{
+		libmqtt.WithVersion(libmqtt.V5, false),
+		libmqtt.WithAutoReconnect(true),
+		libmqtt.WithBackoffStrategy(10*time.Millisecond, 10*time.Millisecond, 1),
+		libmqtt.WithCustomConnector(func(ctx context.Context, address string, timeout time.Duration, tlsConfig *tls.Config) (net.Conn, error) {
+			conn, err := connector(ctx, address, timeout, tlsConfig)
+			s.mu.Lock()
+			s.conn = conn
+			s.mu.Unlock()
+			return conn, err
+		}),
+		libmqtt.WithConnHandleFunc(func(client libmqtt.Client, server string, code byte, err error) {
+			(*bridge).HandleConn(client, server, code, err)
+			s.connected <- err
+		}),
+		libmqtt.WithSubHandleFunc(func(client libmqtt.Client, topics []*libmqtt.Topic, err error) {
+			s.subscribed <- err
+		}),
+	}, options...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.client = client
+	return s
+}
+
+func (s *testSide) connect(t *testing.T) {
+	t.Helper()
+
+	if err := s.client.ConnectServer("broker"); err != nil {
+		t.Fatal(err)
+	}
+	wait(t, s.connected)
+}
+
+func (s *testSide) close() {
+	s.client.Destroy(true)
+	_ = s.broker.Close()
+}
+
+// publishes returns publish packets of the topic received by the broker
+func (s *testSide) publishes(topic string) []*libmqtt.PublishPacket {
+	var result []*libmqtt.PublishPacket
+	for _, p := range s.broker.Received() {
+		if pub, ok := p.(*libmqtt.PublishPacket); ok && pub.TopicName == topic {
+			result = append(result, pub)
+		}
+	}
+	return result
+}
+
+func wait(t *testing.T, ch <-chan error) {
+	t.Helper()
+
+	select {
+	case err := <-ch:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("timeout")
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+
+	for deadline := time.Now().Add(testTimeout); !cond(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout")
+		}
+	}
+}
+
+func TestBridge(t *testing.T) {
+	var b *Bridge
+	edge, cloud := newTestSide(t, &b), newTestSide(t, &b)
+	defer edge.close()
+	defer cloud.close()
+
+	b, err := NewBridge(edge.client, cloud.client, []BridgeRule{
+		{Filter: "edge/#", Qos: libmqtt.Qos1, StripPrefix: "edge/", AddPrefix: "cloud/"},
+		{Filter: "sync/#", Direction: Both},
+		{Filter: "cmd/#", Qos: libmqtt.Qos1, Direction: DstToSrc, OverrideQos: true, PubQos: libmqtt.Qos0},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	edge.connect(t)
+	cloud.connect(t)
+	wait(t, edge.subscribed)
+	wait(t, cloud.subscribed)
+
+	edge.client.Publish(&libmqtt.PublishPacket{
+		TopicName: "edge/a",
+		Qos:       libmqtt.Qos1,
+		IsRetain:  true,
+		Payload:   []byte("foo"),
+		Props:     &libmqtt.PublishProps{UserProps: libmqtt.UserProps{{Key: "k", Value: "v"}}},
+	})
+	waitFor(t, func() bool { return len(cloud.publishes("cloud/a")) == 1 })
+
+	p := cloud.publishes("cloud/a")[0]
+	if p.Qos != libmqtt.Qos1 || !p.IsRetain || string(p.Payload) != "foo" {
+		t.Error("unexpected message bridged =", p)
+	}
+	if v, _ := p.Props.UserProps.Get("k"); v != "v" {
+		t.Error("user properties not propagated =", p.Props.UserProps)
+	}
+	if v, _ := p.Props.UserProps.Get(MarkerKey); v != b.ID() {
+		t.Error("marker not added =", p.Props.UserProps)
+	}
+
+	// bridged back by the rule of both directions
+	edge.client.Publish(&libmqtt.PublishPacket{TopicName: "sync/x", Payload: []byte("bar")})
+	waitFor(t, func() bool { return b.Stats().LoopedMessages == 1 })
+	if n := len(edge.publishes("sync/x")); n != 1 {
+		t.Error("message looped, published to edge =", n)
+	}
+
+	cloud.client.Publish(&libmqtt.PublishPacket{TopicName: "cmd/y", Qos: libmqtt.Qos1, Payload: []byte("baz")})
+	waitFor(t, func() bool { return len(edge.publishes("cmd/y")) == 1 })
+	if p := edge.publishes("cmd/y")[0]; p.Qos != libmqtt.Qos0 || p.IsRetain {
+		t.Error("unexpected message bridged =", p)
+	}
+
+	if stats := b.Stats(); stats.BridgedMessages != 3 || stats.DroppedMessages != 0 || stats.LoopedMessages != 1 {
+		t.Error("unexpected stats =", stats)
+	}
+}
+
+func TestBridge_Reconnect(t *testing.T) {
+	var b *Bridge
+	edge, cloud := newTestSide(t, &b), newTestSide(t, &b)
+	defer edge.close()
+	defer cloud.close()
+
+	b, err := NewBridge(edge.client, cloud.client, []BridgeRule{{Filter: "edge/#", Qos: libmqtt.Qos1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	edge.connect(t)
+	wait(t, edge.subscribed)
+
+	// queued until cloud connected
+	edge.client.Publish(&libmqtt.PublishPacket{TopicName: "edge/a", Qos: libmqtt.Qos1, Payload: []byte("foo")})
+	waitFor(t, func() bool { return len(edge.publishes("edge/a")) == 1 })
+	cloud.connect(t)
+	waitFor(t, func() bool { return len(cloud.publishes("edge/a")) == 1 })
+
+	// subscribed again once reconnected without session
+	edge.mu.Lock()
+	_ = edge.conn.Close()
+	edge.mu.Unlock()
+	wait(t, edge.connected)
+	wait(t, edge.subscribed)
+
+	subs := 0
+	for _, p := range edge.broker.Received() {
+		if _, ok := p.(*libmqtt.SubscribePacket); ok {
+			subs++
+		}
+	}
+	if subs != 2 {
+		t.Error("unexpected subscribe packets =", subs)
+	}
+
+	edge.client.Publish(&libmqtt.PublishPacket{TopicName: "edge/b", Qos: libmqtt.Qos1, Payload: []byte("bar")})
+	waitFor(t, func() bool { return len(cloud.publishes("edge/b")) == 1 })
+}
+
+func TestBridge_Dropped(t *testing.T) {
+	var b *Bridge
+	edge, cloud := newTestSide(t, &b), newTestSide(t, &b)
+	defer edge.close()
+	defer cloud.close()
+
+	b, err := NewBridge(edge.client, cloud.client, []BridgeRule{{Filter: "edge/#"}}, WithQueueSize(1), WithID("bridge"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	if b.ID() != "bridge" {
+		t.Error("unexpected id =", b.ID())
+	}
+
+	edge.connect(t)
+	wait(t, edge.subscribed)
+
+	// cloud not connected yet, one message in the queue
+	for i := 0; i < 5; i++ {
+		edge.client.Publish(&libmqtt.PublishPacket{TopicName: "edge/a", Payload: []byte("foo")})
+	}
+	waitFor(t, func() bool { return b.Stats().DroppedMessages == 4 })
+}
+
+func TestBridge_ManualAck(t *testing.T) {
+	var b *Bridge
+	edge, cloud := newTestSide(t, &b, libmqtt.WithManualAck(true)), newTestSide(t, &b)
+	defer edge.close()
+	defer cloud.close()
+
+	b, err := NewBridge(edge.client, cloud.client, []BridgeRule{{Filter: "edge/#", Qos: libmqtt.Qos1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	edge.connect(t)
+	cloud.connect(t)
+	wait(t, edge.subscribed)
+
+	// acked once forwarded, later messages not stalled
+	for i := 0; i < 3; i++ {
+		edge.client.Publish(&libmqtt.PublishPacket{TopicName: "edge/a", Qos: libmqtt.Qos1, Payload: []byte("foo")})
+	}
+	waitFor(t, func() bool { return len(cloud.publishes("edge/a")) == 3 })
+	waitFor(t, func() bool {
+		acks := 0
+		for _, p := range edge.broker.Received() {
+			if _, ok := p.(*libmqtt.PubAckPacket); ok {
+				acks++
+			}
+		}
+		return acks == 3
+	})
+}
+
+func TestNewBridge(t *testing.T) {
+	src, err := libmqtt.NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Destroy(true)
+
+	if _, err := NewBridge(src, nil, nil); err != ErrNilClient {
+		t.Error("unexpected error =", err)
+	}
+
+	for expected, rule := range map[error]BridgeRule{
+		libmqtt.ErrTopicEmpty: {},
+		ErrBadDirection:       {Filter: "foo", Direction: Both + 1},
+		ErrBadQos:             {Filter: "foo", OverrideQos: true, PubQos: 3},
+		ErrBadPrefix:          {Filter: "foo", AddPrefix: "bar/+/"},
+	} {
+		if _, err := NewBridge(src, src, []BridgeRule{rule}); err != expected {
+			t.Errorf("expected %v, got %v", expected, err)
+		}
+	}
+}
@@ -32,6 +32,7 @@ typedef enum {
 } libmqtt_log_level;
 
 typedef enum {
+  libmqtt_mqtt_version_31 = 3,
   libmqtt_mqtt_version_311 = 4,
   libmqtt_mqtt_version_5 = 5,
 } libmqtt_mqtt_version;
@@ -0,0 +1,122 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ErrALPNMismatch is matched (with errors.Is) by the ALPNMismatchError
+// notified to the ConnHandleFunc
+var ErrALPNMismatch = errors.New("ALPN protocol mismatch ")
+
+// ALPNMismatchError is notified to the ConnHandleFunc when the protocol
+// negotiated in the TLS handshake is not one of the protocols set with
+// WithALPN (e.g. the server doesn't support ALPN)
+type ALPNMismatchError struct {
+	// Protocols are the protocols requested
+	Protocols []string
+	// Negotiated is the protocol selected by the server, empty if none
+	Negotiated string
+}
+
+func (e *ALPNMismatchError) Error() string {
+	return fmt.Sprintf("ALPN protocol mismatch, requested %s, negotiated %q",
+		strings.Join(e.Protocols, ","), e.Negotiated)
+}
+
+// Is returns true if the target is ErrALPNMismatch
+func (e *ALPNMismatchError) Is(target error) bool {
+	return target == ErrALPNMismatch
+}
+
+// WithALPN designate the ALPN protocols of TLS connections in preference
+// order (e.g. "x-amzn-mqtt-ca" for AWS IoT on port 443), merged into the
+// TLS config of the server (see WithTLS, WithCustomTLS) before protocols
+// already set, the connect fails with ALPNMismatchError if the server
+// negotiated none of them, no effect without TLS
+func WithALPN(protos ...string) Option {
+	return func(c *AsyncClient, options *connectOptions) error {
+		for _, p := range protos {
+			if p == "" || len(p) > 255 {
+				return fmt.Errorf("invalid ALPN protocol %q", p)
+			}
+		}
+
+		options.alpn = append([]string(nil), protos...)
+		return nil
+	}
+}
+
+// alpnConfig returns the TLS config with ALPN protocols merged, the config
+// set by options is not modified
+func (c connectOptions) alpnConfig() *tls.Config {
+	if c.tlsConfig == nil || len(c.alpn) == 0 {
+		return c.tlsConfig
+	}
+
+	config := c.tlsConfig.Clone()
+	config.NextProtos = append([]string(nil), c.alpn...)
+	for _, p := range c.tlsConfig.NextProtos {
+		if !containsString(c.alpn, p) {
+			config.NextProtos = append(config.NextProtos, p)
+		}
+	}
+	return config
+}
+
+// verifyALPN completes the TLS handshake if not yet (e.g. connections of
+// custom connectors) and checks the protocol negotiated, connections
+// without TLS state (e.g. websocket) are not checked
+func (c connectOptions) verifyALPN(conn net.Conn) error {
+	if c.tlsConfig == nil || len(c.alpn) == 0 {
+		return nil
+	}
+
+	tlsConn, ok := conn.(interface{ ConnectionState() tls.ConnectionState })
+	if !ok {
+		return nil
+	}
+
+	state := tlsConn.ConnectionState()
+	if !state.HandshakeComplete {
+		if h, ok := conn.(interface{ Handshake() error }); ok {
+			if err := h.Handshake(); err != nil {
+				return err
+			}
+			state = tlsConn.ConnectionState()
+		}
+	}
+
+	if !containsString(c.alpn, state.NegotiatedProtocol) {
+		return &ALPNMismatchError{Protocols: c.alpn, Negotiated: state.NegotiatedProtocol}
+	}
+	return nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
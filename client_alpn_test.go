@@ -0,0 +1,102 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestClient_ALPN(t *testing.T) {
+	cert, err := tls.LoadX509KeyPair("testdata/client-cert.pem", "testdata/client-key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		serverProtos []string
+		clientProtos []string // set in the TLS config of the server
+		nextProtos   []string // sent in the handshake
+		err          bool
+	}{
+		{serverProtos: []string{"mqtt"}, nextProtos: []string{"x-amzn-mqtt-ca", "mqtt"}},
+		// server without ALPN
+		{serverProtos: nil, nextProtos: []string{"x-amzn-mqtt-ca", "mqtt"}, err: true},
+		// merged with protocols set before, not negotiated
+		{serverProtos: []string{"h2"}, clientProtos: []string{"h2", "mqtt"}, nextProtos: []string{"x-amzn-mqtt-ca", "mqtt", "h2"}, err: true},
+	} {
+		var (
+			results = make(chan error, 1)
+			sent    = make(chan []string, 1)
+			config  = &tls.Config{InsecureSkipVerify: true, NextProtos: c.clientProtos}
+		)
+		client, err := NewClient(WithConnHandleFunc(func(client Client, server string, code byte, err error) {
+			results <- err
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = client.ConnectServer("fake",
+			WithCustomTLS(config),
+			WithALPN("x-amzn-mqtt-ca", "mqtt"),
+			WithCustomConnector(func(ctx context.Context, address string, timeout time.Duration, tlsConfig *tls.Config) (net.Conn, error) {
+				sent <- tlsConfig.NextProtos
+				client, server := net.Pipe()
+				go fakeBroker(tls.Server(server, &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: c.serverProtos}), true)
+				// handshake done when verified
+				return tls.Client(client, tlsConfig), nil
+			}),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if protos := <-sent; !reflect.DeepEqual(protos, c.nextProtos) {
+			t.Error("unexpected ALPN protocols =", protos)
+		}
+
+		select {
+		case err := <-results:
+			var mismatch *ALPNMismatchError
+			if c.err != errors.Is(err, ErrALPNMismatch) || c.err != errors.As(err, &mismatch) {
+				t.Error("unexpected connect result =", err, "server protocols =", c.serverProtos)
+			}
+			if err == nil {
+				if info, ok := client.ConnInfo("fake"); !ok || info.TLS.NegotiatedProtocol != "mqtt" {
+					t.Error("unexpected protocol negotiated, info =", info)
+				}
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("connect result not notified")
+		}
+
+		if !reflect.DeepEqual(config.NextProtos, c.clientProtos) {
+			t.Error("TLS config modified =", config.NextProtos)
+		}
+		client.Destroy(true)
+	}
+
+	if _, err := NewClient(WithALPN("")); err == nil {
+		t.Error("empty ALPN protocol accepted")
+	}
+}
@@ -17,11 +17,18 @@
 package libmqtt
 
 import (
-	"context"
 	"crypto/tls"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"runtime/debug"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
+
+	"github.com/goiiot/libmqtt/internal/clock"
 )
 
 // Client type for *AsyncClient
@@ -38,8 +45,18 @@ func NewClient(options ...Option) (Client, error) {
 		}
 	}
 
-	c.addWorker(c.handleTopicMsg, c.handleMsg)
+	if err := c.options.validate(c.servers, c.secureServers); err != nil {
+		return nil, err
+	}
 
+	if c.imported != nil {
+		if err := c.importSession(c.imported); err != nil {
+			return nil, err
+		}
+		c.imported = nil
+	}
+
+	c.startWorkers()
 	return c, nil
 }
 
@@ -56,46 +73,128 @@ type AsyncClient struct {
 	recvCh           chan *PublishPacket // recv channel for server pub receiving
 	idGen            *idGenerator        // Packet id generator
 	router           TopicRouter         // Topic router
+	routerMu         sync.RWMutex        // guards router replacement
+	customRouter     bool                // router was set by user
+	unmatchedHandler TopicHandleFunc     // handler for packets matched no route
+	subIDRoutes      map[int]*subIDRoute // subscription identifier routes
+	lastSubID        int                 // last assigned subscription identifier
 	persist          PersistMethod       // Persist method
+	persistTTL       time.Duration       // max age of persisted packets, 0 to disable
+	clock            Clock               // time and timers (see WithClock)
 	connectedServers *sync.Map
+	connsMu          sync.Mutex      // guards stores and deletes of connectedServers
 	workers          *sync.WaitGroup // Workers (goroutines)
 	log              *logger         // client logger
 
+	unsubRemovesHandler bool   // remove topic handlers when unsubscribing
+	manualAck           bool   // ack received publish packets with Client.Ack
+	skipTopicValidation bool   // send topics without validation
+	topicPrefix         string // prefix of all topics sent and received
+
+	validatePayloadFormat bool                // validate UTF-8 payloads with payload format indicator
+	payloadFormatPolicy   PayloadFormatPolicy // action when received payload format invalid
+
+	recvOverflow    RecvOverflowPolicy    // action when recvCh is full
+	dropQos0Pub     bool                  // drop QoS0 publishes when sendCh is full
+	pubLimit        rateLimiter           // rate limit of publish packets
+	pubLimitPolicy  RateLimitPolicy       // action when the rate limit exceeded
+	bandwidth       bandwidthBudget       // budget of bytes sent and received
+	bandwidthPolicy BandwidthPolicy       // action when the bandwidth budget exhausted
+	handlerQueues   []chan *PublishPacket // queues of handler workers
+	pubPool         *publishPool          // pool of received publish packets
+
+	streamMu      sync.RWMutex
+	streamNames   map[string]StreamHandleFunc // stream handlers of topic names
+	streamFilters *WildcardRouter             // stream handlers of topic filters
+	streamMatch   func(topic string) bool     // set once a stream handler registered
+
+	qos2Mu   sync.Mutex
+	qos2Recv map[string]*PublishPacket // received QoS2 packets waiting for PubComp sent, by persist key
+	qos2Rel  map[string]struct{}       // keys of qos2Recv released by PubRel
+
+	legacyOnce sync.Once // migrate persisted packets with legacy keys
+
+	sendKeyMu sync.Mutex
+	sendSeq   uint64            // last send sequence
+	sendKeys  map[uint16]string // persist keys of sent packets
+
+	subsMu sync.RWMutex
+	subs   map[subscriptionKey]*subscription // subscriptions acked by servers
+
+	pubTokens pubTokens // tokens of PublishAsync not resolved
+
+	stoppedMu sync.Mutex
+	stopped   map[string]connectOptions // servers refused and not reconnected
+
+	versionsMu sync.Mutex
+	versions   map[string]ProtoVersion // versions accepted by servers
+
+	takeoverMu sync.Mutex
+	shortConns map[string]int // connections closed shortly after connected in a row, by server
+
+	imported *sessionState // session to be restored (WithImportedSession)
+	tracer   Tracer        // traces publishes and received packets (WithTracer)
+
+	preConnMu    sync.Mutex
+	preConnQueue []Packet // packets issued before the first connection
+	preConnSize  int      // size of preConnQueue (WithPreConnectQueue)
+	preConnReady bool     // first connection completed, preConnQueue to be flushed
+	preConnDone  bool     // preConnQueue flushed
+	failFast     bool     // fail when disconnected (WithFailFastWhenDisconnected)
+
+	topicQoS       *topicQoS // QoS of topics (WithTopicQoS)
+	topicQoSStrict bool      // refuse publishes exceeding the topic QoS (WithTopicQoSStrict)
+
+	clientIDMu sync.Mutex
+	clientID   string // client id generated (WithAutoClientID)
+
 	// success/error handlers
 	pubHandler     PubHandleFunc
 	subHandler     SubHandleFunc
 	unsubHandler   UnsubHandleFunc
 	netHandler     NetHandleFunc
 	persistHandler PersistHandleFunc
+	panicHandler   HandlerPanicHandleFunc
+	codecHandler   CodecErrorHandleFunc
+
+	stats  *clientStats // client statistics
+	events chan Event   // client events (see Events)
 
-	ctx     context.Context    // closure of this channel will signal all client worker to stop
-	exit    context.CancelFunc // called when client exit
-	stopSig <-chan struct{}
+	lifeMu sync.Mutex   // guards restart
+	life   atomic.Value // *lifecycle, replaced once restarted
 }
 
 // create a client with default options
 func defaultClient() *AsyncClient {
-	ctx, exitFunc := context.WithCancel(context.Background())
-
-	return &AsyncClient{
+	c := &AsyncClient{
 		servers:       make([]string, 0, 1),
 		secureServers: make([]string, 0, 1),
 
 		options: defaultConnectOptions(),
 		msgCh:   make(chan *message, 10),
 		sendCh:  make(chan Packet, 1),
+		events:  make(chan Event, defaultEventBufSize),
 		recvCh:  make(chan *PublishPacket, 1),
 		router:  NewTextRouter(),
 		idGen:   newIDGenerator(),
 		persist: NonePersist,
 
+		preConnSize: defaultPreConnectQueueSize,
+
 		connectedServers: new(sync.Map),
 		workers:          new(sync.WaitGroup),
-
-		ctx:     ctx,
-		exit:    exitFunc,
-		stopSig: ctx.Done(),
+		stats:            new(clientStats),
+		clock:            clock.Real,
+		subIDRoutes:      make(map[int]*subIDRoute),
+		qos2Recv:         make(map[string]*PublishPacket),
+		qos2Rel:          make(map[string]struct{}),
+		subs:             make(map[subscriptionKey]*subscription),
+		stopped:          make(map[string]connectOptions),
+		shortConns:       make(map[string]int),
+		sendKeys:         make(map[uint16]string),
 	}
+	c.life.Store(newLifecycle())
+	return c
 }
 
 // Handle register subscription message route
@@ -104,9 +203,9 @@ func defaultClient() *AsyncClient {
 func (c *AsyncClient) Handle(topic string, h TopicHandler) {
 	if h != nil {
 		c.log.v("CLI registered topic handler, topic =", topic)
-		c.router.Handle(topic, func(client Client, topic string, qos QosLevel, msg []byte) {
+		c.handleRoute(topic, func(client Client, topic string, qos QosLevel, msg []byte) {
 			h(topic, qos, msg)
-		})
+		}, nil)
 	}
 }
 
@@ -114,8 +213,330 @@ func (c *AsyncClient) Handle(topic string, h TopicHandler) {
 func (c *AsyncClient) HandleTopic(topic string, h TopicHandleFunc) {
 	if h != nil {
 		c.log.v("CLI registered topic handler, topic =", topic)
+		c.handleRoute(topic, h, nil)
+	}
+}
+
+// HandleTopicRetain add a topic routing rule with the handler receiving
+// the retain flag of messages (e.g. to tell stale values from new ones)
+//
+// the router of the client MUST be a PublishRouter
+func (c *AsyncClient) HandleTopicRetain(topic string, h TopicRetainHandleFunc) {
+	if h != nil {
+		c.log.v("CLI registered topic retain handler, topic =", topic)
+		c.handleRoute(topic, nil, func(client Client, p *PublishPacket) {
+			h(client, p.TopicName, p.Qos, p.Payload, p.IsRetain)
+			client.Ack(p)
+		})
+	}
+}
+
+// HandleEx add a topic routing rule with the handler receiving the metadata
+// of messages (see PublishMeta), passed by value without allocation
+//
+// the router of the client MUST be a PublishRouter
+func (c *AsyncClient) HandleEx(topic string, h TopicExHandleFunc) {
+	if h != nil {
+		c.log.v("CLI registered topic ex handler, topic =", topic)
+		c.handleRoute(topic, nil, func(client Client, p *PublishPacket) {
+			h(client, p.TopicName, p.Qos, p.Payload, p.Meta())
+			client.Ack(p)
+		})
+	}
+}
+
+// HandlePublish add a topic routing rule with the handler receiving
+// the full publish packet (e.g. to access MQTT 5 properties)
+//
+// the router of the client MUST be a PublishRouter
+func (c *AsyncClient) HandlePublish(topic string, h PublishHandleFunc) {
+	if h != nil {
+		c.log.v("CLI registered publish handler, topic =", topic)
+		c.handleRoute(topic, nil, h)
+	}
+}
+
+// handleRoute registers the topic handler (h) or publish handler (ph)
+// to the client router, the default TextRouter is replaced with a
+// WildcardRouter (with all registered handlers) once the topic is a
+// filter with wildcards
+func (c *AsyncClient) handleRoute(topic string, h TopicHandleFunc, ph PublishHandleFunc) {
+	c.routerMu.Lock()
+	defer c.routerMu.Unlock()
+
+	if textRouter, ok := c.router.(*TextRouter); ok && !c.customRouter && isWildcardTopic(topic) {
+		c.log.d("CLI switch to WildcardRouter for topic =", topic)
+		wildcardRouter := NewWildcardRouter()
+		textRouter.m.Range(func(key, value interface{}) bool {
+			wildcardRouter.HandlePublish(key.(string), value.(PublishHandleFunc))
+			return true
+		})
+		c.router = wildcardRouter
+	}
+
+	if ph == nil {
 		c.router.Handle(topic, h)
+		return
+	}
+
+	if r, ok := c.router.(PublishRouter); ok {
+		r.HandlePublish(topic, ph)
+	} else {
+		c.log.e("CLI router doesn't support publish handler, router =", c.router.Name())
+	}
+}
+
+// dispatch the publish packet to the router, packets matched no
+// route are counted and sent to the unmatched handler if any
+func (c *AsyncClient) dispatch(pkt *PublishPacket) {
+	c.routerMu.RLock()
+	router, unmatchedHandler := c.router, c.unmatchedHandler
+	subIDHandlers := c.subIDHandlers(pkt)
+	c.routerMu.RUnlock()
+
+	if len(subIDHandlers) > 0 {
+		// subscription identifier takes precedence over topic matching
+		for _, h := range subIDHandlers {
+			h(c, pkt.TopicName, pkt.Qos, pkt.Payload)
+		}
+		c.Ack(pkt)
+		return
+	}
+
+	matcher, ok := router.(MatchRouter)
+	if !ok {
+		// not known if matched, custom routers handle unmatched packets
+		router.Dispatch(c, pkt)
+		return
 	}
+	if matcher.DispatchMatched(c, pkt) {
+		return
+	}
+
+	atomic.AddUint64(&c.stats.unmatchedMsgs, 1)
+	c.log.d("CLI no route matched, topic =", pkt.TopicName)
+	if unmatchedHandler != nil {
+		unmatchedHandler(c, pkt.TopicName, pkt.Qos, pkt.Payload)
+	}
+	c.Ack(pkt)
+}
+
+// subIDRoute is the handler bound to a subscription identifier
+type subIDRoute struct {
+	handler TopicHandleFunc
+	topics  map[string]struct{} // topics still subscribed
+}
+
+// subIDHandlers returns handlers bound to the subscription identifiers
+// of the publish packet (one for each subscription matched), handlers of
+// identifiers included more than once are returned once, caller MUST hold
+// the routerMu
+func (c *AsyncClient) subIDHandlers(pkt *PublishPacket) []TopicHandleFunc {
+	if pkt.Props == nil || len(pkt.Props.SubIDs) == 0 {
+		return nil
+	}
+
+	var handlers []TopicHandleFunc
+	for i, id := range pkt.Props.SubIDs {
+		if containsSubID(pkt.Props.SubIDs[:i], id) {
+			continue
+		}
+
+		if route, ok := c.subIDRoutes[id]; ok {
+			handlers = append(handlers, route.handler)
+		}
+	}
+	return handlers
+}
+
+func containsSubID(ids []int, id int) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+// removeSubIDRoutes removes unsubscribed topics from subscription identifier
+// routes, routes with no topic subscribed are deleted
+func (c *AsyncClient) removeSubIDRoutes(topics []string) {
+	c.routerMu.Lock()
+	defer c.routerMu.Unlock()
+
+	for id, route := range c.subIDRoutes {
+		for _, t := range topics {
+			delete(route.topics, t)
+		}
+
+		if len(route.topics) == 0 {
+			delete(c.subIDRoutes, id)
+		}
+	}
+}
+
+// subscriptionKey identifies the subscription of the topic in the server
+type subscriptionKey struct {
+	server string
+	topic  string
+}
+
+// subscription is the topic subscribed and acked by the server
+type subscription struct {
+	server  string
+	topic   string
+	qos     QosLevel // granted QoS
+	subID   int      // subscription identifier, 0 if not assigned
+	options byte     // requested QoS and MQTT 5 subscription options
+}
+
+// addSubscriptions records the topics acked by the server, options are
+// the requested subscription options of topics, topics with failure codes
+// are ignored
+func (c *AsyncClient) addSubscriptions(server string, topics []*Topic, options, codes []byte, subID int) {
+	c.subsMu.Lock()
+	defer c.subsMu.Unlock()
+
+	for i, t := range topics {
+		if i >= len(codes) || codes[i] >= SubFail {
+			continue
+		}
+
+		opts := codes[i]
+		if i < len(options) {
+			opts = options[i]
+		}
+
+		c.subs[subscriptionKey{server: server, topic: t.Name}] = &subscription{
+			server:  server,
+			topic:   t.Name,
+			qos:     codes[i],
+			subID:   subID,
+			options: opts,
+		}
+	}
+}
+
+// removeSubscriptions removes the topics unsubscribed from the server
+func (c *AsyncClient) removeSubscriptions(server string, topics []string) {
+	c.subsMu.Lock()
+	defer c.subsMu.Unlock()
+
+	for _, t := range topics {
+		delete(c.subs, subscriptionKey{server: server, topic: t})
+	}
+}
+
+// resetSubscriptions removes all subscriptions of the server, as the
+// server has no session state, returns the subscriptions removed
+func (c *AsyncClient) resetSubscriptions(server string) []*subscription {
+	c.subsMu.Lock()
+	defer c.subsMu.Unlock()
+
+	var removed []*subscription
+	for k, s := range c.subs {
+		if k.server == server {
+			removed = append(removed, s)
+			delete(c.subs, k)
+		}
+	}
+	return removed
+}
+
+func (c *AsyncClient) getRouter() TopicRouter {
+	c.routerMu.RLock()
+	defer c.routerMu.RUnlock()
+
+	return c.router
+}
+
+// HandleUnmatched register the handler for all publish packets
+// which matched no topic routing rule
+func (c *AsyncClient) HandleUnmatched(h TopicHandleFunc) {
+	c.log.v("CLI registered unmatched topic handler")
+
+	c.routerMu.Lock()
+	c.unmatchedHandler = h
+	c.routerMu.Unlock()
+}
+
+// HandleStream add a topic routing rule with the handler reading payload
+// streamed from the connection instead of buffering it in memory, useful
+// for large payloads, topic can be a topic filter with wildcards
+//
+// the handler is called in the network receiving goroutine, no more packet
+// from the server can be received until it returned, the ack of QoS1/QoS2
+// packets is sent after the handler returned nil, if an error returned,
+// no ack will be sent with MQTT 3.1.1 (the server redelivers the packet
+// only once reconnected with a persistent session), and PubAck/PubRec
+// with reason code will be sent with MQTT 5 (CodeUnspecifiedError, or the value of the
+// ReasonCode() byte method of the error if implemented)
+//
+// stream handlers take precedence over other topic handlers
+func (c *AsyncClient) HandleStream(topic string, h StreamHandleFunc) {
+	if h == nil {
+		return
+	}
+
+	c.log.v("CLI registered stream handler, topic =", topic)
+
+	c.streamMu.Lock()
+	defer c.streamMu.Unlock()
+
+	if c.streamMatch == nil {
+		c.streamNames = make(map[string]StreamHandleFunc)
+		c.streamFilters = NewWildcardRouter()
+		c.streamMatch = func(topic string) bool { return c.streamHandler(topic) != nil }
+	}
+
+	if isWildcardTopic(topic) {
+		c.streamFilters.handleStream(topic, h)
+	} else {
+		c.streamNames[topic] = h
+	}
+}
+
+// streamHandler returns the stream handler of the topic, handlers of topic
+// names take precedence over topic filters, nil if not found
+func (c *AsyncClient) streamHandler(topic string) StreamHandleFunc {
+	c.streamMu.RLock()
+	defer c.streamMu.RUnlock()
+
+	if h, ok := c.streamNames[topic]; ok {
+		return h
+	}
+	return c.streamFilters.streamHandler(topic)
+}
+
+// streamMatcher returns the function to check stream topics for decoding,
+// nil if no stream handler registered
+func (c *AsyncClient) streamMatcher() func(topic string) bool {
+	c.streamMu.RLock()
+	defer c.streamMu.RUnlock()
+
+	return c.streamMatch
+}
+
+// handleStream calls the stream handler of the streamed publish packet
+func (c *AsyncClient) handleStream(p *PublishPacket) (err error) {
+	h := c.streamHandler(p.TopicName)
+	if h == nil {
+		return nil
+	}
+
+	defer func() {
+		if v := recover(); v != nil {
+			c.handlePanic(p.TopicName, v)
+			err = fmt.Errorf("stream handler panic: %v", v)
+		}
+	}()
+	return h(c, p.TopicName, p.Qos, p.PayloadReader)
+}
+
+// RemoveTopic removes all handlers of the topic routing rule
+func (c *AsyncClient) RemoveTopic(topic string) {
+	c.log.v("CLI removed topic handler, topic =", topic)
+	c.getRouter().Remove(topic)
 }
 
 // Connect to all designated servers
@@ -128,6 +549,12 @@ func (c *AsyncClient) Connect(h ConnHandler) {
 		h(server, code, err)
 	}
 
+	c.restart()
+	if len(c.servers) == 0 && len(c.secureServers) == 0 {
+		c.addWorker(func() { h("", math.MaxUint8, ErrNoServers) })
+		return
+	}
+
 	for _, s := range c.servers {
 		options := c.options.clone()
 		options.connHandler = connHandler
@@ -148,50 +575,558 @@ func (c *AsyncClient) Connect(h ConnHandler) {
 
 // Publish message(s) to topic(s), one to one
 func (c *AsyncClient) Publish(msg ...*PublishPacket) {
-	if c.isClosing() {
-		return
-	}
-
 	for _, m := range msg {
+		if c.isClosing() {
+			return
+		}
+
 		if m == nil {
 			continue
 		}
 
-		p := m
-		if p.Qos > Qos2 {
-			p.Qos = Qos2
+		if err := c.publish(m); err != nil && err != ErrClientDestroyed {
+			notifyPubMsg(c.msgCh, m.TopicName, err)
 		}
+	}
+}
 
-		if p.Qos != Qos0 {
-			if p.PacketID == 0 {
-				p.PacketID = c.idGen.next(p)
-				if err := c.persist.Store(sendKey(p.PacketID), p); err != nil {
-					notifyPersistMsg(c.msgCh, p, err)
-				}
+// publish the message, returns the error of validation, rate limit or
+// the full send buffer
+func (c *AsyncClient) publish(m *PublishPacket) error {
+	if !c.skipTopicValidation {
+		if err := ValidateTopicName(c.prefixTopic(m.TopicName)); err != nil {
+			c.log.e("CLI publish to invalid topic =", m.TopicName, "err =", err)
+			return err
+		}
+	}
+
+	if c.validatePayloadFormat && !validPayloadFormat(m) {
+		c.log.e("CLI publish with invalid payload format, topic =", m.TopicName)
+		return ErrInvalidPayloadFormat
+	}
+
+	if ok, err := c.waitPublishRate(); !ok {
+		if err != nil {
+			c.log.d("CLI publish rate limited, topic =", m.TopicName)
+		}
+		return err
+	}
+
+	// the packet is queued, persisted and resent by the client, use a
+	// copy so the caller can reuse or modify the packet
+	p := m.Clone().(*PublishPacket)
+	p.token = m.token
+
+	if p.Qos > Qos2 {
+		p.Qos = Qos2
+	}
+
+	if err := c.applyTopicQoS(p); err != nil {
+		return err
+	}
+
+	if p.Qos != Qos0 {
+		if p.PacketID == 0 {
+			p.PacketID = c.idGen.next(p)
+			if !p.replayable() && c.persist != NonePersist {
+				// packet is sent without persist
+				notifyPersistMsg(c.msgCh, p, ErrPayloadNotReplayable)
 			}
 		}
+		p.token.setPacketID(p.PacketID)
+	}
 
+	if p.Qos == Qos0 && c.bandwidthExceeded() {
+		c.log.d("CLI bandwidth budget exhausted, dropped QoS0 publish, topic =", p.TopicName)
+		return ErrBandwidthExceeded
+	}
+
+	c.tracePublish(p)
+	c.storeQueued(p)
+	if queued, err := c.queuePreConnect(p); queued || err != nil {
+		if err != nil {
+			c.log.e("CLI publish not queued, topic =", p.TopicName, "err =", err)
+			c.dropPublish(queueNamespace(c.options.connPacket.ClientID), p)
+			if p.Qos > Qos0 {
+				c.idGen.reclaim(p.PacketID)
+			}
+			p.finish(err)
+		}
+		return err
+	}
+
+	if p.Qos == Qos0 && c.dropQos0Pub {
 		select {
-		case <-c.stopSig:
-			return
 		case c.sendCh <- p:
+		default:
+			atomic.AddUint64(&c.stats.droppedPubs, 1)
+			c.log.w("CLI send buffer full, dropped QoS0 publish, topic =", p.TopicName)
+			p.finish(ErrSendBufFull)
+			return ErrSendBufFull
 		}
+		return nil
 	}
+
+	select {
+	case <-c.done():
+		c.dropPublish(queueNamespace(c.options.connPacket.ClientID), p)
+		if p.Qos > Qos0 {
+			c.idGen.reclaim(p.PacketID)
+		}
+		p.finish(ErrClientDestroyed)
+		return ErrClientDestroyed
+	case c.sendCh <- p:
+	}
+	return nil
+}
+
+// Ack the received publish packet, only required for packets delivered to
+// publish handlers (registered with HandlePublish) when the client was
+// created with WithManualAck(true), it's safe to call Ack multiple times
+func (c *AsyncClient) Ack(p *PublishPacket) {
+	c.AckWithReason(p, CodeSuccess, "")
+}
+
+// AckWithReason acks the received publish packet the same way as Ack, with
+// the MQTT 5 reason code and optional reason string of the PubAck, to tell
+// the server the message can not be processed (e.g.
+// CodeImplementationSpecificError, CodePayloadFormatInvalid)
+//
+// only the first ack of the packet takes effect, the reason code is only
+// sent for QoS1 packets with MQTT 5, for QoS2 packets (PubRec was sent once
+// received) and MQTT 3.1.1, a plain ack is sent and the reason is logged
+func (c *AsyncClient) AckWithReason(p *PublishPacket, code byte, reason string) {
+	if p == nil || p.ackConn == nil {
+		return
+	}
+
+	p.ackConn.ack(p, code, reason)
+}
+
+// storeQos2 stores the received QoS2 publish packet in the persist
+// namespace until PubComp sent, return false if a packet with the same id
+// is already stored (duplicate)
+func (c *AsyncClient) storeQos2(ns string, p *PublishPacket) bool {
+	stored, _ := c.storeQos2Max(ns, p, 0)
+	return stored
+}
+
+// storeQos2Max stores the received QoS2 publish packet as storeQos2 unless
+// max packets (0 for no limit) of the persist namespace stored already,
+// returns true if exceeded (not stored), duplicates are not counted
+func (c *AsyncClient) storeQos2Max(ns string, p *PublishPacket, max int) (stored, exceeded bool) {
+	key := recvKey(ns, p.PacketID)
+
+	c.qos2Mu.Lock()
+	if _, ok := c.qos2Recv[key]; ok {
+		c.qos2Mu.Unlock()
+		return false, false
+	}
+
+	if _, ok := c.persist.Load(key); ok {
+		// stored before client restart
+		c.qos2Mu.Unlock()
+		return false, false
+	}
+
+	if max > 0 && c.qos2Count(ns) >= max {
+		c.qos2Mu.Unlock()
+		return false, true
+	}
+
+	c.qos2Recv[key] = p
+	err := c.persist.Store(key, p)
+	c.qos2Mu.Unlock()
+
+	notifyPersistMsg(c.msgCh, p, err)
+	return true, false
+}
+
+// qos2Count returns the number of received QoS2 publish packets of the
+// persist namespace not completed, qos2Mu MUST be held
+func (c *AsyncClient) qos2Count(ns string) int {
+	prefix, n := ns+recvKeyDir, 0
+	for k := range c.qos2Recv {
+		if strings.HasPrefix(k, prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+// releaseQos2 marks the stored QoS2 publish packet released by PubRel, the
+// packet is kept until PubComp sent (see completeQos2), returns false if
+// no packet stored (already completed) or already released (PubComp not
+// sent yet, e.g. in manual ack mode)
+func (c *AsyncClient) releaseQos2(ns string, id uint16) (p *PublishPacket, stored, released bool) {
+	key := recvKey(ns, id)
+
+	c.qos2Mu.Lock()
+	defer c.qos2Mu.Unlock()
+
+	p, stored = c.qos2Recv[key]
+	if !stored {
+		pkt, _ := c.persist.Load(key)
+		if p, stored = pkt.(*PublishPacket); !stored {
+			return nil, false, false
+		}
+		// stored before client restart
+		c.qos2Recv[key] = p
+	}
+
+	if _, ok := c.qos2Rel[key]; ok {
+		return p, true, false
+	}
+	c.qos2Rel[key] = struct{}{}
+	return p, true, true
+}
+
+// completeQos2 deletes the stored QoS2 publish packet once PubComp sent
+func (c *AsyncClient) completeQos2(ns string, id uint16) {
+	key := recvKey(ns, id)
+
+	c.qos2Mu.Lock()
+	p, ok := c.qos2Recv[key]
+	delete(c.qos2Recv, key)
+	delete(c.qos2Rel, key)
+
+	var err error
+	if _, stored := c.persist.Load(key); stored {
+		ok, err = true, c.persist.Delete(key)
+	}
+	c.qos2Mu.Unlock()
+
+	if ok {
+		notifyPersistMsg(c.msgCh, p, err)
+	}
+}
+
+// resetQos2 drops all stored QoS2 publish packets in the persist namespace,
+// called when the server has no session state of the client
+func (c *AsyncClient) resetQos2(ns string) {
+	c.qos2Mu.Lock()
+	defer c.qos2Mu.Unlock()
+
+	prefix := ns + recvKeyDir
+	for k := range c.qos2Recv {
+		if strings.HasPrefix(k, prefix) {
+			delete(c.qos2Recv, k)
+			delete(c.qos2Rel, k)
+		}
+	}
+
+	persist := AsBatchPersist(c.persist)
+
+	var keys []string
+	persist.RangePrefix(prefix, func(key string, p Packet) bool {
+		keys = append(keys, key)
+		return true
+	})
+
+	if len(keys) > 0 {
+		notifyPersistMsg(c.msgCh, nil, persist.DeleteBatch(keys))
+	}
+}
+
+// migrateLegacyKeys moves packets persisted with keys of versions without
+// namespace into the persist namespace, only done for the first connection
+// since legacy keys are not bound to any server
+func (c *AsyncClient) migrateLegacyKeys(ns string) {
+	c.legacyOnce.Do(func() {
+		persist := AsBatchPersist(c.persist)
+
+		var keys []string
+		packets := make(map[string]Packet)
+		for _, prefix := range []string{legacyRecvKeyPrefix, legacySendKeyPrefix} {
+			persist.RangePrefix(prefix, func(key string, p Packet) bool {
+				if k, ok := namespacedKey(ns, key); ok {
+					keys = append(keys, key)
+					packets[k] = p
+				}
+				return true
+			})
+		}
+
+		if len(keys) == 0 {
+			return
+		}
+
+		c.log.i("CLI migrate persisted packets to namespace =", ns, "count =", len(keys))
+		if err := persist.StoreBatch(packets); err != nil {
+			// keep legacy entries for next migration
+			notifyPersistMsg(c.msgCh, nil, err)
+			return
+		}
+		notifyPersistMsg(c.msgCh, nil, persist.DeleteBatch(keys))
+	})
+}
+
+// nextSeq returns the next send sequence, sequences are based on the system
+// time, so sequences of this process are after those of previous processes
+// unless the clock went back, which is also covered by loadSent
+func (c *AsyncClient) nextSeq() uint64 {
+	seq := uint64(time.Now().UnixNano())
+	if !seqBefore(c.sendSeq, seq) {
+		seq = c.sendSeq + 1
+	}
+	c.sendSeq = seq
+	return seq
+}
+
+// storeSent persists the sent packet in the persist namespace with the send
+// sequence, packets of the same packet id (e.g. PubRel replacing publish)
+// keep the sequence, packets queued are moved from the queue namespace
+func (c *AsyncClient) storeSent(ns string, id uint16, p Packet) error {
+	var queued string
+	c.sendKeyMu.Lock()
+	key, ok := c.sendKeys[id]
+	if !ok || !strings.HasPrefix(key, ns) {
+		seq, sequenced := keySeq(key)
+		if _, server, _, _, isKey := parseKey(key); ok && isKey && server == "" && sequenced {
+			queued = key
+		} else {
+			seq = c.nextSeq()
+		}
+		key = sequencedSendKey(ns, id, seq)
+		c.sendKeys[id] = key
+	}
+	c.sendKeyMu.Unlock()
+
+	if err := c.persist.Store(key, p); err != nil || queued == "" {
+		return err
+	}
+	return c.persist.Delete(queued)
+}
+
+// storeQueued persists the publish packet queued (in the send buffer or the
+// pre-connect queue) in the queue namespace, so it's still sent after the
+// client crashed before the packet sent to any server
+func (c *AsyncClient) storeQueued(p *PublishPacket) {
+	if p.Qos > Qos0 && p.replayable() {
+		ns := queueNamespace(c.options.connPacket.ClientID)
+		notifyPersistMsg(c.msgCh, p, c.storeSent(ns, p.PacketID, p))
+	}
+}
+
+// dropPublish deletes the persisted publish packet never sent (e.g.
+// rejected or downgraded to QoS0)
+func (c *AsyncClient) dropPublish(ns string, p *PublishPacket) {
+	if p.Qos > Qos0 && p.replayable() {
+		notifyPersistMsg(c.msgCh, p, c.deleteSent(ns, p.PacketID))
+	}
+}
+
+// deleteSent deletes the persisted sent packet of the packet id
+func (c *AsyncClient) deleteSent(ns string, id uint16) error {
+	c.sendKeyMu.Lock()
+	key, ok := c.sendKeys[id]
+	delete(c.sendKeys, id)
+	c.sendKeyMu.Unlock()
+
+	if !ok {
+		// not loaded, persisted without sequence (e.g. migrated legacy key)
+		key = sendKey(ns, id)
+	}
+	return c.persist.Delete(key)
+}
+
+// sentEntry is the sent packet loaded from persist
+type sentEntry struct {
+	key       string
+	id        uint16
+	seq       uint64
+	sequenced bool
+	queued    bool // queued but never sent
+	pkt       Packet
+}
+
+// before reports whether the packet was sent before the other, packets
+// without sequence are the oldest
+func (e *sentEntry) before(o *sentEntry) bool {
+	if e.sequenced != o.sequenced {
+		return !e.sequenced
+	}
+
+	if !e.sequenced {
+		return e.id < o.id
+	}
+	return seqBefore(e.seq, o.seq)
+}
+
+// loadSent loads the packets sent in the persist namespace in send order,
+// packets sent by previous processes included, the packet ids are reserved
+// until acked, stale packets of reused packet ids are deleted, and the send
+// sequence continues after the loaded packets
+//
+// packets queued by previous processes but never sent are moved from the
+// queue namespace to the persist namespace and loaded as sent
+func (c *AsyncClient) loadSent(ns string) []*sentEntry {
+	latest := make(map[uint16]*sentEntry)
+	var stale []string
+
+	persist := AsBatchPersist(c.persist)
+	loadNamespace := func(prefix string) {
+		persist.RangePrefix(prefix+sendKeyDir, func(key string, p Packet) bool {
+			_, _, send, id, ok := parseKey(key)
+			if !ok || !send {
+				return true
+			}
+
+			e := &sentEntry{key: key, id: id, pkt: p}
+			e.seq, e.sequenced = keySeq(key)
+			if prev, ok := latest[id]; ok {
+				if e.before(prev) {
+					stale = append(stale, key)
+					return true
+				}
+				stale = append(stale, prev.key)
+			}
+			latest[id] = e
+			return true
+		})
+	}
+	queueNS := queueNamespace(namespaceClientID(ns))
+	loadNamespace(ns)
+	loadNamespace(queueNS)
+
+	entries := make([]*sentEntry, 0, len(latest))
+	moved := make(map[string]Packet)
+	var queued []string
+	c.sendKeyMu.Lock()
+	for id, e := range latest {
+		if key, ok := c.sendKeys[id]; ok && key != e.key {
+			// packet id reused by this process
+			stale = append(stale, e.key)
+			continue
+		} else if ok && strings.HasPrefix(key, queueNS) {
+			// queued by this process, moved once sent
+			continue
+		}
+
+		if strings.HasPrefix(e.key, queueNS) {
+			queued = append(queued, e.key)
+			e.key, e.queued = sequencedSendKey(ns, id, e.seq), true
+			moved[e.key] = e.pkt
+		}
+
+		if e.sequenced && seqBefore(c.sendSeq, e.seq) {
+			c.sendSeq = e.seq
+		}
+		c.sendKeys[id] = e.key
+		entries = append(entries, e)
+
+		// packet ids reserved until acked
+		if _, isRel := e.pkt.(*PubRelPacket); isRel {
+			c.idGen.reserve(id, &PublishPacket{Qos: Qos2, PacketID: id})
+		} else {
+			c.idGen.reserve(id, e.pkt)
+		}
+	}
+	c.sendKeyMu.Unlock()
+
+	if len(moved) > 0 {
+		// queued packets deleted once moved
+		err := persist.StoreBatch(moved)
+		notifyPersistMsg(c.msgCh, nil, err)
+		if err == nil {
+			stale = append(stale, queued...)
+		}
+	}
+
+	if len(stale) > 0 {
+		notifyPersistMsg(c.msgCh, nil, persist.DeleteBatch(stale))
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].before(entries[j]) })
+	return entries
 }
 
 // Subscribe topic(s)
+//
+// topics are sent in one SubscribePacket, split into packets not exceeding
+// the Maximum Packet Size of the server if too large, the SubHandleFunc is
+// called once with all topics in the order requested and their granted QoS
+// (SubFail if failed)
 func (c *AsyncClient) Subscribe(topics ...*Topic) {
+	if !c.validSubscribe(topics) {
+		return
+	}
+
+	c.subscribe(&SubscribePacket{Topics: topics})
+}
+
+// SubscribeHandle subscribe topic(s) and bind the handler to the subscription
+//
+// the handler is registered as the topic handler of the topic(s), and
+// when connected with MQTT 5, a subscription identifier is assigned to the
+// subscription, publish packets carrying the identifier will be dispatched
+// to the handler directly instead of topic matching
+func (c *AsyncClient) SubscribeHandle(h TopicHandleFunc, topics ...*Topic) {
+	if c.isClosing() || h == nil || !c.validSubscribe(topics) {
+		return
+	}
+
+	route := &subIDRoute{handler: h, topics: make(map[string]struct{})}
+	for _, t := range topics {
+		c.HandleTopic(t.Name, h)
+		route.topics[t.Name] = struct{}{}
+	}
+
+	c.routerMu.Lock()
+	// find next unused subscription identifier
+	subID := c.lastSubID
+	for i := 0; i < maxSubID; i++ {
+		subID = subID%maxSubID + 1
+		if _, used := c.subIDRoutes[subID]; !used {
+			break
+		}
+	}
+	c.lastSubID = subID
+	c.subIDRoutes[subID] = route
+	c.routerMu.Unlock()
+
+	c.subscribe(&SubscribePacket{Topics: topics, Props: &SubscribeProps{SubID: subID}})
+}
+
+// validSubscribe validates topic filters to subscribe, invalid topics are
+// notified to the SubHandleFunc
+func (c *AsyncClient) validSubscribe(topics []*Topic) bool {
+	filters := make([]string, len(topics))
+	for i, t := range topics {
+		filters[i] = t.Name
+	}
+
+	if err := c.validateTopicFilters(filters...); err != nil {
+		c.log.e("CLI subscribe invalid topics =", filters, "err =", err)
+		notifySubMsg(c.msgCh, topics, err)
+		return false
+	}
+	return true
+}
+
+func (c *AsyncClient) subscribe(s *SubscribePacket) {
 	if c.isClosing() {
 		return
 	}
 
-	c.log.d("CLI subscribe, topic(s) =", topics)
+	c.log.d("CLI subscribe, topic(s) =", s.Topics)
 
-	s := &SubscribePacket{Topics: topics}
+	// topics are updated with the granted QoS on SubAck, copy them so the
+	// caller's topics are not modified
+	s = s.Clone().(*SubscribePacket)
 	s.PacketID = c.idGen.next(s)
 
+	if queued, err := c.queuePreConnect(s); queued || err != nil {
+		if err != nil {
+			c.log.e("CLI subscribe not queued, topic(s) =", s.Topics, "err =", err)
+			c.idGen.reclaim(s.PacketID)
+			notifySubMsg(c.msgCh, s.Topics, err)
+		}
+		return
+	}
+
 	select {
-	case <-c.stopSig:
+	case <-c.done():
 		return
 	case c.sendCh <- s:
 		return
@@ -212,11 +1147,33 @@ func (c *AsyncClient) Unsubscribe(topics ...string) {
 
 	c.log.d("CLI unsubscribe topic(s) =", topics)
 
-	u := &UnsubPacket{TopicNames: topics}
+	if err := c.validateTopicFilters(topics...); err != nil {
+		c.log.e("CLI unsubscribe invalid topics =", topics, "err =", err)
+		notifyUnSubMsg(c.msgCh, topics, err)
+		return
+	}
+
+	if c.unsubRemovesHandler {
+		for _, t := range topics {
+			c.RemoveTopic(t)
+		}
+	}
+	c.removeSubIDRoutes(topics)
+
+	u := &UnsubPacket{TopicNames: append([]string(nil), topics...)}
 	u.PacketID = c.idGen.next(u)
 
+	if queued, err := c.queuePreConnect(u); queued || err != nil {
+		if err != nil {
+			c.log.e("CLI unsubscribe not queued, topic(s) =", topics, "err =", err)
+			c.idGen.reclaim(u.PacketID)
+			notifyUnSubMsg(c.msgCh, topics, err)
+		}
+		return
+	}
+
 	select {
-	case <-c.stopSig:
+	case <-c.done():
 		return
 	case c.sendCh <- u:
 	}
@@ -234,6 +1191,9 @@ func (c *AsyncClient) Wait() {
 
 // Destroy will disconnect form all server
 // If force is true, then close connection without sending a DisconnPacket
+//
+// the client can connect again once destroyed (e.g. ConnectServer), with
+// handlers and options retained
 func (c *AsyncClient) Destroy(force bool) {
 	c.log.d("CLI destroying client with force =", force)
 	if force {
@@ -246,6 +1206,8 @@ func (c *AsyncClient) Destroy(force bool) {
 
 		c.exit()
 	}
+
+	c.pubTokens.resolveAll(ErrClientDestroyed)
 }
 
 // Disconnect from one server
@@ -263,7 +1225,7 @@ func (c *AsyncClient) Disconnect(server string, packet *DisconnPacket) bool {
 		select {
 		case <-conn.stopSig:
 			// wait for conn to exit
-		case <-c.stopSig:
+		case <-c.done():
 			return false
 		}
 
@@ -273,15 +1235,46 @@ func (c *AsyncClient) Disconnect(server string, packet *DisconnPacket) bool {
 	return false
 }
 
-func (c *AsyncClient) addWorker(workerFunc ...func()) {
-	if c.isClosing() {
+// dropRecv drops the received publish packet due to recv buffer overflow
+func (c *AsyncClient) dropRecv(pkt *PublishPacket) {
+	atomic.AddUint64(&c.stats.droppedMsgs, 1)
+	c.log.w("CLI recv buffer full, dropped packet, topic =", pkt.TopicName, "QoS =", pkt.Qos)
+	c.Ack(pkt)
+	pkt.release()
+}
+
+// recoverHandler recovers the panic happened in topic handlers, the packet
+// is acked (in manual ack mode) to not block acks of following packets
+func (c *AsyncClient) recoverHandler(pkt *PublishPacket) {
+	v := recover()
+	if v == nil {
 		return
 	}
 
+	c.handlePanic(pkt.TopicName, v)
+	c.Ack(pkt)
+}
+
+func (c *AsyncClient) handlePanic(topic string, v interface{}) {
+	stack := debug.Stack()
+	if c.panicHandler != nil {
+		c.panicHandler(c, topic, v, stack)
+	} else {
+		c.log.e("CLI topic handler panic, topic =", topic, "panic =", v, "\n", string(stack))
+	}
+}
+
+func (c *AsyncClient) addWorker(workerFunc ...func()) {
+	life := c.lifecycle()
 	for _, f := range workerFunc {
+		if !life.add() {
+			return
+		}
+
 		c.workers.Add(1)
 		go func(f func()) {
 			defer c.workers.Done()
+			defer life.workers.Done()
 			f()
 		}(f)
 	}
@@ -289,24 +1282,157 @@ func (c *AsyncClient) addWorker(workerFunc ...func()) {
 
 func (c *AsyncClient) isClosing() bool {
 	select {
-	case <-c.stopSig:
+	case <-c.done():
 		return true
 	default:
 		return false
 	}
 }
 
+// purgePersist deletes expired packets from persist periodically
+func (c *AsyncClient) purgePersist() {
+	interval := c.persistTTL / 2
+	if interval > time.Minute {
+		interval = time.Minute
+	} else if interval < time.Millisecond {
+		interval = time.Millisecond
+	}
+
+	stop := c.done()
+	t := c.clock.NewTicker(interval)
+	defer t.Stop()
+
+	// first seen time of packets in persist methods without timestamps
+	seen := make(map[string]time.Time)
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C():
+			if n := c.purgeExpired(c.clock.Now(), seen); n > 0 {
+				c.log.i("CLI purged expired persisted packets, count =", n)
+				c.sendEvent(&PersistPurgedEvent{Count: n})
+			}
+		}
+	}
+}
+
+// purgeExpired deletes packets older than the persist ttl (or the message
+// expiry interval of MQTT 5 publish packets if shorter)
+func (c *AsyncClient) purgeExpired(now time.Time, seen map[string]time.Time) int {
+	ts, timestamped := c.persist.(TimestampedPersist)
+
+	var expired []string
+	present := make(map[string]struct{})
+	c.persist.Range(func(key string, p Packet) bool {
+		var (
+			at time.Time
+			ok bool
+		)
+		if timestamped {
+			at, ok = ts.StoredAt(key)
+		}
+
+		if !ok {
+			present[key] = struct{}{}
+			if at, ok = seen[key]; !ok {
+				at = now
+				seen[key] = now
+			}
+		}
+
+		if now.Sub(at) >= persistTTL(c.persistTTL, p) {
+			expired = append(expired, key)
+		}
+		return true
+	})
+
+	for k := range seen {
+		if _, ok := present[k]; !ok {
+			delete(seen, k)
+		}
+	}
+
+	if len(expired) == 0 {
+		return 0
+	}
+
+	for _, k := range expired {
+		delete(seen, k)
+	}
+
+	if err := AsBatchPersist(c.persist).DeleteBatch(expired); err != nil {
+		notifyPersistMsg(c.msgCh, nil, err)
+		return 0
+	}
+	return len(expired)
+}
+
+// persistTTL returns the ttl of the persisted packet, the message expiry
+// interval of MQTT 5 publish packet is applied if shorter
+func persistTTL(ttl time.Duration, p Packet) time.Duration {
+	if pub, ok := p.(*PublishPacket); ok && pub.Props != nil && pub.Props.MessageExpiryInterval > 0 {
+		if expiry := time.Duration(pub.Props.MessageExpiryInterval) * time.Second; expiry < ttl {
+			return expiry
+		}
+	}
+	return ttl
+}
+
 func (c *AsyncClient) handleTopicMsg() {
+	stop := c.done()
+	for _, q := range c.handlerQueues {
+		queue := q
+		c.addWorker(func() { c.handleQueue(queue, stop) })
+	}
+
 	for {
 		select {
-		case <-c.stopSig:
+		case <-stop:
 			return
 		case pkt, more := <-c.recvCh:
 			if !more {
 				return
 			}
 
-			c.addWorker(func() { c.router.Dispatch(c, pkt) })
+			if len(c.handlerQueues) == 0 {
+				c.addWorker(func() { c.dispatchSafe(pkt) })
+				continue
+			}
+
+			// packets of the same topic always go to the same worker
+			h := fnv.New32a()
+			_, _ = h.Write([]byte(pkt.TopicName))
+			select {
+			case c.handlerQueues[h.Sum32()%uint32(len(c.handlerQueues))] <- pkt:
+			case <-stop:
+				return
+			}
+		}
+	}
+}
+
+// handleQueue dispatches packets in the handler queue one by one
+func (c *AsyncClient) handleQueue(queue chan *PublishPacket, stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case pkt := <-queue:
+			c.dispatchSafe(pkt)
+		}
+	}
+}
+
+// dispatchSafe dispatches the packet with panic recovered
+func (c *AsyncClient) dispatchSafe(pkt *PublishPacket) {
+	// pooled packet is no longer used once handled
+	defer pkt.release()
+	defer c.recoverHandler(pkt)
+	if c.tracer != nil {
+		if end := c.tracer.StartHandle(pkt); end != nil {
+			defer end()
 		}
 	}
+	c.dispatch(pkt)
 }
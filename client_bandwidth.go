@@ -0,0 +1,185 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrBandwidthExceeded is returned by PublishWith (and notified to the
+// PubHandleFunc for Publish) when the QoS0 publish is dropped since the
+// bandwidth budget exhausted with BandwidthDropQos0 policy
+var ErrBandwidthExceeded = errors.New("bandwidth budget exceeded ")
+
+// BandwidthPolicy defines the action when the bandwidth budget exhausted
+// (see WithBandwidthBudget)
+type BandwidthPolicy int
+
+const (
+	// BandwidthWarn only calls the callback of WithBandwidthBudget (default)
+	BandwidthWarn BandwidthPolicy = iota
+	// BandwidthDropQos0 drops QoS0 publishes with ErrBandwidthExceeded until
+	// the next window, QoS1 and QoS2 publishes are still sent
+	BandwidthDropQos0
+)
+
+// WithBandwidthBudget limits bytes sent and received (MQTT packets with
+// protocol overhead, counted under connection wrappers) to bytesPerWindow
+// in every window, onExceeded (can be nil) is called once per window when
+// the budget exhausted, use WithBandwidthPolicy to drop QoS0 publishes,
+// bytesPerWindow or window not positive disables the budget
+func WithBandwidthBudget(bytesPerWindow int64, window time.Duration, onExceeded func()) Option {
+	return func(c *AsyncClient, options *connectOptions) error {
+		if bytesPerWindow <= 0 || window <= 0 {
+			c.bandwidth.set(0, 0, nil)
+			return nil
+		}
+
+		c.bandwidth.set(bytesPerWindow, window, onExceeded)
+		return nil
+	}
+}
+
+// WithBandwidthPolicy designate the action when the bandwidth budget
+// exhausted
+func WithBandwidthPolicy(policy BandwidthPolicy) Option {
+	return func(c *AsyncClient, options *connectOptions) error {
+		c.bandwidthPolicy = policy
+		return nil
+	}
+}
+
+// bandwidthExceeded returns true if the QoS0 publish should be dropped
+func (c *AsyncClient) bandwidthExceeded() bool {
+	return c.bandwidthPolicy == BandwidthDropQos0 && c.bandwidth.exhausted(c.clock.Now())
+}
+
+// bandwidthBudget counts bytes in fixed windows, disabled if limit is zero
+type bandwidthBudget struct {
+	mu         sync.Mutex
+	limit      int64
+	window     time.Duration
+	onExceeded func()
+	start      time.Time // start of the current window, zero before bytes counted
+	used       int64     // bytes used in the current window
+	notified   bool      // onExceeded called in the current window
+}
+
+func (b *bandwidthBudget) set(limit int64, window time.Duration, onExceeded func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.limit, b.window, b.onExceeded = limit, window, onExceeded
+	b.start, b.used, b.notified = time.Time{}, 0, false
+}
+
+// advance starts the next window if the current one ended, the first window
+// starts with the first bytes counted, b.mu MUST be held
+func (b *bandwidthBudget) advance(now time.Time) {
+	if b.start.IsZero() {
+		b.start = now
+		return
+	}
+
+	if elapsed := now.Sub(b.start); elapsed >= b.window {
+		b.start = b.start.Add(elapsed - elapsed%b.window)
+		b.used, b.notified = 0, false
+	}
+}
+
+// add counts the bytes, returns true with the callback (may be nil) if the
+// budget exhausted first in the window
+func (b *bandwidthBudget) add(n int64, now time.Time) (bool, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.limit == 0 {
+		return false, nil
+	}
+
+	b.advance(now)
+	b.used += n
+	if b.used < b.limit || b.notified {
+		return false, nil
+	}
+
+	b.notified = true
+	return true, b.onExceeded
+}
+
+func (b *bandwidthBudget) exhausted(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.limit == 0 {
+		return false
+	}
+
+	b.advance(now)
+	return b.used >= b.limit
+}
+
+// countingConn counts bytes read and written of the connection, and in
+// total of the client
+type countingConn struct {
+	sent uint64 // accessed atomically, first for 64-bit alignment
+	recv uint64
+
+	net.Conn
+	parent *AsyncClient
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		atomic.AddUint64(&c.recv, uint64(n))
+		atomic.AddUint64(&c.parent.stats.bytesRecv, uint64(n))
+		c.parent.useBandwidth(n)
+	}
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		atomic.AddUint64(&c.sent, uint64(n))
+		atomic.AddUint64(&c.parent.stats.bytesSent, uint64(n))
+		c.parent.useBandwidth(n)
+	}
+	return n, err
+}
+
+// counts returns bytes sent and received of the connection
+func (c *countingConn) counts() (sent, recv uint64) {
+	return atomic.LoadUint64(&c.sent), atomic.LoadUint64(&c.recv)
+}
+
+func (c *AsyncClient) useBandwidth(n int) {
+	exhausted, onExceeded := c.bandwidth.add(int64(n), c.clock.Now())
+	if !exhausted {
+		return
+	}
+
+	c.log.w("CLI bandwidth budget exhausted")
+	if onExceeded != nil {
+		c.addWorker(onExceeded)
+	}
+}
@@ -0,0 +1,158 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBandwidthBudget(t *testing.T) {
+	var (
+		b   bandwidthBudget
+		now = time.Unix(1000, 0)
+	)
+	if exhausted, _ := b.add(1<<20, now); exhausted || b.exhausted(now) {
+		t.Error("disabled budget exhausted")
+	}
+
+	called := 0
+	b.set(100, time.Hour, func() { called++ })
+	if exhausted, _ := b.add(60, now); exhausted {
+		t.Error("budget exhausted before the limit")
+	}
+
+	exhausted, onExceeded := b.add(40, now.Add(time.Minute))
+	if !exhausted || onExceeded == nil {
+		t.Fatal("budget not exhausted at the limit")
+	}
+	onExceeded()
+
+	// notified once in the window
+	if exhausted, _ := b.add(10, now.Add(time.Minute)); exhausted {
+		t.Error("exhausted budget notified again")
+	}
+	if !b.exhausted(now.Add(time.Minute)) {
+		t.Error("budget not exhausted")
+	}
+
+	// reset in the next window, started with the first bytes counted
+	if b.exhausted(now.Add(time.Hour)) || b.used != 0 {
+		t.Error("budget not reset in the next window, used =", b.used)
+	}
+	if called != 1 {
+		t.Error("unexpected callback count =", called)
+	}
+}
+
+func TestClient_BandwidthBudget(t *testing.T) {
+	var (
+		serverMu   sync.Mutex
+		serverConn net.Conn
+		connected  = make(chan struct{}, 2)
+		exceeded   = make(chan struct{}, 1)
+	)
+	client, err := NewClient(
+		WithBackoffStrategy(time.Millisecond, time.Millisecond, 1),
+		WithBandwidthBudget(100, time.Hour, func() { exceeded <- struct{}{} }),
+		WithBandwidthPolicy(BandwidthDropQos0),
+		WithCustomConnector(func(ctx context.Context, address string, timeout time.Duration, tlsConfig *tls.Config) (net.Conn, error) {
+			client, server := net.Pipe()
+			serverMu.Lock()
+			serverConn = server
+			serverMu.Unlock()
+
+			go fakeBroker(server, true)
+			return client, nil
+		}),
+		WithConnHandleFunc(func(client Client, server string, code byte, err error) {
+			if code == CodeSuccess {
+				connected <- struct{}{}
+			}
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Destroy(true)
+
+	waitConnected := func() {
+		select {
+		case <-connected:
+		case <-time.After(5 * time.Second):
+			t.Fatal("not connected")
+		}
+	}
+
+	if err := client.ConnectServer("fake"); err != nil {
+		t.Fatal(err)
+	}
+	waitConnected()
+
+	if err := client.PublishWith("/foo", bytes.Repeat([]byte("a"), 100)); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-exceeded:
+	case <-time.After(5 * time.Second):
+		t.Fatal("budget exceeded not notified")
+	}
+
+	if err := client.PublishWith("/foo", nil); err != ErrBandwidthExceeded {
+		t.Error("unexpected error of QoS0 publish =", err)
+	}
+	if err := client.PublishWith("/foo", nil, PubQoS(Qos1)); err != nil {
+		t.Error("unexpected error of QoS1 publish =", err)
+	}
+
+	stats := client.Stats()
+	info, ok := client.ConnInfo("fake")
+	if !ok {
+		t.Fatal("no conn info")
+	}
+	if stats.BytesSent < 100 || stats.BytesReceived == 0 || info.BytesSent > stats.BytesSent || info.BytesSent < 100 {
+		t.Errorf("unexpected bytes counted, stats %+v, conn %d/%d", stats, info.BytesSent, info.BytesReceived)
+	}
+
+	// counted in total after reconnected
+	serverMu.Lock()
+	_ = serverConn.Close()
+	serverMu.Unlock()
+	waitConnected()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		info, ok := client.ConnInfo("fake")
+		if ok && info.BytesReceived > 0 {
+			if after := client.Stats(); after.BytesSent <= stats.BytesSent || info.BytesSent >= after.BytesSent {
+				t.Errorf("unexpected bytes counted after reconnected, stats %+v, conn %d", after, info.BytesSent)
+			}
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("not reconnected")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
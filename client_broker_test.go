@@ -0,0 +1,677 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/goiiot/libmqtt"
+	"github.com/goiiot/libmqtt/mqtttest"
+	"github.com/goiiot/libmqtt/testutil"
+)
+
+// client tests with the in-memory broker of mqtttest, every test runs
+// over tcp, tls, websocket and net.Pipe connections for all protocol
+// versions
+
+var (
+	brokerTestTopics = []*libmqtt.Topic{
+		{Name: "/test", Qos: libmqtt.Qos0},
+		{Name: "/test/foo", Qos: libmqtt.Qos1},
+		{Name: "/test/bar", Qos: libmqtt.Qos2},
+	}
+	brokerTestPayloads = []string{"test data qos0", "foo data qos1", "bar data qos2"}
+	brokerTestVersions = []libmqtt.ProtoVersion{libmqtt.V31, libmqtt.V311, libmqtt.V5}
+)
+
+// brokerTestMsgs returns the publish packets of brokerTestTopics
+func brokerTestMsgs() []*libmqtt.PublishPacket {
+	msgs := make([]*libmqtt.PublishPacket, len(brokerTestTopics))
+	for i, topic := range brokerTestTopics {
+		msgs[i] = &libmqtt.PublishPacket{
+			TopicName: topic.Name,
+			Qos:       topic.Qos,
+			Payload:   []byte(brokerTestPayloads[i]),
+		}
+	}
+	return msgs
+}
+
+type extraHandler struct {
+	onConnHandle      func(client libmqtt.Client, server string, code byte, err error) bool
+	afterConnSuccess  func(client libmqtt.Client)
+	afterPubSuccess   func(client libmqtt.Client)
+	afterSubSuccess   func(client libmqtt.Client)
+	afterUnSubSuccess func(client libmqtt.Client)
+}
+
+func baseClient(t *testing.T, version libmqtt.ProtoVersion, handler *extraHandler, options ...libmqtt.Option) libmqtt.Client {
+	var c libmqtt.Client
+
+	c, err := libmqtt.NewClient(append([]libmqtt.Option{
+		libmqtt.WithVersion(version, false),
+		libmqtt.WithDialTimeout(10),
+		libmqtt.WithKeepalive(10, 1.2),
+		libmqtt.WithAutoReconnect(true),
+		libmqtt.WithBackoffStrategy(10*time.Millisecond, 50*time.Millisecond, 1.5),
+		libmqtt.WithConnPacket(&libmqtt.ConnPacket{
+			ClientID:    "libmqtt",
+			Username:    "admin",
+			Password:    []byte("public"),
+			WillTopic:   "test",
+			WillQos:     libmqtt.Qos0,
+			WillRetain:  false,
+			WillMessage: []byte("test data"),
+		}),
+		libmqtt.WithConnHandleFunc(func(client libmqtt.Client, server string, code byte, err error) {
+			if handler.onConnHandle != nil && handler.onConnHandle(c, server, code, err) {
+				return
+			}
+
+			if err != nil {
+				t.Errorf("connect errored: %v", err)
+				c.Destroy(true)
+				return
+			}
+
+			if code != libmqtt.CodeSuccess {
+				t.Errorf("connect failed with code: %d", code)
+				c.Destroy(true)
+				return
+			}
+
+			if handler.afterConnSuccess != nil {
+				handler.afterConnSuccess(c)
+			}
+		}),
+		libmqtt.WithPubHandleFunc(func(client libmqtt.Client, topic string, err error) {
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			if handler.afterPubSuccess != nil {
+				handler.afterPubSuccess(c)
+			}
+		}),
+		libmqtt.WithSubHandleFunc(func(client libmqtt.Client, topics []*libmqtt.Topic, err error) {
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			if handler.afterSubSuccess != nil {
+				handler.afterSubSuccess(c)
+			}
+		}),
+		libmqtt.WithUnsubHandleFunc(func(client libmqtt.Client, topics []string, err error) {
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			if handler.afterUnSubSuccess != nil {
+				handler.afterUnSubSuccess(c)
+			}
+		}),
+	}, options...)...)
+	if err != nil {
+		t.Fatal("create baseClient failed", err)
+	}
+
+	return c
+}
+
+// brokerTLS returns the tls configs of the broker and clients with a self
+// signed certificate of 127.0.0.1
+func brokerTLS(t *testing.T) (server, client *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "mqtttest"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}},
+		&tls.Config{RootCAs: roots}
+}
+
+// allClients returns clients connecting to the broker over tcp, tls,
+// websocket and net.Pipe, with the function to start the test
+func allClients(t *testing.T, b *mqtttest.TestBroker, version libmqtt.ProtoVersion, handler func() *extraHandler) map[libmqtt.Client]func() {
+	addr, err := b.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverTLS, clientTLS := brokerTLS(t)
+	tlsAddr, err := b.ListenTLS(serverTLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wsAddr, err := b.ListenWebSocket()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tcp := baseClient(t, version, handler())
+	secure := baseClient(t, version, handler())
+	ws := baseClient(t, version, handler())
+	pipe := baseClient(t, version, handler())
+	return map[libmqtt.Client]func(){
+		tcp: func() {
+			if err := tcp.ConnectServer(addr); err != nil {
+				t.Error(err)
+			}
+		},
+		secure: func() {
+			if err := secure.ConnectServer(tlsAddr, libmqtt.WithCustomTLS(clientTLS)); err != nil {
+				t.Error(err)
+			}
+		},
+		ws: func() {
+			if err := ws.ConnectServer(wsAddr, libmqtt.WithWebSocketConnector(time.Second, nil)); err != nil {
+				t.Error(err)
+			}
+		},
+		pipe: func() {
+			if err := pipe.ConnectServer("pipe", libmqtt.WithCustomConnector(b.Connector())); err != nil {
+				t.Error(err)
+			}
+		},
+	}
+}
+
+func testAllClient(t *testing.T, handler func() *extraHandler) {
+	for _, version := range brokerTestVersions {
+		b := mqtttest.NewTestBroker()
+
+		for client, startTest := range allClients(t, b, version, handler) {
+			timer := time.AfterFunc(5*time.Second, func() {
+				t.Errorf("version %d: test timeout", version)
+				client.Destroy(true)
+			})
+
+			startTest()
+			client.Wait()
+			timer.Stop()
+		}
+
+		_ = b.Close()
+	}
+}
+
+// countSuccess calls next once n calls counted
+func countSuccess(n int32, next func(c libmqtt.Client)) func(c libmqtt.Client) {
+	var count int32
+	return func(c libmqtt.Client) {
+		if atomic.AddInt32(&count, 1) == n {
+			next(c)
+		}
+	}
+}
+
+func handleTopicAndSub(t *testing.T, c libmqtt.Client, afterRecv func(c libmqtt.Client)) {
+	recv := countSuccess(int32(len(brokerTestTopics)), afterRecv)
+	for _, msg := range brokerTestMsgs() {
+		msg := msg
+		c.HandleTopic(msg.TopicName, func(client libmqtt.Client, topic string, maxQos libmqtt.QosLevel, payload []byte) {
+			if maxQos != msg.Qos || !bytes.Equal(msg.Payload, payload) {
+				t.Errorf("fail at sub topic = %v, content unexpected, payload = %v, target payload = %v",
+					topic, string(payload), string(msg.Payload))
+			}
+			recv(c)
+		})
+	}
+
+	c.Subscribe(brokerTestTopics...)
+}
+
+func destroy(c libmqtt.Client) {
+	c.Destroy(true)
+}
+
+// conn
+func TestClient_Connect(t *testing.T) {
+	testAllClient(t, func() *extraHandler {
+		return &extraHandler{
+			afterConnSuccess: func(c libmqtt.Client) {
+				c.Destroy(false)
+			},
+		}
+	})
+}
+
+// conn -> pub
+func TestClient_Publish(t *testing.T) {
+	testAllClient(t, func() *extraHandler {
+		return &extraHandler{
+			afterConnSuccess: func(c libmqtt.Client) {
+				c.Publish(brokerTestMsgs()...)
+			},
+			afterPubSuccess: countSuccess(int32(len(brokerTestTopics)), destroy),
+		}
+	})
+}
+
+// conn -> pub, the same packets published by all clients
+func TestClient_PublishShared(t *testing.T) {
+	msgs := brokerTestMsgs()
+	testAllClient(t, func() *extraHandler {
+		return &extraHandler{
+			afterConnSuccess: func(c libmqtt.Client) {
+				c.Publish(msgs...)
+			},
+			afterPubSuccess: countSuccess(int32(len(brokerTestTopics)), destroy),
+		}
+	})
+
+	for i, msg := range msgs {
+		if msg.PacketID != 0 || msg.Qos != brokerTestTopics[i].Qos {
+			t.Error("published packet modified, id =", msg.PacketID, "qos =", msg.Qos)
+		}
+	}
+}
+
+// conn -> sub -> pub -> recv
+func TestClient_Subscribe(t *testing.T) {
+	testAllClient(t, func() *extraHandler {
+		return &extraHandler{
+			afterConnSuccess: func(c libmqtt.Client) {
+				handleTopicAndSub(t, c, destroy)
+			},
+			afterSubSuccess: func(c libmqtt.Client) {
+				c.Publish(brokerTestMsgs()...)
+			},
+		}
+	})
+}
+
+// conn -> sub -> unSub
+func TestClient_UnSubscribe(t *testing.T) {
+	testAllClient(t, func() *extraHandler {
+		return &extraHandler{
+			afterConnSuccess: func(c libmqtt.Client) {
+				handleTopicAndSub(t, c, destroy)
+			},
+			afterSubSuccess: func(c libmqtt.Client) {
+				c.UnSubscribe("/test", "/test/foo", "/test/bar")
+			},
+			afterUnSubSuccess: destroy,
+		}
+	})
+}
+
+// conn -> pub -> closed by broker -> reconnect
+func TestClient_Reconnect(t *testing.T) {
+	// connection closed once the publish packet received
+	b := mqtttest.NewTestBroker(mqtttest.WithCloseAfter(2))
+	defer func() { _ = b.Close() }()
+
+	const retry = 4
+	var retryCount int32
+	clients := allClients(t, b, libmqtt.V311, func() *extraHandler {
+		return &extraHandler{
+			afterConnSuccess: func(c libmqtt.Client) {
+				if atomic.AddInt32(&retryCount, 1) == retry {
+					c.Destroy(true)
+					return
+				}
+				c.Publish(brokerTestMsgs()[0])
+			},
+		}
+	})
+
+	for client, connect := range clients {
+		atomic.StoreInt32(&retryCount, 0)
+		conns := b.Conns()
+
+		connect()
+		client.Wait()
+
+		if n := b.Conns() - conns; n != retry {
+			t.Errorf("broker connections = %d, want %d", n, retry)
+		}
+	}
+}
+
+// conn -> sub -> pub (intercepted on send and receive)
+func TestClient_Interceptor(t *testing.T) {
+	b := mqtttest.NewTestBroker()
+	defer func() { _ = b.Close() }()
+
+	var (
+		mu    sync.Mutex
+		order []string
+	)
+	record := func(name string) libmqtt.PacketInterceptor {
+		return func(server string, pkt libmqtt.Packet) libmqtt.Packet {
+			if pkt.Type() == libmqtt.CtrlConn {
+				mu.Lock()
+				order = append(order, name)
+				mu.Unlock()
+			}
+			return pkt
+		}
+	}
+
+	received, dropped := make(chan string, 3), make(chan error, 1)
+	c, err := libmqtt.NewClient(
+		libmqtt.WithVersion(libmqtt.V5, false),
+		libmqtt.WithCustomConnector(b.Connector()),
+		libmqtt.WithSendInterceptor(record("first")),
+		libmqtt.WithSendInterceptor(func(server string, pkt libmqtt.Packet) libmqtt.Packet {
+			if p, ok := pkt.(*libmqtt.PublishPacket); ok {
+				switch p.TopicName {
+				case "/drop":
+					return nil
+				case "/test":
+					p.Payload = []byte("intercepted")
+				}
+			}
+			return pkt
+		}),
+		libmqtt.WithSendInterceptor(record("second")),
+		libmqtt.WithRecvInterceptor(func(server string, pkt libmqtt.Packet) libmqtt.Packet {
+			if p, ok := pkt.(*libmqtt.PublishPacket); ok && p.TopicName == "/test/foo" {
+				return nil
+			}
+			return pkt
+		}),
+		libmqtt.WithConnHandleFunc(func(client libmqtt.Client, server string, code byte, err error) {
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			client.Subscribe(brokerTestTopics[:2]...)
+		}),
+		libmqtt.WithSubHandleFunc(func(client libmqtt.Client, topics []*libmqtt.Topic, err error) {
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			client.Publish(
+				&libmqtt.PublishPacket{TopicName: "/drop", Qos: libmqtt.Qos1, Payload: []byte("drop")},
+				&libmqtt.PublishPacket{TopicName: "/test/foo", Qos: libmqtt.Qos1, Payload: []byte("foo")},
+				&libmqtt.PublishPacket{TopicName: "/test", Qos: libmqtt.Qos0, Payload: []byte("test")},
+			)
+		}),
+		libmqtt.WithPubHandleFunc(func(client libmqtt.Client, topic string, err error) {
+			if topic == "/drop" {
+				dropped <- err
+			}
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, topic := range brokerTestTopics[:2] {
+		c.HandleTopic(topic.Name, func(client libmqtt.Client, topic string, qos libmqtt.QosLevel, msg []byte) {
+			received <- topic + " " + string(msg)
+		})
+	}
+
+	if err := c.ConnectServer("pipe"); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy(true)
+
+	select {
+	case err := <-dropped:
+		if err != libmqtt.ErrPacketIntercepted {
+			t.Error("dropped publish notified with", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("dropped publish not notified")
+	}
+
+	select {
+	case msg := <-received:
+		// publish on /test/foo received before dropped
+		if msg != "/test intercepted" {
+			t.Error("unexpected message received", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not received")
+	}
+
+	mu.Lock()
+	if len(order) != 2 || order[0] != "first" || order[1] != "second" {
+		t.Error("interceptors not called in order, got", order)
+	}
+	mu.Unlock()
+
+	for _, pkt := range b.Received() {
+		if p, ok := pkt.(*libmqtt.PublishPacket); ok && p.TopicName == "/drop" {
+			t.Error("dropped publish sent to broker")
+		}
+	}
+}
+
+// topics prefixed on the wire only
+func TestClient_TopicPrefix(t *testing.T) {
+	b := mqtttest.NewTestBroker()
+	defer func() { _ = b.Close() }()
+
+	received := make(chan string, 2)
+	c, err := libmqtt.NewClient(
+		libmqtt.WithVersion(libmqtt.V5, false),
+		libmqtt.WithCustomConnector(b.Connector()),
+		libmqtt.WithTopicPrefix("tenants/a/"),
+		libmqtt.WithWill("will", libmqtt.Qos0, false, nil),
+		libmqtt.WithConnHandleFunc(func(client libmqtt.Client, server string, code byte, err error) {
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			client.Subscribe(&libmqtt.Topic{Name: "/test", Qos: libmqtt.Qos1}, &libmqtt.Topic{Name: libmqtt.AbsoluteTopic("sys/#")})
+		}),
+		libmqtt.WithSubHandleFunc(func(client libmqtt.Client, topics []*libmqtt.Topic, err error) {
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if len(topics) != 2 || topics[0].Name != "/test" {
+				t.Error("unexpected topics notified", topics)
+			}
+
+			if err := client.PublishWith("/test", []byte("test"), libmqtt.PubQoS(libmqtt.Qos1), libmqtt.PubResponseTopic("/resp")); err != nil {
+				t.Error(err)
+			}
+			client.Publish(&libmqtt.PublishPacket{TopicName: libmqtt.AbsoluteTopic("sys/foo"), Payload: []byte("sys")})
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.HandlePublish("/test", func(client libmqtt.Client, p *libmqtt.PublishPacket) {
+		received <- p.TopicName + " " + p.Props.RespTopic
+	})
+	c.HandleTopic(libmqtt.AbsoluteTopic("sys/#"), func(client libmqtt.Client, topic string, qos libmqtt.QosLevel, msg []byte) {
+		received <- topic
+	})
+
+	if err := c.ConnectServer("pipe"); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy(true)
+
+	msgs := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-received:
+			msgs[msg] = true
+		case <-time.After(5 * time.Second):
+			t.Fatal("message not received, got", msgs)
+		}
+	}
+	if !msgs["/test /resp"] || !msgs[libmqtt.AbsoluteTopic("sys/foo")] {
+		t.Error("unexpected messages received", msgs)
+	}
+
+	if subs := c.Subscriptions(); len(subs) != 2 || subs[0].Topic != libmqtt.AbsoluteTopic("sys/#") || subs[1].Topic != "/test" {
+		t.Error("unexpected subscriptions", subs)
+	}
+
+	topics := make(map[string]bool)
+	for _, pkt := range b.Received() {
+		switch p := pkt.(type) {
+		case *libmqtt.ConnPacket:
+			topics[p.WillTopic] = true
+		case *libmqtt.SubscribePacket:
+			for _, topic := range p.Topics {
+				topics[topic.Name] = true
+			}
+		case *libmqtt.PublishPacket:
+			topics[p.TopicName] = true
+			if p.Props != nil && p.Props.RespTopic != "" {
+				topics[p.Props.RespTopic] = true
+			}
+		}
+	}
+	for _, topic := range []string{"tenants/a/will", "tenants/a//test", "tenants/a//resp", "sys/#", "sys/foo"} {
+		if !topics[topic] {
+			t.Error("topic not sent", topic, "topics =", topics)
+		}
+	}
+}
+
+// conn over wrapped connections
+func TestClient_ConnWrapper(t *testing.T) {
+	b := mqtttest.NewTestBroker()
+	defer func() { _ = b.Close() }()
+
+	var (
+		mu    sync.Mutex
+		order []string
+		dump  = &lockedBuffer{}
+	)
+	record := func(name string) libmqtt.ConnWrapper {
+		return func(server string, conn net.Conn) net.Conn {
+			mu.Lock()
+			order = append(order, name+" "+server)
+			mu.Unlock()
+			return conn
+		}
+	}
+
+	connected := make(chan error, 1)
+	c, err := libmqtt.NewClient(
+		libmqtt.WithCustomConnector(b.Connector()),
+		libmqtt.WithConnWrapper(record("first")),
+		libmqtt.WithConnWrapper(testutil.HexDump(dump)),
+		libmqtt.WithConnWrapper(record("second")),
+		libmqtt.WithConnHandleFunc(func(client libmqtt.Client, server string, code byte, err error) {
+			connected <- err
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.ConnectServer("pipe"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-connected:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("connect timeout")
+	}
+	c.Destroy(true)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(order) != 2 || order[0] != "first pipe" || order[1] != "second pipe" {
+		t.Error("wrappers not applied in order, got", order)
+	}
+
+	// Connect written and ConnAck read, the write is dumped once returned
+	// from net.Pipe, which may be after the ConnAck read
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		out := dump.String()
+		if strings.Contains(out, "# pipe\nO ") && strings.Contains(out, "000000 10 ") &&
+			strings.Contains(out, "# pipe\nI ") && strings.Contains(out, "000000 20 02 00 00") {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Errorf("unexpected dump:\n%s", out)
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// lockedBuffer is the bytes.Buffer safe for concurrent use
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
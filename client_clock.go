@@ -0,0 +1,46 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import "github.com/goiiot/libmqtt/internal/clock"
+
+type (
+	// Clock provides the current time and timers of the client, used for
+	// keepalive, flush delay, retransmission, reconnect backoff, publish
+	// rate limit, bandwidth windows, takeover detection and persist ttl
+	// purge (with the store time of PersistClock methods)
+	Clock = clock.Clock
+
+	// Timer is the timer created by Clock.NewTimer
+	Timer = clock.Timer
+
+	// Ticker is the ticker created by Clock.NewTicker
+	Ticker = clock.Ticker
+)
+
+// WithClock designate the clock of the client (default the real clock),
+// intended for tests advancing time manually
+func WithClock(clk Clock) Option {
+	return func(c *AsyncClient, options *connectOptions) error {
+		if clk == nil {
+			clk = clock.Real
+		}
+
+		c.clock = clk
+		return nil
+	}
+}
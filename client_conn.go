@@ -18,25 +18,140 @@ package libmqtt
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
+var (
+	// ErrRetryExceeded is notified to PubHandler when the ack of a publish
+	// packet was not received after max retries (see WithRetryInterval)
+	ErrRetryExceeded = errors.New("packet not acked after max retries ")
+
+	// ErrQosNotSupported is notified to PubHandler when the QoS of the
+	// publish packet exceeds the maximum QoS of the server and QoS
+	// downgrade disabled (see WithQosDowngrade)
+	ErrQosNotSupported = errors.New("QoS not supported by server ")
+
+	// ErrRetainNotAvailable is notified to PubHandler when the publish
+	// packet is retained but the server does not support retained messages
+	ErrRetainNotAvailable = errors.New("retained message not available in server ")
+
+	// ErrWildcardNotAvailable is notified to SubHandler when topic filters
+	// contain wildcards but the server does not support wildcard subscriptions
+	ErrWildcardNotAvailable = errors.New("wildcard subscription not available in server ")
+)
+
+// connWriter writes encoded packets to the connection
+type connWriter interface {
+	BufferedWriter
+	// Flush writes all buffered bytes to the connection
+	Flush() error
+	// Buffered returns the size of bytes not flushed
+	Buffered() int
+}
+
+// directWriter holds one encoded packet and writes it to the connection
+// with a single write call when flushed, the bytes are not copied again
+type directWriter struct {
+	w   io.Writer
+	buf bytes.Buffer
+}
+
+func (w *directWriter) Write(p []byte) (int, error) {
+	return w.buf.Write(p)
+}
+
+func (w *directWriter) WriteByte(c byte) error {
+	return w.buf.WriteByte(c)
+}
+
+func (w *directWriter) Flush() error {
+	if w.buf.Len() == 0 {
+		return nil
+	}
+
+	_, err := w.w.Write(w.buf.Bytes())
+	w.buf.Reset()
+	return err
+}
+
+func (w *directWriter) Buffered() int {
+	return w.buf.Len()
+}
+
+// deadlineWriter sets the write deadline of the connection before every
+// write, so a server stopped reading can not block the write forever
+type deadlineWriter struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (w *deadlineWriter) Write(p []byte) (int, error) {
+	// not supported by some connections (e.g. websocket), write anyway
+	_ = w.conn.SetWriteDeadline(time.Now().Add(w.timeout))
+	return w.conn.Write(p)
+}
+
+// inflightPacket is a sent packet waiting for the ack from server
+type inflightPacket struct {
+	id      uint16
+	pkt     Packet // *PublishPacket or *PubRelPacket
+	topic   string
+	sentAt  time.Time
+	retries int
+}
+
 // clientConn is the wrapper of connection to server
 // tend to actual packet send and receive
 type clientConn struct {
-	protoVersion ProtoVersion      // mqtt protocol version
-	parent       Client            // client which created this connection
-	name         string            // server addr info
-	conn         net.Conn          // connection to server
-	connRW       *bufio.ReadWriter // make buffered connection
-	logicSendC   chan Packet       // logic send channel
-	netRecvC     chan Packet       // received packet from server
-	keepaliveC   chan struct{}     // keepalive packet
+	protoVersion ProtoVersion  // mqtt protocol version
+	parent       Client        // client which created this connection
+	name         string        // server addr info
+	persistNS    string        // namespace of persist keys
+	conn         net.Conn      // connection to server
+	counted      *countingConn // counts bytes of conn, under connection wrappers
+	connR        *bufio.Reader // buffered connection reader
+	connW        connWriter    // connection writer
+	logicSendC   chan Packet   // logic send channel
+	netRecvC     chan Packet   // received packet from server
+	keepaliveC   chan struct{} // keepalive packet
 	parentExit   uint32
+	recvBusy     uint32        // received packets are blocked by logic (e.g. recvCh is full)
+	recvBlocked  recvItem      // delivery blocked (e.g. recvCh is full), owned by logic
+	recvQueue    []Packet      // publish and PubRel packets received while delivery blocked
+	readTimeout  time.Duration // max time without packets received, 0 to disable
+	maxRecvSize  int           // max size of packets received, 0 for no limit
+	recvMax      int           // max QoS2 flows received not completed, 0 for no limit
+	inAliases    []string      // topics by inbound topic alias - 1, used by handleNetRecv only
+	inAliasCount int32         // inbound topic aliases mapped
+
+	options *connectOptions // options of the connect, with the options of ConnectServer
+
+	connAckMu    sync.RWMutex
+	connAckProps *ConnAckProps  // ConnAck properties sent by server (MQTT 5)
+	connInfo     *ConnInfo      // set once connected, nil after connection lost
+	disconnected *DisconnPacket // sent by server before closing the connection (MQTT 5)
+
+	pingMu sync.Mutex
+	pings  []*pingReq // PingReq sent and not responded, in order
+
+	ackMu       sync.Mutex
+	pendingAcks []*PublishPacket // received packets waiting for Client.Ack (in order)
+
+	inflightMu sync.Mutex
+	inflight   map[uint16]*inflightPacket // sent packets waiting for ack, nil if no retry
+
+	ready    chan struct{} // closed once packets to replay queued, nil if ready
+	replayed []Packet      // packets to resend before any packet published
 
 	ctx     context.Context    // context for single connection
 	exit    context.CancelFunc // terminate this connection if necessary
@@ -47,12 +162,156 @@ func (c *clientConn) parentExiting() bool {
 	return atomic.LoadUint32(&c.parentExit) == 1
 }
 
-// start mqtt logic
+func (c *clientConn) setDisconnected(p *DisconnPacket) {
+	c.connAckMu.Lock()
+	c.disconnected = p
+	c.connAckMu.Unlock()
+}
+
+// getDisconnected returns the DisconnPacket sent by server, nil if not sent
+func (c *clientConn) getDisconnected() *DisconnPacket {
+	c.connAckMu.RLock()
+	defer c.connAckMu.RUnlock()
+	return c.disconnected
+}
+
+func (c *clientConn) setConnAckProps(props *ConnAckProps) {
+	c.connAckMu.Lock()
+	c.connAckProps = props
+	c.connAckMu.Unlock()
+}
+
+func (c *clientConn) setConnInfo(info *ConnInfo) {
+	c.connAckMu.Lock()
+	c.connInfo = info
+	c.connAckMu.Unlock()
+}
+
+func (c *clientConn) getConnInfo() *ConnInfo {
+	c.connAckMu.RLock()
+	defer c.connAckMu.RUnlock()
+
+	return c.connInfo
+}
+
+func (c *clientConn) getConnAckProps() *ConnAckProps {
+	c.connAckMu.RLock()
+	defer c.connAckMu.RUnlock()
+
+	return c.connAckProps
+}
+
+// subIDAvail returns whether the server supports subscription identifiers
+func (c *clientConn) subIDAvail() bool {
+	props := c.getConnAckProps()
+	return props == nil || props.SubIDAvail == nil || *props.SubIDAvail
+}
+
+// adaptPacket drops the features not available in the server from the
+// packet to be sent, the packet MUST NOT be modified in place since it
+// may be shared by connections, error returned if the packet can not be
+// sent to the server
+func (c *clientConn) adaptPacket(pkt Packet) (Packet, error) {
+	props := c.getConnAckProps()
+	if c.protoVersion != V5 || props == nil {
+		return pkt, nil
+	}
+
+	switch p := pkt.(type) {
+	case *PublishPacket:
+		if p.IsRetain && props.RetainAvail != nil && !*props.RetainAvail {
+			return nil, ErrRetainNotAvailable
+		}
+
+		if p.Qos > props.MaxQos {
+			if !c.options.qosDowngrade {
+				return nil, ErrQosNotSupported
+			}
+
+			c.parent.log.d("NET downgrade publish QoS, server =", c.name, "QoS =", p.Qos, "max QoS =", props.MaxQos)
+			downgraded := p.dup()
+			downgraded.IsDup = p.IsDup
+			downgraded.Qos = props.MaxQos
+			if downgraded.Qos == Qos0 {
+				c.parent.dropPublish(c.persistNS, p)
+				c.parent.idGen.reclaim(p.PacketID)
+				downgraded.PacketID = 0
+			} else {
+				// acked as the downgraded QoS
+				c.parent.idGen.setExtra(p.PacketID, downgraded)
+			}
+			return downgraded, nil
+		}
+	case *SubscribePacket:
+		if props.WildcardSubAvail != nil && !*props.WildcardSubAvail {
+			for _, t := range p.Topics {
+				if strings.ContainsAny(t.Name, "#+") {
+					return nil, ErrWildcardNotAvailable
+				}
+			}
+		}
+
+		if p.Props != nil && p.Props.SubID != 0 && !c.subIDAvail() {
+			c.parent.log.d("NET server does not support subscription identifier, server =", c.name)
+			return &SubscribePacket{
+				PacketID: p.PacketID,
+				Topics:   p.Topics,
+				Props:    &SubscribeProps{UserProps: p.Props.UserProps},
+			}, nil
+		}
+	}
+	return pkt, nil
+}
+
+// rejectPacket notifies the packet rejected by adaptPacket or failed to
+// encode and releases its packet id
+func (c *clientConn) rejectPacket(pkt Packet, err error) {
+	switch p := pkt.(type) {
+	case *PublishPacket:
+		c.parent.log.e("NET publish rejected, server =", c.name, "topic =", p.TopicName, "err =", err)
+		c.parent.dropPublish(c.persistNS, p)
+		if p.Qos > Qos0 {
+			c.parent.idGen.reclaim(p.PacketID)
+		}
+		p.finish(err)
+		notifyPubMsg(c.parent.msgCh, p.TopicName, err)
+	case *SubscribePacket:
+		c.parent.log.e("NET subscribe rejected, server =", c.name, "topics =", p.Topics, "err =", err)
+		c.parent.idGen.reclaim(p.PacketID)
+		c.subscribed(p, err)
+	case *UnsubPacket:
+		c.parent.log.e("NET unsubscribe rejected, server =", c.name, "topics =", p.TopicNames, "err =", err)
+		c.parent.idGen.reclaim(p.PacketID)
+		notifyUnSubMsg(c.parent.msgCh, p.TopicNames, err)
+	}
+}
+
+// isEncodeErr reports whether the packet failed to encode before
+// written, the connection is still usable
+func isEncodeErr(err error) bool {
+	return err == ErrStringTooLong || err == ErrPacketTooLarge
+}
+
+// logicHandlers handle packets received from the server by control type
+var logicHandlers = [CtrlAuth + 1]func(c *clientConn, pkt Packet){
+	CtrlPublish:  (*clientConn).queueRecv,
+	CtrlPubAck:   (*clientConn).handlePubAck,
+	CtrlPubRecv:  (*clientConn).handlePubRecv,
+	CtrlPubRel:   (*clientConn).queueRecv,
+	CtrlPubComp:  (*clientConn).handlePubComp,
+	CtrlSubAck:   (*clientConn).handleSubAck,
+	CtrlUnSubAck: (*clientConn).handleUnsubAck,
+}
+
+// start mqtt logic, the blocked delivery (e.g. recvCh is full) waits
+// here along with received packets, acks of packets sent are handled
+// meanwhile while publish and PubRel packets are queued (one more than the
+// recv buffer size at most) to handle in order once delivered
 func (c *clientConn) logic() {
 	defer func() {
 		err := c.conn.Close()
 		if err != nil {
-			notifyNetMsg(c.parent.msgCh, c.name, err)
+			notifyNetMsg(c.parent.msgCh, c.name, &TransportError{Server: c.name, Op: OpClose, Err: err})
 		} else {
 			notifyNetMsg(c.parent.msgCh, c.name, io.EOF)
 		}
@@ -65,151 +324,240 @@ func (c *clientConn) logic() {
 		c.parent.addWorker(c.keepalive)
 	}
 
+	// start retransmission if required
+	if c.options.retryInterval > 0 {
+		c.parent.addWorker(c.retransmit)
+	}
+
 	for {
+		netRecvC, recvCh := c.netRecvC, chan<- *PublishPacket(nil)
+		if c.recvBlocked.pub != nil {
+			recvCh = c.parent.recvCh
+			if len(c.recvQueue) > cap(c.parent.recvCh) {
+				netRecvC = nil
+			}
+		}
+
 		select {
-		case pkt, more := <-c.netRecvC:
+		case pkt, more := <-netRecvC:
 			if !more {
 				return
 			}
 
-			switch pkt.(type) {
-			case *SubAckPacket:
-				p := pkt.(*SubAckPacket)
-				c.parent.log.v("NET received SubAck, id =", p.PacketID)
-
-				if originPkt, ok := c.parent.idGen.getExtra(p.PacketID); ok {
-					switch originPkt.(type) {
-					case *SubscribePacket:
-						originSub := originPkt.(*SubscribePacket)
-						N := len(p.Codes)
-						for i, v := range originSub.Topics {
-							if i < N {
-								v.Qos = p.Codes[i]
-							}
-						}
-						c.parent.log.d("NET subscribed topics =", originSub.Topics)
-						notifySubMsg(c.parent.msgCh, originSub.Topics, nil)
-						c.parent.idGen.free(p.PacketID)
-
-						notifyPersistMsg(c.parent.msgCh, p, c.parent.persist.Delete(sendKey(p.PacketID)))
-					}
-				}
-			case *UnsubAckPacket:
-				p := pkt.(*UnsubAckPacket)
-				c.parent.log.v("NET received UnSubAck, id =", p.PacketID)
-
-				if originPkt, ok := c.parent.idGen.getExtra(p.PacketID); ok {
-					switch originPkt.(type) {
-					case *UnsubPacket:
-						originUnSub := originPkt.(*UnsubPacket)
-						c.parent.log.d("NET unsubscribed topics", originUnSub.TopicNames)
-						notifyUnSubMsg(c.parent.msgCh, originUnSub.TopicNames, nil)
-						c.parent.idGen.free(p.PacketID)
-
-						notifyPersistMsg(c.parent.msgCh, p, c.parent.persist.Delete(sendKey(p.PacketID)))
-					}
-				}
-			case *PublishPacket:
-				p := pkt.(*PublishPacket)
-				c.parent.log.v("NET received publish, topic =", p.TopicName, "id =", p.PacketID, "QoS =", p.Qos)
-				// received server publish, send to client
-				c.parent.recvCh <- p
-
-				// tend to QoS
-				switch p.Qos {
-				case Qos1:
-					c.parent.log.d("NET send PubAck for Publish, id =", p.PacketID)
-					c.send(&PubAckPacket{PacketID: p.PacketID})
-
-					notifyPersistMsg(c.parent.msgCh, p, c.parent.persist.Store(recvKey(p.PacketID), pkt))
-				case Qos2:
-					c.parent.log.d("NET send PubRecv for Publish, id =", p.PacketID)
-					c.send(&PubRecvPacket{PacketID: p.PacketID})
-
-					notifyPersistMsg(c.parent.msgCh, p, c.parent.persist.Store(recvKey(p.PacketID), pkt))
-				}
-			case *PubAckPacket:
-				p := pkt.(*PubAckPacket)
-				c.parent.log.v("NET received PubAck, id =", p.PacketID)
-
-				if originPkt, ok := c.parent.idGen.getExtra(p.PacketID); ok {
-					switch originPkt.(type) {
-					case *PublishPacket:
-						originPub := originPkt.(*PublishPacket)
-						if originPub.Qos == Qos1 {
-							c.parent.log.d("NET published qos1 packet, topic =", originPub.TopicName)
-							notifyPubMsg(c.parent.msgCh, originPub.TopicName, nil)
-							c.parent.idGen.free(p.PacketID)
-
-							notifyPersistMsg(c.parent.msgCh, p, c.parent.persist.Delete(sendKey(p.PacketID)))
-						}
-					}
-				}
-			case *PubRecvPacket:
-				p := pkt.(*PubRecvPacket)
-				c.parent.log.v("NET received PubRec, id =", p.PacketID)
-
-				if originPkt, ok := c.parent.idGen.getExtra(p.PacketID); ok {
-					switch originPkt.(type) {
-					case *PublishPacket:
-						originPub := originPkt.(*PublishPacket)
-						if originPub.Qos == Qos2 {
-							c.send(&PubRelPacket{PacketID: p.PacketID})
-							c.parent.log.d("NET send PubRel, id =", p.PacketID)
-						}
-					}
-				}
-			case *PubRelPacket:
-				p := pkt.(*PubRelPacket)
-				c.parent.log.v("NET send PubRel, id =", p.PacketID)
-
-				if originPkt, ok := c.parent.idGen.getExtra(p.PacketID); ok {
-					switch originPkt.(type) {
-					case *PublishPacket:
-						originPub := originPkt.(*PublishPacket)
-						if originPub.Qos == Qos2 {
-							c.send(&PubCompPacket{PacketID: p.PacketID})
-							c.parent.log.d("NET send PubComp, id =", p.PacketID)
-
-							notifyPersistMsg(c.parent.msgCh, p, c.parent.persist.Store(recvKey(p.PacketID), pkt))
-						}
-					}
-				}
-			case *PubCompPacket:
-				p := pkt.(*PubCompPacket)
-				c.parent.log.v("NET received PubComp, id =", p.PacketID)
-
-				if originPkt, ok := c.parent.idGen.getExtra(p.PacketID); ok {
-					switch originPkt.(type) {
-					case *PublishPacket:
-						originPub := originPkt.(*PublishPacket)
-						if originPub.Qos == Qos2 {
-							c.send(&PubRelPacket{PacketID: p.PacketID})
-							c.parent.log.d("NET send PubRel, id =", p.PacketID)
-							c.parent.log.d("NET published qos2 packet, topic =", originPub.TopicName)
-							notifyPubMsg(c.parent.msgCh, originPub.TopicName, nil)
-							c.parent.idGen.free(p.PacketID)
-
-							notifyPersistMsg(c.parent.msgCh, p, c.parent.persist.Delete(sendKey(p.PacketID)))
-						}
-					}
-				}
-			default:
-				c.parent.log.v("NET received packet, type =", pkt.Type())
+			c.parent.log.v("NET received", pkt)
+			if t := pkt.Type(); int(t) < len(logicHandlers) && logicHandlers[t] != nil {
+				logicHandlers[t](c, pkt)
 			}
+		case recvCh <- c.recvBlocked.pub:
+			c.unblockRecv()
 		case <-c.stopSig:
 			return
 		}
 	}
 }
 
+// origin returns the packet sent with the packet id, nil if not found
+func (c *clientConn) origin(id uint16) Packet {
+	extra, _ := c.parent.idGen.getExtra(id)
+	pkt, _ := extra.(Packet)
+	return pkt
+}
+
+// recvItem is the publish packet of the blocked delivery, acked once
+// delivered if ack
+type recvItem struct {
+	pub *PublishPacket
+	ack bool
+}
+
+// queueRecv handles the publish or PubRel packet received, or queues it
+// while the delivery is blocked, so that packets are handled in receive
+// order
+func (c *clientConn) queueRecv(pkt Packet) {
+	if c.recvBlocked.pub != nil {
+		c.recvQueue = append(c.recvQueue, pkt)
+		return
+	}
+
+	c.handleRecvPacket(pkt)
+}
+
+// unblockRecv acks the packet of the blocked delivery once delivered, and
+// handles the packets queued in order until the delivery blocks again
+func (c *clientConn) unblockRecv() {
+	item := c.recvBlocked
+	c.recvBlocked = recvItem{}
+	if item.ack {
+		c.sendPubAck(item.pub)
+	}
+
+	for len(c.recvQueue) > 0 && c.recvBlocked.pub == nil {
+		pkt := c.recvQueue[0]
+		n := copy(c.recvQueue, c.recvQueue[1:])
+		c.recvQueue[n] = nil
+		c.recvQueue = c.recvQueue[:n]
+
+		c.handleRecvPacket(pkt)
+	}
+}
+
+func (c *clientConn) handleRecvPacket(pkt Packet) {
+	switch p := pkt.(type) {
+	case *PublishPacket:
+		c.handlePublish(p)
+	case *PubRelPacket:
+		c.handlePubRel(p)
+	}
+}
+
+func (c *clientConn) handlePublish(p *PublishPacket) {
+	if c.parent.payloadFormatPolicy == PayloadFormatReject && !c.validPayloadFormat(p) {
+		c.rejectPublish(p, CodePayloadFormatInvalid)
+		return
+	}
+
+	if p.Qos == Qos0 {
+		// QoS0 packet may be reused once delivered (WithPooledDecode)
+		c.deliverPub(p, false)
+		return
+	}
+
+	if p.Qos == Qos2 {
+		// delivered once released by PubRel
+		c.recvQos2(p)
+		return
+	}
+
+	// received server publish, send to client
+	c.deliverAck(p)
+}
+
+func (c *clientConn) handlePubRel(p *PubRelPacket) {
+	pub, stored, released := c.parent.releaseQos2(c.persistNS, p.PacketID)
+	if !stored {
+		// already completed
+		pubComp := &PubCompPacket{PacketID: p.PacketID}
+		c.parent.log.d("NET send", pubComp)
+		c.send(pubComp)
+		return
+	}
+
+	if !released {
+		// duplicate PubRel, PubComp sent once acked
+		c.parent.log.d("NET received duplicate PubRel, id =", p.PacketID)
+		return
+	}
+
+	c.deliverAck(pub)
+}
+
+func (c *clientConn) handleSubAck(pkt Packet) {
+	p := pkt.(*SubAckPacket)
+	originSub, ok := c.origin(p.PacketID).(*SubscribePacket)
+	if !ok || !c.complete(p, p.PacketID) {
+		return
+	}
+
+	if len(p.Codes) != len(originSub.Topics) {
+		err := &MalformedPacketError{
+			Code:   CodeProtoError,
+			Reason: fmt.Sprintf("%d suback codes for %d topics", len(p.Codes), len(originSub.Topics)),
+		}
+		c.subscribed(originSub, err)
+		c.protocolError(err)
+		return
+	}
+
+	options := make([]byte, len(originSub.Topics))
+	for i, v := range originSub.Topics {
+		options[i] = v.Qos
+		if c.protoVersion < V5 {
+			options[i] &= subOptionsQos
+		}
+		v.Qos = p.Codes[i]
+	}
+	subID := 0
+	if c.protoVersion == V5 && originSub.Props != nil && c.subIDAvail() {
+		subID = originSub.Props.SubID
+	}
+	c.parent.addSubscriptions(c.name, originSub.Topics, options, p.Codes, subID)
+
+	c.parent.log.d("NET subscribed topics =", originSub.Topics)
+	c.subscribed(originSub, nil)
+}
+
+func (c *clientConn) handleUnsubAck(pkt Packet) {
+	p := pkt.(*UnsubAckPacket)
+	originUnSub, ok := c.origin(p.PacketID).(*UnsubPacket)
+	if !ok || !c.complete(p, p.PacketID) {
+		return
+	}
+
+	c.parent.removeSubscriptions(c.name, originUnSub.TopicNames)
+	c.parent.log.d("NET unsubscribed topics", originUnSub.TopicNames)
+	notifyUnSubMsg(c.parent.msgCh, originUnSub.TopicNames, nil)
+}
+
+func (c *clientConn) handlePubAck(pkt Packet) {
+	p := pkt.(*PubAckPacket)
+	originPub, ok := c.origin(p.PacketID).(*PublishPacket)
+	if !ok || originPub.Qos != Qos1 || !c.complete(p, p.PacketID) {
+		return
+	}
+
+	err := pubAckError(CtrlPubAck, p.Code, p.Props.reason())
+	c.parent.log.d("NET published qos1 packet, topic =", originPub.TopicName, "err =", err)
+	originPub.finish(err)
+	notifyPubMsg(c.parent.msgCh, originPub.TopicName, err)
+}
+
+func (c *clientConn) handlePubRecv(pkt Packet) {
+	p := pkt.(*PubRecvPacket)
+	originPub, ok := c.origin(p.PacketID).(*PublishPacket)
+	if !ok || originPub.Qos != Qos2 {
+		return
+	}
+
+	if err := pubAckError(CtrlPubRecv, p.Code, p.Props.reason()); err != nil {
+		// publish refused, no PubRel is sent
+		if c.complete(p, p.PacketID) {
+			c.parent.log.d("NET publish qos2 packet refused, topic =", originPub.TopicName, "err =", err)
+			originPub.finish(err)
+			notifyPubMsg(c.parent.msgCh, originPub.TopicName, err)
+		}
+		return
+	}
+
+	pubRel := &PubRelPacket{PacketID: p.PacketID}
+	// persisted before sent, PubComp may arrive once sent
+	notifyPersistMsg(c.parent.msgCh, pubRel, c.parent.storeSent(c.persistNS, p.PacketID, pubRel))
+	c.trackInflight(p.PacketID, pubRel, originPub.TopicName)
+	c.send(pubRel)
+	c.parent.log.d("NET send", pubRel)
+}
+
+// handlePubComp completes the QoS2 publish, PubComp ends the flow, nothing
+// is sent
+func (c *clientConn) handlePubComp(pkt Packet) {
+	p := pkt.(*PubCompPacket)
+	originPub, ok := c.origin(p.PacketID).(*PublishPacket)
+	if !ok || originPub.Qos != Qos2 || !c.complete(p, p.PacketID) {
+		return
+	}
+
+	err := pubAckError(CtrlPubComp, p.Code, p.Props.reason())
+	c.parent.log.d("NET published qos2 packet, topic =", originPub.TopicName, "err =", err)
+	originPub.finish(err)
+	notifyPubMsg(c.parent.msgCh, originPub.TopicName, err)
+}
+
 // keepalive with server
 func (c *clientConn) keepalive() {
 	c.parent.log.d("NET start keepalive")
 
-	t := time.NewTicker(c.parent.options.keepalive * 3 / 4)
+	t := c.parent.clock.NewTicker(c.parent.options.keepalive * 3 / 4)
 	timeout := time.Duration(float64(c.parent.options.keepalive) * c.parent.options.keepaliveFactor)
-	timeoutTimer := time.NewTimer(timeout)
+	timeoutTimer := c.parent.clock.NewTimer(timeout)
 
 	defer func() {
 		t.Stop()
@@ -219,22 +567,11 @@ func (c *clientConn) keepalive() {
 
 	for {
 		select {
-		case <-t.C:
+		case <-t.C():
+			c.pingSent(nil)
 			c.send(PingReqPacket)
 
-			select {
-			case _, more := <-c.keepaliveC:
-				if !more {
-					return
-				}
-
-				timeoutTimer.Reset(timeout)
-			case <-timeoutTimer.C:
-				c.parent.log.i("NET keepalive timeout")
-				// exit client connection
-				c.exit()
-				return
-			case <-c.stopSig:
+			if !c.waitPingResp(timeoutTimer, timeout) {
 				return
 			}
 		case <-c.stopSig:
@@ -243,103 +580,523 @@ func (c *clientConn) keepalive() {
 	}
 }
 
-const (
-	flushDelayInterval = 100 * time.Microsecond
-)
+// waitPingResp waits for the keepalive response, return false if
+// keepalive timeout or the connection exited
+func (c *clientConn) waitPingResp(timeoutTimer Timer, timeout time.Duration) bool {
+	for {
+		select {
+		case _, more := <-c.keepaliveC:
+			if !more {
+				return false
+			}
+
+			timeoutTimer.Reset(timeout)
+			return true
+		case <-timeoutTimer.C():
+			if atomic.LoadUint32(&c.recvBusy) == 1 {
+				// keepalive response is blocked by received packets
+				timeoutTimer.Reset(timeout)
+				continue
+			}
+
+			c.parent.log.i("NET keepalive timeout")
+			notifyNetMsg(c.parent.msgCh, c.name, &TransportError{Server: c.name, Op: OpKeepalive, Err: ErrKeepaliveTimeout})
+			// exit client connection
+			c.exit()
+			return false
+		case <-c.stopSig:
+			return false
+		}
+	}
+}
+
+// complete releases the packet id of the completed packet, the id is
+// marked done first so duplicate acks are ignored, and reclaimed for reuse
+// only after the persisted packet deleted, return false if already done
+func (c *clientConn) complete(pkt Packet, id uint16) bool {
+	if !c.parent.idGen.markDone(id) {
+		return false
+	}
+
+	c.untrackInflight(id)
+	notifyPersistMsg(c.parent.msgCh, pkt, c.parent.deleteSent(c.persistNS, id))
+	c.parent.idGen.reclaim(id)
+	return true
+}
+
+// refreshReadDeadline sets the deadline of reading the next packet, the
+// connection is treated as broken if nothing received from the server
+// before the deadline
+func (c *clientConn) refreshReadDeadline() {
+	if c.readTimeout > 0 {
+		// not supported by some connections (e.g. websocket), read anyway
+		_ = c.conn.SetReadDeadline(time.Now().Add(c.readTimeout))
+	}
+}
+
+func (c *clientConn) clearReadDeadline() {
+	if c.readTimeout > 0 {
+		_ = c.conn.SetReadDeadline(time.Time{})
+	}
+}
+
+// protocolError handles the packet received violating the protocol, with
+// MQTT 5 the connection is closed by sending DisconnPacket with the reason
+// code
+func (c *clientConn) protocolError(err *MalformedPacketError) {
+	c.parent.log.e("NET protocol error, server =", c.name, "err =", err)
+	if c.protoVersion == V5 {
+		// handleSend closes the connection once sent
+		c.send(&DisconnPacket{Code: err.Code, Props: &DisconnProps{Reason: err.Reason}})
+	}
+}
+
+// replay queues the packets not acked in send order with original packet
+// ids, as the session is resumed by the server, they are sent once ready
+func (c *clientConn) replay(entries []*sentEntry) {
+	for _, e := range entries {
+		switch p := e.pkt.(type) {
+		case *PublishPacket:
+			dup := p.dup()
+			dup.IsDup = !e.queued
+			c.trackInflight(e.id, dup, p.TopicName)
+			c.replayed = append(c.replayed, dup)
+		case *PubRelPacket:
+			topic := ""
+			if extra, ok := c.parent.idGen.getExtra(e.id); ok {
+				if pub, ok := extra.(*PublishPacket); ok {
+					topic = pub.TopicName
+				}
+			}
+			c.trackInflight(e.id, p, topic)
+			c.replayed = append(c.replayed, p)
+		default:
+			continue
+		}
+		c.parent.log.d("NET replay packet, id =", e.id, "type =", e.pkt.Type())
+	}
+}
+
+// resend sends publish packets not acked as new packets once the session
+// not present on the server, packets released (PubRel sent) were received
+// by the server and are published
+func (c *clientConn) resend(entries []*sentEntry) {
+	for _, e := range entries {
+		switch p := e.pkt.(type) {
+		case *PublishPacket:
+			pub := p.dup()
+			pub.IsDup = false
+			c.trackInflight(e.id, pub, p.TopicName)
+			c.replayed = append(c.replayed, pub)
+		case *PubRelPacket:
+			originPub, _ := c.origin(e.id).(*PublishPacket)
+			if !c.complete(p, e.id) {
+				continue
+			}
+
+			topic := ""
+			if originPub != nil {
+				topic = originPub.TopicName
+				originPub.finish(nil)
+			}
+			notifyPubMsg(c.parent.msgCh, topic, nil)
+		default:
+			continue
+		}
+		c.parent.log.d("NET resend packet, id =", e.id, "type =", e.pkt.Type())
+	}
+}
+
+// trackInflight starts the retransmission timer of the sent packet, the
+// packet replaces the previous one with the same packet id (e.g. PubRel)
+func (c *clientConn) trackInflight(id uint16, pkt Packet, topic string) {
+	if c.options.retryInterval <= 0 {
+		return
+	}
+
+	c.inflightMu.Lock()
+	if c.inflight == nil {
+		c.inflight = make(map[uint16]*inflightPacket)
+	}
+	c.inflight[id] = &inflightPacket{id: id, pkt: pkt, topic: topic, sentAt: c.parent.clock.Now()}
+	c.inflightMu.Unlock()
+}
+
+// untrackInflight cancels the retransmission of the acked packet
+func (c *clientConn) untrackInflight(id uint16) {
+	c.inflightMu.Lock()
+	delete(c.inflight, id)
+	c.inflightMu.Unlock()
+}
+
+// retransmit resends packets not acked within the retry interval
+func (c *clientConn) retransmit() {
+	c.parent.log.d("NET start retransmission for server =", c.name)
+
+	var (
+		interval   = c.options.retryInterval
+		maxRetries = c.options.maxRetries
+		tick       = interval / 4
+	)
+	if tick < time.Millisecond {
+		tick = time.Millisecond
+	}
+
+	t := c.parent.clock.NewTicker(tick)
+	defer func() {
+		t.Stop()
+		c.parent.log.d("NET stop retransmission for server =", c.name)
+	}()
+
+	for {
+		select {
+		case now := <-t.C():
+			var resend []Packet
+			var exceeded []*inflightPacket
+
+			c.inflightMu.Lock()
+			for id, p := range c.inflight {
+				if now.Sub(p.sentAt) < interval {
+					continue
+				}
+
+				if maxRetries > 0 && p.retries >= maxRetries {
+					delete(c.inflight, id)
+					exceeded = append(exceeded, p)
+					continue
+				}
+
+				p.retries++
+				p.sentAt = now
+				switch pkt := p.pkt.(type) {
+				case *PublishPacket:
+					resend = append(resend, pkt.dup())
+				default:
+					resend = append(resend, pkt)
+				}
+			}
+			c.inflightMu.Unlock()
+
+			for _, pkt := range resend {
+				c.parent.log.d("NET retransmit packet, type =", pkt.Type())
+				c.send(pkt)
+			}
+
+			for _, p := range exceeded {
+				origin, _ := c.parent.idGen.getExtra(p.id)
+				if !c.complete(p.pkt, p.id) {
+					// acked in the meantime
+					continue
+				}
+
+				c.parent.log.e("NET packet not acked after max retries, id =", p.id, "topic =", p.topic)
+				if pub, ok := origin.(*PublishPacket); ok {
+					pub.finish(ErrRetryExceeded)
+				}
+				notifyPubMsg(c.parent.msgCh, p.topic, ErrRetryExceeded)
+			}
+		case <-c.stopSig:
+			return
+		}
+	}
+}
 
 // handle mqtt logic control packet send
 func (c *clientConn) handleSend() {
 	c.parent.log.v("NET clientConn.handleSend() for server =", c.name)
 
-	flushSig := time.NewTimer(time.Hour)
+	var (
+		policy       = c.options.flushPolicy
+		interceptors = c.options.sendInterceptors
+		pending      int // packets written since last flush
+		flushSig     = c.parent.clock.NewTimer(time.Hour)
+	)
+	if c.options.directWrite {
+		// every packet is written to connection once encoded
+		policy = FlushPolicy{}
+	}
 	defer func() {
 		c.parent.log.e("NET exit clientConn.handleSend() for server =", c.name)
 		flushSig.Stop()
 	}()
 
+	// connection broken (or write timeout), exit to reconnect
+	broken := func(op string, err error) {
+		if e, ok := err.(net.Error); ok && e.Timeout() {
+			c.parent.log.e("NET write timeout, server =", c.name)
+		} else {
+			c.parent.log.e("NET write error", err)
+		}
+		notifyNetMsg(c.parent.msgCh, c.name, &TransportError{Server: c.name, Op: op, Err: err})
+		c.exit()
+	}
+
+	flush := func() bool {
+		pending = 0
+		if err := c.connW.Flush(); err != nil {
+			broken(OpFlush, err)
+			return false
+		}
+		return true
+	}
+
+	// apply flush policy to written packet
+	written := func(pkt Packet) bool {
+		pending++
+		if policy.shouldFlush(pkt, pending, c.connW.Buffered()) {
+			return flush()
+		}
+
+		if pending == 1 {
+			flushSig.Reset(policy.Delay)
+		}
+		return true
+	}
+
+	// send the packet of client logic (e.g. acks and pings), returns false
+	// if the connection exited
+	sendLogic := func(pkt Packet, more bool) bool {
+		if !more {
+			return false
+		}
+
+		if len(interceptors) > 0 {
+			if pkt = intercept(interceptors, c.name, pkt); pkt == nil {
+				return true
+			}
+		}
+
+		pkt.SetVersion(c.protoVersion)
+		if err := c.parent.prefixPacket(pkt).WriteTo(c.connW); err != nil {
+			if _, ok := pkt.(*ConnPacket); ok {
+				// e.g. the CONNECT packet too large to encode
+				c.parent.log.e("NET connect packet not sent, server =", c.name, "err =", err)
+				notifyNetMsg(c.parent.msgCh, c.name, &HandshakeError{Server: c.name, Err: err})
+				c.exit()
+				return false
+			}
+			broken(OpWrite, err)
+			return false
+		}
+
+		if !written(pkt) {
+			return false
+		}
+
+		switch pkt.(type) {
+		case *DisconnPacket:
+			// disconnect to server, no more action
+			flush()
+			_ = c.conn.Close()
+
+			c.exit()
+			return false
+		}
+		return true
+	}
+
+	// send the packet of client (e.g. publishes and subscribes) adapted to
+	// the server, returns false if the connection exited
+	sendClient := func(pkt Packet) bool {
+		if len(interceptors) > 0 {
+			if intercepted := intercept(interceptors, c.name, pkt); intercepted != nil {
+				pkt = intercepted
+			} else {
+				c.rejectPacket(pkt, ErrPacketIntercepted)
+				return true
+			}
+		}
+
+		if p, ok := pkt.(*PublishPacket); ok && p.Qos > Qos0 && p.replayable() {
+			// persisted before sent, the ack may arrive once sent
+			notifyPersistMsg(c.parent.msgCh, p, c.parent.storeSent(c.persistNS, p.PacketID, p))
+		}
+
+		pkt.SetVersion(c.protoVersion)
+		if err := c.parent.prefixPacket(pkt).WriteTo(c.connW); err != nil {
+			if isEncodeErr(err) {
+				c.rejectPacket(pkt, err)
+				return true
+			}
+
+			if p, ok := pkt.(*PublishPacket); ok && p.Qos == Qos0 {
+				// QoS0 publish is not resent
+				p.finish(err)
+				notifyPubMsg(c.parent.msgCh, p.TopicName, err)
+			}
+			broken(OpWrite, err)
+			return false
+		}
+
+		if !written(pkt) {
+			return false
+		}
+
+		switch pkt.(type) {
+		case *PublishPacket:
+			p := pkt.(*PublishPacket)
+			if p.Qos == 0 {
+				c.parent.log.d("NET published qos0 packet, topic =", p.TopicName)
+				p.finish(nil)
+				notifyPubMsg(c.parent.msgCh, p.TopicName, nil)
+			} else {
+				c.trackInflight(p.PacketID, p, p.TopicName)
+			}
+		case *DisconnPacket:
+			// client exit with disconnect
+			flush()
+			_ = c.conn.Close()
+
+			c.exit()
+			return false
+		}
+		return true
+	}
+
+	// packets published are sent after replayed packets
+	sendCh, ready := c.parent.sendCh, c.ready
+	if ready != nil {
+		sendCh = nil
+	}
+
 	for {
+		// acks are sent before packets published, so acks are not delayed
+		// by heavy publishing and servers don't resend packets not acked
+		select {
+		case pkt, more := <-c.logicSendC:
+			if !sendLogic(pkt, more) {
+				return
+			}
+			continue
+		default:
+		}
+
 		select {
 		case <-c.stopSig:
 			return
-		case <-flushSig.C:
-			if err := c.connRW.Flush(); err != nil {
-				c.parent.log.e("NET flush error", err)
-				flushSig.Reset(time.Hour)
+		case <-ready:
+			sendCh, ready = c.parent.sendCh, nil
+			for _, pkt := range c.replayed {
+				if len(interceptors) > 0 {
+					if pkt = intercept(interceptors, c.name, pkt); pkt == nil {
+						continue
+					}
+				}
+
+				pkt.SetVersion(c.protoVersion)
+				if err := c.parent.prefixPacket(pkt).WriteTo(c.connW); err != nil {
+					broken(OpWrite, err)
+					return
+				}
 
-				notifyNetMsg(c.parent.msgCh, c.name, err)
+				if !written(pkt) {
+					return
+				}
+			}
+			c.replayed = nil
+		case <-flushSig.C():
+			if !flush() {
+				flushSig.Reset(time.Hour)
 				return
 			}
-		case pkt, more := <-c.parent.sendCh:
+		case pkt, more := <-sendCh:
 			if !more {
 				return
 			}
 
-			pkt.SetVersion(c.protoVersion)
-			if err := pkt.WriteTo(c.connRW); err != nil {
-				c.parent.log.e("NET encode error", err)
-				return
+			if p, ok := pkt.(*PublishPacket); ok {
+				if err := p.discarded(c.parent.clock.Now()); err != nil {
+					c.parent.countDiscarded(err)
+					c.rejectPacket(pkt, err)
+					continue
+				}
 			}
-			flushSig.Reset(flushDelayInterval)
 
-			switch pkt.(type) {
-			case *PublishPacket:
-				p := pkt.(*PublishPacket)
-				if p.Qos == 0 {
-					c.parent.log.d("NET published qos0 packet, topic =", p.TopicName)
-					notifyPubMsg(c.parent.msgCh, p.TopicName, nil)
+			adapted, err := c.adaptPacket(pkt)
+			if err != nil {
+				c.rejectPacket(pkt, err)
+				continue
+			}
+
+			if p, ok := adapted.(*SubscribePacket); ok {
+				chunks, err := c.splitSubscribe(p)
+				if err != nil {
+					c.rejectPacket(pkt, err)
+					continue
 				}
-			case *DisconnPacket:
-				// client exit with disconnect
-				if err := c.connRW.Flush(); err != nil {
-					c.parent.log.e("NET flush error", err)
-					notifyNetMsg(c.parent.msgCh, c.name, err)
+
+				for _, chunk := range chunks {
+					if !sendClient(chunk) {
+						return
+					}
 				}
-				_ = c.conn.Close()
+				continue
+			}
 
-				c.exit()
+			if !sendClient(adapted) {
 				return
 			}
 		case pkt, more := <-c.logicSendC:
-			if !more {
+			if !sendLogic(pkt, more) {
 				return
 			}
+		}
+	}
+}
 
-			pkt.SetVersion(c.protoVersion)
-			if err := pkt.WriteTo(c.connRW); err != nil {
-				c.parent.log.e("NET encode error", err)
-				return
-			}
-			flushSig.Reset(flushDelayInterval)
-
-			switch pkt.(type) {
-			case *PubRelPacket:
-				notifyPersistMsg(c.parent.msgCh, pkt,
-					c.parent.persist.Store(sendKey(pkt.(*PubRelPacket).PacketID), pkt))
-			case *PubAckPacket:
-				notifyPersistMsg(c.parent.msgCh, pkt,
-					c.parent.persist.Delete(sendKey(pkt.(*PubAckPacket).PacketID)))
-			case *PubCompPacket:
-				notifyPersistMsg(c.parent.msgCh, pkt,
-					c.parent.persist.Delete(sendKey(pkt.(*PubCompPacket).PacketID)))
-			case *DisconnPacket:
-				// disconnect to server, no more action
-				if err := c.connRW.Flush(); err != nil {
-					c.parent.log.e("NET flush error", err)
-					notifyNetMsg(c.parent.msgCh, c.name, err)
-				}
-				_ = c.conn.Close()
+// disconnectMalformed disconnects with the reason code of the packet
+// received malformed (MQTT 5), handleSend closes the connection once sent
+func (c *clientConn) disconnectMalformed(err *MalformedPacketError) {
+	c.send(&DisconnPacket{Code: err.Code, Props: &DisconnProps{Reason: err.Reason}})
+	notifyNetMsg(c.parent.msgCh, c.name, &ProtocolError{Server: c.name, Reason: err.Code, Err: err})
 
-				c.exit()
-				return
-			}
+	timer := c.parent.clock.NewTimer(c.parent.options.dialTimeout)
+	select {
+	case <-c.stopSig:
+	case <-timer.C():
+	}
+	timer.Stop()
+	c.exit()
+}
+
+// resolveTopicAlias maps the Topic Alias of the publish packet received
+// (MQTT 5) to the topic name set, or sets the topic name mapped if empty,
+// aliases larger than the Topic Alias Maximum of the connect packet are
+// invalid (see WithInboundTopicAliasMax)
+func (c *clientConn) resolveTopicAlias(p *PublishPacket) *MalformedPacketError {
+	if p.Props == nil || p.Props.TopicAlias == 0 {
+		return nil
+	}
+
+	alias := int(p.Props.TopicAlias)
+	if alias > len(c.inAliases) {
+		return &MalformedPacketError{
+			Code:   CodeTopicAliasInvalid,
+			Reason: fmt.Sprintf("topic alias %d exceeds the maximum %d", alias, len(c.inAliases)),
 		}
 	}
+
+	if p.TopicName != "" {
+		if c.inAliases[alias-1] == "" {
+			atomic.AddInt32(&c.inAliasCount, 1)
+		}
+		c.inAliases[alias-1] = p.TopicName
+		return nil
+	}
+
+	topic := c.inAliases[alias-1]
+	if topic == "" {
+		return &MalformedPacketError{Code: CodeProtoError, Reason: fmt.Sprintf("topic alias %d not mapped", alias)}
+	}
+	p.TopicName = topic
+	return nil
 }
 
 // handle all message receive
 func (c *clientConn) handleNetRecv() {
 	c.parent.log.v("NET clientConn.handleNetRecv() for server =", c.name)
 
+	interceptors := c.options.recvInterceptors
 	defer func() {
 		c.parent.log.v("NET exit clientConn.handleNetRecv() for server =", c.name)
 		close(c.netRecvC)
@@ -347,12 +1104,21 @@ func (c *clientConn) handleNetRecv() {
 	}()
 
 	for {
-		pkt, err := Decode(c.protoVersion, c.connRW)
+		c.refreshReadDeadline()
+		pkt, err := decode(c.protoVersion, c.connR, c.maxRecvSize, c.parent.pubPool, c.parent.streamMatcher())
 		if err != nil {
+			if e, ok := err.(net.Error); ok && e.Timeout() {
+				c.parent.log.e("NET read timeout, nothing received from server =", c.name, "timeout =", c.readTimeout)
+			}
 			c.parent.log.e("NET connection broken, server =", c.name, "err =", err)
 
+			if e, ok := err.(*MalformedPacketError); ok && c.protoVersion == V5 {
+				c.disconnectMalformed(e)
+				return
+			}
+
 			// exit client connection
-			notifyNetMsg(c.parent.msgCh, c.name, err)
+			notifyNetMsg(c.parent.msgCh, c.name, recvError(c.name, err))
 			c.exit()
 			return
 		}
@@ -364,19 +1130,297 @@ func (c *clientConn) handleNetRecv() {
 			return
 		}
 
+		if p, ok := pkt.(*PublishPacket); ok && c.protoVersion == V5 {
+			if err := c.resolveTopicAlias(p); err != nil {
+				c.parent.log.e("NET protocol error, server =", c.name, "err =", err)
+				p.release()
+				c.disconnectMalformed(err)
+				return
+			}
+		}
+
+		c.parent.stripPacket(pkt)
+		if len(interceptors) > 0 {
+			intercepted := intercept(interceptors, c.name, pkt)
+			if intercepted == nil {
+				c.parent.log.d("NET received packet dropped by interceptor", pkt)
+				if p, ok := pkt.(*PublishPacket); ok && p.PayloadReader != nil {
+					// discard the payload to read the next packet
+					if _, err := io.Copy(ioutil.Discard, p.PayloadReader); err != nil {
+						notifyNetMsg(c.parent.msgCh, c.name, recvError(c.name, err))
+						c.exit()
+						return
+					}
+				} else if ok {
+					p.release()
+				}
+				continue
+			}
+			pkt = intercepted
+		}
+
+		if p, ok := pkt.(*PublishPacket); ok {
+			// metadata for handlers (see PublishMeta)
+			p.server, p.recvAt = c.name, c.parent.clock.Now()
+		}
+
+		if p, ok := pkt.(*DisconnPacket); ok {
+			// the server closes the connection once sent
+			c.parent.log.e("NET disconnected by server =", c.name, "code =", p.Code, "reason =", p.Props.reason())
+			c.setDisconnected(p)
+			c.exit()
+			return
+		}
+
+		if p, ok := pkt.(*PublishPacket); ok && p.PayloadReader != nil {
+			// payload read as fast as the handler consumes
+			c.clearReadDeadline()
+			if err := c.handleStream(p); err != nil {
+				c.parent.log.e("NET connection broken, server =", c.name, "err =", err)
+
+				notifyNetMsg(c.parent.msgCh, c.name, recvError(c.name, err))
+				c.exit()
+				return
+			}
+			continue
+		}
+
 		if pkt.Type() == CtrlPingResp {
 			c.parent.log.d("NET received keepalive message")
-			select {
-			case c.keepaliveC <- struct{}{}:
-			case <-c.stopSig:
+			if c.pingResp() {
+				select {
+				case c.keepaliveC <- struct{}{}:
+				case <-c.stopSig:
+				}
 			}
 		} else {
 			select {
 			case c.netRecvC <- pkt:
+			default:
+				// logic is busy, the server is still alive but the
+				// keepalive response can not be read until it's done
+				atomic.StoreUint32(&c.recvBusy, 1)
+				select {
+				case c.netRecvC <- pkt:
+				case <-c.stopSig:
+				}
+				atomic.StoreUint32(&c.recvBusy, 0)
+			}
+		}
+	}
+}
+
+// handleStream calls the stream handler with the payload streamed from
+// the connection, and send the ack once the handler returned, error is
+// returned only when failed to read the connection
+func (c *clientConn) handleStream(p *PublishPacket) error {
+	c.parent.log.v("NET received", p)
+
+	// the keepalive response can not be read until the handler returned
+	atomic.StoreUint32(&c.recvBusy, 1)
+	handleErr := c.parent.handleStream(p)
+	atomic.StoreUint32(&c.recvBusy, 0)
+
+	// discard payload not read by the handler
+	if _, err := io.Copy(ioutil.Discard, p.PayloadReader); err != nil {
+		return err
+	}
+
+	code := byte(CodeSuccess)
+	if handleErr != nil {
+		c.parent.log.e("CLI stream handler failed, topic =", p.TopicName, "err =", handleErr)
+		if c.protoVersion != V5 {
+			// no ack, MQTT 3.1.1 servers redeliver the packet only once
+			// reconnected with a persistent session
+			return nil
+		}
+
+		code = CodeUnspecifiedError
+		if e, ok := handleErr.(interface{ ReasonCode() byte }); ok {
+			code = e.ReasonCode()
+		}
+	}
+
+	switch p.Qos {
+	case Qos1:
+		c.send(&PubAckPacket{PacketID: p.PacketID, Code: code})
+	case Qos2:
+		c.send(&PubRecvPacket{PacketID: p.PacketID, Code: code})
+	}
+	return nil
+}
+
+// deliver the received publish packet to client, apply the recv
+// overflow policy if the recv buffer is full
+func (c *clientConn) deliver(p *PublishPacket) {
+	if c.tryDeliver(p) {
+		return
+	}
+
+	select {
+	case c.parent.recvCh <- p:
+	case <-c.stopSig:
+	}
+}
+
+// tryDeliver is deliver without blocking, false is returned if the recv
+// buffer is full and the packet is neither delivered nor dropped by the
+// recv overflow policy
+func (c *clientConn) tryDeliver(p *PublishPacket) bool {
+	if !c.validPayloadFormat(p) {
+		p.InvalidPayloadFormat = true
+	}
+
+	select {
+	case c.parent.recvCh <- p:
+		return true
+	default:
+	}
+
+	switch c.parent.recvOverflow {
+	case RecvOverflowDropOldest:
+		for {
+			select {
+			case c.parent.recvCh <- p:
+				return true
+			case old := <-c.parent.recvCh:
+				c.parent.dropRecv(old)
 			case <-c.stopSig:
+				return true
 			}
 		}
+	case RecvOverflowSpillQos0:
+		if p.Qos == Qos0 {
+			c.parent.dropRecv(p)
+			return true
+		}
+	}
+
+	return false
+}
+
+// validPayloadFormat validates the payload format of the received publish
+// packet if enabled (WithPayloadFormatValidation)
+func (c *clientConn) validPayloadFormat(p *PublishPacket) bool {
+	return !c.parent.validatePayloadFormat || c.protoVersion != V5 || validPayloadFormat(p)
+}
+
+// rejectPublish drops the received publish packet, QoS1/QoS2 packets are
+// acked with the reason code
+func (c *clientConn) rejectPublish(p *PublishPacket, code byte) {
+	c.parent.log.w("NET rejected publish, topic =", p.TopicName, "id =", p.PacketID, "code =", code)
+	switch p.Qos {
+	case Qos1:
+		c.send(&PubAckPacket{PacketID: p.PacketID, Code: code})
+	case Qos2:
+		c.send(&PubRecvPacket{PacketID: p.PacketID, Code: code})
+	}
+	p.release()
+}
+
+// deliverAck delivers the received QoS1 publish packet or the released
+// QoS2 publish packet to client, and acks it (unless in manual ack mode)
+func (c *clientConn) deliverAck(p *PublishPacket) {
+	manualAck := c.parent.manualAck
+	if manualAck {
+		c.addPendingAck(p)
+	}
+
+	c.deliverPub(p, !manualAck)
+}
+
+// deliverPub delivers the received publish packet and acks it if ack, or
+// leaves the delivery (and the ack) blocked to logic if recvCh is full
+func (c *clientConn) deliverPub(p *PublishPacket, ack bool) {
+	if !c.tryDeliver(p) {
+		c.recvBlocked = recvItem{pub: p, ack: ack}
+		return
+	}
+
+	if ack {
+		c.sendPubAck(p)
+	}
+}
+
+// recvQos2 stores the received QoS2 publish packet and sends PubRec,
+// duplicate packets are not stored again until released by PubRel
+func (c *clientConn) recvQos2(p *PublishPacket) {
+	stored, exceeded := c.parent.storeQos2Max(c.persistNS, p, c.recvMax)
+	if exceeded {
+		if c.protoVersion == V5 {
+			c.protocolError(&MalformedPacketError{
+				Code:   CodeReceiveMaxExceeded,
+				Reason: fmt.Sprintf("more than %d QoS2 publish packets not completed", c.recvMax),
+			})
+			return
+		}
+
+		c.parent.log.w("NET too many QoS2 publish packets not completed, dropped packet, id =", p.PacketID, "max =", c.recvMax)
+		return
+	}
+
+	if !stored {
+		c.parent.log.d("NET received duplicate QoS2 publish, id =", p.PacketID)
+	}
+
+	pubRecv := &PubRecvPacket{PacketID: p.PacketID}
+	c.parent.log.d("NET send", pubRecv)
+	c.send(pubRecv)
+}
+
+// sendPubAck tend to QoS of the delivered publish packet, with the reason
+// code and reason string of the ack if supported
+func (c *clientConn) sendPubAck(p *PublishPacket) {
+	code, reason := p.ackCode, p.ackReason
+	if code != CodeSuccess && (c.protoVersion != V5 || p.Qos != Qos1) {
+		c.parent.log.w("NET ack reason not sent to server, id =", p.PacketID, "code =", code, "reason =", reason)
+		code, reason = CodeSuccess, ""
+	}
+
+	switch p.Qos {
+	case Qos1:
+		pubAck := &PubAckPacket{PacketID: p.PacketID, Code: code}
+		if reason != "" {
+			pubAck.Props = &PubAckProps{Reason: reason}
+		}
+		c.parent.log.d("NET send", pubAck)
+		c.send(pubAck)
+	case Qos2:
+		pubComp := &PubCompPacket{PacketID: p.PacketID}
+		c.parent.log.d("NET send", pubComp)
+		c.send(pubComp)
+		// flow completed, PubRel received again is answered with PubComp
+		c.parent.completeQos2(c.persistNS, p.PacketID)
+	}
+}
+
+// addPendingAck appends the received publish packet to the pending ack list
+func (c *clientConn) addPendingAck(p *PublishPacket) {
+	c.ackMu.Lock()
+	p.ackConn = c
+	c.pendingAcks = append(c.pendingAcks, p)
+	c.ackMu.Unlock()
+}
+
+// ack marks the publish packet as acked with the reason code, since MQTT
+// requires acks to be sent in the receiving order, only acks of the leading
+// acked packets in the pending list are sent, the rest wait for the lowest
+// outstanding packet
+func (c *clientConn) ack(p *PublishPacket, code byte, reason string) {
+	c.ackMu.Lock()
+	defer c.ackMu.Unlock()
+
+	if p.acked {
+		return
+	}
+	p.acked, p.ackCode, p.ackReason = true, code, reason
+
+	n := 0
+	for ; n < len(c.pendingAcks) && c.pendingAcks[n].acked; n++ {
+		c.sendPubAck(c.pendingAcks[n])
+		c.pendingAcks[n] = nil
 	}
+	c.pendingAcks = c.pendingAcks[n:]
 }
 
 // send mqtt logic packet
@@ -0,0 +1,154 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"crypto/tls"
+	"net"
+	"strings"
+	"time"
+)
+
+// ConnInfo is the snapshot of the connection to a server
+type ConnInfo struct {
+	// Server connected
+	Server string
+	// ClientID is the client id of the connection, the id assigned by the
+	// server if the client id was empty (MQTT 5)
+	ClientID string
+	// Version is the MQTT version accepted by the server, may be lower
+	// than configured with protocol version fallback (WithVersionFallback)
+	Version ProtoVersion
+	// Props are the ConnAck properties sent by the server, nil if not
+	// available (MQTT 3.1.1 and MQTT 3.1)
+	Props *ConnAckProps
+	// ResponseInfo is the Response Information of ConnAck (MQTT 5), the
+	// topic prefix of responses if requested with WithRequestResponseInfo
+	ResponseInfo string
+	// Reason is the Reason String of ConnAck (MQTT 5)
+	Reason string
+	// LocalAddr and RemoteAddr are the addresses of the connection
+	LocalAddr  net.Addr
+	RemoteAddr net.Addr
+	// TLS is the state of the TLS connection (negotiated version, cipher
+	// suite and the peer certificate chain), nil if not connected with TLS
+	// (or TLS handled by the transport, e.g. websocket)
+	TLS *tls.ConnectionState
+	// ConnectedAt is the time when the ConnAck received
+	ConnectedAt time.Time
+	// BytesSent and BytesReceived are the bytes of the connection (see
+	// ClientStats.BytesSent for bytes of all connections)
+	BytesSent     uint64
+	BytesReceived uint64
+}
+
+// ConnInfo returns the info of the connection to the server, false if
+// the server is not connected (ConnAck not received or connection lost),
+// safe to call concurrently
+func (c *AsyncClient) ConnInfo(server string) (ConnInfo, bool) {
+	val, ok := c.connectedServers.Load(server)
+	if !ok {
+		return ConnInfo{}, false
+	}
+
+	conn := val.(*clientConn)
+	info := conn.getConnInfo()
+	if info == nil {
+		return ConnInfo{}, false
+	}
+
+	snapshot := *info
+	if conn.counted != nil {
+		snapshot.BytesSent, snapshot.BytesReceived = conn.counted.counts()
+	}
+	return snapshot, true
+}
+
+// ResponseTopic returns the response topic of requests sent to the server
+// (see PubResponseTopic), topic is prefixed with the Response Information
+// of the server if available (see WithRequestResponseInfo), servers usually
+// only authorize clients to subscribe the topics with the prefix, the topic
+// returned is marked absolute (see AbsoluteTopic) with the topic prefix
+// (see WithTopicPrefix), and can be used to subscribe and handle responses
+func (c *AsyncClient) ResponseTopic(server, topic string) string {
+	info, ok := c.ConnInfo(server)
+	if !ok || info.ResponseInfo == "" {
+		return topic
+	}
+
+	respTopic := info.ResponseInfo + topic
+	if !strings.HasSuffix(info.ResponseInfo, "/") {
+		respTopic = info.ResponseInfo + "/" + topic
+	}
+
+	if c.topicPrefix != "" {
+		return AbsoluteTopic(respTopic)
+	}
+	return respTopic
+}
+
+// newConnInfo creates the connection info once ConnAck received, rawConn
+// is the connection before wrapped by ConnWrapper
+func newConnInfo(server string, version ProtoVersion, clientID string, conn, rawConn net.Conn, props *ConnAckProps) *ConnInfo {
+	if props != nil && props.AssignedClientID != "" {
+		clientID = props.AssignedClientID
+	}
+
+	info := &ConnInfo{
+		Server:      server,
+		ClientID:    clientID,
+		Version:     version,
+		Props:       props,
+		LocalAddr:   conn.LocalAddr(),
+		RemoteAddr:  conn.RemoteAddr(),
+		ConnectedAt: time.Now(),
+	}
+
+	if props != nil {
+		info.ResponseInfo, info.Reason = props.RespInfo, props.Reason
+	}
+
+	if tlsConn, ok := rawConn.(interface{ ConnectionState() tls.ConnectionState }); ok {
+		if state := tlsConn.ConnectionState(); state.HandshakeComplete {
+			info.TLS = &state
+		}
+	}
+
+	return info
+}
+
+// setNegotiatedVersion remembers the version accepted by the server
+func (c *AsyncClient) setNegotiatedVersion(server string, version ProtoVersion) {
+	c.versionsMu.Lock()
+	if c.versions == nil {
+		c.versions = make(map[string]ProtoVersion)
+	}
+	c.versions[server] = version
+	c.versionsMu.Unlock()
+}
+
+// negotiatedVersion returns the version accepted by the server before if
+// lower than the version, versions refused are skipped on reconnect
+func (c *AsyncClient) negotiatedVersion(server string, version ProtoVersion) ProtoVersion {
+	c.versionsMu.Lock()
+	defer c.versionsMu.Unlock()
+
+	if v, ok := c.versions[server]; ok && v < version {
+		return v
+	}
+	return version
+}
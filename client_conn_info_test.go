@@ -0,0 +1,194 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// wrappedConn hides the TLS connection like connection wrappers
+type wrappedConn struct {
+	net.Conn
+}
+
+func TestClient_ConnInfo(t *testing.T) {
+	cert, err := tls.LoadX509KeyPair("testdata/client-cert.pem", "testdata/client-key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		serverMu   sync.Mutex
+		serverConn net.Conn
+		connected  = make(chan struct{}, 1)
+	)
+	client, err := NewClient(
+		WithBackoffStrategy(time.Hour, time.Hour, 1),
+		WithConnWrapper(func(name string, conn net.Conn) net.Conn { return &wrappedConn{conn} }),
+		WithCustomConnector(func(ctx context.Context, address string, timeout time.Duration, tlsConfig *tls.Config) (net.Conn, error) {
+			client, server := net.Pipe()
+			serverMu.Lock()
+			serverConn = server
+			serverMu.Unlock()
+
+			go fakeBroker(tls.Server(server, &tls.Config{Certificates: []tls.Certificate{cert}}), true)
+			return tls.Client(client, &tls.Config{InsecureSkipVerify: true}), nil
+		}),
+		WithConnHandleFunc(func(client Client, server string, code byte, err error) {
+			if code == CodeSuccess {
+				connected <- struct{}{}
+			}
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Destroy(true)
+
+	start := time.Now()
+	if err := client.ConnectServer("fake"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not connected")
+	}
+
+	info, ok := client.ConnInfo("fake")
+	if !ok {
+		t.Fatal("no conn info once connected")
+	}
+
+	if info.Server != "fake" || info.Version != V311 || info.Props != nil ||
+		info.LocalAddr == nil || info.RemoteAddr == nil || info.ConnectedAt.Before(start) {
+		t.Errorf("unexpected conn info %+v", info)
+	}
+
+	if info.TLS == nil {
+		t.Fatal("no tls state")
+	}
+	if info.TLS.Version == 0 || info.TLS.CipherSuite == 0 || len(info.TLS.PeerCertificates) != 1 ||
+		!bytes.Equal(info.TLS.PeerCertificates[0].Raw, cert.Certificate[0]) {
+		t.Errorf("unexpected tls state %+v", info.TLS)
+	}
+
+	// cleared once connection lost
+	serverMu.Lock()
+	_ = serverConn.Close()
+	serverMu.Unlock()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := client.ConnInfo("fake"); !ok {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("conn info not cleared after connection lost")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestClient_ResponseInfo(t *testing.T) {
+	var (
+		received  = make(chan *ConnPacket, 1)
+		connected = make(chan struct{}, 1)
+	)
+	client, err := NewClient(
+		WithVersion(V5, false),
+		WithRequestResponseInfo(true),
+		WithRequestProblemInfo(false),
+		WithCustomConnector(func(ctx context.Context, address string, timeout time.Duration, tlsConfig *tls.Config) (net.Conn, error) {
+			client, server := net.Pipe()
+			go func() {
+				defer func() { _ = server.Close() }()
+				pkt, err := Decode(V5, bufio.NewReader(server))
+				if err != nil {
+					return
+				}
+				received <- pkt.(*ConnPacket)
+
+				w := bufio.NewWriter(server)
+				ack := &ConnAckPacket{Props: &ConnAckProps{RespInfo: "resp/cid", Reason: "welcome"}}
+				ack.SetVersion(V5)
+				_ = ack.WriteTo(w)
+				_ = w.Flush()
+				_, _ = io.Copy(ioutil.Discard, server)
+			}()
+			return client, nil
+		}),
+		WithConnHandleFunc(func(client Client, server string, code byte, err error) {
+			if code == CodeSuccess {
+				connected <- struct{}{}
+			}
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Destroy(true)
+
+	if topic := client.ResponseTopic("fake", "rpc/1"); topic != "rpc/1" {
+		t.Error("unexpected response topic before connected =", topic)
+	}
+
+	if err := client.ConnectServer("fake"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case pkt := <-received:
+		if props := pkt.Props; props == nil || props.ReqRespInfo == nil || !*props.ReqRespInfo ||
+			props.ReqProblemInfo == nil || *props.ReqProblemInfo {
+			t.Errorf("unexpected connect props %+v", props)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("connect packet not received")
+	}
+
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not connected")
+	}
+
+	if info, ok := client.ConnInfo("fake"); !ok || info.ResponseInfo != "resp/cid" || info.Reason != "welcome" {
+		t.Errorf("unexpected conn info %+v", info)
+	}
+
+	if topic := client.ResponseTopic("fake", "rpc/1"); topic != "resp/cid/rpc/1" {
+		t.Error("unexpected response topic =", topic)
+	}
+
+	// the response information is not prefixed
+	client.topicPrefix = "tenant/"
+	if topic := client.ResponseTopic("fake", "rpc/1"); topic != AbsoluteTopic("resp/cid/rpc/1") {
+		t.Errorf("unexpected response topic with prefix = %q", topic)
+	}
+}
@@ -20,13 +20,16 @@ import (
 	"bufio"
 	"context"
 	"crypto/tls"
+	"io"
 	"math"
 	"net"
+	"sync/atomic"
 	"time"
 )
 
 // ConnectServer connect to server with connection specific options
-// only return errors happened when applying options
+// only return errors happened when applying options, the client destroyed
+// (see Destroy) is restarted
 func (c *AsyncClient) ConnectServer(server string, connOptions ...Option) error {
 	options := c.options.clone()
 
@@ -36,11 +39,112 @@ func (c *AsyncClient) ConnectServer(server string, connOptions ...Option) error
 		}
 	}
 
+	if err := options.requireV5(options.protoVersion, server); err != nil {
+		return err
+	}
+
+	if err := options.validateClientID(); err != nil {
+		return err
+	}
+
+	c.restart()
 	c.addWorker(func() { options.connect(c, server, options.protoVersion, options.firstDelay) })
 
 	return nil
 }
 
+// ConnectWith connect to server over the established connection conn
+// without dialing (e.g. connection handed over by custom transports, or
+// net.Pipe in tests), the connect handshake and packets are the same as
+// ConnectServer, server is the name of the connection used in handlers
+// and persist keys, only return errors happened when applying options
+//
+// the Connector set in connOptions (see WithCustomConnector) is used to get
+// fresh connections to reconnect, if not set, auto reconnect is disabled and
+// ErrConnNotReusable is notified to the ConnHandleFunc once connection lost
+func (c *AsyncClient) ConnectWith(conn net.Conn, server string, connOptions ...Option) error {
+	if conn == nil {
+		return ErrConnNotReusable
+	}
+
+	options := c.options.clone()
+	options.newConnection = nil
+
+	for _, setOption := range connOptions {
+		if err := setOption(c, &options); err != nil {
+			return err
+		}
+	}
+
+	if err := options.requireV5(options.protoVersion, server); err != nil {
+		return err
+	}
+
+	if err := options.validateClientID(); err != nil {
+		return err
+	}
+
+	reconnect := options.newConnection
+	if reconnect == nil {
+		options.autoReconnect = false
+	}
+
+	used := uint32(0)
+	options.newConnection = func(ctx context.Context, address string, timeout time.Duration, tlsConfig *tls.Config) (net.Conn, error) {
+		if atomic.CompareAndSwapUint32(&used, 0, 1) {
+			return conn, nil
+		}
+
+		if reconnect == nil {
+			return nil, ErrConnNotReusable
+		}
+		return reconnect(ctx, address, timeout, tlsConfig)
+	}
+
+	c.restart()
+	c.addWorker(func() { options.connect(c, server, options.protoVersion, options.firstDelay) })
+
+	return nil
+}
+
+// Reconnect connects again to servers refused with ConnAck codes not
+// retried (see WithNonRetryableConnCodes), e.g. after credentials fixed
+// with WithIdentity in options, options are applied to connections of all
+// these servers, only return errors happened when applying options, no
+// server is reconnected (they are still stopped) on error
+func (c *AsyncClient) Reconnect(connOptions ...Option) error {
+	c.stoppedMu.Lock()
+	stopped := make(map[string]connectOptions, len(c.stopped))
+	for server, options := range c.stopped {
+		options := options.clone()
+		for _, setOption := range connOptions {
+			if err := setOption(c, &options); err != nil {
+				c.stoppedMu.Unlock()
+				return err
+			}
+		}
+		stopped[server] = options
+	}
+	c.stopped = make(map[string]connectOptions)
+	c.stoppedMu.Unlock()
+
+	c.restart()
+	for server, options := range stopped {
+		server, options := server, options
+		c.log.i("CLI reconnecting to stopped server =", server)
+		c.addWorker(func() { options.connect(c, server, options.protoVersion, options.firstDelay) })
+	}
+
+	return nil
+}
+
+// stopConnect records the server refused and not reconnected
+func (c *AsyncClient) stopConnect(server string, options connectOptions) {
+	c.stoppedMu.Lock()
+	c.stopped[server] = options
+	c.stoppedMu.Unlock()
+}
+
 func defaultConnectOptions() connectOptions {
 	return connectOptions{
 		protoVersion:    V311,
@@ -53,6 +157,10 @@ func defaultConnectOptions() connectOptions {
 		keepalive:       2 * time.Minute,
 		keepaliveFactor: 1.5,
 		connPacket:      &ConnPacket{},
+		flushPolicy:     FlushPolicy{Delay: 100 * time.Microsecond},
+		qosDowngrade:    true,
+		readBufSize:     defaultConnBufSize,
+		writeBufSize:    defaultConnBufSize,
 
 		newConnection: func(ctx context.Context, address string, timeout time.Duration, tlsConfig *tls.Config) (conn net.Conn, e error) {
 			return tcpConnect(ctx, address, timeout, 0, tlsConfig)
@@ -68,77 +176,328 @@ type connectOptions struct {
 	protoCompromise bool
 
 	tlsConfig     *tls.Config // tls config with client side cert
+	alpn          []string    // ALPN protocols merged into tlsConfig (WithALPN)
 	maxDelay      time.Duration
 	firstDelay    time.Duration
 	backOffFactor float64
 	autoReconnect bool
-
-	connPacket      *ConnPacket
-	keepalive       time.Duration // used by ConnPacket (time in second)
-	keepaliveFactor float64       // used for reasonable amount time to close conn if no ping resp
+	resubscribe   bool   // subscribe again if the session not present (WithAutoResubscribe)
+	recvMax       uint16 // max QoS2 flows received not completed (WithRecvMaximum)
+
+	inboundAliasMax uint16 // Topic Alias Maximum of the connect packet (WithInboundTopicAliasMax)
+
+	nonRetryableCodes map[byte]bool // ConnAck codes not reconnected, nil for default
+
+	takeoverHandler  TakeoverHandleFunc // called once the session taken over
+	takeoverCloses   int                // short connections in a row to suspect takeover, 0 to disable
+	takeoverWithin   time.Duration      // connections closed within are short connections
+	takeoverCooldown time.Duration      // min reconnect delay once the session taken over
+
+	connPacket        *ConnPacket
+	serverUserProps   map[string]UserProps // connect user properties by server (WithServerConnUserProps)
+	persistentSession bool                 // clean session unset explicitly, client id required before MQTT 5
+	serversSet        bool                 // WithServer or WithSecureServer applied
+	strictClientID    bool                 // validate client id with MQTT 3.1.1 rules
+	customConnPacket  ConnPacketFunc       // customize connPacket before every connect attempt
+	credentials       CredentialsProvider  // overrides username and password of connPacket
+	keepalive         time.Duration        // used by ConnPacket (time in second)
+	keepaliveFactor   float64              // used for reasonable amount time to close conn if no ping resp
+
+	flushPolicy  FlushPolicy   // when to flush written packets
+	readBufSize  int           // size of connection read buffer
+	writeBufSize int           // size of connection write buffer
+	directWrite  bool          // write packets without write buffer
+	writeTimeout time.Duration // timeout of every connection write, 0 for keepalive timeout
+	readTimeout  time.Duration // max time without packets received, 0 for keepalive timeout after PingReq
+
+	retryInterval time.Duration // resend interval of unacked packets, 0 to disable
+	maxRetries    int           // max resend times of unacked packets, 0 for no limit
+	qosDowngrade  bool          // downgrade publish QoS to the max QoS of server
+
+	sendInterceptors []PacketInterceptor // called before packets written
+	recvInterceptors []PacketInterceptor // called after packets decoded
 
 	newConnection Connector
+	connWrappers  []ConnWrapper     // applied to connections established
+	validators    []OptionValidator // run by NewClient once options applied
+	tcpOptions    *TCPOptions       // socket options of TCP connections
+
+	life *lifecycle // lifecycle of the client the connect started with, not cloned
+}
+
+// retryable returns true if the connect refused with the ConnAck code
+// should be retried by auto reconnect
+func (c connectOptions) retryable(version ProtoVersion, code byte) bool {
+	if c.nonRetryableCodes != nil {
+		return !c.nonRetryableCodes[code]
+	}
+
+	return !isFatalConnErr(ConnAckError(version, code))
+}
+
+// sendTimeout returns the timeout of connection writes, the keepalive
+// timeout is used if not set, 0 if disabled
+func (c connectOptions) sendTimeout() time.Duration {
+	if c.writeTimeout != 0 {
+		if c.writeTimeout < 0 {
+			return 0
+		}
+		return c.writeTimeout
+	}
+
+	return time.Duration(float64(c.keepalive) * c.keepaliveFactor)
+}
+
+// recvTimeout returns the max time without packets received, 1.5 times
+// the keepalive interval if not set (or the keepalive timeout once PingReq
+// sent if longer, not to expire before PingResp is late), 0 if disabled
+func (c connectOptions) recvTimeout() time.Duration {
+	if c.readTimeout != 0 {
+		if c.readTimeout < 0 {
+			return 0
+		}
+		return c.readTimeout
+	}
+
+	// PingReq sent every 3/4 of the keepalive interval
+	factor := math.Max(1.5, 0.75+c.keepaliveFactor)
+	return time.Duration(float64(c.keepalive) * factor)
+}
+
+// requireV5 returns the error if connect properties requiring MQTT 5
+// (authentication or user properties) are set for the server but
+// connecting with version
+func (c connectOptions) requireV5(version ProtoVersion, server string) error {
+	switch {
+	case version >= V5:
+		return nil
+	case c.connPacket.Props.hasAuth():
+		return ErrAuthRequiresV5
+	case c.connPacket.Props != nil && len(c.connPacket.Props.UserProps) > 0, len(c.serverUserProps[server]) > 0:
+		return ErrPropsRequireV5
+	}
+	return nil
+}
+
+// applyServerUserProps replaces user properties of the connect packet with
+// those of the server of the same key (see WithServerConnUserProps)
+func (c connectOptions) applyServerUserProps(server string, pkt *ConnPacket) {
+	override, ok := c.serverUserProps[server]
+	if !ok {
+		return
+	}
+
+	if pkt.Props == nil {
+		pkt.Props = &ConnProps{}
+	}
+	for _, p := range override {
+		pkt.Props.UserProps = pkt.Props.UserProps.without(p.Key)
+	}
+	pkt.Props.UserProps = append(pkt.Props.UserProps, override...)
+}
+
+// applyRecvLimits sets the Receive Maximum and the Topic Alias Maximum of
+// the connect packet (MQTT 5) if configured (see WithRecvMaximum and
+// WithInboundTopicAliasMax)
+func (c connectOptions) applyRecvLimits(pkt *ConnPacket) {
+	if c.recvMax == 0 && c.inboundAliasMax == 0 || pkt.ProtoVersion != V5 {
+		return
+	}
+
+	if pkt.Props == nil {
+		pkt.Props = &ConnProps{}
+	}
+	if c.recvMax > 0 {
+		pkt.Props.MaxRecv = c.recvMax
+	}
+	if c.inboundAliasMax > 0 {
+		pkt.Props.MaxTopicAlias = c.inboundAliasMax
+	}
+}
+
+// inboundTopicAliasMax returns the Topic Alias Maximum of the connect
+// packet (MQTT 5), 0 if topic aliases not accepted
+func inboundTopicAliasMax(connPkt *ConnPacket) int {
+	if connPkt.ProtoVersion != V5 || connPkt.Props == nil {
+		return 0
+	}
+	return int(connPkt.Props.MaxTopicAlias)
+}
+
+// recvMaxFlows returns the max QoS2 flows received not completed, the
+// Receive Maximum of the connect packet (MQTT 5) or the local limit
+// (WithRecvMaximum), 0 for no limit
+func (c connectOptions) recvMaxFlows(connPkt *ConnPacket) int {
+	if connPkt.ProtoVersion == V5 && connPkt.Props != nil && connPkt.Props.MaxRecv > 0 {
+		return int(connPkt.Props.MaxRecv)
+	}
+	return int(c.recvMax)
+}
+
+// recvMaxPacketSize returns the Maximum Packet Size of the connect packet,
+// 0 for no limit
+func recvMaxPacketSize(connPkt *ConnPacket) int {
+	if connPkt.Props == nil {
+		return 0
+	}
+	return int(connPkt.Props.MaxPacketSize)
+}
+
+func (c connectOptions) newConnWriter(conn net.Conn) connWriter {
+	var w io.Writer = conn
+	if timeout := c.sendTimeout(); timeout > 0 {
+		w = &deadlineWriter{conn: conn, timeout: timeout}
+	}
+
+	if c.directWrite {
+		return &directWriter{w: w}
+	}
+
+	return bufio.NewWriterSize(w, c.writeBufSize)
 }
 
 func (c connectOptions) connect(parent *AsyncClient, server string, version ProtoVersion, reconnectDelay time.Duration) {
 	var (
-		conn net.Conn
-		err  error
+		conn     net.Conn
+		rawConn  net.Conn      // conn before wrapped by connWrappers
+		counted  *countingConn // counts bytes of rawConn
+		connPkt  *ConnPacket
+		err      error
+		cooldown time.Duration // min reconnect delay once the session taken over
+		username = c.connPacket.Username
+		password = c.connPacket.Password
+		stored   *clientConn // conn stored in connectedServers
 	)
 
 	parent.log.v("NET connectOptions.connect()")
-	defer parent.connectedServers.Delete(server)
+	if c.life == nil {
+		// reconnects keep the lifecycle, stop once the client destroyed
+		c.life = parent.lifecycle()
+	}
+	defer func() { parent.deleteConn(server, stored) }()
 
-	conn, err = c.newConnection(parent.ctx, server, c.dialTimeout, c.tlsConfig)
-	if err != nil {
+	if c.protoCompromise {
+		// skip versions refused by the server before
+		version = parent.negotiatedVersion(server, version)
+	}
+
+	if err := c.requireV5(version, server); err != nil {
+		// e.g. server requires MQTT 3.1.1 with protocol compromise
 		parent.log.e("CLI connect server failed, err =", err, ", server =", server)
-		if c.connHandler != nil {
-			parent.addWorker(func() { c.connHandler(parent, server, math.MaxUint8, err) })
+		c.notifyConn(parent, server, math.MaxUint8, err)
+		return
+	}
+
+	if n := len(c.connPacket.ClientID); version == V31 && (n == 0 || n > maxClientIDLenV31) {
+		// MQTT 3.1 servers may refuse with CodeIdentifierRejected
+		parent.log.w("CLI client id should be 1 to 23 characters for MQTT 3.1, server =", server)
+	}
+
+	if c.credentials != nil {
+		ctx, cancel := context.WithTimeout(c.life.ctx, c.dialTimeout)
+		username, password, err = c.credentials(ctx, server)
+		cancel()
+
+		if err != nil {
+			parent.log.e("CLI get credentials failed, err =", err, ", server =", server)
+			c.notifyConn(parent, server, math.MaxUint8, err)
+
+			if c.autoReconnect && !c.life.closing() {
+				goto reconnect
+			}
+
+			return
+		}
+	}
+
+	connPkt = c.connPacket.clone()
+	connPkt.ProtoVersion = version
+	connPkt.Username, connPkt.Password = username, password
+	c.applyServerUserProps(server, connPkt)
+	c.applyRecvLimits(connPkt)
+	if c.customConnPacket != nil {
+		if p := c.customConnPacket(server, connPkt); p != nil {
+			connPkt = p
 		}
+		connPkt.ProtoVersion = version
+
+		if err = c.validateConnPacket(parent, version, connPkt); err != nil {
+			parent.log.e("CLI custom connect packet invalid, err =", err, ", server =", server)
+			c.notifyConn(parent, server, math.MaxUint8, err)
+			return
+		}
+	}
+
+	conn, err = c.newConnection(c.life.ctx, server, c.dialTimeout, c.alpnConfig())
+	if err != nil {
+		err = dialError(server, err)
+	} else if err = c.verifyALPN(conn); err != nil {
+		_ = conn.Close()
+		err = &HandshakeError{Server: server, Err: err}
+	}
+	if err != nil {
+		parent.log.e("CLI connect server failed, err =", err, ", server =", server)
+		c.notifyConn(parent, server, math.MaxUint8, err)
 
-		if c.autoReconnect && !parent.isClosing() {
+		if c.autoReconnect && !c.life.closing() {
 			goto reconnect
 		}
 
 		return
 	}
 
+	if c.tcpOptions != nil {
+		if err := c.tcpOptions.apply(conn); err != nil {
+			parent.log.w("CLI set tcp options failed, err =", err, ", server =", server)
+		}
+	}
+
+	rawConn = conn
+	counted = &countingConn{Conn: conn, parent: parent}
+	conn = c.wrapConn(server, counted)
 	defer func() { _ = conn.Close() }()
 
 	{
-		if parent.isClosing() {
+		if c.life.closing() {
 			return
 		}
 
 		connImpl := &clientConn{
 			protoVersion: version,
 			parent:       parent,
+			options:      &c,
 			name:         server,
+			persistNS:    persistNamespace(connPkt.ClientID, server),
 			conn:         conn,
-			connRW:       bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)),
+			counted:      counted,
+			connR:        bufio.NewReaderSize(conn, c.readBufSize),
+			connW:        c.newConnWriter(conn),
+			readTimeout:  c.recvTimeout(),
+			maxRecvSize:  recvMaxPacketSize(connPkt),
+			recvMax:      c.recvMaxFlows(connPkt),
+			inAliases:    make([]string, inboundTopicAliasMax(connPkt)),
 			keepaliveC:   make(chan struct{}, 1),
 			logicSendC:   make(chan Packet, 10),
 			netRecvC:     make(chan Packet, 10),
+			ready:        make(chan struct{}),
 		}
 
-		parent.connectedServers.Store(server, connImpl)
+		stored = connImpl
+		parent.storeConn(server, connImpl)
 
-		connImpl.ctx, connImpl.exit = context.WithCancel(parent.ctx)
+		connImpl.ctx, connImpl.exit = context.WithCancel(c.life.ctx)
 		connImpl.stopSig = connImpl.ctx.Done()
 
 		parent.addWorker(connImpl.handleSend, connImpl.handleNetRecv)
 
-		connPkt := c.connPacket.clone()
-		connPkt.ProtoVersion = version
 		connImpl.send(connPkt)
 
+		present := false
 		select {
 		case pkt, more := <-connImpl.netRecvC:
 			if !more {
-				if c.connHandler != nil {
-					parent.addWorker(func() { c.connHandler(parent, server, math.MaxUint8, ErrDecodeBadPacket) })
-				}
-				close(connImpl.logicSendC)
+				c.notifyConn(parent, server, math.MaxUint8, &HandshakeError{Server: server, Err: ErrDecodeBadPacket})
+				connImpl.exit()
 				return
 			}
 
@@ -147,57 +506,117 @@ func (c connectOptions) connect(parent *AsyncClient, server string, version Prot
 				p := pkt.(*ConnAckPacket)
 
 				if p.Code != CodeSuccess {
-					close(connImpl.logicSendC)
+					connImpl.exit()
 
-					if version > V311 && c.protoCompromise && p.Code == CodeUnsupportedProtoVersion {
+					if c.protoCompromise && versionRefused(version, p.Code) {
+						// retry with the lower version
+						parent.log.i("CLI version", version, "refused by server =", server, ", fallback to", version-1)
 						parent.addWorker(func() { c.connect(parent, server, version-1, reconnectDelay) })
 						return
 					}
 
-					if c.connHandler != nil {
-						parent.addWorker(func() { c.connHandler(parent, server, p.Code, nil) })
+					err := ConnAckError(version, p.Code)
+					parent.log.e("CLI connect refused by server =", server, "err =", err)
+					c.notifyConn(parent, server, p.Code, err)
+
+					if c.life.closing() {
+						return
+					}
+
+					// no retry if refused because of the client (e.g. bad credentials)
+					if c.autoReconnect && c.retryable(version, p.Code) {
+						goto reconnect
+					}
+
+					parent.stopConnect(server, c)
+					if c.autoReconnect {
+						parent.log.e("CLI auto reconnect stopped, server =", server, "code =", p.Code)
+						notifyNetMsg(parent.msgCh, server, &ReconnectStoppedError{Code: p.Code, Err: err})
 					}
 					return
 				}
-			default:
-				close(connImpl.logicSendC)
-				if c.connHandler != nil {
-					parent.addWorker(func() { c.connHandler(parent, server, math.MaxUint8, ErrDecodeBadPacket) })
+
+				if p.Props != nil && p.Props.AssignedClientID != "" {
+					parent.log.i("CLI client id assigned by server =", server, "client id =", p.Props.AssignedClientID)
 				}
+
+				connImpl.setConnAckProps(p.Props)
+				connImpl.setConnInfo(newConnInfo(server, version, connPkt.ClientID, conn, rawConn, p.Props))
+				parent.setNegotiatedVersion(server, version)
+				parent.migrateLegacyKeys(connImpl.persistNS)
+				sent := parent.loadSent(connImpl.persistNS)
+				present = p.Present
+				if present {
+					// session resumed, resend packets not acked, the server
+					// keeps the subscriptions
+					parent.log.i("CLI session resumed by server =", server, "replay packets =", len(sent))
+					connImpl.replay(sent)
+				} else {
+					// server has no session state, drop the QoS2 receive state
+					// and subscriptions, packets not acked are sent as new
+					parent.resetQos2(connImpl.persistNS)
+					subs := parent.resetSubscriptions(server)
+					if c.resubscribe {
+						connImpl.resubscribe(subs)
+					} else {
+						subs = nil
+					}
+					parent.log.i("CLI session not present on server =", server, "resubscribe topics =", len(subs), "resend packets =", len(sent))
+					connImpl.resend(sent)
+				}
+				close(connImpl.ready)
+				parent.preConnectReady()
+			default:
+				connImpl.exit()
+				c.notifyConn(parent, server, math.MaxUint8, &HandshakeError{Server: server, Err: ErrDecodeBadPacket})
 				return
 			}
 		case <-connImpl.stopSig:
 			return
 		}
 
-		parent.log.i("CLI connected to server =", server)
-		if c.connHandler != nil {
-			parent.addWorker(func() { c.connHandler(parent, server, CodeSuccess, nil) })
-		}
+		parent.log.i("CLI connected to server =", server, "session present =", present)
+		c.notifyConnected(parent, server, present)
 
 		// start mqtt logic
+		connectedAt := parent.clock.Now()
 		connImpl.logic()
+		connImpl.setConnInfo(nil)
 
-		if parent.isClosing() || connImpl.parentExiting() {
+		if c.life.closing() || connImpl.parentExiting() {
 			return
 		}
+
+		if err := c.detectTakeover(parent, server, connImpl.getDisconnected(), connectedAt); err != nil {
+			parent.log.e("CLI session taken over, server =", server, "err =", err)
+			if c.takeoverHandler != nil {
+				parent.addWorker(func() { c.takeoverHandler(parent, server, err) })
+			}
+			cooldown = c.takeoverCooldown
+		}
 	}
 
 reconnect:
 
-	reconnectTimer := time.NewTimer(reconnectDelay)
+	delay := reconnectDelay
+	if cooldown > delay {
+		delay = cooldown
+	}
+
+	parent.sendEvent(&ReconnectingEvent{Server: server, Delay: delay})
+	reconnectTimer := parent.clock.NewTimer(delay)
 	defer reconnectTimer.Stop()
 
 	select {
-	case <-reconnectTimer.C:
-		parent.log.e("CLI reconnecting to server =", server, "delay =", reconnectDelay)
+	case <-reconnectTimer.C():
+		parent.log.e("CLI reconnecting to server =", server, "delay =", delay)
 		reconnectDelay = time.Duration(float64(reconnectDelay) * c.backOffFactor)
 		if reconnectDelay > c.maxDelay {
 			reconnectDelay = c.maxDelay
 		}
 
 		parent.addWorker(func() { c.connect(parent, server, version, reconnectDelay) })
-	case <-parent.stopSig:
+	case <-c.life.done():
 		return
 	}
 }
@@ -208,18 +627,47 @@ func (c connectOptions) clone() connectOptions {
 		tlsConfig = c.tlsConfig.Clone()
 	}
 	return connectOptions{
-		connHandler:     c.connHandler,
-		dialTimeout:     c.dialTimeout,
-		protoVersion:    c.protoVersion,
-		protoCompromise: c.protoCompromise,
-		tlsConfig:       tlsConfig,
-		maxDelay:        c.maxDelay,
-		firstDelay:      c.firstDelay,
-		backOffFactor:   c.backOffFactor,
-		autoReconnect:   c.autoReconnect,
-		connPacket:      c.connPacket,
-		keepalive:       c.keepalive,
-		keepaliveFactor: c.keepaliveFactor,
-		newConnection:   c.newConnection,
+		connHandler:       c.connHandler,
+		dialTimeout:       c.dialTimeout,
+		protoVersion:      c.protoVersion,
+		protoCompromise:   c.protoCompromise,
+		tlsConfig:         tlsConfig,
+		alpn:              c.alpn,
+		maxDelay:          c.maxDelay,
+		firstDelay:        c.firstDelay,
+		backOffFactor:     c.backOffFactor,
+		autoReconnect:     c.autoReconnect,
+		resubscribe:       c.resubscribe,
+		recvMax:           c.recvMax,
+		inboundAliasMax:   c.inboundAliasMax,
+		nonRetryableCodes: c.nonRetryableCodes,
+		takeoverHandler:   c.takeoverHandler,
+		takeoverCloses:    c.takeoverCloses,
+		takeoverWithin:    c.takeoverWithin,
+		takeoverCooldown:  c.takeoverCooldown,
+		connPacket:        c.connPacket,
+		serverUserProps:   c.serverUserProps,
+		persistentSession: c.persistentSession,
+		serversSet:        c.serversSet,
+		strictClientID:    c.strictClientID,
+		customConnPacket:  c.customConnPacket,
+		credentials:       c.credentials,
+		keepalive:         c.keepalive,
+		keepaliveFactor:   c.keepaliveFactor,
+		flushPolicy:       c.flushPolicy,
+		readBufSize:       c.readBufSize,
+		writeBufSize:      c.writeBufSize,
+		directWrite:       c.directWrite,
+		writeTimeout:      c.writeTimeout,
+		readTimeout:       c.readTimeout,
+		retryInterval:     c.retryInterval,
+		maxRetries:        c.maxRetries,
+		qosDowngrade:      c.qosDowngrade,
+		sendInterceptors:  c.sendInterceptors,
+		recvInterceptors:  c.recvInterceptors,
+		newConnection:     c.newConnection,
+		connWrappers:      c.connWrappers,
+		validators:        c.validators,
+		tcpOptions:        c.tcpOptions,
 	}
 }
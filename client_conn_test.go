@@ -0,0 +1,727 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"math"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/goiiot/libmqtt/internal/testutil"
+)
+
+func TestClientConn_AdaptSubID(t *testing.T) {
+	c := defaultClient()
+	conn := &clientConn{parent: c, name: "test", protoVersion: V5}
+	pkt := &SubscribePacket{
+		PacketID: 1,
+		Topics:   []*Topic{{Name: "foo"}},
+		Props:    &SubscribeProps{SubID: 1},
+	}
+
+	if adapted, err := conn.adaptPacket(pkt); adapted != pkt || err != nil {
+		t.Error("packet changed without ConnAck props")
+	}
+
+	subIDAvail := false
+	conn.setConnAckProps(&ConnAckProps{MaxQos: Qos2, SubIDAvail: &subIDAvail})
+	p, _ := conn.adaptPacket(pkt)
+	adapted := p.(*SubscribePacket)
+	if adapted.Props.SubID != 0 || adapted.PacketID != 1 || len(adapted.Topics) != 1 {
+		t.Error("subscription identifier not stripped, packet =", adapted)
+	}
+
+	if pkt.Props.SubID != 1 {
+		t.Error("original packet modified")
+	}
+}
+
+func TestClientConn_AdaptCapabilities(t *testing.T) {
+	c := defaultClient()
+	options := c.options.clone()
+	conn := &clientConn{parent: c, options: &options, name: "test", protoVersion: V5}
+	unavailable := false
+	conn.setConnAckProps(&ConnAckProps{MaxQos: Qos1, RetainAvail: &unavailable, WildcardSubAvail: &unavailable})
+
+	pub := &PublishPacket{TopicName: "/foo", Qos: Qos2, PacketID: c.idGen.next(nil)}
+	adapted, err := conn.adaptPacket(pub)
+	if err != nil || adapted.(*PublishPacket).Qos != Qos1 || adapted.(*PublishPacket).PacketID != pub.PacketID {
+		t.Error("publish QoS not downgraded, packet =", adapted, "err =", err)
+	}
+	if pub.Qos != Qos2 {
+		t.Error("original packet modified")
+	}
+	if extra, _ := c.idGen.getExtra(pub.PacketID); extra != adapted {
+		t.Error("downgraded packet not tracked for ack")
+	}
+
+	conn.setConnAckProps(&ConnAckProps{MaxQos: Qos0})
+	if adapted, _ := conn.adaptPacket(pub); adapted.(*PublishPacket).Qos != Qos0 || adapted.(*PublishPacket).PacketID != 0 {
+		t.Error("publish QoS not downgraded to QoS0, packet =", adapted)
+	}
+	if _, ok := c.idGen.getExtra(pub.PacketID); ok {
+		t.Error("packet id of QoS0 packet not reclaimed")
+	}
+
+	// disabled by the options of ConnectServer
+	options.qosDowngrade = false
+	if _, err := conn.adaptPacket(pub); err != ErrQosNotSupported {
+		t.Error("unexpected error =", err)
+	}
+
+	conn.setConnAckProps(&ConnAckProps{MaxQos: Qos2, RetainAvail: &unavailable, WildcardSubAvail: &unavailable})
+	if _, err := conn.adaptPacket(&PublishPacket{TopicName: "/foo", IsRetain: true}); err != ErrRetainNotAvailable {
+		t.Error("unexpected error =", err)
+	}
+	if _, err := conn.adaptPacket(&SubscribePacket{Topics: []*Topic{{Name: "/foo"}, {Name: "/bar/+"}}}); err != ErrWildcardNotAvailable {
+		t.Error("unexpected error =", err)
+	}
+	if _, err := conn.adaptPacket(&SubscribePacket{Topics: []*Topic{{Name: "/foo"}}}); err != nil {
+		t.Error("unexpected error =", err)
+	}
+
+	// MQTT 3.1.1
+	conn.protoVersion = V311
+	if _, err := conn.adaptPacket(&PublishPacket{TopicName: "/foo", IsRetain: true}); err != nil {
+		t.Error("unexpected error =", err)
+	}
+}
+
+func TestClientConn_ManualAck(t *testing.T) {
+	c := defaultClient()
+	c.manualAck = true
+	conn := &clientConn{parent: c, name: "test", logicSendC: make(chan Packet, 10)}
+
+	var received []*PublishPacket
+	c.HandlePublish("/foo", func(client Client, p *PublishPacket) {
+		received = append(received, p)
+	})
+	c.HandleTopic("/bar", func(client Client, topic string, qos QosLevel, msg []byte) {})
+
+	pkts := []*PublishPacket{
+		{TopicName: "/foo", Qos: Qos1, PacketID: 1},
+		{TopicName: "/foo", Qos: Qos2, PacketID: 2},
+		{TopicName: "/bar", Qos: Qos1, PacketID: 3},
+	}
+	for _, p := range pkts {
+		conn.addPendingAck(p)
+		c.dispatch(p)
+	}
+
+	if len(received) != 2 || len(conn.logicSendC) != 0 {
+		t.Fatal("acked before Client.Ack, pending acks =", len(conn.logicSendC))
+	}
+
+	// acks must be released in receiving order
+	c.Ack(received[1])
+	c.Ack(received[1])
+	if len(conn.logicSendC) != 0 {
+		t.Fatal("ack sent before lower outstanding packet acked")
+	}
+
+	c.Ack(received[0])
+	if len(conn.logicSendC) != 3 {
+		t.Fatal("acks not sent, count =", len(conn.logicSendC))
+	}
+
+	if ack, ok := (<-conn.logicSendC).(*PubAckPacket); !ok || ack.PacketID != 1 {
+		t.Error("unexpected ack =", ack)
+	}
+
+	if comp, ok := (<-conn.logicSendC).(*PubCompPacket); !ok || comp.PacketID != 2 {
+		t.Error("unexpected ack =", comp)
+	}
+
+	if ack, ok := (<-conn.logicSendC).(*PubAckPacket); !ok || ack.PacketID != 3 {
+		t.Error("unexpected ack =", ack)
+	}
+
+	if len(conn.pendingAcks) != 0 {
+		t.Error("pending acks not released, count =", len(conn.pendingAcks))
+	}
+}
+
+func TestClientConn_AckWithReason(t *testing.T) {
+	for _, version := range []ProtoVersion{V5, V311} {
+		c := defaultClient()
+		c.manualAck = true
+		conn := &clientConn{parent: c, name: "test", protoVersion: version, logicSendC: make(chan Packet, 10)}
+
+		c.HandlePublish("/foo", func(client Client, p *PublishPacket) {
+			client.AckWithReason(p, CodePayloadFormatInvalid, "bad schema")
+			// not overridden by following acks
+			client.Ack(p)
+		})
+
+		for _, p := range []*PublishPacket{
+			{TopicName: "/foo", Qos: Qos1, PacketID: 1},
+			{TopicName: "/foo", Qos: Qos2, PacketID: 2},
+		} {
+			conn.addPendingAck(p)
+			c.dispatch(p)
+		}
+
+		if len(conn.logicSendC) != 2 {
+			t.Fatal("acks not sent, count =", len(conn.logicSendC))
+		}
+
+		ack, ok := (<-conn.logicSendC).(*PubAckPacket)
+		switch {
+		case !ok || ack.PacketID != 1:
+			t.Error("unexpected ack =", ack)
+		case version == V5 && (ack.Code != CodePayloadFormatInvalid || ack.Props == nil || ack.Props.Reason != "bad schema"):
+			t.Error("reason not sent, code =", ack.Code, "props =", ack.Props)
+		case version == V311 && (ack.Code != CodeSuccess || ack.Props != nil):
+			t.Error("reason sent with MQTT 3.1.1, code =", ack.Code, "props =", ack.Props)
+		}
+
+		// PubComp can not carry the reason
+		if comp, ok := (<-conn.logicSendC).(*PubCompPacket); !ok || comp.PacketID != 2 || comp.Code != CodeSuccess {
+			t.Error("unexpected ack =", comp)
+		}
+	}
+}
+
+func TestClientConn_RecvOverflow(t *testing.T) {
+	newConn := func(policy RecvOverflowPolicy) *clientConn {
+		c := defaultClient()
+		c.recvOverflow = policy
+		return &clientConn{parent: c, name: "test", stopSig: make(chan struct{})}
+	}
+
+	conn := newConn(RecvOverflowDropOldest)
+	conn.deliver(&PublishPacket{TopicName: "/old", Qos: Qos1})
+	conn.deliver(&PublishPacket{TopicName: "/new", Qos: Qos1})
+	if p := <-conn.parent.recvCh; p.TopicName != "/new" {
+		t.Error("oldest packet not dropped, received =", p.TopicName)
+	}
+	if n := conn.parent.Stats().DroppedMessages; n != 1 {
+		t.Error("dropped message count =", n)
+	}
+
+	conn = newConn(RecvOverflowSpillQos0)
+	conn.deliver(&PublishPacket{TopicName: "/qos0", Qos: Qos0})
+	conn.deliver(&PublishPacket{TopicName: "/qos0", Qos: Qos0})
+	if n := conn.parent.Stats().DroppedMessages; n != 1 {
+		t.Error("dropped message count =", n)
+	}
+
+	delivered := make(chan struct{})
+	go func() {
+		conn.deliver(&PublishPacket{TopicName: "/qos1", Qos: Qos1})
+		close(delivered)
+	}()
+
+	select {
+	case <-delivered:
+		t.Fatal("QoS1 packet not blocked")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	<-conn.parent.recvCh
+	<-delivered
+	if p := <-conn.parent.recvCh; p.TopicName != "/qos1" {
+		t.Error("QoS1 packet not delivered, received =", p.TopicName)
+	}
+}
+
+func TestClientConn_KeepaliveRecvBusy(t *testing.T) {
+	clk := testutil.NewFakeClock(time.Now())
+	conn := &clientConn{
+		parent:     defaultClient(),
+		name:       "test",
+		keepaliveC: make(chan struct{}),
+	}
+	conn.parent.clock = clk
+	conn.ctx, conn.exit = context.WithCancel(context.Background())
+	conn.stopSig = conn.ctx.Done()
+
+	timeout := 10 * time.Second
+	atomic.StoreUint32(&conn.recvBusy, 1)
+
+	result := make(chan bool)
+	go func() { result <- conn.waitPingResp(clk.NewTimer(timeout), timeout) }()
+
+	for i := 0; i < 5; i++ {
+		// timer reset while recv busy
+		clk.BlockUntil(1)
+		clk.Advance(timeout)
+	}
+	clk.BlockUntil(1)
+	conn.keepaliveC <- struct{}{}
+	if !<-result {
+		t.Error("keepalive timeout when recv busy")
+	}
+
+	atomic.StoreUint32(&conn.recvBusy, 0)
+	go func() { result <- conn.waitPingResp(clk.NewTimer(timeout), timeout) }()
+	clk.BlockUntil(2)
+	clk.Advance(timeout)
+	if <-result {
+		t.Error("keepalive not timeout")
+	}
+}
+
+func TestClientConn_KeepaliveTimeout(t *testing.T) {
+	clk := testutil.NewFakeClock(time.Now())
+	c := defaultClient()
+	c.clock = clk
+	c.options.keepalive, c.options.keepaliveFactor = 60*time.Second, 1.5
+
+	conn := &clientConn{
+		parent:     c,
+		name:       "test",
+		keepaliveC: make(chan struct{}, 1),
+		logicSendC: make(chan Packet, 10),
+	}
+	conn.ctx, conn.exit = context.WithCancel(context.Background())
+	conn.stopSig = conn.ctx.Done()
+
+	done := make(chan struct{})
+	go func() {
+		conn.keepalive()
+		close(done)
+	}()
+
+	// ticker and timeout timer
+	clk.BlockUntil(2)
+	for i := 0; i < 3; i++ {
+		clk.Advance(45 * time.Second)
+		if pkt := <-conn.logicSendC; pkt != PingReqPacket {
+			t.Fatal("unexpected packet sent =", pkt)
+		}
+		conn.keepaliveC <- struct{}{}
+		// timeout timer reset once responded
+		clk.BlockUntilAt(clk.Now().Add(90 * time.Second))
+	}
+
+	// no response
+	clk.Advance(45 * time.Second)
+	<-conn.logicSendC
+	clk.Advance(44 * time.Second)
+	if conn.ctx.Err() != nil {
+		t.Fatal("keepalive timeout before 1.5 times of keepalive")
+	}
+	clk.Advance(time.Second)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("keepalive not stopped")
+	}
+	if conn.ctx.Err() == nil {
+		t.Error("connection not exited once keepalive timeout")
+	}
+}
+
+// benchmarkLogic runs logic with packets received from the server, done
+// returns true once the packet of the last op handled
+func benchmarkLogic(b *testing.B, recv func(c *AsyncClient, i int) Packet, done func(c *AsyncClient, conn *clientConn) bool) {
+	c := defaultClient()
+	c.options.keepalive, c.options.retryInterval = 0, 0
+
+	netConn, _ := net.Pipe()
+	stop := make(chan struct{})
+	conn := &clientConn{
+		parent:     c,
+		options:    &c.options,
+		name:       "bench",
+		conn:       netConn,
+		logicSendC: make(chan Packet, 64),
+		netRecvC:   make(chan Packet, 64),
+		stopSig:    stop,
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		conn.logic()
+		close(exited)
+	}()
+
+	handled := make(chan struct{})
+	go func() {
+		defer close(handled)
+		for !done(c, conn) {
+		}
+	}()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		conn.netRecvC <- recv(c, i)
+	}
+	<-handled
+	b.StopTimer()
+
+	close(stop)
+	<-exited
+}
+
+func BenchmarkClientConn_LogicPubAck(b *testing.B) {
+	// limit packet ids in use
+	window := make(chan struct{}, 1024)
+	pub := &PublishPacket{TopicName: "/foo", Qos: Qos1}
+	acked := 0
+
+	benchmarkLogic(b, func(c *AsyncClient, i int) Packet {
+		window <- struct{}{}
+		return &PubAckPacket{PacketID: c.idGen.next(pub)}
+	}, func(c *AsyncClient, conn *clientConn) bool {
+		if m := <-c.msgCh; m.what == pubMsg {
+			<-window
+			acked++
+		}
+		return acked == b.N
+	})
+}
+
+func BenchmarkClientConn_LogicRecvQos1(b *testing.B) {
+	acks := 0
+	benchmarkLogic(b, func(c *AsyncClient, i int) Packet {
+		return &PublishPacket{TopicName: "/foo", Qos: Qos1, PacketID: uint16(i%math.MaxUint16 + 1), Payload: []byte("bar")}
+	}, func(c *AsyncClient, conn *clientConn) bool {
+		select {
+		case <-c.recvCh:
+		case <-conn.logicSendC:
+			acks++
+		}
+		return acks == b.N
+	})
+}
+
+func BenchmarkClientConn_LogicMixedSlowRecv(b *testing.B) {
+	// publishes received and acks of publishes sent interleaved, the
+	// handler takes some time for each publish
+	window := make(chan struct{}, 1024)
+	pub := &PublishPacket{TopicName: "/foo", Qos: Qos1}
+	acked, finished, delivered := 0, false, make(chan struct{})
+
+	benchmarkLogic(b, func(c *AsyncClient, i int) Packet {
+		if i == 0 {
+			go func() {
+				for n := b.N - b.N/2; n > 0; n-- {
+					<-c.recvCh
+					for start := time.Now(); time.Since(start) < time.Microsecond; {
+					}
+				}
+				close(delivered)
+			}()
+		}
+
+		if i%2 == 0 {
+			return &PublishPacket{TopicName: "/foo", Qos: Qos1, PacketID: uint16(i%math.MaxUint16 + 1), Payload: []byte("bar")}
+		}
+		window <- struct{}{}
+		return &PubAckPacket{PacketID: c.idGen.next(pub)}
+	}, func(c *AsyncClient, conn *clientConn) bool {
+		select {
+		case m := <-c.msgCh:
+			if m.what == pubMsg {
+				<-window
+				acked++
+			}
+		case <-conn.logicSendC:
+		case <-delivered:
+			finished = true
+		}
+		return acked == b.N/2 && finished
+	})
+}
+
+func TestClientConn_AckPriority(t *testing.T) {
+	const (
+		flood = 1000
+		acks  = 10
+	)
+
+	parent := defaultClient()
+	_ = WithDirectWrite(true)(parent, &parent.options)
+	parent.sendCh = make(chan Packet, flood)
+	for i := 0; i < flood; i++ {
+		parent.sendCh <- &PublishPacket{TopicName: "/foo", Qos: Qos1, PacketID: uint16(i + 1), Payload: []byte("bar")}
+	}
+
+	client, server := net.Pipe()
+	defer func() { _ = client.Close(); _ = server.Close() }()
+	conn := &clientConn{
+		protoVersion: V311,
+		parent:       parent,
+		options:      &parent.options,
+		name:         "test",
+		conn:         client,
+		connW:        parent.options.newConnWriter(client),
+		logicSendC:   make(chan Packet, acks),
+	}
+	conn.ctx, conn.exit = context.WithCancel(context.Background())
+	conn.stopSig = conn.ctx.Done()
+	defer conn.exit()
+	go conn.handleSend()
+
+	r := bufio.NewReader(server)
+	for i := 0; i < 5; i++ {
+		if _, err := Decode(V311, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// acks received while publishing, the publish is blocked in write
+	for i := 0; i < acks; i++ {
+		conn.logicSendC <- &PubAckPacket{PacketID: uint16(i + 1)}
+	}
+
+	published := 0
+	for acked := 0; acked < acks; {
+		pkt, err := Decode(V311, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		switch pkt.(type) {
+		case *PublishPacket:
+			published++
+		case *PubAckPacket:
+			acked++
+		}
+	}
+
+	// at most the publish blocked is sent before acks
+	if published > 1 {
+		t.Error("acks delayed by publishes, published before acks =", published)
+	}
+}
+
+func TestClientConn_DiscardQueuedPublish(t *testing.T) {
+	clk := testutil.NewFakeClock(time.Now())
+	parent := defaultClient()
+	parent.clock = clk
+	_ = WithSendBuf(4)(parent, &parent.options)
+	// flushed once written, no flush timer of the fake clock
+	_ = WithFlushPolicy(FlushPolicy{})(parent, &parent.options)
+	// queued while the connection lost (connected before)
+	parent.flushPreConnect()
+
+	canceled, cancel := context.WithCancel(context.Background())
+	expired, cancelExpired := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancelExpired()
+	for _, pub := range []struct {
+		topic   string
+		options []PubOption
+	}{
+		{"/expired", []PubOption{PubQoS(Qos1), PubDeadline(clk.Now().Add(10 * time.Millisecond))}},
+		{"/canceled", []PubOption{PubContext(canceled)}},
+		{"/ctx-expired", []PubOption{PubQoS(Qos2), PubContext(expired)}},
+		{"/ok", []PubOption{PubDeadline(clk.Now().Add(time.Hour)), PubContext(context.Background())}},
+	} {
+		if err := parent.PublishWith(pub.topic, nil, pub.options...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// expired and canceled while queued
+	cancel()
+	clk.Advance(20 * time.Millisecond)
+
+	client, server := net.Pipe()
+	defer func() { _ = client.Close(); _ = server.Close() }()
+	conn := &clientConn{
+		protoVersion: V311,
+		parent:       parent,
+		options:      &parent.options,
+		name:         "test",
+		conn:         client,
+		connW:        parent.options.newConnWriter(client),
+		logicSendC:   make(chan Packet, 1),
+	}
+	conn.ctx, conn.exit = context.WithCancel(context.Background())
+	conn.stopSig = conn.ctx.Done()
+	defer conn.exit()
+	go conn.handleSend()
+
+	pkt, err := Decode(V311, bufio.NewReader(server))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, ok := pkt.(*PublishPacket); !ok || p.TopicName != "/ok" {
+		t.Error("unexpected packet sent =", pkt)
+	}
+
+	for _, expected := range []struct {
+		topic string
+		err   error
+	}{
+		{"/expired", ErrPublishExpired},
+		{"/canceled", ErrPublishCanceled},
+		{"/ctx-expired", ErrPublishExpired},
+		{"/ok", nil},
+	} {
+		if m := <-parent.msgCh; m.what != pubMsg || m.msg != expected.topic || m.err != expected.err {
+			t.Errorf("unexpected notification %+v, expected %+v", m, expected)
+		}
+	}
+
+	if stats := parent.Stats(); stats.ExpiredPublishes != 2 || stats.CanceledPublishes != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	// packet ids reclaimed once discarded
+	if parent.idGen.used(1) || parent.idGen.used(2) {
+		t.Error("packet ids of discarded packets not reclaimed")
+	}
+}
+
+type testReasonErr byte
+
+func (e testReasonErr) Error() string    { return "reason error" }
+func (e testReasonErr) ReasonCode() byte { return byte(e) }
+
+func TestClientConn_HandleStream(t *testing.T) {
+	for _, c := range []struct {
+		version ProtoVersion
+		err     error
+		ack     Packet
+	}{
+		{V311, nil, &PubAckPacket{PacketID: 1}},
+		{V311, io.ErrUnexpectedEOF, nil},
+		{V5, nil, &PubAckPacket{PacketID: 1}},
+		{V5, io.ErrUnexpectedEOF, &PubAckPacket{PacketID: 1, Code: CodeUnspecifiedError}},
+		{V5, testReasonErr(CodePayloadFormatInvalid), &PubAckPacket{PacketID: 1, Code: CodePayloadFormatInvalid}},
+	} {
+		parent := defaultClient()
+		payload := bytes.Repeat([]byte("foo"), 1000)
+
+		var received []byte
+		parent.HandleStream("/ota/+", func(client Client, topic string, qos QosLevel, r io.Reader) error {
+			// only read part of the payload
+			received = make([]byte, 10)
+			_, _ = io.ReadFull(r, received)
+			return c.err
+		})
+
+		buf := new(bytes.Buffer)
+		for _, p := range []*PublishPacket{
+			{TopicName: "/ota/1", Qos: Qos1, PacketID: 1, Payload: payload, Props: &PublishProps{ContentType: "bin"}},
+			{TopicName: "/foo", Payload: []byte("bar"), Props: &PublishProps{}},
+		} {
+			p.SetVersion(c.version)
+			_ = p.WriteTo(buf)
+		}
+
+		conn := &clientConn{
+			protoVersion: c.version,
+			parent:       parent,
+			options:      &parent.options,
+			name:         "test",
+			connR:        bufio.NewReader(buf),
+			logicSendC:   make(chan Packet, 10),
+			netRecvC:     make(chan Packet, 10),
+			keepaliveC:   make(chan struct{}, 1),
+		}
+		conn.ctx, conn.exit = context.WithCancel(context.Background())
+		conn.stopSig = conn.ctx.Done()
+
+		// returns once all packets were read
+		conn.handleNetRecv()
+
+		if !bytes.Equal(received, payload[:10]) {
+			t.Error("unexpected stream payload =", string(received))
+		}
+
+		if pkt := <-conn.netRecvC; pkt == nil || pkt.(*PublishPacket).TopicName != "/foo" {
+			t.Error("packet after stream not decoded, packet =", pkt)
+		}
+
+		if c.ack == nil {
+			if len(conn.logicSendC) != 0 {
+				t.Error("ack sent for failed stream handler")
+			}
+			continue
+		}
+
+		ack := (<-conn.logicSendC).(*PubAckPacket)
+		expected := c.ack.(*PubAckPacket)
+		if ack.PacketID != expected.PacketID || ack.Code != expected.Code {
+			t.Error("unexpected ack, version =", c.version, "code =", ack.Code)
+		}
+	}
+}
+
+func TestClientConn_AckWhileRecvBlocked(t *testing.T) {
+	c := defaultClient()
+	c.options.keepalive, c.options.retryInterval = 0, 0
+
+	netConn, _ := net.Pipe()
+	stop := make(chan struct{})
+	conn := &clientConn{
+		parent:     c,
+		options:    &c.options,
+		name:       "test",
+		conn:       netConn,
+		logicSendC: make(chan Packet, 10),
+		netRecvC:   make(chan Packet, 10),
+		stopSig:    stop,
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		conn.logic()
+		close(exited)
+	}()
+	defer func() {
+		close(stop)
+		<-exited
+	}()
+
+	// recv buffer full, delivery blocked
+	c.recvCh <- &PublishPacket{TopicName: "/full", Qos: Qos0}
+	conn.netRecvC <- &PublishPacket{TopicName: "/foo", Qos: Qos1, PacketID: 1}
+	conn.netRecvC <- &PublishPacket{TopicName: "/baz", Qos: Qos1, PacketID: 2}
+
+	pub := &PublishPacket{TopicName: "/bar", Qos: Qos1}
+	conn.netRecvC <- &PubAckPacket{PacketID: c.idGen.next(pub)}
+
+	select {
+	case m := <-c.msgCh:
+		if m.what != pubMsg || m.msg != "/bar" || m.err != nil {
+			t.Error("unexpected notification =", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ack not handled while delivery blocked")
+	}
+
+	// delivered in order once unblocked, then acked
+	if p := <-c.recvCh; p.TopicName != "/full" {
+		t.Error("unexpected packet delivered =", p)
+	}
+	if p := <-c.recvCh; p.TopicName != "/foo" {
+		t.Error("unexpected packet delivered =", p)
+	}
+	if ack, ok := (<-conn.logicSendC).(*PubAckPacket); !ok || ack.PacketID != 1 {
+		t.Error("unexpected ack =", ack)
+	}
+	if p := <-c.recvCh; p.TopicName != "/baz" {
+		t.Error("unexpected packet delivered =", p)
+	}
+	if ack, ok := (<-conn.logicSendC).(*PubAckPacket); !ok || ack.PacketID != 2 {
+		t.Error("unexpected ack =", ack)
+	}
+}
@@ -0,0 +1,206 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import "errors"
+
+// errors of ConnAck codes, codes of MQTT 3.1.1 and MQTT 5 with the same
+// meaning are mapped to the same error
+var (
+	// ErrConnBadProtocol used when the protocol version is not supported
+	// (CodeUnacceptableVersion, CodeUnsupportedProtoVersion)
+	ErrConnBadProtocol = errors.New("connect refused, unacceptable protocol version ")
+
+	// ErrConnIDRejected used when the client id is not allowed
+	// (CodeIdentifierRejected, CodeClientIdNotValid)
+	ErrConnIDRejected = errors.New("connect refused, client identifier rejected ")
+
+	// ErrConnServerUnavailable used when the MQTT service is unavailable
+	// (CodeServerUnavailable, CodeServerUnavail)
+	ErrConnServerUnavailable = errors.New("connect refused, server unavailable ")
+
+	// ErrConnBadAuth used when the username or password is malformed or
+	// not accepted (CodeBadUsernameOrPassword, CodeBadUserPass)
+	ErrConnBadAuth = errors.New("connect refused, bad username or password ")
+
+	// ErrConnNotAuthorized used when the client is not authorized to
+	// connect (CodeUnauthorized, CodeNotAuthorized)
+	ErrConnNotAuthorized = errors.New("connect refused, not authorized ")
+
+	// ErrConnUnspecified used when the server refused with no specific
+	// reason (CodeUnspecifiedError) or the code is unknown
+	ErrConnUnspecified = errors.New("connect refused, unspecified error ")
+
+	// ErrConnMalformedPacket used when the connect packet can not be
+	// parsed by the server (CodeMalformedPacket)
+	ErrConnMalformedPacket = errors.New("connect refused, malformed packet ")
+
+	// ErrConnProtoError used when the connect packet does not conform the
+	// specification (CodeProtoError)
+	ErrConnProtoError = errors.New("connect refused, protocol error ")
+
+	// ErrConnImplementationError used when the connect packet is valid but
+	// not accepted by the server implementation (CodeImplementationSpecificError)
+	ErrConnImplementationError = errors.New("connect refused, implementation specific error ")
+
+	// ErrConnServerBusy used when the server is busy (CodeServerBusy)
+	ErrConnServerBusy = errors.New("connect refused, server busy ")
+
+	// ErrConnBanned used when the client is banned (CodeBanned)
+	ErrConnBanned = errors.New("connect refused, client banned ")
+
+	// ErrConnBadAuthMethod used when the authentication method is not
+	// supported (CodeBadAuthenticationMethod)
+	ErrConnBadAuthMethod = errors.New("connect refused, bad authentication method ")
+
+	// ErrConnTopicNameInvalid used when the will topic is not accepted
+	// (CodeTopicNameInvalid)
+	ErrConnTopicNameInvalid = errors.New("connect refused, will topic name invalid ")
+
+	// ErrConnPacketTooLarge used when the connect packet exceeds the size
+	// limit of the server (CodePacketTooLarge)
+	ErrConnPacketTooLarge = errors.New("connect refused, packet too large ")
+
+	// ErrConnQuotaExceeded used when the quota of the server exceeded
+	// (CodeQuotaExceeded)
+	ErrConnQuotaExceeded = errors.New("connect refused, quota exceeded ")
+
+	// ErrConnPayloadFormatInvalid used when the will payload does not
+	// match the payload format indicator (CodePayloadFormatInvalid)
+	ErrConnPayloadFormatInvalid = errors.New("connect refused, will payload format invalid ")
+
+	// ErrConnRetainNotSupported used when the will retain is set but not
+	// supported (CodeRetainNotSupported)
+	ErrConnRetainNotSupported = errors.New("connect refused, retain not supported ")
+
+	// ErrConnQosNotSupported used when the will QoS is not supported
+	// (CodeQosNoSupported)
+	ErrConnQosNotSupported = errors.New("connect refused, QoS not supported ")
+
+	// ErrConnUseAnotherServer used when the client should temporarily use
+	// another server (CodeUseAnotherServer)
+	ErrConnUseAnotherServer = errors.New("connect refused, use another server ")
+
+	// ErrConnServerMoved used when the client should permanently use
+	// another server (CodeServerMoved)
+	ErrConnServerMoved = errors.New("connect refused, server moved ")
+
+	// ErrConnRateExceeded used when the connection rate limit exceeded
+	// (CodeConnectionRateExceeded)
+	ErrConnRateExceeded = errors.New("connect refused, connection rate exceeded ")
+)
+
+var (
+	connAckErrorsV311 = map[byte]error{
+		CodeUnacceptableVersion:   ErrConnBadProtocol,
+		CodeIdentifierRejected:    ErrConnIDRejected,
+		CodeServerUnavailable:     ErrConnServerUnavailable,
+		CodeBadUsernameOrPassword: ErrConnBadAuth,
+		CodeUnauthorized:          ErrConnNotAuthorized,
+	}
+
+	connAckErrorsV5 = map[byte]error{
+		CodeUnspecifiedError:            ErrConnUnspecified,
+		CodeMalformedPacket:             ErrConnMalformedPacket,
+		CodeProtoError:                  ErrConnProtoError,
+		CodeImplementationSpecificError: ErrConnImplementationError,
+		CodeUnsupportedProtoVersion:     ErrConnBadProtocol,
+		CodeClientIdNotValid:            ErrConnIDRejected,
+		CodeBadUserPass:                 ErrConnBadAuth,
+		CodeNotAuthorized:               ErrConnNotAuthorized,
+		CodeServerUnavail:               ErrConnServerUnavailable,
+		CodeServerBusy:                  ErrConnServerBusy,
+		CodeBanned:                      ErrConnBanned,
+		CodeBadAuthenticationMethod:     ErrConnBadAuthMethod,
+		CodeTopicNameInvalid:            ErrConnTopicNameInvalid,
+		CodePacketTooLarge:              ErrConnPacketTooLarge,
+		CodeQuotaExceeded:               ErrConnQuotaExceeded,
+		CodePayloadFormatInvalid:        ErrConnPayloadFormatInvalid,
+		CodeRetainNotSupported:          ErrConnRetainNotSupported,
+		CodeQosNoSupported:              ErrConnQosNotSupported,
+		CodeUseAnotherServer:            ErrConnUseAnotherServer,
+		CodeServerMoved:                 ErrConnServerMoved,
+		CodeConnectionRateExceeded:      ErrConnRateExceeded,
+
+		// MQTT 3.1.1 servers refuse MQTT 5 clients with the code of MQTT 3.1.1
+		CodeUnacceptableVersion: ErrConnBadProtocol,
+	}
+
+	// connAckRetryable errors are transient, connect may succeed later
+	connAckRetryable = map[error]bool{
+		ErrConnServerUnavailable:   true,
+		ErrConnUnspecified:         true,
+		ErrConnImplementationError: true,
+		ErrConnServerBusy:          true,
+		ErrConnQuotaExceeded:       true,
+		ErrConnRateExceeded:        true,
+	}
+)
+
+// ReconnectStoppedError is notified to the NetHandleFunc when the auto
+// reconnect stopped because the connect refused with the ConnAck code not
+// retried, the underlying ConnAck error can be checked with errors.Is
+type ReconnectStoppedError struct {
+	Code byte
+	Err  error
+}
+
+func (e *ReconnectStoppedError) Error() string {
+	return "auto reconnect stopped, " + e.Err.Error()
+}
+
+// Unwrap returns the ConnAck error
+func (e *ReconnectStoppedError) Unwrap() error {
+	return e.Err
+}
+
+// ConnAckError returns the error of the ConnAck code of the MQTT version,
+// nil if CodeSuccess, ErrConnUnspecified if the code is unknown
+func ConnAckError(version ProtoVersion, code byte) error {
+	if code == CodeSuccess {
+		return nil
+	}
+
+	errs := connAckErrorsV311
+	if version == V5 {
+		errs = connAckErrorsV5
+	}
+
+	if err, ok := errs[code]; ok {
+		return err
+	}
+	return ErrConnUnspecified
+}
+
+// versionRefused returns true if the ConnAck code refused the version and
+// a lower version can be used
+func versionRefused(version ProtoVersion, code byte) bool {
+	switch version {
+	case V5:
+		// MQTT 3.1.1 servers reply with the code of MQTT 3.1.1
+		return code == CodeUnsupportedProtoVersion || code == CodeUnacceptableVersion
+	case V311:
+		return code == CodeUnacceptableVersion
+	}
+	return false
+}
+
+// isFatalConnErr returns true if the connect is refused because of the
+// client (e.g. bad credentials) and should not be retried
+func isFatalConnErr(err error) bool {
+	return !connAckRetryable[err]
+}
@@ -0,0 +1,205 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClient_ConnectWith(t *testing.T) {
+	for _, withConnector := range []bool{false, true} {
+		connected := make(chan error, 2)
+		pubErrs := make(chan error, 1)
+		client, err := NewClient(
+			WithAutoReconnect(true),
+			WithBackoffStrategy(10*time.Millisecond, 10*time.Millisecond, 1),
+			WithConnHandleFunc(func(client Client, server string, code byte, err error) { connected <- err }),
+			WithPubHandleFunc(func(client Client, topic string, err error) { pubErrs <- err }),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var options []Option
+		if withConnector {
+			options = append(options, WithCustomConnector(fakeConnector(fakeBrokerConfig{ackPub: true})))
+		}
+
+		conn, server := net.Pipe()
+		go func() {
+			// connection lost once published
+			r, w := bufio.NewReader(server), bufio.NewWriter(server)
+			if _, err := Decode(V311, r); err != nil {
+				return
+			}
+			_ = (&ConnAckPacket{}).WriteTo(w)
+			_ = w.Flush()
+			if pkt, err := Decode(V311, r); err == nil {
+				_ = (&PubAckPacket{PacketID: pkt.(*PublishPacket).PacketID}).WriteTo(w)
+				_ = w.Flush()
+			}
+			_ = server.Close()
+		}()
+
+		if err := client.ConnectWith(conn, "pipe", options...); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case err := <-connected:
+			if err != nil {
+				t.Fatal("connect failed, err =", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("connect timeout")
+		}
+
+		client.Publish(&PublishPacket{TopicName: "/foo", Qos: Qos1, Payload: []byte("bar")})
+		select {
+		case err := <-pubErrs:
+			if err != nil {
+				t.Error("publish failed, err =", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("publish timeout")
+		}
+
+		select {
+		case err := <-connected:
+			if withConnector && err != nil || !withConnector && !errors.Is(err, ErrConnNotReusable) {
+				t.Error("unexpected reconnect, err =", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Error("reconnect timeout")
+		}
+
+		if !withConnector {
+			select {
+			case err := <-connected:
+				t.Error("reconnected again, err =", err)
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+		client.Destroy(true)
+	}
+}
+
+func TestClient_CustomConnPacket(t *testing.T) {
+	var (
+		attempts  int32
+		received  = make(chan *ConnPacket, 2)
+		reqRespOn = true
+	)
+	client, err := NewClient(
+		WithVersion(V5, false),
+		WithClientID("cid"),
+		WithAutoReconnect(true),
+		WithBackoffStrategy(time.Millisecond, time.Millisecond, 1),
+		WithCustomConnPacket(func(server string, base *ConnPacket) *ConnPacket {
+			n := atomic.AddInt32(&attempts, 1)
+			if server != "fake" || base.ClientID != "cid" || base.ProtoVersion != V5 {
+				t.Errorf("unexpected base packet of server %q: %v", server, base)
+			}
+
+			if base.Props == nil {
+				base.Props = &ConnProps{}
+			}
+			base.Props.ReqRespInfo = &reqRespOn
+			base.Props.UserProps.Add("attempt", strconv.Itoa(int(n)))
+			// version is always the version in use
+			base.ProtoVersion = V311
+			return base
+		}),
+		WithCustomConnector(scriptBroker(V5, func(s *fakeSession) {
+			select {
+			case received <- s.connect:
+			default:
+			}
+
+			// close once connected, so the client reconnects
+			s.write(&ConnAckPacket{})
+		})),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Destroy(true)
+
+	if err := client.ConnectServer("fake"); err != nil {
+		t.Fatal(err)
+	}
+
+	// called for every connect attempt
+	for i := 1; i <= 2; i++ {
+		select {
+		case pkt := <-received:
+			attempt, _ := pkt.Props.UserProps.Get("attempt")
+			if attempt != strconv.Itoa(i) || pkt.Props.ReqRespInfo == nil || !*pkt.Props.ReqRespInfo {
+				t.Errorf("unexpected connect packet %d props %+v", i, pkt.Props)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("connect packet not received, attempt =", i)
+		}
+	}
+}
+
+func TestClient_CustomConnPacketInvalid(t *testing.T) {
+	var (
+		dialed   int32
+		connErrs = make(chan error, 1)
+	)
+	client, err := NewClient(
+		WithConnHandleFunc(func(client Client, server string, code byte, err error) { connErrs <- err }),
+		WithCustomConnPacket(func(server string, base *ConnPacket) *ConnPacket {
+			return &ConnPacket{ClientID: "cid", IsWill: true, WillTopic: "will/#"}
+		}),
+		WithCustomConnector(func(ctx context.Context, address string, timeout time.Duration, tlsConfig *tls.Config) (net.Conn, error) {
+			atomic.AddInt32(&dialed, 1)
+			return fakeConnector(fakeBrokerConfig{ackPub: true})(ctx, address, timeout, tlsConfig)
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Destroy(true)
+
+	if err := client.ConnectServer("fake"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-connErrs:
+		if err != ErrTopicWildcard {
+			t.Error("unexpected connect error =", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("invalid connect packet not reported")
+	}
+
+	// validated before dialing
+	if n := atomic.LoadInt32(&dialed); n != 0 {
+		t.Error("dialed with invalid connect packet, dialed =", n)
+	}
+}
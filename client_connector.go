@@ -56,6 +56,107 @@ func WithCustomConnector(connector Connector) Option {
 	}
 }
 
+// ConnWrapper wraps the connection established to the server with name
+type ConnWrapper func(name string, conn net.Conn) net.Conn
+
+// WithConnWrapper adds the wrapper applied to every connection once
+// established (after TLS handshake, so the plain MQTT bytes are visible),
+// e.g. to tee the bytes read and written (see testutil.HexDump), or to
+// inject latency and faults in tests
+//
+// wrappers are applied in the order added, the first one wraps the
+// connection established
+func WithConnWrapper(wrapper ConnWrapper) Option {
+	return func(c *AsyncClient, options *connectOptions) error {
+		if wrapper != nil {
+			options.connWrappers = append(options.connWrappers, wrapper)
+		}
+		return nil
+	}
+}
+
+// wrapConn applies all connection wrappers in order
+func (c connectOptions) wrapConn(name string, conn net.Conn) net.Conn {
+	for _, wrap := range c.connWrappers {
+		conn = wrap(name, conn)
+	}
+	return conn
+}
+
+// TCPOptions are the socket options of TCP connections (see WithTCPOptions),
+// zero values keep the defaults
+type TCPOptions struct {
+	// NoDelay disables the Nagle's algorithm (TCP_NODELAY) if true, Go
+	// sets it by default
+	NoDelay *bool
+	// KeepAlive is the period of TCP keepalive probes, negative disables
+	// TCP keepalive
+	KeepAlive time.Duration
+	// ReadBufSize and WriteBufSize are the sizes of the socket receive and
+	// send buffers (SO_RCVBUF and SO_SNDBUF)
+	ReadBufSize  int
+	WriteBufSize int
+}
+
+// WithTCPOptions sets socket options of connections once established, the
+// options are applied to the TCP connection (or the TCP connection under
+// the TLS connection) returned by the connector, connections of other
+// transports (e.g. unix sockets and websockets) are not changed
+//
+// options failed to apply are logged, the connection is still used
+func WithTCPOptions(opts TCPOptions) Option {
+	return func(c *AsyncClient, options *connectOptions) error {
+		options.tcpOptions = &opts
+		return nil
+	}
+}
+
+// apply the options to the TCP connection of conn
+func (o *TCPOptions) apply(conn net.Conn) error {
+	if tlsConn, ok := conn.(interface{ NetConn() net.Conn }); ok {
+		// tls.Conn since Go 1.18
+		conn = tlsConn.NetConn()
+	}
+
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+
+	if o.NoDelay != nil {
+		if err := tcpConn.SetNoDelay(*o.NoDelay); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case o.KeepAlive < 0:
+		if err := tcpConn.SetKeepAlive(false); err != nil {
+			return err
+		}
+	case o.KeepAlive > 0:
+		if err := tcpConn.SetKeepAlive(true); err != nil {
+			return err
+		}
+		if err := tcpConn.SetKeepAlivePeriod(o.KeepAlive); err != nil {
+			return err
+		}
+	}
+
+	if o.ReadBufSize > 0 {
+		if err := tcpConn.SetReadBuffer(o.ReadBufSize); err != nil {
+			return err
+		}
+	}
+
+	if o.WriteBufSize > 0 {
+		if err := tcpConn.SetWriteBuffer(o.WriteBufSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 type tlsTimeoutError struct{}
 
 func (tlsTimeoutError) Error() string   { return "tls: timed out" }
@@ -110,7 +211,7 @@ func tcpConnect(ctx context.Context, address string, timeout, handshakeTimeout t
 
 		if err != nil {
 			_ = conn.Close()
-			return nil, err
+			return nil, &HandshakeError{Server: address, Err: err}
 		}
 
 		conn = tlsConn
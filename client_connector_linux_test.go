@@ -0,0 +1,112 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"crypto/tls"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// getsockopt reads the int socket option of the TCP connection
+func getsockopt(t *testing.T, conn *net.TCPConn, level, opt int) int {
+	t.Helper()
+
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		v      int
+		optErr error
+	)
+	if err := raw.Control(func(fd uintptr) {
+		v, optErr = syscall.GetsockoptInt(int(fd), level, opt)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if optErr != nil {
+		t.Fatal(optErr)
+	}
+	return v
+}
+
+func TestTCPOptions_Apply(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = l.Close() }()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+
+	noDelay := false
+	opts := &TCPOptions{NoDelay: &noDelay, KeepAlive: 10 * time.Second, ReadBufSize: 64 << 10, WriteBufSize: 64 << 10}
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+	defer func() { _ = (<-accepted).Close() }()
+	tcpConn := conn.(*net.TCPConn)
+
+	// applied to the TCP connection under TLS
+	if err := opts.apply(tls.Client(conn, &tls.Config{})); err != nil {
+		t.Fatal(err)
+	}
+
+	if v := getsockopt(t, tcpConn, syscall.IPPROTO_TCP, syscall.TCP_NODELAY); v != 0 {
+		t.Error("TCP_NODELAY not disabled")
+	}
+	if v := getsockopt(t, tcpConn, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE); v == 0 {
+		t.Error("SO_KEEPALIVE not enabled")
+	}
+	if v := getsockopt(t, tcpConn, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE); v != 10 {
+		t.Error("unexpected keepalive idle time =", v)
+	}
+	// the kernel doubles the size
+	if v := getsockopt(t, tcpConn, syscall.SOL_SOCKET, syscall.SO_RCVBUF); v < 64<<10 {
+		t.Error("unexpected read buffer size =", v)
+	}
+	if v := getsockopt(t, tcpConn, syscall.SOL_SOCKET, syscall.SO_SNDBUF); v < 64<<10 {
+		t.Error("unexpected write buffer size =", v)
+	}
+
+	// keepalive disabled
+	if err := (&TCPOptions{KeepAlive: -1}).apply(conn); err != nil {
+		t.Fatal(err)
+	}
+	if v := getsockopt(t, tcpConn, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE); v != 0 {
+		t.Error("SO_KEEPALIVE not disabled")
+	}
+
+	// no-op for other transports
+	c1, c2 := net.Pipe()
+	defer func() { _ = c1.Close(); _ = c2.Close() }()
+	if err := opts.apply(c1); err != nil {
+		t.Error("options applied to pipe, err =", err)
+	}
+}
@@ -0,0 +1,129 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrKeepaliveTimeout used when the keepalive response not received in
+// time, notified as the error of TransportError with op OpKeepalive
+var ErrKeepaliveTimeout = errors.New("keepalive timeout ")
+
+// operations of TransportError
+const (
+	OpRead      = "read"
+	OpWrite     = "write"
+	OpFlush     = "flush"
+	OpClose     = "close"
+	OpKeepalive = "keepalive"
+)
+
+// DialError is notified to the ConnHandleFunc when the connection to the
+// server not established (e.g. connection refused, dns lookup failed or
+// errors returned by the Connector)
+type DialError struct {
+	Server string
+	Err    error
+}
+
+func (e *DialError) Error() string {
+	return "dial server " + e.Server + " failed, " + e.Err.Error()
+}
+
+// Unwrap returns the error of the connector
+func (e *DialError) Unwrap() error {
+	return e.Err
+}
+
+// HandshakeError is notified to the ConnHandleFunc when the connection
+// established but not ready for MQTT, e.g. TLS handshake failed, ALPN
+// mismatch (see ALPNMismatchError) or the ConnAck packet not received, and
+// to the NetHandleFunc when the CONNECT packet not sent (e.g. too large to
+// encode), custom connectors may return it for handshakes of their own
+type HandshakeError struct {
+	Server string
+	Err    error
+}
+
+func (e *HandshakeError) Error() string {
+	return "handshake with server " + e.Server + " failed, " + e.Err.Error()
+}
+
+// Unwrap returns the error of the handshake
+func (e *HandshakeError) Unwrap() error {
+	return e.Err
+}
+
+// ProtocolError is notified to the NetHandleFunc when the server violated
+// the MQTT protocol (e.g. malformed packets), Reason is the reason code of
+// the Disconnect packet sent (MQTT 5)
+type ProtocolError struct {
+	Server string
+	Reason byte
+	Err    error
+}
+
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf("protocol error of server %s, reason code 0x%02x, %v", e.Server, e.Reason, e.Err)
+}
+
+// Unwrap returns the error of the violation, usually MalformedPacketError
+func (e *ProtocolError) Unwrap() error {
+	return e.Err
+}
+
+// TransportError is notified to the NetHandleFunc when the connection
+// established is broken, Op is one of OpRead, OpWrite, OpFlush, OpClose
+// and OpKeepalive, timeouts can be checked with errors.As and net.Error
+type TransportError struct {
+	Server string
+	Op     string
+	Err    error
+}
+
+func (e *TransportError) Error() string {
+	return "connection " + e.Op + " failed, server " + e.Server + ", " + e.Err.Error()
+}
+
+// Unwrap returns the error of the connection
+func (e *TransportError) Unwrap() error {
+	return e.Err
+}
+
+// dialError wraps the error of the connector with DialError, errors
+// already classified (e.g. HandshakeError of the TLS handshake) are kept
+func dialError(server string, err error) error {
+	var handshake *HandshakeError
+	if errors.As(err, &handshake) {
+		return err
+	}
+	return &DialError{Server: server, Err: err}
+}
+
+// recvError classifies the error of reading packets from the server
+func recvError(server string, err error) error {
+	var malformed *MalformedPacketError
+	switch {
+	case errors.As(err, &malformed):
+		return &ProtocolError{Server: server, Reason: malformed.Code, Err: err}
+	case err == ErrDecodeNoneV311Packet || err == ErrDecodeNoneV5Packet || err == ErrDecodeBadPacket:
+		return &ProtocolError{Server: server, Reason: CodeMalformedPacket, Err: err}
+	}
+	return &TransportError{Server: server, Op: OpRead, Err: err}
+}
@@ -0,0 +1,386 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClient_DialError(t *testing.T) {
+	refused := errors.New("refused")
+	for _, c := range []struct {
+		err       error
+		handshake bool
+	}{
+		{err: refused},
+		{err: &HandshakeError{Server: "fake", Err: refused}, handshake: true},
+	} {
+		results := make(chan error, 1)
+		client, err := NewClient(
+			WithCustomConnector(func(ctx context.Context, address string, timeout time.Duration, tlsConfig *tls.Config) (net.Conn, error) {
+				return nil, c.err
+			}),
+			WithConnHandleFunc(func(client Client, server string, code byte, err error) {
+				results <- err
+			}),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := client.ConnectServer("fake"); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case err := <-results:
+			var (
+				dial      *DialError
+				handshake *HandshakeError
+			)
+			if !errors.Is(err, refused) {
+				t.Error("cause not wrapped, err =", err)
+			}
+			if c.handshake && (!errors.As(err, &handshake) || errors.As(err, &dial)) {
+				t.Error("handshake error not kept, err =", err)
+			}
+			if !c.handshake && (!errors.As(err, &dial) || dial.Server != "fake") {
+				t.Error("unexpected dial error =", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("connect timeout")
+		}
+		client.Destroy(true)
+	}
+}
+
+func TestTCPConnect_HandshakeError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = l.Close() }()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+		}
+	}()
+
+	_, err = tcpConnect(context.Background(), l.Addr().String(), time.Second, 0, &tls.Config{InsecureSkipVerify: true})
+	var handshake *HandshakeError
+	if !errors.As(err, &handshake) || handshake.Server != l.Addr().String() {
+		t.Error("unexpected tls error =", err)
+	}
+}
+
+func TestClient_TransportError(t *testing.T) {
+	for _, c := range []struct {
+		op    string
+		cause error
+	}{
+		{op: OpKeepalive, cause: ErrKeepaliveTimeout},
+		{op: OpRead, cause: io.EOF},
+	} {
+		c := c
+		netErrs := make(chan error, 10)
+		connector := func(ctx context.Context, address string, timeout time.Duration, tlsConfig *tls.Config) (net.Conn, error) {
+			client, server := net.Pipe()
+			go func() {
+				defer func() { _ = server.Close() }()
+				r := bufio.NewReader(server)
+				if _, err := Decode(V311, r); err != nil {
+					return
+				}
+
+				w := bufio.NewWriter(server)
+				_ = (&ConnAckPacket{Code: CodeSuccess}).WriteTo(w)
+				_ = w.Flush()
+				if c.op == OpKeepalive {
+					// pings never responded
+					_, _ = io.Copy(ioutil.Discard, r)
+				}
+			}()
+			return client, nil
+		}
+
+		client, err := NewClient(
+			WithDialTimeout(1),
+			WithKeepalive(1, 1.2),
+			WithReadTimeout(-1),
+			WithCustomConnector(connector),
+			WithNetHandleFunc(func(client Client, server string, err error) {
+				select {
+				case netErrs <- err:
+				default:
+				}
+			}),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := client.ConnectServer("fake"); err != nil {
+			t.Fatal(err)
+		}
+
+		// handlers are called concurrently, io.EOF and read errors of the
+		// connection closed on keepalive timeout may be handled first
+	wait:
+		for {
+			select {
+			case err := <-netErrs:
+				var transport *TransportError
+				if err == io.EOF || c.op == OpKeepalive && errors.As(err, &transport) && transport.Op == OpRead {
+					continue
+				}
+				if !errors.As(err, &transport) || transport.Op != c.op || transport.Server != "fake" || !errors.Is(err, c.cause) {
+					t.Error("unexpected transport error =", err, "expected op =", c.op)
+				}
+				break wait
+			case <-time.After(5 * time.Second):
+				t.Error("connection not broken, op =", c.op)
+				break wait
+			}
+		}
+		client.Destroy(true)
+	}
+}
+
+func TestRecvError(t *testing.T) {
+	malformed := &MalformedPacketError{Code: CodeProtoError, Reason: "bad"}
+	for _, c := range []struct {
+		err    error
+		reason byte
+	}{
+		{err: malformed, reason: CodeProtoError},
+		{err: ErrDecodeNoneV5Packet, reason: CodeMalformedPacket},
+		{err: io.ErrUnexpectedEOF},
+	} {
+		err := recvError("fake", c.err)
+		if !errors.Is(err, c.err) {
+			t.Error("cause not wrapped, err =", err)
+		}
+
+		var (
+			protocol  *ProtocolError
+			transport *TransportError
+		)
+		if c.reason == 0 {
+			if !errors.As(err, &transport) || transport.Op != OpRead {
+				t.Error("unexpected read error =", err)
+			}
+			continue
+		}
+
+		var e *MalformedPacketError
+		if !errors.As(err, &protocol) || protocol.Reason != c.reason || errors.As(err, &e) != (c.err == malformed) {
+			t.Error("unexpected protocol error =", err)
+		}
+	}
+}
+
+func TestClient_EncodeError(t *testing.T) {
+	pubErrs, subErrs := make(chan error, 2), make(chan error, 1)
+	client, err := NewClient(
+		WithDialTimeout(10),
+		WithKeepalive(10, 1.2),
+		WithoutTopicValidation(),
+		WithPubHandleFunc(func(client Client, topic string, err error) { pubErrs <- err }),
+		WithSubHandleFunc(func(client Client, topics []*Topic, err error) { subErrs <- err }),
+		WithCustomConnector(fakeConnector(fakeBrokerConfig{ackPub: true})),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Destroy(true)
+
+	if err := client.ConnectServer("fake"); err != nil {
+		t.Fatal(err)
+	}
+
+	wait := func(ch chan error) error {
+		select {
+		case err := <-ch:
+			return err
+		case <-time.After(5 * time.Second):
+			return errors.New("timeout")
+		}
+	}
+
+	longTopic := strings.Repeat("a", maxStringLen+1)
+	client.Publish(&PublishPacket{TopicName: longTopic, Qos: Qos1, Payload: []byte("foo")})
+	if err := wait(pubErrs); err != ErrStringTooLong {
+		t.Error("unexpected publish error =", err)
+	}
+
+	client.Subscribe(&Topic{Name: longTopic})
+	if err := wait(subErrs); err != ErrStringTooLong {
+		t.Error("unexpected subscribe error =", err)
+	}
+
+	// connection still usable
+	client.Publish(&PublishPacket{TopicName: "/foo", Qos: Qos1, Payload: []byte("foo")})
+	if err := wait(pubErrs); err != nil {
+		t.Error("publish failed after encode error, err =", err)
+	}
+
+	if pending := client.Pending(); len(pending) != 0 {
+		t.Error("packet id not released, pending =", pending)
+	}
+}
+
+func TestClient_DisconnMalformed(t *testing.T) {
+	for _, c := range []struct {
+		props []byte
+		code  byte
+	}{
+		// duplicate reason string
+		{props: []byte{8, propKeyReasonString, 0, 1, 'a', propKeyReasonString, 0, 1, 'b'}, code: CodeProtoError},
+		// topic alias not allowed in PubAck
+		{props: []byte{3, propKeyTopicAlias, 0, 1}, code: CodeMalformedPacket},
+		// truncated reason string
+		{props: []byte{4, propKeyReasonString, 0, 5, 'a'}, code: CodeMalformedPacket},
+	} {
+		disconn := make(chan *DisconnPacket, 1)
+		client, err := NewClient(
+			WithVersion(V5, false),
+			WithCustomConnector(scriptBroker(V5, func(s *fakeSession) {
+				s.write(&ConnAckPacket{})
+
+				// PubAck with packet id, reason code and properties
+				body := append([]byte{0, 1, CodeSuccess}, c.props...)
+				s.writeRaw(append([]byte{CtrlPubAck << 4, byte(len(body))}, body...))
+
+				if p := s.waitDisconn(); p != nil {
+					disconn <- p
+				}
+			})),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := client.ConnectServer("fake"); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case p := <-disconn:
+			if p.Code != c.code || p.Props == nil || p.Props.Reason == "" {
+				t.Error("unexpected disconnect, code =", p.Code, "props =", p.Props)
+			}
+		case <-time.After(5 * time.Second):
+			t.Error("disconnect not sent, props =", c.props)
+		}
+		client.Destroy(true)
+	}
+}
+
+func TestClient_PubAckError(t *testing.T) {
+	pubErrs := make(map[string]chan error)
+	for _, topic := range []string{"/denied", "/quota", "/nobody"} {
+		pubErrs[topic] = make(chan error, 1)
+	}
+
+	pubRel := make(chan uint16, 1)
+	client, err := NewClient(
+		WithVersion(V5, false),
+		WithPubHandleFunc(func(client Client, topic string, err error) { pubErrs[topic] <- err }),
+		WithCustomConnector(scriptBroker(V5, func(s *fakeSession) {
+			s.write(&ConnAckPacket{})
+			for {
+				pkt, err := s.read()
+				if err != nil {
+					return
+				}
+
+				switch p := pkt.(type) {
+				case *PublishPacket:
+					switch p.TopicName {
+					case "/denied":
+						s.write(&PubAckPacket{PacketID: p.PacketID, Code: CodeNotAuthorized, Props: &PubAckProps{Reason: "denied"}})
+					case "/quota":
+						s.write(&PubRecvPacket{PacketID: p.PacketID, Code: CodeQuotaExceeded})
+					default:
+						s.write(&PubAckPacket{PacketID: p.PacketID, Code: CodeNoMatchingSubscribers})
+					}
+				case *PubRelPacket:
+					pubRel <- p.PacketID
+				}
+			}
+		})),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Destroy(true)
+
+	if err := client.ConnectServer("fake"); err != nil {
+		t.Fatal(err)
+	}
+
+	wait := func(topic string) error {
+		select {
+		case err := <-pubErrs[topic]:
+			return err
+		case <-time.After(5 * time.Second):
+			return errors.New("timeout")
+		}
+	}
+
+	client.Publish(&PublishPacket{TopicName: "/denied", Qos: Qos1, Payload: []byte("foo")})
+	if err, ok := wait("/denied").(*PubAckError); !ok || err.Packet != CtrlPubAck ||
+		err.ReasonCode() != CodeNotAuthorized || err.Reason != "denied" {
+		t.Error("unexpected publish error =", err)
+	}
+
+	client.Publish(&PublishPacket{TopicName: "/quota", Qos: Qos2, Payload: []byte("foo")})
+	if err, ok := wait("/quota").(*PubAckError); !ok || err.Packet != CtrlPubRecv ||
+		err.ReasonCode() != CodeQuotaExceeded {
+		t.Error("unexpected publish error =", err)
+	}
+
+	// success reason code
+	client.Publish(&PublishPacket{TopicName: "/nobody", Qos: Qos1, Payload: []byte("foo")})
+	if err := wait("/nobody"); err != nil {
+		t.Error("unexpected publish error =", err)
+	}
+
+	select {
+	case id := <-pubRel:
+		t.Error("PubRel sent for refused publish, id =", id)
+	default:
+	}
+
+	if pending := client.Pending(); len(pending) != 0 {
+		t.Error("packet id not released, pending =", pending)
+	}
+}
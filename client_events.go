@@ -0,0 +1,155 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const defaultEventBufSize = 64
+
+// Event is the event of the client received from Client.Events, one of
+// ConnectedEvent, DisconnectedEvent, ReconnectingEvent, SubscribedEvent,
+// UnsubscribedEvent, PublishedEvent, PersistErrorEvent or PersistPurgedEvent
+type Event interface {
+	isEvent()
+}
+
+// ConnectedEvent is the result of the connect to the server, the same as
+// the ConnHandleFunc is called with (Err is nil if connected)
+type ConnectedEvent struct {
+	Server string
+	Code   byte
+	Err    error
+	// SessionPresent is the flag of ConnAck, true if the server resumed the
+	// session, packets not acked are resent with the DUP flag and no
+	// subscription sent again, otherwise packets not acked are resent as
+	// new packets and subscriptions sent again if WithAutoResubscribe
+	SessionPresent bool
+}
+
+// DisconnectedEvent is sent when the connection to the server lost or
+// failed, the same as the NetHandleFunc is called with
+type DisconnectedEvent struct {
+	Server string
+	Err    error
+}
+
+// ReconnectingEvent is sent when the reconnect to the server scheduled
+// after the delay
+type ReconnectingEvent struct {
+	Server string
+	Delay  time.Duration
+}
+
+// SubscribedEvent is the result of the subscribe, the same as the
+// SubHandleFunc is called with
+type SubscribedEvent struct {
+	Topics []*Topic
+	Err    error
+}
+
+// UnsubscribedEvent is the result of the unsubscribe, the same as the
+// UnsubHandleFunc is called with
+type UnsubscribedEvent struct {
+	Topics []string
+	Err    error
+}
+
+// PublishedEvent is the result of the publish, the same as the
+// PubHandleFunc is called with
+type PublishedEvent struct {
+	Topic string
+	Err   error
+}
+
+// PersistErrorEvent is sent when the persist failed, the same as the
+// PersistHandleFunc is called with (Packet is nil if the error is not
+// related to a packet)
+type PersistErrorEvent struct {
+	Packet Packet
+	Err    error
+}
+
+// PersistPurgedEvent is sent when expired packets purged from persist
+// (see WithPersistTTL), purges are not errors
+type PersistPurgedEvent struct {
+	Count int
+}
+
+func (*ConnectedEvent) isEvent()     {}
+func (*DisconnectedEvent) isEvent()  {}
+func (*ReconnectingEvent) isEvent()  {}
+func (*SubscribedEvent) isEvent()    {}
+func (*UnsubscribedEvent) isEvent()  {}
+func (*PublishedEvent) isEvent()     {}
+func (*PersistErrorEvent) isEvent()  {}
+func (*PersistPurgedEvent) isEvent() {}
+
+// WithEventBuf designate the size of the event buffer (see Client.Events),
+// events are dropped once the buffer is full
+func WithEventBuf(size int) Option {
+	return func(c *AsyncClient, options *connectOptions) error {
+		if size < 1 {
+			size = 1
+		}
+
+		c.events = make(chan Event, size)
+		return nil
+	}
+}
+
+// Events returns the channel of client events, the alternative of
+// handlers (e.g. WithConnHandleFunc), handlers are still called if set
+//
+// events are never blocked by the receiver, events are dropped once the
+// buffer is full (see WithEventBuf) and counted in
+// ClientStats.DroppedEvents, events of the same kind are in order, but not
+// ordered among kinds (e.g. DisconnectedEvent may follow ReconnectingEvent),
+// the channel is never closed
+func (c *AsyncClient) Events() <-chan Event {
+	return c.events
+}
+
+// sendEvent sends the event without blocking
+func (c *AsyncClient) sendEvent(e Event) {
+	select {
+	case c.events <- e:
+	default:
+		atomic.AddUint64(&c.stats.droppedEvents, 1)
+	}
+}
+
+// notifyConn notifies the result of the connect to the ConnHandleFunc and
+// the event receiver
+func (c connectOptions) notifyConn(parent *AsyncClient, server string, code byte, err error) {
+	c.notifyConnEvent(parent, &ConnectedEvent{Server: server, Code: code, Err: err})
+}
+
+// notifyConnected notifies the connect succeeded with the session present
+// flag of ConnAck
+func (c connectOptions) notifyConnected(parent *AsyncClient, server string, present bool) {
+	c.notifyConnEvent(parent, &ConnectedEvent{Server: server, Code: CodeSuccess, SessionPresent: present})
+}
+
+func (c connectOptions) notifyConnEvent(parent *AsyncClient, e *ConnectedEvent) {
+	parent.sendEvent(e)
+	if c.connHandler != nil {
+		parent.addWorker(func() { c.connHandler(parent, e.Server, e.Code, e.Err) })
+	}
+}
@@ -0,0 +1,119 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestClient_Events(t *testing.T) {
+	var (
+		serverMu   sync.Mutex
+		serverConn net.Conn
+		handled    = make(chan struct{}, 2)
+	)
+	client, err := NewClient(
+		WithBackoffStrategy(time.Millisecond, time.Millisecond, 1),
+		WithCustomConnector(func(ctx context.Context, address string, timeout time.Duration, tlsConfig *tls.Config) (net.Conn, error) {
+			client, server := net.Pipe()
+			serverMu.Lock()
+			serverConn = server
+			serverMu.Unlock()
+
+			go fakeBroker(server, true)
+			return client, nil
+		}),
+		// handlers are still called with events
+		WithConnHandleFunc(func(client Client, server string, code byte, err error) {
+			handled <- struct{}{}
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Destroy(true)
+
+	next := func() Event {
+		select {
+		case e := <-client.Events():
+			return e
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event received")
+			return nil
+		}
+	}
+
+	if err := client.ConnectServer("fake"); err != nil {
+		t.Fatal(err)
+	}
+	if e, ok := next().(*ConnectedEvent); !ok || e.Server != "fake" || e.Code != CodeSuccess || e.Err != nil {
+		t.Fatalf("unexpected event %+v", e)
+	}
+	select {
+	case <-handled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("conn handler not called")
+	}
+
+	client.Publish(&PublishPacket{TopicName: "/foo", Qos: Qos1})
+	if e, ok := next().(*PublishedEvent); !ok || e.Topic != "/foo" || e.Err != nil {
+		t.Fatalf("unexpected event %+v", e)
+	}
+
+	serverMu.Lock()
+	_ = serverConn.Close()
+	serverMu.Unlock()
+
+	// the connection lost may be notified by both read and write, and not
+	// ordered with the reconnect
+	var disconnected, reconnecting, reconnected bool
+	for !disconnected || !reconnecting || !reconnected {
+		switch e := next().(type) {
+		case *DisconnectedEvent:
+			disconnected = e.Server == "fake" && e.Err != nil
+		case *ReconnectingEvent:
+			reconnecting = e.Server == "fake" && e.Delay > 0
+		case *ConnectedEvent:
+			reconnected = reconnecting && e.Code == CodeSuccess
+		default:
+			t.Fatalf("unexpected event %+v", e)
+		}
+	}
+}
+
+func TestClient_EventsDropped(t *testing.T) {
+	client, err := NewClient(WithEventBuf(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Destroy(true)
+
+	client.sendEvent(&PublishedEvent{Topic: "/foo"})
+	client.sendEvent(&PublishedEvent{Topic: "/bar"})
+
+	if e := <-client.Events(); e.(*PublishedEvent).Topic != "/foo" {
+		t.Error("unexpected event", e)
+	}
+	if dropped := client.Stats().DroppedEvents; dropped != 1 {
+		t.Error("unexpected dropped events =", dropped)
+	}
+}
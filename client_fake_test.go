@@ -0,0 +1,246 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// pipeConnector returns the connector of a fake broker, the server side of
+// every connection is served by serve
+func pipeConnector(serve func(conn net.Conn)) Connector {
+	return func(ctx context.Context, address string, timeout time.Duration, tlsConfig *tls.Config) (net.Conn, error) {
+		client, server := net.Pipe()
+		go serve(server)
+		return client, nil
+	}
+}
+
+// fakeConnector returns the connector of the fake broker configured by cfg
+func fakeConnector(cfg fakeBrokerConfig) Connector {
+	return pipeConnector(func(conn net.Conn) { serveFakeBroker(conn, cfg) })
+}
+
+// fakeBroker acks every packet received from the client instantly (publish
+// packets only if ackPub), acks are queued without limit since net.Pipe
+// has no buffer
+func fakeBroker(conn net.Conn, ackPub bool) {
+	serveFakeBroker(conn, fakeBrokerConfig{ackPub: ackPub})
+}
+
+// fakeBrokerConfig configures the fake broker
+type fakeBrokerConfig struct {
+	ackPub   bool                        // ack publish packets received
+	noAck    func(p *PublishPacket) bool // publish packets not acked if ackPub, nil to ack all
+	present  bool                        // SessionPresent of ConnAck
+	received chan<- Packet               // packets received after connect if not nil
+}
+
+func serveFakeBroker(conn net.Conn, cfg fakeBrokerConfig) {
+	serveFakeSession(conn, bufio.NewReader(conn), nil, cfg)
+}
+
+// serveFakeSession is serveFakeBroker reading conn with r, the connect
+// packet is read already if not nil
+func serveFakeSession(conn net.Conn, r *bufio.Reader, connect *ConnPacket, cfg fakeBrokerConfig) {
+	defer func() { _ = conn.Close() }()
+
+	var (
+		mu     sync.Mutex
+		cond   = sync.NewCond(&mu)
+		queue  []Packet
+		closed bool
+	)
+	defer func() {
+		mu.Lock()
+		closed = true
+		mu.Unlock()
+		cond.Signal()
+	}()
+
+	ack := func(pkt Packet) {
+		mu.Lock()
+		queue = append(queue, pkt)
+		mu.Unlock()
+		cond.Signal()
+	}
+
+	go func() {
+		w := bufio.NewWriter(conn)
+		for {
+			mu.Lock()
+			for len(queue) == 0 && !closed {
+				cond.Wait()
+			}
+			pkts := queue
+			queue = nil
+			mu.Unlock()
+
+			if len(pkts) == 0 {
+				return
+			}
+
+			for _, pkt := range pkts {
+				_ = pkt.WriteTo(w)
+			}
+			if w.Flush() != nil {
+				return
+			}
+		}
+	}()
+
+	var pkt Packet
+	if connect != nil {
+		pkt = connect
+	}
+	for ; ; pkt = nil {
+		if pkt == nil {
+			var err error
+			if pkt, err = Decode(V311, r); err != nil {
+				return
+			}
+		}
+
+		if _, ok := pkt.(*ConnPacket); !ok && cfg.received != nil {
+			cfg.received <- pkt
+		}
+
+		switch p := pkt.(type) {
+		case *ConnPacket:
+			ack(&ConnAckPacket{Code: CodeSuccess, Present: cfg.present})
+		case *PublishPacket:
+			if !cfg.ackPub || cfg.noAck != nil && cfg.noAck(p) {
+				break
+			}
+
+			switch p.Qos {
+			case Qos1:
+				ack(&PubAckPacket{PacketID: p.PacketID})
+			case Qos2:
+				ack(&PubRecvPacket{PacketID: p.PacketID})
+			}
+		case *PubRelPacket:
+			ack(&PubCompPacket{PacketID: p.PacketID})
+		case *SubscribePacket:
+			codes := make([]byte, len(p.Topics))
+			for i, t := range p.Topics {
+				codes[i] = t.Qos & 0x03
+			}
+			ack(&SubAckPacket{PacketID: p.PacketID, Codes: codes})
+		case *UnsubPacket:
+			ack(&UnsubAckPacket{PacketID: p.PacketID})
+		case *pingReqPacket:
+			ack(PingRespPacket)
+		case *DisconnPacket:
+			return
+		}
+	}
+}
+
+// scriptBroker returns the connector of a fake broker running script with
+// every connection once the connect packet decoded with version, the
+// connection is closed once script returned
+func scriptBroker(version ProtoVersion, script func(s *fakeSession)) Connector {
+	var dialed int32
+	return func(ctx context.Context, address string, timeout time.Duration, tlsConfig *tls.Config) (net.Conn, error) {
+		n := atomic.AddInt32(&dialed, 1)
+		client, server := net.Pipe()
+		go func() {
+			defer func() { _ = server.Close() }()
+
+			s := &fakeSession{
+				n:       n,
+				version: version,
+				conn:    server,
+				r:       bufio.NewReader(server),
+				w:       bufio.NewWriter(server),
+			}
+			pkt, err := s.read()
+			if err != nil {
+				return
+			}
+			if s.connect, _ = pkt.(*ConnPacket); s.connect != nil {
+				script(s)
+			}
+		}()
+		return client, nil
+	}
+}
+
+// fakeSession is a connection of the scripted fake broker
+type fakeSession struct {
+	n       int32        // connections dialed so far, including this one
+	version ProtoVersion // version to decode and encode packets
+	connect *ConnPacket  // connect packet received
+
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+// write sends packets to the client with the version of the session
+func (s *fakeSession) write(pkts ...Packet) {
+	for _, pkt := range pkts {
+		pkt.SetVersion(s.version)
+		_ = pkt.WriteTo(s.w)
+	}
+	_ = s.w.Flush()
+}
+
+// writeRaw sends the bytes of packets not encodable (e.g. malformed)
+func (s *fakeSession) writeRaw(b []byte) {
+	_, _ = s.w.Write(b)
+	_ = s.w.Flush()
+}
+
+// read receives the next packet from the client
+func (s *fakeSession) read() (Packet, error) {
+	return Decode(s.version, s.r)
+}
+
+// discard reads all packets from the client until the connection closed
+func (s *fakeSession) discard() {
+	_, _ = io.Copy(ioutil.Discard, s.r)
+}
+
+// waitDisconn reads packets from the client until DisconnPacket received,
+// nil if the connection closed before
+func (s *fakeSession) waitDisconn() *DisconnPacket {
+	for {
+		pkt, err := s.read()
+		if err != nil {
+			return nil
+		}
+		if p, ok := pkt.(*DisconnPacket); ok {
+			return p
+		}
+	}
+}
+
+// serve serves the session as the fake broker configured by cfg (MQTT
+// 3.1.1 only), starting with the connect packet received
+func (s *fakeSession) serve(cfg fakeBrokerConfig) {
+	serveFakeSession(s.conn, s.r, s.connect, cfg)
+}
@@ -0,0 +1,201 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClient_ConnectServerFlushPolicy(t *testing.T) {
+	testConnectServerFlush(t, WithFlushPolicy(FlushPolicy{}))
+}
+
+func TestClient_ConnectServerDirectWrite(t *testing.T) {
+	// every packet flushed once written, no matter the flush policy
+	testConnectServerFlush(t, WithDirectWrite(true))
+}
+
+// testConnectServerFlush connects with the options passed to ConnectServer,
+// the client flush policy never flushes the connect packet
+func testConnectServerFlush(t *testing.T, options ...Option) {
+	t.Helper()
+
+	connected := make(chan error, 1)
+	client, err := NewClient(
+		WithDialTimeout(10),
+		WithFlushPolicy(FlushPolicy{Delay: time.Hour}),
+		WithCustomConnector(fakeConnector(fakeBrokerConfig{ackPub: true})),
+		WithConnHandleFunc(func(client Client, server string, code byte, err error) {
+			connected <- err
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Destroy(true)
+
+	if err := client.ConnectServer("fake", options...); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-connected:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("flush options of ConnectServer not applied")
+	}
+}
+
+func TestFlushPolicy_ShouldFlush(t *testing.T) {
+	pub := &PublishPacket{TopicName: "/foo"}
+	for _, c := range []struct {
+		policy   FlushPolicy
+		pkt      Packet
+		pending  int
+		buffered int
+		flush    bool
+	}{
+		{FlushPolicy{}, pub, 1, 10, true},
+		{FlushPolicy{Delay: time.Millisecond}, pub, 100, 10000, false},
+		{FlushPolicy{Delay: time.Millisecond}, &PubAckPacket{}, 1, 10, true},
+		{FlushPolicy{Delay: time.Millisecond}, &PubRecvPacket{}, 1, 10, true},
+		{FlushPolicy{Delay: time.Millisecond}, &PubRelPacket{}, 1, 10, true},
+		{FlushPolicy{Delay: time.Millisecond}, &PubCompPacket{}, 1, 10, true},
+		{FlushPolicy{Delay: time.Millisecond, MaxPackets: 10}, pub, 9, 10, false},
+		{FlushPolicy{Delay: time.Millisecond, MaxPackets: 10}, pub, 10, 10, true},
+		{FlushPolicy{Delay: time.Millisecond, MaxBytes: 100}, pub, 1, 99, false},
+		{FlushPolicy{Delay: time.Millisecond, MaxBytes: 100}, pub, 1, 100, true},
+	} {
+		if flush := c.policy.shouldFlush(c.pkt, c.pending, c.buffered); flush != c.flush {
+			t.Errorf("policy %+v, packet %v, pending %d, buffered %d: flush = %v", c.policy, c.pkt.Type(), c.pending, c.buffered, flush)
+		}
+	}
+}
+
+// countConn counts write calls and discards all data
+type countConn struct {
+	net.Conn
+	writes int64
+}
+
+func (c *countConn) Write(b []byte) (int, error) {
+	atomic.AddInt64(&c.writes, 1)
+	return len(b), nil
+}
+
+func (c *countConn) Close() error {
+	return nil
+}
+
+func (c *countConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func benchmarkFlushPolicy(b *testing.B, policy FlushPolicy) {
+	parent := defaultClient()
+	parent.options.flushPolicy = policy
+	parent.sendCh = make(chan Packet, 100)
+
+	netConn := &countConn{}
+	conn := &clientConn{
+		parent:     parent,
+		options:    &parent.options,
+		name:       "bench",
+		conn:       netConn,
+		connW:      bufio.NewWriter(netConn),
+		logicSendC: make(chan Packet),
+	}
+	conn.ctx, conn.exit = context.WithCancel(context.Background())
+	conn.stopSig = conn.ctx.Done()
+
+	done := make(chan struct{})
+	go func() {
+		conn.handleSend()
+		close(done)
+	}()
+
+	// QoS1 packet, no publish notification will be sent to msgCh
+	pkt := &PublishPacket{TopicName: "/foo/bar", Qos: Qos1, PacketID: 1, Payload: make([]byte, 64)}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		parent.sendCh <- pkt
+	}
+	parent.sendCh <- &DisconnPacket{}
+	<-done
+	b.StopTimer()
+
+	b.ReportMetric(float64(atomic.LoadInt64(&netConn.writes))/float64(b.N), "writes/op")
+}
+
+func BenchmarkFlushPolicy_Immediate(b *testing.B) {
+	benchmarkFlushPolicy(b, FlushPolicy{})
+}
+
+func BenchmarkFlushPolicy_Default(b *testing.B) {
+	benchmarkFlushPolicy(b, defaultConnectOptions().flushPolicy)
+}
+
+func BenchmarkFlushPolicy_Delay5ms(b *testing.B) {
+	benchmarkFlushPolicy(b, FlushPolicy{Delay: 5 * time.Millisecond})
+}
+
+func BenchmarkFlushPolicy_MaxPackets(b *testing.B) {
+	benchmarkFlushPolicy(b, FlushPolicy{Delay: 5 * time.Millisecond, MaxPackets: 16})
+}
+
+func BenchmarkFlushPolicy_MaxBytes(b *testing.B) {
+	benchmarkFlushPolicy(b, FlushPolicy{Delay: 5 * time.Millisecond, MaxBytes: 1024})
+}
+
+func TestClientConn_DirectWrite(t *testing.T) {
+	parent := defaultClient()
+	_ = WithDirectWrite(true)(parent, &parent.options)
+	_ = WithFlushPolicy(FlushPolicy{Delay: time.Hour})(parent, &parent.options)
+	parent.sendCh = make(chan Packet, 10)
+
+	netConn := &countConn{}
+	conn := &clientConn{
+		parent:     parent,
+		options:    &parent.options,
+		name:       "test",
+		conn:       netConn,
+		connW:      parent.options.newConnWriter(netConn),
+		logicSendC: make(chan Packet),
+	}
+	conn.ctx, conn.exit = context.WithCancel(context.Background())
+	conn.stopSig = conn.ctx.Done()
+
+	const count = 5
+	for i := 0; i < count; i++ {
+		parent.sendCh <- &PublishPacket{TopicName: "/foo", Qos: Qos1, PacketID: uint16(i + 1), Payload: []byte("bar")}
+	}
+	parent.sendCh <- &DisconnPacket{}
+	conn.handleSend()
+
+	// every packet written with a single write call
+	if n := atomic.LoadInt64(&netConn.writes); n != count+1 {
+		t.Error("write calls =", n)
+	}
+}
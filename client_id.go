@@ -0,0 +1,157 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"crypto/rand"
+	"errors"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+// errors of client id validation (see WithStrictClientID)
+var (
+	// ErrClientIDRequired used when the client id is empty with persistent
+	// session (WithCleanSession(false)) for MQTT 3.1.1 and MQTT 3.1
+	ErrClientIDRequired = errors.New("client id required for persistent session ")
+
+	// ErrClientIDTooLong used when the client id is longer than 65535 bytes
+	// (23 bytes with strict validation)
+	ErrClientIDTooLong = errors.New("client id too long ")
+
+	// ErrClientIDBadChar used when the client id is not well formed UTF-8
+	// or contains U+0000 (characters other than 0-9, a-z and A-Z with
+	// strict validation)
+	ErrClientIDBadChar = errors.New("client id contains illegal character ")
+)
+
+const (
+	clientIDChars        = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	clientIDSuffixLen    = 8
+	clientIDMaxHostLen   = maxClientIDLenV31 - clientIDSuffixLen
+	clientIDDefaultLabel = "libmqtt"
+)
+
+// WithAutoClientID generates the client id with the prefix and a random
+// suffix, the prefix is the hostname (only letters and digits, at most 15
+// characters) if empty, the id is generated once and reused for the
+// lifetime of the client (even applied again with another prefix)
+func WithAutoClientID(prefix string) Option {
+	return func(c *AsyncClient, options *connectOptions) error {
+		id, err := c.autoClientID(prefix)
+		if err != nil {
+			return err
+		}
+
+		options.connPacket.ClientID = id
+		return nil
+	}
+}
+
+// WithStrictClientID validates client ids with the rules of MQTT 3.1.1
+// servers MUST accept (1 to 23 characters of 0-9, a-z and A-Z), most
+// servers are lenient and accept longer ids with any UTF-8 characters, so
+// only well formed UTF-8 without U+0000 is required by default
+func WithStrictClientID(strict bool) Option {
+	return func(c *AsyncClient, options *connectOptions) error {
+		options.strictClientID = strict
+		return nil
+	}
+}
+
+// autoClientID returns the client id generated, generates one if not
+// generated before
+func (c *AsyncClient) autoClientID(prefix string) (string, error) {
+	c.clientIDMu.Lock()
+	defer c.clientIDMu.Unlock()
+
+	if c.clientID != "" {
+		return c.clientID, nil
+	}
+
+	if prefix == "" {
+		prefix = hostLabel()
+	}
+
+	suffix := make([]byte, clientIDSuffixLen)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	for i, b := range suffix {
+		suffix[i] = clientIDChars[int(b)%len(clientIDChars)]
+	}
+
+	c.clientID = prefix + string(suffix)
+	return c.clientID, nil
+}
+
+// hostLabel returns letters and digits of the hostname, so the id
+// generated is valid with strict validation
+func hostLabel() string {
+	host, _ := os.Hostname()
+
+	label := strings.Map(func(r rune) rune {
+		if r < utf8.RuneSelf && strings.IndexByte(clientIDChars, byte(r)) >= 0 {
+			return r
+		}
+		return -1
+	}, host)
+
+	if label == "" {
+		label = clientIDDefaultLabel
+	}
+	if len(label) > clientIDMaxHostLen {
+		label = label[:clientIDMaxHostLen]
+	}
+	return label
+}
+
+// validateClientID validates the client id of the connect packet
+func (c connectOptions) validateClientID() error {
+	id := c.connPacket.ClientID
+	if id == "" {
+		// MQTT 5 servers assign the client id (see ConnInfo.ClientID)
+		if c.persistentSession && c.protoVersion < V5 {
+			return ErrClientIDRequired
+		}
+		return nil
+	}
+
+	return checkClientID(id, c.strictClientID)
+}
+
+// checkClientID validates the client id not empty
+func checkClientID(id string, strict bool) error {
+	switch {
+	case len(id) > maxStringLen:
+		return ErrClientIDTooLong
+	case !utf8.ValidString(id), strings.IndexByte(id, 0) >= 0:
+		return ErrClientIDBadChar
+	case !strict:
+		return nil
+	case len(id) > maxClientIDLenV31:
+		return ErrClientIDTooLong
+	}
+
+	for i := 0; i < len(id); i++ {
+		if strings.IndexByte(clientIDChars, id[i]) < 0 {
+			return ErrClientIDBadChar
+		}
+	}
+	return nil
+}
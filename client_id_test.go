@@ -0,0 +1,256 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWithAutoClientID(t *testing.T) {
+	c := defaultClient()
+	if err := WithAutoClientID("")(c, &c.options); err != nil {
+		t.Fatal(err)
+	}
+
+	id := c.options.connPacket.ClientID
+	strict := defaultConnectOptions()
+	strict.strictClientID = true
+	strict.connPacket.ClientID = id
+	if id == "" || strict.validateClientID() != nil {
+		t.Error("generated client id invalid =", id)
+	}
+
+	// reused for the client
+	options := c.options.clone()
+	options.connPacket = &ConnPacket{}
+	if err := WithAutoClientID("other-")(c, &options); err != nil {
+		t.Fatal(err)
+	}
+	if options.connPacket.ClientID != id {
+		t.Error("client id generated again =", options.connPacket.ClientID, "first =", id)
+	}
+
+	// unique for clients
+	other := defaultClient()
+	if err := WithAutoClientID("sensor-")(other, &other.options); err != nil {
+		t.Fatal(err)
+	}
+	if otherID := other.options.connPacket.ClientID; otherID == id || !strings.HasPrefix(otherID, "sensor-") ||
+		len(otherID) != len("sensor-")+clientIDSuffixLen {
+		t.Error("unexpected client id =", otherID)
+	}
+}
+
+func TestConnectOptions_ValidateClientID(t *testing.T) {
+	for _, c := range []struct {
+		id         string
+		version    ProtoVersion
+		persistent bool
+		strict     bool
+		err        error
+	}{
+		{id: "", version: V311},
+		{id: "", version: V311, persistent: true, err: ErrClientIDRequired},
+		{id: "", version: V31, persistent: true, err: ErrClientIDRequired},
+		{id: "", version: V5, persistent: true},
+		{id: "client-1/a.b", version: V311},
+		{id: strings.Repeat("a", 24), version: V311},
+		{id: strings.Repeat("a", maxStringLen+1), version: V311, err: ErrClientIDTooLong},
+		{id: "bad\x00id", version: V311, err: ErrClientIDBadChar},
+		{id: "\xff", version: V311, err: ErrClientIDBadChar},
+		{id: "Client01", version: V311, strict: true},
+		{id: strings.Repeat("a", 24), version: V311, strict: true, err: ErrClientIDTooLong},
+		{id: "client-1", version: V311, strict: true, err: ErrClientIDBadChar},
+	} {
+		options := defaultConnectOptions()
+		options.connPacket.ClientID = c.id
+		options.protoVersion = c.version
+		options.persistentSession = c.persistent
+		options.strictClientID = c.strict
+
+		if err := options.validateClientID(); err != c.err {
+			t.Errorf("client id %q %+v: unexpected error = %v", c.id, c, err)
+		}
+	}
+}
+
+func TestNewClient_ClientIDRequired(t *testing.T) {
+	if _, err := NewClient(WithCleanSession(false)); !errors.Is(err, ErrClientIDRequired) {
+		t.Error("unexpected error =", err)
+	}
+
+	if _, err := NewClient(WithCleanSession(false), WithStrictClientID(true), WithClientID("a-b")); !errors.Is(err, ErrClientIDBadChar) {
+		t.Error("unexpected error =", err)
+	}
+
+	for _, options := range [][]Option{
+		{WithCleanSession(false), WithAutoClientID("")},
+		{WithCleanSession(false), WithVersion(V5, false)},
+	} {
+		client, err := NewClient(options...)
+		if err != nil {
+			t.Error("unexpected error =", err)
+			continue
+		}
+		client.Destroy(true)
+	}
+
+	client, err := NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Destroy(true)
+
+	if err := client.ConnectServer("fake", WithCleanSession(false)); err != ErrClientIDRequired {
+		t.Error("unexpected connect error =", err)
+	}
+}
+
+func TestClient_AssignedClientID(t *testing.T) {
+	connected := make(chan struct{}, 1)
+	client, err := NewClient(
+		WithVersion(V5, false),
+		WithCustomConnector(func(ctx context.Context, address string, timeout time.Duration, tlsConfig *tls.Config) (net.Conn, error) {
+			client, server := net.Pipe()
+			go func() {
+				defer func() { _ = server.Close() }()
+				if _, err := Decode(V5, bufio.NewReader(server)); err != nil {
+					return
+				}
+
+				w := bufio.NewWriter(server)
+				ack := &ConnAckPacket{Props: &ConnAckProps{AssignedClientID: "assigned"}}
+				ack.SetVersion(V5)
+				_ = ack.WriteTo(w)
+				_ = w.Flush()
+				_, _ = io.Copy(ioutil.Discard, server)
+			}()
+			return client, nil
+		}),
+		WithConnHandleFunc(func(client Client, server string, code byte, err error) {
+			if code == CodeSuccess {
+				connected <- struct{}{}
+			}
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Destroy(true)
+
+	if err := client.ConnectServer("fake"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not connected")
+	}
+
+	if info, ok := client.ConnInfo("fake"); !ok || info.ClientID != "assigned" {
+		t.Error("assigned client id not surfaced, info =", info)
+	}
+}
+
+func TestClientConn_PacketIDReuse(t *testing.T) {
+	const n = 5000
+
+	var (
+		published = make(chan struct{}, n)
+		inflight  = make(chan struct{}, 128) // less than available packet ids
+		connected = make(chan struct{})
+		persist   = NewMemPersist(nil)
+	)
+
+	client, err := NewClient(
+		WithPersist(persist),
+		WithDialTimeout(10),
+		WithKeepalive(10, 1.2),
+		WithCustomConnector(fakeConnector(fakeBrokerConfig{ackPub: true})),
+		WithConnHandleFunc(func(client Client, server string, code byte, err error) {
+			if err == nil && code == CodeSuccess {
+				close(connected)
+			}
+		}),
+		WithPubHandleFunc(func(client Client, topic string, err error) {
+			if err != nil {
+				t.Error("publish failed, err =", err)
+			}
+			<-inflight
+			published <- struct{}{}
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Destroy(true)
+
+	if err := client.ConnectServer("fake"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connect timeout")
+	}
+
+	// only a few packet ids are available, ids are reused frequently
+	const available = 256
+	client.idGen.mu.Lock()
+	for id := available + 1; id <= math.MaxUint16; id++ {
+		client.idGen.usedIDs[uint16(id)] = &idEntry{}
+	}
+	client.idGen.mu.Unlock()
+
+	go func() {
+		for i := 0; i < n; i++ {
+			inflight <- struct{}{}
+			client.Publish(&PublishPacket{TopicName: "/foo", Qos: QosLevel(i%2 + 1), Payload: []byte("bar")})
+		}
+	}()
+
+	for i := 0; i < n; i++ {
+		select {
+		case <-published:
+		case <-time.After(10 * time.Second):
+			t.Fatal("publish timeout, published =", i)
+		}
+	}
+
+	persist.Range(func(key string, p Packet) bool {
+		t.Error("persisted packet not deleted, key =", key)
+		return true
+	})
+
+	client.idGen.mu.RLock()
+	if used := len(client.idGen.usedIDs); used != math.MaxUint16-available {
+		t.Error("packet ids not reclaimed, count =", used)
+	}
+	client.idGen.mu.RUnlock()
+}
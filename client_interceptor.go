@@ -0,0 +1,74 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"errors"
+)
+
+// ErrPacketIntercepted is notified to the handler of publish, subscribe
+// and unsubscribe packets dropped by send interceptors
+var ErrPacketIntercepted = errors.New("packet dropped by interceptor ")
+
+// PacketInterceptor is called with every packet sent to or received from
+// the server, returns the packet to continue with (the packet itself or
+// a replacement), or nil to drop the packet
+//
+// interceptors are called in the send or receive goroutine of the
+// connection, and MUST NOT block
+type PacketInterceptor func(server string, pkt Packet) Packet
+
+// WithSendInterceptor adds the interceptor called before every packet
+// written to the connection (including Connect, acks and packets resent),
+// interceptors are called in the order added
+//
+// publish, subscribe and unsubscribe packets dropped are notified to
+// their handlers with ErrPacketIntercepted, other packets (and packets
+// resent) are dropped silently
+func WithSendInterceptor(interceptor PacketInterceptor) Option {
+	return func(c *AsyncClient, options *connectOptions) error {
+		if interceptor != nil {
+			options.sendInterceptors = append(options.sendInterceptors, interceptor)
+		}
+		return nil
+	}
+}
+
+// WithRecvInterceptor adds the interceptor called after every packet
+// decoded from the connection, interceptors are called in the order added
+//
+// packets dropped are not handled (e.g. publish packets are neither
+// delivered nor acked, QoS > 0 packets are redelivered by the server only
+// after reconnected with a persistent session)
+func WithRecvInterceptor(interceptor PacketInterceptor) Option {
+	return func(c *AsyncClient, options *connectOptions) error {
+		if interceptor != nil {
+			options.recvInterceptors = append(options.recvInterceptors, interceptor)
+		}
+		return nil
+	}
+}
+
+// intercept the packet with interceptors in order, returns nil if dropped
+func intercept(interceptors []PacketInterceptor, server string, pkt Packet) Packet {
+	for _, interceptor := range interceptors {
+		if pkt = interceptor(server, pkt); pkt == nil {
+			return nil
+		}
+	}
+	return pkt
+}
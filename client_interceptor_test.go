@@ -0,0 +1,121 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIntercept(t *testing.T) {
+	var order []string
+	interceptors := []PacketInterceptor{
+		func(server string, pkt Packet) Packet {
+			order = append(order, "first")
+			return &PublishPacket{TopicName: server}
+		},
+		func(server string, pkt Packet) Packet {
+			order = append(order, "second")
+			if pkt.(*PublishPacket).TopicName == "drop" {
+				return nil
+			}
+			return pkt
+		},
+		func(server string, pkt Packet) Packet {
+			order = append(order, "third")
+			return pkt
+		},
+	}
+
+	pkt := intercept(interceptors, "foo", PingReqPacket)
+	if p, ok := pkt.(*PublishPacket); !ok || p.TopicName != "foo" {
+		t.Error("packet not replaced, got", pkt)
+	}
+	if len(order) != 3 || order[0] != "first" || order[1] != "second" || order[2] != "third" {
+		t.Error("interceptors not called in order, got", order)
+	}
+
+	order = nil
+	if pkt := intercept(interceptors, "drop", PingReqPacket); pkt != nil {
+		t.Error("packet not dropped, got", pkt)
+	}
+	if len(order) != 2 {
+		t.Error("interceptors called after packet dropped, got", order)
+	}
+}
+
+func TestIntercept_NoAlloc(t *testing.T) {
+	noop := []PacketInterceptor{func(server string, pkt Packet) Packet { return pkt }}
+	pkt := &PublishPacket{TopicName: "foo"}
+
+	for _, interceptors := range [][]PacketInterceptor{nil, noop} {
+		if n := testing.AllocsPerRun(100, func() { _ = intercept(interceptors, "foo", pkt) }); n != 0 {
+			t.Error("allocs per intercept =", n)
+		}
+	}
+}
+
+func TestClient_ConnectServerInterceptors(t *testing.T) {
+	var (
+		mu        sync.Mutex
+		sent      []CtrlType
+		recv      []CtrlType
+		connected = make(chan error, 1)
+	)
+	record := func(types *[]CtrlType) PacketInterceptor {
+		return func(server string, pkt Packet) Packet {
+			mu.Lock()
+			*types = append(*types, pkt.Type())
+			mu.Unlock()
+			return pkt
+		}
+	}
+
+	client, err := NewClient(
+		WithDialTimeout(10),
+		WithCustomConnector(fakeConnector(fakeBrokerConfig{ackPub: true})),
+		WithConnHandleFunc(func(client Client, server string, code byte, err error) {
+			connected <- err
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Destroy(true)
+
+	if err := client.ConnectServer("fake", WithSendInterceptor(record(&sent)), WithRecvInterceptor(record(&recv))); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-connected:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("connect timeout")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(sent) == 0 || sent[0] != CtrlConn {
+		t.Error("send interceptor of ConnectServer not called, sent =", sent)
+	}
+	if len(recv) == 0 || recv[0] != CtrlConnAck {
+		t.Error("recv interceptor of ConnectServer not called, received =", recv)
+	}
+}
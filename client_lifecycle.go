@@ -0,0 +1,151 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrClientDestroyed is returned by PublishWith once the client destroyed
+// (until connected again), other operations are ignored
+var ErrClientDestroyed = errors.New("client destroyed ")
+
+// lifecycle of the client from created (or restarted) to destroyed,
+// workers and connections keep the lifecycle they started with, so they
+// exit once destroyed even if the client restarted
+type lifecycle struct {
+	ctx      context.Context    // canceled once destroyed
+	exit     context.CancelFunc // called when client exit
+	replaced chan struct{}      // closed once the client restarted
+
+	mu      sync.Mutex     // no worker added once destroyed and waited
+	workers sync.WaitGroup // workers started in the lifecycle except handleMsg
+}
+
+func newLifecycle() *lifecycle {
+	ctx, exit := context.WithCancel(context.Background())
+	return &lifecycle{ctx: ctx, exit: exit, replaced: make(chan struct{})}
+}
+
+// add counts the worker started, false if destroyed
+func (l *lifecycle) add() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closing() {
+		return false
+	}
+	l.workers.Add(1)
+	return true
+}
+
+// wait for workers of the lifecycle destroyed to exit
+func (l *lifecycle) wait() {
+	// workers added before destroyed are counted once the lock released
+	l.mu.Lock()
+	l.mu.Unlock()
+
+	l.workers.Wait()
+}
+
+// done returns the channel closed once destroyed
+func (l *lifecycle) done() <-chan struct{} {
+	return l.ctx.Done()
+}
+
+func (l *lifecycle) closing() bool {
+	return l.ctx.Err() != nil
+}
+
+// lifecycle returns the current lifecycle of the client
+func (c *AsyncClient) lifecycle() *lifecycle {
+	return c.life.Load().(*lifecycle)
+}
+
+// done returns the channel closed once the client destroyed
+func (c *AsyncClient) done() <-chan struct{} {
+	return c.lifecycle().done()
+}
+
+// exit stops all workers and connections of the client
+func (c *AsyncClient) exit() {
+	c.lifecycle().exit()
+}
+
+// startWorkers starts workers of the client handling messages, handleMsg
+// is not counted by the lifecycle since it drains messages until other
+// workers exited once destroyed
+func (c *AsyncClient) startWorkers() {
+	life := c.lifecycle()
+	c.workers.Add(1)
+	go func() {
+		defer c.workers.Done()
+		c.handleMsg(life)
+	}()
+
+	c.addWorker(c.handleTopicMsg)
+	if c.persistTTL > 0 {
+		c.addWorker(c.purgePersist)
+	}
+}
+
+// restart the client destroyed to connect again, handlers, options,
+// subscriptions and packets not acked are retained, operations issued
+// before connected are queued again (see WithPreConnectQueue)
+func (c *AsyncClient) restart() {
+	c.lifeMu.Lock()
+	defer c.lifeMu.Unlock()
+
+	if !c.isClosing() {
+		return
+	}
+
+	c.log.i("CLI restart destroyed client")
+	// messages are handled by workers of the new lifecycle
+	close(c.lifecycle().replaced)
+	c.life.Store(newLifecycle())
+
+	c.preConnMu.Lock()
+	c.preConnReady, c.preConnDone = false, false
+	c.preConnMu.Unlock()
+
+	c.startWorkers()
+}
+
+// storeConn stores the connection of the server
+func (c *AsyncClient) storeConn(server string, conn *clientConn) {
+	c.connsMu.Lock()
+	c.connectedServers.Store(server, conn)
+	c.connsMu.Unlock()
+}
+
+// deleteConn deletes the connection of the server if not replaced (e.g.
+// by the reconnect or the connect once the client restarted)
+func (c *AsyncClient) deleteConn(server string, conn *clientConn) {
+	if conn == nil {
+		return
+	}
+
+	c.connsMu.Lock()
+	defer c.connsMu.Unlock()
+
+	if val, ok := c.connectedServers.Load(server); ok && val.(*clientConn) == conn {
+		c.connectedServers.Delete(server)
+	}
+}
@@ -0,0 +1,239 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClient_ConnectAfterDestroy(t *testing.T) {
+	const cycles = 100
+
+	var (
+		dials     int32
+		connected = make(chan struct{}, 1)
+		published = make(chan error, 1)
+	)
+	broker := fakeConnector(fakeBrokerConfig{ackPub: true})
+	client, err := NewClient(
+		WithBackoffStrategy(time.Millisecond, time.Millisecond, 1),
+		WithCustomConnector(func(ctx context.Context, address string, timeout time.Duration, tlsConfig *tls.Config) (net.Conn, error) {
+			atomic.AddInt32(&dials, 1)
+			return broker(ctx, address, timeout, tlsConfig)
+		}),
+		WithConnHandleFunc(func(client Client, server string, code byte, err error) {
+			if code == CodeSuccess {
+				connected <- struct{}{}
+			}
+		}),
+		WithPubHandleFunc(func(client Client, topic string, err error) {
+			published <- err
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wait := func(i int, ch <-chan struct{}, what string) {
+		select {
+		case <-ch:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("cycle %d: %s timeout", i, what)
+		}
+	}
+
+	goroutines := runtime.NumGoroutine()
+	for i := 0; i < cycles; i++ {
+		if err := client.ConnectServer("fake"); err != nil {
+			t.Fatal(err)
+		}
+		wait(i, connected, "connect")
+
+		// handlers retained
+		if err := client.PublishWith("/foo", nil, PubQoS(Qos1)); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case err := <-published:
+			if err != nil {
+				t.Fatalf("cycle %d: publish failed, err = %v", i, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("cycle %d: publish timeout", i)
+		}
+
+		if _, ok := client.ConnInfo("fake"); !ok {
+			t.Fatalf("cycle %d: no conn info", i)
+		}
+
+		client.Destroy(i%2 == 0)
+		// workers of the lifecycle exited before restarted
+		client.workers.Wait()
+	}
+
+	if n := atomic.LoadInt32(&dials); n != cycles {
+		t.Error("unexpected dials =", n)
+	}
+
+	// workers of the client destroyed exited
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > goroutines+2 {
+		if time.Now().After(deadline) {
+			t.Fatal("goroutines leaked, before =", goroutines, "after =", runtime.NumGoroutine())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestClient_ConnectRightAfterDestroy(t *testing.T) {
+	const cycles = 100
+
+	var (
+		dials     int32
+		connected = make(chan struct{}, 1)
+	)
+	broker := fakeConnector(fakeBrokerConfig{ackPub: true})
+	client, err := NewClient(
+		WithBackoffStrategy(time.Millisecond, time.Millisecond, 1),
+		WithCustomConnector(func(ctx context.Context, address string, timeout time.Duration, tlsConfig *tls.Config) (net.Conn, error) {
+			atomic.AddInt32(&dials, 1)
+			return broker(ctx, address, timeout, tlsConfig)
+		}),
+		WithConnHandleFunc(func(client Client, server string, code byte, err error) {
+			if code == CodeSuccess {
+				connected <- struct{}{}
+			}
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Destroy(true)
+
+	for i := 0; i < cycles; i++ {
+		if err := client.ConnectServer("fake"); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case <-connected:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("cycle %d: connect timeout", i)
+		}
+
+		// connections of the client destroyed are not reconnected
+		client.Destroy(true)
+	}
+
+	if err := client.ConnectServer("fake"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connect timeout")
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&dials); n != cycles+1 {
+		t.Error("unexpected dials =", n)
+	}
+	if _, ok := client.ConnInfo("fake"); !ok {
+		t.Error("connection of the client restarted deleted")
+	}
+}
+
+func TestClient_DestroyWhilePublishing(t *testing.T) {
+	const publishers = 10
+
+	for round := 0; round < 10; round++ {
+		connected := make(chan struct{}, 1)
+		client, err := NewClient(
+			WithCustomConnector(fakeConnector(fakeBrokerConfig{ackPub: true})),
+			WithConnHandleFunc(func(client Client, server string, code byte, err error) {
+				if code == CodeSuccess {
+					connected <- struct{}{}
+				}
+			}),
+			// results notified to handlers until destroyed
+			WithPubHandleFunc(func(client Client, topic string, err error) {}),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := client.ConnectServer("fake"); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-connected:
+		case <-time.After(5 * time.Second):
+			t.Fatal("connect timeout")
+		}
+
+		var (
+			started  int32
+			returned = make(chan error, publishers)
+		)
+		for i := 0; i < publishers; i++ {
+			go func(i int) {
+				atomic.AddInt32(&started, 1)
+				for {
+					client.Subscribe(&Topic{Name: "/foo"})
+					if err := client.PublishWith("/foo", []byte("bar"), PubQoS(QosLevel(i%3))); err != nil {
+						returned <- err
+						return
+					}
+				}
+			}(i)
+		}
+		for atomic.LoadInt32(&started) < publishers {
+			time.Sleep(time.Millisecond)
+		}
+		time.Sleep(10 * time.Millisecond)
+
+		client.Destroy(round%2 == 0)
+		for i := 0; i < publishers; i++ {
+			select {
+			case err := <-returned:
+				if err != ErrClientDestroyed {
+					t.Fatal("unexpected publish error =", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("publish not returned once destroyed")
+			}
+		}
+
+		// workers not blocked notifying results once destroyed
+		exited := make(chan struct{})
+		go func() {
+			client.workers.Wait()
+			close(exited)
+		}()
+		select {
+		case <-exited:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("round %d: workers not exited", round)
+		}
+	}
+}
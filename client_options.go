@@ -17,17 +17,27 @@
 package libmqtt
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"strings"
 	"time"
 )
 
 var (
 	ErrNotSupportedVersion = errors.New("mqtt version not supported ")
+
+	// ErrAuthRequiresV5 happens when connecting with authentication method
+	// or data using MQTT 3.1.1
+	ErrAuthRequiresV5 = errors.New("authentication method and data require MQTT 5 ")
+
+	// ErrConnNotReusable happens when reconnecting the server connected with
+	// Client.ConnectWith without Connector for fresh connections
+	ErrConnNotReusable = errors.New("connection can not be reused to reconnect ")
 )
 
 // Option is client option for connection options
@@ -45,6 +55,7 @@ func WithSecureServer(servers ...string) Option {
 		}
 
 		c.secureServers = append(c.secureServers, servers...)
+		options.serversSet = true
 		return nil
 	}
 }
@@ -57,6 +68,226 @@ func WithSecureServer(servers ...string) Option {
 func WithServer(servers ...string) Option {
 	return func(c *AsyncClient, options *connectOptions) error {
 		c.servers = append(c.servers, servers...)
+		options.serversSet = true
+		return nil
+	}
+}
+
+// RecvOverflowPolicy defines the action when received publish packets
+// can not be buffered since the recv buffer is full
+type RecvOverflowPolicy int
+
+const (
+	// RecvOverflowBlock blocks until the recv buffer is available (default)
+	RecvOverflowBlock RecvOverflowPolicy = iota
+	// RecvOverflowDropOldest drops the oldest buffered packet
+	RecvOverflowDropOldest
+	// RecvOverflowSpillQos0 drops QoS0 packets, blocks for QoS1 and QoS2
+	RecvOverflowSpillQos0
+)
+
+// WithRecvBuf designate the size of recv buffer for received publish packets
+func WithRecvBuf(size int) Option {
+	return func(c *AsyncClient, options *connectOptions) error {
+		if size < 1 {
+			size = 1
+		}
+
+		c.recvCh = make(chan *PublishPacket, size)
+		return nil
+	}
+}
+
+// WithSendBuf designate the size of send buffer for packets to be sent
+func WithSendBuf(size int) Option {
+	return func(c *AsyncClient, options *connectOptions) error {
+		if size < 1 {
+			size = 1
+		}
+
+		c.sendCh = make(chan Packet, size)
+		return nil
+	}
+}
+
+// WithQoS0DropWhenFull drops QoS0 publishes instead of blocking the
+// publish when the send buffer is full (see WithSendBuf), dropped
+// publishes are counted in ClientStats.DroppedPublishes and notified to
+// the PubHandleFunc (or returned by PublishWith) with ErrSendBufFull,
+// QoS1 and QoS2 publishes are always blocked until buffered
+func WithQoS0DropWhenFull(drop bool) Option {
+	return func(c *AsyncClient, options *connectOptions) error {
+		c.dropQos0Pub = drop
+		return nil
+	}
+}
+
+// WithRecvOverflowPolicy designate the action when the recv buffer is full,
+// dropped packets are counted in ClientStats.DroppedMessages
+//
+// keepalive will not timeout when received packets are blocked by the full
+// recv buffer, no matter what policy is used
+func WithRecvOverflowPolicy(policy RecvOverflowPolicy) Option {
+	return func(c *AsyncClient, options *connectOptions) error {
+		c.recvOverflow = policy
+		return nil
+	}
+}
+
+// PayloadFormatPolicy defines the action when received MQTT 5 publish
+// packets failed the payload format validation (see
+// WithPayloadFormatValidation)
+type PayloadFormatPolicy int
+
+const (
+	// PayloadFormatReject drops the packet, QoS1/QoS2 packets are acked with
+	// CodePayloadFormatInvalid (default)
+	PayloadFormatReject PayloadFormatPolicy = iota
+	// PayloadFormatFlag delivers the packet with
+	// PublishPacket.InvalidPayloadFormat set
+	PayloadFormatFlag
+)
+
+// WithPayloadFormatValidation validates payloads of MQTT 5 publish packets
+// with payload format indicator set (UTF-8), publishing invalid payloads
+// fails with ErrInvalidPayloadFormat notified to the PubHandleFunc, and
+// invalid packets received are handled with the PayloadFormatPolicy (see
+// WithPayloadFormatPolicy)
+//
+// streamed payloads (PublishPacket.PayloadReader and HandleStream) are not
+// validated
+func WithPayloadFormatValidation(validate bool) Option {
+	return func(c *AsyncClient, options *connectOptions) error {
+		c.validatePayloadFormat = validate
+		return nil
+	}
+}
+
+// WithPayloadFormatPolicy designate the action when received packets failed
+// the payload format validation, only used with WithPayloadFormatValidation
+func WithPayloadFormatPolicy(policy PayloadFormatPolicy) Option {
+	return func(c *AsyncClient, options *connectOptions) error {
+		c.payloadFormatPolicy = policy
+		return nil
+	}
+}
+
+// WithHandlerConcurrency dispatches received publish packets to topic
+// handlers with a pool of n workers, packets of the same topic are always
+// handled by the same worker in the receiving order (n = 1 means all packets
+// are handled one by one)
+//
+// if not set (or n < 1), every packet is handled in a new goroutine
+// without ordering guarantee
+func WithHandlerConcurrency(n int) Option {
+	return func(c *AsyncClient, options *connectOptions) error {
+		c.handlerQueues = nil
+		for i := 0; i < n; i++ {
+			c.handlerQueues = append(c.handlerQueues, make(chan *PublishPacket, handlerQueueSize))
+		}
+		return nil
+	}
+}
+
+// FlushPolicy defines when to flush packets written to the connection buffer,
+// acks (PubAck, PubRec, PubRel and PubComp) are always flushed immediately
+type FlushPolicy struct {
+	// Delay of flush after the first packet written,
+	// zero value means flush every packet immediately
+	Delay time.Duration
+	// MaxPackets flush once the count of written packets reached (0 for no limit)
+	MaxPackets int
+	// MaxBytes flush once the size of written packets reached (0 for no limit)
+	MaxBytes int
+}
+
+func (p FlushPolicy) shouldFlush(pkt Packet, pending, buffered int) bool {
+	switch pkt.(type) {
+	case *PubAckPacket, *PubRecvPacket, *PubRelPacket, *PubCompPacket:
+		return true
+	}
+
+	return p.Delay <= 0 ||
+		(p.MaxPackets > 0 && pending >= p.MaxPackets) ||
+		(p.MaxBytes > 0 && buffered >= p.MaxBytes)
+}
+
+// WithFlushPolicy designate when to flush the packets written,
+// the default policy is flush 100us after the first packet written
+func WithFlushPolicy(policy FlushPolicy) Option {
+	return func(c *AsyncClient, options *connectOptions) error {
+		options.flushPolicy = policy
+		return nil
+	}
+}
+
+// WithConnBufSize designate the size of read and write buffer of
+// every connection (default 4096 bytes), larger buffers can reduce
+// syscalls for large payloads
+func WithConnBufSize(readBufSize, writeBufSize int) Option {
+	return func(c *AsyncClient, options *connectOptions) error {
+		if readBufSize < 1 {
+			readBufSize = defaultConnBufSize
+		}
+
+		if writeBufSize < 1 {
+			writeBufSize = defaultConnBufSize
+		}
+
+		options.readBufSize = readBufSize
+		options.writeBufSize = writeBufSize
+		return nil
+	}
+}
+
+// WithDirectWrite will write every encoded packet to the connection
+// immediately without the write buffer, flush policy will be ignored,
+// useful for latency critical cases
+func WithDirectWrite(direct bool) Option {
+	return func(c *AsyncClient, options *connectOptions) error {
+		options.directWrite = direct
+		return nil
+	}
+}
+
+// WithWriteTimeout designate the timeout of every connection write, the
+// connection is treated as broken if the server stopped reading (and then
+// reconnected if auto reconnect enabled), the keepalive timeout (keepalive
+// interval * factor) is used by default, timeout negative disables
+func WithWriteTimeout(timeout time.Duration) Option {
+	return func(c *AsyncClient, options *connectOptions) error {
+		options.writeTimeout = timeout
+		return nil
+	}
+}
+
+// WithReadTimeout designate the max time without any packet received from
+// the server, the connection is treated as broken once exceeded (and then
+// reconnected if auto reconnect enabled) to detect half-open connections,
+// the timeout should be longer than the keepalive interval, by default 1.5
+// times the keepalive interval, or the keepalive timeout after PingReq sent
+// if longer (see WithKeepalive), timeout negative disables
+func WithReadTimeout(timeout time.Duration) Option {
+	return func(c *AsyncClient, options *connectOptions) error {
+		options.readTimeout = timeout
+		return nil
+	}
+}
+
+// WithPooledDecode will reuse received QoS0 publish packets and their
+// payload buffers to reduce allocations
+//
+// packets are reused once all topic handlers returned, if the packet or
+// payload is used after the handler returned, publish handlers MUST call
+// PublishPacket.Retain or use PublishPacket.Copy, and topic handlers MUST
+// copy the payload
+func WithPooledDecode(pooled bool) Option {
+	return func(c *AsyncClient, options *connectOptions) error {
+		if pooled {
+			c.pubPool = newPublishPool()
+		} else {
+			c.pubPool = nil
+		}
 		return nil
 	}
 }
@@ -149,15 +380,58 @@ func WithPersist(method PersistMethod) Option {
 	return func(c *AsyncClient, options *connectOptions) error {
 		if method != nil {
 			c.persist = method
+			if r, ok := method.(PersistErrorReporter); ok {
+				r.SetErrorReporter(func(err error) { notifyPersistMsg(c.msgCh, nil, err) })
+			}
+			if clk, ok := method.(PersistClock); ok {
+				// the clock may be set by following options
+				clk.SetClock(func() time.Time { return c.clock.Now() })
+			}
 		}
 		return nil
 	}
 }
 
+// WithPersistTTL will purge persisted packets stored for more than ttl
+// periodically (disabled if ttl <= 0), for MQTT 5 publish packets, the
+// message expiry interval is applied if shorter
+//
+// the purge count is sent as PersistPurgedEvent (see Client.Events),
+// persist methods implementing TimestampedPersist are preferred, packets
+// of other persist methods expire after ttl since first seen by the client
+func WithPersistTTL(ttl time.Duration) Option {
+	return func(c *AsyncClient, options *connectOptions) error {
+		if ttl < 0 {
+			ttl = 0
+		}
+		c.persistTTL = ttl
+		return nil
+	}
+}
+
+// WithImportedSession restores the session exported by Client.ExportSession
+// once the client created, the persisted packets are stored to the persist
+// method of the client, and the clean flag in connect packet is unset so
+// the session is resumed by servers
+func WithImportedSession(data []byte) Option {
+	return func(c *AsyncClient, options *connectOptions) error {
+		s, err := decodeSession(data)
+		if err != nil {
+			return err
+		}
+
+		c.imported = s
+		options.connPacket.CleanSession = false
+		options.persistentSession = true
+		return nil
+	}
+}
+
 // WithCleanSession will set clean flag in connect packet
 func WithCleanSession(f bool) Option {
 	return func(c *AsyncClient, options *connectOptions) error {
 		options.connPacket.CleanSession = f
+		options.persistentSession = !f
 		return nil
 	}
 }
@@ -166,12 +440,163 @@ func WithCleanSession(f bool) Option {
 func WithIdentity(username, password string) Option {
 	return func(c *AsyncClient, options *connectOptions) error {
 		options.connPacket.Username = username
-		options.connPacket.Password = password
+		options.connPacket.Password = []byte(password)
+		return nil
+	}
+}
+
+// WithAuth set the authentication method and data of the connect packet
+// (MQTT 5), e.g. a token in the data for brokers authenticating with it
+//
+// connecting with MQTT 3.1.1 fails with ErrAuthRequiresV5
+func WithAuth(method string, data []byte) Option {
+	return func(c *AsyncClient, options *connectOptions) error {
+		props := options.connPacket.Props.clone()
+		if props == nil {
+			props = &ConnProps{}
+		}
+
+		props.AuthMethod, props.AuthData = method, data
+		options.connPacket.Props = props
+		return nil
+	}
+}
+
+// WithRequestResponseInfo set the Request Response Information flag of
+// the connect packet (MQTT 5), servers may return the Response Information
+// (the topic prefix of responses) in ConnAck if requested, available in
+// ConnInfo.ResponseInfo and used by Client.ResponseTopic
+func WithRequestResponseInfo(request bool) Option {
+	return func(c *AsyncClient, options *connectOptions) error {
+		props := options.connPacket.Props.clone()
+		if props == nil {
+			props = &ConnProps{}
+		}
+
+		props.ReqRespInfo = &request
+		options.connPacket.Props = props
 		return nil
 	}
 }
 
-// WithKeepalive set the keepalive interval (time in second)
+// WithConnUserProps set the user properties of the connect packet (MQTT 5),
+// e.g. the tenant used by the server for routing, props replace those set
+// before, and are also in the packet passed to WithCustomConnPacket
+//
+// NewClient fails with ErrPropsRequireV5 if MQTT 3.1.1 configured
+func WithConnUserProps(props UserProps) Option {
+	return func(c *AsyncClient, options *connectOptions) error {
+		p := options.connPacket.Props.clone()
+		if p == nil {
+			p = &ConnProps{}
+		}
+
+		p.UserProps = props.clone()
+		options.connPacket.Props = p
+		return nil
+	}
+}
+
+// WithServerConnUserProps set user properties of the connect packet to the
+// server (MQTT 5), which replace those of the same key set by
+// WithConnUserProps, e.g. the firmware version reported differs by server
+//
+// NewClient fails with ErrPropsRequireV5 if MQTT 3.1.1 configured
+func WithServerConnUserProps(server string, props UserProps) Option {
+	return func(c *AsyncClient, options *connectOptions) error {
+		m := make(map[string]UserProps, len(options.serverUserProps)+1)
+		for k, v := range options.serverUserProps {
+			m[k] = v
+		}
+
+		m[server] = props.clone()
+		options.serverUserProps = m
+		return nil
+	}
+}
+
+// WithRequestProblemInfo set the Request Problem Information flag of the
+// connect packet (MQTT 5), if false, servers send the Reason String and
+// user properties only in Publish, ConnAck and Disconnect packets (not in
+// acks, e.g. PubAckError.Reason is empty)
+func WithRequestProblemInfo(request bool) Option {
+	return func(c *AsyncClient, options *connectOptions) error {
+		props := options.connPacket.Props.clone()
+		if props == nil {
+			props = &ConnProps{}
+		}
+
+		props.ReqProblemInfo = &request
+		options.connPacket.Props = props
+		return nil
+	}
+}
+
+// WithRecvMaximum set the max number of QoS2 publish packets received from
+// the server not completed (PubComp not sent), with MQTT 5 it is sent as
+// the Receive Maximum of the connect packet, and the connection is closed
+// with CodeReceiveMaxExceeded once the server exceeds it, with MQTT 3.1.1
+// it only bounds the packets stored, publish packets exceeding it are
+// dropped without PubRec (resent by the server once reconnected), n 0 for
+// no limit
+func WithRecvMaximum(n uint16) Option {
+	return func(c *AsyncClient, options *connectOptions) error {
+		options.recvMax = n
+		return nil
+	}
+}
+
+// WithInboundTopicAliasMax set the Topic Alias Maximum of the connect
+// packet (MQTT 5), the server may send publish packets with topic aliases
+// up to n, which are mapped to topic names per connection (dropped once
+// reconnected), the connection is closed with CodeTopicAliasInvalid if
+// the server sends an alias 0 or larger than n, ignored with MQTT 3.1.1
+func WithInboundTopicAliasMax(n uint16) Option {
+	return func(c *AsyncClient, options *connectOptions) error {
+		options.inboundAliasMax = n
+		return nil
+	}
+}
+
+// WithMaxPacketSize set the Maximum Packet Size of the connect packet
+// (MQTT 5), the server MUST NOT send packets larger than size, packets
+// received larger (also with MQTT 3.1.1, but not known by the server) are
+// rejected before the body read, the connection is closed with
+// MalformedPacketError of CodePacketTooLarge, size 0 for no limit
+func WithMaxPacketSize(size uint32) Option {
+	return func(c *AsyncClient, options *connectOptions) error {
+		props := options.connPacket.Props.clone()
+		if props == nil {
+			props = &ConnProps{}
+		}
+
+		props.MaxPacketSize = size
+		options.connPacket.Props = props
+		return nil
+	}
+}
+
+// CredentialsProvider returns the username and password used in the connect
+// packet to the server, e.g. a fresh token before the previous one expired
+type CredentialsProvider func(ctx context.Context, server string) (username string, password []byte, err error)
+
+// WithCredentialsProvider set the credentials provider invoked before every
+// connect attempt (including reconnect), the username and password provided
+// override those set by WithIdentity, if an error returned, the attempt is
+// aborted and the error is passed to the ConnHandleFunc, then retried with
+// backoff if auto reconnect enabled
+func WithCredentialsProvider(provider CredentialsProvider) Option {
+	return func(c *AsyncClient, options *connectOptions) error {
+		options.credentials = provider
+		return nil
+	}
+}
+
+// WithKeepalive set the keepalive interval (time in second), the connection
+// is closed if no keepalive response in keepalive * factor (1.5 by default,
+// not changed if factor is 0 or 1), factor less than 1 fails NewClient with
+// ErrBadKeepaliveFactor, keepalive shorter than the dial timeout (20s by
+// default) with ErrKeepaliveBelowDialTimeout
 func WithKeepalive(keepalive uint16, factor float64) Option {
 	return func(c *AsyncClient, options *connectOptions) error {
 		if keepalive <= 0 {
@@ -180,10 +605,8 @@ func WithKeepalive(keepalive uint16, factor float64) Option {
 
 		options.connPacket.Keepalive = keepalive
 		options.keepalive = time.Duration(keepalive) * time.Second
-		if factor > 1 {
+		if factor > 0 && factor != 1 {
 			options.keepaliveFactor = factor
-		} else {
-			factor = 1.2
 		}
 		return nil
 	}
@@ -197,6 +620,38 @@ func WithAutoReconnect(autoReconnect bool) Option {
 	}
 }
 
+// WithAutoResubscribe set client to subscribe again once connected if the
+// server has no session of the client (SessionPresent of ConnAck unset),
+// subscriptions acked by the server are sent again with their options and
+// subscription identifiers, the SubHandleFunc is called with the results,
+// no subscription sent if the session resumed since the server keeps the
+// subscriptions
+func WithAutoResubscribe(resubscribe bool) Option {
+	return func(c *AsyncClient, options *connectOptions) error {
+		options.resubscribe = resubscribe
+		return nil
+	}
+}
+
+// WithNonRetryableConnCodes set ConnAck codes the auto reconnect stops
+// on, the connect refused with these codes will not be retried until
+// Client.Reconnect called, and a *ReconnectStoppedError is notified
+// to the NetHandleFunc
+//
+// by default, codes of errors caused by the client (e.g. ErrConnBadAuth,
+// ErrConnBanned) are not retried, while codes of transient server errors
+// (e.g. ErrConnServerUnavailable, ErrConnServerBusy) are retried,
+// no code provided means all codes are retried
+func WithNonRetryableConnCodes(codes ...byte) Option {
+	return func(c *AsyncClient, options *connectOptions) error {
+		options.nonRetryableCodes = make(map[byte]bool)
+		for _, code := range codes {
+			options.nonRetryableCodes[code] = true
+		}
+		return nil
+	}
+}
+
 // WithBackoffStrategy will set reconnect backoff strategy
 // firstDelay is the time to wait before retrying after the first failure
 // maxDelay defines the upper bound of backoff delay
@@ -225,6 +680,37 @@ func WithBackoffStrategy(firstDelay, maxDelay time.Duration, factor float64) Opt
 	}
 }
 
+// WithRetryInterval will resend QoS1/QoS2 publish packets (with DUP set)
+// and PubRel packets not acked by server within the interval d in the
+// same connection, PubHandler is notified with ErrRetryExceeded once the
+// packet has been resent for maxRetries times (no limit if maxRetries <= 0)
+func WithRetryInterval(d time.Duration, maxRetries int) Option {
+	return func(c *AsyncClient, options *connectOptions) error {
+		if d < 0 {
+			return fmt.Errorf("retry interval provided must not be negative")
+		}
+
+		if maxRetries < 0 {
+			maxRetries = 0
+		}
+
+		options.retryInterval = d
+		options.maxRetries = maxRetries
+		return nil
+	}
+}
+
+// WithQosDowngrade set whether to downgrade the QoS of publish packets to
+// the maximum QoS supported by the server (MQTT 5), if disabled, publish
+// packets with QoS exceeding are not sent, and ErrQosNotSupported is
+// notified to PubHandleFunc, enabled by default
+func WithQosDowngrade(downgrade bool) Option {
+	return func(c *AsyncClient, options *connectOptions) error {
+		options.qosDowngrade = downgrade
+		return nil
+	}
+}
+
 // WithClientID set the client id for connection
 func WithClientID(clientID string) Option {
 	return func(c *AsyncClient, options *connectOptions) error {
@@ -245,6 +731,41 @@ func WithWill(topic string, qos QosLevel, retain bool, payload []byte) Option {
 	}
 }
 
+// ConnPacketFunc returns the connect packet sent to the server, base is the
+// packet built with options (a copy for every connect attempt), it can be
+// modified and returned, or replaced by another packet (nil to keep base)
+type ConnPacketFunc func(server string, base *ConnPacket) *ConnPacket
+
+// WithCustomConnPacket set the function to customize the connect packet
+// for fields not covered by options (e.g. MQTT 5 user properties and
+// request response information), called before every connect attempt
+// (including reconnect), so time-varying fields can be updated
+//
+// the packet returned is validated (client id, will topic and QoS,
+// authentication requires MQTT 5), the connect attempt fails with the
+// error passed to the ConnHandleFunc if invalid, the protocol version of
+// the packet is always the version in use
+func WithCustomConnPacket(f ConnPacketFunc) Option {
+	return func(c *AsyncClient, options *connectOptions) error {
+		options.customConnPacket = f
+		return nil
+	}
+}
+
+// WithWillProps set the properties of the will message (MQTT 5), e.g.
+// WillDelayInterval to delay publishing the will message, so the will
+// message is not published if reconnected within the interval (failover)
+//
+// the will message is set by WithWill, NewClient fails with
+// ErrPropsRequireV5 if the client version is MQTT 3.1.1, props are ignored
+// for servers connected with MQTT 3.1.1 (e.g. ConnectServer with WithVersion)
+func WithWillProps(props *WillProps) Option {
+	return func(c *AsyncClient, options *connectOptions) error {
+		options.connPacket.WillProps = props
+		return nil
+	}
+}
+
 // WithTLSReader set tls from client cert, key, ca reader, apply to all servers
 // listed in `WithServer` Option
 func WithTLSReader(certReader, keyReader, caReader io.Reader, serverNameOverride string, skipVerify bool) Option {
@@ -333,11 +854,13 @@ func WithDialTimeout(timeout uint16) Option {
 	}
 }
 
-// WithVersion defines the mqtt protocol ProtoVersion in use
+// WithVersion defines the mqtt protocol ProtoVersion in use, if compromise
+// is true, lower versions are used once the version refused by the server
+// (MQTT 5 to MQTT 3.1.1, MQTT 3.1.1 to MQTT 3.1)
 func WithVersion(version ProtoVersion, compromise bool) Option {
 	return func(c *AsyncClient, options *connectOptions) error {
 		switch version {
-		case V311, V5:
+		case V31, V311, V5:
 			options.protoVersion = version
 			options.protoCompromise = compromise
 			return nil
@@ -347,19 +870,103 @@ func WithVersion(version ProtoVersion, compromise bool) Option {
 	}
 }
 
+// WithVersionFallback retries the connection with the next lower version
+// (MQTT 5 to MQTT 3.1.1 to MQTT 3.1) once the version refused by the
+// server, the same as the compromise of WithVersion, the version accepted is
+// used on later reconnects to the server and can be inspected with
+// Client.ConnInfo
+func WithVersionFallback(fallback bool) Option {
+	return func(c *AsyncClient, options *connectOptions) error {
+		options.protoCompromise = fallback
+		return nil
+	}
+}
+
 // WithRouter set the router for topic dispatch
 func WithRouter(r TopicRouter) Option {
 	return func(c *AsyncClient, options *connectOptions) error {
 		if r != nil {
+			c.routerMu.Lock()
 			c.router = r
+			c.customRouter = true
+			c.routerMu.Unlock()
 		}
 		return nil
 	}
 }
 
-func WithConnPacket(pkt ConnPacket) Option {
+// WithUnsubRemovesHandler will remove the topic handlers registered
+// (using Client.HandleTopic) of the topics when unsubscribing them
+func WithUnsubRemovesHandler(remove bool) Option {
 	return func(c *AsyncClient, options *connectOptions) error {
-		options.connPacket = &pkt
+		c.unsubRemovesHandler = remove
+		return nil
+	}
+}
+
+// WithManualAck will delay the PubAck/PubComp of received QoS1/QoS2 publish
+// packets until Client.Ack called with the packet, (packets delivered to
+// topic handlers registered with HandleTopic are acked after the handler
+// returned), acks are always sent in the receiving order, use
+// Client.AckWithReason to ack with a MQTT 5 reason code
+//
+// unacked packets will be redelivered by the server after reconnect,
+// if the session was not cleaned
+func WithManualAck(manual bool) Option {
+	return func(c *AsyncClient, options *connectOptions) error {
+		c.manualAck = manual
+		return nil
+	}
+}
+
+// WithoutTopicValidation disables the validation of topic names to publish
+// and topic filters to subscribe and unsubscribe (see ValidateTopicName and
+// ValidateTopicFilter), for trusted topics
+func WithoutTopicValidation() Option {
+	return func(c *AsyncClient, options *connectOptions) error {
+		c.skipTopicValidation = true
+		return nil
+	}
+}
+
+// WithTopicPrefix sets the prefix (e.g. tenants/{id}/) prepended to topic
+// names and filters of all packets sent (including the will topic and
+// MQTT 5 response topics), and removed from topics of publish packets
+// received before routing, so handlers, subscriptions and notifications
+// only see topics without the prefix, use AbsoluteTopic for topics out of
+// the prefix (e.g. $SYS/#)
+//
+// the prefix MUST be a topic name ending with '/', ErrTopicBadPrefix is
+// returned otherwise, the prefix of shared subscriptions is added after
+// the share name ($share/{name}/{prefix}{filter})
+func WithTopicPrefix(prefix string) Option {
+	return func(c *AsyncClient, options *connectOptions) error {
+		if ValidateTopicName(prefix) != nil || !strings.HasSuffix(prefix, "/") {
+			return ErrTopicBadPrefix
+		}
+
+		c.topicPrefix = prefix
+		return nil
+	}
+}
+
+// WithHandlerPanicHandler will set the handler for panics recovered from
+// topic handlers, if not set, the panic will be logged with error level
+func WithHandlerPanicHandler(h HandlerPanicHandleFunc) Option {
+	return func(c *AsyncClient, options *connectOptions) error {
+		c.panicHandler = h
+		return nil
+	}
+}
+
+// WithConnPacket replaces the connect packet template with a copy of pkt
+func WithConnPacket(pkt *ConnPacket) Option {
+	return func(c *AsyncClient, options *connectOptions) error {
+		if pkt == nil {
+			return nil
+		}
+
+		options.connPacket = pkt.clone()
 
 		if pkt.Keepalive > 0 {
 			options.keepalive = time.Duration(pkt.Keepalive) * time.Second
@@ -0,0 +1,251 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"net/url"
+	"sort"
+	"time"
+)
+
+// PendingDirection is the direction of the pending message
+type PendingDirection byte
+
+const (
+	// PendingSend message published to server, waiting for PubAck (QoS1)
+	// or PubRec and PubComp (QoS2)
+	PendingSend PendingDirection = iota
+	// PendingRecv QoS2 message received from server, waiting for PubRel
+	PendingRecv
+)
+
+func (d PendingDirection) String() string {
+	if d == PendingRecv {
+		return "recv"
+	}
+	return "send"
+}
+
+// PendingMessage is the snapshot of a message not acknowledged
+type PendingMessage struct {
+	PacketID  uint16
+	Direction PendingDirection
+
+	// Server of the connection, empty if the message is not persisted
+	// and not sent to any server
+	Server string
+	Topic  string
+	Qos    QosLevel
+
+	// Age is the time since the message was persisted, or since last sent
+	// if the store time is not recorded by the persist method, 0 if unknown
+	Age time.Duration
+
+	// Retries is the count of retransmissions (see WithRetryInterval)
+	Retries int
+}
+
+// inflightState is the snapshot of inflightPacket
+type inflightState struct {
+	server  string
+	sentAt  time.Time
+	retries int
+}
+
+// Pending returns all messages the client believes still unacknowledged,
+// assembled from the persisted packets and the in memory state, available
+// both while connected and disconnected, sorted by direction, server and
+// packet id
+func (c *AsyncClient) Pending() []PendingMessage {
+	var (
+		now        = c.clock.Now()
+		extras     = c.idGen.extras()
+		inflight   = c.inflightStates()
+		ts, hasTS  = c.persist.(TimestampedPersist)
+		sendIDs    = make(map[uint16]struct{})
+		recvKeys   = make(map[string]struct{})
+		pending    []PendingMessage
+		setPublish = func(m *PendingMessage, p Packet) {
+			switch pkt := p.(type) {
+			case *PublishPacket:
+				m.Topic, m.Qos = pkt.TopicName, pkt.Qos
+			case *PubRelPacket:
+				// PubRec received, waiting for PubComp
+				m.Qos = Qos2
+				if pub, ok := extras[pkt.PacketID].(*PublishPacket); ok {
+					m.Topic = pub.TopicName
+				}
+			}
+		}
+	)
+
+	c.rangeOwnPersisted(func(key, server string, send bool, id uint16, p Packet) {
+		m := PendingMessage{PacketID: id, Direction: PendingRecv, Server: server}
+		if send {
+			m.Direction = PendingSend
+			sendIDs[id] = struct{}{}
+			if s, ok := inflight[id]; ok && s.server == server {
+				m.Retries = s.retries
+				m.Age = now.Sub(s.sentAt)
+			}
+		} else {
+			recvKeys[key] = struct{}{}
+		}
+
+		if hasTS {
+			if at, ok := ts.StoredAt(key); ok {
+				m.Age = now.Sub(at)
+			}
+		}
+
+		setPublish(&m, p)
+		pending = append(pending, m)
+	})
+
+	// not persisted (e.g. NonePersist)
+	for id, extra := range extras {
+		pub, ok := extra.(*PublishPacket)
+		if _, persisted := sendIDs[id]; !ok || persisted || pub.Qos == Qos0 {
+			continue
+		}
+
+		m := PendingMessage{PacketID: id, Direction: PendingSend, Topic: pub.TopicName, Qos: pub.Qos}
+		if s, ok := inflight[id]; ok {
+			m.Server, m.Retries, m.Age = s.server, s.retries, now.Sub(s.sentAt)
+		}
+		pending = append(pending, m)
+	}
+
+	c.qos2Mu.Lock()
+	for key, pub := range c.qos2Recv {
+		if _, persisted := recvKeys[key]; persisted {
+			continue
+		}
+
+		if _, server, _, id, ok := parseKey(key); ok {
+			pending = append(pending, PendingMessage{
+				PacketID: id, Direction: PendingRecv, Server: server, Topic: pub.TopicName, Qos: pub.Qos,
+			})
+		}
+	}
+	c.qos2Mu.Unlock()
+
+	sort.Slice(pending, func(i, j int) bool {
+		a, b := pending[i], pending[j]
+		if a.Direction != b.Direction {
+			return a.Direction < b.Direction
+		}
+		if a.Server != b.Server {
+			return a.Server < b.Server
+		}
+		return a.PacketID < b.PacketID
+	})
+	return pending
+}
+
+// DropPending discards the pending messages with the packet id in both
+// directions, the persisted packets are deleted, the retransmission is
+// stopped and the packet id is released, return false if no pending
+// message found, intended to discard a poisoned entry, the server may
+// still redeliver or ack the dropped message
+func (c *AsyncClient) DropPending(id uint16) bool {
+	var keys []string
+	c.rangeOwnPersisted(func(key, server string, send bool, packetID uint16, p Packet) {
+		if packetID == id {
+			keys = append(keys, key)
+		}
+	})
+
+	dropped := len(keys) > 0
+	if dropped {
+		notifyPersistMsg(c.msgCh, nil, AsBatchPersist(c.persist).DeleteBatch(keys))
+	}
+
+	c.qos2Mu.Lock()
+	for key := range c.qos2Recv {
+		if _, _, _, packetID, ok := parseKey(key); ok && packetID == id {
+			delete(c.qos2Recv, key)
+			delete(c.qos2Rel, key)
+			dropped = true
+		}
+	}
+	c.qos2Mu.Unlock()
+
+	c.connectedServers.Range(func(key, value interface{}) bool {
+		value.(*clientConn).untrackInflight(id)
+		return true
+	})
+
+	c.sendKeyMu.Lock()
+	delete(c.sendKeys, id)
+	c.sendKeyMu.Unlock()
+
+	if extra, ok := c.idGen.getExtra(id); ok {
+		if _, isPub := extra.(*PublishPacket); isPub && c.idGen.markDone(id) {
+			c.idGen.reclaim(id)
+			dropped = true
+		}
+	}
+
+	if dropped {
+		c.log.i("CLI dropped pending message, id =", id)
+	}
+	return dropped
+}
+
+// rangeOwnPersisted ranges over the packets persisted in namespaces of
+// the client
+func (c *AsyncClient) rangeOwnPersisted(f func(key, server string, send bool, id uint16, p Packet)) {
+	// client id may be overridden by server options
+	prefixes := map[string]struct{}{url.PathEscape(c.options.connPacket.ClientID) + "/": {}}
+	c.connectedServers.Range(func(key, value interface{}) bool {
+		prefixes[value.(*clientConn).persistNS] = struct{}{}
+		return true
+	})
+
+	persist := AsBatchPersist(c.persist)
+	seen := make(map[string]struct{})
+	for prefix := range prefixes {
+		persist.RangePrefix(prefix, func(key string, p Packet) bool {
+			if _, ok := seen[key]; ok {
+				return true
+			}
+			seen[key] = struct{}{}
+
+			if _, server, send, id, ok := parseKey(key); ok {
+				f(key, server, send, id, p)
+			}
+			return true
+		})
+	}
+}
+
+// inflightStates returns the retransmission state of sent packets of
+// all connections
+func (c *AsyncClient) inflightStates() map[uint16]inflightState {
+	states := make(map[uint16]inflightState)
+	c.connectedServers.Range(func(key, value interface{}) bool {
+		conn := value.(*clientConn)
+		conn.inflightMu.Lock()
+		for id, p := range conn.inflight {
+			states[id] = inflightState{server: conn.name, sentAt: p.sentAt, retries: p.retries}
+		}
+		conn.inflightMu.Unlock()
+		return true
+	})
+	return states
+}
@@ -0,0 +1,124 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClient_Pending(t *testing.T) {
+	persist := NewMemPersist(nil)
+	connected := make(chan struct{})
+	client, err := NewClient(
+		WithPersist(persist),
+		WithClientID("cid"),
+		WithDialTimeout(10),
+		WithKeepalive(10, 1.2),
+		WithRetryInterval(10*time.Millisecond, 0),
+		WithCustomConnector(fakeConnector(fakeBrokerConfig{ackPub: false})),
+		WithConnHandleFunc(func(client Client, server string, code byte, err error) {
+			if err == nil && code == CodeSuccess {
+				close(connected)
+			}
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Destroy(true)
+
+	if err := client.ConnectServer("fake"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connect timeout")
+	}
+
+	ns := persistNamespace("cid", "fake")
+	client.storeQos2(ns, &PublishPacket{TopicName: "/recv", Qos: Qos2, PacketID: 7})
+	client.Publish(
+		&PublishPacket{TopicName: "/foo", Qos: Qos1, Payload: []byte("foo")},
+		&PublishPacket{TopicName: "/bar", Qos: Qos2, Payload: []byte("bar")},
+	)
+
+	var pending []PendingMessage
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(5 * time.Millisecond) {
+		pending = client.Pending()
+		if len(pending) == 3 && pending[0].Retries > 0 && pending[1].Retries > 0 {
+			break
+		}
+	}
+
+	expected := []PendingMessage{
+		{PacketID: 1, Direction: PendingSend, Server: "fake", Topic: "/foo", Qos: Qos1},
+		{PacketID: 2, Direction: PendingSend, Server: "fake", Topic: "/bar", Qos: Qos2},
+		{PacketID: 7, Direction: PendingRecv, Server: "fake", Topic: "/recv", Qos: Qos2},
+	}
+	if len(pending) != len(expected) {
+		t.Fatal("unexpected pending messages =", pending)
+	}
+	for i, m := range pending {
+		if m.Retries == 0 && m.Direction == PendingSend {
+			t.Error("retries not counted, id =", m.PacketID)
+		}
+		if m.Age <= 0 || m.Age > 5*time.Second {
+			t.Error("unexpected age =", m.Age, "id =", m.PacketID)
+		}
+
+		m.Retries, m.Age = 0, 0
+		if m != expected[i] {
+			t.Error("unexpected pending message =", m, "expected =", expected[i])
+		}
+	}
+
+	if !client.DropPending(1) || !client.DropPending(7) {
+		t.Error("pending message not dropped")
+	}
+	if client.DropPending(100) {
+		t.Error("dropped message not pending")
+	}
+	if _, ok := loadSentPacket(persist, ns, 1); ok {
+		t.Error("persisted packet of dropped message not deleted")
+	}
+	if client.idGen.used(1) {
+		t.Error("packet id of dropped message not released")
+	}
+
+	// pending messages of disconnected client
+	other, err := NewClient(WithPersist(persist), WithClientID("cid"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Destroy(true)
+
+	pending = other.Pending()
+	if len(pending) != 1 || pending[0].PacketID != 2 || pending[0].Server != "fake" || pending[0].Topic != "/bar" {
+		t.Error("unexpected pending messages of disconnected client =", pending)
+	}
+
+	// not persisted
+	mem := defaultClient()
+	mem.idGen.next(&PublishPacket{TopicName: "/foo", Qos: Qos1})
+	mem.idGen.next(&SubscribePacket{})
+	if pending := mem.Pending(); len(pending) != 1 || pending[0].Topic != "/foo" || pending[0].Server != "" {
+		t.Error("unexpected pending messages in memory =", pending)
+	}
+}
@@ -0,0 +1,132 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// ErrNotConnected is returned by Ping when the server is not connected
+// (ConnAck not received) or the connection lost before the PingResp
+// received, and by PublishWith (or notified to handlers) when no server
+// is connected with WithFailFastWhenDisconnected
+var ErrNotConnected = errors.New("server not connected ")
+
+// Ping sends the PingReq to the server out of the keepalive schedule and
+// waits for the PingResp, returns the round-trip time, or the error of
+// ctx if done before responded, safe to call concurrently
+func (c *AsyncClient) Ping(ctx context.Context, server string) (time.Duration, error) {
+	val, ok := c.connectedServers.Load(server)
+	if !ok {
+		return 0, ErrNotConnected
+	}
+
+	conn := val.(*clientConn)
+	if conn.getConnInfo() == nil {
+		return 0, ErrNotConnected
+	}
+
+	return conn.ping(ctx)
+}
+
+func (c *clientConn) ping(ctx context.Context) (time.Duration, error) {
+	req := c.pingSent(make(chan time.Duration, 1))
+
+	select {
+	case c.logicSendC <- PingReqPacket:
+	case <-c.stopSig:
+		return 0, ErrNotConnected
+	case <-ctx.Done():
+		c.cancelPing(req, false)
+		return 0, ctx.Err()
+	}
+
+	select {
+	case rtt := <-req.resp:
+		return rtt, nil
+	case <-c.stopSig:
+		return 0, ErrNotConnected
+	case <-ctx.Done():
+		c.cancelPing(req, true)
+		return 0, ctx.Err()
+	}
+}
+
+// pingReq is the PingReq sent and waiting for the PingResp
+type pingReq struct {
+	sentAt time.Time
+	byPing bool               // sent by Ping, false for keepalive
+	resp   chan time.Duration // receives the round-trip time, nil once Ping canceled
+}
+
+// pingSent records the PingReq to be sent, resp is nil if the response is
+// not waited (keepalive)
+func (c *clientConn) pingSent(resp chan time.Duration) *pingReq {
+	req := &pingReq{sentAt: c.parent.clock.Now(), byPing: resp != nil, resp: resp}
+
+	c.pingMu.Lock()
+	c.pings = append(c.pings, req)
+	c.pingMu.Unlock()
+	return req
+}
+
+// cancelPing stops waiting for the PingResp, the PingReq not sent is
+// removed, the one sent is kept to match the PingResp in order
+func (c *clientConn) cancelPing(req *pingReq, sent bool) {
+	c.pingMu.Lock()
+	defer c.pingMu.Unlock()
+
+	if sent {
+		req.resp = nil
+		return
+	}
+
+	for i, r := range c.pings {
+		if r == req {
+			c.pings = append(c.pings[:i], c.pings[i+1:]...)
+			return
+		}
+	}
+}
+
+// pingResp records the round-trip time of the oldest PingReq not responded
+// (servers respond in order) and notifies the Ping waiting for it, returns
+// false if the PingReq is sent by Ping, so keepalive is not notified
+func (c *clientConn) pingResp() bool {
+	c.pingMu.Lock()
+	defer c.pingMu.Unlock()
+
+	if len(c.pings) == 0 {
+		return true
+	}
+
+	req := c.pings[0]
+	c.pings = c.pings[1:]
+
+	rtt := c.parent.clock.Now().Sub(req.sentAt)
+	atomic.StoreInt64(&c.parent.stats.pingRTT, int64(rtt))
+	if req.byPing {
+		if req.resp != nil {
+			req.resp <- rtt
+		}
+		return false
+	}
+	return true
+}
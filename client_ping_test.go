@@ -0,0 +1,168 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/goiiot/libmqtt/internal/testutil"
+)
+
+// pingBroker responds PingReq after the delay
+func pingBroker(conn net.Conn, delay *int64) {
+	defer func() { _ = conn.Close() }()
+
+	var mu sync.Mutex
+	write := func(pkt Packet) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		w := bufio.NewWriter(conn)
+		_ = pkt.WriteTo(w)
+		_ = w.Flush()
+	}
+
+	r := bufio.NewReader(conn)
+	for {
+		pkt, err := Decode(V311, r)
+		if err != nil {
+			return
+		}
+
+		switch pkt.(type) {
+		case *ConnPacket:
+			write(&ConnAckPacket{})
+		case *pingReqPacket:
+			time.Sleep(time.Duration(atomic.LoadInt64(delay)))
+			write(PingRespPacket)
+		}
+	}
+}
+
+func TestClient_Ping(t *testing.T) {
+	var (
+		delay     = int64(20 * time.Millisecond)
+		connected = make(chan struct{}, 1)
+	)
+	client, err := NewClient(
+		WithCustomConnector(func(ctx context.Context, address string, timeout time.Duration, tlsConfig *tls.Config) (net.Conn, error) {
+			client, server := net.Pipe()
+			go pingBroker(server, &delay)
+			return client, nil
+		}),
+		WithConnHandleFunc(func(client Client, server string, code byte, err error) {
+			if code == CodeSuccess {
+				connected <- struct{}{}
+			}
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Destroy(true)
+
+	if _, err := client.Ping(context.Background(), "fake"); err != ErrNotConnected {
+		t.Error("unexpected error before connected =", err)
+	}
+
+	if err := client.ConnectServer("fake"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not connected")
+	}
+
+	rtt, err := client.Ping(context.Background(), "fake")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rtt < 20*time.Millisecond || rtt > 5*time.Second {
+		t.Error("unexpected rtt =", rtt)
+	}
+	if stats := client.Stats(); stats.PingRTT < 20*time.Millisecond {
+		t.Error("unexpected ping rtt of stats =", stats.PingRTT)
+	}
+
+	// canceled before responded
+	atomic.StoreInt64(&delay, int64(200*time.Millisecond))
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := client.Ping(ctx, "fake"); err != context.DeadlineExceeded {
+		t.Error("unexpected error of canceled ping =", err)
+	}
+
+	// the response of the canceled ping is not taken
+	atomic.StoreInt64(&delay, 0)
+	rtt, err = client.Ping(context.Background(), "fake")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rtt < 100*time.Millisecond {
+		t.Error("response of canceled ping taken, rtt =", rtt)
+	}
+
+	if _, err := client.Ping(context.Background(), "other"); err != ErrNotConnected {
+		t.Error("unexpected error of unknown server =", err)
+	}
+}
+
+func TestClientConn_PingResp(t *testing.T) {
+	clk := testutil.NewFakeClock(time.Now())
+	conn := &clientConn{parent: defaultClient()}
+	conn.parent.clock = clk
+
+	// keepalive
+	conn.pingSent(nil)
+	clk.Advance(10 * time.Millisecond)
+	if !conn.pingResp() {
+		t.Error("keepalive not notified")
+	}
+	if rtt := conn.parent.Stats().PingRTT; rtt != 10*time.Millisecond {
+		t.Error("keepalive rtt not recorded, rtt =", rtt)
+	}
+
+	// responses matched in order
+	resp := make(chan time.Duration, 1)
+	conn.pingSent(resp)
+	conn.pingSent(nil)
+	if conn.pingResp() {
+		t.Error("keepalive notified by the response of Ping")
+	}
+	select {
+	case <-resp:
+	default:
+		t.Error("ping not notified")
+	}
+	if !conn.pingResp() {
+		t.Error("keepalive not notified")
+	}
+
+	// unsolicited response
+	if !conn.pingResp() {
+		t.Error("keepalive not notified by unsolicited response")
+	}
+}
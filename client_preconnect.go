@@ -0,0 +1,136 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import "errors"
+
+const defaultPreConnectQueueSize = 64
+
+// ErrPreConnectQueueFull is returned by PublishWith (and notified to the
+// PubHandleFunc, SubHandleFunc or UnsubHandleFunc) when the operation
+// issued before the first connection exceeds the queue size (see
+// WithPreConnectQueue)
+var ErrPreConnectQueueFull = errors.New("pre-connect queue full ")
+
+// WithPreConnectQueue designate the size of the queue of publishes,
+// subscribes and unsubscribes issued before the first connection
+// completed (ConnAck received) once the send buffer (see WithSendBuf) is
+// full, instead of blocking until connected, they are sent in order once
+// connected, operations exceeding the size fail with
+// ErrPreConnectQueueFull (default 64)
+func WithPreConnectQueue(size int) Option {
+	return func(c *AsyncClient, options *connectOptions) error {
+		if size < 0 {
+			size = 0
+		}
+
+		c.preConnSize = size
+		return nil
+	}
+}
+
+// WithFailFastWhenDisconnected fails publishes, subscribes and
+// unsubscribes with ErrNotConnected immediately when no server is
+// connected instead of queuing them (before the first connection) or
+// blocking until reconnected
+func WithFailFastWhenDisconnected(failFast bool) Option {
+	return func(c *AsyncClient, options *connectOptions) error {
+		c.failFast = failFast
+		return nil
+	}
+}
+
+// connected returns true if any server is connected (ConnAck received)
+func (c *AsyncClient) connected() bool {
+	connected := false
+	c.connectedServers.Range(func(key, value interface{}) bool {
+		conn := value.(*clientConn)
+		// ctx is set before the conn info
+		connected = conn.getConnInfo() != nil && conn.ctx.Err() == nil
+		return !connected
+	})
+	return connected
+}
+
+// queuePreConnect queues the packet without blocking if the first
+// connection not completed, to sendCh if not full or preConnQueue, returns
+// false if the packet should be sent to sendCh
+func (c *AsyncClient) queuePreConnect(pkt Packet) (bool, error) {
+	if c.failFast && !c.connected() {
+		return false, ErrNotConnected
+	}
+
+	c.preConnMu.Lock()
+	defer c.preConnMu.Unlock()
+
+	if c.preConnDone {
+		return false, nil
+	}
+
+	if len(c.preConnQueue) == 0 {
+		// queued packets are sent first
+		select {
+		case c.sendCh <- pkt:
+			return true, nil
+		default:
+		}
+	}
+
+	// not limited once connected, flushed soon
+	if len(c.preConnQueue) >= c.preConnSize && !c.preConnReady {
+		return false, ErrPreConnectQueueFull
+	}
+
+	c.preConnQueue = append(c.preConnQueue, pkt)
+	return true, nil
+}
+
+// preConnectReady flushes packets queued once the first connection
+// completed
+func (c *AsyncClient) preConnectReady() {
+	c.preConnMu.Lock()
+	c.preConnReady = true
+	c.preConnMu.Unlock()
+
+	c.addWorker(c.flushPreConnect)
+}
+
+// flushPreConnect sends packets queued before the first connection in
+// order, packets issued while flushing wait until flushed
+func (c *AsyncClient) flushPreConnect() {
+	c.preConnMu.Lock()
+	defer c.preConnMu.Unlock()
+
+	if c.preConnDone {
+		return
+	}
+	c.preConnDone = true
+
+	queued := c.preConnQueue
+	c.preConnQueue = nil
+	if len(queued) > 0 {
+		c.log.d("CLI send packets queued before connected, count =", len(queued))
+	}
+
+	for _, pkt := range queued {
+		select {
+		case <-c.done():
+			return
+		case c.sendCh <- pkt:
+		}
+	}
+}
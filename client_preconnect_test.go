@@ -0,0 +1,138 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestClient_PreConnectQueue(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		sent []string
+		subs = make(chan error, 2)
+	)
+	client, err := NewClient(
+		WithPreConnectQueue(3),
+		WithCustomConnector(fakeConnector(fakeBrokerConfig{ackPub: true})),
+		WithSendInterceptor(func(server string, pkt Packet) Packet {
+			mu.Lock()
+			defer mu.Unlock()
+			switch p := pkt.(type) {
+			case *SubscribePacket:
+				sent = append(sent, "sub "+p.Topics[0].Name)
+			case *PublishPacket:
+				sent = append(sent, "pub "+p.TopicName)
+			case *UnsubPacket:
+				sent = append(sent, "unsub "+p.TopicNames[0])
+			}
+			return pkt
+		}),
+		WithSubHandleFunc(func(client Client, topics []*Topic, err error) {
+			subs <- err
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Destroy(true)
+
+	// not blocked before connected (1 in the send buffer, 3 queued)
+	client.Subscribe(&Topic{Name: "/foo", Qos: Qos1})
+	if err := client.PublishWith("/foo", nil, PubQoS(Qos1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.PublishWith("/bar", nil); err != nil {
+		t.Fatal(err)
+	}
+	client.Unsubscribe("/foo")
+
+	if err := client.PublishWith("/full", nil, PubQoS(Qos1)); err != ErrPreConnectQueueFull {
+		t.Error("unexpected error of queue full =", err)
+	}
+	client.Subscribe(&Topic{Name: "/full"})
+	if err := <-subs; err != ErrPreConnectQueueFull {
+		t.Error("unexpected error of subscribe queue full =", err)
+	}
+
+	if err := client.ConnectServer("fake"); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-subs; err != nil {
+		t.Fatal("subscribe queued failed, err =", err)
+	}
+
+	// sent after queued ones
+	if err := client.PublishWith("/after", nil, PubQoS(Qos1)); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"sub /foo", "pub /foo", "pub /bar", "unsub /foo", "pub /after"}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		n := len(sent)
+		got := append([]string(nil), sent...)
+		mu.Unlock()
+
+		if n >= len(want) {
+			for i := range want {
+				if got[i] != want[i] {
+					t.Fatal("unexpected packets sent =", got)
+				}
+			}
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("queued packets not sent =", got)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestClient_FailFastWhenDisconnected(t *testing.T) {
+	subs := make(chan error, 1)
+	client, err := NewClient(
+		WithFailFastWhenDisconnected(true),
+		WithSubHandleFunc(func(client Client, topics []*Topic, err error) {
+			subs <- err
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Destroy(true)
+
+	if err := client.PublishWith("/foo", nil, PubQoS(Qos1)); err != ErrNotConnected {
+		t.Error("unexpected error of publish =", err)
+	}
+	client.Subscribe(&Topic{Name: "/foo"})
+	select {
+	case err := <-subs:
+		if err != ErrNotConnected {
+			t.Error("unexpected error of subscribe =", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("subscribe not failed")
+	}
+	if len(client.sendCh) != 0 {
+		t.Error("packets queued when disconnected")
+	}
+}
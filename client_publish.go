@@ -0,0 +1,349 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+var (
+	// ErrPubOptionRequiresV5 used when publish properties are set by
+	// PubOption while the client is configured for MQTT 3.1.1
+	ErrPubOptionRequiresV5 = errors.New("publish option requires MQTT 5 ")
+
+	// ErrPayloadNotUTF8 used when the payload is not valid UTF-8 encoded
+	// with payload format indicator set
+	ErrPayloadNotUTF8 = errors.New("payload not UTF-8 encoded with payload format indicator set ")
+
+	// ErrInvalidPayloadFormat is the same as ErrPayloadNotUTF8, notified to
+	// the PubHandleFunc when the payload format validation failed (see
+	// WithPayloadFormatValidation)
+	ErrInvalidPayloadFormat = ErrPayloadNotUTF8
+
+	// ErrSendBufFull is returned by PublishWith (and notified to the
+	// PubHandleFunc for Publish) when the QoS0 publish is dropped since
+	// the send buffer is full (see WithQoS0DropWhenFull)
+	ErrSendBufFull = errors.New("send buffer full ")
+
+	// ErrPublishExpired is notified to the PubHandleFunc when the queued
+	// publish is discarded since the deadline passed before sent (see
+	// PubDeadline and PubContext)
+	ErrPublishExpired = errors.New("publish expired before sent ")
+
+	// ErrPublishCanceled is notified to the PubHandleFunc when the queued
+	// publish is discarded since the context canceled before sent (see
+	// PubContext)
+	ErrPublishCanceled = errors.New("publish canceled before sent ")
+)
+
+// PubAckError is notified to the PubHandleFunc when the server refused the
+// publish with a failure reason code (0x80 or greater) in the PubAck, PubRec
+// or PubComp packet (MQTT 5), reason codes less than 0x80 (e.g.
+// CodeNoMatchingSubscribers) are successful
+type PubAckError struct {
+	// Packet is the control type of the packet with the reason code
+	Packet CtrlType
+	Code   byte
+	// Reason is the reason string property, may be empty
+	Reason string
+}
+
+func (e *PubAckError) Error() string {
+	msg := fmt.Sprintf("publish refused, reason code 0x%02x", e.Code)
+	if e.Reason != "" {
+		msg += ": " + e.Reason
+	}
+	return msg
+}
+
+// ReasonCode is the reason code of the packet
+func (e *PubAckError) ReasonCode() byte {
+	return e.Code
+}
+
+// pubAckError returns the PubAckError of the reason code, nil if successful
+func pubAckError(packet CtrlType, code byte, reason string) error {
+	if code < CodeUnspecifiedError {
+		return nil
+	}
+
+	return &PubAckError{Packet: packet, Code: code, Reason: reason}
+}
+
+// PubOption is the option to build the publish packet for PublishWith,
+// options setting publish properties require MQTT 5
+type PubOption func(p *PublishPacket) error
+
+// PubQoS set the QoS of the publish packet
+func PubQoS(qos QosLevel) PubOption {
+	return func(p *PublishPacket) error {
+		if qos > Qos2 {
+			return fmt.Errorf("invalid publish QoS %d", qos)
+		}
+
+		p.Qos = qos
+		return nil
+	}
+}
+
+// PubRetain set the retain flag of the publish packet
+func PubRetain(retain bool) PubOption {
+	return func(p *PublishPacket) error {
+		p.IsRetain = retain
+		return nil
+	}
+}
+
+// PubPayloadUTF8 set the payload format indicator, the payload MUST be
+// UTF-8 encoded character data (MQTT 5)
+func PubPayloadUTF8() PubOption {
+	return func(p *PublishPacket) error {
+		pubProps(p).PayloadFormat = 1
+		return nil
+	}
+}
+
+// PubContentType set the content type of the payload, e.g. MIME type
+// "application/json" (MQTT 5)
+func PubContentType(contentType string) PubOption {
+	return func(p *PublishPacket) error {
+		if !utf8.ValidString(contentType) {
+			return fmt.Errorf("content type %q not UTF-8 encoded", contentType)
+		}
+
+		pubProps(p).ContentType = contentType
+		return nil
+	}
+}
+
+// PubExpiry set the lifetime of the message, the server discards the
+// message not delivered within the expiry, rounded up to seconds (MQTT 5)
+func PubExpiry(expiry time.Duration) PubOption {
+	return func(p *PublishPacket) error {
+		if expiry <= 0 {
+			return fmt.Errorf("publish expiry must be positive, got %v", expiry)
+		}
+
+		seconds := (expiry + time.Second - 1) / time.Second
+		if seconds > 0xffffffff {
+			return fmt.Errorf("publish expiry %v too large", expiry)
+		}
+
+		pubProps(p).MessageExpiryInterval = uint32(seconds)
+		return nil
+	}
+}
+
+// PubResponseTopic set the topic of the response message (MQTT 5)
+func PubResponseTopic(topic string) PubOption {
+	return func(p *PublishPacket) error {
+		if err := ValidateTopicName(strings.TrimPrefix(topic, absoluteTopicMarker)); err != nil {
+			return fmt.Errorf("invalid response topic %q: %v", topic, err)
+		}
+
+		pubProps(p).RespTopic = topic
+		return nil
+	}
+}
+
+// PubCorrelation set the correlation data to identify which request the
+// response message is for (MQTT 5)
+func PubCorrelation(data []byte) PubOption {
+	return func(p *PublishPacket) error {
+		pubProps(p).CorrelationData = data
+		return nil
+	}
+}
+
+// PubDeadline set the deadline to send the publish packet, the packet
+// still queued (e.g. while the connection is lost) once the deadline
+// passed is discarded with ErrPublishExpired, packets sent are not
+// affected (use PubExpiry to limit the lifetime in servers)
+func PubDeadline(deadline time.Time) PubOption {
+	return func(p *PublishPacket) error {
+		p.deadline = deadline
+		return nil
+	}
+}
+
+// PubContext set the context of the publish packet, the packet still
+// queued once the context done is discarded with ErrPublishCanceled (or
+// ErrPublishExpired if the context deadline exceeded), so a specific
+// publish can be canceled with the cancel function of the context
+func PubContext(ctx context.Context) PubOption {
+	return func(p *PublishPacket) error {
+		if ctx == nil {
+			return errors.New("nil publish context")
+		}
+
+		p.ctx = ctx
+		return nil
+	}
+}
+
+// PubUserProp add the user property, can be used multiple times with the
+// same key (MQTT 5)
+func PubUserProp(key, value string) PubOption {
+	return func(p *PublishPacket) error {
+		pubProps(p).UserProps.Add(key, value)
+		return nil
+	}
+}
+
+func pubProps(p *PublishPacket) *PublishProps {
+	if p.Props == nil {
+		p.Props = &PublishProps{}
+	}
+	return p.Props
+}
+
+// PublishWith builds the publish packet to the topic with options and
+// publishes it, error is returned if options are invalid (e.g. MQTT 5
+// options while the client is configured for MQTT 3.1.1, see WithVersion,
+// or ErrTopicQoSExceeded, see WithTopicQoSStrict) or the publish rejected by the rate limit (ErrRateLimited), the full
+// send buffer (ErrSendBufFull), the bandwidth budget
+// (ErrBandwidthExceeded), the full pre-connect queue
+// (ErrPreConnectQueueFull), not connected (ErrNotConnected, see
+// WithFailFastWhenDisconnected) or the client destroyed
+// (ErrClientDestroyed), the result of the publish is notified to
+// the PubHandleFunc, the QoS of the topic is used if PubQoS not set (Qos0
+// if not configured, see WithTopicQoS)
+func (c *AsyncClient) PublishWith(topic string, payload []byte, options ...PubOption) error {
+	return c.publishWith(nil, topic, payload, options)
+}
+
+// PublishAsync publishes the same as PublishWith, the PublishToken returned
+// is resolved once the publish completed (acked for QoS1/QoS2, written for
+// QoS0) or failed, with the error returned by PublishWith, the error of
+// the write, ErrRetryExceeded, or ErrClientDestroyed once destroyed, QoS1
+// and QoS2 publishes not acked before the connection lost are resolved
+// once resent and acked on the new connection, the result is also
+// notified to the PubHandleFunc (except errors PublishWith returns)
+func (c *AsyncClient) PublishAsync(topic string, payload []byte, options ...PubOption) *PublishToken {
+	token := c.pubTokens.newToken(topic)
+	if err := c.publishWith(token, topic, payload, options); err != nil {
+		token.resolve(err)
+	}
+	return token
+}
+
+func (c *AsyncClient) publishWith(token *PublishToken, topic string, payload []byte, options []PubOption) error {
+	p, err := c.newPublish(topic, payload, options...)
+	if err != nil {
+		return err
+	}
+
+	if c.isClosing() {
+		return ErrClientDestroyed
+	}
+
+	p.token = token
+	if err := c.publish(p); err != nil {
+		switch err {
+		case ErrRateLimited, ErrSendBufFull, ErrBandwidthExceeded, ErrPreConnectQueueFull, ErrNotConnected, ErrClientDestroyed:
+			return err
+		}
+		notifyPubMsg(c.msgCh, topic, err)
+		token.resolve(err)
+	}
+	return nil
+}
+
+// PublishRetained publishes the payload to the topic as the retained
+// message, which is sent to future subscribers of the topic
+func (c *AsyncClient) PublishRetained(topic string, qos QosLevel, payload []byte) error {
+	return c.PublishWith(topic, payload, PubQoS(qos), PubRetain(true))
+}
+
+// ClearRetained clears the retained message of the topic by publishing an
+// empty retained message, Qos0 is raised to Qos1 so the clear is not lost
+// silently (the result is notified to the PubHandleFunc)
+func (c *AsyncClient) ClearRetained(topic string, qos QosLevel) error {
+	if qos < Qos1 {
+		qos = Qos1
+	}
+	return c.PublishWith(topic, nil, PubQoS(qos), PubRetain(true))
+}
+
+// newPublish builds and validates the publish packet of PublishWith
+func (c *AsyncClient) newPublish(topic string, payload []byte, options ...PubOption) (*PublishPacket, error) {
+	if !c.skipTopicValidation {
+		if err := ValidateTopicName(c.prefixTopic(topic)); err != nil {
+			return nil, err
+		}
+	}
+
+	p := &PublishPacket{TopicName: topic, Payload: payload, Qos: qosUnset}
+	for _, setOption := range options {
+		if err := setOption(p); err != nil {
+			return nil, err
+		}
+	}
+
+	// QoS of the topic if PubQoS not set
+	if err := c.applyTopicQoS(p); err != nil {
+		return nil, err
+	}
+
+	if p.Props != nil {
+		if c.options.protoVersion < V5 {
+			return nil, ErrPubOptionRequiresV5
+		}
+
+		if !validPayloadFormat(p) {
+			return nil, ErrPayloadNotUTF8
+		}
+	}
+
+	return p, nil
+}
+
+// discarded returns the reason why the queued publish packet should not be
+// sent at now (of the client clock), nil if still valid
+func (p *PublishPacket) discarded(now time.Time) error {
+	if !p.deadline.IsZero() && !now.Before(p.deadline) {
+		return ErrPublishExpired
+	}
+
+	if p.ctx == nil {
+		return nil
+	}
+
+	switch p.ctx.Err() {
+	case nil:
+		return nil
+	case context.DeadlineExceeded:
+		return ErrPublishExpired
+	default:
+		return ErrPublishCanceled
+	}
+}
+
+// validPayloadFormat returns false if the payload format indicator is set
+// but the payload is not UTF-8 encoded, streamed payloads are not validated
+func validPayloadFormat(p *PublishPacket) bool {
+	if p.Props == nil || p.Props.PayloadFormat != 1 || p.PayloadReader != nil {
+		return true
+	}
+
+	return utf8.Valid(p.Payload)
+}
@@ -0,0 +1,495 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClient_PublishWith(t *testing.T) {
+	c, err := NewClient(WithVersion(V5, false))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer c.Destroy(true)
+
+	p, err := c.newPublish("/foo", []byte(`{"foo":"bar"}`),
+		PubQoS(Qos1),
+		PubRetain(true),
+		PubPayloadUTF8(),
+		PubContentType("application/json"),
+		PubExpiry(1500*time.Millisecond),
+		PubResponseTopic("/resp"),
+		PubCorrelation([]byte{1, 2}),
+		PubUserProp("k", "v1"),
+		PubUserProp("k", "v2"),
+	)
+	if assert.NoError(t, err) {
+		assert.Equal(t, &PublishPacket{
+			TopicName: "/foo",
+			Qos:       Qos1,
+			IsRetain:  true,
+			Payload:   []byte(`{"foo":"bar"}`),
+			Props: &PublishProps{
+				PayloadFormat:         1,
+				MessageExpiryInterval: 2,
+				RespTopic:             "/resp",
+				CorrelationData:       []byte{1, 2},
+				UserProps:             UserProps{{Key: "k", Value: "v1"}, {Key: "k", Value: "v2"}},
+				ContentType:           "application/json",
+			},
+		}, p)
+	}
+
+	_, err = c.newPublish("/foo", []byte{0xff}, PubPayloadUTF8())
+	assert.Equal(t, ErrPayloadNotUTF8, err)
+
+	for _, options := range [][]PubOption{
+		{PubQoS(3)},
+		{PubExpiry(0)},
+		{PubResponseTopic("/resp/#")},
+	} {
+		_, err = c.newPublish("/foo", nil, options...)
+		assert.Error(t, err)
+	}
+
+	_, err = c.newPublish("/foo/+", nil)
+	assert.Error(t, err)
+
+	// MQTT 5 options with MQTT 3.1.1
+	c311, err := NewClient(WithVersion(V311, false))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer c311.Destroy(true)
+
+	_, err = c311.newPublish("/foo", nil, PubQoS(Qos2), PubRetain(true))
+	assert.NoError(t, err)
+	assert.Equal(t, ErrPubOptionRequiresV5, c311.PublishWith("/foo", nil, PubContentType("text/plain")))
+}
+
+func TestClient_PublishRetained(t *testing.T) {
+	c := defaultClient()
+
+	for _, pub := range []struct {
+		publish func() error
+		qos     QosLevel
+		payload []byte
+	}{
+		{func() error { return c.PublishRetained("/foo", Qos0, []byte("bar")) }, Qos0, []byte("bar")},
+		// clear with Qos0 raised to Qos1
+		{func() error { return c.ClearRetained("/foo", Qos0) }, Qos1, nil},
+		{func() error { return c.ClearRetained("/foo", Qos2) }, Qos2, nil},
+	} {
+		if !assert.NoError(t, pub.publish()) {
+			return
+		}
+
+		p := (<-c.sendCh).(*PublishPacket)
+		assert.Equal(t, "/foo", p.TopicName)
+		assert.Equal(t, pub.qos, p.Qos)
+		assert.True(t, p.IsRetain)
+		assert.Equal(t, pub.payload, p.Payload)
+	}
+
+	assert.Error(t, c.ClearRetained("/foo/#", Qos1))
+}
+
+func TestClient_HandleTopicRetain(t *testing.T) {
+	c := defaultClient()
+
+	var retained []bool
+	c.HandleTopicRetain("/foo", func(client Client, topic string, qos QosLevel, msg []byte, r bool) {
+		assert.Equal(t, "/foo", topic)
+		retained = append(retained, r)
+	})
+
+	c.dispatch(&PublishPacket{TopicName: "/foo", IsRetain: true})
+	c.dispatch(&PublishPacket{TopicName: "/foo"})
+	assert.Equal(t, []bool{true, false}, retained)
+}
+
+func TestClient_HandleEx(t *testing.T) {
+	c := defaultClient()
+
+	var metas []PublishMeta
+	c.HandleEx("/foo", func(client Client, topic string, qos QosLevel, msg []byte, meta PublishMeta) {
+		assert.Equal(t, "/foo", topic)
+		metas = append(metas, meta)
+	})
+
+	now := time.Now()
+	c.dispatch(&PublishPacket{TopicName: "/foo", Qos: Qos1, IsRetain: true, IsDup: true, PacketID: 10, server: "fake", recvAt: now})
+	c.dispatch(&PublishPacket{TopicName: "/foo"})
+	assert.Equal(t, []PublishMeta{
+		{Retain: true, Dup: true, PacketID: 10, Server: "fake", ReceivedAt: now},
+		{},
+	}, metas)
+
+	// no allocation more than topic handlers
+	c.HandleEx("/ex", func(client Client, topic string, qos QosLevel, msg []byte, meta PublishMeta) {})
+	c.HandleTopic("/topic", func(client Client, topic string, qos QosLevel, msg []byte) {})
+	allocs := make(map[string]float64)
+	for _, topic := range []string{"/ex", "/topic"} {
+		pkt := &PublishPacket{TopicName: topic, Qos: Qos1, PacketID: 1, server: "fake", recvAt: now}
+		allocs[topic] = testing.AllocsPerRun(100, func() { c.dispatch(pkt) })
+	}
+	assert.LessOrEqual(t, allocs["/ex"], allocs["/topic"])
+}
+
+func TestClient_QoS0DropWhenFull(t *testing.T) {
+	c := defaultClient()
+	for _, setOption := range []Option{WithSendBuf(2), WithQoS0DropWhenFull(true)} {
+		if !assert.NoError(t, setOption(c, &c.options)) {
+			return
+		}
+	}
+	assert.Equal(t, 2, cap(c.sendCh))
+	// connected before, not queued in the pre-connect queue
+	c.flushPreConnect()
+
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, c.PublishWith("/foo", nil))
+	}
+	assert.Equal(t, ErrSendBufFull, c.PublishWith("/foo", nil))
+
+	c.Publish(&PublishPacket{TopicName: "/bar"})
+	if m := <-c.msgCh; assert.Equal(t, pubMsg, m.what) {
+		assert.Equal(t, "/bar", m.msg)
+		assert.Equal(t, ErrSendBufFull, m.err)
+	}
+	assert.Equal(t, uint64(2), c.Stats().DroppedPublishes)
+
+	// QoS1 publishes blocked until buffered
+	done := make(chan error, 1)
+	go func() { done <- c.PublishWith("/foo", nil, PubQoS(Qos1)) }()
+	select {
+	case err := <-done:
+		t.Fatal("QoS1 publish not blocked, err =", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	<-c.sendCh
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("QoS1 publish not buffered")
+	}
+	assert.Equal(t, uint64(2), c.Stats().DroppedPublishes)
+}
+
+func TestClient_TopicQoS(t *testing.T) {
+	topicQoS := map[string]QosLevel{
+		"sensors/#":       Qos0,
+		"sensors/+/alarm": Qos1,
+		"sensors/a/alarm": Qos2,
+		"cmd/+":           Qos2,
+		"cmd/#":           Qos1,
+	}
+
+	_, err := NewClient(WithTopicQoS(map[string]QosLevel{"/foo/#/bar": Qos1}))
+	assert.Error(t, err)
+	_, err = NewClient(WithTopicQoS(map[string]QosLevel{"/foo": 3}))
+	assert.Error(t, err)
+
+	c, err := NewClient(WithTopicQoS(topicQoS))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer c.Destroy(true)
+
+	sent := func() *PublishPacket {
+		select {
+		case p := <-c.sendCh:
+			return p.(*PublishPacket)
+		case <-time.After(time.Second):
+			t.Fatal("publish not sent")
+			return nil
+		}
+	}
+
+	for _, pub := range []struct {
+		topic   string
+		options []PubOption
+		qos     QosLevel
+	}{
+		// QoS of the topic if not set
+		{"sensors/b/temp", nil, Qos0},
+		{"sensors/b/alarm", nil, Qos0},
+		{"sensors/a/alarm", nil, Qos2},
+		{"cmd/reboot", nil, Qos1},
+		{"other", nil, Qos0},
+		// downgraded to the topic QoS
+		{"sensors/b/temp", []PubOption{PubQoS(Qos2)}, Qos0},
+		{"cmd/reboot", []PubOption{PubQoS(Qos2)}, Qos1},
+		{"sensors/a/alarm", []PubOption{PubQoS(Qos1)}, Qos1},
+		{"other", []PubOption{PubQoS(Qos2)}, Qos2},
+	} {
+		if !assert.NoError(t, c.PublishWith(pub.topic, nil, pub.options...)) {
+			return
+		}
+		assert.Equal(t, pub.qos, sent().Qos, pub.topic)
+	}
+
+	// packets published downgraded without modified
+	p := &PublishPacket{TopicName: "cmd/reboot", Qos: Qos2}
+	c.Publish(p)
+	assert.Equal(t, Qos1, sent().Qos)
+	assert.Equal(t, Qos2, p.Qos)
+
+	// refused if strict
+	pubErrs := make(chan error, 1)
+	strict, err := NewClient(
+		WithTopicQoS(topicQoS),
+		WithTopicQoSStrict(true),
+		WithPubHandleFunc(func(client Client, topic string, err error) {
+			pubErrs <- err
+		}),
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer strict.Destroy(true)
+
+	assert.Equal(t, ErrTopicQoSExceeded, strict.PublishWith("cmd/reboot", nil, PubQoS(Qos2)))
+	assert.NoError(t, strict.PublishWith("cmd/reboot", nil, PubQoS(Qos1)))
+	strict.Publish(&PublishPacket{TopicName: "sensors/b/temp", Qos: Qos1})
+	select {
+	case err := <-pubErrs:
+		assert.Equal(t, ErrTopicQoSExceeded, err)
+	case <-time.After(time.Second):
+		t.Error("publish exceeding the topic QoS not refused")
+	}
+}
+
+func TestClient_PublishAsync(t *testing.T) {
+	connected := make(chan struct{}, 1)
+	c, err := NewClient(
+		WithRetryInterval(20*time.Millisecond, 2),
+		WithCustomConnector(fakeConnector(fakeBrokerConfig{
+			ackPub: true,
+			noAck:  func(p *PublishPacket) bool { return string(p.Payload) == "lost" },
+		})),
+		WithConnHandleFunc(func(client Client, server string, code byte, err error) {
+			if code == CodeSuccess {
+				connected <- struct{}{}
+			}
+		}),
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer c.Destroy(true)
+
+	wait := func(token *PublishToken) error {
+		select {
+		case <-token.Done():
+			return token.Error()
+		case <-time.After(5 * time.Second):
+			t.Fatal("token not resolved, packet id =", token.PacketID())
+			return nil
+		}
+	}
+
+	// rejected before sent
+	token := c.PublishAsync("/foo/#", nil)
+	assert.Equal(t, ErrTopicWildcard, wait(token))
+	assert.Equal(t, "/foo/#", token.Topic())
+
+	if !assert.NoError(t, c.ConnectServer("fake")) {
+		return
+	}
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connect timeout")
+	}
+
+	// published to the same topic concurrently
+	payloads := []string{"ok", "lost", "ok"}
+	tokens := make([]*PublishToken, len(payloads))
+	var wg sync.WaitGroup
+	for i := range payloads {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tokens[i] = c.PublishAsync("alerts", []byte(payloads[i]), PubQoS(Qos1))
+		}(i)
+	}
+	wg.Wait()
+
+	ids := make(map[uint16]bool)
+	for i, token := range tokens {
+		err := wait(token)
+		if payloads[i] == "lost" {
+			assert.Equal(t, ErrRetryExceeded, err)
+		} else {
+			assert.NoError(t, err)
+		}
+		assert.Equal(t, "alerts", token.Topic())
+		assert.NotZero(t, token.PacketID())
+		ids[token.PacketID()] = true
+	}
+	assert.Len(t, ids, len(tokens), "packet ids not unique")
+
+	// QoS0 resolved once written
+	assert.NoError(t, wait(c.PublishAsync("alerts", []byte("ok"))))
+
+	// not acked before destroyed
+	token = c.PublishAsync("alerts", []byte("lost"), PubQoS(Qos2))
+	c.Destroy(true)
+	assert.Equal(t, ErrClientDestroyed, wait(token))
+	assert.Equal(t, ErrClientDestroyed, wait(c.PublishAsync("alerts", nil)))
+	assert.Empty(t, c.pubTokens.tokens, "tokens not removed once resolved")
+}
+
+func TestClient_HandleExMeta(t *testing.T) {
+	metas := make(chan PublishMeta, 1)
+	client, err := NewClient(
+		WithCustomConnector(scriptBroker(V311, func(s *fakeSession) {
+			s.write(&ConnAckPacket{}, &PublishPacket{TopicName: "/foo", Qos: Qos1, PacketID: 7, IsRetain: true})
+			s.discard()
+		})),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Destroy(true)
+
+	client.HandleEx("/foo", func(client Client, topic string, qos QosLevel, msg []byte, meta PublishMeta) {
+		metas <- meta
+	})
+
+	start := time.Now()
+	if err := client.ConnectServer("fake"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case m := <-metas:
+		if !m.Retain || m.Dup || m.PacketID != 7 || m.Server != "fake" ||
+			m.ReceivedAt.Before(start) || m.ReceivedAt.After(time.Now()) {
+			t.Errorf("unexpected publish meta = %+v", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("publish not handled")
+	}
+}
+
+func TestClient_PayloadFormatValidation(t *testing.T) {
+	invalid := []byte{0xff, 0xfe}
+	for _, policy := range []PayloadFormatPolicy{PayloadFormatReject, PayloadFormatFlag} {
+		acks := make(chan Packet, 2)
+		received := make(chan *PublishPacket, 3)
+		pubErrs := make(chan error, 1)
+		client, err := NewClient(
+			WithVersion(V5, false),
+			WithPayloadFormatValidation(true),
+			WithPayloadFormatPolicy(policy),
+			WithPubHandleFunc(func(client Client, topic string, err error) { pubErrs <- err }),
+			WithCustomConnector(scriptBroker(V5, func(s *fakeSession) {
+				pkts := []Packet{&ConnAckPacket{}}
+				for i, qos := range []QosLevel{Qos1, Qos2, Qos0} {
+					pkts = append(pkts, &PublishPacket{
+						TopicName: "/foo",
+						Qos:       qos,
+						PacketID:  uint16(i + 1),
+						Payload:   invalid,
+						Props:     &PublishProps{PayloadFormat: 1},
+					})
+				}
+				s.write(pkts...)
+
+				for {
+					pkt, err := s.read()
+					if err != nil {
+						return
+					}
+
+					switch pkt.(type) {
+					case *PubAckPacket, *PubRecvPacket:
+						acks <- pkt
+					}
+				}
+			})),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		client.HandlePublish("/foo", func(client Client, p *PublishPacket) { received <- p })
+		if err := client.ConnectServer("fake"); err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 2; i++ {
+			select {
+			case pkt := <-acks:
+				code := byte(0)
+				switch p := pkt.(type) {
+				case *PubAckPacket:
+					code = p.Code
+				case *PubRecvPacket:
+					code = p.Code
+				}
+
+				if policy == PayloadFormatReject && code != CodePayloadFormatInvalid ||
+					policy == PayloadFormatFlag && code != CodeSuccess {
+					t.Error("unexpected ack code =", code, "policy =", policy)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("ack not sent, policy =", policy)
+			}
+		}
+
+		if policy == PayloadFormatFlag {
+			// QoS1 and QoS0 packets, QoS2 packet is not released
+			for i := 0; i < 2; i++ {
+				select {
+				case p := <-received:
+					if !p.InvalidPayloadFormat {
+						t.Error("invalid payload format not flagged, id =", p.PacketID)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatal("packet not delivered")
+				}
+			}
+		} else {
+			select {
+			case p := <-received:
+				t.Error("invalid packet delivered, id =", p.PacketID)
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+
+		client.Publish(&PublishPacket{TopicName: "/foo", Payload: invalid, Props: &PublishProps{PayloadFormat: 1}})
+		select {
+		case err := <-pubErrs:
+			if err != ErrInvalidPayloadFormat {
+				t.Error("unexpected publish error =", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Error("publish error not notified")
+		}
+		client.Destroy(true)
+	}
+}
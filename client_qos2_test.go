@@ -0,0 +1,421 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestClientConn_Qos2ExactlyOnce(t *testing.T) {
+	persist := NewMemPersist(nil)
+	manualAck := false
+	runLogic := func(pkts ...Packet) (*AsyncClient, *clientConn) {
+		c := defaultClient()
+		c.options.keepalive = 0
+		c.manualAck = manualAck
+		c.persist = persist
+		c.recvCh = make(chan *PublishPacket, 10)
+
+		conn, _ := net.Pipe()
+		cc := &clientConn{
+			parent:     c,
+			options:    &c.options,
+			name:       "test",
+			conn:       conn,
+			logicSendC: make(chan Packet, 10),
+			netRecvC:   make(chan Packet, 10),
+			stopSig:    make(chan struct{}),
+		}
+		for _, p := range pkts {
+			cc.netRecvC <- p
+		}
+		close(cc.netRecvC)
+		cc.logic()
+		return c, cc
+	}
+
+	acks := func(conn *clientConn) []Packet {
+		var ret []Packet
+		for len(conn.logicSendC) > 0 {
+			ret = append(ret, <-conn.logicSendC)
+		}
+		return ret
+	}
+
+	pub := &PublishPacket{TopicName: "/foo", Qos: Qos2, PacketID: 1, Payload: []byte("bar")}
+	dup := &PublishPacket{TopicName: "/foo", Qos: Qos2, PacketID: 1, Payload: []byte("bar"), IsDup: true}
+	c, conn := runLogic(pub, dup, &PubRelPacket{PacketID: 1}, &PubRelPacket{PacketID: 1})
+
+	if len(c.recvCh) != 1 {
+		t.Fatal("packet not delivered exactly once, count =", len(c.recvCh))
+	}
+
+	expected := []Packet{
+		&PubRecvPacket{PacketID: 1},
+		&PubRecvPacket{PacketID: 1},
+		&PubCompPacket{PacketID: 1},
+		&PubCompPacket{PacketID: 1},
+	}
+	sent := acks(conn)
+	if len(sent) != len(expected) {
+		t.Fatal("unexpected acks =", sent)
+	}
+	for i, p := range sent {
+		if p.Type() != expected[i].Type() {
+			t.Error("unexpected ack type =", p.Type(), "index =", i)
+		}
+	}
+
+	if _, ok := persist.Load(recvKey("", 1)); ok {
+		t.Error("released packet not deleted from persist")
+	}
+
+	// the state is kept across client restart
+	pub.PacketID, dup.PacketID = 2, 2
+	c, _ = runLogic(pub)
+	if len(c.recvCh) != 0 {
+		t.Fatal("packet delivered before PubRel")
+	}
+
+	c, conn = runLogic(dup, &PubRelPacket{PacketID: 2})
+	if len(c.recvCh) != 1 {
+		t.Fatal("packet not delivered exactly once after restart, count =", len(c.recvCh))
+	}
+
+	if p := <-c.recvCh; p.TopicName != "/foo" || string(p.Payload) != "bar" {
+		t.Error("unexpected delivered packet =", p)
+	}
+
+	if sent := acks(conn); len(sent) != 2 || sent[1].Type() != CtrlPubComp {
+		t.Error("unexpected acks after restart =", sent)
+	}
+
+	// kept until PubComp sent in manual ack mode
+	manualAck = true
+	pub.PacketID = 3
+	c, conn = runLogic(pub, &PubRelPacket{PacketID: 3}, &PubRelPacket{PacketID: 3})
+	if len(c.recvCh) != 1 {
+		t.Fatal("packet not delivered exactly once in manual ack mode, count =", len(c.recvCh))
+	}
+	if sent := acks(conn); len(sent) != 1 || sent[0].Type() != CtrlPubRecv {
+		t.Error("PubComp sent before acked =", sent)
+	}
+	if _, ok := persist.Load(recvKey("", 3)); !ok {
+		t.Error("released packet deleted before PubComp sent")
+	}
+
+	c.Ack(<-c.recvCh)
+	if sent := acks(conn); len(sent) != 1 || sent[0].Type() != CtrlPubComp {
+		t.Error("unexpected acks once acked =", sent)
+	}
+	if _, ok := persist.Load(recvKey("", 3)); ok {
+		t.Error("completed packet not deleted from persist")
+	}
+}
+
+// qos2Broker publishes a QoS2 packet once connected and releases it once
+// PubRec received, the PubRel is sent twice as retransmitted by servers
+func qos2Broker(s *fakeSession, completed chan<- *PubCompPacket) {
+	s.write(&ConnAckPacket{Code: CodeSuccess})
+	s.write(&PublishPacket{TopicName: "/foo", Qos: Qos2, PacketID: 7, Payload: []byte("bar")})
+
+	for comps := 0; ; {
+		pkt, err := s.read()
+		if err != nil {
+			return
+		}
+
+		switch p := pkt.(type) {
+		case *PubRecvPacket:
+			s.write(&PubRelPacket{PacketID: p.PacketID})
+		case *PubCompPacket:
+			completed <- p
+			if comps++; comps == 1 {
+				s.write(&PubRelPacket{PacketID: p.PacketID})
+			}
+		}
+	}
+}
+
+func TestClient_Qos2Receive(t *testing.T) {
+	var (
+		persist   = NewMemPersist(nil)
+		completed = make(chan *PubCompPacket, 2)
+		persisted = make(chan error, 10)
+		received  = make(chan string, 2)
+	)
+	client, err := NewClient(
+		WithPersist(persist),
+		WithCustomConnector(scriptBroker(V311, func(s *fakeSession) { qos2Broker(s, completed) })),
+		WithPersistHandleFunc(func(client Client, packet Packet, err error) {
+			persisted <- err
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Destroy(true)
+
+	client.HandleTopic("/foo", func(client Client, topic string, qos QosLevel, msg []byte) {
+		received <- string(msg)
+	})
+
+	if err := client.ConnectServer("fake"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case p := <-completed:
+			if p.PacketID != 7 {
+				t.Fatal("unexpected PubComp =", p)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("PubComp not sent, count =", i)
+		}
+	}
+
+	select {
+	case msg := <-received:
+		if msg != "bar" {
+			t.Error("unexpected message =", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not delivered")
+	}
+
+	select {
+	case msg := <-received:
+		t.Error("message delivered more than once =", msg)
+	case err := <-persisted:
+		t.Error("persist failed, err =", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// deleted once PubComp sent
+	persist.Range(func(key string, p Packet) bool {
+		t.Error("persist store not empty, key =", key, "packet =", p)
+		return true
+	})
+	if pending := client.Pending(); len(pending) != 0 {
+		t.Error("unexpected pending messages =", pending)
+	}
+}
+
+func TestClient_Qos2PublishWire(t *testing.T) {
+	var (
+		mu        sync.Mutex
+		wire      []CtrlType
+		published = make(chan error, 1)
+	)
+	record := func(pkt Packet) {
+		mu.Lock()
+		wire = append(wire, pkt.Type())
+		mu.Unlock()
+	}
+
+	client, err := NewClient(
+		WithCustomConnector(scriptBroker(V311, func(s *fakeSession) {
+			send := func(pkt Packet) {
+				record(pkt)
+				s.write(pkt)
+			}
+
+			s.write(&ConnAckPacket{Code: CodeSuccess})
+			for {
+				pkt, err := s.read()
+				if err != nil {
+					return
+				}
+
+				switch p := pkt.(type) {
+				case *PublishPacket:
+					record(p)
+					send(&PubRecvPacket{PacketID: p.PacketID})
+				case *PubRelPacket:
+					record(p)
+					send(&PubCompPacket{PacketID: p.PacketID})
+				default:
+					if p.Type() != CtrlPingReq && p.Type() != CtrlDisConn {
+						record(p)
+					}
+				}
+			}
+		})),
+		WithPubHandleFunc(func(client Client, topic string, err error) {
+			published <- err
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Destroy(true)
+
+	if err := client.ConnectServer("fake"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.PublishWith("/foo", []byte("bar"), PubQoS(Qos2)); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-published:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("publish not completed")
+	}
+
+	// nothing sent after PubComp
+	time.Sleep(50 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []CtrlType{CtrlPublish, CtrlPubRecv, CtrlPubRel, CtrlPubComp}
+	if len(wire) != len(want) {
+		t.Fatal("unexpected packets on the wire =", wire)
+	}
+	for i := range want {
+		if wire[i] != want[i] {
+			t.Fatal("unexpected packets on the wire =", wire)
+		}
+	}
+}
+
+func TestClient_RecvMaximum(t *testing.T) {
+	for _, version := range []ProtoVersion{V311, V5} {
+		t.Run(fmt.Sprint("version=", version), func(t *testing.T) {
+			testRecvMaximum(t, version)
+		})
+	}
+}
+
+func testRecvMaximum(t *testing.T, version ProtoVersion) {
+	var (
+		maxRecv  = make(chan uint16, 1)
+		received = make(chan Packet, 10)
+	)
+	client, err := NewClient(
+		WithVersion(version, false),
+		WithRecvMaximum(2),
+		WithCustomConnector(scriptBroker(version, func(s *fakeSession) {
+			if props := s.connect.Props; props != nil {
+				maxRecv <- props.MaxRecv
+			} else {
+				maxRecv <- 0
+			}
+
+			s.write(&ConnAckPacket{})
+			for id := uint16(1); id <= 3; id++ {
+				s.write(&PublishPacket{TopicName: "/foo", Qos: Qos2, PacketID: id})
+			}
+
+			for {
+				pkt, err := s.read()
+				if err != nil {
+					close(received)
+					return
+				}
+				received <- pkt
+
+				// complete the first flow
+				if p, ok := pkt.(*PubRecvPacket); ok && p.PacketID == 1 {
+					s.write(&PubRelPacket{PacketID: 1})
+				}
+				if _, ok := pkt.(*PubCompPacket); ok {
+					s.write(&PublishPacket{TopicName: "/foo", Qos: Qos2, PacketID: 4})
+				}
+			}
+		})),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Destroy(true)
+
+	if err := client.ConnectServer("fake"); err != nil {
+		t.Fatal(err)
+	}
+
+	expectedMax := uint16(0)
+	if version == V5 {
+		expectedMax = 2
+	}
+	if n := <-maxRecv; n != expectedMax {
+		t.Error("unexpected receive maximum of connect =", n)
+	}
+
+	next := func() Packet {
+		select {
+		case pkt := <-received:
+			return pkt
+		case <-time.After(5 * time.Second):
+			t.Fatal("packet not received")
+			return nil
+		}
+	}
+
+	var ids []uint16
+	for len(ids) < 2 {
+		if p, ok := next().(*PubRecvPacket); ok {
+			ids = append(ids, p.PacketID)
+		}
+	}
+	if ids[0] != 1 || ids[1] != 2 {
+		t.Fatal("unexpected PubRec ids =", ids)
+	}
+
+	if version == V5 {
+		// the third flow exceeded the receive maximum
+		for {
+			pkt := next()
+			if pkt == nil {
+				t.Fatal("connection closed without disconnect")
+			}
+			if p, ok := pkt.(*DisconnPacket); ok {
+				if p.Code != CodeReceiveMaxExceeded {
+					t.Error("unexpected disconnect code =", p.Code)
+				}
+				return
+			}
+			if _, ok := pkt.(*PubRecvPacket); ok {
+				t.Fatal("PubRec sent exceeding the receive maximum")
+			}
+		}
+	}
+
+	// the third publish dropped, the fourth accepted once the first completed
+	for {
+		switch p := next().(type) {
+		case *PubRecvPacket:
+			if p.PacketID != 4 {
+				t.Fatal("unexpected PubRec id =", p.PacketID)
+			}
+			return
+		case *PubCompPacket:
+		case nil:
+			t.Fatal("connection closed")
+		default:
+			t.Fatal("unexpected packet =", p)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrRateLimited is returned by PublishWith (and notified to the
+// PubHandleFunc for Publish) when the publish exceeded the rate limit
+// with RateLimitReject policy
+var ErrRateLimited = errors.New("publish rate limited ")
+
+// RateLimitPolicy defines the action when the publish exceeded the rate
+// limit (see WithPublishRateLimit)
+type RateLimitPolicy int
+
+const (
+	// RateLimitBlock blocks the publish until allowed by the rate limit
+	// (default)
+	RateLimitBlock RateLimitPolicy = iota
+	// RateLimitReject drops the publish with ErrRateLimited
+	RateLimitReject
+)
+
+// WithPublishRateLimit limits publish packets sent to msgsPerSec on
+// average with bursts of at most burst packets (token bucket), applied to
+// Publish and PublishWith only (acks, pings and packets resent are not
+// limited), use WithPublishRateLimitPolicy to reject publishes exceeded
+// the limit instead of blocking, msgsPerSec not positive disables the
+// limit
+func WithPublishRateLimit(msgsPerSec float64, burst int) Option {
+	return func(c *AsyncClient, options *connectOptions) error {
+		c.pubLimit.set(c.clock.Now(), msgsPerSec, burst)
+		return nil
+	}
+}
+
+// WithPublishRateLimitPolicy designate the action when the publish
+// exceeded the rate limit, publishes delayed or rejected are counted in
+// ClientStats.RateLimitedMessages
+func WithPublishRateLimitPolicy(policy RateLimitPolicy) Option {
+	return func(c *AsyncClient, options *connectOptions) error {
+		c.pubLimitPolicy = policy
+		return nil
+	}
+}
+
+// SetPublishRateLimit changes the publish rate limit at runtime (see
+// WithPublishRateLimit), publishes already waiting are not affected
+func (c *AsyncClient) SetPublishRateLimit(msgsPerSec float64, burst int) {
+	c.pubLimit.set(c.clock.Now(), msgsPerSec, burst)
+}
+
+// waitPublishRate takes a token of the rate limit for the publish, blocks
+// until the token available with RateLimitBlock policy, returns false if
+// rejected (with ErrRateLimited) or the client stopped
+func (c *AsyncClient) waitPublishRate() (bool, error) {
+	wait, ok := c.pubLimit.take(c.clock.Now(), c.pubLimitPolicy == RateLimitBlock)
+	if !ok {
+		return false, ErrRateLimited
+	}
+
+	if wait <= 0 {
+		return true, nil
+	}
+
+	timer := c.clock.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-c.done():
+		return false, nil
+	case <-timer.C():
+		return true, nil
+	}
+}
+
+// rateLimiter is the token bucket of publish rate limit, disabled if rate
+// is zero
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64 // tokens per second
+	burst   float64 // max tokens
+	tokens  float64 // negative if tokens reserved by waiting publishes
+	last    time.Time
+	limited uint64 // publishes delayed or rejected
+}
+
+// set the rate and burst at now, the bucket is full once enabled
+func (l *rateLimiter) set(now time.Time, rate float64, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.advance(now)
+	if rate <= 0 {
+		l.rate, l.tokens = 0, 0
+		return
+	}
+
+	if burst < 1 {
+		burst = 1
+	}
+
+	if l.rate == 0 {
+		l.tokens = float64(burst)
+	}
+	l.rate, l.burst, l.last = rate, float64(burst), now
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+}
+
+// advance refills tokens since the last update, MUST be called with mu
+// held, no tokens refilled if the clock went back (e.g. replaced by
+// WithClock once the limit set)
+func (l *rateLimiter) advance(now time.Time) {
+	if l.rate > 0 && now.After(l.last) {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+	}
+	l.last = now
+}
+
+// take a token at now, returns the time to wait for the token reserved if
+// no token available and reserve is true, or false if not reserved
+func (l *rateLimiter) take(now time.Time, reserve bool) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.rate == 0 {
+		return 0, true
+	}
+
+	l.advance(now)
+	if l.tokens >= 1 {
+		l.tokens--
+		return 0, true
+	}
+
+	l.limited++
+	if !reserve {
+		return 0, false
+	}
+
+	l.tokens--
+	return time.Duration(-l.tokens / l.rate * float64(time.Second)), true
+}
+
+// stats returns the tokens available at now and the count of publishes
+// limited
+func (l *rateLimiter) stats(now time.Time) (float64, uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.advance(now)
+	return l.tokens, l.limited
+}
@@ -0,0 +1,135 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/goiiot/libmqtt/internal/testutil"
+)
+
+func TestRateLimiter(t *testing.T) {
+	var l rateLimiter
+	now := time.Now()
+	if wait, ok := l.take(now, false); !ok || wait != 0 {
+		t.Error("disabled limiter limited, wait =", wait)
+	}
+
+	l.set(now, 10, 2)
+	for i := 0; i < 2; i++ {
+		if wait, ok := l.take(now, false); !ok || wait != 0 {
+			t.Error("burst limited, wait =", wait)
+		}
+	}
+
+	if _, ok := l.take(now, false); ok {
+		t.Error("token taken over burst")
+	}
+
+	// reserved tokens are waited in order
+	if first, ok := l.take(now, true); !ok || first != 100*time.Millisecond {
+		t.Error("unexpected wait of first reservation =", first)
+	}
+	if second, ok := l.take(now, true); !ok || second != 200*time.Millisecond {
+		t.Error("unexpected wait of second reservation =", second)
+	}
+
+	if tokens, limited := l.stats(now); tokens != -2 || limited != 3 {
+		t.Error("unexpected stats, tokens =", tokens, "limited =", limited)
+	}
+
+	// refilled as time goes, not once the clock went back
+	if tokens, _ := l.stats(now.Add(300 * time.Millisecond)); tokens != 1 {
+		t.Error("unexpected tokens refilled =", tokens)
+	}
+	if tokens, _ := l.stats(now); tokens != 1 {
+		t.Error("tokens changed once the clock went back =", tokens)
+	}
+
+	// disabled at runtime
+	l.set(now, 0, 0)
+	if wait, ok := l.take(now, false); !ok || wait != 0 {
+		t.Error("disabled limiter limited, wait =", wait)
+	}
+}
+
+func TestClient_PublishRateLimit(t *testing.T) {
+	clk := testutil.NewFakeClock(time.Now())
+	c := defaultClient()
+	for _, setOption := range []Option{WithClock(clk), WithPublishRateLimit(20, 1), WithPublishRateLimitPolicy(RateLimitReject)} {
+		if err := setOption(c, &c.options); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := c.PublishWith("/foo", nil); err != nil {
+		t.Fatal(err)
+	}
+	<-c.sendCh
+
+	if err := c.PublishWith("/foo", nil); err != ErrRateLimited {
+		t.Error("unexpected error =", err)
+	}
+
+	c.Publish(&PublishPacket{TopicName: "/bar"})
+	if m := <-c.msgCh; m.what != pubMsg || m.msg != "/bar" || m.err != ErrRateLimited {
+		t.Error("rate limited publish not notified, msg =", m)
+	}
+
+	// blocking until allowed
+	c.pubLimitPolicy = RateLimitBlock
+	c.SetPublishRateLimit(20, 1)
+	go c.Publish(&PublishPacket{TopicName: "/foo"}, &PublishPacket{TopicName: "/foo"})
+	for i := 0; i < 2; i++ {
+		// blocked until the token refilled in 50ms
+		clk.BlockUntil(1)
+		select {
+		case <-c.sendCh:
+			t.Fatal("publish not blocked by rate limit")
+		default:
+		}
+
+		clk.Advance(50 * time.Millisecond)
+		select {
+		case <-c.sendCh:
+		case <-time.After(5 * time.Second):
+			t.Fatal("publish not sent")
+		}
+	}
+
+	// the first blocking publish may not be delayed
+	if stats := c.Stats(); stats.RateLimitedMessages < 3 {
+		t.Error("unexpected rate limited messages =", stats.RateLimitedMessages)
+	}
+
+	// waiting publish returns once stopped
+	c.SetPublishRateLimit(0.001, 1)
+	done := make(chan struct{})
+	go func() {
+		c.Publish(&PublishPacket{TopicName: "/foo"})
+		close(done)
+	}()
+
+	clk.BlockUntil(1)
+	c.exit()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("publish blocked after stopped")
+	}
+}
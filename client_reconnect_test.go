@@ -0,0 +1,303 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/goiiot/libmqtt/internal/testutil"
+)
+
+func TestClient_ConnAckError(t *testing.T) {
+	for _, c := range []struct {
+		code    byte
+		err     error
+		retried bool
+	}{
+		{code: CodeBadUsernameOrPassword, err: ErrConnBadAuth, retried: false},
+		{code: CodeServerUnavailable, err: ErrConnServerUnavailable, retried: true},
+	} {
+		c := c
+		var (
+			dialed  int32
+			results = make(chan error, 10)
+			broker  = scriptBroker(V311, func(s *fakeSession) {
+				s.write(&ConnAckPacket{Code: c.code})
+			})
+		)
+		client, err := NewClient(
+			WithAutoReconnect(true),
+			WithBackoffStrategy(time.Millisecond, time.Millisecond, 1),
+			WithCustomConnector(func(ctx context.Context, address string, timeout time.Duration, tlsConfig *tls.Config) (net.Conn, error) {
+				atomic.AddInt32(&dialed, 1)
+				return broker(ctx, address, timeout, tlsConfig)
+			}),
+			WithConnHandleFunc(func(client Client, server string, code byte, err error) {
+				if code != c.code {
+					t.Error("unexpected code =", code)
+				}
+				select {
+				case results <- err:
+				default:
+				}
+			}),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := client.ConnectServer("fake"); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case err := <-results:
+			if err != c.err {
+				t.Error("unexpected error =", err, "expected =", c.err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("connect timeout")
+		}
+
+		time.Sleep(50 * time.Millisecond)
+		if retried := atomic.LoadInt32(&dialed) > 1; retried != c.retried {
+			t.Error("unexpected reconnect, code =", c.code, "dialed =", atomic.LoadInt32(&dialed))
+		}
+		client.Destroy(true)
+	}
+}
+
+func TestClient_ReconnectBackoff(t *testing.T) {
+	clk := testutil.NewFakeClock(time.Now())
+	dials := make(chan struct{}, 10)
+	client, err := NewClient(
+		WithClock(clk),
+		WithAutoReconnect(true),
+		WithBackoffStrategy(time.Second, 4*time.Second, 2),
+		WithCustomConnector(func(ctx context.Context, address string, timeout time.Duration, tlsConfig *tls.Config) (net.Conn, error) {
+			dials <- struct{}{}
+			return nil, errors.New("refused")
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Destroy(true)
+
+	if err := client.ConnectServer("fake"); err != nil {
+		t.Fatal(err)
+	}
+	<-dials
+
+	reconnecting := func() time.Duration {
+		for ev := range client.Events() {
+			if e, ok := ev.(*ReconnectingEvent); ok {
+				return e.Delay
+			}
+		}
+		return 0
+	}
+
+	for i, delay := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second} {
+		if d := reconnecting(); d != delay {
+			t.Fatalf("attempt %d: unexpected delay = %v, want %v", i, d, delay)
+		}
+
+		// reconnect timer
+		clk.BlockUntil(1)
+		clk.Advance(delay - time.Millisecond)
+		select {
+		case <-dials:
+			t.Fatalf("attempt %d: reconnected before delay", i)
+		default:
+		}
+
+		clk.Advance(time.Millisecond)
+		<-dials
+	}
+}
+
+func TestClient_ReconnectStopped(t *testing.T) {
+	for _, c := range []struct {
+		code    byte
+		err     error
+		options []Option
+	}{
+		{code: CodeBadUsernameOrPassword, err: ErrConnBadAuth},
+		{code: CodeServerUnavailable, err: ErrConnServerUnavailable, options: []Option{WithNonRetryableConnCodes(CodeServerUnavailable)}},
+	} {
+		c := c
+		var (
+			dialed    int32
+			connected = make(chan struct{})
+			stopped   = make(chan error, 10)
+			broker    = scriptBroker(V311, func(s *fakeSession) {
+				ack := &ConnAckPacket{Code: c.code}
+				if string(s.connect.Password) == "right" {
+					ack.Code = CodeSuccess
+				}
+				s.write(ack)
+				s.discard()
+			})
+		)
+		client, err := NewClient(append([]Option{
+			WithIdentity("user", "wrong"),
+			WithAutoReconnect(true),
+			WithBackoffStrategy(time.Millisecond, time.Millisecond, 1),
+			WithCustomConnector(func(ctx context.Context, address string, timeout time.Duration, tlsConfig *tls.Config) (net.Conn, error) {
+				atomic.AddInt32(&dialed, 1)
+				return broker(ctx, address, timeout, tlsConfig)
+			}),
+			WithConnHandleFunc(func(client Client, server string, code byte, err error) {
+				if code == CodeSuccess {
+					close(connected)
+				}
+			}),
+			WithNetHandleFunc(func(client Client, server string, err error) {
+				if _, ok := err.(*ReconnectStoppedError); ok {
+					stopped <- err
+				}
+			}),
+		}, c.options...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := client.ConnectServer("fake"); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case err := <-stopped:
+			if err.(*ReconnectStoppedError).Code != c.code || !errors.Is(err, c.err) {
+				t.Error("unexpected reconnect stopped error =", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("reconnect not stopped, code =", c.code)
+		}
+
+		time.Sleep(50 * time.Millisecond)
+		if n := atomic.LoadInt32(&dialed); n != 1 {
+			t.Error("reconnected after stopped, dialed =", n)
+		}
+
+		if err := client.Reconnect(WithIdentity("user", "right")); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case <-connected:
+		case <-time.After(5 * time.Second):
+			t.Fatal("not reconnected, code =", c.code)
+		}
+		client.Destroy(true)
+	}
+}
+
+func TestClient_ReconnectOptionError(t *testing.T) {
+	c := defaultClient()
+	c.stopConnect("foo", defaultConnectOptions())
+	c.stopConnect("bar", defaultConnectOptions())
+
+	errOption := errors.New("bad option")
+	if err := c.Reconnect(func(*AsyncClient, *connectOptions) error { return errOption }); err != errOption {
+		t.Error("unexpected reconnect error =", err)
+	}
+
+	if len(c.stopped) != 2 {
+		t.Error("stopped servers lost on option error, stopped =", len(c.stopped))
+	}
+
+	if err := c.Reconnect(WithCustomConnector(func(context.Context, string, time.Duration, *tls.Config) (net.Conn, error) {
+		return nil, errOption
+	})); err != nil {
+		t.Error(err)
+	}
+	if len(c.stopped) != 0 {
+		t.Error("stopped servers not reconnected, stopped =", len(c.stopped))
+	}
+	c.Destroy(true)
+}
+
+func TestClient_CredentialsProvider(t *testing.T) {
+	var (
+		calls     int32
+		passwords = make(chan string, 10)
+		results   = make(chan error, 10)
+		errToken  = errors.New("token unavailable")
+	)
+	client, err := NewClient(
+		WithIdentity("user", "static"),
+		WithAutoReconnect(true),
+		WithBackoffStrategy(time.Millisecond, time.Millisecond, 1),
+		WithCredentialsProvider(func(ctx context.Context, server string) (string, []byte, error) {
+			n := atomic.AddInt32(&calls, 1)
+			if server != "fake" {
+				t.Error("unexpected server =", server)
+			}
+			if n == 1 {
+				return "", nil, errToken
+			}
+			return "jwt", []byte{'t', byte(n), 0}, nil
+		}),
+		WithCustomConnector(scriptBroker(V311, func(s *fakeSession) {
+			passwords <- s.connect.Username + ":" + string(s.connect.Password)
+
+			// token of the second call expired
+			ack := &ConnAckPacket{Code: CodeServerUnavailable}
+			if s.connect.Password[1] == 3 {
+				ack.Code = CodeSuccess
+			}
+			s.write(ack)
+			s.discard()
+		})),
+		WithConnHandleFunc(func(client Client, server string, code byte, err error) {
+			results <- err
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Destroy(true)
+
+	if err := client.ConnectServer("fake"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []error{errToken, ErrConnServerUnavailable, nil} {
+		select {
+		case err := <-results:
+			if err != expected {
+				t.Error("unexpected connect result =", err, "expected =", expected)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("connect timeout")
+		}
+	}
+
+	for _, expected := range []string{"jwt:t\x02\x00", "jwt:t\x03\x00"} {
+		if p := <-passwords; p != expected {
+			t.Errorf("unexpected credentials = %q", p)
+		}
+	}
+}
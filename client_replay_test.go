@@ -0,0 +1,230 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClient_ReplayOrder(t *testing.T) {
+	ns := persistNamespace("cid", "fake")
+	persist := NewMemPersist(nil)
+	pub := func(id uint16, msg string) *PublishPacket {
+		return &PublishPacket{TopicName: "/foo", Qos: Qos1, PacketID: id, Payload: []byte(msg)}
+	}
+
+	// persisted by previous process, sequence wrapped after id 7
+	for key, pkt := range map[string]Packet{
+		sendKey(ns, 3): pub(3, "0"),
+		sequencedSendKey(ns, 7, math.MaxUint64-1):                 pub(7, "1"),
+		sequencedSendKey(ns, 8, 1):                                pub(8, "2"),
+		sequencedSendKey(ns, 2, 50):                               pub(2, "stale"),
+		sequencedSendKey(ns, 5, 100):                              pub(5, "3"),
+		sequencedSendKey(ns, 2, 200):                              pub(2, "4"),
+		sequencedSendKey(ns, 9, 300):                              &PubRelPacket{PacketID: 9},
+		sequencedSendKey(persistNamespace("other", "fake"), 1, 1): pub(1, "other"),
+	} {
+		if err := persist.Store(key, pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	received := make(chan Packet, 100)
+	client, err := NewClient(
+		WithPersist(persist),
+		WithClientID("cid"),
+		WithDialTimeout(10),
+		WithKeepalive(10, 1.2),
+		WithCustomConnector(scriptBroker(V311, func(s *fakeSession) {
+			// nothing acked, packets replayed are kept
+			s.write(&ConnAckPacket{Present: true})
+			for {
+				pkt, err := s.read()
+				if err != nil {
+					return
+				}
+				received <- pkt
+			}
+		})),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Destroy(true)
+
+	// published before connected, sent after replayed packets
+	go client.Publish(pub(0, "6"))
+	if err := client.ConnectServer("fake"); err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []uint16
+	for i := 0; i < 7; i++ {
+		select {
+		case pkt := <-received:
+			switch p := pkt.(type) {
+			case *PublishPacket:
+				if string(p.Payload) != strconv.Itoa(i) {
+					t.Error("unexpected publish order, index =", i, "payload =", string(p.Payload))
+				}
+				if i < 6 && !p.IsDup {
+					t.Error("replayed publish without dup flag, id =", p.PacketID)
+				}
+				ids = append(ids, p.PacketID)
+			case *PubRelPacket:
+				if i != 5 {
+					t.Error("unexpected PubRel order, index =", i)
+				}
+				ids = append(ids, p.PacketID)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("replay timeout, received =", ids)
+		}
+	}
+
+	if expected := []uint16{3, 7, 8, 5, 2, 9}; len(ids) != 7 || fmt.Sprint(ids[:6]) != fmt.Sprint(expected) {
+		t.Fatal("unexpected replayed packet ids =", ids)
+	}
+	for _, id := range []uint16{3, 7, 8, 5, 2, 9} {
+		if ids[6] == id {
+			t.Error("packet id reused =", id)
+		}
+	}
+
+	if _, ok := persist.Load(sequencedSendKey(ns, 2, 50)); ok {
+		t.Error("stale packet not deleted")
+	}
+
+	// new packet persisted after replayed packets
+	var newKey string
+	persist.Range(func(key string, p Packet) bool {
+		if _, _, _, id, _ := parseKey(key); id == ids[6] && strings.HasPrefix(key, ns) {
+			newKey = key
+		}
+		return true
+	})
+	if seq, ok := keySeq(newKey); !ok || !seqBefore(300, seq) {
+		t.Error("unexpected key of new packet =", newKey)
+	}
+}
+
+func TestClient_SessionPresent(t *testing.T) {
+	for _, present := range []bool{true, false} {
+		t.Run(fmt.Sprint("present=", present), func(t *testing.T) {
+			testSessionPresent(t, present)
+		})
+	}
+}
+
+func testSessionPresent(t *testing.T, present bool) {
+	ns := persistNamespace("cid", "fake")
+	persist := NewMemPersist(nil)
+	for key, pkt := range map[string]Packet{
+		sequencedSendKey(ns, 3, 1): &PublishPacket{TopicName: "/foo", Qos: Qos1, PacketID: 3, Payload: []byte("foo")},
+		sequencedSendKey(ns, 9, 2): &PubRelPacket{PacketID: 9},
+	} {
+		if err := persist.Store(key, pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	received := make(chan Packet, 100)
+	client, err := NewClient(
+		WithPersist(persist),
+		WithClientID("cid"),
+		WithCleanSession(false),
+		WithDialTimeout(10),
+		WithKeepalive(10, 1.2),
+		WithAutoResubscribe(true),
+		WithCustomConnector(fakeConnector(fakeBrokerConfig{present: present, received: received})),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Destroy(true)
+
+	// acked by the server of the previous connection
+	client.addSubscriptions("fake", []*Topic{{Name: "/b"}, {Name: "/a"}}, []byte{Qos1, Qos0}, []byte{Qos1, Qos0}, 0)
+
+	if err := client.ConnectServer("fake"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case e := <-client.Events():
+		if e, ok := e.(*ConnectedEvent); !ok || e.Err != nil || e.SessionPresent != present {
+			t.Fatalf("unexpected event %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("connected event not received")
+	}
+
+	next := func() Packet {
+		select {
+		case pkt := <-received:
+			return pkt
+		case <-time.After(5 * time.Second):
+			t.Fatal("packet not received")
+			return nil
+		}
+	}
+
+	if present {
+		// resent with dup flag, no subscription sent
+		if p, ok := next().(*PublishPacket); !ok || p.PacketID != 3 || !p.IsDup {
+			t.Fatal("unexpected replayed publish =", p)
+		}
+		if p, ok := next().(*PubRelPacket); !ok || p.PacketID != 9 {
+			t.Fatal("unexpected replayed PubRel =", p)
+		}
+	} else {
+		s, ok := next().(*SubscribePacket)
+		if !ok || len(s.Topics) != 2 || s.Topics[0].Name != "/a" || s.Topics[0].Qos != Qos0 ||
+			s.Topics[1].Name != "/b" || s.Topics[1].Qos != Qos1 {
+			t.Fatal("unexpected resubscribe =", s)
+		}
+
+		// resent as new packet, the message released is published
+		if p, ok := next().(*PublishPacket); !ok || p.PacketID != 3 || p.IsDup {
+			t.Fatal("unexpected resent publish =", p)
+		}
+		if _, ok := loadSentPacket(persist, ns, 9); ok {
+			t.Error("PubRel of the session lost not deleted")
+		}
+		if client.idGen.used(9) {
+			t.Error("packet id of the released message not reclaimed")
+		}
+	}
+
+	// subscriptions kept by the server, or acked again
+	for start := time.Now(); len(client.Subscriptions()) != 2; time.Sleep(5 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("unexpected subscriptions =", client.Subscriptions())
+		}
+	}
+
+	// no other packets sent before new ones
+	client.Publish(&PublishPacket{TopicName: "/new"})
+	if p, ok := next().(*PublishPacket); !ok || p.TopicName != "/new" {
+		t.Error("unexpected packet =", p)
+	}
+}
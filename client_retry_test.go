@@ -0,0 +1,127 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClient_ConnectServerRetryInterval(t *testing.T) {
+	var (
+		connected = make(chan error, 1)
+		received  = make(chan Packet, 10)
+	)
+	client, err := NewClient(
+		WithDialTimeout(10),
+		// publish packets never acked
+		WithCustomConnector(fakeConnector(fakeBrokerConfig{received: received})),
+		WithConnHandleFunc(func(client Client, server string, code byte, err error) {
+			connected <- err
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Destroy(true)
+
+	if err := client.ConnectServer("fake", WithRetryInterval(20*time.Millisecond, 2)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-connected:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("connect timeout")
+	}
+
+	token := client.PublishAsync("/foo", []byte("bar"), PubQoS(Qos1))
+	select {
+	case <-token.Done():
+		if err := token.Error(); err != ErrRetryExceeded {
+			t.Error("unexpected publish error =", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("retry options of ConnectServer not applied")
+	}
+
+	// sent once and resent max retries times
+	var dups []bool
+	for len(received) > 0 {
+		if p, ok := (<-received).(*PublishPacket); ok {
+			dups = append(dups, p.IsDup)
+		}
+	}
+	if len(dups) != 3 || dups[0] || !dups[1] || !dups[2] {
+		t.Error("unexpected publish packets, dup flags =", dups)
+	}
+}
+
+func TestClientConn_Retransmit(t *testing.T) {
+	c := defaultClient()
+	c.options.retryInterval = 20 * time.Millisecond
+	c.options.maxRetries = 2
+
+	stop := make(chan struct{})
+	defer close(stop)
+	conn := &clientConn{parent: c, options: &c.options, name: "test", logicSendC: make(chan Packet, 10), stopSig: stop}
+	go conn.retransmit()
+
+	pub := &PublishPacket{TopicName: "/foo", Qos: Qos1, PacketID: c.idGen.next(nil), Payload: []byte("bar")}
+	conn.trackInflight(pub.PacketID, pub, pub.TopicName)
+
+	for i := 0; i < 2; i++ {
+		select {
+		case pkt := <-conn.logicSendC:
+			dup, ok := pkt.(*PublishPacket)
+			if !ok || !dup.IsDup || dup.PacketID != pub.PacketID || string(dup.Payload) != "bar" {
+				t.Fatal("unexpected retransmitted packet =", pkt)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("packet not retransmitted")
+		}
+	}
+
+	if pub.IsDup {
+		t.Error("original packet modified")
+	}
+
+	select {
+	case m := <-c.msgCh:
+		if m.what != pubMsg || m.msg != "/foo" || m.err != ErrRetryExceeded {
+			t.Error("unexpected notification =", m)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("max retries not notified")
+	}
+
+	if c.idGen.used(pub.PacketID) {
+		t.Error("packet id not freed after max retries")
+	}
+
+	// acked packet must not be resent
+	rel := &PubRelPacket{PacketID: 2}
+	conn.trackInflight(rel.PacketID, rel, "/foo")
+	conn.untrackInflight(rel.PacketID)
+	select {
+	case pkt := <-conn.logicSendC:
+		t.Error("acked packet retransmitted =", pkt)
+	case <-time.After(80 * time.Millisecond):
+	}
+}
@@ -0,0 +1,121 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// ClientStats is the snapshot of client statistics
+type ClientStats struct {
+	// UnmatchedMessages is the count of received publish packets
+	// which matched no registered topic handler
+	UnmatchedMessages uint64
+
+	// DroppedMessages is the count of received publish packets
+	// dropped due to the recv buffer overflow
+	DroppedMessages uint64
+
+	// HandlerQueueDepth is the count of packets waiting in the queue of
+	// each handler worker (only available with WithHandlerConcurrency)
+	HandlerQueueDepth []int
+
+	// PublishRateTokens is the count of publishes allowed by the rate
+	// limit without waiting (see WithPublishRateLimit), negative if
+	// publishes are waiting, 0 if not limited
+	PublishRateTokens float64
+
+	// RateLimitedMessages is the count of publishes delayed or rejected
+	// by the rate limit
+	RateLimitedMessages uint64
+
+	// DroppedPublishes is the count of QoS0 publishes dropped due to the
+	// send buffer overflow (see WithQoS0DropWhenFull)
+	DroppedPublishes uint64
+
+	// ExpiredPublishes and CanceledPublishes are the count of queued
+	// publishes discarded before sent (see PubDeadline and PubContext)
+	ExpiredPublishes  uint64
+	CanceledPublishes uint64
+
+	// PingRTT is the round-trip time of the most recent PingReq (sent for
+	// keepalive or by Ping), 0 if no PingResp received
+	PingRTT time.Duration
+
+	// BytesSent and BytesReceived are the bytes of all connections in the
+	// client lifetime (including reconnects), MQTT packets with protocol
+	// overhead are counted under connection wrappers (see WithConnWrapper)
+	BytesSent     uint64
+	BytesReceived uint64
+
+	// DroppedEvents is the count of events dropped due to the event buffer
+	// overflow (see Client.Events)
+	DroppedEvents uint64
+
+	// InboundTopicAliases is the count of topic aliases mapped by servers
+	// of current connections (see WithInboundTopicAliasMax)
+	InboundTopicAliases int
+}
+
+// clientStats holds the counters of the client, all fields
+// MUST be accessed atomically
+type clientStats struct {
+	unmatchedMsgs uint64
+	droppedMsgs   uint64
+	droppedPubs   uint64
+	expiredPubs   uint64
+	canceledPubs  uint64
+	pingRTT       int64 // time.Duration
+	bytesSent     uint64
+	bytesRecv     uint64
+	droppedEvents uint64
+}
+
+// Stats returns the snapshot of client statistics
+func (c *AsyncClient) Stats() ClientStats {
+	stats := ClientStats{
+		UnmatchedMessages: atomic.LoadUint64(&c.stats.unmatchedMsgs),
+		DroppedMessages:   atomic.LoadUint64(&c.stats.droppedMsgs),
+		DroppedPublishes:  atomic.LoadUint64(&c.stats.droppedPubs),
+		ExpiredPublishes:  atomic.LoadUint64(&c.stats.expiredPubs),
+		CanceledPublishes: atomic.LoadUint64(&c.stats.canceledPubs),
+		PingRTT:           time.Duration(atomic.LoadInt64(&c.stats.pingRTT)),
+		BytesSent:         atomic.LoadUint64(&c.stats.bytesSent),
+		BytesReceived:     atomic.LoadUint64(&c.stats.bytesRecv),
+		DroppedEvents:     atomic.LoadUint64(&c.stats.droppedEvents),
+	}
+
+	stats.PublishRateTokens, stats.RateLimitedMessages = c.pubLimit.stats(c.clock.Now())
+	for _, q := range c.handlerQueues {
+		stats.HandlerQueueDepth = append(stats.HandlerQueueDepth, len(q))
+	}
+	c.connectedServers.Range(func(key, value interface{}) bool {
+		stats.InboundTopicAliases += int(atomic.LoadInt32(&value.(*clientConn).inAliasCount))
+		return true
+	})
+	return stats
+}
+
+// countDiscarded counts the queued publish discarded with the error
+func (c *AsyncClient) countDiscarded(err error) {
+	if err == ErrPublishExpired {
+		atomic.AddUint64(&c.stats.expiredPubs, 1)
+	} else {
+		atomic.AddUint64(&c.stats.canceledPubs, 1)
+	}
+}
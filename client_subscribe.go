@@ -0,0 +1,188 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"sort"
+	"sync"
+)
+
+// subBatch aggregates results of chunks of the subscribe split by the
+// maximum packet size, notified once all chunks acked or rejected
+type subBatch struct {
+	mu      sync.Mutex
+	topics  []*Topic // all topics in the order requested
+	pending int      // chunks not acked or rejected
+	err     error    // the first error of chunks rejected
+}
+
+// done records the result of the chunk, returns true if all chunks done
+func (b *subBatch) done(err error) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err != nil && b.err == nil {
+		b.err = err
+	}
+	b.pending--
+	return b.pending == 0, b.err
+}
+
+// maxPacketSize returns the maximum size of packets accepted by the server
+func (c *clientConn) maxPacketSize() int {
+	if c.protoVersion == V5 {
+		if props := c.getConnAckProps(); props != nil && props.MaxPacketSize > 0 {
+			return int(props.MaxPacketSize)
+		}
+	}
+
+	// fixed header with the maximum remaining length
+	return 1 + 4 + maxMsgSize
+}
+
+// splitSubscribe splits the subscribe into chunks not exceeding the maximum
+// packet size of the server, the subscribe is returned as is if not split,
+// ErrPacketTooLarge returned if a topic can not be sent in any chunk
+func (c *clientConn) splitSubscribe(s *SubscribePacket) ([]*SubscribePacket, error) {
+	// packet id + properties (MQTT 5)
+	header := 2
+	if c.protoVersion == V5 {
+		props, err := s.Props.props()
+		if err != nil {
+			return nil, err
+		}
+		header += varIntSize(len(props)) + len(props)
+	}
+
+	limit := c.maxPacketSize()
+	fits := func(remaining int) bool {
+		return remaining <= maxMsgSize && 1+varIntSize(remaining)+remaining <= limit
+	}
+
+	if fits(header + s.payloadSize()) {
+		return []*SubscribePacket{s}, nil
+	}
+
+	var (
+		chunks []*SubscribePacket
+		start  = 0
+		size   = header
+	)
+	for i, t := range s.Topics {
+		topicSize := 2 + len(t.Name) + 1
+		if !fits(header + topicSize) {
+			return nil, ErrPacketTooLarge
+		}
+
+		if !fits(size + topicSize) {
+			chunks = append(chunks, &SubscribePacket{Topics: s.Topics[start:i], Props: s.Props})
+			start, size = i, header
+		}
+		size += topicSize
+	}
+	chunks = append(chunks, &SubscribePacket{Topics: s.Topics[start:], Props: s.Props})
+
+	batch := &subBatch{topics: s.Topics, pending: len(chunks)}
+	for i, chunk := range chunks {
+		chunk.batch = batch
+		if i == 0 {
+			// the packet id of the subscribe is used by the first chunk
+			chunk.PacketID = s.PacketID
+			c.parent.idGen.setExtra(s.PacketID, chunk)
+		} else {
+			chunk.PacketID = c.parent.idGen.next(chunk)
+		}
+	}
+
+	c.parent.log.d("NET subscribe split, server =", c.name, "topics =", len(s.Topics), "chunks =", len(chunks))
+	return chunks, nil
+}
+
+// resubscribe sends the subscriptions of the session not present on the
+// server again before any packet published, subscriptions with the same
+// subscription identifier are sent in one subscribe (split if too large)
+func (c *clientConn) resubscribe(subs []*subscription) {
+	sort.Slice(subs, func(i, j int) bool { return subs[i].topic < subs[j].topic })
+
+	var (
+		subIDs []int
+		topics = make(map[int][]*Topic)
+	)
+	for _, s := range subs {
+		subID, options := s.subID, s.options
+		if c.protoVersion < V5 {
+			subID, options = 0, options&subOptionsQos
+		} else if !c.subIDAvail() {
+			subID = 0
+		}
+
+		if _, ok := topics[subID]; !ok {
+			subIDs = append(subIDs, subID)
+		}
+		topics[subID] = append(topics[subID], &Topic{Name: s.topic, Qos: options})
+	}
+
+	for _, subID := range subIDs {
+		s := &SubscribePacket{Topics: topics[subID]}
+		if subID != 0 {
+			s.Props = &SubscribeProps{SubID: subID}
+		}
+		s.PacketID = c.parent.idGen.next(s)
+
+		chunks, err := c.splitSubscribe(s)
+		if err != nil {
+			c.parent.idGen.reclaim(s.PacketID)
+			notifySubMsg(c.parent.msgCh, s.Topics, err)
+			continue
+		}
+
+		for _, chunk := range chunks {
+			c.replayed = append(c.replayed, chunk)
+		}
+		c.parent.log.d("NET resubscribe, server =", c.name, "topic(s) =", s.Topics)
+	}
+}
+
+// subscribed notifies the result of the subscribe, results of chunks are
+// notified once all chunks done with all topics in the order requested
+// (topics of chunks rejected with the granted QoS SubFail)
+func (c *clientConn) subscribed(s *SubscribePacket, err error) {
+	if s.batch == nil {
+		notifySubMsg(c.parent.msgCh, s.Topics, err)
+		return
+	}
+
+	if err != nil {
+		for _, t := range s.Topics {
+			t.Qos = SubFail
+		}
+	}
+
+	if done, err := s.batch.done(err); done {
+		notifySubMsg(c.parent.msgCh, s.batch.topics, err)
+	}
+}
+
+// varIntSize returns the size of n encoded as variable byte integer
+func varIntSize(n int) int {
+	size := 1
+	for n >= 128 {
+		n /= 128
+		size++
+	}
+	return size
+}
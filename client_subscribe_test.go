@@ -0,0 +1,408 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func numberedTopics(n int) []*Topic {
+	topics := make([]*Topic, n)
+	for i := range topics {
+		topics[i] = &Topic{Name: fmt.Sprintf("topic/%03d", i), Qos: Qos1}
+	}
+	return topics
+}
+
+func TestClientConn_SplitSubscribe(t *testing.T) {
+	c := defaultClient()
+	conn := &clientConn{parent: c, name: "test", protoVersion: V5}
+
+	// size of the subscribe with 2 topics as the limit
+	two := &SubscribePacket{PacketID: 1, Topics: numberedTopics(2), Props: &SubscribeProps{SubID: 1}}
+	two.SetVersion(V5)
+	limit := len(two.Bytes())
+
+	s := &SubscribePacket{Topics: numberedTopics(5), Props: &SubscribeProps{SubID: 1}}
+	s.PacketID = c.idGen.next(s)
+
+	// not split without the maximum packet size
+	if chunks, err := conn.splitSubscribe(s); err != nil || len(chunks) != 1 || chunks[0] != s {
+		t.Fatal("subscribe split without the maximum packet size")
+	}
+
+	conn.setConnAckProps(&ConnAckProps{MaxPacketSize: uint32(limit)})
+	chunks, err := conn.splitSubscribe(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 3 {
+		t.Fatal("unexpected chunks =", len(chunks))
+	}
+
+	var topics []*Topic
+	ids := make(map[uint16]bool)
+	for i, chunk := range chunks {
+		chunk.SetVersion(V5)
+		if size := len(chunk.Bytes()); size > limit {
+			t.Errorf("chunk %d size %d exceeds %d", i, size, limit)
+		}
+		if chunk.batch == nil || chunk.Props.SubID != 1 || ids[chunk.PacketID] {
+			t.Errorf("unexpected chunk %d = %+v", i, chunk)
+		}
+		if extra, _ := c.idGen.getExtra(chunk.PacketID); extra != chunk {
+			t.Errorf("packet id of chunk %d not bound", i)
+		}
+		ids[chunk.PacketID] = true
+		topics = append(topics, chunk.Topics...)
+	}
+	if chunks[0].PacketID != s.PacketID || len(chunks[0].Topics) != 2 || len(chunks[2].Topics) != 1 {
+		t.Error("unexpected chunk boundary")
+	}
+	for i, topic := range topics {
+		if topic != s.Topics[i] {
+			t.Error("topics not in the order requested")
+		}
+	}
+
+	// one byte less than 2 topics
+	conn.setConnAckProps(&ConnAckProps{MaxPacketSize: uint32(limit - 1)})
+	if chunks, _ := conn.splitSubscribe(&SubscribePacket{Topics: numberedTopics(2), Props: s.Props}); len(chunks) != 2 {
+		t.Error("unexpected chunks below the boundary =", len(chunks))
+	}
+
+	// topic not fit in any chunk
+	tooLong := &SubscribePacket{Topics: []*Topic{{Name: strings.Repeat("a", limit)}}}
+	if _, err := conn.splitSubscribe(tooLong); err != ErrPacketTooLarge {
+		t.Error("unexpected error of topic too long =", err)
+	}
+}
+
+// subscribeBroker acks subscribes with the QoS requested, or SubFail for
+// topics starting with "deny"
+func subscribeBroker(conn net.Conn, maxPacketSize uint32, subscribes chan<- *SubscribePacket) {
+	defer func() { _ = conn.Close() }()
+
+	r, w := bufio.NewReader(conn), bufio.NewWriter(conn)
+	send := func(pkt Packet) {
+		pkt.SetVersion(V5)
+		_ = pkt.WriteTo(w)
+		_ = w.Flush()
+	}
+
+	if _, err := Decode(V5, r); err != nil {
+		return
+	}
+	send(&ConnAckPacket{Props: &ConnAckProps{MaxQos: Qos2, MaxPacketSize: maxPacketSize}})
+
+	for {
+		pkt, err := Decode(V5, r)
+		if err != nil {
+			return
+		}
+
+		s, ok := pkt.(*SubscribePacket)
+		if !ok {
+			continue
+		}
+		subscribes <- s
+
+		codes := make([]byte, len(s.Topics))
+		for i, t := range s.Topics {
+			codes[i] = t.Qos & subOptionsQos
+			if strings.HasPrefix(t.Name, "deny") {
+				codes[i] = SubFail
+			}
+		}
+		send(&SubAckPacket{PacketID: s.PacketID, Codes: codes})
+	}
+}
+
+func TestClient_SubscribeChunked(t *testing.T) {
+	var (
+		subscribes = make(chan *SubscribePacket, 10)
+		connected  = make(chan struct{}, 1)
+		results    = make(chan []*Topic, 2)
+		resultErrs = make(chan error, 2)
+		mu         sync.Mutex
+		intercept  string
+	)
+
+	limit := &SubscribePacket{PacketID: 1, Topics: numberedTopics(2)}
+	limit.SetVersion(V5)
+
+	client, err := NewClient(
+		WithVersion(V5, false),
+		WithCustomConnector(func(ctx context.Context, address string, timeout time.Duration, tlsConfig *tls.Config) (net.Conn, error) {
+			client, server := net.Pipe()
+			go subscribeBroker(server, uint32(len(limit.Bytes())), subscribes)
+			return client, nil
+		}),
+		WithSendInterceptor(func(server string, pkt Packet) Packet {
+			mu.Lock()
+			defer mu.Unlock()
+			if s, ok := pkt.(*SubscribePacket); ok && intercept != "" && s.Topics[0].Name == intercept {
+				return nil
+			}
+			return pkt
+		}),
+		WithConnHandleFunc(func(client Client, server string, code byte, err error) {
+			if code == CodeSuccess {
+				connected <- struct{}{}
+			}
+		}),
+		WithSubHandleFunc(func(client Client, topics []*Topic, err error) {
+			results <- topics
+			resultErrs <- err
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Destroy(true)
+
+	if err := client.ConnectServer("fake"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not connected")
+	}
+
+	wait := func() ([]*Topic, error) {
+		select {
+		case topics := <-results:
+			return topics, <-resultErrs
+		case <-time.After(5 * time.Second):
+			t.Fatal("subscribe result not notified")
+			return nil, nil
+		}
+	}
+
+	// granted and failed topics aggregated in the order requested
+	topics := numberedTopics(5)
+	topics[1].Name, topics[3].Name, topics[4].Qos = "deny/1", "deny/3", Qos2
+	client.Subscribe(topics...)
+
+	result, err := wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{Qos1, SubFail, Qos1, SubFail, Qos2}
+	if len(result) != len(topics) {
+		t.Fatal("unexpected topics notified =", result)
+	}
+	for i, topic := range result {
+		if topic.Name != topics[i].Name || topic.Qos != want[i] {
+			t.Errorf("unexpected topic %d = %s (%d)", i, topic.Name, topic.Qos)
+		}
+	}
+	if topics[1].Qos != Qos1 {
+		t.Error("topics of the caller modified")
+	}
+	if n := len(subscribes); n != 3 {
+		t.Error("unexpected subscribe packets sent =", n)
+	}
+	for len(subscribes) > 0 {
+		<-subscribes
+	}
+
+	select {
+	case <-results:
+		t.Fatal("subscribe result notified more than once")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// chunk rejected
+	mu.Lock()
+	intercept = "topic/002"
+	mu.Unlock()
+	client.Subscribe(numberedTopics(4)...)
+
+	result, err = wait()
+	if err != ErrPacketIntercepted {
+		t.Error("unexpected error of chunk rejected =", err)
+	}
+	want = []byte{Qos1, Qos1, SubFail, SubFail}
+	for i, topic := range result {
+		if topic.Qos != want[i] {
+			t.Errorf("unexpected topic %d = %s (%d)", i, topic.Name, topic.Qos)
+		}
+	}
+	if n := len(subscribes); n != 1 {
+		t.Error("unexpected subscribe packets sent =", n)
+	}
+
+	// topics granted (topic/000, topic/002 and topic/004 subscribed before)
+	if subs := client.Subscriptions(); len(subs) != 4 {
+		t.Error("unexpected subscriptions =", subs)
+	}
+}
+
+func TestClient_SubAckCodesMismatch(t *testing.T) {
+	for _, version := range []ProtoVersion{V5, V311} {
+		for _, extra := range []int{-1, 1} {
+			var (
+				subs  = make(chan error, 1)
+				discs = make(chan *DisconnPacket, 1)
+			)
+			client, err := NewClient(
+				WithVersion(version, false),
+				WithCustomConnector(func(ctx context.Context, address string, timeout time.Duration, tlsConfig *tls.Config) (net.Conn, error) {
+					client, server := net.Pipe()
+					go func() {
+						defer func() { _ = server.Close() }()
+
+						r, w := bufio.NewReader(server), bufio.NewWriter(server)
+						send := func(pkt Packet) {
+							pkt.SetVersion(version)
+							_ = pkt.WriteTo(w)
+							_ = w.Flush()
+						}
+
+						if _, err := Decode(version, r); err != nil {
+							return
+						}
+						send(&ConnAckPacket{})
+
+						for {
+							pkt, err := Decode(version, r)
+							if err != nil {
+								return
+							}
+
+							switch p := pkt.(type) {
+							case *SubscribePacket:
+								// codes not matching topics subscribed
+								send(&SubAckPacket{PacketID: p.PacketID, Codes: make([]byte, len(p.Topics)+extra)})
+							case *DisconnPacket:
+								discs <- p
+								return
+							}
+						}
+					}()
+					return client, nil
+				}),
+				WithSubHandleFunc(func(client Client, topics []*Topic, err error) {
+					subs <- err
+				}),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := client.ConnectServer("fake"); err != nil {
+				t.Fatal(err)
+			}
+			client.Subscribe(numberedTopics(2)...)
+
+			select {
+			case err := <-subs:
+				if e, ok := err.(*MalformedPacketError); !ok || e.Code != CodeProtoError {
+					t.Errorf("version %d, extra %d: unexpected error = %v", version, extra, err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("version %d, extra %d: subscribe not failed", version, extra)
+			}
+
+			if subs := client.Subscriptions(); len(subs) != 0 {
+				t.Errorf("version %d, extra %d: unexpected subscriptions = %v", version, extra, subs)
+			}
+
+			if version == V5 {
+				select {
+				case p := <-discs:
+					if p.Code != CodeProtoError {
+						t.Errorf("extra %d: unexpected disconnect code = %d", extra, p.Code)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatalf("extra %d: not disconnected", extra)
+				}
+			}
+
+			client.Destroy(true)
+		}
+	}
+}
+
+func TestClient_Subscriptions(t *testing.T) {
+	client, err := NewClient(
+		WithDialTimeout(10),
+		WithKeepalive(10, 1.2),
+		WithCustomConnector(fakeConnector(fakeBrokerConfig{ackPub: false})),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Destroy(true)
+
+	if err := client.ConnectServer("fake"); err != nil {
+		t.Fatal(err)
+	}
+
+	waitSubs := func(n int) []SubscriptionInfo {
+		var subs []SubscriptionInfo
+		for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(5 * time.Millisecond) {
+			if subs = client.Subscriptions(); len(subs) == n {
+				break
+			}
+		}
+		return subs
+	}
+
+	client.Subscribe(&Topic{Name: "/foo", Qos: Qos1}, &Topic{Name: "/bar/#", Qos: Qos2})
+	subs := waitSubs(2)
+	expected := []SubscriptionInfo{
+		{Server: "fake", Topic: "/bar/#", Qos: Qos2, GrantedQos: Qos2},
+		{Server: "fake", Topic: "/foo", Qos: Qos1, GrantedQos: Qos1},
+	}
+	if !reflect.DeepEqual(expected, subs) {
+		t.Error("unexpected subscriptions =", subs)
+	}
+
+	client.UnSubscribe("/foo")
+	subs = waitSubs(1)
+	if len(subs) != 1 || subs[0].Topic != "/bar/#" {
+		t.Error("unexpected subscriptions after unsubscribed =", subs)
+	}
+
+	// MQTT 5 subscription options
+	client.addSubscriptions("other", []*Topic{{Name: "/baz"}}, []byte{Qos1 | subOptionNoLocal | 2<<4}, []byte{SubOkMaxQos0}, 5)
+	subs = client.Subscriptions()
+	if len(subs) != 2 || !reflect.DeepEqual(subs[1], SubscriptionInfo{
+		Server: "other", Topic: "/baz", Qos: Qos1, GrantedQos: Qos0,
+		NoLocal: true, RetainHandling: 2, SubID: 5,
+	}) {
+		t.Error("unexpected subscription options =", subs)
+	}
+
+	// server resumed no session
+	client.resetSubscriptions("other")
+	if subs = client.Subscriptions(); len(subs) != 1 || subs[0].Server != "fake" {
+		t.Error("subscriptions not reset =", subs)
+	}
+}
@@ -0,0 +1,96 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import "sort"
+
+// MQTT 5 subscription options, combined with the QoS of the Topic to
+// subscribe (e.g. Qos1 | SubRetainHandlingNone), options are dropped when
+// subscribing with MQTT 3.1.1 or MQTT 3.1
+const (
+	// SubNoLocal doesn't deliver messages published by the client itself
+	SubNoLocal QosLevel = 0x04
+	// SubRetainAsPublished keeps the retain flag of messages delivered as
+	// published, otherwise only set for retained messages sent on subscribe
+	SubRetainAsPublished QosLevel = 0x08
+	// SubRetainHandlingNew sends retained messages only if the subscription
+	// does not exist
+	SubRetainHandlingNew QosLevel = 0x10
+	// SubRetainHandlingNone sends no retained messages on subscribe, e.g.
+	// to subscribe without receiving stale retained values
+	SubRetainHandlingNone QosLevel = 0x20
+)
+
+// subscription options encoded with the requested QoS
+const (
+	subOptionNoLocal           = SubNoLocal
+	subOptionRetainAsPublished = SubRetainAsPublished
+	subOptionRetainHandling    = 0x30
+	subOptionsQos              = 0x03
+)
+
+// SubscriptionInfo is the snapshot of a subscription acked by the server
+type SubscriptionInfo struct {
+	// Server the subscription applies to
+	Server string
+	// Topic filter subscribed
+	Topic string
+	// Qos requested in subscribe packet
+	Qos QosLevel
+	// GrantedQos in SubAck packet
+	GrantedQos QosLevel
+
+	// NoLocal subscription option (MQTT 5)
+	NoLocal bool
+	// RetainAsPublished subscription option (MQTT 5)
+	RetainAsPublished bool
+	// RetainHandling subscription option (MQTT 5)
+	RetainHandling byte
+
+	// SubID is the subscription identifier, 0 if not assigned or not
+	// available in the server
+	SubID int
+}
+
+// Subscriptions returns all subscriptions acked by servers, subscriptions
+// of the server are removed once unsubscribed or the server resumed no
+// session on reconnect, sorted by server and topic
+func (c *AsyncClient) Subscriptions() []SubscriptionInfo {
+	c.subsMu.RLock()
+	result := make([]SubscriptionInfo, 0, len(c.subs))
+	for _, sub := range c.subs {
+		result = append(result, SubscriptionInfo{
+			Server:            sub.server,
+			Topic:             sub.topic,
+			Qos:               sub.options & subOptionsQos,
+			GrantedQos:        sub.qos,
+			NoLocal:           sub.options&subOptionNoLocal != 0,
+			RetainAsPublished: sub.options&subOptionRetainAsPublished != 0,
+			RetainHandling:    (sub.options & subOptionRetainHandling) >> 4,
+			SubID:             sub.subID,
+		})
+	}
+	c.subsMu.RUnlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Server != result[j].Server {
+			return result[i].Server < result[j].Server
+		}
+		return result[i].Topic < result[j].Topic
+	})
+	return result
+}
@@ -0,0 +1,98 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"errors"
+	"time"
+)
+
+// errors of session takeover (see WithTakeoverHandler)
+var (
+	// ErrSessionTakenOver used when the server disconnected with
+	// CodeSessionTakenOver (MQTT 5)
+	ErrSessionTakenOver = errors.New("session taken over by another client ")
+
+	// ErrSessionTakeoverSuspected used when connections were closed shortly
+	// after connected too many times in a row (see WithTakeoverDetection),
+	// usually another client connected with the same client id
+	ErrSessionTakeoverSuspected = errors.New("session takeover suspected ")
+)
+
+// TakeoverHandleFunc is called when the session is taken over by another
+// client with the same client id, err is ErrSessionTakenOver or
+// ErrSessionTakeoverSuspected
+type TakeoverHandleFunc func(client Client, server string, err error)
+
+// WithTakeoverHandler set the handler called when the session is taken
+// over, the server closes the connection of the client connected before
+// (MQTT 5 servers disconnect with CodeSessionTakenOver), MQTT 3.1.1
+// takeovers are only detected with WithTakeoverDetection
+func WithTakeoverHandler(handler TakeoverHandleFunc) Option {
+	return func(c *AsyncClient, options *connectOptions) error {
+		options.takeoverHandler = handler
+		return nil
+	}
+}
+
+// WithTakeoverDetection suspects the session taken over when connections
+// were closed within the duration after connected in n times in a row,
+// n not positive disables the detection (default)
+func WithTakeoverDetection(n int, within time.Duration) Option {
+	return func(c *AsyncClient, options *connectOptions) error {
+		options.takeoverCloses = n
+		options.takeoverWithin = within
+		return nil
+	}
+}
+
+// WithTakeoverCooldown delays the reconnect for at least the cooldown once
+// the session taken over, so two clients with the same client id do not
+// take over the session from each other over and over again, 0 reconnects
+// with the backoff strategy (default)
+func WithTakeoverCooldown(cooldown time.Duration) Option {
+	return func(c *AsyncClient, options *connectOptions) error {
+		options.takeoverCooldown = cooldown
+		return nil
+	}
+}
+
+// detectTakeover returns the takeover error once the connection to the
+// server lost, nil if not taken over, disconn is the DisconnPacket sent by
+// the server, nil if not sent
+func (c connectOptions) detectTakeover(parent *AsyncClient, server string, disconn *DisconnPacket, connectedAt time.Time) error {
+	parent.takeoverMu.Lock()
+	defer parent.takeoverMu.Unlock()
+
+	if disconn != nil && disconn.Code == CodeSessionTakenOver {
+		delete(parent.shortConns, server)
+		return ErrSessionTakenOver
+	}
+
+	if c.takeoverCloses <= 0 || parent.clock.Now().Sub(connectedAt) >= c.takeoverWithin {
+		delete(parent.shortConns, server)
+		return nil
+	}
+
+	parent.shortConns[server]++
+	if parent.shortConns[server] < c.takeoverCloses {
+		return nil
+	}
+
+	delete(parent.shortConns, server)
+	return ErrSessionTakeoverSuspected
+}
@@ -0,0 +1,198 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// takeoverBroker accepts the connection and closes it at once, as the
+// session is taken over by another client, MQTT 5 connections are
+// disconnected with CodeSessionTakenOver
+func takeoverBroker(conn net.Conn, version ProtoVersion) {
+	defer func() { _ = conn.Close() }()
+
+	if _, err := Decode(version, bufio.NewReader(conn)); err != nil {
+		return
+	}
+
+	w := bufio.NewWriter(conn)
+	pkts := []Packet{&ConnAckPacket{}}
+	if version == V5 {
+		pkts = append(pkts, &DisconnPacket{Code: CodeSessionTakenOver})
+	}
+	for _, pkt := range pkts {
+		pkt.SetVersion(version)
+		_ = pkt.WriteTo(w)
+	}
+	_ = w.Flush()
+}
+
+func newTakeoverClient(t *testing.T, version ProtoVersion, dials *int32, takeovers chan<- error, options ...Option) Client {
+	client, err := NewClient(append([]Option{
+		WithVersion(version, false),
+		WithBackoffStrategy(time.Millisecond, time.Millisecond, 1),
+		WithCustomConnector(func(ctx context.Context, address string, timeout time.Duration, tlsConfig *tls.Config) (net.Conn, error) {
+			atomic.AddInt32(dials, 1)
+			client, server := net.Pipe()
+			go takeoverBroker(server, version)
+			return client, nil
+		}),
+		WithTakeoverHandler(func(client Client, server string, err error) {
+			select {
+			case takeovers <- err:
+			default:
+			}
+		}),
+		WithTakeoverCooldown(time.Hour),
+	}, options...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestClient_TakeoverV5(t *testing.T) {
+	var (
+		dials     int32
+		takeovers = make(chan error, 1)
+	)
+	client := newTakeoverClient(t, V5, &dials, takeovers)
+	defer client.Destroy(true)
+
+	if err := client.ConnectServer("fake"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-takeovers:
+		if err != ErrSessionTakenOver {
+			t.Error("unexpected takeover error =", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("takeover not detected")
+	}
+
+	// reconnect suppressed by the cooldown
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt32(&dials); n != 1 {
+		t.Error("reconnected during the cooldown, dials =", n)
+	}
+}
+
+func TestClient_TakeoverDetection(t *testing.T) {
+	var (
+		dials     int32
+		takeovers = make(chan error, 1)
+	)
+	client := newTakeoverClient(t, V311, &dials, takeovers, WithTakeoverDetection(3, time.Second))
+	defer client.Destroy(true)
+
+	if err := client.ConnectServer("fake"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-takeovers:
+		if err != ErrSessionTakeoverSuspected {
+			t.Error("unexpected takeover error =", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("takeover not detected")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt32(&dials); n != 3 {
+		t.Error("unexpected dials =", n)
+	}
+}
+
+func TestClient_TakeoverNotDetected(t *testing.T) {
+	var (
+		dials     int32
+		takeovers = make(chan error, 1)
+	)
+	// connections closed at once are not short connections
+	client := newTakeoverClient(t, V311, &dials, takeovers, WithTakeoverDetection(3, 0))
+	defer client.Destroy(true)
+
+	if err := client.ConnectServer("fake"); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&dials) < 10 {
+		if time.Now().After(deadline) {
+			t.Fatal("not reconnected, dials =", atomic.LoadInt32(&dials))
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	select {
+	case err := <-takeovers:
+		t.Error("unexpected takeover =", err)
+	default:
+	}
+}
+
+func TestConnectOptions_DetectTakeover(t *testing.T) {
+	parent := defaultClient()
+	options := defaultConnectOptions()
+	options.takeoverCloses = 2
+	options.takeoverWithin = time.Minute
+
+	short, long := time.Now(), time.Now().Add(-time.Hour)
+	for i, c := range []struct {
+		disconn     *DisconnPacket
+		connectedAt time.Time
+		err         error
+	}{
+		{nil, short, nil},
+		// reset by the long connection
+		{nil, long, nil},
+		{nil, short, nil},
+		{nil, short, ErrSessionTakeoverSuspected},
+		// reset once detected
+		{nil, short, nil},
+		{&DisconnPacket{Code: CodeSessionTakenOver}, long, ErrSessionTakenOver},
+		{&DisconnPacket{Code: CodeServerShuttingDown}, short, nil},
+		{nil, short, ErrSessionTakeoverSuspected},
+	} {
+		if err := options.detectTakeover(parent, "fake", c.disconn, c.connectedAt); err != c.err {
+			t.Errorf("#%d unexpected error = %v, expected %v", i, err, c.err)
+		}
+	}
+
+	// other servers are not affected
+	if err := options.detectTakeover(parent, "other", nil, short); err != nil {
+		t.Error("unexpected error of other server =", err)
+	}
+
+	// disabled
+	options.takeoverCloses = 0
+	for i := 0; i < 3; i++ {
+		if err := options.detectTakeover(parent, "fake", nil, short); err != nil {
+			t.Error("unexpected error with detection disabled =", err)
+		}
+	}
+}
@@ -22,9 +22,6 @@ import (
 	"go.uber.org/goleak"
 )
 
-// test with emqx server (http://emqtt.io/ or https://github.com/emqx/emqx)
-// the server is configured with default configuration
-
 func TestNewClient(t *testing.T) {
 	_, err := NewClient(
 		WithTLS("foo", "bar", "foobar", "foo.bar", true),
@@ -35,71 +32,3 @@ func TestNewClient(t *testing.T) {
 
 	goleak.VerifyNoLeaks(t)
 }
-
-func testAllClient(t *testing.T, handler *extraHandler) {
-	clients := allClients(t, handler)
-	for client, startTest := range clients {
-		startTest()
-		// time.Sleep(10 * time.Millisecond)
-		client.Wait()
-	}
-}
-
-// conn
-func TestClient_Connect(t *testing.T) {
-	testAllClient(t, &extraHandler{
-		afterConnSuccess: func(client Client) {
-			client.Destroy(false)
-		},
-	})
-
-	goleak.VerifyNoLeaks(t)
-}
-
-// conn -> pub
-func TestClient_Publish(t *testing.T) {
-	testAllClient(t, &extraHandler{
-		afterConnSuccess: func(c Client) {
-			c.Publish(testPubMsgs...)
-		},
-		afterPubSuccess: func(c Client) {
-			c.Destroy(true)
-		},
-	})
-
-	goleak.VerifyNoLeaks(t)
-}
-
-// conn -> sub -> pub
-func TestClient_Subscribe(t *testing.T) {
-	testAllClient(t, &extraHandler{
-		afterConnSuccess: func(c Client) {
-			handleTopicAndSub(c, t)
-		},
-		afterSubSuccess: func(c Client) {
-			c.Publish(testPubMsgs...)
-		},
-		afterPubSuccess: func(c Client) {
-			c.Destroy(true)
-		},
-	})
-
-	goleak.VerifyNoLeaks(t)
-}
-
-// conn -> sub -> pub -> unSub
-func TestClient_UnSubscribe(t *testing.T) {
-	testAllClient(t, &extraHandler{
-		afterConnSuccess: func(c Client) {
-			handleTopicAndSub(c, t)
-		},
-		afterSubSuccess: func(c Client) {
-			c.UnSubscribe(testTopics...)
-		},
-		afterUnSubSuccess: func(c Client) {
-			c.Destroy(true)
-		},
-	})
-
-	goleak.VerifyNoLeaks(t)
-}
@@ -0,0 +1,255 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestClient_WriteTimeout(t *testing.T) {
+	var (
+		stalled   = make(chan struct{})
+		connected = make(chan struct{}, 2)
+		timeouts  = make(chan error, 1)
+	)
+	defer close(stalled)
+
+	client, err := NewClient(
+		WithDialTimeout(10),
+		WithKeepalive(10, 1.2),
+		WithWriteTimeout(100*time.Millisecond),
+		WithAutoReconnect(true),
+		WithBackoffStrategy(time.Millisecond, time.Millisecond, 1),
+		WithCustomConnector(scriptBroker(V311, func(s *fakeSession) {
+			if s.n > 1 {
+				s.serve(fakeBrokerConfig{ackPub: true})
+				return
+			}
+
+			// server stops reading once connected
+			s.write(&ConnAckPacket{})
+			<-stalled
+		})),
+		WithConnHandleFunc(func(client Client, server string, code byte, err error) {
+			if code == CodeSuccess {
+				connected <- struct{}{}
+			}
+		}),
+		WithNetHandleFunc(func(client Client, server string, err error) {
+			var e net.Error
+			if errors.As(err, &e) && e.Timeout() {
+				select {
+				case timeouts <- err:
+				default:
+				}
+			}
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Destroy(true)
+
+	if err := client.ConnectServer("fake"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not connected")
+	}
+
+	start := time.Now()
+	client.Publish(&PublishPacket{TopicName: "/foo", Payload: []byte("bar")})
+
+	select {
+	case <-timeouts:
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Error("write timeout detected too late, elapsed =", elapsed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("write timeout not detected")
+	}
+
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not reconnected after write timeout")
+	}
+}
+
+func TestConnectOptions_SendTimeout(t *testing.T) {
+	options := defaultConnectOptions()
+	if timeout := options.sendTimeout(); timeout != 3*time.Minute {
+		t.Error("unexpected default write timeout =", timeout)
+	}
+
+	options.writeTimeout = time.Second
+	if timeout := options.sendTimeout(); timeout != time.Second {
+		t.Error("unexpected write timeout =", timeout)
+	}
+
+	options.writeTimeout = -1
+	if timeout := options.sendTimeout(); timeout != 0 {
+		t.Error("write timeout not disabled =", timeout)
+	}
+}
+
+func TestClient_ReadTimeout(t *testing.T) {
+	var (
+		silent    = make(chan struct{})
+		connected = make(chan struct{}, 2)
+		timeouts  = make(chan error, 1)
+	)
+	defer close(silent)
+
+	client, err := NewClient(
+		WithDialTimeout(10),
+		WithKeepalive(10, 1.2),
+		WithReadTimeout(100*time.Millisecond),
+		WithAutoReconnect(true),
+		WithBackoffStrategy(time.Millisecond, time.Millisecond, 1),
+		WithCustomConnector(scriptBroker(V311, func(s *fakeSession) {
+			if s.n > 1 {
+				s.serve(fakeBrokerConfig{ackPub: true})
+				return
+			}
+
+			// server sends nothing once connected (half-open)
+			s.write(&ConnAckPacket{})
+			go s.discard()
+			<-silent
+		})),
+		WithConnHandleFunc(func(client Client, server string, code byte, err error) {
+			if code == CodeSuccess {
+				connected <- struct{}{}
+			}
+		}),
+		WithNetHandleFunc(func(client Client, server string, err error) {
+			var e net.Error
+			if errors.As(err, &e) && e.Timeout() {
+				select {
+				case timeouts <- err:
+				default:
+				}
+			}
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Destroy(true)
+
+	start := time.Now()
+	if err := client.ConnectServer("fake"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not connected")
+	}
+
+	select {
+	case <-timeouts:
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Error("read timeout detected too late, elapsed =", elapsed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("read timeout not detected")
+	}
+
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not reconnected after read timeout")
+	}
+}
+
+func TestClient_ReadTimeoutKeepalive(t *testing.T) {
+	var (
+		connected = make(chan struct{}, 1)
+		netErrs   = make(chan error, 1)
+	)
+
+	client, err := NewClient(
+		func(c *AsyncClient, options *connectOptions) error {
+			// quiet subscription kept alive by PingReq every 75ms
+			options.keepalive = 100 * time.Millisecond
+			options.dialTimeout = options.keepalive
+			return nil
+		},
+		WithCustomConnector(fakeConnector(fakeBrokerConfig{ackPub: true})),
+		WithConnHandleFunc(func(client Client, server string, code byte, err error) {
+			if code == CodeSuccess {
+				connected <- struct{}{}
+			}
+		}),
+		WithNetHandleFunc(func(client Client, server string, err error) {
+			select {
+			case netErrs <- err:
+			default:
+			}
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Destroy(true)
+
+	if err := client.ConnectServer("fake"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not connected")
+	}
+
+	select {
+	case err := <-netErrs:
+		t.Fatal("connection broken with keepalive traffic, err =", err)
+	case <-time.After(time.Second):
+	}
+}
+
+func TestConnectOptions_RecvTimeout(t *testing.T) {
+	options := defaultConnectOptions()
+	if timeout := options.recvTimeout(); timeout != 4*time.Minute+30*time.Second {
+		t.Error("unexpected default read timeout =", timeout)
+	}
+
+	options.keepaliveFactor = 0.5
+	if timeout := options.recvTimeout(); timeout != 3*time.Minute {
+		t.Error("unexpected read timeout of small factor =", timeout)
+	}
+
+	options.readTimeout = time.Second
+	if timeout := options.recvTimeout(); timeout != time.Second {
+		t.Error("unexpected read timeout =", timeout)
+	}
+
+	options.readTimeout = -1
+	if timeout := options.recvTimeout(); timeout != 0 {
+		t.Error("read timeout not disabled =", timeout)
+	}
+}
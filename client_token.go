@@ -0,0 +1,122 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// PublishToken is the result of one publish of PublishAsync, messages
+// published to the same topic concurrently are told apart by their tokens
+type PublishToken struct {
+	topic    string
+	packetID uint32 // accessed atomically
+
+	tokens *pubTokens
+	once   sync.Once
+	done   chan struct{}
+	err    error
+}
+
+// Topic returns the topic published to
+func (t *PublishToken) Topic() string {
+	return t.topic
+}
+
+// PacketID returns the packet id assigned to the publish, 0 for QoS0 or
+// if failed before assigned
+func (t *PublishToken) PacketID() uint16 {
+	return uint16(atomic.LoadUint32(&t.packetID))
+}
+
+// Done returns the channel closed once the publish completed or failed
+func (t *PublishToken) Done() <-chan struct{} {
+	return t.done
+}
+
+// Error returns the error of the publish once done, nil if completed or
+// not done yet
+func (t *PublishToken) Error() error {
+	select {
+	case <-t.done:
+		return t.err
+	default:
+		return nil
+	}
+}
+
+func (t *PublishToken) setPacketID(id uint16) {
+	if t != nil {
+		atomic.StoreUint32(&t.packetID, uint32(id))
+	}
+}
+
+// resolve the token with the result of the publish, only the first result
+// is kept
+func (t *PublishToken) resolve(err error) {
+	if t == nil {
+		return
+	}
+
+	t.once.Do(func() {
+		t.err = err
+		close(t.done)
+		t.tokens.remove(t)
+	})
+}
+
+// pubTokens holds tokens not resolved, which are resolved once the client
+// destroyed, tokens are held by the publish packets (and the packet id
+// generator) until resolved, so publishes resent on a new connection keep
+// their tokens
+type pubTokens struct {
+	mu     sync.Mutex
+	tokens map[*PublishToken]struct{}
+}
+
+func (r *pubTokens) newToken(topic string) *PublishToken {
+	t := &PublishToken{topic: topic, tokens: r, done: make(chan struct{})}
+
+	r.mu.Lock()
+	if r.tokens == nil {
+		r.tokens = make(map[*PublishToken]struct{})
+	}
+	r.tokens[t] = struct{}{}
+	r.mu.Unlock()
+	return t
+}
+
+func (r *pubTokens) remove(t *PublishToken) {
+	r.mu.Lock()
+	delete(r.tokens, t)
+	r.mu.Unlock()
+}
+
+// resolveAll resolves all tokens not resolved with the error
+func (r *pubTokens) resolveAll(err error) {
+	r.mu.Lock()
+	tokens := make([]*PublishToken, 0, len(r.tokens))
+	for t := range r.tokens {
+		tokens = append(tokens, t)
+	}
+	r.mu.Unlock()
+
+	for _, t := range tokens {
+		t.resolve(err)
+	}
+}
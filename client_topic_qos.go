@@ -0,0 +1,125 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrTopicQoSExceeded is returned by PublishWith (and notified to the
+// PubHandleFunc for Publish) when the publish QoS is greater than the QoS
+// configured for the topic with strict topic QoS (see WithTopicQoS and
+// WithTopicQoSStrict)
+var ErrTopicQoSExceeded = errors.New("publish QoS exceeds the topic QoS ")
+
+// qosUnset is the QoS of the publish packet built by PublishWith before
+// options applied, replaced by the topic QoS if PubQoS not set
+const qosUnset QosLevel = 0xff
+
+// topicQoS is the QoS configured for topic names and filters, filters are
+// matched with the trie of WildcardRouter
+type topicQoS struct {
+	names   map[string]QosLevel
+	filters *WildcardRouter
+}
+
+// WithTopicQoS designate the QoS of topics (topic names or topic filters
+// with wildcards), used by PublishWith when PubQoS not set, and as the max
+// QoS of publishes to the topic, publishes with greater QoS are downgraded
+// (or refused, see WithTopicQoSStrict), the QoS of the topic name takes
+// precedence over topic filters, the minimum QoS is used if more than one
+// filter matched
+func WithTopicQoS(qos map[string]QosLevel) Option {
+	return func(c *AsyncClient, options *connectOptions) error {
+		t := &topicQoS{names: make(map[string]QosLevel), filters: NewWildcardRouter()}
+		for topic, q := range qos {
+			if q > Qos2 {
+				return fmt.Errorf("invalid QoS %d of topic %q", q, topic)
+			}
+
+			if !isWildcardTopic(topic) {
+				t.names[topic] = q
+				continue
+			}
+
+			if err := ValidateTopicFilter(topic); err != nil {
+				return err
+			}
+
+			q := q
+			t.filters.HandlePublish(topic, func(client Client, p *PublishPacket) {
+				if q < p.Qos {
+					p.Qos = q
+				}
+			})
+		}
+
+		c.topicQoS = t
+		return nil
+	}
+}
+
+// WithTopicQoSStrict refuses publishes with QoS greater than the QoS
+// configured for the topic (see WithTopicQoS) with ErrTopicQoSExceeded
+// instead of downgrading them
+func WithTopicQoSStrict(strict bool) Option {
+	return func(c *AsyncClient, options *connectOptions) error {
+		c.topicQoSStrict = strict
+		return nil
+	}
+}
+
+// qos returns the QoS configured for the topic, false if not configured
+func (t *topicQoS) qos(topic string) (QosLevel, bool) {
+	if t == nil {
+		return 0, false
+	}
+
+	if q, ok := t.names[topic]; ok {
+		return q, true
+	}
+
+	probe := &PublishPacket{TopicName: topic, Qos: qosUnset}
+	if !t.filters.DispatchMatched(nil, probe) {
+		return 0, false
+	}
+	return probe.Qos, true
+}
+
+// applyTopicQoS sets the topic QoS of the publish packet if not set,
+// downgrades the QoS greater than the topic QoS, or returns
+// ErrTopicQoSExceeded if strict
+func (c *AsyncClient) applyTopicQoS(p *PublishPacket) error {
+	q, ok := c.topicQoS.qos(p.TopicName)
+	switch {
+	case p.Qos == qosUnset:
+		p.Qos = Qos0
+		if ok {
+			p.Qos = q
+		}
+	case ok && p.Qos > q:
+		if c.topicQoSStrict {
+			c.log.e("CLI publish QoS exceeds the topic QoS, topic =", p.TopicName, "qos =", p.Qos, "max =", q)
+			return ErrTopicQoSExceeded
+		}
+
+		c.log.d("CLI publish QoS downgraded to the topic QoS, topic =", p.TopicName, "qos =", p.Qos, "max =", q)
+		p.Qos = q
+	}
+	return nil
+}
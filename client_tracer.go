@@ -0,0 +1,72 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"context"
+)
+
+// Tracer traces publishes and the handling of received publish packets
+// (e.g. with OpenTelemetry, see the otel package), methods are called
+// concurrently and MUST NOT block
+type Tracer interface {
+	// StartPublish is called once the publish accepted by Publish or
+	// PublishWith, before queued to send, ctx is the context set with
+	// PubContext (context.Background() if not set), the packet can be
+	// modified (e.g. to add user properties of MQTT 5), the function
+	// returned (can be nil) is called once the publish completed (acked
+	// for QoS1/QoS2, written for QoS0) or failed, with the error notified
+	// to the PubHandleFunc
+	StartPublish(ctx context.Context, p *PublishPacket) func(err error)
+
+	// StartHandle is called before the received publish packet dispatched
+	// to topic handlers, the function returned (can be nil) is called once
+	// handlers returned (or panicked)
+	StartHandle(p *PublishPacket) func()
+}
+
+// WithTracer set the tracer of publishes and received publish packets,
+// packets resent after restored from the persist are not traced
+func WithTracer(tracer Tracer) Option {
+	return func(c *AsyncClient, options *connectOptions) error {
+		c.tracer = tracer
+		return nil
+	}
+}
+
+// tracePublish starts the trace of the publish packet to be queued
+func (c *AsyncClient) tracePublish(p *PublishPacket) {
+	if c.tracer == nil {
+		return
+	}
+
+	ctx := p.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	p.traceEnd = c.tracer.StartPublish(ctx, p)
+}
+
+// finish ends the trace of the publish and resolves its token (see
+// PublishAsync) with the result, MUST be called once the publish completed
+// or failed
+func (p *PublishPacket) finish(err error) {
+	if p.traceEnd != nil {
+		p.traceEnd(err)
+	}
+	p.token.resolve(err)
+}
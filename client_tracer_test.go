@@ -0,0 +1,148 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+type tracedPub struct {
+	topic string
+	ctx   context.Context
+	err   error
+}
+
+type testTracer struct {
+	published chan tracedPub
+	handled   chan string
+}
+
+func (t *testTracer) StartPublish(ctx context.Context, p *PublishPacket) func(err error) {
+	topic := p.TopicName
+	return func(err error) {
+		t.published <- tracedPub{topic: topic, ctx: ctx, err: err}
+	}
+}
+
+func (t *testTracer) StartHandle(p *PublishPacket) func() {
+	topic := p.TopicName
+	return func() {
+		t.handled <- topic
+	}
+}
+
+func TestClient_TracePublish(t *testing.T) {
+	type ctxKey struct{}
+	var (
+		tracer    = &testTracer{published: make(chan tracedPub, 10)}
+		connected = make(chan struct{}, 1)
+		ctx       = context.WithValue(context.Background(), ctxKey{}, "span")
+	)
+	client, err := NewClient(
+		WithTracer(tracer),
+		WithCustomConnector(fakeConnector(fakeBrokerConfig{ackPub: true})),
+		WithConnHandleFunc(func(client Client, server string, code byte, err error) {
+			if code == CodeSuccess {
+				connected <- struct{}{}
+			}
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Destroy(true)
+
+	if err := client.ConnectServer("fake"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not connected")
+	}
+
+	client.Publish(&PublishPacket{TopicName: "/qos0"})
+	for _, pub := range []struct {
+		topic   string
+		options []PubOption
+		err     error
+	}{
+		{"/qos1", []PubOption{PubQoS(Qos1), PubContext(ctx)}, nil},
+		{"/qos2", []PubOption{PubQoS(Qos2)}, nil},
+		{"/expired", []PubOption{PubQoS(Qos1), PubDeadline(time.Now())}, ErrPublishExpired},
+	} {
+		if err := client.PublishWith(pub.topic, nil, pub.options...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	results := make(map[string]tracedPub)
+	for len(results) < 4 {
+		select {
+		case pub := <-tracer.published:
+			results[pub.topic] = pub
+		case <-time.After(5 * time.Second):
+			t.Fatal("publish trace not ended, ended =", results)
+		}
+	}
+
+	for topic, err := range map[string]error{"/qos0": nil, "/qos1": nil, "/qos2": nil, "/expired": ErrPublishExpired} {
+		if results[topic].err != err {
+			t.Errorf("unexpected result of %s = %v", topic, results[topic].err)
+		}
+	}
+
+	if v := results["/qos1"].ctx.Value(ctxKey{}); v != "span" {
+		t.Error("publish context not passed to tracer, value =", v)
+	}
+	if results["/qos0"].ctx == nil {
+		t.Error("nil context passed to tracer")
+	}
+}
+
+func TestClient_TraceHandle(t *testing.T) {
+	tracer := &testTracer{handled: make(chan string, 1)}
+	c := defaultClient()
+	_ = WithTracer(tracer)(c, &c.options)
+
+	handled := false
+	c.HandleTopic("/foo", func(client Client, topic string, qos QosLevel, msg []byte) {
+		handled = true
+		select {
+		case <-tracer.handled:
+			t.Error("handle trace ended before handled")
+		default:
+		}
+	})
+
+	c.dispatchSafe(&PublishPacket{TopicName: "/foo"})
+	if !handled {
+		t.Fatal("not handled")
+	}
+
+	select {
+	case topic := <-tracer.handled:
+		if topic != "/foo" {
+			t.Error("unexpected topic traced =", topic)
+		}
+	default:
+		t.Error("handle trace not ended")
+	}
+}
@@ -0,0 +1,244 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestClient_MaxPacketSize(t *testing.T) {
+	var (
+		maxSize = make(chan uint32, 1)
+		disconn = make(chan *DisconnPacket, 1)
+	)
+	client, err := NewClient(
+		WithVersion(V5, false),
+		WithMaxPacketSize(64),
+		WithCustomConnector(scriptBroker(V5, func(s *fakeSession) {
+			maxSize <- s.connect.Props.MaxPacketSize
+			s.write(&ConnAckPacket{}, &PublishPacket{TopicName: "/large", Payload: make([]byte, 100)})
+			if p := s.waitDisconn(); p != nil {
+				disconn <- p
+			}
+		})),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Destroy(true)
+
+	if err := client.ConnectServer("fake"); err != nil {
+		t.Fatal(err)
+	}
+
+	if size := <-maxSize; size != 64 {
+		t.Error("unexpected max packet size of connect =", size)
+	}
+
+	select {
+	case p := <-disconn:
+		if p.Code != CodePacketTooLarge {
+			t.Error("unexpected disconnect code =", p.Code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("disconnect not sent")
+	}
+}
+
+func TestClient_InboundTopicAlias(t *testing.T) {
+	var (
+		aliasMax = make(chan uint16, 2)
+		disconn  = make(chan *DisconnPacket, 2)
+		topics   = make(chan string, 10)
+		mapped   = make(chan struct{})
+	)
+	client, err := NewClient(
+		WithVersion(V5, false),
+		WithInboundTopicAliasMax(2),
+		WithAutoReconnect(true),
+		WithBackoffStrategy(time.Millisecond, time.Millisecond, 1),
+		WithCustomConnector(scriptBroker(V5, func(s *fakeSession) {
+			aliasMax <- s.connect.Props.MaxTopicAlias
+
+			pub := func(topic string, alias uint16) *PublishPacket {
+				return &PublishPacket{TopicName: topic, Props: &PublishProps{TopicAlias: alias}}
+			}
+
+			s.write(&ConnAckPacket{})
+			switch s.n {
+			case 1:
+				s.write(pub("/foo", 1), pub("", 1), pub("/bar", 2))
+				<-mapped
+				s.write(pub("/baz", 3))
+			case 2:
+				// aliases of the previous connection dropped
+				s.write(pub("", 1))
+			default:
+				return
+			}
+
+			if p := s.waitDisconn(); p != nil {
+				disconn <- p
+			}
+		})),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Destroy(true)
+
+	client.HandleUnmatched(func(client Client, topic string, qos QosLevel, msg []byte) {
+		topics <- topic
+	})
+	if err := client.ConnectServer("fake"); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := <-aliasMax; n != 2 {
+		t.Error("unexpected topic alias maximum of connect =", n)
+	}
+	// handlers called concurrently
+	var received []string
+	for len(received) < 3 {
+		select {
+		case topic := <-topics:
+			received = append(received, topic)
+		case <-time.After(5 * time.Second):
+			t.Fatal("publish not received")
+		}
+	}
+	if sort.Strings(received); fmt.Sprint(received) != "[/bar /foo /foo]" {
+		t.Error("unexpected topics =", received)
+	}
+	if n := client.Stats().InboundTopicAliases; n != 2 {
+		t.Error("unexpected topic aliases mapped =", n)
+	}
+	close(mapped)
+
+	for _, code := range []byte{CodeTopicAliasInvalid, CodeProtoError} {
+		select {
+		case p := <-disconn:
+			if p.Code != code {
+				t.Error("unexpected disconnect code =", p.Code, "expected =", code)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("disconnect not sent")
+		}
+	}
+	<-aliasMax
+}
+
+func TestClient_ConnAuth(t *testing.T) {
+	connected := make(chan *ConnPacket, 1)
+	client, err := NewClient(
+		WithVersion(V5, false),
+		WithAuth("token", []byte("secret")),
+		WithCustomConnector(scriptBroker(V5, func(s *fakeSession) {
+			connected <- s.connect
+		})),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Destroy(true)
+
+	if err := client.ConnectServer("fake", WithVersion(V311, false)); err != ErrAuthRequiresV5 {
+		t.Error("unexpected error with MQTT 3.1.1 =", err)
+	}
+
+	if err := client.ConnectServer("fake"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case p := <-connected:
+		if p.Props == nil || p.Props.AuthMethod != "token" || string(p.Props.AuthData) != "secret" {
+			t.Errorf("unexpected connect props = %+v", p.Props)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("connect packet not received")
+	}
+
+	if client.options.connPacket.Props.AuthMethod != "token" {
+		t.Error("client options changed")
+	}
+}
+
+func TestClient_ConnUserProps(t *testing.T) {
+	var (
+		connected = make(chan *ConnPacket, 2)
+		hooked    = make(chan UserProps, 2)
+	)
+	client, err := NewClient(
+		WithVersion(V5, false),
+		WithConnUserProps(UserProps{{Key: "tenant", Value: "acme"}, {Key: "fw", Value: "1.0.0"}}),
+		WithServerConnUserProps("edge", UserProps{{Key: "fw", Value: "1.2.3"}}),
+		WithCustomConnPacket(func(server string, base *ConnPacket) *ConnPacket {
+			hooked <- base.Props.UserProps
+			return nil
+		}),
+		WithCustomConnector(scriptBroker(V5, func(s *fakeSession) {
+			connected <- s.connect
+		})),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Destroy(true)
+
+	if err := client.ConnectServer("edge", WithVersion(V311, false)); err != ErrPropsRequireV5 {
+		t.Error("unexpected error with MQTT 3.1.1 =", err)
+	}
+
+	for _, c := range []struct {
+		server string
+		props  UserProps
+	}{
+		{server: "cloud", props: UserProps{{Key: "tenant", Value: "acme"}, {Key: "fw", Value: "1.0.0"}}},
+		{server: "edge", props: UserProps{{Key: "tenant", Value: "acme"}, {Key: "fw", Value: "1.2.3"}}},
+	} {
+		if err := client.ConnectServer(c.server); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case props := <-hooked:
+			if !reflect.DeepEqual(props, c.props) {
+				t.Error("unexpected user props passed to hook =", props)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("connect packet hook not called")
+		}
+
+		select {
+		case p := <-connected:
+			if p.Props == nil || !reflect.DeepEqual(p.Props.UserProps, c.props) {
+				t.Errorf("unexpected connect props of %s = %+v", c.server, p.Props)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("connect packet not received")
+		}
+	}
+
+	if props := client.options.connPacket.Props.UserProps; len(props) != 2 || props[1].Value != "1.0.0" {
+		t.Error("client options changed =", props)
+	}
+}
@@ -0,0 +1,209 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// errors of option validation (see OptionsError)
+var (
+	// ErrBadKeepaliveFactor used when the keepalive factor is less than 1,
+	// the connection would be closed before the keepalive response is due
+	ErrBadKeepaliveFactor = errors.New("keepalive factor less than 1 ")
+
+	// ErrPropsRequireV5 used when MQTT 5 properties (e.g. WithWillProps)
+	// are set with MQTT 3.1.1 or MQTT 3.1
+	ErrPropsRequireV5 = errors.New("properties require MQTT 5 ")
+
+	// ErrKeepaliveBelowDialTimeout used when the keepalive is shorter than
+	// the dial timeout, the keepalive would be due before a slow connection
+	// attempt timed out
+	ErrKeepaliveBelowDialTimeout = errors.New("keepalive shorter than dial timeout ")
+
+	// ErrNoServers used when WithServer or WithSecureServer applied without
+	// any server, and passed to the ConnHandler of Client.Connect if no
+	// server set
+	ErrNoServers = errors.New("no server to connect ")
+)
+
+// OptionsError is returned by NewClient with all violations of options
+// applied, use errors.Is to check the violation (e.g. ErrClientIDRequired)
+type OptionsError struct {
+	Errs []error
+}
+
+func (e *OptionsError) Error() string {
+	msgs := make([]string, len(e.Errs))
+	for i, err := range e.Errs {
+		msgs[i] = strings.TrimSpace(err.Error())
+	}
+	return "invalid options: " + strings.Join(msgs, "; ")
+}
+
+// Is returns true if any violation matches the target
+func (e *OptionsError) Is(target error) bool {
+	for _, err := range e.Errs {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// Unwrap returns all violations (for errors.As with Go 1.20 or later)
+func (e *OptionsError) Unwrap() []error {
+	return e.Errs
+}
+
+// OptionsInfo is the snapshot of options applied, passed to validators
+// registered with WithOptionValidator
+type OptionsInfo struct {
+	Version         ProtoVersion
+	VersionFallback bool
+	ClientID        string
+	CleanSession    bool // the flag set, MQTT 5 servers may assign a ClientID if empty
+	Keepalive       time.Duration
+	KeepaliveFactor float64
+	DialTimeout     time.Duration
+	AutoReconnect   bool
+	TLS             bool
+	ConnProps       *ConnProps
+	WillProps       *WillProps
+}
+
+// OptionValidator validates options applied, returns the violation found
+type OptionValidator func(options OptionsInfo) error
+
+// WithOptionValidator registers the validator run by NewClient once all
+// options applied, so custom options (e.g. returned with other options as
+// a slice) can validate combinations of options, errors returned are
+// included in the OptionsError
+func WithOptionValidator(v OptionValidator) Option {
+	return func(c *AsyncClient, options *connectOptions) error {
+		if v != nil {
+			options.validators = append(options.validators, v)
+		}
+		return nil
+	}
+}
+
+func (c connectOptions) info() OptionsInfo {
+	return OptionsInfo{
+		Version:         c.protoVersion,
+		VersionFallback: c.protoCompromise,
+		ClientID:        c.connPacket.ClientID,
+		CleanSession:    c.connPacket.CleanSession,
+		Keepalive:       c.keepalive,
+		KeepaliveFactor: c.keepaliveFactor,
+		DialTimeout:     c.dialTimeout,
+		AutoReconnect:   c.autoReconnect,
+		TLS:             c.tlsConfig != nil,
+		ConnProps:       c.connPacket.Props,
+		WillProps:       c.connPacket.WillProps,
+	}
+}
+
+// validateConnPacket validates the connect packet customized (see
+// WithCustomConnPacket) of the version
+func (c connectOptions) validateConnPacket(parent *AsyncClient, version ProtoVersion, pkt *ConnPacket) error {
+	if pkt.ClientID == "" {
+		if !pkt.CleanSession && version < V5 {
+			return ErrClientIDRequired
+		}
+	} else if err := checkClientID(pkt.ClientID, c.strictClientID); err != nil {
+		return err
+	}
+
+	if version < V5 && pkt.Props.hasAuth() {
+		return ErrAuthRequiresV5
+	}
+
+	if version < V5 && pkt.Props != nil && len(pkt.Props.UserProps) > 0 {
+		return ErrPropsRequireV5
+	}
+
+	if !pkt.IsWill {
+		return nil
+	}
+
+	if pkt.WillQos > Qos2 {
+		return fmt.Errorf("invalid will QoS %d", pkt.WillQos)
+	}
+
+	if parent.skipTopicValidation {
+		return nil
+	}
+	return ValidateTopicName(parent.prefixTopic(pkt.WillTopic))
+}
+
+// validate returns the OptionsError with all violations, nil if valid,
+// servers are those set with WithServer and WithSecureServer
+func (c connectOptions) validate(servers ...[]string) error {
+	var errs []error
+	if c.keepalive > 0 && c.keepaliveFactor < 1 {
+		errs = append(errs, ErrBadKeepaliveFactor)
+	}
+
+	if c.keepalive > 0 && c.keepalive < c.dialTimeout {
+		errs = append(errs, ErrKeepaliveBelowDialTimeout)
+	}
+
+	if c.serversSet && !hasServer(servers...) {
+		errs = append(errs, ErrNoServers)
+	}
+
+	if err := c.validateClientID(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if c.protoVersion < V5 {
+		switch {
+		case c.connPacket.Props.hasAuth():
+			errs = append(errs, ErrAuthRequiresV5)
+		case c.connPacket.Props != nil, c.connPacket.WillProps != nil, len(c.serverUserProps) > 0:
+			errs = append(errs, ErrPropsRequireV5)
+		}
+	}
+
+	info := c.info()
+	for _, v := range c.validators {
+		if err := v(info); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return &OptionsError{Errs: errs}
+}
+
+// hasServer returns true if any server address not empty
+func hasServer(servers ...[]string) bool {
+	for _, s := range servers {
+		for _, addr := range s {
+			if addr != "" {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,123 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewClient_Validate(t *testing.T) {
+	errCustom := errors.New("custom violation ")
+
+	var info OptionsInfo
+	_, err := NewClient(
+		WithKeepalive(10, 0.5),
+		WithServer(""),
+		WithCleanSession(false),
+		WithWillProps(&WillProps{MessageExpiryInterval: 10}),
+		WithOptionValidator(func(options OptionsInfo) error {
+			info = options
+			return errCustom
+		}),
+		WithOptionValidator(func(options OptionsInfo) error { return nil }),
+	)
+
+	var optionsErr *OptionsError
+	if !errors.As(err, &optionsErr) {
+		t.Fatal("unexpected error =", err)
+	}
+
+	// every violation reported
+	for _, expected := range []error{
+		ErrBadKeepaliveFactor, ErrKeepaliveBelowDialTimeout, ErrNoServers, ErrClientIDRequired, ErrPropsRequireV5, errCustom,
+	} {
+		if !errors.Is(err, expected) {
+			t.Error("violation not reported =", expected)
+		}
+		if !strings.Contains(err.Error(), strings.TrimSpace(expected.Error())) {
+			t.Error("violation not described =", err)
+		}
+	}
+	if len(optionsErr.Errs) != 6 || errors.Is(err, ErrAuthRequiresV5) {
+		t.Error("unexpected violations =", optionsErr.Errs)
+	}
+
+	if info.Version != V311 || info.Keepalive != 10*time.Second || info.KeepaliveFactor != 0.5 ||
+		info.CleanSession || info.ClientID != "" || info.WillProps == nil {
+		t.Errorf("unexpected options info %+v", info)
+	}
+
+	_, err = NewClient(WithAuth("token", nil))
+	if !errors.Is(err, ErrAuthRequiresV5) || errors.Is(err, ErrPropsRequireV5) {
+		t.Error("unexpected error =", err)
+	}
+
+	for _, option := range []Option{
+		WithConnUserProps(UserProps{{Key: "tenant", Value: "acme"}}),
+		WithServerConnUserProps("fake", UserProps{{Key: "fw", Value: "1.2.3"}}),
+	} {
+		if _, err = NewClient(option); !errors.Is(err, ErrPropsRequireV5) {
+			t.Error("unexpected error of user props with MQTT 3.1.1 =", err)
+		}
+	}
+
+	for _, options := range [][]Option{
+		{WithKeepalive(20, 1.5)},
+		{WithDialTimeout(30), WithKeepalive(30, 1.5)},
+		{WithServer("localhost:1883")},
+	} {
+		c, err := NewClient(options...)
+		if err != nil {
+			t.Error("unexpected error =", err)
+			continue
+		}
+		c.Destroy(true)
+	}
+
+	client, err := NewClient(WithVersion(V5, false), WithAuth("token", nil), WithDialTimeout(10), WithKeepalive(10, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Destroy(true)
+
+	if factor := client.options.keepaliveFactor; factor != 1.5 {
+		t.Error("keepalive factor changed =", factor)
+	}
+}
+
+func TestClient_ConnectNoServers(t *testing.T) {
+	client, err := NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Destroy(true)
+
+	errs := make(chan error, 1)
+	client.Connect(func(server string, code byte, err error) { errs <- err })
+
+	select {
+	case err := <-errs:
+		if err != ErrNoServers {
+			t.Error("unexpected error =", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("connect handler not called")
+	}
+}
@@ -0,0 +1,141 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestClient_V31Compromise(t *testing.T) {
+	versions := make(chan ProtoVersion, 2)
+	connected := make(chan error, 1)
+	client, err := NewClient(
+		WithVersion(V311, true),
+		WithConnHandleFunc(func(client Client, server string, code byte, err error) { connected <- err }),
+		WithCustomConnector(scriptBroker(V311, func(s *fakeSession) {
+			versions <- s.connect.Version()
+
+			connAck := &ConnAckPacket{}
+			if s.connect.Version() != V31 || s.connect.ProtoName != "MQIsdp" {
+				connAck.Code = CodeUnacceptableVersion
+			}
+			s.write(connAck)
+			s.discard()
+		})),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Destroy(true)
+
+	if err := client.ConnectServer("fake"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-connected:
+		if err != nil {
+			t.Error("connect failed, err =", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("connect timeout")
+	}
+
+	if v1, v2 := <-versions, <-versions; v1 != V311 || v2 != V31 {
+		t.Error("unexpected versions =", v1, v2)
+	}
+}
+
+func TestClient_VersionFallback(t *testing.T) {
+	levels := make(chan byte, 10)
+	connected := make(chan error, 10)
+	client, err := NewClient(
+		WithVersion(V5, false),
+		WithVersionFallback(true),
+		WithAutoReconnect(true),
+		WithBackoffStrategy(10*time.Millisecond, 10*time.Millisecond, 1),
+		WithConnHandleFunc(func(client Client, server string, code byte, err error) { connected <- err }),
+		WithCustomConnector(pipeConnector(func(conn net.Conn) {
+			defer func() { _ = conn.Close() }()
+
+			// MQTT 3.1 only server, connect packets of other versions not decoded
+			r := bufio.NewReader(conn)
+			if _, err := r.ReadByte(); err != nil {
+				return
+			}
+			n, _ := getRemainLength(r)
+			body := make([]byte, n)
+			if _, err := io.ReadFull(r, body); err != nil || len(body) < 3 || len(body) < 3+int(body[1]) {
+				return
+			}
+
+			level := body[2+int(body[1])]
+			levels <- level
+			if level != byte(V31) {
+				_, _ = conn.Write([]byte{CtrlConnAck << 4, 2, 0, CodeUnacceptableVersion})
+				return
+			}
+
+			// connection lost once connected
+			_, _ = conn.Write([]byte{CtrlConnAck << 4, 2, 0, CodeSuccess})
+			time.Sleep(100 * time.Millisecond)
+		})),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Destroy(true)
+
+	if err := client.ConnectServer("fake"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-connected:
+			if err != nil {
+				t.Fatal("connect failed, err =", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("connect timeout")
+		}
+
+		if i == 0 {
+			if info, ok := client.ConnInfo("fake"); !ok || info.Version != V31 {
+				t.Error("unexpected conn info =", info)
+			}
+		}
+	}
+
+	// reconnected with the version accepted
+	var got []byte
+	for len(levels) > 0 {
+		got = append(got, <-levels)
+	}
+	if !bytes.HasPrefix(got, []byte{byte(V5), byte(V311), byte(V31), byte(V31)}) {
+		t.Error("unexpected protocol levels =", got)
+	}
+
+	if _, ok := client.ConnInfo("unknown"); ok {
+		t.Error("conn info of unknown server")
+	}
+}
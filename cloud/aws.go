@@ -0,0 +1,169 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package cloud provides the options and topics to connect AWS IoT Core
+// and Azure IoT Hub
+package cloud
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"unicode/utf8"
+
+	"github.com/goiiot/libmqtt"
+)
+
+var (
+	// ErrAWSEndpoint is returned if the AWS IoT endpoint is empty or has a
+	// bad port
+	ErrAWSEndpoint = errors.New("cloud: bad AWS IoT endpoint ")
+	// ErrAWSClientID is returned if the client id is empty, longer than
+	// 128 bytes or not UTF-8 encoded
+	ErrAWSClientID = errors.New("cloud: bad AWS IoT client id ")
+	// ErrBadCA is returned if no certificate found in the CA PEM data
+	ErrBadCA = errors.New("cloud: no certificate in CA ")
+)
+
+const (
+	// AWSALPN is the ALPN protocol of MQTT with X.509 client certificates
+	// on port 443
+	AWSALPN = "x-amzn-mqtt-ca"
+
+	// AWSMinKeepalive and AWSMaxKeepalive are the keepalive bounds of AWS
+	// IoT in seconds, keepalive out of bounds are adjusted by AWS IoT
+	AWSMinKeepalive = 30
+	AWSMaxKeepalive = 1200
+
+	awsDefaultPort      = "443"
+	awsDefaultKeepalive = 300
+	awsMaxClientIDLen   = 128
+)
+
+// AWSCerts are the credentials of the thing, PEM encoded
+type AWSCerts struct {
+	// Cert is the certificate of the thing
+	Cert []byte
+	// Key is the private key of the certificate
+	Key []byte
+	// CA is the Amazon root CA, system roots are used if empty
+	CA []byte
+}
+
+// NewAWSIoTOptions returns the server address and the options to connect
+// the AWS IoT endpoint (e.g. xxx-ats.iot.us-east-1.amazonaws.com) as the
+// thing with mutual TLS (see client.ConnectServer)
+//
+// the endpoint connected is port 443 with ALPN x-amzn-mqtt-ca unless a
+// port set (e.g. 8883 without ALPN), AWS IoT requires a unique client id
+// of at most 128 bytes (usually the thing name allowed by the policy),
+// the keepalive is 300 seconds (see AWSKeepalive) and auto reconnect is
+// enabled
+func NewAWSIoTOptions(endpoint, clientID string, certs AWSCerts) (string, []libmqtt.Option, error) {
+	if clientID == "" || len(clientID) > awsMaxClientIDLen || !utf8.ValidString(clientID) {
+		return "", nil, ErrAWSClientID
+	}
+
+	host, port, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		host, port = endpoint, awsDefaultPort
+	}
+	if host == "" || port == "" {
+		return "", nil, ErrAWSEndpoint
+	}
+
+	config, err := awsTLSConfig(host, port, certs)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return net.JoinHostPort(host, port), []libmqtt.Option{
+		libmqtt.WithCustomTLS(config),
+		libmqtt.WithClientID(clientID),
+		AWSKeepalive(awsDefaultKeepalive),
+		libmqtt.WithAutoReconnect(true),
+	}, nil
+}
+
+// AWSKeepalive sets the keepalive (in seconds) within the bounds of AWS
+// IoT (AWSMinKeepalive to AWSMaxKeepalive)
+func AWSKeepalive(keepalive uint16) libmqtt.Option {
+	return libmqtt.WithKeepalive(clamp(keepalive, AWSMinKeepalive, AWSMaxKeepalive), 1.5)
+}
+
+// awsTLSConfig is the TLS config of the thing, ALPN is only used on 443
+func awsTLSConfig(host, port string, certs AWSCerts) (*tls.Config, error) {
+	cert, err := tls.X509KeyPair(certs.Cert, certs.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ServerName:   host,
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if len(certs.CA) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(certs.CA) {
+			return nil, ErrBadCA
+		}
+		config.RootCAs = pool
+	}
+
+	if port == awsDefaultPort {
+		config.NextProtos = []string{AWSALPN}
+	}
+	return config, nil
+}
+
+// shadow operations and their response topics, see AWSShadowTopic
+const (
+	ShadowUpdate          = "update"
+	ShadowUpdateAccepted  = "update/accepted"
+	ShadowUpdateRejected  = "update/rejected"
+	ShadowUpdateDelta     = "update/delta"
+	ShadowUpdateDocuments = "update/documents"
+	ShadowGet             = "get"
+	ShadowGetAccepted     = "get/accepted"
+	ShadowGetRejected     = "get/rejected"
+	ShadowDelete          = "delete"
+	ShadowDeleteAccepted  = "delete/accepted"
+	ShadowDeleteRejected  = "delete/rejected"
+)
+
+// AWSShadowTopic returns the topic of the shadow operation (e.g.
+// ShadowUpdate), the classic shadow is used if shadowName is empty
+func AWSShadowTopic(thing, shadowName, op string) string {
+	if shadowName == "" {
+		return "$aws/things/" + thing + "/shadow/" + op
+	}
+	return "$aws/things/" + thing + "/shadow/name/" + shadowName + "/" + op
+}
+
+// clamp v within [min, max]
+func clamp(v, min, max uint16) uint16 {
+	switch {
+	case v < min:
+		return min
+	case v > max:
+		return max
+	default:
+		return v
+	}
+}
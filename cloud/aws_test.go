@@ -0,0 +1,189 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package cloud
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/goiiot/libmqtt"
+)
+
+// testCert generates a self-signed certificate of localhost, PEM encoded
+func testCert(t *testing.T) (certPEM, keyPEM []byte) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func TestNewAWSIoTOptions(t *testing.T) {
+	cert, key := testCert(t)
+	certs := AWSCerts{Cert: cert, Key: key}
+
+	for endpoint, expected := range map[string]string{
+		"xxx-ats.iot.us-east-1.amazonaws.com":      "xxx-ats.iot.us-east-1.amazonaws.com:443",
+		"xxx-ats.iot.us-east-1.amazonaws.com:8883": "xxx-ats.iot.us-east-1.amazonaws.com:8883",
+	} {
+		server, options, err := NewAWSIoTOptions(endpoint, "thing", certs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if server != expected {
+			t.Error("unexpected server =", server, "want =", expected)
+		}
+
+		client, err := libmqtt.NewClient(options...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.Destroy(true)
+	}
+
+	for expected, args := range map[error]struct {
+		endpoint, clientID string
+		certs              AWSCerts
+	}{
+		ErrAWSClientID: {"xxx-ats.iot.us-east-1.amazonaws.com", "", certs},
+		ErrAWSEndpoint: {"xxx-ats.iot.us-east-1.amazonaws.com:", "thing", certs},
+		ErrBadCA:       {"xxx-ats.iot.us-east-1.amazonaws.com", "thing", AWSCerts{Cert: cert, Key: key, CA: []byte("bad")}},
+	} {
+		if _, _, err := NewAWSIoTOptions(args.endpoint, args.clientID, args.certs); err != expected {
+			t.Errorf("expected %v, got %v", expected, err)
+		}
+	}
+
+	for _, id := range []string{strings.Repeat("a", 129), "\xff"} {
+		if _, _, err := NewAWSIoTOptions("xxx-ats.iot.us-east-1.amazonaws.com", id, certs); err != ErrAWSClientID {
+			t.Error("unexpected error =", err, "id =", id)
+		}
+	}
+
+	if _, _, err := NewAWSIoTOptions("xxx-ats.iot.us-east-1.amazonaws.com", "thing", AWSCerts{Cert: cert}); err == nil {
+		t.Error("no error without key")
+	}
+}
+
+func TestAWSTLSConfig(t *testing.T) {
+	cert, key := testCert(t)
+	serverCert, err := tls.X509KeyPair(cert, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(cert)
+
+	// mutual TLS server of AWS IoT on 443
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		NextProtos:   []string{AWSALPN},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = l.Close() }()
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		_ = conn.(*tls.Conn).Handshake()
+		_ = conn.Close()
+	}()
+
+	config, err := awsTLSConfig("localhost", "443", AWSCerts{Cert: cert, Key: key, CA: cert})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := tls.Dial("tcp", l.Addr().String(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	if proto := conn.ConnectionState().NegotiatedProtocol; proto != AWSALPN {
+		t.Error("unexpected ALPN =", proto)
+	}
+
+	config, err = awsTLSConfig("localhost", "8883", AWSCerts{Cert: cert, Key: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.NextProtos) != 0 || config.RootCAs != nil || config.ServerName != "localhost" {
+		t.Error("unexpected config on 8883 =", config.NextProtos, config.ServerName)
+	}
+}
+
+func TestAWSShadowTopic(t *testing.T) {
+	for topic, expected := range map[string]string{
+		AWSShadowTopic("thing", "", ShadowUpdate):               "$aws/things/thing/shadow/update",
+		AWSShadowTopic("thing", "", ShadowGetAccepted):          "$aws/things/thing/shadow/get/accepted",
+		AWSShadowTopic("thing", "config", ShadowUpdateDelta):    "$aws/things/thing/shadow/name/config/update/delta",
+		AWSShadowTopic("thing", "config", ShadowDeleteRejected): "$aws/things/thing/shadow/name/config/delete/rejected",
+	} {
+		if topic != expected {
+			t.Error("unexpected topic =", topic, "want =", expected)
+		}
+	}
+}
+
+func TestClamp(t *testing.T) {
+	for v, expected := range map[uint16]uint16{0: AWSMinKeepalive, 60: 60, 3600: AWSMaxKeepalive} {
+		if got := clamp(v, AWSMinKeepalive, AWSMaxKeepalive); got != expected {
+			t.Error("unexpected keepalive =", got, "want =", expected)
+		}
+	}
+}
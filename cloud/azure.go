@@ -0,0 +1,227 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cloud
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/goiiot/libmqtt"
+)
+
+var (
+	// ErrAzureHub is returned if the IoT Hub host name is empty or not a
+	// host name
+	ErrAzureHub = errors.New("cloud: bad Azure IoT Hub host name ")
+	// ErrAzureDeviceID is returned if the device id is empty, longer than
+	// 128 characters or has characters not allowed by IoT Hub
+	ErrAzureDeviceID = errors.New("cloud: bad Azure IoT Hub device id ")
+	// ErrAzureSASKey is returned if the SAS key is not base64 encoded
+	ErrAzureSASKey = errors.New("cloud: bad Azure IoT Hub SAS key ")
+)
+
+const (
+	// AzureAPIVersion is the IoT Hub API version in the username
+	AzureAPIVersion = "2021-04-12"
+
+	// AzureMaxKeepalive is the max keepalive of IoT Hub in seconds,
+	// keepalive greater than it is replaced by IoT Hub
+	AzureMaxKeepalive = 1177
+
+	// AzureSASTTL is the default lifetime of SAS tokens generated
+	AzureSASTTL = time.Hour
+
+	azurePort             = "8883"
+	azureDefaultKeepalive = 300
+	azureMaxDeviceIDLen   = 128
+	azureDeviceIDChars    = "-.+%_#*?!(),:=@$'"
+)
+
+// now is replaced in tests
+var now = time.Now
+
+// NewAzureIoTOptions returns the server address and the options to connect
+// the IoT Hub (e.g. myhub.azure-devices.net) as the device with the SAS
+// key (primary or secondary key of the device) with MQTT 3.1.1 over TLS
+// (see client.ConnectServer)
+//
+// the username is {hub}/{deviceID}/?api-version={AzureAPIVersion}, and the
+// password is a SAS token valid for AzureSASTTL generated before every
+// connect attempt, IoT Hub closes the connection once the token expired,
+// the client is reconnected (auto reconnect is enabled) with a new token,
+// the keepalive is 300 seconds (see AzureKeepalive)
+func NewAzureIoTOptions(hub, deviceID, sasKey string) (string, []libmqtt.Option, error) {
+	if hub == "" || strings.ContainsAny(hub, "/:") {
+		return "", nil, ErrAzureHub
+	}
+
+	if !validAzureDeviceID(deviceID) {
+		return "", nil, ErrAzureDeviceID
+	}
+
+	if _, err := base64.StdEncoding.DecodeString(sasKey); err != nil || sasKey == "" {
+		return "", nil, ErrAzureSASKey
+	}
+
+	return net.JoinHostPort(hub, azurePort), []libmqtt.Option{
+		libmqtt.WithCustomTLS(&tls.Config{ServerName: hub, MinVersion: tls.VersionTLS12}),
+		libmqtt.WithVersion(libmqtt.V311, false),
+		libmqtt.WithClientID(deviceID),
+		libmqtt.WithCredentialsProvider(AzureSASCredentials(hub, deviceID, sasKey, AzureSASTTL)),
+		AzureKeepalive(azureDefaultKeepalive),
+		libmqtt.WithAutoReconnect(true),
+	}, nil
+}
+
+// AzureKeepalive sets the keepalive (in seconds) not greater than
+// AzureMaxKeepalive
+func AzureKeepalive(keepalive uint16) libmqtt.Option {
+	return libmqtt.WithKeepalive(clamp(keepalive, 1, AzureMaxKeepalive), 1.5)
+}
+
+// AzureSASCredentials returns the credentials provider of the device, the
+// SAS token in the password is generated with the key for every connect
+// attempt, and is valid for ttl (AzureSASTTL if not positive)
+func AzureSASCredentials(hub, deviceID, key string, ttl time.Duration) libmqtt.CredentialsProvider {
+	if ttl <= 0 {
+		ttl = AzureSASTTL
+	}
+
+	username := hub + "/" + deviceID + "/?api-version=" + AzureAPIVersion
+	return func(ctx context.Context, server string) (string, []byte, error) {
+		token, err := AzureSASToken(hub+"/devices/"+deviceID, key, "", now().Add(ttl))
+		if err != nil {
+			return "", nil, err
+		}
+		return username, []byte(token), nil
+	}
+}
+
+// AzureSASToken generates the SAS token of the resource URI (e.g.
+// {hub}/devices/{deviceID}) signed with the base64 encoded key, which
+// expires at expiry, policy is the name of the shared access policy of
+// the key (empty for device keys)
+func AzureSASToken(resourceURI, key, policy string, expiry time.Time) (string, error) {
+	k, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return "", ErrAzureSASKey
+	}
+
+	uri := url.QueryEscape(resourceURI)
+	se := strconv.FormatInt(expiry.Unix(), 10)
+
+	mac := hmac.New(sha256.New, k)
+	mac.Write([]byte(uri + "\n" + se))
+	sig := url.QueryEscape(base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+
+	token := "SharedAccessSignature sr=" + uri + "&sig=" + sig + "&se=" + se
+	if policy != "" {
+		token += "&skn=" + url.QueryEscape(policy)
+	}
+	return token, nil
+}
+
+// validAzureDeviceID checks the device id is ASCII alphanumeric characters
+// or special characters allowed, at most 128 characters
+func validAzureDeviceID(id string) bool {
+	if id == "" || len(id) > azureMaxDeviceIDLen {
+		return false
+	}
+
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.ContainsRune(azureDeviceIDChars, c):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// device twin and direct method topics of IoT Hub
+const (
+	// AzureTwinResponseFilter receives the responses of twin requests
+	AzureTwinResponseFilter = "$iothub/twin/res/#"
+	// AzureTwinDesiredFilter receives the desired properties updated
+	AzureTwinDesiredFilter = "$iothub/twin/PATCH/properties/desired/#"
+	// AzureMethodFilter receives direct method calls
+	AzureMethodFilter = "$iothub/methods/POST/#"
+)
+
+// AzureTelemetryTopic is the topic of device-to-cloud messages
+func AzureTelemetryTopic(deviceID string) string {
+	return "devices/" + deviceID + "/messages/events/"
+}
+
+// AzureC2DFilter is the topic filter of cloud-to-device messages
+func AzureC2DFilter(deviceID string) string {
+	return "devices/" + deviceID + "/messages/devicebound/#"
+}
+
+// AzureTwinGetTopic is the topic to get the twin, the response is sent
+// with the request id (rid) to AzureTwinResponseFilter
+func AzureTwinGetTopic(rid string) string {
+	return "$iothub/twin/GET/?$rid=" + rid
+}
+
+// AzureTwinReportedTopic is the topic to update reported properties, the
+// response is sent with the request id (rid) to AzureTwinResponseFilter
+func AzureTwinReportedTopic(rid string) string {
+	return "$iothub/twin/PATCH/properties/reported/?$rid=" + rid
+}
+
+// AzureMethodResponseTopic is the topic to respond the direct method call
+// of the request id (rid) with the status
+func AzureMethodResponseTopic(status int, rid string) string {
+	return "$iothub/methods/res/" + strconv.Itoa(status) + "/?$rid=" + rid
+}
+
+// ParseAzureTwinResponse parses the status and the request id of the twin
+// response topic ($iothub/twin/res/{status}/?$rid={rid}), false if the
+// topic is not a twin response
+func ParseAzureTwinResponse(topic string) (status int, rid string, ok bool) {
+	const prefix = "$iothub/twin/res/"
+	if !strings.HasPrefix(topic, prefix) {
+		return 0, "", false
+	}
+
+	parts := strings.SplitN(topic[len(prefix):], "/?", 2)
+	if len(parts) != 2 {
+		return 0, "", false
+	}
+
+	status, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, "", false
+	}
+
+	query, err := url.ParseQuery(parts[1])
+	if err != nil {
+		return 0, "", false
+	}
+	return status, query.Get("$rid"), true
+}
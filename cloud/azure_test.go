@@ -0,0 +1,150 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package cloud
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/goiiot/libmqtt"
+)
+
+const (
+	testSASKey = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+	testSAS    = "SharedAccessSignature sr=myhub.azure-devices.net%2Fdevices%2Fdevice-1" +
+		"&sig=hQ%2B7oZ7l7t40CHWYehUEpZnYQvrGAv9kBy%2FH2yjnztc%3D&se=1700000000"
+)
+
+func TestAzureSASToken(t *testing.T) {
+	expiry := time.Unix(1700000000, 0)
+
+	token, err := AzureSASToken("myhub.azure-devices.net/devices/device-1", testSASKey, "", expiry)
+	if err != nil || token != testSAS {
+		t.Error("unexpected token =", token, "err =", err)
+	}
+
+	token, err = AzureSASToken("myhub.azure-devices.net/devices/device-1", testSASKey, "iothubowner", expiry)
+	if err != nil || token != testSAS+"&skn=iothubowner" {
+		t.Error("unexpected token with policy =", token, "err =", err)
+	}
+
+	if _, err := AzureSASToken("myhub.azure-devices.net/devices/device-1", "not base64", "", expiry); err != ErrAzureSASKey {
+		t.Error("unexpected error =", err)
+	}
+}
+
+func TestAzureSASCredentials(t *testing.T) {
+	defer func() { now = time.Now }()
+
+	provider := AzureSASCredentials("myhub.azure-devices.net", "device-1", testSASKey, 0)
+	for _, ts := range []int64{1700000000 - int64(AzureSASTTL/time.Second), 1800000000} {
+		now = func() time.Time { return time.Unix(ts, 0) }
+
+		username, password, err := provider(context.Background(), "myhub.azure-devices.net:8883")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if username != "myhub.azure-devices.net/device-1/?api-version="+AzureAPIVersion {
+			t.Error("unexpected username =", username)
+		}
+
+		// regenerated with the expiry of every attempt
+		expiry := strconv.FormatInt(ts+int64(AzureSASTTL/time.Second), 10)
+		if !strings.HasSuffix(string(password), "&se="+expiry) {
+			t.Error("unexpected password =", string(password), "expiry =", expiry)
+		}
+		if ts == 1700000000-int64(AzureSASTTL/time.Second) && string(password) != testSAS {
+			t.Error("unexpected password =", string(password))
+		}
+	}
+}
+
+func TestNewAzureIoTOptions(t *testing.T) {
+	server, options, err := NewAzureIoTOptions("myhub.azure-devices.net", "device-1", testSASKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server != "myhub.azure-devices.net:8883" {
+		t.Error("unexpected server =", server)
+	}
+
+	client, err := libmqtt.NewClient(options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Destroy(true)
+
+	for expected, args := range map[error][3]string{
+		ErrAzureHub:      {"", "device-1", testSASKey},
+		ErrAzureDeviceID: {"myhub.azure-devices.net", "device/1", testSASKey},
+		ErrAzureSASKey:   {"myhub.azure-devices.net", "device-1", "not base64"},
+	} {
+		if _, _, err := NewAzureIoTOptions(args[0], args[1], args[2]); err != expected {
+			t.Errorf("expected %v, got %v", expected, err)
+		}
+	}
+}
+
+func TestValidAzureDeviceID(t *testing.T) {
+	for id, valid := range map[string]bool{
+		"device-1":                         true,
+		"a.b+c%d_e#f*g?h!i(j)k,l:m=n@o$p'": true,
+		"":                                 false,
+		"device/1":                         false,
+		"device 1":                         false,
+		"设备":                               false,
+		strings.Repeat("a", 128):           true,
+		strings.Repeat("a", 129):           false,
+	} {
+		if validAzureDeviceID(id) != valid {
+			t.Error("unexpected validation of id =", id, "want =", valid)
+		}
+	}
+}
+
+func TestAzureTopics(t *testing.T) {
+	for topic, expected := range map[string]string{
+		AzureTelemetryTopic("device-1"):    "devices/device-1/messages/events/",
+		AzureC2DFilter("device-1"):         "devices/device-1/messages/devicebound/#",
+		AzureTwinGetTopic("1"):             "$iothub/twin/GET/?$rid=1",
+		AzureTwinReportedTopic("2"):        "$iothub/twin/PATCH/properties/reported/?$rid=2",
+		AzureMethodResponseTopic(200, "3"): "$iothub/methods/res/200/?$rid=3",
+	} {
+		if topic != expected {
+			t.Error("unexpected topic =", topic, "want =", expected)
+		}
+	}
+
+	for _, filter := range []string{AzureTwinResponseFilter, AzureTwinDesiredFilter, AzureMethodFilter, AzureC2DFilter("device-1")} {
+		if err := libmqtt.ValidateTopicFilter(filter); err != nil {
+			t.Error("invalid filter =", filter, "err =", err)
+		}
+	}
+
+	status, rid, ok := ParseAzureTwinResponse("$iothub/twin/res/204/?$rid=2&$version=5")
+	if !ok || status != 204 || rid != "2" {
+		t.Error("unexpected response, status =", status, "rid =", rid, "ok =", ok)
+	}
+
+	for _, topic := range []string{"$iothub/twin/res/204", "$iothub/twin/res/ok/?$rid=2", AzureTelemetryTopic("device-1")} {
+		if _, _, ok := ParseAzureTwinResponse(topic); ok {
+			t.Error("parsed bad response topic =", topic)
+		}
+	}
+}
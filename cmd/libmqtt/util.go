@@ -17,16 +17,20 @@
 package main
 
 import (
+	"math"
+
 	mqtt "github.com/goiiot/libmqtt"
 )
 
 func connHandler(client mqtt.Client, server string, code byte, err error) {
-	if err != nil {
-		println("\nconnect to server error:", err)
-	} else if code != mqtt.CodeSuccess {
-		println("\nconnection rejected by server, code:", code)
-	} else {
+	switch {
+	case err == nil:
 		println("\nconnected to server")
+	case code != mqtt.CodeSuccess && code != math.MaxUint8:
+		// refused by server with the ConnAck code
+		println("\nconnection rejected by server, code:", code, "error:", err.Error())
+	default:
+		println("\nconnect to server error:", err.Error())
 	}
 	print(lineStart)
 }
@@ -0,0 +1,137 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+)
+
+// ErrCodecUnsupportedType is returned by ProtobufCodec if the value is not
+// a protobuf message with Marshal and Unmarshal methods
+var ErrCodecUnsupportedType = errors.New("type not supported by codec ")
+
+// Codec encodes and decodes typed messages (see SubscribeTyped and
+// PublishTyped)
+type Codec interface {
+	// Marshal encodes v as the payload
+	Marshal(v interface{}) ([]byte, error)
+	// Unmarshal decodes the payload into v, v is always a pointer
+	Unmarshal(data []byte, v interface{}) error
+	// ContentType is the MQTT 5 content type property of the payloads
+	ContentType() string
+}
+
+// CodecErrorHandleFunc handles the payload failed to decode by the codec
+// of SubscribeTyped, err is the error returned by the codec
+type CodecErrorHandleFunc func(client Client, topic string, payload []byte, err error)
+
+// WithCodecErrorHandleFunc set the handler of payloads failed to decode by
+// the codec of SubscribeTyped, the typed handler is not called for these
+// payloads if set (by default the error is passed to the typed handler)
+func WithCodecErrorHandleFunc(handler CodecErrorHandleFunc) Option {
+	return func(c *AsyncClient, options *connectOptions) error {
+		c.codecHandler = handler
+		return nil
+	}
+}
+
+// JSONCodec encodes messages with encoding/json
+type JSONCodec struct{}
+
+// Marshal v with json.Marshal
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal data with json.Unmarshal
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// ContentType of JSONCodec is "application/json"
+func (JSONCodec) ContentType() string {
+	return "application/json"
+}
+
+// ProtobufCodec encodes protobuf messages with their Marshal and Unmarshal
+// methods (e.g. messages generated by gogo/protobuf), libmqtt doesn't
+// depend on a protobuf runtime, for messages without these methods (e.g.
+// google.golang.org/protobuf), implement Codec with proto.Marshal and
+// proto.Unmarshal instead
+type ProtobufCodec struct{}
+
+type protoMarshaler interface {
+	Marshal() ([]byte, error)
+}
+
+type protoUnmarshaler interface {
+	Unmarshal(data []byte) error
+}
+
+// Marshal the protobuf message
+func (ProtobufCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(protoMarshaler)
+	if !ok {
+		return nil, ErrCodecUnsupportedType
+	}
+	return m.Marshal()
+}
+
+// Unmarshal data into the protobuf message, v can be a pointer to a
+// message pointer, which is allocated if nil
+func (ProtobufCodec) Unmarshal(data []byte, v interface{}) error {
+	if rv := reflect.ValueOf(v); rv.Kind() == reflect.Ptr && !rv.IsNil() && rv.Elem().Kind() == reflect.Ptr {
+		if rv.Elem().IsNil() {
+			rv.Elem().Set(reflect.New(rv.Elem().Type().Elem()))
+		}
+		v = rv.Elem().Interface()
+	}
+
+	m, ok := v.(protoUnmarshaler)
+	if !ok {
+		return ErrCodecUnsupportedType
+	}
+	return m.Unmarshal(data)
+}
+
+// ContentType of ProtobufCodec is "application/x-protobuf"
+func (ProtobufCodec) ContentType() string {
+	return "application/x-protobuf"
+}
+
+// publishEncoded publishes the encoded payload, the content type property
+// is set with MQTT 5 (options can override it)
+func (c *AsyncClient) publishEncoded(topic string, payload []byte, contentType string, options []PubOption) error {
+	if c.options.protoVersion >= V5 && contentType != "" {
+		options = append([]PubOption{PubContentType(contentType)}, options...)
+	}
+	return c.PublishWith(topic, payload, options...)
+}
+
+// codecError sends the decode error to the codec error handler, returns
+// false if no handler set
+func (c *AsyncClient) codecError(topic string, payload []byte, err error) bool {
+	if c.codecHandler == nil {
+		return false
+	}
+
+	c.log.e("CLI decode payload failed, topic =", topic, "err =", err)
+	c.codecHandler(c, topic, payload, err)
+	return true
+}
@@ -0,0 +1,118 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"errors"
+	"testing"
+)
+
+// testProtoMsg is a protobuf message with gogo/protobuf style methods
+type testProtoMsg struct {
+	data string
+}
+
+func (m *testProtoMsg) Marshal() ([]byte, error) {
+	return []byte(m.data), nil
+}
+
+func (m *testProtoMsg) Unmarshal(data []byte) error {
+	if len(data) == 0 {
+		return errors.New("empty message")
+	}
+	m.data = string(data)
+	return nil
+}
+
+func TestJSONCodec(t *testing.T) {
+	type msg struct {
+		Foo string `json:"foo"`
+	}
+
+	codec := JSONCodec{}
+	data, err := codec.Marshal(&msg{Foo: "bar"})
+	if err != nil || string(data) != `{"foo":"bar"}` {
+		t.Error("marshal failed, data =", string(data), "err =", err)
+	}
+
+	var decoded msg
+	if err := codec.Unmarshal(data, &decoded); err != nil || decoded.Foo != "bar" {
+		t.Error("unmarshal failed, msg =", decoded, "err =", err)
+	}
+
+	if codec.ContentType() != "application/json" {
+		t.Error("unexpected content type =", codec.ContentType())
+	}
+}
+
+func TestProtobufCodec(t *testing.T) {
+	codec := ProtobufCodec{}
+	data, err := codec.Marshal(&testProtoMsg{data: "foo"})
+	if err != nil || string(data) != "foo" {
+		t.Error("marshal failed, data =", string(data), "err =", err)
+	}
+
+	var msg testProtoMsg
+	if err := codec.Unmarshal(data, &msg); err != nil || msg.data != "foo" {
+		t.Error("unmarshal failed, msg =", msg, "err =", err)
+	}
+
+	// message pointer allocated
+	var ptr *testProtoMsg
+	if err := codec.Unmarshal(data, &ptr); err != nil || ptr == nil || ptr.data != "foo" {
+		t.Error("unmarshal to pointer failed, msg =", ptr, "err =", err)
+	}
+
+	if _, err := codec.Marshal("foo"); err != ErrCodecUnsupportedType {
+		t.Error("unexpected marshal error =", err)
+	}
+
+	var s string
+	if err := codec.Unmarshal(data, &s); err != ErrCodecUnsupportedType {
+		t.Error("unexpected unmarshal error =", err)
+	}
+}
+
+func TestClient_PublishEncoded(t *testing.T) {
+	for version, expected := range map[ProtoVersion]string{V311: "", V5: "application/json"} {
+		c := defaultClient()
+		c.options.protoVersion = version
+
+		if err := c.publishEncoded("/foo", []byte("{}"), "application/json", nil); err != nil {
+			t.Error(err)
+			continue
+		}
+
+		p := (<-c.sendCh).(*PublishPacket)
+		var contentType string
+		if p.Props != nil {
+			contentType = p.Props.ContentType
+		}
+		if contentType != expected {
+			t.Error("unexpected content type =", contentType, "version =", version)
+		}
+	}
+
+	// content type overridden by options
+	c := defaultClient()
+	c.options.protoVersion = V5
+	if err := c.publishEncoded("/foo", nil, "application/json", []PubOption{PubContentType("text/plain")}); err != nil {
+		t.Error(err)
+	} else if p := (<-c.sendCh).(*PublishPacket); p.Props.ContentType != "text/plain" {
+		t.Error("content type not overridden =", p.Props.ContentType)
+	}
+}
@@ -0,0 +1,60 @@
+//go:build go1.18
+// +build go1.18
+
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+// SubscribeTyped subscribes the topic (filter) and registers the handler
+// receiving payloads decoded by the codec as T
+//
+// payloads failed to decode are passed to the handler with the zero T and
+// the codec error, or to the handler set by WithCodecErrorHandleFunc, in
+// manual ack mode, the packet is acked once the handler returned
+func SubscribeTyped[T any](c Client, topic string, qos QosLevel, codec Codec, handler func(topic string, msg T, err error)) {
+	if c == nil || codec == nil || handler == nil {
+		return
+	}
+
+	c.HandlePublish(topic, func(client Client, p *PublishPacket) {
+		var msg T
+		if err := codec.Unmarshal(p.Payload, &msg); err != nil {
+			if !c.codecError(p.TopicName, p.Payload, err) {
+				var zero T
+				handler(p.TopicName, zero, err)
+			}
+			client.Ack(p)
+			return
+		}
+
+		handler(p.TopicName, msg, nil)
+		client.Ack(p)
+	})
+	c.Subscribe(&Topic{Name: topic, Qos: qos})
+}
+
+// PublishTyped publishes the message encoded by the codec to the topic,
+// with MQTT 5, the content type property is set as the codec's content
+// type (unless set by options), returns the encode error or the error of
+// PublishWith
+func PublishTyped[T any](c Client, topic string, msg T, codec Codec, options ...PubOption) error {
+	payload, err := codec.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return c.publishEncoded(topic, payload, codec.ContentType(), options)
+}
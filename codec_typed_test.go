@@ -0,0 +1,116 @@
+//go:build go1.18
+// +build go1.18
+
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"testing"
+)
+
+type testTypedMsg struct {
+	Foo string `json:"foo"`
+}
+
+func TestSubscribeTyped(t *testing.T) {
+	c := defaultClient()
+
+	var (
+		msgs []testTypedMsg
+		errs []error
+	)
+	SubscribeTyped(c, "/foo/+", Qos1, JSONCodec{}, func(topic string, msg testTypedMsg, err error) {
+		if topic != "/foo/bar" {
+			t.Error("unexpected topic =", topic)
+		}
+		msgs, errs = append(msgs, msg), append(errs, err)
+	})
+
+	if sub := (<-c.sendCh).(*SubscribePacket); len(sub.Topics) != 1 || sub.Topics[0].Name != "/foo/+" || sub.Topics[0].Qos != Qos1 {
+		t.Error("unexpected subscribe =", sub)
+	}
+
+	c.dispatch(&PublishPacket{TopicName: "/foo/bar", Payload: []byte(`{"foo":"bar"}`)})
+	c.dispatch(&PublishPacket{TopicName: "/foo/bar", Payload: []byte(`{`)})
+	if len(msgs) != 2 || msgs[0].Foo != "bar" || errs[0] != nil {
+		t.Fatal("unexpected messages =", msgs, "errors =", errs)
+	}
+	if msgs[1].Foo != "" || errs[1] == nil {
+		t.Error("decode error not passed to handler, msg =", msgs[1])
+	}
+
+	// decode errors sent to the codec error handler
+	var payloads []string
+	if err := WithCodecErrorHandleFunc(func(client Client, topic string, payload []byte, err error) {
+		if err == nil {
+			t.Error("no decode error")
+		}
+		payloads = append(payloads, string(payload))
+	})(c, &c.options); err != nil {
+		t.Fatal(err)
+	}
+
+	c.dispatch(&PublishPacket{TopicName: "/foo/bar", Payload: []byte(`[`)})
+	if len(msgs) != 2 || len(payloads) != 1 || payloads[0] != "[" {
+		t.Error("decode error not sent to the codec error handler, payloads =", payloads)
+	}
+}
+
+func TestPublishTyped(t *testing.T) {
+	c := defaultClient()
+	c.options.protoVersion = V5
+
+	if err := PublishTyped(c, "/foo", testTypedMsg{Foo: "bar"}, JSONCodec{}, PubQoS(Qos1)); err != nil {
+		t.Fatal(err)
+	}
+
+	p := (<-c.sendCh).(*PublishPacket)
+	if string(p.Payload) != `{"foo":"bar"}` || p.Qos != Qos1 || p.Props == nil || p.Props.ContentType != "application/json" {
+		t.Error("unexpected publish =", p)
+	}
+
+	if err := PublishTyped(c, "/foo", "bar", ProtobufCodec{}); err != ErrCodecUnsupportedType {
+		t.Error("unexpected error =", err)
+	}
+}
+
+func TestSubscribeTyped_ManualAck(t *testing.T) {
+	c := defaultClient()
+	c.manualAck = true
+	conn := &clientConn{parent: c, name: "test", logicSendC: make(chan Packet, 10)}
+
+	SubscribeTyped(c, "/foo", Qos1, JSONCodec{}, func(topic string, msg testTypedMsg, err error) {})
+	<-c.sendCh
+
+	for _, p := range []*PublishPacket{
+		{TopicName: "/foo", Qos: Qos1, PacketID: 1, Payload: []byte(`{"foo":"bar"}`)},
+		{TopicName: "/foo", Qos: Qos1, PacketID: 2, Payload: []byte(`{`)},
+	} {
+		conn.addPendingAck(p)
+		c.dispatch(p)
+	}
+
+	if len(conn.logicSendC) != 2 || len(conn.pendingAcks) != 0 {
+		t.Fatal("typed deliveries not acked, acks =", len(conn.logicSendC))
+	}
+	for i := 1; i <= 2; i++ {
+		if ack, ok := (<-conn.logicSendC).(*PubAckPacket); !ok || ack.PacketID != uint16(i) {
+			t.Error("unexpected ack =", ack)
+		}
+	}
+}
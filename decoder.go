@@ -18,11 +18,13 @@ package libmqtt
 
 import (
 	"errors"
+	"fmt"
 	"io"
 )
 
 var (
-	// ErrDecodeBadPacket is the error happened when trying to decode a none MQTT packet
+	// ErrDecodeBadPacket is the error happened when trying to decode a none MQTT packet,
+	// packets malformed are returned as MalformedPacketError wrapping it
 	ErrDecodeBadPacket = errors.New("none MQTT packet")
 
 	// ErrDecodeNoneV311Packet is the error happened when
@@ -34,54 +36,326 @@ var (
 	ErrDecodeNoneV5Packet = errors.New("none MQTT v5 packet")
 )
 
-// Decode will decode one mqtt packet
+// MalformedPacketError is the error happened when decoding a malformed
+// packet (e.g. length fields exceeding the remaining length, or MQTT 5
+// packets with invalid properties), a packet larger than the maximum packet
+// size, or receiving a packet violating the protocol (e.g. SubAck codes not
+// matching topics subscribed, or invalid topic aliases), the connection should be closed by sending a
+// DisconnPacket with the Code
+type MalformedPacketError struct {
+	// Code is CodeMalformedPacket, CodeProtoError, CodePacketTooLarge,
+	// CodeTopicAliasInvalid or CodeReceiveMaxExceeded
+	Code byte
+	// Reason describes the error
+	Reason string
+}
+
+func (e *MalformedPacketError) Error() string {
+	switch e.Code {
+	case CodeProtoError:
+		return "MQTT protocol error: " + e.Reason
+	case CodePacketTooLarge:
+		return "MQTT packet too large: " + e.Reason
+	case CodeTopicAliasInvalid:
+		return "MQTT topic alias invalid: " + e.Reason
+	}
+	return "malformed MQTT packet: " + e.Reason
+}
+
+// ReasonCode is the reason code to disconnect with
+func (e *MalformedPacketError) ReasonCode() byte {
+	return e.Code
+}
+
+// Unwrap returns ErrDecodeBadPacket
+func (e *MalformedPacketError) Unwrap() error {
+	return ErrDecodeBadPacket
+}
+
+// Decode will decode one mqtt packet (see DecodePacket for any io.Reader),
+// malformed packets are returned as MalformedPacketError, the buffer of the
+// packet body grows with the data read, not allocated at once by the
+// remaining length in the fixed header
 func Decode(version ProtoVersion, r BufferedReader) (Packet, error) {
+	return decode(version, r, 0, nil, nil)
+}
+
+// decode one mqtt packet, packets larger than maxSize (fixed header
+// included, 0 for no limit) are rejected before the body read, QoS0 publish
+// packets are taken from the pool if the pool is not nil, payload of publish
+// packets with topic accepted by isStream (if not nil) is not read but set
+// as the PayloadReader
+func decode(version ProtoVersion, r BufferedReader, maxSize int, pool *publishPool, isStream func(topic string) bool) (Packet, error) {
 	header, err := r.ReadByte()
 	if err != nil {
 		return nil, err
 	}
 
-	bytesToRead, _ := getRemainLength(r)
+	bytesToRead, n, err := readRemainLength(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if maxSize > 0 && 1+n+bytesToRead > maxSize {
+		return nil, &MalformedPacketError{
+			Code:   CodePacketTooLarge,
+			Reason: fmt.Sprintf("packet size %d exceeds the maximum packet size %d", 1+n+bytesToRead, maxSize),
+		}
+	}
+
+	if header>>4 == CtrlPublish && header&0x06 == 0x06 {
+		return nil, malformed("publish packet with QoS 3")
+	}
+
 	if bytesToRead == 0 {
 		switch header >> 4 {
 		case CtrlPingReq:
-			PingReqPacket = &pingReqPacket{}
-			PingReqPacket.SetVersion(version)
-			return PingReqPacket, nil
+			// not the shared PingReqPacket, which may be sent concurrently
+			pkt := &pingReqPacket{}
+			pkt.SetVersion(version)
+			return pkt, nil
 		case CtrlPingResp:
-			PingRespPacket = &pingRespPacket{}
-			PingRespPacket.SetVersion(version)
-			return PingRespPacket, nil
+			pkt := &pingRespPacket{}
+			pkt.SetVersion(version)
+			return pkt, nil
 		case CtrlDisConn:
-			if version == V311 {
-				return &DisconnPacket{}, nil
+			// mqtt v5 reason code omitted if normal disconnection without props
+			pkt := &DisconnPacket{}
+			pkt.SetVersion(version)
+			return pkt, nil
+		case CtrlAuth:
+			if version != V5 {
+				return nil, malformed("auth packet in MQTT v3.1.1")
 			}
-			// mqtt v5 has props
-			return nil, ErrDecodeBadPacket
+
+			// reason code omitted if success without props
+			pkt := &AuthPacket{}
+			pkt.SetVersion(version)
+			return pkt, nil
 		default:
-			return nil, ErrDecodeBadPacket
+			return nil, malformed("packet body missing")
 		}
 	} else if bytesToRead < 2 {
-		return nil, ErrDecodeBadPacket
+		// mqtt v5 property length omitted if no props
+		if t := header >> 4; version != V5 || t != CtrlDisConn && t != CtrlAuth {
+			return nil, malformed("packet too short")
+		}
+	}
+
+	if isStream != nil && header>>4 == CtrlPublish {
+		return decodeStreamPublish(version, header, bytesToRead, r, pool, isStream)
 	}
 
-	body := make([]byte, bytesToRead)
-	if _, err = io.ReadFull(r, body[:]); err != nil {
+	body, pub, err := readDecodeBody(r, header, bytesToRead, nil, pool)
+	if err != nil {
 		return nil, err
 	}
 
+	return decodeBody(version, header, body, pub)
+}
+
+// malformed returns the MalformedPacketError of CodeMalformedPacket
+func malformed(reason string) error {
+	return &MalformedPacketError{Code: CodeMalformedPacket, Reason: reason}
+}
+
+// checkTopicAlias rejects the Topic Alias 0 of the publish packet, which is
+// not permitted (the alias is not set if absent)
+func checkTopicAlias(props map[byte][]byte, p *PublishProps) error {
+	if _, ok := props[propKeyTopicAlias]; ok && p.TopicAlias == 0 {
+		return &MalformedPacketError{Code: CodeTopicAliasInvalid, Reason: "topic alias 0"}
+	}
+	return nil
+}
+
+// readRemainLength reads the remaining length of the fixed header,
+// returns the length and bytes of it
+func readRemainLength(r io.ByteReader) (int, int, error) {
+	length := 0
+	for i := 0; i < 4; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, 0, err
+		}
+
+		length |= int(b&127) << (7 * i)
+		if b&128 == 0 {
+			return length, i + 1, nil
+		}
+	}
+	return 0, 0, malformed("remaining length exceeds 4 bytes")
+}
+
+// readDecodeBody reads the packet body of size bytes with prefix already
+// read from r, bodies larger than maxDecodePreAlloc are read into buffers
+// growing with the data read, so that the remaining length can not allocate
+// more than twice of the data received
+func readDecodeBody(r io.Reader, header byte, size int, prefix []byte, pool *publishPool) ([]byte, *PublishPacket, error) {
+	if size <= maxDecodePreAlloc {
+		body, pub := newDecodeBody(header, size, pool)
+		n := copy(body, prefix)
+		if _, err := io.ReadFull(r, body[n:]); err != nil {
+			pub.release()
+			return nil, nil, err
+		}
+		return body, pub, nil
+	}
+
+	body := make([]byte, len(prefix), len(prefix)+maxDecodePreAlloc)
+	copy(body, prefix)
+	for len(body) < size {
+		if len(body) == cap(body) {
+			n := 2 * cap(body)
+			if n > size {
+				n = size
+			}
+
+			grown := make([]byte, len(body), n)
+			copy(grown, body)
+			body = grown
+		}
+
+		end := cap(body)
+		if end > size {
+			end = size
+		}
+
+		n, err := io.ReadFull(r, body[len(body):end])
+		body = body[:len(body)+n]
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, nil, err
+		}
+	}
+	return body, nil, nil
+}
+
+// newDecodeBody allocates the packet body to decode, QoS0 publish packet
+// is returned with the body if pool is not nil
+func newDecodeBody(header byte, size int, pool *publishPool) ([]byte, *PublishPacket) {
+	if pool != nil && header>>4 == CtrlPublish && header&0x06>>1 == Qos0 {
+		pub := pool.get(size)
+		return pub.buf, pub
+	}
+
+	return make([]byte, size), nil
+}
+
+func decodeBody(version ProtoVersion, header byte, body []byte, pub *PublishPacket) (Packet, error) {
+	var (
+		pkt Packet
+		err error
+	)
 	switch version {
-	case V311:
-		return decodeV311Packet(header, body)
+	case V31, V311:
+		pkt, err = decodeV311Packet(header, body, pub)
+		if err == nil && version == V31 && pkt.Type() != CtrlConn {
+			// wire format is the same as MQTT 3.1.1
+			pkt.SetVersion(V31)
+		}
 	case V5:
-		return decodeV5Packet(header, body)
+		pkt, err = decodeV5Packet(header, body, pub)
 	default:
-		return nil, ErrUnsupportedVersion
+		err = ErrUnsupportedVersion
+	}
+
+	if err != nil {
+		pub.release()
+		return nil, err
 	}
+	return pkt, nil
+}
+
+// decodeStreamPublish decodes the publish packet with only the variable
+// header read if the topic is accepted by isStream, the payload is left in r
+// and set as the PayloadReader, which MUST be read (or discarded) before
+// decoding next packet
+func decodeStreamPublish(version ProtoVersion, header byte, remainLength int, r BufferedReader, pool *publishPool, isStream func(topic string) bool) (Packet, error) {
+	topicLen := make([]byte, 2)
+	if _, err := io.ReadFull(r, topicLen); err != nil {
+		return nil, err
+	}
+
+	consumed := 2 + int(getUint16(topicLen))
+	if consumed > remainLength {
+		return nil, malformed("topic name exceeds the remaining length")
+	}
+
+	topic := make([]byte, consumed-2)
+	if _, err := io.ReadFull(r, topic); err != nil {
+		return nil, err
+	}
+
+	if !isStream(string(topic)) {
+		body, pub, err := readDecodeBody(r, header, remainLength, append(topicLen, topic...), pool)
+		if err != nil {
+			return nil, err
+		}
+
+		return decodeBody(version, header, body, pub)
+	}
+
+	pub := &PublishPacket{
+		IsDup:     header&0x08 == 0x08,
+		Qos:       header & 0x06 >> 1,
+		IsRetain:  header&0x01 == 1,
+		TopicName: string(topic),
+	}
+
+	if pub.Qos > Qos0 {
+		if consumed += 2; consumed > remainLength {
+			return nil, malformed("packet id exceeds the remaining length")
+		}
+
+		packetID := make([]byte, 2)
+		if _, err := io.ReadFull(r, packetID); err != nil {
+			return nil, err
+		}
+		pub.PacketID = getUint16(packetID)
+	}
+
+	if version == V5 {
+		propsLen, n, err := readRemainLength(r)
+		if err != nil {
+			return nil, err
+		}
+		if consumed += n + propsLen; consumed > remainLength {
+			return nil, malformed("properties exceed the remaining length")
+		}
+
+		propsBytes, _ := varIntBytes(propsLen)
+		propsBytes = append(propsBytes, make([]byte, propsLen)...)
+		if _, err := io.ReadFull(r, propsBytes[len(propsBytes)-propsLen:]); err != nil {
+			return nil, err
+		}
+
+		props, _, err := getPacketProps(propsBytes, CtrlPublish)
+		if err != nil {
+			return nil, err
+		}
+
+		pub.Props = &PublishProps{}
+		pub.Props.setProps(props)
+		if err := checkTopicAlias(props, pub.Props); err != nil {
+			return nil, err
+		}
+	}
+	pub.ProtoVersion = version
+
+	pub.PayloadLength = int64(remainLength - consumed)
+	pub.PayloadReader = io.LimitReader(r, pub.PayloadLength)
+	return pub, nil
 }
 
 // decode mqtt v3.1.1 packets
-func decodeV311Packet(header byte, body []byte) (Packet, error) {
+//
+// pub is the publish packet to reuse for CtrlPublish, could be nil
+func decodeV311Packet(header byte, body []byte, pub *PublishPacket) (Packet, error) {
 	var err error
 	switch header >> 4 {
 	case CtrlConn:
@@ -91,10 +365,10 @@ func decodeV311Packet(header byte, body []byte) (Packet, error) {
 		}
 
 		if len(body) < 4 {
-			return nil, ErrDecodeBadPacket
+			return nil, malformed("connect flags truncated")
 		}
 
-		if body[0] != byte(V311) {
+		if body[0] != byte(V311) && body[0] != byte(V31) {
 			return nil, ErrDecodeNoneV311Packet
 		}
 
@@ -130,7 +404,7 @@ func decodeV311Packet(header byte, body []byte) (Packet, error) {
 		}
 
 		if hasPassword {
-			if pkt.Password, _, err = getStringData(body); err != nil {
+			if pkt.Password, _, err = getBinaryData(body); err != nil {
 				return nil, err
 			}
 		}
@@ -144,16 +418,17 @@ func decodeV311Packet(header byte, body []byte) (Packet, error) {
 			return nil, err
 		}
 
-		pub := &PublishPacket{
-			IsDup:     header&0x08 == 0x08,
-			Qos:       header & 0x06 >> 1,
-			IsRetain:  header&0x01 == 1,
-			TopicName: topicName,
+		if pub == nil {
+			pub = &PublishPacket{}
 		}
+		pub.IsDup = header&0x08 == 0x08
+		pub.Qos = header & 0x06 >> 1
+		pub.IsRetain = header&0x01 == 1
+		pub.TopicName = topicName
 
 		if pub.Qos > Qos0 {
 			if len(body) < 2 {
-				return nil, ErrDecodeBadPacket
+				return nil, malformed("packet id truncated")
 			}
 
 			pub.PacketID = getUint16(body)
@@ -181,7 +456,7 @@ func decodeV311Packet(header byte, body []byte) (Packet, error) {
 			}
 
 			if len(body) < 1 {
-				return nil, ErrDecodeBadPacket
+				return nil, malformed("subscription options truncated")
 			}
 
 			pkt.Topics = append(pkt.Topics, &Topic{Name: name, Qos: body[0]})
@@ -213,11 +488,13 @@ func decodeV311Packet(header byte, body []byte) (Packet, error) {
 		return &UnsubAckPacket{PacketID: getUint16(body)}, nil
 	}
 
-	return nil, ErrDecodeBadPacket
+	return nil, malformed(fmt.Sprintf("unexpected packet type %d", header>>4))
 }
 
 // decode mqtt v5 packets
-func decodeV5Packet(header byte, body []byte) (Packet, error) {
+//
+// pub is the publish packet to reuse for CtrlPublish, could be nil
+func decodeV5Packet(header byte, body []byte, pub *PublishPacket) (Packet, error) {
 	var err error
 	switch header >> 4 {
 	case CtrlConn:
@@ -227,7 +504,7 @@ func decodeV5Packet(header byte, body []byte) (Packet, error) {
 		}
 
 		if len(next) < 5 {
-			return nil, ErrDecodeBadPacket
+			return nil, malformed("connect flags truncated")
 		}
 
 		if next[0] != byte(V5) {
@@ -245,11 +522,11 @@ func decodeV5Packet(header byte, body []byte) (Packet, error) {
 			Keepalive:    getUint16(next[2:4]),
 			Props:        &ConnProps{},
 		}
-		pkt.ProtoVersion = ProtoVersion(body[0])
+		pkt.ProtoVersion = ProtoVersion(next[0])
 
 		// read properties
 		var props map[byte][]byte
-		props, next, err = getRawProps(next[4:])
+		props, next, err = getPacketProps(next[4:], CtrlConn)
 		if err != nil {
 			return nil, err
 		}
@@ -260,6 +537,12 @@ func decodeV5Packet(header byte, body []byte) (Packet, error) {
 		}
 
 		if pkt.IsWill {
+			if props, next, err = getPacketProps(next, ctrlWill); err != nil {
+				return nil, err
+			}
+			pkt.WillProps = &WillProps{}
+			pkt.WillProps.setProps(props)
+
 			if pkt.WillTopic, next, err = getStringData(next); err != nil {
 				return nil, err
 			}
@@ -275,7 +558,7 @@ func decodeV5Packet(header byte, body []byte) (Packet, error) {
 		}
 
 		if hasPassword {
-			if pkt.Password, _, err = getStringData(next); err != nil {
+			if pkt.Password, _, err = getBinaryData(next); err != nil {
 				return nil, err
 			}
 		}
@@ -289,7 +572,7 @@ func decodeV5Packet(header byte, body []byte) (Packet, error) {
 			Props:   &ConnAckProps{},
 		}
 
-		props, _, err := getRawProps(body[2:])
+		props, _, err := getPacketProps(body[2:], CtrlConnAck)
 		if err != nil {
 			return nil, err
 		}
@@ -303,17 +586,18 @@ func decodeV5Packet(header byte, body []byte) (Packet, error) {
 			return nil, err
 		}
 
-		pub := &PublishPacket{
-			IsDup:     header&0x08 == 0x08,
-			Qos:       header & 0x06 >> 1,
-			IsRetain:  header&0x01 == 1,
-			TopicName: topicName,
-			Props:     &PublishProps{},
+		if pub == nil {
+			pub = &PublishPacket{}
 		}
+		pub.IsDup = header&0x08 == 0x08
+		pub.Qos = header & 0x06 >> 1
+		pub.IsRetain = header&0x01 == 1
+		pub.TopicName = topicName
+		pub.Props = &PublishProps{}
 
 		if pub.Qos > Qos0 {
 			if len(body) < 2 {
-				return nil, ErrDecodeBadPacket
+				return nil, malformed("packet id truncated")
 			}
 
 			pub.PacketID = getUint16(body)
@@ -321,11 +605,14 @@ func decodeV5Packet(header byte, body []byte) (Packet, error) {
 		}
 
 		var props map[byte][]byte
-		props, body, err = getRawProps(body)
+		props, body, err = getPacketProps(body, CtrlPublish)
 		if err != nil {
 			return nil, err
 		}
 		pub.Props.setProps(props)
+		if err := checkTopicAlias(props, pub.Props); err != nil {
+			return nil, err
+		}
 
 		pub.Payload = body
 		pub.ProtoVersion = V5
@@ -334,7 +621,7 @@ func decodeV5Packet(header byte, body []byte) (Packet, error) {
 		code := byte(0)
 
 		if len(body) < 2 {
-			return nil, ErrDecodeBadPacket
+			return nil, malformed("packet id truncated")
 		} else if len(body) > 2 {
 			code = body[2]
 		}
@@ -346,7 +633,7 @@ func decodeV5Packet(header byte, body []byte) (Packet, error) {
 		}
 
 		if len(body) > 3 {
-			props, _, err := getRawProps(body[3:])
+			props, _, err := getPacketProps(body[3:], CtrlPubAck)
 			if err != nil {
 				return nil, err
 			}
@@ -358,7 +645,7 @@ func decodeV5Packet(header byte, body []byte) (Packet, error) {
 		code := byte(0)
 
 		if len(body) < 2 {
-			return nil, ErrDecodeBadPacket
+			return nil, malformed("packet id truncated")
 		} else if len(body) > 2 {
 			code = body[2]
 		}
@@ -370,7 +657,7 @@ func decodeV5Packet(header byte, body []byte) (Packet, error) {
 		}
 
 		if len(body) > 3 {
-			props, _, err := getRawProps(body[3:])
+			props, _, err := getPacketProps(body[3:], CtrlPubRecv)
 			if err != nil {
 				return nil, err
 			}
@@ -382,7 +669,7 @@ func decodeV5Packet(header byte, body []byte) (Packet, error) {
 		code := byte(0)
 
 		if len(body) < 2 {
-			return nil, ErrDecodeBadPacket
+			return nil, malformed("packet id truncated")
 		} else if len(body) > 2 {
 			code = body[2]
 		}
@@ -394,7 +681,7 @@ func decodeV5Packet(header byte, body []byte) (Packet, error) {
 		}
 
 		if len(body) > 3 {
-			props, _, err := getRawProps(body[3:])
+			props, _, err := getPacketProps(body[3:], CtrlPubRel)
 			if err != nil {
 				return nil, err
 			}
@@ -406,7 +693,7 @@ func decodeV5Packet(header byte, body []byte) (Packet, error) {
 		code := byte(0)
 
 		if len(body) < 2 {
-			return nil, ErrDecodeBadPacket
+			return nil, malformed("packet id truncated")
 		} else if len(body) > 2 {
 			code = body[2]
 		}
@@ -418,7 +705,7 @@ func decodeV5Packet(header byte, body []byte) (Packet, error) {
 		}
 
 		if len(body) > 3 {
-			props, _, err := getRawProps(body[3:])
+			props, _, err := getPacketProps(body[3:], CtrlPubComp)
 			if err != nil {
 				return nil, err
 			}
@@ -432,7 +719,7 @@ func decodeV5Packet(header byte, body []byte) (Packet, error) {
 			Props:    &SubscribeProps{},
 		}
 
-		props, next, err := getRawProps(body[2:])
+		props, next, err := getPacketProps(body[2:], CtrlSubscribe)
 		if err != nil {
 			return nil, err
 		}
@@ -445,7 +732,7 @@ func decodeV5Packet(header byte, body []byte) (Packet, error) {
 			}
 
 			if len(next) < 1 {
-				return nil, ErrDecodeBadPacket
+				return nil, malformed("subscription options truncated")
 			}
 
 			pkt.Topics = append(pkt.Topics, &Topic{Name: name, Qos: next[0]})
@@ -459,7 +746,7 @@ func decodeV5Packet(header byte, body []byte) (Packet, error) {
 			Props:    &SubAckProps{},
 		}
 
-		props, next, err := getRawProps(body[2:])
+		props, next, err := getPacketProps(body[2:], CtrlSubAck)
 		if err != nil {
 			return nil, err
 		}
@@ -476,7 +763,7 @@ func decodeV5Packet(header byte, body []byte) (Packet, error) {
 			Props:    &UnsubProps{},
 		}
 
-		props, next, err := getRawProps(body[2:])
+		props, next, err := getPacketProps(body[2:], CtrlUnSub)
 		if err != nil {
 			return nil, err
 		}
@@ -498,11 +785,13 @@ func decodeV5Packet(header byte, body []byte) (Packet, error) {
 			Props:    &UnsubAckProps{},
 		}
 
-		props, _, err := getRawProps(body[2:])
+		props, next, err := getPacketProps(body[2:], CtrlUnSubAck)
 		if err != nil {
 			return nil, err
 		}
 		pkt.Props.setProps(props)
+
+		pkt.Codes = append([]byte(nil), next...)
 		pkt.ProtoVersion = V5
 		return pkt, nil
 	case CtrlDisConn:
@@ -511,7 +800,7 @@ func decodeV5Packet(header byte, body []byte) (Packet, error) {
 			Props: &DisconnProps{},
 		}
 
-		props, _, err := getRawProps(body[1:])
+		props, _, err := getPacketProps(body[1:], CtrlDisConn)
 		if err != nil {
 			return nil, err
 		}
@@ -524,7 +813,7 @@ func decodeV5Packet(header byte, body []byte) (Packet, error) {
 			Props: &AuthProps{},
 		}
 
-		props, _, err := getRawProps(body[1:])
+		props, _, err := getPacketProps(body[1:], CtrlAuth)
 		if err != nil {
 			return nil, err
 		}
@@ -532,6 +821,6 @@ func decodeV5Packet(header byte, body []byte) (Packet, error) {
 		pkt.ProtoVersion = V5
 		return pkt, nil
 	default:
-		return nil, ErrDecodeBadPacket
+		return nil, malformed(fmt.Sprintf("unexpected packet type %d", header>>4))
 	}
 }
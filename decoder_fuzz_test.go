@@ -0,0 +1,119 @@
+//go:build go1.18
+// +build go1.18
+
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/goiiot/libmqtt/internal/testutil"
+)
+
+// fuzzMaxPacketSize is the maximum packet size of fuzz decoding, packets
+// larger than the input are also rejected by the allocation cap
+const fuzzMaxPacketSize = 1 << 16
+
+// run with
+//
+//	go test -run '^$' -fuzz FuzzDecodeV311
+func FuzzDecodeV311(f *testing.F) {
+	addDecodeSeeds(f, "v311")
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzzDecode(t, V311, data)
+	})
+}
+
+// run with
+//
+//	go test -run '^$' -fuzz FuzzDecodeV5
+func FuzzDecodeV5(f *testing.F) {
+	addDecodeSeeds(f, "v5")
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzzDecode(t, V5, data)
+	})
+}
+
+// addDecodeSeeds adds golden fixtures of the version directory as seeds
+func addDecodeSeeds(f *testing.F, dir string) {
+	files, err := filepath.Glob(filepath.Join("testdata", "packets", dir, "*.hex"))
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	for _, file := range files {
+		r, err := os.Open(file)
+		if err != nil {
+			f.Fatal(err)
+		}
+		data, err := testutil.ReadHex(r)
+		_ = r.Close()
+		if err != nil {
+			f.Fatalf("%s: %v", file, err)
+		}
+		f.Add(data)
+	}
+}
+
+// fuzzDecode decodes data without panic, errors MUST be MalformedPacketError
+// (or the read error of truncated data), packets decoded MUST be decoded
+// again once encoded, and the encoding MUST be stable
+func fuzzDecode(t *testing.T, version ProtoVersion, data []byte) {
+	pkt, err := decode(version, bytes.NewReader(data), fuzzMaxPacketSize, nil, nil)
+	if err != nil {
+		if pkt != nil {
+			t.Fatal("packet returned with error =", err)
+		}
+
+		var malformed *MalformedPacketError
+		if !errors.As(err, &malformed) && err != io.EOF && err != io.ErrUnexpectedEOF &&
+			err != ErrDecodeNoneV311Packet && err != ErrDecodeNoneV5Packet {
+			t.Fatalf("unexpected error type %T = %v", err, err)
+		}
+		return
+	}
+
+	encoded, err := pkt.MarshalBinary()
+	if err != nil {
+		// decoded packets may not be valid to send (e.g. empty topic)
+		return
+	}
+
+	// properties absent are decoded as defaults (e.g. MaxQos of ConnAck),
+	// which may be encoded explicitly, check from the second encoding
+	for i := 0; i < 2; i++ {
+		again, err := Decode(version, bytes.NewReader(encoded))
+		if err != nil {
+			t.Fatalf("encoded packet not decoded, packet = %v, err = %v\n% x", pkt, err, encoded)
+		}
+
+		reencoded, err := again.MarshalBinary()
+		if err != nil {
+			t.Fatalf("decoded packet not encoded, packet = %v, err = %v", again, err)
+		}
+		if i > 0 && !bytes.Equal(encoded, reencoded) {
+			t.Fatalf("encoding not stable, packet = %v\nwant % x\ngot  % x", pkt, encoded, reencoded)
+		}
+		encoded = reencoded
+	}
+}
@@ -18,6 +18,11 @@ package libmqtt
 
 import (
 	"bytes"
+	"errors"
+	"io"
+	"runtime"
+	"strconv"
+	"sync"
 	"testing"
 )
 
@@ -105,3 +110,231 @@ func BenchmarkDecodeOnePacket(b *testing.B) {
 		}
 	}
 }
+
+func TestDecode_Pooled(t *testing.T) {
+	pool := newPublishPool()
+	buf := new(bytes.Buffer)
+	for _, p := range []*PublishPacket{
+		{TopicName: "/foo", Payload: []byte("foo")},
+		{TopicName: "/bar", Payload: []byte("bar")},
+		{TopicName: "/qos1", Qos: Qos1, PacketID: 1, Payload: []byte("qos1")},
+	} {
+		_ = p.WriteTo(buf)
+	}
+
+	foo, err := decode(V311, buf, 0, pool, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	retained := foo.(*PublishPacket)
+	retained.Retain()
+	retained.release()
+
+	bar, err := decode(V311, buf, 0, pool, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copied := bar.(*PublishPacket).Copy()
+	bar.(*PublishPacket).release()
+
+	qos1, err := decode(V311, buf, 0, pool, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if qos1.(*PublishPacket).pool != nil {
+		t.Error("QoS1 packet pooled")
+	}
+
+	// reuse released packets
+	for i := 0; i < 10; i++ {
+		_ = (&PublishPacket{TopicName: "/baz", Payload: []byte("baz")}).WriteTo(buf)
+		p, err := decode(V311, buf, 0, pool, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.(*PublishPacket).release()
+	}
+
+	if retained.TopicName != "/foo" || string(retained.Payload) != "foo" {
+		t.Error("retained packet reused, packet =", retained.TopicName, string(retained.Payload))
+	}
+
+	if copied.TopicName != "/bar" || string(copied.Payload) != "bar" || copied.pool != nil {
+		t.Error("copied packet reused, packet =", copied.TopicName, string(copied.Payload))
+	}
+}
+
+func TestClient_PooledDecode(t *testing.T) {
+	c := defaultClient()
+	_ = WithPooledDecode(true)(c, &c.options)
+	_ = WithHandlerConcurrency(4)(c, &c.options)
+
+	const count = 1000
+	var (
+		mu       sync.Mutex
+		retained []*PublishPacket
+		copied   []*PublishPacket
+		wg       sync.WaitGroup
+	)
+	wg.Add(count)
+	c.HandlePublish("/foo/+", func(client Client, p *PublishPacket) {
+		defer wg.Done()
+
+		mu.Lock()
+		defer mu.Unlock()
+		if len(retained) < len(copied) {
+			p.Retain()
+			retained = append(retained, p)
+		} else {
+			copied = append(copied, p.Copy())
+		}
+	})
+
+	buf := new(bytes.Buffer)
+	for i := 0; i < count; i++ {
+		n := strconv.Itoa(i % 8)
+		_ = (&PublishPacket{TopicName: "/foo/" + n, Payload: []byte(n)}).WriteTo(buf)
+	}
+
+	go c.handleTopicMsg()
+	for i := 0; i < count; i++ {
+		pkt, err := decode(V311, buf, 0, c.pubPool, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.recvCh <- pkt.(*PublishPacket)
+	}
+	wg.Wait()
+	c.exit()
+
+	for _, p := range append(retained, copied...) {
+		if p.TopicName != "/foo/"+string(p.Payload) {
+			t.Fatal("packet reused while retained, topic =", p.TopicName, "payload =", string(p.Payload))
+		}
+	}
+}
+
+func TestDecode_Malformed(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		version ProtoVersion
+		data    []byte
+	}{
+		{"ConnAckShort", V311, []byte{0x20, 0x01, 0x00}},
+		{"PubAckShort", V311, []byte{0x40, 0x01, 0x00}},
+		{"SubscribeShort", V311, []byte{0x82, 0x01, 0x00}},
+		{"UnsubAckEmpty", V311, []byte{0xb0, 0x00}},
+		{"TopicOutOfRange", V311, []byte{0x30, 0x03, 0x00, 0x05, 'a'}},
+		{"PublishQos3", V311, []byte{0x36, 0x03, 0x00, 0x01, 'a'}},
+		{"RemainLength5Bytes", V311, []byte{0x30, 0xff, 0xff, 0xff, 0xff, 0x7f}},
+		{"AuthV311", V311, []byte{0xf0, 0x00}},
+		{"ConnAckShortV5", V5, []byte{0x20, 0x01, 0x00}},
+		{"SubAckShortV5", V5, []byte{0x90, 0x01, 0x00}},
+		{"UnsubShortV5", V5, []byte{0xa2, 0x01, 0x00}},
+		{"PropsOutOfRangeV5", V5, []byte{0x40, 0x04, 0x00, 0x01, 0x00, 0x05}},
+		{"StreamPropsLength5BytesV5", V5, []byte{0x30, 0x08, 0x00, 0x01, 'a', 0xff, 0xff, 0xff, 0xff, 0x7f}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			pkt, err := decode(c.version, bytes.NewReader(c.data), 0, nil, func(string) bool { return true })
+			if pkt != nil {
+				t.Error("malformed packet decoded =", pkt)
+			}
+
+			var e *MalformedPacketError
+			if !errors.As(err, &e) || e.Code != CodeMalformedPacket || !errors.Is(err, ErrDecodeBadPacket) {
+				t.Errorf("unexpected error %T = %v", err, err)
+			}
+		})
+	}
+}
+
+func TestDecode_TopicAliasZero(t *testing.T) {
+	data := []byte{0x30, 0x07, 0x00, 0x01, 'a', 0x03, propKeyTopicAlias, 0x00, 0x00}
+	for _, stream := range []bool{false, true} {
+		pkt, err := decode(V5, bytes.NewReader(data), 0, nil, func(string) bool { return stream })
+		var e *MalformedPacketError
+		if pkt != nil || !errors.As(err, &e) || e.Code != CodeTopicAliasInvalid {
+			t.Errorf("unexpected result of stream = %v, packet = %v, err = %v", stream, pkt, err)
+		}
+	}
+
+	data[8] = 0x01
+	if pkt, err := Decode(V5, bytes.NewReader(data)); err != nil || pkt.(*PublishPacket).Props.TopicAlias != 1 {
+		t.Error("topic alias not decoded, packet =", pkt, "err =", err)
+	}
+}
+
+func TestDecode_BoundedAlloc(t *testing.T) {
+	// remaining length of 256 MB with only a few bytes sent
+	data := []byte{0x30, 0xff, 0xff, 0xff, 0x7f, 0x00, 0x01, 'a', 'b', 'c'}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err := Decode(V311, bytes.NewReader(data))
+	runtime.ReadMemStats(&after)
+
+	if err != io.ErrUnexpectedEOF {
+		t.Error("unexpected error of truncated packet =", err)
+	}
+	if n := after.TotalAlloc - before.TotalAlloc; n > 1<<20 {
+		t.Error("allocated by the remaining length, bytes =", n)
+	}
+
+	// large packets still decoded, also if not streamed
+	p := &PublishPacket{TopicName: "/large", Payload: bytes.Repeat([]byte("0123456789"), 100*1024+1)}
+	for _, isStream := range []func(string) bool{nil, func(string) bool { return false }} {
+		pkt, err := decode(V311, bytes.NewReader(p.Bytes()), 0, nil, isStream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pub := pkt.(*PublishPacket); pub.TopicName != p.TopicName || !bytes.Equal(pub.Payload, p.Payload) {
+			t.Error("large packet not decoded, topic =", pub.TopicName, "payload length =", len(pub.Payload))
+		}
+	}
+}
+
+func TestDecode_MaxPacketSize(t *testing.T) {
+	data := (&PublishPacket{TopicName: "/foo", Payload: make([]byte, 100)}).Bytes()
+
+	r := bytes.NewReader(data)
+	pkt, err := decode(V5, r, len(data)-1, nil, nil)
+	var e *MalformedPacketError
+	if pkt != nil || !errors.As(err, &e) || e.Code != CodePacketTooLarge {
+		t.Errorf("unexpected error %T = %v", err, err)
+	}
+	if r.Len() != len(data)-2 {
+		t.Error("packet body read, bytes left =", r.Len())
+	}
+
+	if _, err := decode(V5, bytes.NewReader(data), len(data), nil, nil); err != nil {
+		t.Error("packet of max size rejected, err =", err)
+	}
+}
+
+func BenchmarkDecodePublish(b *testing.B) {
+	data := (&PublishPacket{TopicName: "/foo/bar", Payload: make([]byte, 1024)}).Bytes()
+	r := bytes.NewReader(data)
+
+	b.Run("Default", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			r.Reset(data)
+			if _, err := Decode(V311, r); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("Pooled", func(b *testing.B) {
+		pool := newPublishPool()
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			r.Reset(data)
+			pkt, err := decode(V311, r, 0, pool, nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			pkt.(*PublishPacket).release()
+		}
+	})
+}
@@ -29,9 +29,24 @@ var (
 
 	// ErrEncodeLargePacket happens when MQTT packet is too large according to MQTT spec
 	ErrEncodeLargePacket = errors.New("MQTT packet too large")
+
+	// ErrPacketTooLarge is the same as ErrEncodeLargePacket
+	ErrPacketTooLarge = ErrEncodeLargePacket
+
+	// ErrStringTooLong happens when string or binary data in MQTT packet
+	// is longer than 65535 bytes
+	ErrStringTooLong = errors.New("MQTT string too long ")
+
+	// ErrEncodeShortPayload happens when PublishPacket.PayloadReader has less
+	// data than PublishPacket.PayloadLength
+	ErrEncodeShortPayload = errors.New("MQTT payload reader too short")
 )
 
-// Encode MQTT packet to bytes according to protocol ProtoVersion
+// Encode MQTT packet to bytes according to protocol ProtoVersion, the
+// encoding is deterministic (the same as MarshalBinary), properties are
+// encoded in the order of property identifiers, user properties and
+// subscription identifiers in the order set, and optional fields of MQTT 5
+// acks, Disconnect and Auth packets are omitted when allowed
 func Encode(packet Packet, w BufferedWriter) error {
 	return packet.WriteTo(w)
 }
@@ -18,6 +18,7 @@ package libmqtt
 
 import (
 	"bytes"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -66,6 +67,48 @@ func TestEncodeRemainLength(t *testing.T) {
 	//}
 }
 
+func TestEncodeStringTooLong(t *testing.T) {
+	long := strings.Repeat("a", maxStringLen+1)
+	exact := strings.Repeat("a", maxStringLen)
+
+	for _, v := range []ProtoVersion{V311, V5} {
+		for _, p := range []Packet{
+			&ConnPacket{ClientID: long},
+			&ConnPacket{ClientID: "foo", Username: long},
+			&ConnPacket{ClientID: "foo", Password: []byte(long)},
+			&ConnPacket{ClientID: "foo", IsWill: true, WillTopic: "/foo", WillMessage: []byte(long)},
+			&PublishPacket{TopicName: long},
+			&SubscribePacket{Topics: []*Topic{{Name: "/foo"}, {Name: long}}},
+			&UnsubPacket{TopicNames: []string{long}},
+		} {
+			p.SetVersion(v)
+			buf := new(bytes.Buffer)
+			assert.Equal(t, ErrStringTooLong, p.WriteTo(buf), "%T", p)
+			assert.Equal(t, 0, buf.Len(), "%T written", p)
+		}
+	}
+
+	for _, p := range []Packet{
+		&PublishPacket{TopicName: "/foo", Props: &PublishProps{ContentType: long}},
+		&PublishPacket{TopicName: "/foo", Props: &PublishProps{CorrelationData: []byte(long)}},
+		&PublishPacket{TopicName: "/foo", Props: &PublishProps{UserProps: UserProps{{Key: long, Value: "v"}}}},
+		&PublishPacket{TopicName: "/foo", Props: &PublishProps{UserProps: UserProps{{Key: "k", Value: long}}}},
+		&ConnPacket{ClientID: "foo", IsWill: true, WillProps: &WillProps{ResponseTopic: long}},
+		&SubscribePacket{Topics: []*Topic{{Name: "/foo"}}, Props: &SubscribeProps{UserProps: UserProps{{Key: "k", Value: long}}}},
+		&PubAckPacket{Props: &PubAckProps{Reason: long}},
+		&DisconnPacket{Props: &DisconnProps{Reason: long}},
+		&AuthPacket{Props: &AuthProps{AuthMethod: long}},
+	} {
+		p.SetVersion(V5)
+		buf := new(bytes.Buffer)
+		assert.Equal(t, ErrStringTooLong, p.WriteTo(buf), "%T", p)
+		assert.Equal(t, 0, buf.Len(), "%T written", p)
+	}
+
+	p := &PublishPacket{TopicName: exact}
+	assert.NoError(t, p.WriteTo(new(bytes.Buffer)))
+}
+
 func TestEncodeOnePacket(t *testing.T) {
 
 }
@@ -92,3 +135,170 @@ func BenchmarkFuncDecode(b *testing.B) {
 		}
 	}
 }
+
+func benchmarkEncode(b *testing.B, pkt Packet) {
+	buf := new(bytes.Buffer)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		if err := pkt.WriteTo(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEncodePublish(b *testing.B) {
+	b.Run("V311", func(b *testing.B) {
+		benchmarkEncode(b, &PublishPacket{
+			BasePacket: BasePacket{ProtoVersion: V311},
+			TopicName:  "/foo/bar",
+			Qos:        Qos1,
+			PacketID:   1,
+			Payload:    make([]byte, 1024),
+		})
+	})
+	b.Run("V5", func(b *testing.B) {
+		benchmarkEncode(b, &PublishPacket{
+			BasePacket: BasePacket{ProtoVersion: V5},
+			TopicName:  "/foo/bar",
+			Qos:        Qos1,
+			PacketID:   1,
+			Payload:    make([]byte, 1024),
+			Props:      &PublishProps{ContentType: "text/plain", MessageExpiryInterval: 10},
+		})
+	})
+	b.Run("Bytes", func(b *testing.B) {
+		pkt := &PublishPacket{TopicName: "/foo/bar", Qos: Qos1, PacketID: 1, Payload: make([]byte, 1024)}
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_ = pkt.Bytes()
+		}
+	})
+}
+
+func BenchmarkEncodeSubscribe(b *testing.B) {
+	topics := make([]*Topic, 10)
+	for i := range topics {
+		topics[i] = &Topic{Name: "/foo/bar/" + string(rune('a'+i)), Qos: Qos1}
+	}
+
+	b.Run("V311", func(b *testing.B) {
+		benchmarkEncode(b, &SubscribePacket{BasePacket: BasePacket{ProtoVersion: V311}, PacketID: 1, Topics: topics})
+	})
+	b.Run("V5", func(b *testing.B) {
+		benchmarkEncode(b, &SubscribePacket{
+			BasePacket: BasePacket{ProtoVersion: V5},
+			PacketID:   1,
+			Topics:     topics,
+			Props:      &SubscribeProps{SubID: 1},
+		})
+	})
+	b.Run("Bytes", func(b *testing.B) {
+		pkt := &SubscribePacket{PacketID: 1, Topics: topics}
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_ = pkt.Bytes()
+		}
+	})
+}
+
+func TestEncodeUserProps(t *testing.T) {
+	props := UserProps{{Key: "a", Value: "1"}, {Key: "a", Value: "2"}}
+	propsBytes := []byte{
+		14,
+		propKeyUserProps, 0, 1, 'a', 0, 1, '1',
+		propKeyUserProps, 0, 1, 'a', 0, 1, '2',
+	}
+	with := func(b ...[]byte) []byte {
+		var ret []byte
+		for _, v := range b {
+			ret = append(ret, v...)
+		}
+		return ret
+	}
+
+	for _, c := range []struct {
+		pkt      Packet
+		expected []byte
+	}{
+		{
+			pkt:      &ConnPacket{ClientID: "c", Props: &ConnProps{UserProps: props}},
+			expected: with([]byte{CtrlConn << 4, 28, 0, 4, 'M', 'Q', 'T', 'T', 5, 0, 0, 0}, propsBytes, []byte{0, 1, 'c'}),
+		},
+		{
+			pkt: &ConnPacket{
+				ClientID: "c", IsWill: true, WillTopic: "w", WillMessage: []byte("m"),
+				WillProps: &WillProps{UserProps: props},
+			},
+			expected: with([]byte{CtrlConn << 4, 35, 0, 4, 'M', 'Q', 'T', 'T', 5, 0x04, 0, 0, 0, 0, 1, 'c'},
+				propsBytes, []byte{0, 1, 'w', 0, 1, 'm'}),
+		},
+		{
+			pkt:      &ConnAckPacket{Props: &ConnAckProps{UserProps: props}},
+			expected: with([]byte{CtrlConnAck << 4, 17, 0, 0}, propsBytes),
+		},
+		{
+			pkt:      &PublishPacket{TopicName: "t", Qos: Qos1, PacketID: 1, Payload: []byte("p"), Props: &PublishProps{UserProps: props}},
+			expected: with([]byte{CtrlPublish<<4 | Qos1<<1, 21, 0, 1, 't', 0, 1}, propsBytes, []byte{'p'}),
+		},
+		{
+			pkt:      &PubAckPacket{PacketID: 1, Props: &PubAckProps{UserProps: props}},
+			expected: with([]byte{CtrlPubAck << 4, 18, 0, 1, CodeSuccess}, propsBytes),
+		},
+		{
+			pkt:      &PubRecvPacket{PacketID: 1, Props: &PubRecvProps{UserProps: props}},
+			expected: with([]byte{CtrlPubRecv << 4, 18, 0, 1, CodeSuccess}, propsBytes),
+		},
+		{
+			pkt:      &PubRelPacket{PacketID: 1, Props: &PubRelProps{UserProps: props}},
+			expected: with([]byte{CtrlPubRel<<4 | 0x02, 18, 0, 1, CodeSuccess}, propsBytes),
+		},
+		{
+			pkt:      &PubCompPacket{PacketID: 1, Props: &PubCompProps{UserProps: props}},
+			expected: with([]byte{CtrlPubComp << 4, 18, 0, 1, CodeSuccess}, propsBytes),
+		},
+		{
+			pkt:      &SubscribePacket{PacketID: 1, Topics: []*Topic{{Name: "t", Qos: Qos1}}, Props: &SubscribeProps{UserProps: props}},
+			expected: with([]byte{CtrlSubscribe<<4 | 0x02, 21, 0, 1}, propsBytes, []byte{0, 1, 't', Qos1}),
+		},
+		{
+			pkt:      &SubAckPacket{PacketID: 1, Codes: []byte{SubOkMaxQos1}, Props: &SubAckProps{UserProps: props}},
+			expected: with([]byte{CtrlSubAck << 4, 18, 0, 1}, propsBytes, []byte{SubOkMaxQos1}),
+		},
+		{
+			pkt:      &UnsubPacket{PacketID: 1, TopicNames: []string{"t"}, Props: &UnsubProps{UserProps: props}},
+			expected: with([]byte{CtrlUnSub<<4 | 0x02, 20, 0, 1}, propsBytes, []byte{0, 1, 't'}),
+		},
+		{
+			pkt:      &UnsubAckPacket{PacketID: 1, Props: &UnsubAckProps{UserProps: props}},
+			expected: with([]byte{CtrlUnSubAck << 4, 17, 0, 1}, propsBytes),
+		},
+		{
+			pkt:      &DisconnPacket{Props: &DisconnProps{UserProps: props}},
+			expected: with([]byte{CtrlDisConn << 4, 16, CodeSuccess}, propsBytes),
+		},
+		{
+			pkt:      &AuthPacket{Props: &AuthProps{UserProps: props}},
+			expected: with([]byte{CtrlAuth << 4, 16, CodeSuccess}, propsBytes),
+		},
+	} {
+		c.pkt.SetVersion(V5)
+		assert.Equal(t, c.expected, c.pkt.Bytes(), "%T", c.pkt)
+
+		decoded, err := Decode(V5, bytes.NewReader(c.expected))
+		if assert.NoError(t, err, "%T", c.pkt) {
+			assert.Equal(t, c.pkt.Type(), decoded.Type())
+		}
+	}
+
+	// properties are encoded in the order of identifiers
+	p := &PublishProps{ContentType: "c", UserProps: props, PayloadFormat: 1, SubIDs: []int{2}}
+	encoded, err := p.props()
+	assert.NoError(t, err)
+	assert.Equal(t, with([]byte{
+		propKeyPayloadFormatIndicator, 1,
+		propKeyContentType, 0, 1, 'c',
+		propKeySubID, 2,
+	}, propsBytes[1:]), encoded)
+}
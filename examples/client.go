@@ -33,6 +33,8 @@ func ExampleClient() {
 	client, err = libmqtt.NewClient(
 		// try MQTT 5.0 and fallback to MQTT 3.1.1
 		libmqtt.WithVersion(libmqtt.V5, true),
+		// dial timeout must not exceed the keepalive
+		libmqtt.WithDialTimeout(10),
 		// enable keepalive (10s interval) with 20% tolerance
 		libmqtt.WithKeepalive(10, 1.2),
 		// enable auto reconnect and set backoff strategy
@@ -0,0 +1,79 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package extension
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/goiiot/libmqtt"
+)
+
+var (
+	// ErrBadPersistEntry used when the persisted entry can not be decoded
+	ErrBadPersistEntry = errors.New("bad persist entry ")
+)
+
+// entryHeaderSize is the size of zero byte and store time
+const entryHeaderSize = 9
+
+// encodeEntry encodes the packet as a zero byte, the store time (unix
+// nanoseconds, big endian uint64) and the MQTT version byte followed by
+// the encoded packet, which is portable across library versions, packets
+// failed to encode (e.g. ErrStringTooLong) are not stored
+func encodeEntry(p libmqtt.Packet, at time.Time) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	header := [entryHeaderSize]byte{}
+	binary.BigEndian.PutUint64(header[1:], uint64(at.UnixNano()))
+	buf.Write(header[:])
+	buf.WriteByte(byte(p.Version()))
+	if err := p.WriteTo(buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeEntry decodes the entry encoded by encodeEntry, entries without
+// the leading zero byte and store time are accepted as well
+func decodeEntry(v []byte) (libmqtt.Packet, error) {
+	if len(v) > 0 && v[0] == 0 {
+		if len(v) < entryHeaderSize {
+			return nil, ErrBadPersistEntry
+		}
+		v = v[entryHeaderSize:]
+	}
+
+	if len(v) < 2 {
+		return nil, ErrBadPersistEntry
+	}
+
+	// the value may be only valid in the transaction, decode a copy
+	data := make([]byte, len(v)-1)
+	copy(data, v[1:])
+
+	return libmqtt.Decode(libmqtt.ProtoVersion(v[0]), bytes.NewReader(data))
+}
+
+// entryStoredAt returns the store time of the entry if any
+func entryStoredAt(v []byte) (time.Time, bool) {
+	if len(v) > entryHeaderSize && v[0] == 0 {
+		return time.Unix(0, int64(binary.BigEndian.Uint64(v[1:]))), true
+	}
+	return time.Time{}, false
+}
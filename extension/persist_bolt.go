@@ -0,0 +1,287 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package extension
+
+import (
+	"bytes"
+	"errors"
+	"time"
+
+	"go.etcd.io/bbolt"
+
+	"github.com/goiiot/libmqtt"
+)
+
+// NewBoltPersist will create a bolt persist method storing packets in the
+// bucket of the opened db, if no strategy provided (nil), then the default
+// strategy will be used
+//
+// the db can be shared by clients with different buckets (e.g. clientID),
+// and is not closed by the persist method
+func NewBoltPersist(db *bbolt.DB, bucket string, strategy *libmqtt.PersistStrategy) (libmqtt.PersistMethod, error) {
+	if db == nil || bucket == "" {
+		return nil, errors.New("bolt persist requires db and bucket name")
+	}
+
+	p := &boltPersist{
+		db:       db,
+		bucket:   []byte(bucket),
+		strategy: strategy,
+		now:      time.Now,
+	}
+
+	if p.strategy == nil {
+		p.strategy = &libmqtt.PersistStrategy{DuplicateReplace: true}
+	}
+
+	err := db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(p.bucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// boltPersist is the bolt db persist method, every action is applied in
+// a transaction, PersistStrategy.Interval is ignored
+//
+// entries are stored with the store time in the format of encodeEntry
+type boltPersist struct {
+	db       *bbolt.DB
+	bucket   []byte
+	strategy *libmqtt.PersistStrategy
+	now      func() time.Time // store time of entries
+}
+
+// Name of boltPersist is "BoltPersist"
+func (b *boltPersist) Name() string {
+	if b == nil {
+		return "<nil>"
+	}
+
+	return "BoltPersist"
+}
+
+// Store a key packet pair, error happens when db access failed
+func (b *boltPersist) Store(key string, p libmqtt.Packet) error {
+	if b == nil || p == nil {
+		return nil
+	}
+
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(b.bucket)
+		if err != nil {
+			return err
+		}
+
+		return b.put(bucket, key, p)
+	})
+}
+
+// StoreBatch stores all key packet pairs in one transaction, packets
+// dropped by strategy are not stored while others are stored
+func (b *boltPersist) StoreBatch(packets map[string]libmqtt.Packet) error {
+	if b == nil || len(packets) == 0 {
+		return nil
+	}
+
+	var dropErr error
+	err := b.db.Update(func(tx *bbolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(b.bucket)
+		if err != nil {
+			return err
+		}
+
+		for k, p := range packets {
+			if p == nil {
+				continue
+			}
+
+			err := b.put(bucket, k, p)
+			if err == libmqtt.ErrPacketDroppedByStrategy {
+				dropErr = err
+				continue
+			}
+
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return dropErr
+}
+
+func (b *boltPersist) put(bucket *bbolt.Bucket, key string, p libmqtt.Packet) error {
+	k := []byte(key)
+	exists := bucket.Get(k) != nil
+	if exists && !b.strategy.DuplicateReplace {
+		return nil
+	}
+
+	if !exists && b.strategy.MaxCount > 0 && b.strategy.DropOnExceed &&
+		bucket.Stats().KeyN >= int(b.strategy.MaxCount) {
+		// packet dropped
+		return libmqtt.ErrPacketDroppedByStrategy
+	}
+
+	data, err := encodeEntry(p, b.now())
+	if err != nil {
+		return err
+	}
+	return bucket.Put(k, data)
+}
+
+// Load a packet with key, return nil, false when no packet found
+func (b *boltPersist) Load(key string) (libmqtt.Packet, bool) {
+	if b == nil {
+		return nil, false
+	}
+
+	var pkt libmqtt.Packet
+	_ = b.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(b.bucket)
+		if bucket == nil {
+			return nil
+		}
+
+		if v := bucket.Get([]byte(key)); v != nil {
+			pkt, _ = decodeEntry(v)
+		}
+		return nil
+	})
+
+	return pkt, pkt != nil
+}
+
+// Range over all packet persisted, entries can not be decoded are skipped
+func (b *boltPersist) Range(ranger func(key string, p libmqtt.Packet) bool) {
+	b.RangePrefix("", ranger)
+}
+
+// RangePrefix over packets persisted with key prefix in key order, entries
+// can not be decoded are skipped
+func (b *boltPersist) RangePrefix(prefix string, ranger func(key string, p libmqtt.Packet) bool) {
+	if b == nil || ranger == nil {
+		return
+	}
+
+	_ = b.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(b.bucket)
+		if bucket == nil {
+			return nil
+		}
+
+		c, pre := bucket.Cursor(), []byte(prefix)
+		for k, v := c.Seek(pre); k != nil && bytes.HasPrefix(k, pre); k, v = c.Next() {
+			pkt, err := decodeEntry(v)
+			if err != nil {
+				continue
+			}
+
+			if !ranger(string(k), pkt) {
+				break
+			}
+		}
+		return nil
+	})
+}
+
+// Delete a persisted packet with key
+func (b *boltPersist) Delete(key string) error {
+	if b == nil {
+		return nil
+	}
+
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(b.bucket)
+		if bucket == nil {
+			return nil
+		}
+
+		return bucket.Delete([]byte(key))
+	})
+}
+
+// DeleteBatch deletes packets of all keys in one transaction
+func (b *boltPersist) DeleteBatch(keys []string) error {
+	if b == nil || len(keys) == 0 {
+		return nil
+	}
+
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(b.bucket)
+		if bucket == nil {
+			return nil
+		}
+
+		for _, k := range keys {
+			if err := bucket.Delete([]byte(k)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Destroy all data stored in the bucket
+func (b *boltPersist) Destroy() error {
+	if b == nil {
+		return nil
+	}
+
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		err := tx.DeleteBucket(b.bucket)
+		if err == bbolt.ErrBucketNotFound {
+			return nil
+		}
+		return err
+	})
+}
+
+// StoredAt returns the time when the packet with key stored
+func (b *boltPersist) StoredAt(key string) (time.Time, bool) {
+	if b == nil {
+		return time.Time{}, false
+	}
+
+	var (
+		at time.Time
+		ok bool
+	)
+	_ = b.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(b.bucket)
+		if bucket == nil {
+			return nil
+		}
+
+		at, ok = entryStoredAt(bucket.Get([]byte(key)))
+		return nil
+	})
+	return at, ok
+}
+
+// SetClock sets the function returning the store time of entries
+func (b *boltPersist) SetClock(now func() time.Time) {
+	b.now = now
+}
@@ -0,0 +1,320 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package extension
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/bbolt"
+
+	"github.com/goiiot/libmqtt"
+)
+
+func openTestBolt(t testing.TB) (*bbolt.DB, string) {
+	dir, err := ioutil.TempDir("", "libmqtt-bolt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "persist.db")
+	db, err := bbolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db, path
+}
+
+func testBoltPacket(id uint16) *libmqtt.PublishPacket {
+	p := &libmqtt.PublishPacket{
+		TopicName: "/foo",
+		Qos:       libmqtt.Qos1,
+		PacketID:  id,
+		Payload:   []byte("bar"),
+		Props:     &libmqtt.PublishProps{ContentType: "text/plain"},
+	}
+	p.SetVersion(libmqtt.V5)
+	return p
+}
+
+func TestBoltPersist(t *testing.T) {
+	db, path := openTestBolt(t)
+	defer func() { _ = os.RemoveAll(filepath.Dir(path)) }()
+	defer func() { _ = db.Close() }()
+
+	p, err := NewBoltPersist(db, "client", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	other, err := NewBoltPersist(db, "other", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.NoError(t, p.Store("S1", testBoltPacket(1)))
+	assert.NoError(t, p.Store("S2", testBoltPacket(2)))
+	assert.NoError(t, other.Store("S3", testBoltPacket(3)))
+
+	pkt, ok := p.Load("S1")
+	if assert.True(t, ok) {
+		pub := pkt.(*libmqtt.PublishPacket)
+		assert.Equal(t, libmqtt.V5, pub.Version())
+		assert.Equal(t, uint16(1), pub.PacketID)
+		assert.Equal(t, "bar", string(pub.Payload))
+		assert.Equal(t, "text/plain", pub.Props.ContentType)
+	}
+
+	_, ok = p.Load("S3")
+	assert.False(t, ok, "bucket not isolated")
+
+	var keys []string
+	p.Range(func(key string, p libmqtt.Packet) bool {
+		keys = append(keys, key)
+		return true
+	})
+	assert.Equal(t, []string{"S1", "S2"}, keys)
+
+	assert.NoError(t, p.Delete("S1"))
+	_, ok = p.Load("S1")
+	assert.False(t, ok)
+
+	assert.NoError(t, p.Destroy())
+	_, ok = p.Load("S2")
+	assert.False(t, ok)
+
+	_, ok = other.Load("S3")
+	assert.True(t, ok)
+}
+
+func TestBoltPersist_Strategy(t *testing.T) {
+	db, path := openTestBolt(t)
+	defer func() { _ = os.RemoveAll(filepath.Dir(path)) }()
+	defer func() { _ = db.Close() }()
+
+	p, err := NewBoltPersist(db, "client", &libmqtt.PersistStrategy{
+		MaxCount:         1,
+		DropOnExceed:     true,
+		DuplicateReplace: false,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.NoError(t, p.Store("S1", testBoltPacket(1)))
+	assert.NoError(t, p.Store("S1", testBoltPacket(2)))
+	assert.Equal(t, libmqtt.ErrPacketDroppedByStrategy, p.Store("S3", testBoltPacket(3)))
+
+	pkt, ok := p.Load("S1")
+	if assert.True(t, ok) {
+		assert.Equal(t, uint16(1), pkt.(*libmqtt.PublishPacket).PacketID, "duplicate replaced")
+	}
+}
+
+func TestBoltPersist_EncodeError(t *testing.T) {
+	db, path := openTestBolt(t)
+	defer func() { _ = os.RemoveAll(filepath.Dir(path)) }()
+	defer func() { _ = db.Close() }()
+
+	p, err := NewBoltPersist(db, "client", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	bad := &libmqtt.PublishPacket{TopicName: strings.Repeat("a", 1<<16), Qos: libmqtt.Qos1, PacketID: 1}
+	assert.Equal(t, libmqtt.ErrStringTooLong, p.Store("S1", bad))
+	assert.Equal(t, libmqtt.ErrStringTooLong, p.(libmqtt.BatchPersist).StoreBatch(map[string]libmqtt.Packet{"S2": testBoltPacket(2), "S3": bad}))
+
+	for _, key := range []string{"S1", "S3"} {
+		_, ok := p.Load(key)
+		assert.False(t, ok, "packet failed to encode stored, key = "+key)
+	}
+}
+
+func TestBoltPersist_CrashRecovery(t *testing.T) {
+	if path := os.Getenv("LIBMQTT_BOLT_CRASH"); path != "" {
+		// packet stored, process killed before acked
+		db, err := bbolt.Open(path, 0600, nil)
+		if err != nil {
+			os.Exit(2)
+		}
+
+		p, err := NewBoltPersist(db, "client", nil)
+		if err != nil {
+			os.Exit(2)
+		}
+
+		for i := 1; i <= 10; i++ {
+			if err := p.Store("S"+strconv.Itoa(i), testBoltPacket(uint16(i))); err != nil {
+				os.Exit(2)
+			}
+		}
+		_ = p.Delete("S10")
+		os.Exit(1)
+	}
+
+	db, path := openTestBolt(t)
+	defer func() { _ = os.RemoveAll(filepath.Dir(path)) }()
+	_ = db.Close()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestBoltPersist_CrashRecovery$")
+	cmd.Env = append(os.Environ(), "LIBMQTT_BOLT_CRASH="+path)
+	err := cmd.Run()
+	if e, ok := err.(*exec.ExitError); !ok || e.ExitCode() != 1 {
+		t.Fatal("unexpected crash process result, err =", err)
+	}
+
+	db, err = bbolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = db.Close() }()
+
+	p, err := NewBoltPersist(db, "client", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	count := 0
+	p.Range(func(key string, pkt libmqtt.Packet) bool {
+		count++
+		assert.Equal(t, key, "S"+strconv.Itoa(int(pkt.(*libmqtt.PublishPacket).PacketID)))
+		return true
+	})
+	assert.Equal(t, 9, count)
+
+	_, ok := p.Load("S10")
+	assert.False(t, ok)
+}
+
+func benchmarkPersist(b *testing.B, p libmqtt.PersistMethod) {
+	pkt := testBoltPacket(1)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		key := "S" + strconv.Itoa(i%1000)
+		if err := p.Store(key, pkt); err != nil {
+			b.Fatal(err)
+		}
+		_ = p.Delete(key)
+	}
+}
+
+func BenchmarkBoltPersist(b *testing.B) {
+	db, path := openTestBolt(b)
+	defer func() { _ = os.RemoveAll(filepath.Dir(path)) }()
+	defer func() { _ = db.Close() }()
+
+	p, err := NewBoltPersist(db, "client", nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	benchmarkPersist(b, p)
+}
+
+func BenchmarkFilePersist(b *testing.B) {
+	dir, err := ioutil.TempDir("", "libmqtt-file")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	benchmarkPersist(b, libmqtt.NewFilePersist(dir, &libmqtt.PersistStrategy{DuplicateReplace: true}))
+}
+
+func TestBoltPersist_StoredAt(t *testing.T) {
+	db, path := openTestBolt(t)
+	defer func() { _ = os.RemoveAll(filepath.Dir(path)) }()
+	defer func() { _ = db.Close() }()
+
+	p, err := NewBoltPersist(db, "client", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	before := time.Now()
+	assert.NoError(t, p.Store("S1", testBoltPacket(1)))
+
+	at, ok := p.(libmqtt.TimestampedPersist).StoredAt("S1")
+	assert.True(t, ok)
+	assert.False(t, at.Before(before) || at.After(time.Now()), "unexpected store time %v", at)
+
+	_, ok = p.(libmqtt.TimestampedPersist).StoredAt("S2")
+	assert.False(t, ok)
+
+	// stamped with the client clock
+	clientNow := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+	p.(libmqtt.PersistClock).SetClock(func() time.Time { return clientNow })
+	assert.NoError(t, p.Store("S3", testBoltPacket(3)))
+	at, ok = p.(libmqtt.TimestampedPersist).StoredAt("S3")
+	assert.True(t, ok)
+	assert.True(t, at.Equal(clientNow), "unexpected store time %v", at)
+
+	// entries without store time
+	assert.NoError(t, db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte("client")).Put([]byte("S2"), append([]byte{byte(libmqtt.V5)}, testBoltPacket(2).Bytes()...))
+	}))
+	pkt, ok := p.Load("S2")
+	if assert.True(t, ok) {
+		assert.Equal(t, uint16(2), pkt.(*libmqtt.PublishPacket).PacketID)
+	}
+	_, ok = p.(libmqtt.TimestampedPersist).StoredAt("S2")
+	assert.False(t, ok)
+}
+
+func TestBoltPersist_Batch(t *testing.T) {
+	db, path := openTestBolt(t)
+	defer func() { _ = os.RemoveAll(filepath.Dir(path)) }()
+	defer func() { _ = db.Close() }()
+
+	p, err := NewBoltPersist(db, "client", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	bp := p.(libmqtt.BatchPersist)
+
+	assert.NoError(t, bp.StoreBatch(map[string]libmqtt.Packet{
+		"R1": testBoltPacket(1),
+		"S1": testBoltPacket(1),
+		"S2": testBoltPacket(2),
+		"T1": testBoltPacket(3),
+	}))
+
+	var keys []string
+	bp.RangePrefix("S", func(key string, p libmqtt.Packet) bool {
+		keys = append(keys, key)
+		return true
+	})
+	assert.Equal(t, []string{"S1", "S2"}, keys)
+
+	assert.NoError(t, bp.DeleteBatch(keys))
+	keys = nil
+	bp.Range(func(key string, p libmqtt.Packet) bool {
+		keys = append(keys, key)
+		return true
+	})
+	assert.Equal(t, []string{"R1", "T1"}, keys)
+}
@@ -0,0 +1,479 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package extension
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"github.com/goiiot/libmqtt"
+)
+
+var (
+	// ErrRedisUnavailable used when redis failed recently, operations are
+	// rejected without accessing redis until RedisOptions.RetryDelay passed
+	ErrRedisUnavailable = errors.New("redis persist unavailable ")
+)
+
+const (
+	defaultRedisTimeout    = time.Second
+	defaultRedisRetryDelay = 5 * time.Second
+)
+
+// RedisOptions defines the redis connection and key layout of redis persist
+type RedisOptions struct {
+	// Addrs of a single redis server, or seed addresses of cluster nodes
+	// when Cluster is true
+	Addrs []string
+
+	// Cluster connects to a redis cluster
+	Cluster bool
+
+	// Username and Password for redis AUTH, Username requires redis 6 ACL
+	Username string
+	Password string
+
+	// DB to be selected, only for single server
+	DB int
+
+	// TLSConfig enables TLS connection when not nil
+	TLSConfig *tls.Config
+
+	// KeyPrefix is the namespace of the persisted packets (e.g. clientID),
+	// packets are stored in the hash with key KeyPrefix, required
+	KeyPrefix string
+
+	// Timeout of every redis operation, including dial, default 1s
+	Timeout time.Duration
+
+	// RetryDelay is the time operations rejected with ErrRedisUnavailable
+	// after redis failed, default 5s, negative to always access redis
+	RetryDelay time.Duration
+}
+
+// NewRedisPersist will create a redis persist method with the redis
+// options, if no strategy provided (nil), then the default strategy
+// will be used
+func NewRedisPersist(options *RedisOptions, strategy *libmqtt.PersistStrategy) (libmqtt.PersistMethod, error) {
+	if options == nil || len(options.Addrs) == 0 {
+		return nil, errors.New("redis persist requires redis addresses")
+	}
+
+	timeout := options.Timeout
+	if timeout <= 0 {
+		timeout = defaultRedisTimeout
+	}
+
+	uo := &redis.UniversalOptions{
+		Addrs:        options.Addrs,
+		DB:           options.DB,
+		Username:     options.Username,
+		Password:     options.Password,
+		TLSConfig:    options.TLSConfig,
+		MaxRetries:   -1,
+		DialTimeout:  timeout,
+		ReadTimeout:  timeout,
+		WriteTimeout: timeout,
+		PoolTimeout:  timeout,
+	}
+
+	var client redis.UniversalClient
+	if options.Cluster {
+		client = redis.NewClusterClient(uo.Cluster())
+	} else {
+		client = redis.NewClient(uo.Simple())
+	}
+
+	p, err := NewRedisPersistWithClient(client, options.KeyPrefix, strategy)
+	if err != nil {
+		_ = client.Close()
+		return nil, err
+	}
+
+	rp := p.(*redisPersist)
+	rp.timeout, rp.ownClient = timeout, true
+	if options.RetryDelay != 0 {
+		rp.retryDelay = options.RetryDelay
+	}
+	return rp, nil
+}
+
+// NewRedisPersistWithClient will create a redis persist method using the
+// redis client with the key prefix as namespace, the client is not closed
+// by the persist method
+func NewRedisPersistWithClient(client redis.UniversalClient, keyPrefix string, strategy *libmqtt.PersistStrategy) (libmqtt.PersistMethod, error) {
+	if client == nil || keyPrefix == "" {
+		return nil, errors.New("redis persist requires client and key prefix")
+	}
+
+	p := &redisPersist{
+		client:     client,
+		key:        keyPrefix,
+		strategy:   strategy,
+		timeout:    defaultRedisTimeout,
+		retryDelay: defaultRedisRetryDelay,
+		now:        time.Now,
+	}
+
+	if p.strategy == nil {
+		p.strategy = &libmqtt.PersistStrategy{DuplicateReplace: true}
+	}
+
+	return p, nil
+}
+
+// redisPersist is the redis persist method, packets are stored as fields
+// of one hash, so that all packets of the namespace are in the same slot
+// of redis cluster, PersistStrategy.Interval is ignored
+//
+// entries are stored with the store time in the format of encodeEntry
+//
+// every operation is bounded by the timeout, after redis failed, the
+// following operations fail fast with ErrRedisUnavailable until the retry
+// delay passed, so the client logic is never blocked by an unreachable
+// redis, errors of Load and Range are reported to PersistHandler
+type redisPersist struct {
+	client     redis.UniversalClient
+	ownClient  bool
+	key        string
+	strategy   *libmqtt.PersistStrategy
+	timeout    time.Duration
+	retryDelay time.Duration
+	// unix nano time until when redis is considered unavailable
+	downUntil int64
+	reportErr func(err error)
+	now       func() time.Time // store time of entries
+}
+
+// Name of redisPersist is "RedisPersist"
+func (r *redisPersist) Name() string {
+	if r == nil {
+		return "<nil>"
+	}
+
+	return "RedisPersist"
+}
+
+// Store a key packet pair, error happens when redis access failed
+func (r *redisPersist) Store(key string, p libmqtt.Packet) error {
+	if r == nil || p == nil {
+		return nil
+	}
+
+	return r.StoreBatch(map[string]libmqtt.Packet{key: p})
+}
+
+// StoreBatch stores all key packet pairs in one pipeline, packets dropped
+// by strategy are not stored while others are stored
+func (r *redisPersist) StoreBatch(packets map[string]libmqtt.Packet) error {
+	if r == nil || len(packets) == 0 {
+		return nil
+	}
+
+	ctx, cancel, err := r.begin()
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	keys := make([]string, 0, len(packets))
+	for k, p := range packets {
+		if p != nil {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	sort.Strings(keys)
+
+	var dropErr error
+	if r.strategy.MaxCount > 0 && r.strategy.DropOnExceed {
+		// drop packets exceeding the max count, existing keys are not counted
+		n := len(keys)
+		keys, err = r.checkCount(ctx, keys)
+		if err != nil {
+			return err
+		}
+
+		if len(keys) < n {
+			dropErr = libmqtt.ErrPacketDroppedByStrategy
+		}
+	}
+
+	entries := make([][]byte, len(keys))
+	now := r.now()
+	for i, k := range keys {
+		if entries[i], err = encodeEntry(packets[k], now); err != nil {
+			// nothing stored
+			return err
+		}
+	}
+
+	_, err = r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, k := range keys {
+			if r.strategy.DuplicateReplace {
+				pipe.HSet(ctx, r.key, k, entries[i])
+			} else {
+				pipe.HSetNX(ctx, r.key, k, entries[i])
+			}
+		}
+		return nil
+	})
+	if err = r.end(err); err != nil {
+		return err
+	}
+	return dropErr
+}
+
+// checkCount returns keys can be stored without exceeding the max count
+func (r *redisPersist) checkCount(ctx context.Context, keys []string) ([]string, error) {
+	var (
+		n      *redis.IntCmd
+		exists *redis.SliceCmd
+	)
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		n = pipe.HLen(ctx, r.key)
+		exists = pipe.HMGet(ctx, r.key, keys...)
+		return nil
+	})
+	if err = r.end(err); err != nil {
+		return nil, err
+	}
+
+	count, result := n.Val(), keys[:0]
+	for i, v := range exists.Val() {
+		if v == nil {
+			if count >= int64(r.strategy.MaxCount) {
+				// packet dropped
+				continue
+			}
+			count++
+		}
+		result = append(result, keys[i])
+	}
+	return result, nil
+}
+
+// Load a packet with key, return nil, false when no packet found
+func (r *redisPersist) Load(key string) (libmqtt.Packet, bool) {
+	if r == nil {
+		return nil, false
+	}
+
+	ctx, cancel, err := r.begin()
+	if err != nil {
+		r.report(err)
+		return nil, false
+	}
+	defer cancel()
+
+	v, err := r.client.HGet(ctx, r.key, key).Bytes()
+	if err = r.end(err); err != nil {
+		r.report(err)
+		return nil, false
+	}
+
+	if v == nil {
+		return nil, false
+	}
+
+	pkt, err := decodeEntry(v)
+	if err != nil {
+		r.report(&libmqtt.PersistCorruptedError{Key: key, Err: err})
+		return nil, false
+	}
+	return pkt, true
+}
+
+// Range over all packet persisted, entries can not be decoded are skipped
+func (r *redisPersist) Range(ranger func(key string, p libmqtt.Packet) bool) {
+	r.RangePrefix("", ranger)
+}
+
+// RangePrefix over packets persisted with key prefix in key order, entries
+// can not be decoded are skipped
+func (r *redisPersist) RangePrefix(prefix string, ranger func(key string, p libmqtt.Packet) bool) {
+	if r == nil || ranger == nil {
+		return
+	}
+
+	entries, err := r.scan(prefix)
+	if err != nil {
+		r.report(err)
+		return
+	}
+
+	keys := make([]string, 0, len(entries))
+	for k := range entries {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		pkt, err := decodeEntry([]byte(entries[k]))
+		if err != nil {
+			r.report(&libmqtt.PersistCorruptedError{Key: k, Err: err})
+			continue
+		}
+
+		if !ranger(k, pkt) {
+			break
+		}
+	}
+}
+
+// scan all entries with key prefix
+func (r *redisPersist) scan(prefix string) (map[string]string, error) {
+	ctx, cancel, err := r.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+
+	var (
+		cursor  uint64
+		match   = escapeRedisPattern(prefix) + "*"
+		entries = make(map[string]string)
+	)
+	for {
+		var kv []string
+		kv, cursor, err = r.client.HScan(ctx, r.key, cursor, match, 100).Result()
+		if err = r.end(err); err != nil {
+			return nil, err
+		}
+
+		for i := 0; i+1 < len(kv); i += 2 {
+			entries[kv[i]] = kv[i+1]
+		}
+
+		if cursor == 0 {
+			return entries, nil
+		}
+	}
+}
+
+// Delete a persisted packet with key
+func (r *redisPersist) Delete(key string) error {
+	if r == nil {
+		return nil
+	}
+
+	return r.DeleteBatch([]string{key})
+}
+
+// DeleteBatch deletes packets of all keys in one command
+func (r *redisPersist) DeleteBatch(keys []string) error {
+	if r == nil || len(keys) == 0 {
+		return nil
+	}
+
+	ctx, cancel, err := r.begin()
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	return r.end(r.client.HDel(ctx, r.key, keys...).Err())
+}
+
+// Destroy all data stored in the namespace, the redis client is closed
+// if created by NewRedisPersist
+func (r *redisPersist) Destroy() error {
+	if r == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+
+	err := r.end(r.client.Del(ctx, r.key).Err())
+	if r.ownClient {
+		_ = r.client.Close()
+	}
+	return err
+}
+
+// StoredAt returns the time when the packet with key stored
+func (r *redisPersist) StoredAt(key string) (time.Time, bool) {
+	if r == nil {
+		return time.Time{}, false
+	}
+
+	ctx, cancel, err := r.begin()
+	if err != nil {
+		return time.Time{}, false
+	}
+	defer cancel()
+
+	v, err := r.client.HGet(ctx, r.key, key).Bytes()
+	if r.end(err) != nil {
+		return time.Time{}, false
+	}
+	return entryStoredAt(v)
+}
+
+// SetErrorReporter sets the function to report errors of Load and Range
+func (r *redisPersist) SetErrorReporter(report func(err error)) {
+	r.reportErr = report
+}
+
+// SetClock sets the function returning the store time of entries
+func (r *redisPersist) SetClock(now func() time.Time) {
+	r.now = now
+}
+
+func (r *redisPersist) report(err error) {
+	if r.reportErr != nil {
+		r.reportErr(err)
+	}
+}
+
+// begin checks redis availability and returns the operation context
+func (r *redisPersist) begin() (context.Context, context.CancelFunc, error) {
+	if r.retryDelay > 0 && time.Now().UnixNano() < atomic.LoadInt64(&r.downUntil) {
+		return nil, nil, ErrRedisUnavailable
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	return ctx, cancel, nil
+}
+
+// end checks the operation result, redis is marked unavailable for the
+// retry delay when failed other than error replies, redis.Nil (key not
+// found) is not an error
+func (r *redisPersist) end(err error) error {
+	if err == nil || err == redis.Nil {
+		return nil
+	}
+
+	if _, isReply := err.(redis.Error); !isReply && r.retryDelay > 0 {
+		atomic.StoreInt64(&r.downUntil, time.Now().Add(r.retryDelay).UnixNano())
+	}
+	return err
+}
+
+func escapeRedisPattern(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`).Replace(s)
+}
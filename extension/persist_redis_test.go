@@ -0,0 +1,222 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package extension
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/goiiot/libmqtt"
+)
+
+func startTestRedis(t *testing.T) *miniredis.Miniredis {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestRedisPersist(t *testing.T) {
+	s := startTestRedis(t)
+	defer s.Close()
+
+	p, err := NewRedisPersist(&RedisOptions{Addrs: []string{s.Addr()}, KeyPrefix: "libmqtt:client"}, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	other, err := NewRedisPersist(&RedisOptions{Addrs: []string{s.Addr()}, KeyPrefix: "libmqtt:other"}, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer func() { _ = other.Destroy() }()
+
+	assert.NoError(t, p.Store("S1", testBoltPacket(1)))
+	assert.NoError(t, p.Store("S2", testBoltPacket(2)))
+	assert.NoError(t, p.Store("R1", testBoltPacket(3)))
+	assert.NoError(t, other.Store("S3", testBoltPacket(3)))
+
+	pkt, ok := p.Load("S1")
+	if assert.True(t, ok) {
+		pub := pkt.(*libmqtt.PublishPacket)
+		assert.Equal(t, libmqtt.V5, pub.Version())
+		assert.Equal(t, uint16(1), pub.PacketID)
+		assert.Equal(t, "bar", string(pub.Payload))
+		assert.Equal(t, "text/plain", pub.Props.ContentType)
+	}
+
+	_, ok = p.Load("S3")
+	assert.False(t, ok, "namespace not isolated")
+
+	var keys []string
+	p.Range(func(key string, p libmqtt.Packet) bool {
+		keys = append(keys, key)
+		return true
+	})
+	assert.Equal(t, []string{"R1", "S1", "S2"}, keys)
+
+	keys = nil
+	p.(libmqtt.BatchPersist).RangePrefix("S", func(key string, p libmqtt.Packet) bool {
+		keys = append(keys, key)
+		return true
+	})
+	assert.Equal(t, []string{"S1", "S2"}, keys)
+
+	at, ok := p.(libmqtt.TimestampedPersist).StoredAt("S1")
+	assert.True(t, ok)
+	assert.WithinDuration(t, time.Now(), at, time.Minute)
+
+	assert.NoError(t, p.Delete("S1"))
+	_, ok = p.Load("S1")
+	assert.False(t, ok)
+
+	assert.NoError(t, p.Destroy())
+	assert.False(t, s.Exists("libmqtt:client"))
+	assert.True(t, s.Exists("libmqtt:other"))
+}
+
+func TestRedisPersist_Strategy(t *testing.T) {
+	s := startTestRedis(t)
+	defer s.Close()
+
+	p, err := NewRedisPersist(&RedisOptions{Addrs: []string{s.Addr()}, KeyPrefix: "client"}, &libmqtt.PersistStrategy{
+		MaxCount:         2,
+		DropOnExceed:     true,
+		DuplicateReplace: false,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer func() { _ = p.Destroy() }()
+
+	assert.NoError(t, p.Store("S1", testBoltPacket(1)))
+	assert.NoError(t, p.Store("S1", testBoltPacket(2)))
+	assert.Equal(t, libmqtt.ErrPacketDroppedByStrategy, p.(libmqtt.BatchPersist).StoreBatch(map[string]libmqtt.Packet{
+		"S1": testBoltPacket(3),
+		"S2": testBoltPacket(4),
+		"S3": testBoltPacket(5),
+	}))
+
+	pkt, ok := p.Load("S1")
+	if assert.True(t, ok) {
+		assert.Equal(t, uint16(1), pkt.(*libmqtt.PublishPacket).PacketID, "duplicate replaced")
+	}
+
+	_, ok = p.Load("S2")
+	assert.True(t, ok)
+	_, ok = p.Load("S3")
+	assert.False(t, ok)
+}
+
+func TestRedisPersist_Batch(t *testing.T) {
+	s := startTestRedis(t)
+	defer s.Close()
+
+	p, err := NewRedisPersist(&RedisOptions{Addrs: []string{s.Addr()}, KeyPrefix: "client"}, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer func() { _ = p.Destroy() }()
+	bp := p.(libmqtt.BatchPersist)
+
+	packets := make(map[string]libmqtt.Packet)
+	for i := 1; i <= 200; i++ {
+		packets["S"+strconv.Itoa(i)] = testBoltPacket(uint16(i))
+	}
+	assert.NoError(t, bp.StoreBatch(packets))
+
+	var keys []string
+	bp.Range(func(key string, p libmqtt.Packet) bool {
+		keys = append(keys, key)
+		return true
+	})
+	assert.Len(t, keys, 200)
+
+	assert.NoError(t, bp.DeleteBatch(keys[:150]))
+	count := 0
+	bp.Range(func(key string, p libmqtt.Packet) bool {
+		count++
+		return true
+	})
+	assert.Equal(t, 50, count)
+}
+
+func TestRedisPersist_Auth(t *testing.T) {
+	s := startTestRedis(t)
+	defer s.Close()
+	s.RequireUserAuth("mqtt", "secret")
+
+	p, err := NewRedisPersist(&RedisOptions{Addrs: []string{s.Addr()}, KeyPrefix: "client", Password: "wrong", RetryDelay: -1}, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Error(t, p.Store("S1", testBoltPacket(1)))
+
+	p, err = NewRedisPersist(&RedisOptions{Addrs: []string{s.Addr()}, KeyPrefix: "client", Username: "mqtt", Password: "secret"}, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer func() { _ = p.Destroy() }()
+
+	assert.NoError(t, p.Store("S1", testBoltPacket(1)))
+	_, ok := p.Load("S1")
+	assert.True(t, ok)
+}
+
+func TestRedisPersist_Unavailable(t *testing.T) {
+	s := startTestRedis(t)
+	addr := s.Addr()
+
+	p, err := NewRedisPersist(&RedisOptions{
+		Addrs:      []string{addr},
+		KeyPrefix:  "client",
+		Timeout:    100 * time.Millisecond,
+		RetryDelay: time.Hour,
+	}, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer func() { _ = p.Destroy() }()
+
+	var reported []error
+	p.(libmqtt.PersistErrorReporter).SetErrorReporter(func(err error) { reported = append(reported, err) })
+
+	assert.NoError(t, p.Store("S1", testBoltPacket(1)))
+	s.Close()
+
+	start := time.Now()
+	err = p.Store("S2", testBoltPacket(2))
+	assert.Error(t, err)
+	assert.NotEqual(t, ErrRedisUnavailable, err)
+
+	// fail fast without accessing redis
+	assert.Equal(t, ErrRedisUnavailable, p.Store("S2", testBoltPacket(2)))
+	assert.Equal(t, ErrRedisUnavailable, p.Delete("S1"))
+	_, ok := p.Load("S1")
+	assert.False(t, ok)
+	p.Range(func(key string, p libmqtt.Packet) bool {
+		t.Error("unexpected range over unavailable redis")
+		return true
+	})
+	assert.True(t, time.Since(start) < time.Second, "blocked by unavailable redis")
+	assert.Equal(t, []error{ErrRedisUnavailable, ErrRedisUnavailable}, reported)
+}
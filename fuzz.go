@@ -40,3 +40,26 @@ func Fuzz(data []byte) int {
 	}
 	return 1
 }
+
+// FuzzProps fuzzes the MQTT 5 property decoder
+func FuzzProps(data []byte) int {
+	if len(data) == 0 {
+		return 0
+	}
+
+	// first byte selects the packet type
+	props, next, err := getPacketProps(data[1:], data[0]&0x0f)
+	if err != nil {
+		if _, ok := err.(*MalformedPacketError); !ok {
+			panic("unexpected error type")
+		}
+		if props != nil || next != nil {
+			panic("props != nil on error")
+		}
+		return 0
+	}
+
+	(&PublishProps{}).setProps(props)
+	(&ConnAckProps{}).setProps(props)
+	return 1
+}
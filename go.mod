@@ -3,9 +3,11 @@ module github.com/goiiot/libmqtt
 go 1.13
 
 require (
+	github.com/alicebob/miniredis/v2 v2.14.1
 	github.com/eclipse/paho.mqtt.golang v1.2.0
-	github.com/stretchr/testify v1.4.0
+	github.com/go-redis/redis/v8 v8.11.5
+	github.com/stretchr/testify v1.5.1
+	go.etcd.io/bbolt v1.3.5
 	go.uber.org/goleak v0.10.0
-	golang.org/x/net v0.0.0-20190628185345-da137c7871d7 // indirect
 	nhooyr.io/websocket v1.7.4
 )
@@ -0,0 +1,142 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/goiiot/libmqtt/internal/testutil"
+)
+
+// fixtures of captured packets are added with
+//
+//	go test -run TestGolden_Fixtures -golden.pcap=capture.pcap -golden.source=mosquitto -golden.version=v5
+var (
+	goldenPcap    = flag.String("golden.pcap", "", "pcap file to add fixtures from")
+	goldenSource  = flag.String("golden.source", "capture", "source of packets in the pcap (e.g. broker name)")
+	goldenVersion = flag.String("golden.version", "v5", "protocol version of packets in the pcap (v311 or v5)")
+	goldenPort    = flag.Int("golden.port", 1883, "MQTT server port in the pcap")
+)
+
+var goldenVersions = map[string]ProtoVersion{
+	"v311": V311,
+	"v5":   V5,
+}
+
+// TestGolden_Fixtures decodes every packet in testdata/packets and encodes
+// it again, the bytes MUST be the same as the fixture, or the fixture
+// <name>.encoded.hex if exists (e.g. captured packets with properties not
+// in the order of property identifiers)
+func TestGolden_Fixtures(t *testing.T) {
+	if *goldenPcap != "" {
+		addPcapFixtures(t)
+	}
+
+	files, err := filepath.Glob("testdata/packets/*/*.hex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no fixtures")
+	}
+
+	for _, file := range files {
+		if strings.HasSuffix(file, ".encoded.hex") {
+			continue
+		}
+
+		dir := filepath.Base(filepath.Dir(file))
+		version, ok := goldenVersions[dir]
+		if !ok {
+			t.Errorf("%s: unknown version directory %q", file, dir)
+			continue
+		}
+
+		wire := readHexFixture(t, file)
+		expected := wire
+		if encoded := strings.TrimSuffix(file, ".hex") + ".encoded.hex"; fileExists(encoded) {
+			expected = readHexFixture(t, encoded)
+		}
+
+		r := bufio.NewReader(bytes.NewReader(wire))
+		pkt, err := Decode(version, r)
+		if err != nil {
+			t.Errorf("%s: decode failed, err = %v", file, err)
+			continue
+		}
+		if r.Buffered() != 0 {
+			t.Errorf("%s: %d bytes not decoded", file, r.Buffered())
+		}
+
+		data, err := pkt.MarshalBinary()
+		if err != nil {
+			t.Errorf("%s: encode failed, err = %v", file, err)
+			continue
+		}
+		if !bytes.Equal(data, expected) {
+			t.Errorf("%s: encoded bytes mismatch, packet = %v\nwant % x\ngot  % x", file, pkt, expected, data)
+		}
+	}
+}
+
+// readHexFixture reads hex bytes of the fixture, `#` starts a comment
+func readHexFixture(t *testing.T, file string) []byte {
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = f.Close() }()
+
+	data, err := testutil.ReadHex(f)
+	if err != nil {
+		t.Fatalf("%s: %v", file, err)
+	}
+	return data
+}
+
+func addPcapFixtures(t *testing.T) {
+	if _, ok := goldenVersions[*goldenVersion]; !ok {
+		t.Fatal("unknown version =", *goldenVersion)
+	}
+
+	f, err := os.Open(*goldenPcap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = f.Close() }()
+
+	frames, err := testutil.PcapMQTTFrames(f, uint16(*goldenPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := filepath.Join("testdata", "packets", *goldenVersion)
+	for _, name := range testutil.WriteFixtures(dir, *goldenSource, frames, t.Errorf) {
+		t.Log("fixture added =", name)
+	}
+}
+
+func fileExists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
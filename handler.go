@@ -16,11 +16,15 @@
 
 package libmqtt
 
+import "io"
+
 // ConnHandleFunc is the handler which tend to the Connect result
 // server is the server address provided by user in client creation call
 // code is the ConnResult code
-// err is the error happened when connect to server, if a error happened,
-// the code value will max byte value (255)
+// err is the error happened when connect to server, if a error happened
+// before ConnAck received, the code value will max byte value (255), if the
+// connect is refused by the server, err is the error of the ConnAck code
+// (e.g. ErrConnBadAuth, see ConnAckError)
 type ConnHandleFunc func(client Client, server string, code byte, err error)
 
 // Deprecated: use ConnHandleFunc instead, will be removed in v1.0
@@ -34,6 +38,42 @@ type TopicHandleFunc func(client Client, topic string, qos QosLevel, msg []byte)
 // Deprecated: use TopicHandleFunc instead, will be removed in v1.0
 type TopicHandler func(topic string, qos QosLevel, msg []byte)
 
+// TopicRetainHandleFunc handles topic sub message with the retain flag,
+// retained is true for retained messages sent by the broker on subscribe
+// (and for all retained messages of MQTT 5 subscriptions with
+// SubRetainAsPublished)
+type TopicRetainHandleFunc func(client Client, topic string, qos QosLevel, msg []byte, retained bool)
+
+// TopicExHandleFunc handles topic sub message with the metadata of the
+// publish packet (e.g. packet id for idempotency keys, retain flag to tell
+// retained messages sent on subscribe from live ones)
+type TopicExHandleFunc func(client Client, topic string, qos QosLevel, msg []byte, meta PublishMeta)
+
+// PublishHandleFunc handles topic sub message with the full publish packet,
+// including MQTT 5 properties
+// the packet is never reused by the client, so it's safe to retain (unless
+// WithPooledDecode enabled, see PublishPacket.Retain), but it's shared by
+// all matched handlers and SHOULD NOT be modified
+type PublishHandleFunc func(client Client, p *PublishPacket)
+
+// StreamHandleFunc handles topic sub message with payload streamed from r,
+// r is only valid before the handler returned
+// return nil to send the ack of the message
+type StreamHandleFunc func(client Client, topic string, qos QosLevel, r io.Reader) error
+
+// publishHandler adapts the topic handler to publish handler, in manual ack
+// mode, the packet is acked once the topic handler returned
+func (h TopicHandleFunc) publishHandler() PublishHandleFunc {
+	return func(client Client, p *PublishPacket) {
+		h(client, p.TopicName, p.Qos, p.Payload)
+		client.Ack(p)
+	}
+}
+
+// HandlerPanicHandleFunc handles the panic recovered from topic handlers
+// v is the value passed to panic and stack is the stack trace of the panic
+type HandlerPanicHandleFunc func(client Client, topic string, v interface{}, stack []byte)
+
 // PubHandleFunc handles the error occurred when publish some message
 // if err is not nil, that means a error occurred when sending pub msg
 type PubHandleFunc func(client Client, topic string, err error)
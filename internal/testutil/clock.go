@@ -0,0 +1,186 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package testutil provides helpers for tests of the client
+package testutil
+
+import (
+	"sync"
+	"time"
+
+	"github.com/goiiot/libmqtt/internal/clock"
+)
+
+// FakeClock is the clock advanced manually by tests, timers and tickers
+// fire in Advance once due
+type FakeClock struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	now    time.Time
+	timers map[*fakeTimer]struct{} // active timers and tickers
+}
+
+// NewFakeClock creates the fake clock starting at now
+func NewFakeClock(now time.Time) *FakeClock {
+	c := &FakeClock{now: now, timers: make(map[*fakeTimer]struct{})}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+var _ clock.Clock = (*FakeClock)(nil)
+
+// Now returns the time of the fake clock
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// NewTimer creates the timer firing once the clock advanced by d
+func (c *FakeClock) NewTimer(d time.Duration) clock.Timer {
+	return c.newTimer(d, 0)
+}
+
+// NewTicker creates the ticker firing every d the clock advanced, ticks
+// are dropped if not received as time.Ticker does
+func (c *FakeClock) NewTicker(d time.Duration) clock.Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	return fakeTicker{c.newTimer(d, d)}
+}
+
+// Sleep blocks until the clock advanced by d
+func (c *FakeClock) Sleep(d time.Duration) {
+	<-c.NewTimer(d).C()
+}
+
+// Advance moves the clock forward by d and fires timers and tickers due
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+	for t := range c.timers {
+		if t.when.After(c.now) {
+			continue
+		}
+
+		select {
+		case t.ch <- t.when:
+		default:
+		}
+
+		if t.period == 0 {
+			delete(c.timers, t)
+			continue
+		}
+		for !t.when.After(c.now) {
+			t.when = t.when.Add(t.period)
+		}
+	}
+	c.cond.Broadcast()
+}
+
+// BlockUntil blocks until at least n timers and tickers are active (e.g.
+// created by the goroutine under test and not fired or stopped)
+func (c *FakeClock) BlockUntil(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for len(c.timers) < n {
+		c.cond.Wait()
+	}
+}
+
+// BlockUntilAt blocks until any active timer or ticker is due at when
+// (e.g. reset by the goroutine under test)
+func (c *FakeClock) BlockUntilAt(when time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for !c.dueAt(when) {
+		c.cond.Wait()
+	}
+}
+
+func (c *FakeClock) dueAt(when time.Time) bool {
+	for t := range c.timers {
+		if t.when.Equal(when) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *FakeClock) newTimer(d, period time.Duration) *fakeTimer {
+	t := &fakeTimer{clock: c, ch: make(chan time.Time, 1), period: period}
+	t.Reset(d)
+	return t
+}
+
+// fakeTimer is the timer (period is zero) or ticker of FakeClock
+type fakeTimer struct {
+	clock  *FakeClock
+	ch     chan time.Time
+	when   time.Time
+	period time.Duration
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.ch
+}
+
+func (t *fakeTimer) Stop() bool {
+	c := t.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, active := c.timers[t]
+	delete(c.timers, t)
+	c.cond.Broadcast()
+	return active
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	c := t.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, active := c.timers[t]
+	t.when = c.now.Add(d)
+	if d <= 0 && t.period == 0 {
+		// fires immediately
+		delete(c.timers, t)
+		select {
+		case t.ch <- t.when:
+		default:
+		}
+		return active
+	}
+
+	c.timers[t] = struct{}{}
+	c.cond.Broadcast()
+	return active
+}
+
+type fakeTicker struct {
+	*fakeTimer
+}
+
+func (t fakeTicker) Stop() {
+	t.fakeTimer.Stop()
+}
@@ -0,0 +1,76 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package testutil
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Unix(0, 0)
+	c := NewFakeClock(start)
+
+	timer := c.NewTimer(time.Second)
+	ticker := c.NewTicker(400 * time.Millisecond)
+	stopped := c.NewTimer(time.Millisecond)
+	if !stopped.Stop() || stopped.Stop() {
+		t.Error("unexpected result of Stop")
+	}
+
+	c.Advance(999 * time.Millisecond)
+	select {
+	case <-timer.C():
+		t.Fatal("timer fired before due")
+	default:
+	}
+	// ticks not received are dropped
+	if at := <-ticker.C(); !at.Equal(start.Add(400 * time.Millisecond)) {
+		t.Error("unexpected tick =", at)
+	}
+
+	c.Advance(time.Millisecond)
+	if at := <-timer.C(); !at.Equal(start.Add(time.Second)) {
+		t.Error("unexpected timer fired at =", at)
+	}
+	if !c.Now().Equal(start.Add(time.Second)) {
+		t.Error("unexpected now =", c.Now())
+	}
+
+	if timer.Reset(time.Second) {
+		t.Error("timer fired still active")
+	}
+	c.BlockUntilAt(start.Add(2 * time.Second))
+
+	select {
+	case <-stopped.C():
+		t.Error("stopped timer fired")
+	default:
+	}
+
+	slept := make(chan struct{})
+	go func() {
+		c.Sleep(time.Minute)
+		close(slept)
+	}()
+	// timer, ticker and sleep
+	c.BlockUntil(3)
+	c.Advance(time.Minute)
+	<-slept
+	<-timer.C()
+	ticker.Stop()
+}
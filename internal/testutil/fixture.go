@@ -0,0 +1,127 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package testutil
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// packet type names of fixtures, by control packet type
+var fixtureTypes = [...]string{
+	"reserved", "connect", "connack", "publish", "puback", "pubrec", "pubrel", "pubcomp",
+	"subscribe", "suback", "unsubscribe", "unsuback", "pingreq", "pingresp", "disconnect", "auth",
+}
+
+// ReadHex reads hex bytes separated by spaces or lines, `#` starts a
+// comment to the end of the line
+func ReadHex(r io.Reader) ([]byte, error) {
+	var data []byte
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		text := s.Text()
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+
+		for _, field := range strings.Fields(text) {
+			b, err := hex.DecodeString(field)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", line, err)
+			}
+			data = append(data, b...)
+		}
+	}
+	return data, s.Err()
+}
+
+// WriteHex writes data as the fixture read by ReadHex, comments are
+// written first
+func WriteHex(w io.Writer, data []byte, comments ...string) error {
+	buf := new(bytes.Buffer)
+	for _, c := range comments {
+		buf.WriteString("# " + c + "\n")
+	}
+
+	for len(data) > 0 {
+		n := 16
+		if n > len(data) {
+			n = len(data)
+		}
+
+		for i, b := range data[:n] {
+			if i > 0 {
+				buf.WriteByte(' ')
+			}
+			fmt.Fprintf(buf, "%02x", b)
+		}
+		buf.WriteByte('\n')
+		data = data[n:]
+	}
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// WriteFixtures writes frames to dir as <source>-<type>-<n>.hex files,
+// fixtures already exist are not overwritten (numbered after them),
+// errors are reported with errorf, returns names of fixtures written
+func WriteFixtures(dir, source string, frames []MQTTFrame, errorf func(format string, args ...interface{})) []string {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		errorf("create fixture dir failed, err = %v", err)
+		return nil
+	}
+
+	var written []string
+	counts := make(map[string]int)
+	for _, frame := range frames {
+		typ := fixtureTypes[frame.Data[0]>>4]
+
+		var name string
+		for {
+			counts[typ]++
+			name = filepath.Join(dir, fmt.Sprintf("%s-%s-%d.hex", source, typ, counts[typ]))
+			if _, err := os.Stat(name); os.IsNotExist(err) {
+				break
+			}
+		}
+
+		direction := "from server"
+		if frame.ToServer {
+			direction = "to server"
+		}
+
+		buf := new(bytes.Buffer)
+		_ = WriteHex(buf, frame.Data,
+			fmt.Sprintf("%s %s, stream %s", strings.ToUpper(typ), direction, frame.Stream),
+			"source: "+source+" capture",
+		)
+		if err := ioutil.WriteFile(name, buf.Bytes(), 0644); err != nil {
+			errorf("write fixture failed, err = %v", err)
+			continue
+		}
+		written = append(written, name)
+	}
+	return written
+}
@@ -0,0 +1,247 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package testutil
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// pcap link types supported
+const (
+	linkNull     = 0   // BSD loopback
+	linkEthernet = 1   // Ethernet
+	linkRaw      = 101 // raw IPv4 or IPv6
+	linkLinuxSLL = 113 // Linux cooked capture
+)
+
+// ErrPcapFormat is returned by PcapMQTTFrames when the file is not a
+// classic pcap file (pcapng is not supported, convert it with
+// `editcap -F pcap`) or the link type is not supported
+var ErrPcapFormat = errors.New("unsupported pcap format ")
+
+// MQTTFrame is a MQTT packet carried in the TCP stream
+type MQTTFrame struct {
+	// ToServer is true if sent to the MQTT server port
+	ToServer bool
+	// Stream identifies the TCP connection (addresses and ports)
+	Stream string
+	// Data is the whole packet, fixed header included
+	Data []byte
+}
+
+// tcpSegment is the TCP payload of one direction
+type tcpSegment struct {
+	seq  uint32
+	data []byte
+}
+
+// PcapMQTTFrames returns MQTT packets sent to and from the server port in
+// the classic pcap file, TCP payloads of every direction are reassembled
+// in sequence order (retransmissions dropped), packets are returned by
+// stream in the order of the first packet captured of the stream
+func PcapMQTTFrames(r io.Reader, port uint16) ([]MQTTFrame, error) {
+	header := make([]byte, 24)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	var order binary.ByteOrder
+	switch binary.LittleEndian.Uint32(header) {
+	case 0xa1b2c3d4, 0xa1b23c4d:
+		order = binary.LittleEndian
+	case 0xd4c3b2a1, 0x4d3cb2a1:
+		order = binary.BigEndian
+	default:
+		return nil, ErrPcapFormat
+	}
+	linkType := order.Uint32(header[20:])
+
+	var (
+		streams  []string
+		segments = make(map[string][]tcpSegment)
+		toServer = make(map[string]bool) // also streams seen
+	)
+	record := make([]byte, 16)
+	for {
+		if _, err := io.ReadFull(r, record); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		frame := make([]byte, order.Uint32(record[8:]))
+		if _, err := io.ReadFull(r, frame); err != nil {
+			return nil, err
+		}
+
+		stream, seq, srcPort, dstPort, payload, err := tcpPayload(linkType, frame)
+		if err != nil {
+			return nil, err
+		}
+		if stream == "" || srcPort != port && dstPort != port {
+			continue
+		}
+
+		if _, ok := toServer[stream]; !ok {
+			streams = append(streams, stream)
+			toServer[stream] = dstPort == port
+		}
+		if len(payload) > 0 {
+			segments[stream] = append(segments[stream], tcpSegment{seq: seq, data: payload})
+		}
+	}
+
+	var frames []MQTTFrame
+	for _, stream := range streams {
+		data := reassemble(segments[stream])
+		for len(data) > 0 {
+			n, ok := mqttFrameLen(data)
+			if !ok {
+				return frames, fmt.Errorf("stream %s: truncated MQTT packet", stream)
+			}
+
+			frames = append(frames, MQTTFrame{ToServer: toServer[stream], Stream: stream, Data: data[:n]})
+			data = data[n:]
+		}
+	}
+	return frames, nil
+}
+
+// tcpPayload returns the TCP payload of the captured frame, stream is
+// empty if not TCP
+func tcpPayload(linkType uint32, frame []byte) (stream string, seq uint32, srcPort, dstPort uint16, payload []byte, err error) {
+	var ip []byte
+	switch linkType {
+	case linkNull:
+		if len(frame) < 4 {
+			return
+		}
+		ip = frame[4:]
+	case linkEthernet:
+		if len(frame) < 14 {
+			return
+		}
+		etherType, offset := binary.BigEndian.Uint16(frame[12:]), 14
+		if etherType == 0x8100 && len(frame) >= 18 {
+			// VLAN tagged
+			etherType, offset = binary.BigEndian.Uint16(frame[16:]), 18
+		}
+		if etherType != 0x0800 && etherType != 0x86dd {
+			return
+		}
+		ip = frame[offset:]
+	case linkRaw:
+		ip = frame
+	case linkLinuxSLL:
+		if len(frame) < 16 {
+			return
+		}
+		ip = frame[16:]
+	default:
+		err = ErrPcapFormat
+		return
+	}
+
+	var src, dst string
+	var tcp []byte
+	switch {
+	case len(ip) >= 20 && ip[0]>>4 == 4:
+		headerLen, totalLen := int(ip[0]&0x0f)*4, int(binary.BigEndian.Uint16(ip[2:]))
+		if ip[9] != 6 || headerLen < 20 || totalLen > len(ip) || headerLen > totalLen {
+			return
+		}
+		src, dst = fmt.Sprintf("%d.%d.%d.%d", ip[12], ip[13], ip[14], ip[15]), fmt.Sprintf("%d.%d.%d.%d", ip[16], ip[17], ip[18], ip[19])
+		tcp = ip[headerLen:totalLen]
+	case len(ip) >= 40 && ip[0]>>4 == 6:
+		// extension headers not supported
+		payloadLen := int(binary.BigEndian.Uint16(ip[4:]))
+		if ip[6] != 6 || 40+payloadLen > len(ip) {
+			return
+		}
+		src, dst = fmt.Sprintf("[%x]", ip[8:24]), fmt.Sprintf("[%x]", ip[24:40])
+		tcp = ip[40 : 40+payloadLen]
+	default:
+		return
+	}
+
+	if len(tcp) < 20 || int(tcp[12]>>4)*4 > len(tcp) {
+		return
+	}
+	srcPort, dstPort = binary.BigEndian.Uint16(tcp), binary.BigEndian.Uint16(tcp[2:])
+	seq = binary.BigEndian.Uint32(tcp[4:])
+	stream = fmt.Sprintf("%s:%d->%s:%d", src, srcPort, dst, dstPort)
+	payload = tcp[int(tcp[12]>>4)*4:]
+	return
+}
+
+// reassemble the TCP payload in sequence order, data received more than
+// once is used once
+func reassemble(segments []tcpSegment) []byte {
+	if len(segments) == 0 {
+		return nil
+	}
+
+	// the earliest sequence, segments may be captured out of order
+	base := segments[0].seq
+	for _, s := range segments[1:] {
+		if int32(s.seq-base) < 0 {
+			base = s.seq
+		}
+	}
+
+	sort.SliceStable(segments, func(i, j int) bool {
+		// relative to the first segment to handle sequence wrap around
+		return segments[i].seq-base < segments[j].seq-base
+	})
+
+	var data []byte
+	next := uint32(0)
+	for _, s := range segments {
+		offset := s.seq - base
+		end := offset + uint32(len(s.data))
+		if end <= next {
+			continue
+		}
+		if offset > next {
+			// segment not captured, stop at the gap
+			break
+		}
+
+		data = append(data, s.data[next-offset:]...)
+		next = end
+	}
+	return data
+}
+
+// mqttFrameLen returns the length of the MQTT packet at the beginning of
+// data, false if truncated
+func mqttFrameLen(data []byte) (int, bool) {
+	length, multiplier := 0, 1
+	for i := 1; i < len(data) && i <= 4; i++ {
+		length += int(data[i]&0x7f) * multiplier
+		if data[i]&0x80 == 0 {
+			n := 1 + i + length
+			return n, n <= len(data)
+		}
+		multiplier *= 128
+	}
+	return 0, false
+}
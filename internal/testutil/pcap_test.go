@@ -0,0 +1,152 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package testutil
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// pcapWriter writes the classic pcap file of Ethernet frames with IPv4
+// TCP segments
+type pcapWriter struct {
+	buf *bytes.Buffer
+}
+
+func newPcapWriter() *pcapWriter {
+	w := &pcapWriter{buf: new(bytes.Buffer)}
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header, 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], 65535)
+	binary.LittleEndian.PutUint32(header[20:], linkEthernet)
+	w.buf.Write(header)
+	return w
+}
+
+func (w *pcapWriter) segment(srcPort, dstPort uint16, seq uint32, payload []byte) {
+	tcp := make([]byte, 20)
+	binary.BigEndian.PutUint16(tcp, srcPort)
+	binary.BigEndian.PutUint16(tcp[2:], dstPort)
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	tcp[12] = 5 << 4
+	tcp = append(tcp, payload...)
+
+	ip := make([]byte, 20)
+	ip[0], ip[9] = 0x45, 6
+	binary.BigEndian.PutUint16(ip[2:], uint16(20+len(tcp)))
+	copy(ip[12:], []byte{127, 0, 0, 1})
+	copy(ip[16:], []byte{127, 0, 0, 1})
+	ip = append(ip, tcp...)
+
+	frame := make([]byte, 14)
+	binary.BigEndian.PutUint16(frame[12:], 0x0800)
+	frame = append(frame, ip...)
+
+	record := make([]byte, 16)
+	binary.LittleEndian.PutUint32(record[8:], uint32(len(frame)))
+	binary.LittleEndian.PutUint32(record[12:], uint32(len(frame)))
+	w.buf.Write(record)
+	w.buf.Write(frame)
+}
+
+func TestPcapMQTTFrames(t *testing.T) {
+	var (
+		connect = []byte{0x10, 0x0c, 0x00, 0x04, 'M', 'Q', 'T', 'T', 0x04, 0x02, 0x00, 0x3c, 0x00, 0x00}
+		connAck = []byte{0x20, 0x02, 0x00, 0x00}
+		publish = []byte{0x30, 0x05, 0x00, 0x01, 't', 'h', 'i'}
+	)
+
+	w := newPcapWriter()
+	// SYN without payload, sequence wraps around
+	w.segment(50000, 1883, 0xfffffff0, nil)
+	// connect split, out of order and retransmitted
+	w.segment(50000, 1883, 0xfffffff5, connect[5:])
+	w.segment(50000, 1883, 0xfffffff0, connect[:5])
+	w.segment(50000, 1883, 0xfffffff0, connect[:5])
+	w.segment(1883, 50000, 100, connAck)
+	// publish and pingreq in one segment
+	w.segment(50000, 1883, 0xfffffff0+uint32(len(connect)), append(append([]byte{}, publish...), 0xc0, 0x00))
+	// other port
+	w.segment(50001, 8080, 1, []byte("GET / HTTP/1.1\r\n"))
+
+	frames, err := PcapMQTTFrames(w.buf, 1883)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []MQTTFrame{
+		{ToServer: true, Data: connect},
+		{ToServer: true, Data: publish},
+		{ToServer: true, Data: []byte{0xc0, 0x00}},
+		{ToServer: false, Data: connAck},
+	}
+	if len(frames) != len(expected) {
+		t.Fatal("unexpected frames =", frames)
+	}
+	for i, f := range frames {
+		if f.ToServer != expected[i].ToServer || !bytes.Equal(f.Data, expected[i].Data) {
+			t.Errorf("unexpected frame %d = %+v", i, f)
+		}
+	}
+	if frames[0].Stream != "127.0.0.1:50000->127.0.0.1:1883" {
+		t.Error("unexpected stream =", frames[0].Stream)
+	}
+
+	if _, err := PcapMQTTFrames(bytes.NewReader(make([]byte, 24)), 1883); err != ErrPcapFormat {
+		t.Error("unexpected error of bad magic =", err)
+	}
+}
+
+func TestWriteFixtures(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fixtures")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	data := make([]byte, 20)
+	data[0], data[1] = 0x30, 18
+	frames := []MQTTFrame{{ToServer: true, Stream: "a->b", Data: data}, {Data: []byte{0xd0, 0x00}}}
+
+	for round := 1; round <= 2; round++ {
+		names := WriteFixtures(dir, "mosquitto", frames, t.Errorf)
+		if len(names) != 2 || !strings.HasSuffix(names[0], "mosquitto-publish-"+string(rune('0'+round))+".hex") {
+			t.Fatal("unexpected fixtures written =", names)
+		}
+
+		f, err := os.Open(filepath.Join(names[0]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		read, err := ReadHex(f)
+		_ = f.Close()
+		if err != nil || !bytes.Equal(read, data) {
+			t.Error("fixture not read back, err =", err, "data =", read)
+		}
+	}
+
+	if _, err := ReadHex(strings.NewReader("10 0g  # bad")); err == nil {
+		t.Error("bad hex accepted")
+	}
+}
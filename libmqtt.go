@@ -17,8 +17,10 @@
 package libmqtt
 
 import (
+	"bytes"
+	"encoding"
 	"fmt"
-	"io"
+	"sort"
 	"sync"
 )
 
@@ -31,20 +33,29 @@ var (
 	}
 )
 
+// propertySet holds encoded property values, a nil value is added when
+// the property can not be encoded, and reported by bytes
 type propertySet map[byte][][]byte
 
 func (p propertySet) add(propKey byte, propValue interface{}) {
-	var val []byte
+	var (
+		val []byte
+		err error
+	)
 	switch v := propValue.(type) {
 	case string:
-		if propValue.(string) != "" {
-			val = encodeStringWithLen(propValue.(string))
+		if v != "" {
+			val, err = encodeStringWithLen(v)
 		}
 	case []byte:
-		if len(propValue.([]byte)) > 0 {
-			val = encodeBytesWithLen(propValue.([]byte))
+		if len(v) > 0 {
+			val, err = encodeBytesWithLen(v)
 		}
 	case *bool:
+		if v == nil {
+			return
+		}
+
 		if *v {
 			val = []byte{1}
 		} else {
@@ -73,13 +84,29 @@ func (p propertySet) add(propKey byte, propValue interface{}) {
 			putUint32(val, v)
 		}
 	case UserProps:
-		v.encodeTo(val)
+		// every key value pair is a property, in order
+		for _, prop := range v {
+			pair, err := encodeStringWithLen(prop.Key)
+			if err == nil {
+				pair, err = appendStringWithLen(pair, prop.Value)
+			}
+			if err != nil {
+				pair = nil
+			}
+			p[propKey] = append(p[propKey], pair)
+		}
+		return
 	case nil:
 		return
 	default:
 		panic(fmt.Sprintf("unexpected property value type %T", v))
 	}
 
+	if err != nil {
+		p[propKey] = append(p[propKey], nil)
+		return
+	}
+
 	if val != nil {
 		v := p[propKey]
 		p[propKey] = append(v, val)
@@ -95,54 +122,130 @@ func (p propertySet) del(propKey byte) {
 	delete(p, propKey)
 }
 
-func (p propertySet) bytes() []byte {
+// bytes encodes properties in the order of property identifiers, so the
+// same properties are always encoded to the same bytes
+func (p propertySet) bytes() ([]byte, error) {
+	keys := make([]int, 0, len(p))
+	for propKey := range p {
+		keys = append(keys, int(propKey))
+	}
+	sort.Ints(keys)
+
 	var ret []byte
-	for propKey, propValue := range p {
-		for _, v := range propValue {
+	for _, k := range keys {
+		propKey := byte(k)
+		for _, v := range p[propKey] {
+			if v == nil {
+				return nil, ErrStringTooLong
+			}
+
 			ret = append(ret, propKey)
 			ret = append(ret, v...)
 		}
 	}
-	return ret
+	return ret, nil
+}
+
+// UserProp is a user defined property
+type UserProp struct {
+	Key   string
+	Value string
 }
 
-// UserProps contains user defined properties
-type UserProps map[string][]string
+// UserProps contains user defined properties in the order of sent or
+// received, the same key can appear more than once
+type UserProps []UserProp
 
-func (u UserProps) Add(key, value string) {
-	val, ok := u[key]
-	if !ok || val == nil {
-		val = make([]string, 0)
+// NewUserProps creates UserProps from the map, keys are sorted since map
+// has no order, values of the same key are kept in order
+func NewUserProps(m map[string][]string) UserProps {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
 	}
+	sort.Strings(keys)
+
+	var u UserProps
+	for _, k := range keys {
+		for _, v := range m[k] {
+			u = append(u, UserProp{Key: k, Value: v})
+		}
+	}
+	return u
+}
 
-	u[key] = append(val, value)
+// Add the key value pair to the end
+func (u *UserProps) Add(key, value string) {
+	*u = append(*u, UserProp{Key: key, Value: value})
 }
 
+// Get the first value of the key
 func (u UserProps) Get(key string) (string, bool) {
-	if val, ok := u[key]; ok && len(val) > 0 {
-		return val[0], true
+	for _, p := range u {
+		if p.Key == key {
+			return p.Value, true
+		}
 	}
 
 	return "", false
 }
 
-func (u UserProps) Set(key string, value string) {
-	u[key] = []string{value}
+// Values returns all values of the key in order
+func (u UserProps) Values(key string) []string {
+	var values []string
+	for _, p := range u {
+		if p.Key == key {
+			values = append(values, p.Value)
+		}
+	}
+	return values
+}
+
+// Set the only value of the key, replaces the first value of the key and
+// deletes others, or adds to the end if not exists
+func (u *UserProps) Set(key string, value string) {
+	if _, ok := u.Get(key); !ok {
+		u.Add(key, value)
+		return
+	}
+
+	set, ret := false, (*u)[:0]
+	for _, p := range *u {
+		switch {
+		case p.Key != key:
+			ret = append(ret, p)
+		case !set:
+			ret = append(ret, UserProp{Key: key, Value: value})
+			set = true
+		}
+	}
+	*u = ret
+}
+
+// Del all values of the key
+func (u *UserProps) Del(key string) {
+	*u = u.without(key)
 }
 
-func (u UserProps) Del(key string) {
-	delete(u, key)
+// Map returns all values grouped by key
+func (u UserProps) Map() map[string][]string {
+	m := make(map[string][]string)
+	for _, p := range u {
+		m[p.Key] = append(m[p.Key], p.Value)
+	}
+	return m
 }
 
-func (u UserProps) encodeTo(result []byte) []byte {
-	for k, v := range u {
-		for _, val := range v {
-			// result = append(result, propKeyUserProps)
-			result = append(result, encodeStringWithLen(k)...)
-			result = append(result, encodeStringWithLen(val)...)
+// without returns the properties except the key, the backing array is
+// reused
+func (u UserProps) without(key string) UserProps {
+	ret := u[:0]
+	for _, p := range u {
+		if p.Key != key {
+			ret = append(ret, p)
 		}
 	}
-	return result
+	return ret
 }
 
 // Packet is MQTT control packet
@@ -150,9 +253,19 @@ type Packet interface {
 	// Type return the packet type
 	Type() CtrlType
 
-	// Bytes presentation of this packet
+	// Bytes presentation of this packet, nil if the packet can not be
+	// encoded
+	//
+	// Deprecated: use MarshalBinary to get the encode error (will be
+	// removed in v1.0)
 	Bytes() []byte
 
+	// MarshalBinary encodes the packet with the protocol version set,
+	// UnmarshalBinary decodes the only packet of the same type in data
+	// with the protocol version set
+	encoding.BinaryMarshaler
+	encoding.BinaryUnmarshaler
+
 	// Write bytes to the buffered writer
 	WriteTo(w BufferedWriter) error
 
@@ -160,6 +273,10 @@ type Packet interface {
 	Version() ProtoVersion
 
 	SetVersion(version ProtoVersion)
+
+	// Clone returns a deep copy of the packet, modifying the copy (e.g.
+	// payload, topics or properties) will not affect the packet
+	Clone() Packet
 }
 
 // BasePacket for packet encoding and MQTT version note
@@ -168,47 +285,109 @@ type BasePacket struct {
 	mutex        sync.RWMutex
 }
 
-func (b *BasePacket) write(w io.Writer, first byte, varHeader, payload []byte) error {
-	_, err := w.Write([]byte{first})
+func (b *BasePacket) write(w BufferedWriter, first byte, varHeader, payload []byte) error {
+	err := b.writeHeader(w, first, varHeader, len(payload))
 	if err != nil {
 		return err
 	}
 
-	remainingLengthBytes, err := varIntBytes(len(varHeader) + len(payload))
+	if payload != nil {
+		_, err = w.Write(payload)
+	}
+	return err
+}
+
+// writeHeader writes fixed header and variable header, payload
+// of payloadLength bytes MUST be written after it
+func (b *BasePacket) writeHeader(w BufferedWriter, first byte, varHeader []byte, payloadLength int) error {
+	remainLength := len(varHeader) + payloadLength
+	if payloadLength > maxMsgSize || remainLength > maxMsgSize {
+		return ErrEncodeLargePacket
+	}
+
+	if buf, ok := w.(*bytes.Buffer); ok {
+		// fixed header takes at most 5 bytes
+		buf.Grow(5 + remainLength)
+	}
+
+	err := w.WriteByte(first)
 	if err != nil {
 		return err
 	}
 
-	_, err = w.Write(remainingLengthBytes)
+	err = writeVarInt(remainLength, w)
 	if err != nil {
 		return err
 	}
 
 	if varHeader != nil {
 		_, err = w.Write(varHeader)
-		if err != nil {
-			return err
-		}
 	}
+	return err
+}
 
-	if payload != nil {
-		_, err = w.Write(payload)
+// encodeBufPool holds scratch buffers for MQTT 5 variable header encoding
+var encodeBufPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+const (
+	// max size of scratch buffer to be put back to encodeBufPool
+	maxPooledEncodeBufSize = 64 * 1024
+	// max size of decode buffer to be kept by publishPool
+	maxPooledDecodeBufSize = 64 * 1024
+	// max size of decode buffer allocated before the packet body read
+	maxDecodePreAlloc = 64 * 1024
+)
+
+func (b *BasePacket) writeV5(w BufferedWriter, first byte, varHeader, props, payload []byte) error {
+	return withV5VarHeader(varHeader, props, func(v5VarHeader []byte) error {
+		return b.write(w, first, v5VarHeader, payload)
+	})
+}
+
+// writeV5Ack writes the MQTT 5 PubAck, PubRec, PubRel and PubComp packets,
+// the reason code is omitted if CodeSuccess without properties, and the
+// property length is omitted if no properties
+func (b *BasePacket) writeV5Ack(w BufferedWriter, first byte, packetID uint16, code byte, props []byte) error {
+	varHeader := []byte{byte(packetID >> 8), byte(packetID), code}
+	if len(props) > 0 {
+		return b.writeV5(w, first, varHeader, props, nil)
 	}
-	return err
+
+	if code == CodeSuccess {
+		varHeader = varHeader[:2]
+	}
+	return b.write(w, first, varHeader, nil)
 }
 
-func (b *BasePacket) writeV5(w io.Writer, first byte, varHeader, props, payload []byte) error {
-	propLen := len(props)
-	propsLengthBytes, err := varIntBytes(propLen)
-	if err != nil {
+// writeV5Reason writes the MQTT 5 Disconnect and Auth packets, the reason
+// code is omitted if CodeSuccess without properties
+func (b *BasePacket) writeV5Reason(w BufferedWriter, first byte, code byte, props []byte) error {
+	if code == CodeSuccess && len(props) == 0 {
+		return b.write(w, first, nil, nil)
+	}
+	return b.writeV5(w, first, []byte{code}, props, nil)
+}
+
+// withV5VarHeader calls f with the MQTT 5 variable header (with properties)
+// encoded in a pooled scratch buffer, which MUST NOT be used after f returned
+func withV5VarHeader(varHeader, props []byte, f func(v5VarHeader []byte) error) error {
+	buf := encodeBufPool.Get().(*bytes.Buffer)
+	defer func() {
+		if buf.Cap() <= maxPooledEncodeBufSize {
+			buf.Reset()
+			encodeBufPool.Put(buf)
+		}
+	}()
+
+	buf.Write(varHeader)
+	if err := writeVarInt(len(props), buf); err != nil {
 		return err
 	}
+	buf.Write(props)
 
-	actualVarHeader := make([]byte, 0, len(varHeader)+len(propsLengthBytes)+propLen)
-	actualVarHeader = append(actualVarHeader, varHeader...)
-	actualVarHeader = append(actualVarHeader, propsLengthBytes...)
-	actualVarHeader = append(actualVarHeader, props...)
-	return b.write(w, first, actualVarHeader, payload)
+	return f(buf.Bytes())
 }
 
 func (b *BasePacket) SetVersion(version ProtoVersion) {
@@ -242,6 +421,14 @@ func (t *Topic) String() string {
 
 const (
 	maxMsgSize = 268435455
+	maxSubID   = 268435455
+
+	// max client id length allowed by MQTT 3.1 (and MQTT 3.1.1 servers
+	// MUST accept)
+	maxClientIDLenV31 = 23
+
+	handlerQueueSize   = 64
+	defaultConnBufSize = 4096
 )
 
 // CtrlType is MQTT Control packet type
@@ -269,6 +456,7 @@ const (
 type ProtoVersion byte
 
 const (
+	V31  ProtoVersion = 3 // V31 means MQTT 3.1 (protocol name "MQIsdp")
 	V311 ProtoVersion = 4 // V311 means MQTT 3.1.1
 	V5   ProtoVersion = 5 // V5 means MQTT 5
 )
@@ -383,3 +571,48 @@ const (
 	propKeySubIDAvail             = 41 // byte, Packet: ConnAck
 	propKeySharedSubAvail         = 42 // byte, Packet: ConnAck
 )
+
+// ctrlWill is the packet type of will properties in propPackets
+const ctrlWill CtrlType = 0
+
+// propPackets is the packet types a property is allowed in, bit n is set
+// if allowed in packet type n
+var propPackets = map[byte]uint16{
+	propKeyPayloadFormatIndicator: ctrlBits(ctrlWill, CtrlPublish),
+	propKeyMessageExpiryInterval:  ctrlBits(ctrlWill, CtrlPublish),
+	propKeyContentType:            ctrlBits(ctrlWill, CtrlPublish),
+	propKeyRespTopic:              ctrlBits(ctrlWill, CtrlPublish),
+	propKeyCorrelationData:        ctrlBits(ctrlWill, CtrlPublish),
+	propKeySubID:                  ctrlBits(CtrlPublish, CtrlSubscribe),
+	propKeySessionExpiryInterval:  ctrlBits(CtrlConn, CtrlConnAck, CtrlDisConn),
+	propKeyAssignedClientID:       ctrlBits(CtrlConnAck),
+	propKeyServerKeepalive:        ctrlBits(CtrlConnAck),
+	propKeyAuthMethod:             ctrlBits(CtrlConn, CtrlConnAck, CtrlAuth),
+	propKeyAuthData:               ctrlBits(CtrlConn, CtrlConnAck, CtrlAuth),
+	propKeyReqProblemInfo:         ctrlBits(CtrlConn),
+	propKeyWillDelayInterval:      ctrlBits(ctrlWill),
+	propKeyReqRespInfo:            ctrlBits(CtrlConn),
+	propKeyRespInfo:               ctrlBits(CtrlConnAck),
+	propKeyServerRef:              ctrlBits(CtrlConnAck, CtrlDisConn),
+	propKeyReasonString: ctrlBits(CtrlConnAck, CtrlPubAck, CtrlPubRecv, CtrlPubRel, CtrlPubComp,
+		CtrlSubAck, CtrlUnSubAck, CtrlDisConn, CtrlAuth),
+	propKeyMaxRecv:       ctrlBits(CtrlConn, CtrlConnAck),
+	propKeyMaxTopicAlias: ctrlBits(CtrlConn, CtrlConnAck),
+	propKeyTopicAlias:    ctrlBits(CtrlPublish),
+	propKeyMaxQos:        ctrlBits(CtrlConnAck),
+	propKeyRetainAvail:   ctrlBits(CtrlConnAck),
+	propKeyUserProps: ctrlBits(ctrlWill, CtrlConn, CtrlConnAck, CtrlPublish, CtrlPubAck, CtrlPubRecv, CtrlPubRel,
+		CtrlPubComp, CtrlSubscribe, CtrlSubAck, CtrlUnSub, CtrlUnSubAck, CtrlDisConn, CtrlAuth),
+	propKeyMaxPacketSize:    ctrlBits(CtrlConn, CtrlConnAck),
+	propKeyWildcardSubAvail: ctrlBits(CtrlConnAck),
+	propKeySubIDAvail:       ctrlBits(CtrlConnAck),
+	propKeySharedSubAvail:   ctrlBits(CtrlConnAck),
+}
+
+func ctrlBits(types ...CtrlType) uint16 {
+	var bits uint16
+	for _, t := range types {
+		bits |= 1 << t
+	}
+	return bits
+}
@@ -49,7 +49,7 @@ var (
 )
 
 var (
-	testConstUserProps      = UserProps{"MQ": []string{"TT"}}
+	testConstUserProps      = UserProps{{Key: "MQ", Value: "TT"}}
 	testConstUserPropsBytes = []byte{0, 2, 'M', 'Q', 0, 2, 'T', 'T'}
 )
 
@@ -105,3 +105,62 @@ func init() {
 	initTestData_Sub()
 	initTestData_Pub()
 }
+
+func TestUserProps(t *testing.T) {
+	var u UserProps
+	u.Add("k", "v1")
+	u.Add("a", "b")
+	u.Add("k", "v2")
+	assert.Equal(t, UserProps{{"k", "v1"}, {"a", "b"}, {"k", "v2"}}, u)
+
+	v, ok := u.Get("k")
+	assert.True(t, ok)
+	assert.Equal(t, "v1", v)
+	assert.Equal(t, []string{"v1", "v2"}, u.Values("k"))
+	assert.Equal(t, map[string][]string{"k": {"v1", "v2"}, "a": {"b"}}, u.Map())
+
+	_, ok = u.Get("none")
+	assert.False(t, ok)
+	assert.Nil(t, u.Values("none"))
+
+	u.Set("k", "v3")
+	assert.Equal(t, UserProps{{"k", "v3"}, {"a", "b"}}, u)
+	u.Set("c", "d")
+	assert.Equal(t, UserProps{{"k", "v3"}, {"a", "b"}, {"c", "d"}}, u)
+
+	u.Del("a")
+	assert.Equal(t, UserProps{{"k", "v3"}, {"c", "d"}}, u)
+
+	assert.Equal(t, UserProps{{"a", "1"}, {"a", "2"}, {"b", "3"}},
+		NewUserProps(map[string][]string{"b": {"3"}, "a": {"1", "2"}}))
+}
+
+func TestUserProps_RoundTrip(t *testing.T) {
+	props := UserProps{{"k", "v2"}, {"a", "b"}, {"k", "v1"}, {"k", "v2"}, {"", ""}}
+
+	for _, pkt := range []Packet{
+		&PublishPacket{TopicName: "/foo", Props: &PublishProps{UserProps: props}},
+		&PubAckPacket{PacketID: 1, Props: &PubAckProps{UserProps: props}},
+		&SubscribePacket{PacketID: 1, Topics: []*Topic{{Name: "/foo"}}, Props: &SubscribeProps{UserProps: props}},
+		&DisconnPacket{Props: &DisconnProps{UserProps: props}},
+	} {
+		pkt.SetVersion(V5)
+		decoded, err := Decode(V5, bytes.NewReader(pkt.Bytes()))
+		if !assert.NoError(t, err) {
+			continue
+		}
+
+		var u UserProps
+		switch p := decoded.(type) {
+		case *PublishPacket:
+			u = p.Props.UserProps
+		case *PubAckPacket:
+			u = p.Props.UserProps
+		case *SubscribePacket:
+			u = p.Props.UserProps
+		case *DisconnPacket:
+			u = p.Props.UserProps
+		}
+		assert.Equal(t, props, u, "%T", pkt)
+	}
+}
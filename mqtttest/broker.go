@@ -0,0 +1,568 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package mqtttest provides an in-memory MQTT broker for tests, which
+// implements enough of MQTT 3.1, 3.1.1 and 5 to complete connect,
+// subscribe and publish flows (QoS 0, 1 and 2) with scripted behaviors
+package mqtttest
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goiiot/libmqtt"
+	"nhooyr.io/websocket"
+)
+
+// ErrBrokerClosed is returned by Serve once the broker closed
+var ErrBrokerClosed = errors.New("mqtttest: broker closed ")
+
+// BrokerOption is the option to script the behavior of TestBroker
+type BrokerOption func(b *TestBroker)
+
+// WithConnAckDelay delays the ConnAck of every connection
+func WithConnAckDelay(delay time.Duration) BrokerOption {
+	return func(b *TestBroker) {
+		b.connAckDelay = delay
+	}
+}
+
+// WithConnAckCode refuses every connection with the ConnAck code
+func WithConnAckCode(code byte) BrokerOption {
+	return func(b *TestBroker) {
+		b.connAckCode = code
+	}
+}
+
+// WithPubAckDropEvery drops every nth PubAck of QoS1 publish packets
+// received (the publish is still delivered to subscribers), 0 to disable
+func WithPubAckDropEvery(n int) BrokerOption {
+	return func(b *TestBroker) {
+		b.dropPubAckEvery = n
+	}
+}
+
+// WithCloseAfter closes every connection once n packets received from it
+// (including Connect), the nth packet is recorded but not handled, 0 to
+// disable
+func WithCloseAfter(n int) BrokerOption {
+	return func(b *TestBroker) {
+		b.closeAfter = n
+	}
+}
+
+// TestBroker is a minimal in-memory MQTT broker, publish packets are
+// delivered to all connections subscribed (no retained messages and no
+// session state, the retain flag is only kept for MQTT 5 subscriptions
+// with retain as published), every packet received is recorded for
+// assertions
+type TestBroker struct {
+	connAckDelay    time.Duration
+	connAckCode     byte
+	dropPubAckEvery int
+	closeAfter      int
+
+	mu        sync.Mutex
+	sessions  map[*session]struct{}
+	listeners []net.Listener
+	received  []libmqtt.Packet
+	pubAcks   int // QoS1 publish packets received
+	conns     int // connections handled
+	closed    bool
+
+	wg sync.WaitGroup
+}
+
+// NewTestBroker creates a broker with options, connections are served with
+// Serve, ServeConn or Connector, the broker MUST be closed once done
+func NewTestBroker(options ...BrokerOption) *TestBroker {
+	b := &TestBroker{sessions: make(map[*session]struct{})}
+	for _, setOption := range options {
+		setOption(b)
+	}
+	return b
+}
+
+// Listen serves connections of a tcp listener on a random local port,
+// returns the address to connect
+func (b *TestBroker) Listen() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	return b.serveListener(l), nil
+}
+
+// ListenTLS serves connections of a tls listener with the config on a
+// random local port, returns the address to connect (see
+// libmqtt.WithCustomTLS)
+func (b *TestBroker) ListenTLS(config *tls.Config) (string, error) {
+	l, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		return "", err
+	}
+	return b.serveListener(l), nil
+}
+
+// ListenWebSocket serves websocket connections (subprotocol "mqtt") of a
+// http server on a random local port, returns the address to connect
+// (see libmqtt.WithWebSocketConnector)
+func (b *TestBroker) ListenWebSocket() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		_ = l.Close()
+		return "", ErrBrokerClosed
+	}
+	b.listeners = append(b.listeners, l)
+	b.wg.Add(1)
+	b.mu.Unlock()
+
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{Subprotocols: []string{"mqtt"}})
+		if err != nil {
+			return
+		}
+		b.ServeConn(websocket.NetConn(context.Background(), conn, websocket.MessageBinary))
+	})}
+
+	go func() {
+		defer b.wg.Done()
+		_ = srv.Serve(l)
+	}()
+	return l.Addr().String(), nil
+}
+
+// serveListener serves the listener in background, returns the address
+func (b *TestBroker) serveListener(l net.Listener) string {
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		_ = b.Serve(l)
+	}()
+	return l.Addr().String()
+}
+
+// Serve accepts connections from the listener until the broker closed,
+// the listener is closed once the broker closed
+func (b *TestBroker) Serve(l net.Listener) error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		_ = l.Close()
+		return ErrBrokerClosed
+	}
+	b.listeners = append(b.listeners, l)
+	b.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if b.isClosed() {
+				return ErrBrokerClosed
+			}
+			return err
+		}
+
+		b.ServeConn(conn)
+	}
+}
+
+// ServeConn serves the connection in background until the connection
+// closed or the broker closed
+func (b *TestBroker) ServeConn(conn net.Conn) {
+	s := &session{broker: b, conn: conn, w: bufio.NewWriter(conn), qos2: make(map[uint16]*libmqtt.PublishPacket)}
+
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		_ = conn.Close()
+		return
+	}
+	b.sessions[s] = struct{}{}
+	b.conns++
+	b.wg.Add(1)
+	b.mu.Unlock()
+
+	go func() {
+		defer b.wg.Done()
+		s.serve()
+
+		b.mu.Lock()
+		delete(b.sessions, s)
+		b.mu.Unlock()
+	}()
+}
+
+// Conn returns the client end of a net.Pipe served by the broker, to be
+// used with Client.ConnectWith
+func (b *TestBroker) Conn() net.Conn {
+	client, server := net.Pipe()
+	b.ServeConn(server)
+	return client
+}
+
+// Connector returns the libmqtt.Connector connecting to the broker with
+// net.Pipe, the address is ignored (see libmqtt.WithCustomConnector)
+func (b *TestBroker) Connector() libmqtt.Connector {
+	return func(ctx context.Context, address string, timeout time.Duration, tlsConfig *tls.Config) (net.Conn, error) {
+		if b.isClosed() {
+			return nil, ErrBrokerClosed
+		}
+		return b.Conn(), nil
+	}
+}
+
+// Received returns all packets received by the broker in receiving order
+func (b *TestBroker) Received() []libmqtt.Packet {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return append([]libmqtt.Packet(nil), b.received...)
+}
+
+// Conns returns the count of connections handled by the broker
+func (b *TestBroker) Conns() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.conns
+}
+
+// Close the broker with all listeners and connections, and wait for all
+// connections to exit
+func (b *TestBroker) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+
+	for _, l := range b.listeners {
+		_ = l.Close()
+	}
+	for s := range b.sessions {
+		_ = s.conn.Close()
+	}
+	b.mu.Unlock()
+
+	b.wg.Wait()
+	return nil
+}
+
+func (b *TestBroker) isClosed() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.closed
+}
+
+// record the received packet, return false if the connection should be
+// closed (see WithCloseAfter)
+func (b *TestBroker) record(s *session, pkt libmqtt.Packet) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.received = append(b.received, pkt)
+	s.count++
+	return b.closeAfter == 0 || s.count < b.closeAfter
+}
+
+// dropPubAck returns true if the PubAck of the QoS1 publish packet should
+// be dropped (see WithPubAckDropEvery)
+func (b *TestBroker) dropPubAck() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.pubAcks++
+	return b.dropPubAckEvery > 0 && b.pubAcks%b.dropPubAckEvery == 0
+}
+
+// route the publish packet to all sessions subscribed
+func (b *TestBroker) route(p *libmqtt.PublishPacket) {
+	b.mu.Lock()
+	sessions := make([]*session, 0, len(b.sessions))
+	for s := range b.sessions {
+		sessions = append(sessions, s)
+	}
+	b.mu.Unlock()
+
+	for _, s := range sessions {
+		if qos, retain, ok := s.subscribed(p.TopicName); ok {
+			s.deliver(p, qos, retain && p.IsRetain)
+		}
+	}
+}
+
+// session is the state of one connection
+type session struct {
+	broker  *TestBroker
+	conn    net.Conn
+	version libmqtt.ProtoVersion
+	count   int // packets received, guarded by broker.mu
+
+	writeMu sync.Mutex
+	w       *bufio.Writer
+
+	mu     sync.Mutex
+	subs   map[string]byte                   // topic filters subscribed with subscription options
+	qos2   map[uint16]*libmqtt.PublishPacket // QoS2 packets waiting for PubRel
+	nextID uint16
+}
+
+func (s *session) serve() {
+	defer func() { _ = s.conn.Close() }()
+
+	r := bufio.NewReader(s.conn)
+	connect, err := readConnect(r)
+	if err != nil {
+		return
+	}
+	s.version = connect.Version()
+	if !s.broker.record(s, connect) {
+		return
+	}
+
+	if s.broker.connAckDelay > 0 {
+		time.Sleep(s.broker.connAckDelay)
+	}
+
+	s.write(&libmqtt.ConnAckPacket{Code: s.broker.connAckCode})
+	if s.broker.connAckCode != libmqtt.CodeSuccess {
+		return
+	}
+
+	for {
+		pkt, err := libmqtt.Decode(s.version, r)
+		if err != nil {
+			return
+		}
+
+		if !s.broker.record(s, pkt) {
+			return
+		}
+
+		if !s.handle(pkt) {
+			return
+		}
+	}
+}
+
+// handle the packet received, return false if the connection should be closed
+func (s *session) handle(pkt libmqtt.Packet) bool {
+	switch p := pkt.(type) {
+	case *libmqtt.SubscribePacket:
+		codes := make([]byte, len(p.Topics))
+		s.mu.Lock()
+		if s.subs == nil {
+			s.subs = make(map[string]byte)
+		}
+		for i, t := range p.Topics {
+			// MQTT 5 subscription options are encoded with the QoS
+			codes[i] = t.Qos & 0x03
+			s.subs[t.Name] = t.Qos
+		}
+		s.mu.Unlock()
+		s.write(&libmqtt.SubAckPacket{PacketID: p.PacketID, Codes: codes})
+	case *libmqtt.UnsubPacket:
+		s.mu.Lock()
+		for _, t := range p.TopicNames {
+			delete(s.subs, t)
+		}
+		s.mu.Unlock()
+		s.write(&libmqtt.UnsubAckPacket{PacketID: p.PacketID})
+	case *libmqtt.PublishPacket:
+		switch p.Qos {
+		case libmqtt.Qos0:
+			s.broker.route(p)
+		case libmqtt.Qos1:
+			if !s.broker.dropPubAck() {
+				s.write(&libmqtt.PubAckPacket{PacketID: p.PacketID})
+			}
+			s.broker.route(p)
+		case libmqtt.Qos2:
+			s.mu.Lock()
+			s.qos2[p.PacketID] = p
+			s.mu.Unlock()
+			s.write(&libmqtt.PubRecvPacket{PacketID: p.PacketID})
+		}
+	case *libmqtt.PubRelPacket:
+		s.mu.Lock()
+		pub, ok := s.qos2[p.PacketID]
+		delete(s.qos2, p.PacketID)
+		s.mu.Unlock()
+
+		s.write(&libmqtt.PubCompPacket{PacketID: p.PacketID})
+		if ok {
+			s.broker.route(pub)
+		}
+	case *libmqtt.PubRecvPacket:
+		// QoS2 packet delivered by the broker
+		s.write(&libmqtt.PubRelPacket{PacketID: p.PacketID})
+	case *libmqtt.DisconnPacket:
+		return false
+	default:
+		if pkt.Type() == libmqtt.CtrlPingReq {
+			s.write(libmqtt.PingRespPacket)
+		}
+	}
+	return true
+}
+
+// subscribed returns the max QoS of the topic filters matched the topic,
+// and whether any of them was subscribed with MQTT 5 retain as published
+func (s *session) subscribed(topic string) (libmqtt.QosLevel, bool, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var (
+		qos     libmqtt.QosLevel
+		retain  bool
+		matched bool
+	)
+	for filter, options := range s.subs {
+		if matchTopic(filter, topic) {
+			if q := options & 0x03; !matched || q > qos {
+				qos = q
+			}
+			retain = retain || options&0x08 != 0
+			matched = true
+		}
+	}
+	return qos, retain, matched
+}
+
+// deliver the publish packet with QoS not greater than qos, the retain
+// flag is only kept for subscriptions with retain as published
+func (s *session) deliver(p *libmqtt.PublishPacket, qos libmqtt.QosLevel, retain bool) {
+	if p.Qos < qos {
+		qos = p.Qos
+	}
+
+	pub := &libmqtt.PublishPacket{
+		TopicName: p.TopicName,
+		Qos:       qos,
+		IsRetain:  retain,
+		Payload:   p.Payload,
+		Props:     p.Props,
+	}
+
+	if qos > libmqtt.Qos0 {
+		s.mu.Lock()
+		if s.nextID++; s.nextID == 0 {
+			s.nextID = 1
+		}
+		pub.PacketID = s.nextID
+		s.mu.Unlock()
+	}
+	s.write(pub)
+}
+
+// write the packet with the version of the session
+func (s *session) write(pkt libmqtt.Packet) {
+	if pkt.Type() != libmqtt.CtrlPingResp {
+		// PingRespPacket is shared
+		pkt.SetVersion(s.version)
+	}
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	if err := pkt.WriteTo(s.w); err == nil {
+		_ = s.w.Flush()
+	}
+}
+
+// readConnect reads the connect packet with the protocol level of it
+func readConnect(r *bufio.Reader) (*libmqtt.ConnPacket, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	raw := []byte{header}
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+
+		raw = append(raw, b)
+		length += int(b&0x7f) * multiplier
+		multiplier *= 128
+		if b&0x80 == 0 {
+			break
+		}
+
+		if i == 3 {
+			return nil, libmqtt.ErrDecodeBadPacket
+		}
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	// protocol name (length prefixed) followed by protocol level
+	if len(body) < 2 || len(body) < 3+int(body[1]) {
+		return nil, libmqtt.ErrDecodeBadPacket
+	}
+	version := libmqtt.ProtoVersion(body[2+int(body[1])])
+
+	pkt, err := libmqtt.Decode(version, bytes.NewReader(append(raw, body...)))
+	if err != nil {
+		return nil, err
+	}
+
+	connect, ok := pkt.(*libmqtt.ConnPacket)
+	if !ok {
+		return nil, libmqtt.ErrDecodeBadPacket
+	}
+	return connect, nil
+}
+
+// matchTopic returns true if the topic name matches the topic filter
+func matchTopic(filter, topic string) bool {
+	filterLevels, topicLevels := strings.Split(filter, "/"), strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		switch {
+		case level == "#":
+			return true
+		case i >= len(topicLevels):
+			return false
+		case level != "+" && level != topicLevels[i]:
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
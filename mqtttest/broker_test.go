@@ -0,0 +1,260 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqtttest
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/goiiot/libmqtt"
+)
+
+func wait(t *testing.T, ch <-chan error) {
+	t.Helper()
+
+	select {
+	case err := <-ch:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+}
+
+func newTestClient(t *testing.T, b *TestBroker, connected chan error, options ...libmqtt.Option) libmqtt.Client {
+	t.Helper()
+
+	client, err := libmqtt.NewClient(append([]libmqtt.Option{
+		libmqtt.WithCustomConnector(b.Connector()),
+		libmqtt.WithConnHandleFunc(func(client libmqtt.Client, server string, code byte, err error) { connected <- err }),
+	}, options...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestTestBroker_PubSub(t *testing.T) {
+	for _, version := range []libmqtt.ProtoVersion{libmqtt.V31, libmqtt.V311, libmqtt.V5} {
+		b := NewTestBroker()
+
+		connected, subscribed, published := make(chan error, 1), make(chan error, 1), make(chan error, 3)
+		client := newTestClient(t, b, connected,
+			libmqtt.WithVersion(version, false),
+			libmqtt.WithSubHandleFunc(func(client libmqtt.Client, topics []*libmqtt.Topic, err error) { subscribed <- err }),
+			libmqtt.WithPubHandleFunc(func(client libmqtt.Client, topic string, err error) { published <- err }),
+		)
+
+		received := make(chan libmqtt.QosLevel, 3)
+		client.HandleTopic("/foo/#", func(client libmqtt.Client, topic string, qos libmqtt.QosLevel, msg []byte) {
+			if topic != "/foo/bar" || string(msg) != "baz" {
+				t.Error("unexpected message, topic =", topic, "msg =", string(msg))
+			}
+			received <- qos
+		})
+
+		if err := client.ConnectServer("broker"); err != nil {
+			t.Fatal(err)
+		}
+		wait(t, connected)
+
+		client.Subscribe(&libmqtt.Topic{Name: "/foo/#", Qos: libmqtt.Qos2})
+		wait(t, subscribed)
+
+		for _, qos := range []libmqtt.QosLevel{libmqtt.Qos0, libmqtt.Qos1, libmqtt.Qos2} {
+			client.Publish(&libmqtt.PublishPacket{TopicName: "/foo/bar", Qos: qos, Payload: []byte("baz")})
+			wait(t, published)
+
+			select {
+			case got := <-received:
+				if got != qos {
+					t.Error("unexpected QoS =", got, "want =", qos)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("message not received, QoS =", qos)
+			}
+		}
+
+		client.Destroy(true)
+		_ = b.Close()
+
+		var types []libmqtt.CtrlType
+		for _, p := range b.Received() {
+			if p.Type() != libmqtt.CtrlPingReq {
+				types = append(types, p.Type())
+			}
+		}
+		if len(types) < 5 || types[0] != libmqtt.CtrlConn || types[1] != libmqtt.CtrlSubscribe {
+			t.Error("unexpected packets received =", types)
+		}
+
+		if b.Received()[0].Version() != version {
+			t.Error("unexpected version =", b.Received()[0].Version())
+		}
+	}
+}
+
+func TestTestBroker_ConnAck(t *testing.T) {
+	b := NewTestBroker(WithConnAckDelay(100*time.Millisecond), WithConnAckCode(libmqtt.CodeUnauthorized))
+	defer func() { _ = b.Close() }()
+
+	connected := make(chan error, 1)
+	client := newTestClient(t, b, connected)
+	defer client.Destroy(true)
+
+	start := time.Now()
+	if err := client.ConnectServer("broker"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-connected:
+		if !errors.Is(err, libmqtt.ErrConnNotAuthorized) {
+			t.Error("unexpected error =", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Error("ConnAck not delayed, elapsed =", elapsed)
+	}
+}
+
+func TestTestBroker_CloseAfter(t *testing.T) {
+	b := NewTestBroker(WithCloseAfter(2))
+	defer func() { _ = b.Close() }()
+
+	connected := make(chan error, 10)
+	client := newTestClient(t, b, connected,
+		libmqtt.WithAutoReconnect(true),
+		libmqtt.WithBackoffStrategy(10*time.Millisecond, 10*time.Millisecond, 1),
+	)
+	defer client.Destroy(true)
+
+	if err := client.ConnectServer("broker"); err != nil {
+		t.Fatal(err)
+	}
+	wait(t, connected)
+
+	// closed once received
+	client.Publish(&libmqtt.PublishPacket{TopicName: "/foo", Payload: []byte("bar")})
+	wait(t, connected)
+
+	if n := b.Conns(); n != 2 {
+		t.Error("unexpected connections =", n)
+	}
+}
+
+func TestTestBroker_PubAckDrop(t *testing.T) {
+	b := NewTestBroker(WithPubAckDropEvery(2))
+	defer func() { _ = b.Close() }()
+
+	connected, published := make(chan error, 1), make(chan error, 2)
+	client := newTestClient(t, b, connected,
+		libmqtt.WithRetryInterval(50*time.Millisecond, 0),
+		libmqtt.WithPubHandleFunc(func(client libmqtt.Client, topic string, err error) { published <- err }),
+	)
+	defer client.Destroy(true)
+
+	if err := client.ConnectServer("broker"); err != nil {
+		t.Fatal(err)
+	}
+	wait(t, connected)
+
+	client.Publish(&libmqtt.PublishPacket{TopicName: "/foo", Qos: libmqtt.Qos1, Payload: []byte("bar")})
+	wait(t, published)
+
+	// PubAck dropped, acked once resent
+	client.Publish(&libmqtt.PublishPacket{TopicName: "/foo", Qos: libmqtt.Qos1, Payload: []byte("bar")})
+	wait(t, published)
+
+	dup := 0
+	for _, p := range b.Received() {
+		if pub, ok := p.(*libmqtt.PublishPacket); ok && pub.IsDup {
+			dup++
+		}
+	}
+	if dup != 1 {
+		t.Error("unexpected resent packets =", dup)
+	}
+}
+
+func TestTestBroker_RetainAsPublished(t *testing.T) {
+	b := NewTestBroker()
+	defer func() { _ = b.Close() }()
+
+	connected, subscribed := make(chan error, 1), make(chan error, 2)
+	client := newTestClient(t, b, connected,
+		libmqtt.WithVersion(libmqtt.V5, false),
+		libmqtt.WithSubHandleFunc(func(client libmqtt.Client, topics []*libmqtt.Topic, err error) { subscribed <- err }),
+	)
+	defer client.Destroy(true)
+
+	retained := make(chan bool, 2)
+	client.HandlePublish("/#", func(client libmqtt.Client, p *libmqtt.PublishPacket) {
+		retained <- p.IsRetain
+	})
+
+	if err := client.ConnectServer("broker"); err != nil {
+		t.Fatal(err)
+	}
+	wait(t, connected)
+
+	for _, c := range []struct {
+		topic    string
+		options  byte
+		expected bool
+	}{
+		{topic: "/foo", expected: false},
+		{topic: "/bar", options: 0x08, expected: true},
+	} {
+		client.Subscribe(&libmqtt.Topic{Name: c.topic, Qos: c.options})
+		wait(t, subscribed)
+
+		client.Publish(&libmqtt.PublishPacket{TopicName: c.topic, IsRetain: true, Payload: []byte("baz")})
+		select {
+		case got := <-retained:
+			if got != c.expected {
+				t.Error("unexpected retain flag =", got, "topic =", c.topic)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("message not received, topic =", c.topic)
+		}
+	}
+}
+
+func TestMatchTopic(t *testing.T) {
+	for _, c := range []struct {
+		filter, topic string
+		match         bool
+	}{
+		{"/foo/bar", "/foo/bar", true},
+		{"/foo/+", "/foo/bar", true},
+		{"/foo/#", "/foo/bar/baz", true},
+		{"/foo/#", "/foo", true},
+		{"/foo/+", "/foo/bar/baz", false},
+		{"/foo/bar", "/foo", false},
+		{"+/+", "/foo", true},
+	} {
+		if matchTopic(c.filter, c.topic) != c.match {
+			t.Error("unexpected match result, filter =", c.filter, "topic =", c.topic)
+		}
+	}
+}
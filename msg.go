@@ -78,10 +78,12 @@ func notifyPersistMsg(ch chan<- *message, packet Packet, err error) {
 	}
 }
 
-func (c *AsyncClient) handleMsg() {
+func (c *AsyncClient) handleMsg(life *lifecycle) {
+	stop := life.done()
 	for {
 		select {
-		case <-c.stopSig:
+		case <-stop:
+			c.drainMsg(life)
 			return
 		case m, more := <-c.msgCh:
 			if !more {
@@ -90,26 +92,54 @@ func (c *AsyncClient) handleMsg() {
 
 			switch m.what {
 			case pubMsg:
+				c.sendEvent(&PublishedEvent{Topic: m.msg, Err: m.err})
 				if c.pubHandler != nil {
 					c.addWorker(func() { c.pubHandler(c, m.msg, m.err) })
 				}
 			case subMsg:
+				c.sendEvent(&SubscribedEvent{Topics: m.obj.([]*Topic), Err: m.err})
 				if c.subHandler != nil {
 					c.addWorker(func() { c.subHandler(c, m.obj.([]*Topic), m.err) })
 				}
 			case unSubMsg:
+				c.sendEvent(&UnsubscribedEvent{Topics: m.obj.([]string), Err: m.err})
 				if c.unsubHandler != nil {
 					c.addWorker(func() { c.unsubHandler(c, m.obj.([]string), m.err) })
 				}
 			case netMsg:
+				c.sendEvent(&DisconnectedEvent{Server: m.msg, Err: m.err})
 				if c.netHandler != nil {
 					c.addWorker(func() { c.netHandler(c, m.msg, m.err) })
 				}
 			case persistMsg:
+				// packet is nil if the error is not related to a packet
+				pkt, _ := m.obj.(Packet)
+				c.sendEvent(&PersistErrorEvent{Packet: pkt, Err: m.err})
 				if c.persistHandler != nil {
-					c.addWorker(func() { c.persistHandler(c, m.obj.(Packet), m.err) })
+					c.addWorker(func() { c.persistHandler(c, pkt, m.err) })
 				}
 			}
 		}
 	}
 }
+
+// drainMsg drops messages notified once destroyed until workers of the
+// lifecycle exited (or the client restarted), so workers exiting are not
+// blocked by the full msgCh
+func (c *AsyncClient) drainMsg(life *lifecycle) {
+	exited := make(chan struct{})
+	go func() {
+		life.wait()
+		close(exited)
+	}()
+
+	for {
+		select {
+		case <-c.msgCh:
+		case <-exited:
+			return
+		case <-life.replaced:
+			return
+		}
+	}
+}
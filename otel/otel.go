@@ -0,0 +1,153 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package otel traces publishes and the handling of received messages with
+// OpenTelemetry (see libmqtt.WithTracer), the trace context is propagated
+// in MQTT 5 user properties (W3C traceparent by default)
+package otel
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/goiiot/libmqtt"
+)
+
+const instrumentationName = "github.com/goiiot/libmqtt/otel"
+
+// attributes of spans
+var (
+	attrSystem = attribute.String("messaging.system", "mqtt")
+	keyTopic   = attribute.Key("messaging.destination.name")
+	keyQos     = attribute.Key("messaging.mqtt.qos")
+	keyRetain  = attribute.Key("messaging.mqtt.retain")
+)
+
+// TracerOption is the option of the tracer
+type TracerOption func(t *tracer)
+
+// WithTracerProvider sets the provider of tracers, the global provider is
+// used by default
+func WithTracerProvider(provider trace.TracerProvider) TracerOption {
+	return func(t *tracer) {
+		if provider != nil {
+			t.provider = provider
+		}
+	}
+}
+
+// WithPropagator sets the propagator of the trace context, the W3C trace
+// context propagator is used by default
+func WithPropagator(propagator propagation.TextMapPropagator) TracerOption {
+	return func(t *tracer) {
+		if propagator != nil {
+			t.propagator = propagator
+		}
+	}
+}
+
+// NewTracer returns the tracer to use with libmqtt.WithTracer, publishes
+// are traced with producer spans from the context of libmqtt.PubContext to
+// the ack, and handlers of received messages are traced with consumer
+// spans from the trace context propagated
+func NewTracer(options ...TracerOption) libmqtt.Tracer {
+	t := &tracer{
+		provider:   otel.GetTracerProvider(),
+		propagator: propagation.TraceContext{},
+	}
+	for _, setOption := range options {
+		setOption(t)
+	}
+
+	t.tracer = t.provider.Tracer(instrumentationName)
+	return t
+}
+
+type tracer struct {
+	provider   trace.TracerProvider
+	propagator propagation.TextMapPropagator
+	tracer     trace.Tracer
+}
+
+func (t *tracer) StartPublish(ctx context.Context, p *libmqtt.PublishPacket) func(err error) {
+	ctx, span := t.tracer.Start(ctx, p.TopicName+" publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(attributes(p)...),
+	)
+
+	// ignored if published with MQTT 3.1.1
+	if p.Props == nil {
+		p.Props = &libmqtt.PublishProps{}
+	}
+	t.propagator.Inject(ctx, carrier{&p.Props.UserProps})
+
+	return func(err error) {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
+
+func (t *tracer) StartHandle(p *libmqtt.PublishPacket) func() {
+	ctx := context.Background()
+	if p.Props != nil {
+		ctx = t.propagator.Extract(ctx, carrier{&p.Props.UserProps})
+	}
+
+	_, span := t.tracer.Start(ctx, p.TopicName+" process",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(attributes(p)...),
+	)
+	return func() { span.End() }
+}
+
+func attributes(p *libmqtt.PublishPacket) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attrSystem,
+		keyTopic.String(p.TopicName),
+		keyQos.Int(int(p.Qos)),
+		keyRetain.Bool(p.IsRetain),
+	}
+}
+
+// carrier propagates the trace context in user properties
+type carrier struct {
+	props *libmqtt.UserProps
+}
+
+func (c carrier) Get(key string) string {
+	v, _ := c.props.Get(key)
+	return v
+}
+
+func (c carrier) Set(key, value string) {
+	c.props.Set(key, value)
+}
+
+func (c carrier) Keys() []string {
+	keys := make([]string, 0, len(*c.props))
+	for _, p := range *c.props {
+		keys = append(keys, p.Key)
+	}
+	return keys
+}
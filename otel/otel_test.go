@@ -0,0 +1,122 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package otel
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/goiiot/libmqtt"
+)
+
+func newTestTracer() (libmqtt.Tracer, *tracetest.SpanRecorder) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	return NewTracer(WithTracerProvider(provider)), recorder
+}
+
+func TestTracer_Publish(t *testing.T) {
+	tracer, recorder := newTestTracer()
+
+	parentCtx, parentSpan := recorderTracer(recorder).Start(context.Background(), "parent")
+
+	p := &libmqtt.PublishPacket{TopicName: "/foo", Qos: libmqtt.Qos1}
+	end := tracer.StartPublish(parentCtx, p)
+	if p.Props == nil {
+		t.Fatal("trace context not injected")
+	}
+	if _, ok := p.Props.UserProps.Get("traceparent"); !ok {
+		t.Error("traceparent not injected, user props =", p.Props.UserProps)
+	}
+
+	refused := errors.New("refused")
+	end(refused)
+	parentSpan.End()
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatal("unexpected spans ended =", len(spans))
+	}
+
+	span := spans[0]
+	if span.SpanKind() != trace.SpanKindProducer || span.Name() != "/foo publish" {
+		t.Errorf("unexpected span kind = %v, name = %q", span.SpanKind(), span.Name())
+	}
+	if span.Parent().SpanID() != parentSpan.SpanContext().SpanID() {
+		t.Error("publish span not started from the context")
+	}
+	if span.Status().Code != codes.Error || span.Status().Description != "refused" {
+		t.Error("unexpected status =", span.Status())
+	}
+	assertAttr(t, span, "messaging.destination.name", attribute.StringValue("/foo"))
+	assertAttr(t, span, "messaging.mqtt.qos", attribute.IntValue(1))
+
+	// received with the trace context
+	end2 := tracer.StartHandle(p)
+	end2()
+
+	spans = recorder.Ended()
+	handled := spans[len(spans)-1]
+	if handled.SpanKind() != trace.SpanKindConsumer || handled.Name() != "/foo process" {
+		t.Errorf("unexpected span kind = %v, name = %q", handled.SpanKind(), handled.Name())
+	}
+	if handled.Parent().SpanID() != span.SpanContext().SpanID() ||
+		handled.SpanContext().TraceID() != span.SpanContext().TraceID() {
+		t.Error("trace context not extracted")
+	}
+}
+
+func TestTracer_HandleWithoutContext(t *testing.T) {
+	tracer, recorder := newTestTracer()
+
+	tracer.StartHandle(&libmqtt.PublishPacket{TopicName: "/foo"})()
+	tracer.StartHandle(&libmqtt.PublishPacket{TopicName: "/bar", Props: &libmqtt.PublishProps{}})()
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatal("unexpected spans ended =", len(spans))
+	}
+	for _, span := range spans {
+		if span.Parent().IsValid() {
+			t.Error("unexpected parent of span", span.Name())
+		}
+	}
+}
+
+func recorderTracer(recorder *tracetest.SpanRecorder) trace.Tracer {
+	return sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test")
+}
+
+func assertAttr(t *testing.T, span sdktrace.ReadOnlySpan, key attribute.Key, value attribute.Value) {
+	t.Helper()
+	for _, attr := range span.Attributes() {
+		if attr.Key == key {
+			if attr.Value != value {
+				t.Errorf("unexpected attribute %s = %v", key, attr.Value.Emit())
+			}
+			return
+		}
+	}
+	t.Error("attribute not set =", key)
+}
@@ -0,0 +1,653 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package pahocompat adapts libmqtt to the Client, Token and Message
+// interfaces of github.com/eclipse/paho.mqtt.golang (v1.2), to migrate
+// code built on paho by replacing mqtt.NewClient with pahocompat.NewClient
+//
+// paho options are mapped to libmqtt options when connecting, options and
+// behaviors libmqtt can not provide are returned as errors by the token of
+// Connect (or the token of the operation), instead of being ignored:
+//
+//   - only one broker is supported (no failover between brokers)
+//   - protocol versions 3 (MQTT 3.1) and 4 (MQTT 3.1.1) are supported, not
+//     set means MQTT 3.1.1 with fallback to MQTT 3.1 as in paho
+//   - Store must be nil or a MemoryStore, WriteTimeout and ResumeSubs are
+//     not supported
+//   - publish tokens of a topic complete in the order the client notified
+//     the results (packet ids are not reported), publishing with another QoS
+//     to a topic with publish tokens pending fails with ErrMixedQos
+//
+// MessageChannelDepth is not used since libmqtt queues publish packets
+// while reconnecting in its send buffer (see libmqtt.WithBufSize), and the
+// tokens are not the token types of paho (use ConnectToken.ReturnCode and
+// SubscribeToken.Result instead of type assertions to paho tokens)
+package pahocompat
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	"github.com/goiiot/libmqtt"
+)
+
+var (
+	// ErrBrokerCount is returned by Connect if not exactly one broker added
+	ErrBrokerCount = errors.New("pahocompat: exactly one broker is supported ")
+	// ErrUnsupportedScheme is returned by Connect if the scheme of the broker
+	// is not one of tcp, mqtt, ssl, tls, tcps, mqtts, ws and wss
+	ErrUnsupportedScheme = errors.New("pahocompat: unsupported broker scheme ")
+	// ErrUnsupportedVersion is returned by Connect if the protocol version
+	// is not 3 or 4 (e.g. bridge mode)
+	ErrUnsupportedVersion = errors.New("pahocompat: unsupported protocol version ")
+	// ErrUnsupportedStore is returned by Connect if the store is not a
+	// MemoryStore
+	ErrUnsupportedStore = errors.New("pahocompat: only the memory store is supported ")
+	// ErrUnsupportedKeepAlive is returned by Connect if the keepalive is not
+	// between 1 and 65535 seconds
+	ErrUnsupportedKeepAlive = errors.New("pahocompat: keepalive must be 1 to 65535 seconds ")
+	// ErrWriteTimeout is returned by Connect if the write timeout is set
+	ErrWriteTimeout = errors.New("pahocompat: write timeout is not supported ")
+	// ErrResumeSubs is returned by Connect if ResumeSubs is set
+	ErrResumeSubs = errors.New("pahocompat: resuming subscriptions is not supported ")
+	// ErrConnected is returned by Connect if the client is connected
+	ErrConnected = errors.New("pahocompat: already connected ")
+	// ErrMixedQos is returned by Publish if publish tokens of the topic with
+	// another QoS are pending, since results can not be told apart
+	ErrMixedQos = errors.New("pahocompat: publish with another QoS pending on the topic ")
+	// ErrPayloadType is returned by Publish if the payload is neither a
+	// string nor a []byte
+	ErrPayloadType = errors.New("pahocompat: unknown payload type ")
+)
+
+const (
+	disconnected uint32 = iota
+	connecting
+	reconnecting
+	connected
+)
+
+var _ mqtt.Client = (*Client)(nil)
+
+// Client implements mqtt.Client with a libmqtt Client, a new libmqtt Client
+// is created by every Connect
+type Client struct {
+	options mqtt.ClientOptions
+	reader  mqtt.ClientOptionsReader
+	router  *router
+
+	mu      sync.Mutex
+	client  libmqtt.Client // nil if disconnected
+	status  uint32
+	connect *ConnectToken // pending until the first connect result
+	pubs    map[string][]*pubToken
+	subs    map[string][]*SubscribeToken
+	unsubs  map[string][]*Token
+}
+
+type pubToken struct {
+	*Token
+	qos byte
+}
+
+// NewClient creates the client with the paho client options, the options
+// are copied, and checked once connecting
+func NewClient(o *mqtt.ClientOptions) *Client {
+	c := &Client{
+		options: *o,
+		// the options reader can only be created by a paho client,
+		// which is never connected
+		reader: mqtt.NewClient(o).OptionsReader(),
+		pubs:   make(map[string][]*pubToken),
+		subs:   make(map[string][]*SubscribeToken),
+		unsubs: make(map[string][]*Token),
+	}
+	c.router = newRouter(c, o.DefaultPublishHandler)
+	return c
+}
+
+// IsConnected returns true if connected, or reconnecting with auto
+// reconnect enabled
+func (c *Client) IsConnected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.status == connected || (c.options.AutoReconnect && c.status == reconnecting)
+}
+
+// IsConnectionOpen returns true if connected (not reconnecting)
+func (c *Client) IsConnectionOpen() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.status == connected
+}
+
+// Connect to the broker, the token completes once the first ConnAck
+// received or the connect failed (no retry even if auto reconnect enabled,
+// same as paho)
+func (c *Client) Connect() mqtt.Token {
+	t := &ConnectToken{Token: Token{done: make(chan struct{})}, code: math.MaxUint8}
+
+	server, options, err := c.libmqttOptions()
+	if err != nil {
+		t.complete(err)
+		return t
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.client != nil {
+		t.complete(ErrConnected)
+		return t
+	}
+
+	client, err := libmqtt.NewClient(options...)
+	if err != nil {
+		t.complete(err)
+		return t
+	}
+
+	c.client, c.status, c.connect = client, connecting, t
+	if err := client.ConnectServer(server); err != nil {
+		c.client, c.status, c.connect = nil, disconnected, nil
+		client.Destroy(true)
+		t.complete(err)
+	}
+	return t
+}
+
+// Disconnect from the broker, waits at most quiesce milliseconds for
+// pending tokens to complete, tokens not completed fail with
+// mqtt.ErrNotConnected
+func (c *Client) Disconnect(quiesce uint) {
+	c.mu.Lock()
+	client := c.client
+	pending := c.pending()
+	c.client, c.status = nil, disconnected
+	c.mu.Unlock()
+
+	if client == nil {
+		return
+	}
+
+	deadline := time.Now().Add(time.Duration(quiesce) * time.Millisecond)
+	for _, t := range pending {
+		if !t.WaitTimeout(time.Until(deadline)) {
+			break
+		}
+	}
+
+	client.Destroy(false)
+	c.failPending()
+}
+
+// Publish the payload (string or []byte) to the topic
+func (c *Client) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	t := &pubToken{Token: newToken(), qos: qos}
+
+	var data []byte
+	switch v := payload.(type) {
+	case string:
+		data = []byte(v)
+	case []byte:
+		data = v
+	default:
+		t.complete(ErrPayloadType)
+		return t
+	}
+
+	if qos > libmqtt.Qos2 {
+		t.complete(mqtt.ErrInvalidQos)
+		return t
+	}
+
+	c.mu.Lock()
+	client, status := c.client, c.status
+	switch {
+	case !c.isConnected():
+		c.mu.Unlock()
+		t.complete(mqtt.ErrNotConnected)
+		return t
+	case status == reconnecting && qos == libmqtt.Qos0:
+		// dropped as in paho
+		c.mu.Unlock()
+		t.complete(nil)
+		return t
+	}
+
+	for _, pending := range c.pubs[topic] {
+		if pending.qos != qos {
+			c.mu.Unlock()
+			t.complete(ErrMixedQos)
+			return t
+		}
+	}
+	c.pubs[topic] = append(c.pubs[topic], t)
+	c.mu.Unlock()
+
+	client.Publish(&libmqtt.PublishPacket{TopicName: topic, Qos: qos, IsRetain: retained, Payload: data})
+	return t
+}
+
+// Subscribe the topic filter, the callback is registered as the route of
+// the topic filter if not nil, messages matched no route are sent to the
+// default publish handler
+func (c *Client) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	return c.SubscribeMultiple(map[string]byte{topic: qos}, callback)
+}
+
+// SubscribeMultiple subscribes all topic filters in one subscribe packet
+func (c *Client) SubscribeMultiple(filters map[string]byte, callback mqtt.MessageHandler) mqtt.Token {
+	t := &SubscribeToken{Token: Token{done: make(chan struct{})}}
+
+	topics := make([]*libmqtt.Topic, 0, len(filters))
+	for filter, qos := range filters {
+		switch {
+		case filter == "":
+			t.complete(mqtt.ErrInvalidTopicEmptyString)
+			return t
+		case qos > libmqtt.Qos2:
+			t.complete(mqtt.ErrInvalidQos)
+			return t
+		}
+		topics = append(topics, &libmqtt.Topic{Name: filter, Qos: qos})
+	}
+
+	c.mu.Lock()
+	client := c.client
+	if !c.isConnected() {
+		c.mu.Unlock()
+		t.complete(mqtt.ErrNotConnected)
+		return t
+	}
+
+	if callback != nil {
+		for filter := range filters {
+			c.router.route(filter, callback)
+		}
+	}
+
+	key := topicsKey(topics)
+	c.subs[key] = append(c.subs[key], t)
+	c.mu.Unlock()
+
+	client.Subscribe(topics...)
+	return t
+}
+
+// Unsubscribe the topic filters and remove their routes
+func (c *Client) Unsubscribe(topics ...string) mqtt.Token {
+	t := newToken()
+
+	c.mu.Lock()
+	client := c.client
+	if !c.isConnected() {
+		c.mu.Unlock()
+		t.complete(mqtt.ErrNotConnected)
+		return t
+	}
+
+	key := strings.Join(topics, "\n")
+	c.unsubs[key] = append(c.unsubs[key], t)
+	c.mu.Unlock()
+
+	client.Unsubscribe(topics...)
+	for _, topic := range topics {
+		c.router.remove(topic)
+	}
+	return t
+}
+
+// AddRoute registers the callback of the topic filter without subscribing
+func (c *Client) AddRoute(topic string, callback mqtt.MessageHandler) {
+	if callback != nil {
+		c.router.route(topic, callback)
+	}
+}
+
+// OptionsReader returns the reader of the options the client created with
+func (c *Client) OptionsReader() mqtt.ClientOptionsReader {
+	return c.reader
+}
+
+// isConnected is IsConnected with c.mu held
+func (c *Client) isConnected() bool {
+	return c.client != nil && (c.status == connected || (c.options.AutoReconnect && c.status == reconnecting))
+}
+
+// libmqttOptions maps the paho options to the server address and libmqtt
+// options of the connection
+func (c *Client) libmqttOptions() (string, []libmqtt.Option, error) {
+	o := &c.options
+	if len(o.Servers) != 1 {
+		return "", nil, ErrBrokerCount
+	}
+
+	var options []libmqtt.Option
+	u := o.Servers[0]
+	server := u.Host
+	switch u.Scheme {
+	case "tcp", "mqtt":
+	case "ssl", "tls", "tcps", "mqtts":
+		options = append(options, libmqtt.WithCustomTLS(tlsConfig(o.TLSConfig)))
+	case "ws":
+		server += u.Path
+		options = append(options, libmqtt.WithWebSocketConnector(0, o.HTTPHeaders))
+	case "wss":
+		server += u.Path
+		options = append(options,
+			libmqtt.WithWebSocketConnector(0, o.HTTPHeaders),
+			libmqtt.WithCustomTLS(tlsConfig(o.TLSConfig)),
+		)
+	default:
+		return "", nil, ErrUnsupportedScheme
+	}
+
+	switch o.ProtocolVersion {
+	case 0:
+		options = append(options, libmqtt.WithVersion(libmqtt.V311, true))
+	case 3:
+		options = append(options, libmqtt.WithVersion(libmqtt.V31, false))
+	case 4:
+		options = append(options, libmqtt.WithVersion(libmqtt.V311, false))
+	default:
+		return "", nil, ErrUnsupportedVersion
+	}
+
+	switch o.Store.(type) {
+	case nil, *mqtt.MemoryStore:
+		options = append(options, libmqtt.WithPersist(libmqtt.NewMemPersist(nil)))
+	default:
+		return "", nil, ErrUnsupportedStore
+	}
+
+	switch {
+	case o.KeepAlive < 1 || o.KeepAlive > math.MaxUint16:
+		return "", nil, ErrUnsupportedKeepAlive
+	case o.WriteTimeout > 0:
+		return "", nil, ErrWriteTimeout
+	case o.ResumeSubs:
+		return "", nil, ErrResumeSubs
+	}
+
+	// the connection is closed if no packet received in keepalive * factor
+	keepalive := time.Duration(o.KeepAlive) * time.Second
+	options = append(options, libmqtt.WithKeepalive(uint16(o.KeepAlive), float64(keepalive+o.PingTimeout)/float64(keepalive)))
+
+	// libmqtt rejects dial timeouts longer than the keepalive
+	connectTimeout := o.ConnectTimeout
+	if connectTimeout <= 0 || connectTimeout > keepalive {
+		connectTimeout = keepalive
+	}
+	options = append(options, libmqtt.WithDialTimeout(uint16((connectTimeout+time.Second-1)/time.Second)))
+
+	// paho retries after 1s, doubling the delay up to MaxReconnectInterval
+	firstDelay := time.Second
+	if o.MaxReconnectInterval < firstDelay {
+		firstDelay = o.MaxReconnectInterval
+	}
+	options = append(options,
+		libmqtt.WithAutoReconnect(o.AutoReconnect),
+		libmqtt.WithBackoffStrategy(firstDelay, o.MaxReconnectInterval, 2),
+		libmqtt.WithClientID(o.ClientID),
+		libmqtt.WithCleanSession(o.CleanSession),
+	)
+
+	if o.Username != "" || o.Password != "" {
+		options = append(options, libmqtt.WithIdentity(o.Username, o.Password))
+	}
+
+	if provider := o.CredentialsProvider; provider != nil {
+		options = append(options, libmqtt.WithCredentialsProvider(func(ctx context.Context, server string) (string, []byte, error) {
+			username, password := provider()
+			return username, []byte(password), nil
+		}))
+	}
+
+	if o.WillEnabled {
+		options = append(options, libmqtt.WithWill(o.WillTopic, o.WillQos, o.WillRetained, o.WillPayload))
+	}
+
+	if o.Order {
+		// messages are handled one by one in order
+		options = append(options, libmqtt.WithHandlerConcurrency(1))
+	}
+
+	return server, append(options,
+		libmqtt.WithRouter(c.router),
+		libmqtt.WithConnHandleFunc(c.handleConn),
+		libmqtt.WithNetHandleFunc(c.handleNet),
+		libmqtt.WithPubHandleFunc(c.handlePub),
+		libmqtt.WithSubHandleFunc(c.handleSub),
+		libmqtt.WithUnsubHandleFunc(c.handleUnsub),
+	), nil
+}
+
+func tlsConfig(config *tls.Config) *tls.Config {
+	if config == nil {
+		return &tls.Config{}
+	}
+	return config
+}
+
+func (c *Client) handleConn(client libmqtt.Client, server string, code byte, err error) {
+	c.mu.Lock()
+	if client != c.client {
+		// destroyed by Disconnect
+		c.mu.Unlock()
+		return
+	}
+
+	t := c.connect
+	c.connect = nil
+	if err != nil {
+		if t == nil {
+			// reconnect failed, retried by the client
+			c.mu.Unlock()
+			return
+		}
+
+		c.client, c.status = nil, disconnected
+		c.mu.Unlock()
+
+		client.Destroy(true)
+		t.code = code
+		t.complete(err)
+		return
+	}
+
+	c.status = connected
+	c.mu.Unlock()
+
+	if t != nil {
+		t.code = code
+		t.complete(nil)
+	}
+
+	if c.options.OnConnect != nil {
+		go c.options.OnConnect(c)
+	}
+}
+
+func (c *Client) handleNet(client libmqtt.Client, server string, err error) {
+	c.mu.Lock()
+	if client != c.client {
+		c.mu.Unlock()
+		return
+	}
+
+	if _, stopped := err.(*libmqtt.ReconnectStoppedError); stopped && c.status == reconnecting {
+		c.client, c.status = nil, disconnected
+		c.mu.Unlock()
+
+		client.Destroy(true)
+		c.failPending()
+		return
+	}
+
+	if c.status != connected {
+		// notified more than once for a connection
+		c.mu.Unlock()
+		return
+	}
+
+	if c.options.AutoReconnect {
+		c.status = reconnecting
+		c.mu.Unlock()
+	} else {
+		c.client, c.status = nil, disconnected
+		c.mu.Unlock()
+
+		client.Destroy(true)
+		c.failPending()
+	}
+
+	if c.options.OnConnectionLost != nil {
+		go c.options.OnConnectionLost(c, err)
+	}
+}
+
+func (c *Client) handlePub(client libmqtt.Client, topic string, err error) {
+	c.mu.Lock()
+	pending := c.pubs[topic]
+	if len(pending) == 0 {
+		c.mu.Unlock()
+		return
+	}
+
+	t := pending[0]
+	if len(pending) == 1 {
+		delete(c.pubs, topic)
+	} else {
+		c.pubs[topic] = pending[1:]
+	}
+	c.mu.Unlock()
+
+	t.complete(err)
+}
+
+func (c *Client) handleSub(client libmqtt.Client, topics []*libmqtt.Topic, err error) {
+	key := topicsKey(topics)
+
+	c.mu.Lock()
+	pending := c.subs[key]
+	if len(pending) == 0 {
+		c.mu.Unlock()
+		return
+	}
+
+	t := pending[0]
+	if len(pending) == 1 {
+		delete(c.subs, key)
+	} else {
+		c.subs[key] = pending[1:]
+	}
+	c.mu.Unlock()
+
+	if err == nil {
+		t.mu.Lock()
+		t.result = make(map[string]byte, len(topics))
+		for _, topic := range topics {
+			t.result[topic.Name] = topic.Qos
+		}
+		t.mu.Unlock()
+	}
+	t.complete(err)
+}
+
+func (c *Client) handleUnsub(client libmqtt.Client, topics []string, err error) {
+	key := strings.Join(topics, "\n")
+
+	c.mu.Lock()
+	pending := c.unsubs[key]
+	if len(pending) == 0 {
+		c.mu.Unlock()
+		return
+	}
+
+	t := pending[0]
+	if len(pending) == 1 {
+		delete(c.unsubs, key)
+	} else {
+		c.unsubs[key] = pending[1:]
+	}
+	c.mu.Unlock()
+
+	t.complete(err)
+}
+
+// pending returns all pending tokens with c.mu held
+func (c *Client) pending() []mqtt.Token {
+	var tokens []mqtt.Token
+	for _, pubs := range c.pubs {
+		for _, t := range pubs {
+			tokens = append(tokens, t)
+		}
+	}
+	for _, subs := range c.subs {
+		for _, t := range subs {
+			tokens = append(tokens, t)
+		}
+	}
+	for _, unsubs := range c.unsubs {
+		for _, t := range unsubs {
+			tokens = append(tokens, t)
+		}
+	}
+	return tokens
+}
+
+// failPending completes all pending tokens with mqtt.ErrNotConnected
+func (c *Client) failPending() {
+	c.mu.Lock()
+	pubs, subs, unsubs := c.pubs, c.subs, c.unsubs
+	c.pubs = make(map[string][]*pubToken)
+	c.subs = make(map[string][]*SubscribeToken)
+	c.unsubs = make(map[string][]*Token)
+	c.mu.Unlock()
+
+	for _, pending := range pubs {
+		for _, t := range pending {
+			t.complete(mqtt.ErrNotConnected)
+		}
+	}
+	for _, pending := range subs {
+		for _, t := range pending {
+			t.complete(mqtt.ErrNotConnected)
+		}
+	}
+	for _, pending := range unsubs {
+		for _, t := range pending {
+			t.complete(mqtt.ErrNotConnected)
+		}
+	}
+}
+
+func topicsKey(topics []*libmqtt.Topic) string {
+	names := make([]string, len(topics))
+	for i, t := range topics {
+		names[i] = t.Name
+	}
+	return strings.Join(names, "\n")
+}
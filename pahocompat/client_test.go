@@ -0,0 +1,235 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pahocompat
+
+import (
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	"github.com/goiiot/libmqtt"
+	"github.com/goiiot/libmqtt/mqtttest"
+)
+
+const testTimeout = 5 * time.Second
+
+func testOptions(t *testing.T, b *mqtttest.TestBroker) *mqtt.ClientOptions {
+	addr, err := b.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return mqtt.NewClientOptions().
+		AddBroker("tcp://" + addr).
+		SetClientID("pahocompat").
+		SetKeepAlive(10 * time.Second)
+}
+
+func waitToken(t *testing.T, token mqtt.Token) error {
+	t.Helper()
+
+	if !token.WaitTimeout(testTimeout) {
+		t.Fatal("token timeout")
+	}
+	return token.Error()
+}
+
+func TestClient(t *testing.T) {
+	b := mqtttest.NewTestBroker()
+	defer func() { _ = b.Close() }()
+
+	defaultMsgs := make(chan mqtt.Message, 3)
+	connected := make(chan struct{}, 1)
+	options := testOptions(t, b).
+		SetDefaultPublishHandler(func(client mqtt.Client, msg mqtt.Message) {
+			defaultMsgs <- msg
+		}).
+		SetOnConnectHandler(func(client mqtt.Client) {
+			connected <- struct{}{}
+		})
+
+	c := NewClient(options)
+	if c.IsConnected() {
+		t.Error("connected before Connect")
+	}
+
+	token := c.Connect()
+	if err := waitToken(t, token); err != nil {
+		t.Fatal(err)
+	}
+	if code := token.(*ConnectToken).ReturnCode(); code != libmqtt.CodeSuccess {
+		t.Error("unexpected return code =", code)
+	}
+	if !c.IsConnected() || !c.IsConnectionOpen() {
+		t.Error("not connected")
+	}
+
+	select {
+	case <-connected:
+	case <-time.After(testTimeout):
+		t.Error("OnConnect not called")
+	}
+
+	msgs := make(chan mqtt.Message, 3)
+	sub := c.SubscribeMultiple(map[string]byte{"/foo/+": 2, "/default": 1}, nil)
+	if err := waitToken(t, sub); err != nil {
+		t.Fatal(err)
+	}
+	if result := sub.(*SubscribeToken).Result(); len(result) != 2 || result["/foo/+"] != 2 || result["/default"] != 1 {
+		t.Error("unexpected subscribe result =", result)
+	}
+	c.AddRoute("/foo/+", func(client mqtt.Client, msg mqtt.Message) {
+		if client != c {
+			t.Error("message handled with another client")
+		}
+		msgs <- msg
+	})
+
+	for qos, topic := range []string{"/foo/0", "/foo/1", "/foo/2"} {
+		if err := waitToken(t, c.Publish(topic, byte(qos), false, topic)); err != nil {
+			t.Error("publish failed, topic =", topic, "err =", err)
+		}
+	}
+	if err := waitToken(t, c.Publish("/default", 1, false, []byte("default"))); err != nil {
+		t.Error(err)
+	}
+
+	received := make(map[string]byte)
+	for i := 0; i < 3; i++ {
+		select {
+		case msg := <-msgs:
+			if string(msg.Payload()) != msg.Topic() {
+				t.Error("unexpected payload =", string(msg.Payload()))
+			}
+			received[msg.Topic()] = msg.Qos()
+			msg.Ack()
+		case <-time.After(testTimeout):
+			t.Fatal("message not received, received =", received)
+		}
+	}
+	if len(received) != 3 || received["/foo/2"] != 2 {
+		t.Error("unexpected messages =", received)
+	}
+
+	select {
+	case msg := <-defaultMsgs:
+		if msg.Topic() != "/default" || string(msg.Payload()) != "default" {
+			t.Error("unexpected default message =", msg.Topic())
+		}
+	case <-time.After(testTimeout):
+		t.Error("default handler not called")
+	}
+
+	if err := waitToken(t, c.Unsubscribe("/foo/+", "/default")); err != nil {
+		t.Error(err)
+	}
+
+	c.Disconnect(100)
+	if c.IsConnected() {
+		t.Error("connected after Disconnect")
+	}
+
+	for _, token := range []mqtt.Token{
+		c.Publish("/foo/0", 0, false, "foo"),
+		c.Subscribe("/foo", 0, nil),
+		c.Unsubscribe("/foo"),
+	} {
+		if err := waitToken(t, token); err != mqtt.ErrNotConnected {
+			t.Error("unexpected error when disconnected =", err)
+		}
+	}
+}
+
+func TestClient_ConnectRefused(t *testing.T) {
+	b := mqtttest.NewTestBroker(mqtttest.WithConnAckCode(libmqtt.CodeBadUsernameOrPassword))
+	defer func() { _ = b.Close() }()
+
+	c := NewClient(testOptions(t, b))
+	token := c.Connect()
+	if err := waitToken(t, token); err == nil {
+		t.Error("connect not refused")
+	}
+	if code := token.(*ConnectToken).ReturnCode(); code != libmqtt.CodeBadUsernameOrPassword {
+		t.Error("unexpected return code =", code)
+	}
+	if c.IsConnected() {
+		t.Error("connected after refused")
+	}
+}
+
+func TestClient_Unsupported(t *testing.T) {
+	b := mqtttest.NewTestBroker()
+	defer func() { _ = b.Close() }()
+
+	for expected, options := range map[error]*mqtt.ClientOptions{
+		ErrBrokerCount:          testOptions(t, b).AddBroker("tcp://localhost:1883"),
+		ErrUnsupportedScheme:    mqtt.NewClientOptions().AddBroker("unix://localhost:1883"),
+		ErrUnsupportedVersion:   testOptions(t, b).SetProtocolVersion(0x84),
+		ErrUnsupportedStore:     testOptions(t, b).SetStore(mqtt.NewFileStore(t.Name())),
+		ErrUnsupportedKeepAlive: testOptions(t, b).SetKeepAlive(0),
+		ErrWriteTimeout:         testOptions(t, b).SetWriteTimeout(time.Second),
+		ErrResumeSubs:           testOptions(t, b).SetResumeSubs(true),
+	} {
+		if err := waitToken(t, NewClient(options).Connect()); err != expected {
+			t.Errorf("expected %v, got %v", expected, err)
+		}
+	}
+
+	c := NewClient(testOptions(t, b))
+	if err := waitToken(t, c.Connect()); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Disconnect(0)
+
+	if err := waitToken(t, c.Connect()); err != ErrConnected {
+		t.Error("unexpected error =", err)
+	}
+	if err := waitToken(t, c.Publish("/foo", 0, false, 1)); err != ErrPayloadType {
+		t.Error("unexpected error =", err)
+	}
+	if err := waitToken(t, c.Publish("/foo", 3, false, "foo")); err != mqtt.ErrInvalidQos {
+		t.Error("unexpected error =", err)
+	}
+	if err := waitToken(t, c.Subscribe("", 0, nil)); err != mqtt.ErrInvalidTopicEmptyString {
+		t.Error("unexpected error =", err)
+	}
+}
+
+func TestClient_MixedQos(t *testing.T) {
+	// QoS1 publish tokens are never completed
+	b := mqtttest.NewTestBroker(mqtttest.WithPubAckDropEvery(1))
+	defer func() { _ = b.Close() }()
+
+	c := NewClient(testOptions(t, b))
+	if err := waitToken(t, c.Connect()); err != nil {
+		t.Fatal(err)
+	}
+
+	pending := c.Publish("/foo", 1, false, "foo")
+	if err := waitToken(t, c.Publish("/foo", 2, false, "foo")); err != ErrMixedQos {
+		t.Error("unexpected error =", err)
+	}
+	if err := waitToken(t, c.Publish("/bar", 2, false, "bar")); err != nil {
+		t.Error(err)
+	}
+
+	c.Disconnect(10)
+	if err := waitToken(t, pending); err != mqtt.ErrNotConnected {
+		t.Error("pending token not failed, err =", err)
+	}
+}
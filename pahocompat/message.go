@@ -0,0 +1,107 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pahocompat
+
+import (
+	"strings"
+	"sync"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	"github.com/goiiot/libmqtt"
+)
+
+var _ mqtt.Message = (*message)(nil)
+
+// message implements mqtt.Message with the received publish packet
+type message struct {
+	client libmqtt.Client
+	p      *libmqtt.PublishPacket
+	once   sync.Once
+}
+
+func (m *message) Duplicate() bool   { return m.p.IsDup }
+func (m *message) Qos() byte         { return m.p.Qos }
+func (m *message) Retained() bool    { return m.p.IsRetain }
+func (m *message) Topic() string     { return m.p.TopicName }
+func (m *message) MessageID() uint16 { return m.p.PacketID }
+func (m *message) Payload() []byte   { return m.p.Payload }
+
+// Ack the message, messages are acked by the client once handled, so
+// it's a no-op as in paho
+func (m *message) Ack() {
+	m.once.Do(func() { m.client.Ack(m.p) })
+}
+
+// router routes publish packets with topic filters, packets matched no
+// filter are sent to the default publish handler
+type router struct {
+	*libmqtt.WildcardRouter
+
+	client         *Client
+	defaultHandler mqtt.MessageHandler
+}
+
+func newRouter(c *Client, defaultHandler mqtt.MessageHandler) *router {
+	return &router{
+		WildcardRouter: libmqtt.NewWildcardRouter(),
+		client:         c,
+		defaultHandler: defaultHandler,
+	}
+}
+
+// route registers the callback of the topic filter, shared subscriptions
+// are routed with the topic filter without the share name
+func (r *router) route(filter string, callback mqtt.MessageHandler) {
+	r.WildcardRouter.HandlePublish(routeFilter(filter), func(client libmqtt.Client, p *libmqtt.PublishPacket) {
+		callback(r.client, &message{client: client, p: p})
+	})
+}
+
+func (r *router) remove(filter string) {
+	r.WildcardRouter.Remove(routeFilter(filter))
+}
+
+// Dispatch the packet to callbacks with matched topic filters, or the
+// default publish handler if none matched
+func (r *router) Dispatch(client libmqtt.Client, p *libmqtt.PublishPacket) {
+	r.DispatchMatched(client, p)
+}
+
+// DispatchMatched dispatches the packet as Dispatch, return false if no
+// topic filter matched and no default publish handler
+func (r *router) DispatchMatched(client libmqtt.Client, p *libmqtt.PublishPacket) bool {
+	if r.WildcardRouter.DispatchMatched(client, p) {
+		return true
+	}
+
+	if r.defaultHandler == nil {
+		return false
+	}
+
+	r.defaultHandler(r.client, &message{client: client, p: p})
+	return true
+}
+
+func routeFilter(filter string) string {
+	if strings.HasPrefix(filter, "$share/") {
+		if levels := strings.SplitN(filter, "/", 3); len(levels) == 3 {
+			return levels[2]
+		}
+	}
+	return filter
+}
@@ -0,0 +1,113 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pahocompat
+
+import (
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+var (
+	_ mqtt.Token = (*Token)(nil)
+	_ mqtt.Token = (*ConnectToken)(nil)
+	_ mqtt.Token = (*SubscribeToken)(nil)
+)
+
+// Token implements mqtt.Token, completed once the operation succeeded or
+// failed, returned by Publish and Unsubscribe
+type Token struct {
+	done chan struct{}
+	once sync.Once
+	err  error
+}
+
+func newToken() *Token {
+	return &Token{done: make(chan struct{})}
+}
+
+// Wait until the token completed, always returns true
+func (t *Token) Wait() bool {
+	<-t.done
+	return true
+}
+
+// WaitTimeout waits until the token completed or the timeout elapsed,
+// returns false on timeout
+func (t *Token) WaitTimeout(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-t.done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// Error of the operation, nil if not completed or succeeded
+func (t *Token) Error() error {
+	select {
+	case <-t.done:
+		return t.err
+	default:
+		return nil
+	}
+}
+
+// complete the token with the error, only the first call takes effect
+func (t *Token) complete(err error) {
+	t.once.Do(func() {
+		t.err = err
+		close(t.done)
+	})
+}
+
+// ConnectToken is the token returned by Connect
+type ConnectToken struct {
+	Token
+	code byte
+}
+
+// ReturnCode is the ConnAck code of the connect, 255 (max byte value) if
+// failed before ConnAck received
+func (t *ConnectToken) ReturnCode() byte {
+	t.Wait()
+	return t.code
+}
+
+// SubscribeToken is the token returned by Subscribe and SubscribeMultiple
+type SubscribeToken struct {
+	Token
+	mu     sync.Mutex
+	result map[string]byte
+}
+
+// Result is the map of topic filters subscribed to the QoS granted by the
+// server (0x80 if refused), empty if not completed
+func (t *SubscribeToken) Result() map[string]byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	result := make(map[string]byte, len(t.result))
+	for k, v := range t.result {
+		result[k] = v
+	}
+	return result
+}
@@ -20,8 +20,8 @@ import (
 	"bytes"
 	"errors"
 	"io/ioutil"
+	"net/url"
 	"os"
-	"path"
 	"path/filepath"
 	"strings"
 	"sync"
@@ -33,8 +33,49 @@ var (
 	// ErrPacketDroppedByStrategy used when persist store packet while strategy
 	// don't allow that persist
 	ErrPacketDroppedByStrategy = errors.New("packet persist dropped by strategy ")
+
+	// ErrPayloadNotReplayable used when persist QoS1/QoS2 publish packet
+	// streaming payload from a reader which is not an io.ReadSeeker, the
+	// packet is sent but can not be persisted for resend
+	ErrPayloadNotReplayable = errors.New("streamed payload can not be persisted ")
 )
 
+// PersistCorruptedError is reported to PersistHandler when a persisted
+// entry can not be decoded, the entry is skipped
+type PersistCorruptedError struct {
+	Key string
+	Err error
+}
+
+func (e *PersistCorruptedError) Error() string {
+	return "persisted packet corrupted, key = " + e.Key + ", err = " + e.Err.Error()
+}
+
+// TimestampedPersist is implemented by persist methods recording the store
+// time of entries, which is used to expire entries (see WithPersistTTL)
+type TimestampedPersist interface {
+	PersistMethod
+
+	// StoredAt returns the time when the packet with key stored
+	StoredAt(key string) (time.Time, bool)
+}
+
+// PersistErrorReporter is implemented by persist methods with errors not
+// returned by method calls (e.g. corrupted entries skipped, backend not
+// reachable when loading), the report function is set by WithPersist and
+// delivers errors to PersistHandler
+type PersistErrorReporter interface {
+	SetErrorReporter(report func(err error))
+}
+
+// PersistClock is implemented by persist methods recording the store time
+// of entries (see TimestampedPersist), the now function is set by
+// WithPersist and returns the time of the client clock (see WithClock), so
+// entries are stamped with the same clock as the persist ttl purge
+type PersistClock interface {
+	SetClock(now func() time.Time)
+}
+
 // PersistStrategy defines the details to be complied in persist methods
 type PersistStrategy struct {
 	// Interval applied to file/database persist
@@ -56,6 +97,12 @@ type PersistStrategy struct {
 	// DuplicateReplace defines whether duplicated key should
 	// override previous one, default value is true
 	DuplicateReplace bool
+
+	// QuarantineCorrupted applied to file persist, defines whether
+	// entries can not be decoded should be renamed with ".corrupted"
+	// suffix, so they are kept for inspection but no more loaded,
+	// default value is false
+	QuarantineCorrupted bool
 }
 
 // defaultPersistStrategy
@@ -91,6 +138,65 @@ type PersistMethod interface {
 	Destroy() error
 }
 
+// BatchPersist is implemented by persist methods supporting batch
+// operations, which are applied with less round trips (or file syncs)
+type BatchPersist interface {
+	PersistMethod
+
+	// StoreBatch stores all key packet pairs
+	StoreBatch(packets map[string]Packet) error
+
+	// DeleteBatch deletes packets of all keys
+	DeleteBatch(keys []string) error
+
+	// RangePrefix ranges over data stored with key prefix, return false
+	// to break the range
+	RangePrefix(prefix string, f func(key string, p Packet) bool)
+}
+
+// AsBatchPersist returns the persist method as BatchPersist, persist methods
+// not implementing BatchPersist are adapted with one call per packet
+func AsBatchPersist(p PersistMethod) BatchPersist {
+	if b, ok := p.(BatchPersist); ok {
+		return b
+	}
+	return batchAdapter{p}
+}
+
+// batchAdapter implements BatchPersist with the non batch operations
+type batchAdapter struct {
+	PersistMethod
+}
+
+func (b batchAdapter) StoreBatch(packets map[string]Packet) error {
+	var err error
+	for k, p := range packets {
+		if e := b.Store(k, p); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (b batchAdapter) DeleteBatch(keys []string) error {
+	var err error
+	for _, k := range keys {
+		if e := b.Delete(k); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (b batchAdapter) RangePrefix(prefix string, f func(key string, p Packet) bool) {
+	b.Range(func(key string, p Packet) bool {
+		if !strings.HasPrefix(key, prefix) {
+			return true
+		}
+		return f(key, p)
+	})
+}
+
 // NonePersist defines no persist storage
 var NonePersist = &nonePersist{}
 
@@ -103,12 +209,17 @@ func (n *nonePersist) Range(func(key string, p Packet) bool) {}
 func (n *nonePersist) Delete(key string) error               { return nil }
 func (n *nonePersist) Destroy() error                        { return nil }
 
+func (n *nonePersist) StoreBatch(packets map[string]Packet) error                   { return nil }
+func (n *nonePersist) DeleteBatch(keys []string) error                              { return nil }
+func (n *nonePersist) RangePrefix(prefix string, f func(key string, p Packet) bool) {}
+
 // NewMemPersist create a in memory persist method with provided strategy
 // if no strategy provided (nil), then the default strategy will be used
 func NewMemPersist(strategy *PersistStrategy) PersistMethod {
 	p := &memPersist{
 		data: new(sync.Map),
 		n:    0,
+		now:  time.Now,
 	}
 
 	if strategy == nil {
@@ -121,9 +232,16 @@ func NewMemPersist(strategy *PersistStrategy) PersistMethod {
 
 // memPersist is the in memory persist method
 type memPersist struct {
-	data     *sync.Map
+	data     *sync.Map // key -> *memEntry
 	n        uint32
 	strategy *PersistStrategy
+	now      func() time.Time // store time of entries
+}
+
+// memEntry is the packet stored in memory with its store time
+type memEntry struct {
+	pkt Packet
+	at  time.Time
 }
 
 // Name of memPersist is MemPersist
@@ -134,7 +252,9 @@ func (m *memPersist) Name() string {
 	return "MemPersist"
 }
 
-// Store a key packet pair, in memory persist always return nil (no error)
+// Store a key packet pair, the packet is copied (see Packet.Clone) since
+// it may be modified by the caller, in memory persist always return nil
+// (no error)
 func (m *memPersist) Store(key string, p Packet) error {
 	if m == nil {
 		return nil
@@ -147,10 +267,11 @@ func (m *memPersist) Store(key string, p Packet) error {
 		return ErrPacketDroppedByStrategy
 	}
 
-	if _, loaded := m.data.LoadOrStore(key, p); !loaded {
+	entry := &memEntry{pkt: p.Clone(), at: m.now()}
+	if _, loaded := m.data.LoadOrStore(key, entry); !loaded {
 		atomic.AddUint32(&m.n, 1)
 	} else if m.strategy.DuplicateReplace {
-		m.data.Store(key, p)
+		m.data.Store(key, entry)
 	}
 	return nil
 }
@@ -161,9 +282,9 @@ func (m *memPersist) Load(key string) (Packet, bool) {
 		return nil, false
 	}
 
-	if p, ok := m.data.Load(key); ok {
-		if p != nil {
-			return p.(Packet), true
+	if e, ok := m.data.Load(key); ok {
+		if p := e.(*memEntry).pkt; p != nil {
+			return p, true
 		}
 	} else {
 		return nil, false
@@ -172,6 +293,23 @@ func (m *memPersist) Load(key string) (Packet, bool) {
 	return nil, true
 }
 
+// StoredAt returns the time when the packet with key stored
+func (m *memPersist) StoredAt(key string) (time.Time, bool) {
+	if m == nil {
+		return time.Time{}, false
+	}
+
+	if e, ok := m.data.Load(key); ok {
+		return e.(*memEntry).at, true
+	}
+	return time.Time{}, false
+}
+
+// SetClock sets the function returning the store time of entries
+func (m *memPersist) SetClock(now func() time.Time) {
+	m.now = now
+}
+
 // Range over all packet persisted
 func (m *memPersist) Range(f func(key string, p Packet) bool) {
 	if m == nil || f == nil {
@@ -179,17 +317,44 @@ func (m *memPersist) Range(f func(key string, p Packet) bool) {
 	}
 
 	m.data.Range(func(key, value interface{}) bool {
-		return f(key.(string), value.(Packet))
+		return f(key.(string), value.(*memEntry).pkt)
 	})
 }
 
+// RangePrefix over packets persisted with key prefix
+func (m *memPersist) RangePrefix(prefix string, f func(key string, p Packet) bool) {
+	if m == nil || f == nil {
+		return
+	}
+
+	m.data.Range(func(key, value interface{}) bool {
+		if !strings.HasPrefix(key.(string), prefix) {
+			return true
+		}
+		return f(key.(string), value.(*memEntry).pkt)
+	})
+}
+
+// StoreBatch stores all key packet pairs
+func (m *memPersist) StoreBatch(packets map[string]Packet) error {
+	return batchAdapter{m}.StoreBatch(packets)
+}
+
+// DeleteBatch deletes packets of all keys
+func (m *memPersist) DeleteBatch(keys []string) error {
+	return batchAdapter{m}.DeleteBatch(keys)
+}
+
 // Delete a persisted packet with key
 func (m *memPersist) Delete(key string) error {
 	if m == nil {
 		return nil
 	}
 
-	m.data.Delete(key)
+	if _, loaded := m.data.Load(key); loaded {
+		m.data.Delete(key)
+		atomic.AddUint32(&m.n, ^uint32(0))
+	}
 	return nil
 }
 
@@ -200,11 +365,14 @@ func (m *memPersist) Destroy() error {
 	}
 
 	m.data = new(sync.Map)
+	atomic.StoreUint32(&m.n, 0)
 	return nil
 }
 
 const (
-	fileSuffix = ".mqtt"
+	fileSuffix    = ".mqtt"
+	fileTmpSuffix = ".tmp"
+	fileCorrupted = ".corrupted"
 )
 
 // NewFilePersist will create a file persist method with provided
@@ -223,22 +391,23 @@ func NewFilePersist(dirPath string, strategy *PersistStrategy) PersistMethod {
 		p.strategy = defaultPersistStrategy
 	}
 
-	// init file packet size
-	_ = filepath.Walk(dirPath, func(path string, info os.FileInfo, err error) error {
-		if err != nil || info.IsDir() {
-			return filepath.SkipDir
-		}
-
-		if strings.HasSuffix(info.Name(), fileSuffix) {
+	// init file packet size, and clean up files of unfinished writes
+	for _, name := range p.fileNames() {
+		if strings.HasSuffix(name, fileSuffix) {
 			p.n++
+		} else if strings.Contains(name, fileSuffix+fileTmpSuffix) {
+			_ = os.Remove(filepath.Join(dirPath, name))
 		}
-		return nil
-	})
+	}
 
 	return p
 }
 
-// filePersist is the file persist method
+// filePersist is the file persist method, every entry is written to the
+// temp file and renamed to the packet file to avoid partial writes
+//
+// entries can not be decoded (e.g. corrupted by power cut) are skipped and
+// reported to PersistHandler with PersistCorruptedError
 type filePersist struct {
 	dirPath   string
 	inMemBuf  *sync.Map
@@ -246,6 +415,8 @@ type filePersist struct {
 	bytesBuf  *bytes.Buffer
 	strategy  *PersistStrategy
 	n         uint32
+	reportErr func(err error)
+	now       func() time.Time // store time of entries, nil for the file time
 }
 
 // Name of filePersist is "FilePersist"
@@ -279,8 +450,11 @@ func (m *filePersist) Store(key string, p Packet) error {
 					go m.worker()
 				}()
 			}
-			m.inMemBuf.Store(key, p)
-			atomic.AddUint32(&m.inMemSize, 1)
+			if _, loaded := m.inMemBuf.LoadOrStore(key, p); loaded {
+				m.inMemBuf.Store(key, p)
+			} else {
+				atomic.AddUint32(&m.inMemSize, 1)
+			}
 		} else {
 			// persist every time
 			return m.store(key, p)
@@ -296,41 +470,122 @@ func (m *filePersist) Load(key string) (Packet, bool) {
 		return nil, false
 	}
 
+	if p, ok := m.inMemBuf.Load(key); ok {
+		return p.(Packet), true
+	}
+
 	packet, err := m.getPacketFromFile(m.getFilename(key))
 	if err != nil {
+		if !os.IsNotExist(err) {
+			m.corrupted(key, err)
+		}
 		return nil, false
 	}
 
 	return packet, true
 }
 
-// Range over all packet persisted
+// Range over all packet persisted, corrupted entries are skipped
 func (m *filePersist) Range(ranger func(key string, p Packet) bool) {
+	m.RangePrefix("", ranger)
+}
+
+// RangePrefix over packets persisted with key prefix, corrupted entries
+// are skipped
+func (m *filePersist) RangePrefix(prefix string, ranger func(key string, p Packet) bool) {
 	if m == nil || ranger == nil {
 		return
 	}
 
-	_ = filepath.Walk(m.dirPath, func(path string, info os.FileInfo, err error) error {
-		// error happened or is dir
-		if err != nil || info.IsDir() {
-			return filepath.SkipDir
+	inMem := make(map[string]struct{})
+	next := true
+	m.inMemBuf.Range(func(key, value interface{}) bool {
+		inMem[key.(string)] = struct{}{}
+		if !strings.HasPrefix(key.(string), prefix) {
+			return true
+		}
+
+		next = ranger(key.(string), value.(Packet))
+		return next
+	})
+
+	for _, name := range m.fileNames() {
+		if !next {
+			return
 		}
 
 		// not libmqtt packet file
-		if !strings.HasSuffix(info.Name(), fileSuffix) {
-			return nil
+		if !strings.HasSuffix(name, fileSuffix) {
+			continue
+		}
+
+		key, err := url.PathUnescape(strings.TrimSuffix(name, fileSuffix))
+		if err != nil || !strings.HasPrefix(key, prefix) {
+			continue
+		}
+
+		if _, ok := inMem[key]; ok {
+			continue
 		}
 
 		// decode packet
-		pkt, err := m.getPacketFromFile(path)
+		pkt, err := m.getPacketFromFile(filepath.Join(m.dirPath, name))
 		if err != nil {
-			return nil
+			if !os.IsNotExist(err) {
+				m.corrupted(key, err)
+			}
+			continue
 		}
 
-		ranger(strings.TrimSuffix(info.Name(), fileSuffix), pkt)
+		next = ranger(key, pkt)
+	}
+}
 
+// StoreBatch stores all key packet pairs, the dir is synced once for all
+// packets written to files
+func (m *filePersist) StoreBatch(packets map[string]Packet) error {
+	if m == nil {
 		return nil
-	})
+	}
+
+	if m.strategy.Interval > 0 {
+		return batchAdapter{m}.StoreBatch(packets)
+	}
+
+	var err error
+	written := false
+	for k, p := range packets {
+		if m.strategy.MaxCount > 0 && m.strategy.DropOnExceed &&
+			atomic.LoadUint32(&m.n) >= m.strategy.MaxCount {
+			// packet dropped
+			err = ErrPacketDroppedByStrategy
+			continue
+		}
+
+		if m.exists(k) && !m.strategy.DuplicateReplace {
+			continue
+		}
+
+		if e := m.write(k, p); e != nil {
+			if err == nil {
+				err = e
+			}
+			continue
+		}
+		written = true
+	}
+
+	if written {
+		if e := syncDir(m.dirPath); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// DeleteBatch deletes packets of all keys
+func (m *filePersist) DeleteBatch(keys []string) error {
+	return batchAdapter{m}.DeleteBatch(keys)
 }
 
 // Delete a persisted packet with key
@@ -339,7 +594,21 @@ func (m *filePersist) Delete(key string) error {
 		return nil
 	}
 
-	return os.Remove(path.Join(m.dirPath, key))
+	if _, loaded := m.inMemBuf.Load(key); loaded {
+		m.inMemBuf.Delete(key)
+		atomic.AddUint32(&m.inMemSize, ^uint32(0))
+	}
+
+	err := os.Remove(m.getFilename(key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	atomic.AddUint32(&m.n, ^uint32(0))
+	return nil
 }
 
 // Destroy persist storage
@@ -351,13 +620,83 @@ func (m *filePersist) Destroy() error {
 	return os.RemoveAll(m.dirPath)
 }
 
+// StoredAt returns the time when the packet with key stored
+func (m *filePersist) StoredAt(key string) (time.Time, bool) {
+	if m == nil {
+		return time.Time{}, false
+	}
+
+	if _, ok := m.inMemBuf.Load(key); ok {
+		// not written to file yet
+		return m.storeTime(), true
+	}
+
+	info, err := os.Stat(m.getFilename(key))
+	if err != nil {
+		return time.Time{}, false
+	}
+	return info.ModTime(), true
+}
+
+// SetErrorReporter sets the function to report corrupted entries
+func (m *filePersist) SetErrorReporter(report func(err error)) {
+	m.reportErr = report
+}
+
+// SetClock sets the function returning the store time of entries, which
+// is set as the modification time of packet files
+func (m *filePersist) SetClock(now func() time.Time) {
+	m.now = now
+}
+
+func (m *filePersist) storeTime() time.Time {
+	if m.now != nil {
+		return m.now()
+	}
+	return time.Now()
+}
+
+// corrupted reports the entry can not be decoded, and moves the packet
+// file away if required by PersistStrategy.QuarantineCorrupted
+func (m *filePersist) corrupted(key string, err error) {
+	if m.strategy.QuarantineCorrupted {
+		filename := m.getFilename(key)
+		if os.Rename(filename, filename+fileCorrupted) == nil {
+			atomic.AddUint32(&m.n, ^uint32(0))
+		}
+	}
+
+	if m.reportErr != nil {
+		m.reportErr(&PersistCorruptedError{Key: key, Err: err})
+	}
+}
+
+func (m *filePersist) fileNames() []string {
+	dir, err := os.Open(m.dirPath)
+	if err != nil {
+		return nil
+	}
+	defer func() { _ = dir.Close() }()
+
+	names, _ := dir.Readdirnames(-1)
+	return names
+}
+
 func (m *filePersist) getPacketFromFile(path string) (Packet, error) {
 	content, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
 
-	packet, err := Decode(V311, bytes.NewReader(content))
+	// entries written by old versions have no version prefix, since the
+	// first byte of packet is never a valid version, it's safe to detect
+	version := V311
+	if len(content) > 0 && (content[0] == byte(V31) || content[0] == byte(V311) || content[0] == byte(V5)) {
+		version = ProtoVersion(content[0])
+		content = content[1:]
+	}
+
+	packet, err := Decode(version, bytes.NewReader(content))
 	if err != nil {
 		return nil, err
 	}
@@ -366,12 +705,12 @@ func (m *filePersist) getPacketFromFile(path string) (Packet, error) {
 }
 
 func (m *filePersist) exists(key string) bool {
-	_, err := os.Open(m.getFilename(key))
-	if err != nil && os.IsNotExist(err) {
-		// no such packet file
-		return false
+	if _, ok := m.inMemBuf.Load(key); ok {
+		return true
 	}
-	return true
+
+	_, err := os.Stat(m.getFilename(key))
+	return err == nil
 }
 
 func (m *filePersist) store(key string, p Packet) error {
@@ -379,13 +718,41 @@ func (m *filePersist) store(key string, p Packet) error {
 		return nil
 	}
 
-	err := ioutil.WriteFile(m.getFilename(key), p.Bytes(), 0600)
+	if err := m.write(key, p); err != nil {
+		return err
+	}
+	return syncDir(m.dirPath)
+}
+
+// write the packet file atomically, the dir is not synced
+func (m *filePersist) write(key string, p Packet) error {
+	if p == nil {
+		return nil
+	}
+
+	filename := m.getFilename(key)
+	_, statErr := os.Stat(filename)
+
+	encoded, err := p.MarshalBinary()
 	if err != nil {
 		return err
 	}
 
-	atomic.AddUint32(&m.n, 1)
-	atomic.StoreUint32(&m.inMemSize, atomic.LoadUint32(&m.inMemSize)-1)
+	data := append([]byte{byte(p.Version())}, encoded...)
+	if err := writeFileAtomic(m.dirPath, filename, data); err != nil {
+		return err
+	}
+
+	if m.now != nil {
+		at := m.now()
+		if err := os.Chtimes(filename, at, at); err != nil {
+			return err
+		}
+	}
+
+	if statErr != nil {
+		atomic.AddUint32(&m.n, 1)
+	}
 	return nil
 }
 
@@ -400,13 +767,18 @@ func (m *filePersist) worker() {
 			return true
 		}
 
-		_ = m.store(k, p)
+		if err := m.store(k, p); err != nil && m.reportErr != nil {
+			m.reportErr(err)
+		}
 		persistedKeys = append(persistedKeys, k)
 		return true
 	})
 
 	for _, k := range persistedKeys {
-		m.inMemBuf.Delete(k)
+		if _, loaded := m.inMemBuf.Load(k); loaded {
+			m.inMemBuf.Delete(k)
+			atomic.AddUint32(&m.inMemSize, ^uint32(0))
+		}
 	}
 
 	if atomic.LoadUint32(&m.inMemSize) > 0 {
@@ -415,5 +787,66 @@ func (m *filePersist) worker() {
 }
 
 func (m *filePersist) getFilename(key string) string {
-	return path.Join(m.dirPath, key+fileSuffix)
+	return filepath.Join(m.dirPath, escapeFilename(key)+fileSuffix)
+}
+
+// escapeFilename escapes all characters except letters, digits, '-', '_'
+// and '.' in the key (e.g. '/' in namespaced keys) with the percent
+// encoding, so every key is a valid file name in the flat persist dir
+func escapeFilename(key string) string {
+	const hex = "0123456789ABCDEF"
+
+	buf := make([]byte, 0, len(key))
+	for i := 0; i < len(key); i++ {
+		switch b := key[i]; {
+		case 'a' <= b && b <= 'z', 'A' <= b && b <= 'Z', '0' <= b && b <= '9',
+			b == '-', b == '_', b == '.':
+			buf = append(buf, b)
+		default:
+			buf = append(buf, '%', hex[b>>4], hex[b&0x0f])
+		}
+	}
+	return string(buf)
+}
+
+// writeFileAtomic writes data to a temp file in dir and renames it to
+// filename, so the file is either not changed or fully written, the dir
+// should be synced to make the rename durable
+func writeFileAtomic(dir, filename string, data []byte) error {
+	f, err := ioutil.TempFile(dir, filepath.Base(filename)+fileTmpSuffix)
+	if err != nil {
+		return err
+	}
+	tmpName := f.Name()
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmpName, 0600)
+	}
+	if err == nil {
+		err = os.Rename(tmpName, filename)
+	}
+	if err != nil {
+		_ = os.Remove(tmpName)
+	}
+	return err
+}
+
+// syncDir makes the changes of files in the dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if closeErr := d.Close(); err == nil {
+		err = closeErr
+	}
+	return err
 }
@@ -0,0 +1,264 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"io"
+	"time"
+)
+
+var (
+	// ErrDecryptPersisted used when the persisted entry can not be decrypted
+	// with any of the keys provided
+	ErrDecryptPersisted = errors.New("persisted packet can not be decrypted ")
+)
+
+// encryptedTopic is the topic of publish packets wrapping encrypted packets
+const encryptedTopic = "$libmqtt/encrypted"
+
+// NewEncryptedPersist will create a persist method encrypting packets with
+// AES-GCM before storing them in the inner persist method, the key must be
+// 16, 24 or 32 bytes to select AES-128, AES-192 or AES-256
+//
+// packets are always encrypted with the key, decryptKeys are tried as well
+// when loading packets, so previous keys can be provided for key rotation
+func NewEncryptedPersist(inner PersistMethod, key []byte, decryptKeys ...[]byte) (PersistMethod, error) {
+	if inner == nil {
+		return nil, errors.New("encrypted persist requires inner persist method")
+	}
+
+	p := &encryptedPersist{inner: inner}
+	for _, k := range append([][]byte{key}, decryptKeys...) {
+		block, err := aes.NewCipher(k)
+		if err != nil {
+			return nil, err
+		}
+
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		p.aeads = append(p.aeads, aead)
+	}
+
+	return p, nil
+}
+
+// encryptedPersist wraps the inner persist method, every packet is stored
+// as a publish packet with topic encryptedTopic and payload of the random
+// nonce followed by the sealed MQTT version byte and encoded packet, the
+// persist key is used as additional data, so entries can not be swapped
+type encryptedPersist struct {
+	inner     PersistMethod
+	aeads     []cipher.AEAD
+	reportErr func(err error)
+}
+
+// Name of encryptedPersist is "EncryptedPersist"
+func (e *encryptedPersist) Name() string {
+	if e == nil {
+		return "<nil>"
+	}
+
+	return "EncryptedPersist"
+}
+
+// Store a key packet pair encrypted in the inner persist method
+func (e *encryptedPersist) Store(key string, p Packet) error {
+	if e == nil || p == nil {
+		return nil
+	}
+
+	w, err := e.encrypt(key, p)
+	if err != nil {
+		return err
+	}
+	return e.inner.Store(key, w)
+}
+
+// StoreBatch stores all key packet pairs encrypted in the inner persist
+// method with batch operation if supported
+func (e *encryptedPersist) StoreBatch(packets map[string]Packet) error {
+	if e == nil || len(packets) == 0 {
+		return nil
+	}
+
+	encrypted := make(map[string]Packet, len(packets))
+	for k, p := range packets {
+		if p == nil {
+			continue
+		}
+
+		w, err := e.encrypt(k, p)
+		if err != nil {
+			return err
+		}
+		encrypted[k] = w
+	}
+	return AsBatchPersist(e.inner).StoreBatch(encrypted)
+}
+
+// Load a packet with key and decrypt it, return nil, false when no packet
+// found or the packet can not be decrypted
+func (e *encryptedPersist) Load(key string) (Packet, bool) {
+	if e == nil {
+		return nil, false
+	}
+
+	w, ok := e.inner.Load(key)
+	if !ok {
+		return nil, false
+	}
+
+	p, err := e.decrypt(key, w)
+	if err != nil {
+		e.corrupted(key, err)
+		return nil, false
+	}
+	return p, true
+}
+
+// Range over all packet persisted, entries can not be decrypted are skipped
+func (e *encryptedPersist) Range(ranger func(key string, p Packet) bool) {
+	e.RangePrefix("", ranger)
+}
+
+// RangePrefix over packets persisted with key prefix, entries can not be
+// decrypted are skipped
+func (e *encryptedPersist) RangePrefix(prefix string, ranger func(key string, p Packet) bool) {
+	if e == nil || ranger == nil {
+		return
+	}
+
+	AsBatchPersist(e.inner).RangePrefix(prefix, func(key string, w Packet) bool {
+		p, err := e.decrypt(key, w)
+		if err != nil {
+			e.corrupted(key, err)
+			return true
+		}
+		return ranger(key, p)
+	})
+}
+
+// Delete a persisted packet with key
+func (e *encryptedPersist) Delete(key string) error {
+	if e == nil {
+		return nil
+	}
+
+	return e.inner.Delete(key)
+}
+
+// DeleteBatch deletes packets of all keys in the inner persist method with
+// batch operation if supported
+func (e *encryptedPersist) DeleteBatch(keys []string) error {
+	if e == nil {
+		return nil
+	}
+
+	return AsBatchPersist(e.inner).DeleteBatch(keys)
+}
+
+// Destroy the inner persist method
+func (e *encryptedPersist) Destroy() error {
+	if e == nil {
+		return nil
+	}
+
+	return e.inner.Destroy()
+}
+
+// StoredAt returns the time when the packet with key stored if recorded
+// by the inner persist method
+func (e *encryptedPersist) StoredAt(key string) (time.Time, bool) {
+	if e == nil {
+		return time.Time{}, false
+	}
+
+	if t, ok := e.inner.(TimestampedPersist); ok {
+		return t.StoredAt(key)
+	}
+	return time.Time{}, false
+}
+
+// SetErrorReporter sets the function to report entries can not be
+// decrypted, and the error reporter of the inner persist method
+func (e *encryptedPersist) SetErrorReporter(report func(err error)) {
+	e.reportErr = report
+	if r, ok := e.inner.(PersistErrorReporter); ok {
+		r.SetErrorReporter(report)
+	}
+}
+
+// SetClock sets the clock of the inner persist method
+func (e *encryptedPersist) SetClock(now func() time.Time) {
+	if c, ok := e.inner.(PersistClock); ok {
+		c.SetClock(now)
+	}
+}
+
+func (e *encryptedPersist) corrupted(key string, err error) {
+	if e.reportErr != nil {
+		e.reportErr(&PersistCorruptedError{Key: key, Err: err})
+	}
+}
+
+func (e *encryptedPersist) encrypt(key string, p Packet) (Packet, error) {
+	aead := e.aeads[0]
+	encoded, err := p.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	plain := append([]byte{byte(p.Version())}, encoded...)
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plain)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return &PublishPacket{
+		TopicName: encryptedTopic,
+		Payload:   aead.Seal(nonce, nonce, plain, []byte(key)),
+	}, nil
+}
+
+func (e *encryptedPersist) decrypt(key string, w Packet) (Packet, error) {
+	pub, ok := w.(*PublishPacket)
+	if !ok || pub.TopicName != encryptedTopic {
+		return nil, ErrDecryptPersisted
+	}
+
+	for _, aead := range e.aeads {
+		if len(pub.Payload) < aead.NonceSize() {
+			continue
+		}
+
+		nonce, sealed := pub.Payload[:aead.NonceSize()], pub.Payload[aead.NonceSize():]
+		plain, err := aead.Open(nil, nonce, sealed, []byte(key))
+		if err != nil || len(plain) < 2 {
+			continue
+		}
+
+		return Decode(ProtoVersion(plain[0]), bytes.NewReader(plain[1:]))
+	}
+	return nil, ErrDecryptPersisted
+}
@@ -0,0 +1,127 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	testEncryptKey    = bytes.Repeat([]byte{1}, 32)
+	testEncryptOldKey = bytes.Repeat([]byte{2}, 16)
+)
+
+func TestEncryptedPersist(t *testing.T) {
+	dirPath, err := ioutil.TempDir("", "test-encrypted-persist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dirPath) }()
+
+	strategy := &PersistStrategy{DuplicateReplace: true}
+	for _, inner := range []PersistMethod{
+		NewMemPersist(strategy),
+		NewFilePersist(dirPath, strategy),
+	} {
+		p, err := NewEncryptedPersist(inner, testEncryptKey)
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		pub := &PublishPacket{TopicName: "/provision", Qos: Qos1, PacketID: 1, Payload: []byte("secret-password"),
+			Props: &PublishProps{ContentType: "text/plain"}}
+		pub.SetVersion(V5)
+		assert.NoError(t, p.Store(sendKey("", 1), pub))
+
+		// nothing in plain text
+		w, ok := inner.Load(sendKey("", 1))
+		if assert.True(t, ok, inner.Name()) {
+			assert.False(t, bytes.Contains(w.Bytes(), []byte("secret-password")), inner.Name())
+		}
+
+		pkt, ok := p.Load(sendKey("", 1))
+		if assert.True(t, ok, inner.Name()) {
+			pub := pkt.(*PublishPacket)
+			assert.Equal(t, V5, pub.Version())
+			assert.Equal(t, "/provision", pub.TopicName)
+			assert.Equal(t, "secret-password", string(pub.Payload))
+			assert.Equal(t, "text/plain", pub.Props.ContentType)
+		}
+		assert.NoError(t, p.Delete(sendKey("", 1)))
+
+		testBatchPersist(t, p.(BatchPersist))
+		assert.NoError(t, p.Destroy())
+	}
+
+	matches, _ := filepath.Glob(filepath.Join(dirPath, "*"))
+	assert.Empty(t, matches)
+}
+
+func TestEncryptedPersist_KeyRotation(t *testing.T) {
+	inner := NewMemPersist(nil)
+	old, err := NewEncryptedPersist(inner, testEncryptOldKey)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, old.Store(sendKey("", 1), &PublishPacket{TopicName: "/foo", Qos: Qos1, PacketID: 1}))
+
+	// rotated key
+	p, err := NewEncryptedPersist(inner, testEncryptKey, testEncryptOldKey)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, p.Store(sendKey("", 2), &PublishPacket{TopicName: "/foo", Qos: Qos1, PacketID: 2}))
+
+	var keys []string
+	p.Range(func(key string, pkt Packet) bool {
+		keys = append(keys, key)
+		return true
+	})
+	assert.ElementsMatch(t, []string{sendKey("", 1), sendKey("", 2)}, keys)
+
+	// old key removed
+	p, err = NewEncryptedPersist(inner, testEncryptKey)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	var reported []error
+	p.(PersistErrorReporter).SetErrorReporter(func(err error) { reported = append(reported, err) })
+
+	_, ok := p.Load(sendKey("", 1))
+	assert.False(t, ok)
+	_, ok = p.Load(sendKey("", 2))
+	assert.True(t, ok)
+	if assert.Len(t, reported, 1) {
+		assert.Equal(t, &PersistCorruptedError{Key: sendKey("", 1), Err: ErrDecryptPersisted}, reported[0])
+	}
+
+	// entries can not be moved to other keys
+	w, _ := inner.Load(sendKey("", 2))
+	assert.NoError(t, inner.Store(sendKey("", 3), w))
+	_, ok = p.Load(sendKey("", 3))
+	assert.False(t, ok)
+
+	_, err = NewEncryptedPersist(inner, []byte("bad key"))
+	assert.Error(t, err)
+}
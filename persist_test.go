@@ -17,10 +17,16 @@
 package libmqtt
 
 import (
+	"io/ioutil"
 	"os"
+	"sort"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/goiiot/libmqtt/internal/testutil"
+	"github.com/stretchr/testify/assert"
 )
 
 var (
@@ -120,3 +126,396 @@ func TestFilePersist(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestFilePersist_Corrupted(t *testing.T) {
+	newPacket := func(id uint16) *PublishPacket {
+		p := &PublishPacket{
+			TopicName: "/foo",
+			Qos:       Qos1,
+			PacketID:  id,
+			Payload:   []byte("bar"),
+			Props:     &PublishProps{ContentType: "text/plain"},
+		}
+		p.SetVersion(V5)
+		return p
+	}
+
+	size := len(newPacket(1).Bytes()) + 1
+	for offset := 0; offset < size; offset++ {
+		for _, quarantine := range []bool{false, true} {
+			dirPath, err := ioutil.TempDir("", "test-file-persist")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			strategy := &PersistStrategy{DuplicateReplace: true, QuarantineCorrupted: quarantine}
+			p := NewFilePersist(dirPath, strategy).(*filePersist)
+			for i := uint16(1); i <= 3; i++ {
+				if err := p.Store(sendKey("", i), newPacket(i)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// power cut while writing the entry
+			if err := os.Truncate(p.getFilename(sendKey("", 2)), int64(offset)); err != nil {
+				t.Fatal(err)
+			}
+
+			// unfinished temp file
+			if err := ioutil.WriteFile(p.getFilename(sendKey("", 4))+fileTmpSuffix+"1", nil, 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			// reopen the persist
+			p = NewFilePersist(dirPath, strategy).(*filePersist)
+			var reported []error
+			p.SetErrorReporter(func(err error) { reported = append(reported, err) })
+
+			var keys []string
+			p.Range(func(key string, pkt Packet) bool {
+				keys = append(keys, key)
+				if pub := pkt.(*PublishPacket); pub.Version() != V5 || pub.Props.ContentType != "text/plain" {
+					t.Error("unexpected packet loaded =", pub)
+				}
+				return true
+			})
+			sort.Strings(keys)
+			assert.Equal(t, []string{sendKey("", 1), sendKey("", 3)}, keys, "offset = %d", offset)
+
+			if assert.Len(t, reported, 1) {
+				e, ok := reported[0].(*PersistCorruptedError)
+				assert.True(t, ok && e.Key == sendKey("", 2), "unexpected report = %v", reported[0])
+			}
+
+			_, err = os.Stat(p.getFilename(sendKey("", 2)) + fileCorrupted)
+			assert.Equal(t, quarantine, err == nil, "quarantine = %v", quarantine)
+
+			names, _ := ioutil.ReadDir(dirPath)
+			for _, f := range names {
+				assert.NotContains(t, f.Name(), fileTmpSuffix, "temp file not cleaned")
+			}
+
+			_, ok := p.Load(sendKey("", 2))
+			assert.False(t, ok)
+			_, ok = p.Load(sendKey("", 3))
+			assert.True(t, ok)
+
+			assert.NoError(t, p.Delete(sendKey("", 3)))
+			_, ok = p.Load(sendKey("", 3))
+			assert.False(t, ok)
+
+			_ = os.RemoveAll(dirPath)
+		}
+	}
+}
+
+// untimedPersist hides StoredAt of the persist method
+type untimedPersist struct {
+	PersistMethod
+}
+
+func TestClient_PurgeExpired(t *testing.T) {
+	expiring := &PublishPacket{TopicName: "/foo", Qos: Qos1, PacketID: 2, Props: &PublishProps{MessageExpiryInterval: 1}}
+	expiring.SetVersion(V5)
+
+	for _, persist := range []PersistMethod{
+		NewMemPersist(nil),
+		untimedPersist{NewMemPersist(nil)},
+	} {
+		c := defaultClient()
+		c.persist = persist
+		c.persistTTL = time.Hour
+
+		assert.NoError(t, persist.Store(sendKey("", 1), &PublishPacket{TopicName: "/foo", Qos: Qos1, PacketID: 1}))
+		assert.NoError(t, persist.Store(sendKey("", 2), expiring))
+
+		seen := make(map[string]time.Time)
+		now := time.Now()
+		assert.Equal(t, 0, c.purgeExpired(now, seen))
+
+		// message expiry interval is shorter than ttl
+		assert.Equal(t, 1, c.purgeExpired(now.Add(2*time.Second), seen))
+		_, ok := persist.Load(sendKey("", 2))
+		assert.False(t, ok)
+
+		assert.Equal(t, 1, c.purgeExpired(now.Add(time.Hour+time.Second), seen))
+		_, ok = persist.Load(sendKey("", 1))
+		assert.False(t, ok)
+		assert.Empty(t, seen)
+	}
+}
+
+func TestClient_PersistTTL(t *testing.T) {
+	for _, persist := range []PersistMethod{
+		NewMemPersist(nil),
+		NewFilePersist(t.TempDir(), &PersistStrategy{}),
+	} {
+		// entries stamped with the client clock, far from the real time
+		clk := testutil.NewFakeClock(time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC))
+		c, err := NewClient(
+			WithPersist(persist),
+			WithClock(clk),
+			WithPersistTTL(20*time.Millisecond),
+			WithEventBuf(10),
+			WithPersistHandleFunc(func(client Client, packet Packet, err error) {
+				t.Error("purge reported as persist error =", err)
+			}),
+		)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.NoError(t, persist.Store(sendKey("", 1), &PublishPacket{TopicName: "/foo", Qos: Qos1, PacketID: 1}))
+
+		// purged every 10ms, not expired yet
+		clk.BlockUntil(1)
+		clk.Advance(10 * time.Millisecond)
+		if _, ok := persist.Load(sendKey("", 1)); !ok {
+			t.Error("packet purged before expired,", persist.Name())
+		}
+		clk.Advance(10 * time.Millisecond)
+
+		select {
+		case e := <-c.Events():
+			if purged, ok := e.(*PersistPurgedEvent); !ok || purged.Count != 1 {
+				t.Error("unexpected event =", e, persist.Name())
+			}
+		case <-time.After(time.Second):
+			t.Fatal("expired packet not purged,", persist.Name())
+		}
+
+		if _, ok := persist.Load(sendKey("", 1)); ok {
+			t.Error("expired packet not deleted,", persist.Name())
+		}
+		c.Destroy(true)
+	}
+}
+
+func testBatchPersist(t *testing.T, p BatchPersist) {
+	packets := map[string]Packet{
+		sendKey("", 1): &PublishPacket{TopicName: "/foo", Qos: Qos1, PacketID: 1},
+		sendKey("", 2): &PublishPacket{TopicName: "/foo", Qos: Qos1, PacketID: 2},
+		recvKey("", 1): &PublishPacket{TopicName: "/bar", Qos: Qos2, PacketID: 1},
+	}
+	if !assert.NoError(t, p.StoreBatch(packets), p.Name()) {
+		return
+	}
+
+	var keys []string
+	p.RangePrefix(sendKeyDir, func(key string, pkt Packet) bool {
+		keys = append(keys, key)
+		assert.Equal(t, "/foo", pkt.(*PublishPacket).TopicName, p.Name())
+		return true
+	})
+	sort.Strings(keys)
+	assert.Equal(t, []string{sendKey("", 1), sendKey("", 2)}, keys, p.Name())
+
+	n := 0
+	p.RangePrefix("", func(key string, pkt Packet) bool {
+		n++
+		return false
+	})
+	assert.Equal(t, 1, n, p.Name())
+
+	assert.NoError(t, p.DeleteBatch(keys), p.Name())
+	keys = nil
+	p.Range(func(key string, pkt Packet) bool {
+		keys = append(keys, key)
+		return true
+	})
+	assert.Equal(t, []string{recvKey("", 1)}, keys, p.Name())
+}
+
+func TestBatchPersist(t *testing.T) {
+	dirPath, err := ioutil.TempDir("", "test-file-persist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dirPath) }()
+
+	strategy := &PersistStrategy{DuplicateReplace: true}
+	for _, p := range []PersistMethod{
+		NewMemPersist(strategy),
+		NewFilePersist(dirPath, strategy),
+		untimedPersist{NewMemPersist(strategy)},
+	} {
+		testBatchPersist(t, AsBatchPersist(p))
+	}
+
+	if _, ok := AsBatchPersist(untimedPersist{NonePersist}).(batchAdapter); !ok {
+		t.Error("persist method not adapted")
+	}
+}
+
+func TestClient_SharedPersist(t *testing.T) {
+	const n = 100
+
+	persist := NewMemPersist(nil)
+	// persisted by previous versions
+	assert.NoError(t, persist.Store("S1", &PublishPacket{TopicName: "/legacy", Qos: Qos1, PacketID: 1}))
+	assert.NoError(t, persist.Store("R2", &PublishPacket{TopicName: "/legacy", Qos: Qos2, PacketID: 2}))
+
+	newClient := func(clientID string) Client {
+		connected := make(chan struct{})
+		client, err := NewClient(
+			WithPersist(persist),
+			WithClientID(clientID),
+			WithDialTimeout(10),
+			WithKeepalive(10, 1.2),
+			WithCustomConnector(fakeConnector(fakeBrokerConfig{ackPub: false})),
+			WithConnHandleFunc(func(client Client, server string, code byte, err error) {
+				if err == nil && code == CodeSuccess {
+					close(connected)
+				}
+			}),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := client.ConnectServer("fake/server"); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case <-connected:
+		case <-time.After(5 * time.Second):
+			t.Fatal("connect timeout")
+		}
+		return client
+	}
+
+	c1 := newClient("c1")
+	defer c1.Destroy(true)
+
+	// legacy keys migrated to the namespace of the first connection, no
+	// session state in server, so QoS2 receive state dropped
+	ns1 := persistNamespace("c1", "fake/server")
+	assert.Equal(t, "c1/fake%2Fserver/", ns1)
+	pkt, ok := persist.Load(sendKey(ns1, 1))
+	if assert.True(t, ok) {
+		assert.Equal(t, "/legacy", pkt.(*PublishPacket).TopicName)
+	}
+	for _, k := range []string{"S1", "R2", recvKey(ns1, 2)} {
+		_, ok = persist.Load(k)
+		assert.False(t, ok, k)
+	}
+	assert.True(t, c1.DropPending(1))
+
+	c2 := newClient("c2")
+	defer c2.Destroy(true)
+	ns2 := persistNamespace("c2", "fake/server")
+
+	// packets are never acked, same packet ids used by both clients
+	wg := new(sync.WaitGroup)
+	for topic, c := range map[string]Client{"/c1": c1, "/c2": c2} {
+		wg.Add(1)
+		go func(topic string, c Client) {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				c.Publish(&PublishPacket{TopicName: topic, Qos: QosLevel(i%2 + 1), Payload: []byte("bar")})
+			}
+		}(topic, c)
+	}
+	wg.Wait()
+
+	assert.Eventually(t, func() bool {
+		count := 0
+		persist.Range(func(key string, p Packet) bool {
+			count++
+			return true
+		})
+		return count == 2*n
+	}, 5*time.Second, 10*time.Millisecond, "packets overwritten")
+
+	for id := uint16(1); id <= n; id++ {
+		for ns, topic := range map[string]string{ns1: "/c1", ns2: "/c2"} {
+			pkt, ok := loadSentPacket(persist, ns, id)
+			if assert.True(t, ok, "id = %d", id) {
+				assert.Equal(t, topic, pkt.(*PublishPacket).TopicName)
+			}
+		}
+	}
+}
+
+// loadSentPacket loads the sent packet persisted with any send sequence
+func loadSentPacket(p PersistMethod, ns string, id uint16) (Packet, bool) {
+	var pkt Packet
+	AsBatchPersist(p).RangePrefix(sequencedSendKey(ns, id, 0)[:len(sendKey(ns, id))+1], func(key string, p Packet) bool {
+		pkt = p
+		return false
+	})
+	return pkt, pkt != nil
+}
+
+func TestClient_QueuedPublishCrash(t *testing.T) {
+	persist := NewMemPersist(nil)
+	queueNS, ns := queueNamespace("cid"), persistNamespace("cid", "fake")
+
+	// published but never sent to any server before crashed
+	c1, err := NewClient(WithPersist(persist), WithClientID("cid"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1.Publish(&PublishPacket{TopicName: "/foo", Qos: Qos1, Payload: []byte("queued")})
+	c1.Destroy(true)
+
+	pkt, ok := loadSentPacket(persist, queueNS, 1)
+	if !assert.True(t, ok, "queued publish not persisted") {
+		return
+	}
+	assert.Equal(t, "/foo", pkt.(*PublishPacket).TopicName)
+
+	received := make(chan Packet, 10)
+	c2, err := NewClient(
+		WithPersist(persist),
+		WithClientID("cid"),
+		WithDialTimeout(10),
+		WithKeepalive(10, 1.2),
+		WithCustomConnector(fakeConnector(fakeBrokerConfig{present: true, received: received})),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Destroy(true)
+
+	if err := c2.ConnectServer("fake"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case pkt := <-received:
+		if assert.IsType(t, &PublishPacket{}, pkt) {
+			p := pkt.(*PublishPacket)
+			assert.Equal(t, "queued", string(p.Payload))
+			assert.Equal(t, uint16(1), p.PacketID)
+			assert.False(t, p.IsDup, "never sent before")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("queued publish not replayed")
+	}
+
+	// moved to the namespace of the server
+	_, ok = loadSentPacket(persist, ns, 1)
+	assert.True(t, ok)
+	_, ok = loadSentPacket(persist, queueNS, 1)
+	assert.False(t, ok)
+}
+
+func TestMemPersist_Copy(t *testing.T) {
+	p := NewMemPersist(nil)
+	pkt := &PublishPacket{TopicName: "/foo", Qos: Qos1, PacketID: 1, Payload: []byte("foo")}
+	if err := p.Store("foo", pkt); err != nil {
+		t.Error(err)
+	}
+
+	pkt.Payload[0], pkt.TopicName = 'b', "/bar"
+	stored, ok := p.Load("foo")
+	if !ok {
+		t.Error("packet not stored")
+		return
+	}
+
+	if s := stored.(*PublishPacket); s == pkt || s.TopicName != "/foo" || string(s.Payload) != "foo" {
+		t.Error("stored packet modified by the caller =", s)
+	}
+}
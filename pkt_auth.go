@@ -16,8 +16,6 @@
 
 package libmqtt
 
-import "bytes"
-
 // AuthPacket Client <-> Server
 // as part of an extended authentication exchange,
 // such as challenge / response authentication.
@@ -37,13 +35,8 @@ func (a *AuthPacket) Type() CtrlType {
 }
 
 func (a *AuthPacket) Bytes() []byte {
-	if a == nil {
-		return nil
-	}
-
-	w := new(bytes.Buffer)
-	_ = a.WriteTo(w)
-	return w.Bytes()
+	b, _ := a.MarshalBinary()
+	return b
 }
 
 func (a *AuthPacket) WriteTo(w BufferedWriter) error {
@@ -51,7 +44,11 @@ func (a *AuthPacket) WriteTo(w BufferedWriter) error {
 		return ErrEncodeBadPacket
 	}
 
-	return a.writeV5(w, CtrlAuth<<4, []byte{a.Code}, a.Props.props(), nil)
+	props, err := a.Props.props()
+	if err != nil {
+		return err
+	}
+	return a.writeV5Reason(w, CtrlAuth<<4, a.Code, props)
 }
 
 // AuthProps properties of AuthPacket
@@ -62,9 +59,9 @@ type AuthProps struct {
 	UserProps  UserProps
 }
 
-func (a *AuthProps) props() []byte {
+func (a *AuthProps) props() ([]byte, error) {
 	if a == nil {
-		return nil
+		return nil, nil
 	}
 
 	p := propertySet{}
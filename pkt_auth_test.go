@@ -61,7 +61,9 @@ func TestAuthPacket_Bytes(t *testing.T) {
 
 func TestAuthProps_Props(t *testing.T) {
 	t.Skip("v5")
-	assert.Equal(t, testAuthPropsBytes, testAuthMsg.Props.props())
+	props, err := testAuthMsg.Props.props()
+	assert.NoError(t, err)
+	assert.Equal(t, testAuthPropsBytes, props)
 }
 
 func TestAuthProps_SetProps(t *testing.T) {
@@ -82,18 +84,12 @@ func TestAuthProps_SetProps(t *testing.T) {
 		t.Error("auth reason set failed")
 	}
 
-	for k, v := range emptyProps.UserProps {
-		if tv, ok := testAuthMsg.Props.UserProps[k]; ok {
-			if len(v) == len(tv) {
-				for i := range v {
-					if v[i] != tv[i] {
-						t.Error("auth user props set failed")
-					}
-				}
-				continue
-			} else {
-				t.Error("auth user props length not equal")
-			}
+	if len(emptyProps.UserProps) != len(testAuthMsg.Props.UserProps) {
+		t.Error("auth user props length not equal")
+	}
+	for i, p := range emptyProps.UserProps {
+		if i < len(testAuthMsg.Props.UserProps) && p != testAuthMsg.Props.UserProps[i] {
+			t.Error("auth user props set failed")
 		}
 	}
 }
@@ -0,0 +1,342 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"bytes"
+	"io"
+)
+
+// packets implement encoding.BinaryMarshaler and encoding.BinaryUnmarshaler
+// with the MQTT wire format of the protocol version set (see SetVersion)
+
+// DecodePacket decodes exactly one packet from r, no byte after the packet
+// is read from r if r is not a BufferedReader, the decoded packet has the
+// protocol version (ConnPacket has the version in its protocol level)
+func DecodePacket(version ProtoVersion, r io.Reader) (Packet, error) {
+	br, ok := r.(BufferedReader)
+	if !ok {
+		br = &byteReader{Reader: r}
+	}
+	return Decode(version, br)
+}
+
+// byteReader reads bytes one by one from the reader without read ahead
+type byteReader struct {
+	io.Reader
+	b [1]byte
+}
+
+func (r *byteReader) ReadByte() (byte, error) {
+	if _, err := io.ReadFull(r.Reader, r.b[:]); err != nil {
+		return 0, err
+	}
+	return r.b[0], nil
+}
+
+// marshalPacket encodes the packet with its protocol version
+func marshalPacket(p Packet) ([]byte, error) {
+	w := new(bytes.Buffer)
+	if err := p.WriteTo(w); err != nil {
+		return nil, err
+	}
+	return w.Bytes(), nil
+}
+
+// unmarshalPacket decodes the only packet in data, ErrDecodeBadPacket is
+// returned if data is not one packet of the control type
+func unmarshalPacket(version ProtoVersion, t CtrlType, data []byte) (Packet, error) {
+	r := bytes.NewReader(data)
+	pkt, err := Decode(version, r)
+	if err != nil {
+		return nil, err
+	}
+
+	if pkt.Type() != t || r.Len() > 0 {
+		return nil, ErrDecodeBadPacket
+	}
+	return pkt, nil
+}
+
+// MarshalBinary encodes the ConnPacket
+func (c *ConnPacket) MarshalBinary() ([]byte, error) {
+	return marshalPacket(c)
+}
+
+// UnmarshalBinary decodes the ConnPacket, the protocol version is set as
+// the protocol level decoded
+func (c *ConnPacket) UnmarshalBinary(data []byte) error {
+	pkt, err := unmarshalPacket(c.Version(), CtrlConn, data)
+	if err != nil {
+		return err
+	}
+
+	p := pkt.(*ConnPacket)
+	*c = ConnPacket{
+		BasePacket:   BasePacket{ProtoVersion: p.Version()},
+		ProtoName:    p.ProtoName,
+		CleanSession: p.CleanSession,
+		IsWill:       p.IsWill,
+		WillQos:      p.WillQos,
+		WillRetain:   p.WillRetain,
+		WillProps:    p.WillProps,
+		Props:        p.Props,
+		Username:     p.Username,
+		Password:     p.Password,
+		ClientID:     p.ClientID,
+		Keepalive:    p.Keepalive,
+		WillTopic:    p.WillTopic,
+		WillMessage:  p.WillMessage,
+	}
+	return nil
+}
+
+// MarshalBinary encodes the ConnAckPacket
+func (c *ConnAckPacket) MarshalBinary() ([]byte, error) {
+	return marshalPacket(c)
+}
+
+// UnmarshalBinary decodes the ConnAckPacket
+func (c *ConnAckPacket) UnmarshalBinary(data []byte) error {
+	pkt, err := unmarshalPacket(c.Version(), CtrlConnAck, data)
+	if err != nil {
+		return err
+	}
+
+	p := pkt.(*ConnAckPacket)
+	*c = ConnAckPacket{BasePacket: BasePacket{ProtoVersion: p.Version()}, Present: p.Present, Code: p.Code, Props: p.Props}
+	return nil
+}
+
+// MarshalBinary encodes the DisconnPacket
+func (d *DisconnPacket) MarshalBinary() ([]byte, error) {
+	return marshalPacket(d)
+}
+
+// UnmarshalBinary decodes the DisconnPacket
+func (d *DisconnPacket) UnmarshalBinary(data []byte) error {
+	pkt, err := unmarshalPacket(d.Version(), CtrlDisConn, data)
+	if err != nil {
+		return err
+	}
+
+	p := pkt.(*DisconnPacket)
+	*d = DisconnPacket{BasePacket: BasePacket{ProtoVersion: p.Version()}, Code: p.Code, Props: p.Props}
+	return nil
+}
+
+// MarshalBinary encodes the AuthPacket
+func (a *AuthPacket) MarshalBinary() ([]byte, error) {
+	return marshalPacket(a)
+}
+
+// UnmarshalBinary decodes the AuthPacket
+func (a *AuthPacket) UnmarshalBinary(data []byte) error {
+	pkt, err := unmarshalPacket(a.Version(), CtrlAuth, data)
+	if err != nil {
+		return err
+	}
+
+	p := pkt.(*AuthPacket)
+	*a = AuthPacket{BasePacket: BasePacket{ProtoVersion: p.Version()}, Code: p.Code, Props: p.Props}
+	return nil
+}
+
+// MarshalBinary encodes the pingReqPacket
+func (p *pingReqPacket) MarshalBinary() ([]byte, error) {
+	return marshalPacket(p)
+}
+
+// UnmarshalBinary decodes the pingReqPacket
+func (p *pingReqPacket) UnmarshalBinary(data []byte) error {
+	_, err := unmarshalPacket(p.Version(), CtrlPingReq, data)
+	return err
+}
+
+// MarshalBinary encodes the pingRespPacket
+func (p *pingRespPacket) MarshalBinary() ([]byte, error) {
+	return marshalPacket(p)
+}
+
+// UnmarshalBinary decodes the pingRespPacket
+func (p *pingRespPacket) UnmarshalBinary(data []byte) error {
+	_, err := unmarshalPacket(p.Version(), CtrlPingResp, data)
+	return err
+}
+
+// MarshalBinary encodes the PublishPacket, the PayloadReader is read if
+// set (see WriteTo)
+func (p *PublishPacket) MarshalBinary() ([]byte, error) {
+	return marshalPacket(p)
+}
+
+// UnmarshalBinary decodes the PublishPacket
+func (p *PublishPacket) UnmarshalBinary(data []byte) error {
+	pkt, err := unmarshalPacket(p.Version(), CtrlPublish, data)
+	if err != nil {
+		return err
+	}
+
+	d := pkt.(*PublishPacket)
+	*p = PublishPacket{
+		BasePacket: BasePacket{ProtoVersion: d.Version()},
+		IsDup:      d.IsDup,
+		Qos:        d.Qos,
+		IsRetain:   d.IsRetain,
+		TopicName:  d.TopicName,
+		Payload:    d.Payload,
+		PacketID:   d.PacketID,
+		Props:      d.Props,
+	}
+	return nil
+}
+
+// MarshalBinary encodes the PubAckPacket
+func (p *PubAckPacket) MarshalBinary() ([]byte, error) {
+	return marshalPacket(p)
+}
+
+// UnmarshalBinary decodes the PubAckPacket
+func (p *PubAckPacket) UnmarshalBinary(data []byte) error {
+	pkt, err := unmarshalPacket(p.Version(), CtrlPubAck, data)
+	if err != nil {
+		return err
+	}
+
+	d := pkt.(*PubAckPacket)
+	*p = PubAckPacket{BasePacket: BasePacket{ProtoVersion: d.Version()}, PacketID: d.PacketID, Code: d.Code, Props: d.Props}
+	return nil
+}
+
+// MarshalBinary encodes the PubRecvPacket
+func (p *PubRecvPacket) MarshalBinary() ([]byte, error) {
+	return marshalPacket(p)
+}
+
+// UnmarshalBinary decodes the PubRecvPacket
+func (p *PubRecvPacket) UnmarshalBinary(data []byte) error {
+	pkt, err := unmarshalPacket(p.Version(), CtrlPubRecv, data)
+	if err != nil {
+		return err
+	}
+
+	d := pkt.(*PubRecvPacket)
+	*p = PubRecvPacket{BasePacket: BasePacket{ProtoVersion: d.Version()}, PacketID: d.PacketID, Code: d.Code, Props: d.Props}
+	return nil
+}
+
+// MarshalBinary encodes the PubRelPacket
+func (p *PubRelPacket) MarshalBinary() ([]byte, error) {
+	return marshalPacket(p)
+}
+
+// UnmarshalBinary decodes the PubRelPacket
+func (p *PubRelPacket) UnmarshalBinary(data []byte) error {
+	pkt, err := unmarshalPacket(p.Version(), CtrlPubRel, data)
+	if err != nil {
+		return err
+	}
+
+	d := pkt.(*PubRelPacket)
+	*p = PubRelPacket{BasePacket: BasePacket{ProtoVersion: d.Version()}, PacketID: d.PacketID, Code: d.Code, Props: d.Props}
+	return nil
+}
+
+// MarshalBinary encodes the PubCompPacket
+func (p *PubCompPacket) MarshalBinary() ([]byte, error) {
+	return marshalPacket(p)
+}
+
+// UnmarshalBinary decodes the PubCompPacket
+func (p *PubCompPacket) UnmarshalBinary(data []byte) error {
+	pkt, err := unmarshalPacket(p.Version(), CtrlPubComp, data)
+	if err != nil {
+		return err
+	}
+
+	d := pkt.(*PubCompPacket)
+	*p = PubCompPacket{BasePacket: BasePacket{ProtoVersion: d.Version()}, PacketID: d.PacketID, Code: d.Code, Props: d.Props}
+	return nil
+}
+
+// MarshalBinary encodes the SubscribePacket
+func (s *SubscribePacket) MarshalBinary() ([]byte, error) {
+	return marshalPacket(s)
+}
+
+// UnmarshalBinary decodes the SubscribePacket
+func (s *SubscribePacket) UnmarshalBinary(data []byte) error {
+	pkt, err := unmarshalPacket(s.Version(), CtrlSubscribe, data)
+	if err != nil {
+		return err
+	}
+
+	d := pkt.(*SubscribePacket)
+	*s = SubscribePacket{BasePacket: BasePacket{ProtoVersion: d.Version()}, PacketID: d.PacketID, Topics: d.Topics, Props: d.Props}
+	return nil
+}
+
+// MarshalBinary encodes the SubAckPacket
+func (s *SubAckPacket) MarshalBinary() ([]byte, error) {
+	return marshalPacket(s)
+}
+
+// UnmarshalBinary decodes the SubAckPacket
+func (s *SubAckPacket) UnmarshalBinary(data []byte) error {
+	pkt, err := unmarshalPacket(s.Version(), CtrlSubAck, data)
+	if err != nil {
+		return err
+	}
+
+	d := pkt.(*SubAckPacket)
+	*s = SubAckPacket{BasePacket: BasePacket{ProtoVersion: d.Version()}, PacketID: d.PacketID, Codes: d.Codes, Props: d.Props}
+	return nil
+}
+
+// MarshalBinary encodes the UnsubPacket
+func (s *UnsubPacket) MarshalBinary() ([]byte, error) {
+	return marshalPacket(s)
+}
+
+// UnmarshalBinary decodes the UnsubPacket
+func (s *UnsubPacket) UnmarshalBinary(data []byte) error {
+	pkt, err := unmarshalPacket(s.Version(), CtrlUnSub, data)
+	if err != nil {
+		return err
+	}
+
+	d := pkt.(*UnsubPacket)
+	*s = UnsubPacket{BasePacket: BasePacket{ProtoVersion: d.Version()}, PacketID: d.PacketID, TopicNames: d.TopicNames, Props: d.Props}
+	return nil
+}
+
+// MarshalBinary encodes the UnsubAckPacket
+func (s *UnsubAckPacket) MarshalBinary() ([]byte, error) {
+	return marshalPacket(s)
+}
+
+// UnmarshalBinary decodes the UnsubAckPacket
+func (s *UnsubAckPacket) UnmarshalBinary(data []byte) error {
+	pkt, err := unmarshalPacket(s.Version(), CtrlUnSubAck, data)
+	if err != nil {
+		return err
+	}
+
+	d := pkt.(*UnsubAckPacket)
+	*s = UnsubAckPacket{BasePacket: BasePacket{ProtoVersion: d.Version()}, PacketID: d.PacketID, Codes: d.Codes, Props: d.Props}
+	return nil
+}
@@ -0,0 +1,126 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestPacket_Binary(t *testing.T) {
+	for _, version := range []ProtoVersion{V31, V311, V5} {
+		for _, c := range []struct {
+			pkt   Packet
+			empty Packet
+		}{
+			{&ConnPacket{ClientID: "foo", Username: "admin", Password: []byte("public"), Keepalive: 10}, &ConnPacket{}},
+			{&ConnAckPacket{Present: true, Props: &ConnAckProps{MaxQos: Qos2}}, &ConnAckPacket{}},
+			{&DisconnPacket{}, &DisconnPacket{}},
+			{&pingReqPacket{}, &pingReqPacket{}},
+			{&pingRespPacket{}, &pingRespPacket{}},
+			{&PublishPacket{TopicName: "foo", Qos: Qos1, PacketID: 1, Payload: []byte("bar")}, &PublishPacket{}},
+			{&PubAckPacket{PacketID: 1}, &PubAckPacket{}},
+			{&PubRecvPacket{PacketID: 1}, &PubRecvPacket{}},
+			{&PubRelPacket{PacketID: 1}, &PubRelPacket{}},
+			{&PubCompPacket{PacketID: 1}, &PubCompPacket{}},
+			{&SubscribePacket{PacketID: 1, Topics: []*Topic{{Name: "foo", Qos: Qos1}}}, &SubscribePacket{}},
+			{&SubAckPacket{PacketID: 1, Codes: []byte{SubOkMaxQos1}}, &SubAckPacket{}},
+			{&UnsubPacket{PacketID: 1, TopicNames: []string{"foo"}}, &UnsubPacket{}},
+			{&UnsubAckPacket{PacketID: 1}, &UnsubAckPacket{}},
+		} {
+			c.pkt.SetVersion(version)
+			c.empty.SetVersion(version)
+
+			data, err := c.pkt.MarshalBinary()
+			if err != nil {
+				t.Errorf("v%d marshal %v failed: %v", version, c.pkt, err)
+				continue
+			}
+
+			if err := c.empty.UnmarshalBinary(data); err != nil {
+				t.Errorf("v%d unmarshal %v failed: %v", version, c.pkt, err)
+				continue
+			}
+
+			if c.empty.Version() != version {
+				t.Errorf("v%d unmarshal %v with version %d", version, c.pkt, c.empty.Version())
+			}
+
+			if again, err := c.empty.MarshalBinary(); err != nil || !bytes.Equal(again, data) {
+				t.Errorf("v%d unmarshal %v got %v", version, c.pkt, c.empty)
+			}
+
+			if err := c.empty.UnmarshalBinary(append(data, 0)); err != ErrDecodeBadPacket {
+				t.Errorf("v%d unmarshal %v with trailing bytes, err = %v", version, c.pkt, err)
+			}
+		}
+	}
+
+	// auth packet is available since MQTT 5
+	auth := &AuthPacket{BasePacket: BasePacket{ProtoVersion: V5}, Code: CodeContinueAuth}
+	data, err := auth.MarshalBinary()
+	decoded := &AuthPacket{BasePacket: BasePacket{ProtoVersion: V5}}
+	if err != nil || decoded.UnmarshalBinary(data) != nil || decoded.Code != CodeContinueAuth {
+		t.Error("auth packet round trip failed, err =", err)
+	}
+
+	// type not match
+	if err := (&PubAckPacket{}).UnmarshalBinary(PingReqPacket.Bytes()); err != ErrDecodeBadPacket {
+		t.Error("unmarshal packet of other type, err =", err)
+	}
+}
+
+func TestPacket_BinaryError(t *testing.T) {
+	pkt := &PublishPacket{TopicName: strings.Repeat("a", maxStringLen+1)}
+	if _, err := pkt.MarshalBinary(); err != ErrStringTooLong {
+		t.Error("marshal packet with long topic, err =", err)
+	}
+	if b := pkt.Bytes(); b != nil {
+		t.Error("bytes of packet can not be encoded should be nil, got", len(b))
+	}
+
+	var nilPkt *ConnPacket
+	if _, err := nilPkt.MarshalBinary(); err != ErrEncodeBadPacket {
+		t.Error("marshal nil packet, err =", err)
+	}
+}
+
+func TestDecodePacket(t *testing.T) {
+	first := &PublishPacket{TopicName: "foo", Payload: []byte("bar")}
+	second := &PubAckPacket{PacketID: 1}
+
+	data := append(first.Bytes(), second.Bytes()...)
+	// reader without ReadByte
+	r := struct{ io.Reader }{bytes.NewReader(data)}
+
+	pkt, err := DecodePacket(V311, r)
+	if err != nil || fmt.Sprint(pkt) != fmt.Sprint(first) {
+		t.Fatal("decode first packet failed, err =", err, "packet =", pkt)
+	}
+
+	pkt, err = DecodePacket(V311, r)
+	if err != nil || fmt.Sprint(pkt) != fmt.Sprint(second) {
+		t.Fatal("decode second packet failed, err =", err, "packet =", pkt)
+	}
+
+	if _, err = DecodePacket(V311, r); err != io.EOF {
+		t.Error("decode with no data, err =", err)
+	}
+}
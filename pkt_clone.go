@@ -0,0 +1,352 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+// cloneBytes copies the byte slice, nil stays nil
+func cloneBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append(make([]byte, 0, len(b)), b...)
+}
+
+// cloneBool copies the optional bool value
+func cloneBool(b *bool) *bool {
+	if b == nil {
+		return nil
+	}
+	v := *b
+	return &v
+}
+
+func (u UserProps) clone() UserProps {
+	if u == nil {
+		return nil
+	}
+	return append(make(UserProps, 0, len(u)), u...)
+}
+
+// Clone returns a deep copy of the ConnPacket
+func (c *ConnPacket) Clone() Packet {
+	return c.clone()
+}
+
+func (w *WillProps) clone() *WillProps {
+	if w == nil {
+		return nil
+	}
+
+	return &WillProps{
+		WillDelayInterval:     w.WillDelayInterval,
+		PayloadFormat:         w.PayloadFormat,
+		MessageExpiryInterval: w.MessageExpiryInterval,
+		ContentType:           w.ContentType,
+		ResponseTopic:         w.ResponseTopic,
+		CorrelationData:       cloneBytes(w.CorrelationData),
+		UserProps:             w.UserProps.clone(),
+	}
+}
+
+// Clone returns a deep copy of the ConnAckPacket
+func (c *ConnAckPacket) Clone() Packet {
+	return &ConnAckPacket{
+		BasePacket: BasePacket{ProtoVersion: c.Version()},
+		Present:    c.Present,
+		Code:       c.Code,
+		Props:      c.Props.clone(),
+	}
+}
+
+func (c *ConnAckProps) clone() *ConnAckProps {
+	if c == nil {
+		return nil
+	}
+
+	return &ConnAckProps{
+		SessionExpiryInterval: c.SessionExpiryInterval,
+		MaxRecv:               c.MaxRecv,
+		MaxQos:                c.MaxQos,
+		RetainAvail:           cloneBool(c.RetainAvail),
+		MaxPacketSize:         c.MaxPacketSize,
+		AssignedClientID:      c.AssignedClientID,
+		MaxTopicAlias:         c.MaxTopicAlias,
+		Reason:                c.Reason,
+		UserProps:             c.UserProps.clone(),
+		WildcardSubAvail:      cloneBool(c.WildcardSubAvail),
+		SubIDAvail:            cloneBool(c.SubIDAvail),
+		SharedSubAvail:        cloneBool(c.SharedSubAvail),
+		ServerKeepalive:       c.ServerKeepalive,
+		RespInfo:              c.RespInfo,
+		ServerRef:             c.ServerRef,
+		AuthMethod:            c.AuthMethod,
+		AuthData:              cloneBytes(c.AuthData),
+	}
+}
+
+// Clone returns a deep copy of the DisconnPacket
+func (d *DisconnPacket) Clone() Packet {
+	return &DisconnPacket{
+		BasePacket: BasePacket{ProtoVersion: d.Version()},
+		Code:       d.Code,
+		Props:      d.Props.clone(),
+	}
+}
+
+func (d *DisconnProps) clone() *DisconnProps {
+	if d == nil {
+		return nil
+	}
+
+	return &DisconnProps{
+		SessionExpiryInterval: d.SessionExpiryInterval,
+		Reason:                d.Reason,
+		UserProps:             d.UserProps.clone(),
+		ServerRef:             d.ServerRef,
+	}
+}
+
+// Clone returns a deep copy of the AuthPacket
+func (a *AuthPacket) Clone() Packet {
+	return &AuthPacket{
+		BasePacket: BasePacket{ProtoVersion: a.Version()},
+		Code:       a.Code,
+		Props:      a.Props.clone(),
+	}
+}
+
+func (a *AuthProps) clone() *AuthProps {
+	if a == nil {
+		return nil
+	}
+
+	return &AuthProps{
+		AuthMethod: a.AuthMethod,
+		AuthData:   cloneBytes(a.AuthData),
+		Reason:     a.Reason,
+		UserProps:  a.UserProps.clone(),
+	}
+}
+
+// Clone returns a copy of the pingReqPacket
+func (p *pingReqPacket) Clone() Packet {
+	return &pingReqPacket{BasePacket: BasePacket{ProtoVersion: p.Version()}}
+}
+
+// Clone returns a copy of the pingRespPacket
+func (p *pingRespPacket) Clone() Packet {
+	return &pingRespPacket{BasePacket: BasePacket{ProtoVersion: p.Version()}}
+}
+
+// Clone returns a deep copy of the PublishPacket, the PayloadReader (if
+// set) is shared with the clone since a reader can not be copied
+//
+// the clone is never pooled nor acked manually (see Copy for received
+// packets)
+func (p *PublishPacket) Clone() Packet {
+	return &PublishPacket{
+		BasePacket:    BasePacket{ProtoVersion: p.Version()},
+		IsDup:         p.IsDup,
+		Qos:           p.Qos,
+		IsRetain:      p.IsRetain,
+		TopicName:     p.TopicName,
+		Payload:       cloneBytes(p.Payload),
+		PacketID:      p.PacketID,
+		Props:         p.Props.clone(),
+		PayloadReader: p.PayloadReader,
+		PayloadLength: p.PayloadLength,
+
+		InvalidPayloadFormat: p.InvalidPayloadFormat,
+
+		deadline: p.deadline,
+		ctx:      p.ctx,
+		server:   p.server,
+		recvAt:   p.recvAt,
+	}
+}
+
+func (p *PublishProps) clone() *PublishProps {
+	if p == nil {
+		return nil
+	}
+
+	var subIDs []int
+	if p.SubIDs != nil {
+		subIDs = append(make([]int, 0, len(p.SubIDs)), p.SubIDs...)
+	}
+
+	return &PublishProps{
+		PayloadFormat:         p.PayloadFormat,
+		MessageExpiryInterval: p.MessageExpiryInterval,
+		TopicAlias:            p.TopicAlias,
+		RespTopic:             p.RespTopic,
+		CorrelationData:       cloneBytes(p.CorrelationData),
+		UserProps:             p.UserProps.clone(),
+		SubIDs:                subIDs,
+		ContentType:           p.ContentType,
+	}
+}
+
+// Clone returns a deep copy of the PubAckPacket
+func (p *PubAckPacket) Clone() Packet {
+	return &PubAckPacket{
+		BasePacket: BasePacket{ProtoVersion: p.Version()},
+		PacketID:   p.PacketID,
+		Code:       p.Code,
+		Props:      p.Props.clone(),
+	}
+}
+
+func (p *PubAckProps) clone() *PubAckProps {
+	if p == nil {
+		return nil
+	}
+	return &PubAckProps{Reason: p.Reason, UserProps: p.UserProps.clone()}
+}
+
+// Clone returns a deep copy of the PubRecvPacket
+func (p *PubRecvPacket) Clone() Packet {
+	return &PubRecvPacket{
+		BasePacket: BasePacket{ProtoVersion: p.Version()},
+		PacketID:   p.PacketID,
+		Code:       p.Code,
+		Props:      p.Props.clone(),
+	}
+}
+
+func (p *PubRecvProps) clone() *PubRecvProps {
+	if p == nil {
+		return nil
+	}
+	return &PubRecvProps{Reason: p.Reason, UserProps: p.UserProps.clone()}
+}
+
+// Clone returns a deep copy of the PubRelPacket
+func (p *PubRelPacket) Clone() Packet {
+	return &PubRelPacket{
+		BasePacket: BasePacket{ProtoVersion: p.Version()},
+		PacketID:   p.PacketID,
+		Code:       p.Code,
+		Props:      p.Props.clone(),
+	}
+}
+
+func (p *PubRelProps) clone() *PubRelProps {
+	if p == nil {
+		return nil
+	}
+	return &PubRelProps{Reason: p.Reason, UserProps: p.UserProps.clone()}
+}
+
+// Clone returns a deep copy of the PubCompPacket
+func (p *PubCompPacket) Clone() Packet {
+	return &PubCompPacket{
+		BasePacket: BasePacket{ProtoVersion: p.Version()},
+		PacketID:   p.PacketID,
+		Code:       p.Code,
+		Props:      p.Props.clone(),
+	}
+}
+
+func (p *PubCompProps) clone() *PubCompProps {
+	if p == nil {
+		return nil
+	}
+	return &PubCompProps{Reason: p.Reason, UserProps: p.UserProps.clone()}
+}
+
+// Clone returns a deep copy of the SubscribePacket, topics are copied
+func (s *SubscribePacket) Clone() Packet {
+	var topics []*Topic
+	if s.Topics != nil {
+		topics = make([]*Topic, len(s.Topics))
+		for i, t := range s.Topics {
+			if t != nil {
+				topics[i] = &Topic{Name: t.Name, Qos: t.Qos}
+			}
+		}
+	}
+
+	return &SubscribePacket{
+		BasePacket: BasePacket{ProtoVersion: s.Version()},
+		PacketID:   s.PacketID,
+		Topics:     topics,
+		Props:      s.Props.clone(),
+	}
+}
+
+func (s *SubscribeProps) clone() *SubscribeProps {
+	if s == nil {
+		return nil
+	}
+	return &SubscribeProps{SubID: s.SubID, UserProps: s.UserProps.clone()}
+}
+
+// Clone returns a deep copy of the SubAckPacket
+func (s *SubAckPacket) Clone() Packet {
+	return &SubAckPacket{
+		BasePacket: BasePacket{ProtoVersion: s.Version()},
+		PacketID:   s.PacketID,
+		Codes:      cloneBytes(s.Codes),
+		Props:      s.Props.clone(),
+	}
+}
+
+func (s *SubAckProps) clone() *SubAckProps {
+	if s == nil {
+		return nil
+	}
+	return &SubAckProps{Reason: s.Reason, UserProps: s.UserProps.clone()}
+}
+
+// Clone returns a deep copy of the UnsubPacket
+func (s *UnsubPacket) Clone() Packet {
+	var names []string
+	if s.TopicNames != nil {
+		names = append(make([]string, 0, len(s.TopicNames)), s.TopicNames...)
+	}
+
+	return &UnsubPacket{
+		BasePacket: BasePacket{ProtoVersion: s.Version()},
+		PacketID:   s.PacketID,
+		TopicNames: names,
+		Props:      s.Props.clone(),
+	}
+}
+
+func (s *UnsubProps) clone() *UnsubProps {
+	if s == nil {
+		return nil
+	}
+	return &UnsubProps{UserProps: s.UserProps.clone()}
+}
+
+// Clone returns a deep copy of the UnsubAckPacket
+func (s *UnsubAckPacket) Clone() Packet {
+	return &UnsubAckPacket{
+		BasePacket: BasePacket{ProtoVersion: s.Version()},
+		PacketID:   s.PacketID,
+		Codes:      cloneBytes(s.Codes),
+		Props:      s.Props.clone(),
+	}
+}
+
+func (s *UnsubAckProps) clone() *UnsubAckProps {
+	if s == nil {
+		return nil
+	}
+	return &UnsubAckProps{Reason: s.Reason, UserProps: s.UserProps.clone()}
+}
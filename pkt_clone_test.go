@@ -0,0 +1,102 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"reflect"
+	"testing"
+)
+
+// fillPacket sets every exported field reachable from v to a value derived
+// from seed, existing pointers and slice elements are written in place
+func fillPacket(v reflect.Value, seed int) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		fillPacket(v.Elem(), seed)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Field(i).CanSet() {
+				fillPacket(v.Field(i), seed)
+			}
+		}
+	case reflect.Slice:
+		if v.Len() == 0 {
+			v.Set(reflect.MakeSlice(v.Type(), 2, 2))
+		}
+		for i := 0; i < v.Len(); i++ {
+			fillPacket(v.Index(i), seed)
+		}
+	case reflect.Bool:
+		v.SetBool(seed%2 == 1)
+	case reflect.String:
+		v.SetString(string(rune('a' + seed)))
+	case reflect.Int, reflect.Int64:
+		v.SetInt(int64(seed))
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		v.SetUint(uint64(seed))
+	}
+}
+
+func TestPacket_Clone(t *testing.T) {
+	for _, newPkt := range []func() Packet{
+		func() Packet { return &ConnPacket{} },
+		func() Packet { return &ConnAckPacket{} },
+		func() Packet { return &DisconnPacket{} },
+		func() Packet { return &AuthPacket{} },
+		func() Packet { return &pingReqPacket{} },
+		func() Packet { return &pingRespPacket{} },
+		func() Packet { return &PublishPacket{} },
+		func() Packet { return &PubAckPacket{} },
+		func() Packet { return &PubRecvPacket{} },
+		func() Packet { return &PubRelPacket{} },
+		func() Packet { return &PubCompPacket{} },
+		func() Packet { return &SubscribePacket{} },
+		func() Packet { return &SubAckPacket{} },
+		func() Packet { return &UnsubPacket{} },
+		func() Packet { return &UnsubAckPacket{} },
+	} {
+		origin, expected := newPkt(), newPkt()
+		fillPacket(reflect.ValueOf(origin), 1)
+		fillPacket(reflect.ValueOf(expected), 1)
+
+		cloned := origin.Clone()
+		if !reflect.DeepEqual(cloned, expected) {
+			t.Errorf("clone of %T not equal\n%+v\n%+v", origin, cloned, expected)
+			continue
+		}
+
+		fillPacket(reflect.ValueOf(cloned), 2)
+		if !reflect.DeepEqual(origin, expected) {
+			t.Errorf("%T modified by its clone\n%+v\n%+v", origin, origin, expected)
+		}
+	}
+}
+
+func TestPacket_CloneNil(t *testing.T) {
+	cloned := (&PublishPacket{TopicName: "/foo"}).Clone().(*PublishPacket)
+	if cloned.Payload != nil || cloned.Props != nil {
+		t.Error("nil fields not kept nil =", cloned)
+	}
+
+	sub := (&SubscribePacket{Topics: []*Topic{nil}}).Clone().(*SubscribePacket)
+	if len(sub.Topics) != 1 || sub.Topics[0] != nil {
+		t.Error("nil topic not kept =", sub.Topics)
+	}
+}
@@ -47,9 +47,9 @@ type WillProps struct {
 	UserProps UserProps
 }
 
-func (p *WillProps) props() []byte {
+func (p *WillProps) props() ([]byte, error) {
 	if p == nil {
-		return nil
+		return nil, nil
 	}
 
 	propSet := propertySet{}
@@ -63,6 +63,40 @@ func (p *WillProps) props() []byte {
 	return propSet.bytes()
 }
 
+func (p *WillProps) setProps(props map[byte][]byte) {
+	if p == nil || props == nil {
+		return
+	}
+
+	if v, ok := props[propKeyWillDelayInterval]; ok {
+		p.WillDelayInterval = getUint32(v)
+	}
+
+	if v, ok := props[propKeyPayloadFormatIndicator]; ok && len(v) == 1 {
+		p.PayloadFormat = v[0]
+	}
+
+	if v, ok := props[propKeyMessageExpiryInterval]; ok {
+		p.MessageExpiryInterval = getUint32(v)
+	}
+
+	if v, ok := props[propKeyContentType]; ok {
+		p.ContentType, _, _ = getStringData(v)
+	}
+
+	if v, ok := props[propKeyRespTopic]; ok {
+		p.ResponseTopic, _, _ = getStringData(v)
+	}
+
+	if v, ok := props[propKeyCorrelationData]; ok {
+		p.CorrelationData, _, _ = getBinaryData(v)
+	}
+
+	if v, ok := props[propKeyUserProps]; ok {
+		p.UserProps = getUserProps(v)
+	}
+}
+
 // ConnPacket is the first packet sent by Client to Server
 type ConnPacket struct {
 	BasePacket
@@ -81,7 +115,7 @@ type ConnPacket struct {
 
 	// Payloads
 	Username    string
-	Password    string
+	Password    []byte
 	ClientID    string
 	Keepalive   uint16
 	WillTopic   string
@@ -96,13 +130,8 @@ func (c *ConnPacket) Type() CtrlType {
 }
 
 func (c *ConnPacket) Bytes() []byte {
-	if c == nil {
-		return nil
-	}
-
-	w := new(bytes.Buffer)
-	_ = c.WriteTo(w)
-	return w.Bytes()
+	b, _ := c.MarshalBinary()
+	return b
 }
 
 func (c *ConnPacket) WriteTo(w BufferedWriter) error {
@@ -113,11 +142,28 @@ func (c *ConnPacket) WriteTo(w BufferedWriter) error {
 	const first = CtrlConn << 4
 	varHeader := []byte{0x0, 0x4, 'M', 'Q', 'T', 'T', byte(V311), c.flags(), byte(c.Keepalive >> 8), byte(c.Keepalive)}
 	switch c.Version() {
+	case V31:
+		// protocol name "MQIsdp" and protocol level 3
+		varHeader = append([]byte{0x0, 0x6, 'M', 'Q', 'I', 's', 'd', 'p', byte(V31)}, varHeader[7:]...)
+		fallthrough
 	case V311:
-		return c.write(w, first, varHeader, c.payload())
+		payload, err := c.payload()
+		if err != nil {
+			return err
+		}
+		return c.write(w, first, varHeader, payload)
 	case V5:
 		varHeader[6] = byte(V5)
-		return c.writeV5(w, first, varHeader, c.Props.props(), c.payload())
+		props, err := c.Props.props()
+		if err != nil {
+			return err
+		}
+
+		payload, err := c.payload()
+		if err != nil {
+			return err
+		}
+		return c.writeV5(w, first, varHeader, props, payload)
 	default:
 		return ErrUnsupportedVersion
 	}
@@ -139,8 +185,9 @@ func (c *ConnPacket) clone() *ConnPacket {
 		IsWill:       c.IsWill,
 		WillQos:      c.WillQos,
 		WillRetain:   c.WillRetain,
+		WillProps:    c.WillProps.clone(),
 		Username:     c.Username,
-		Password:     c.Password,
+		Password:     cloneBytes(c.Password),
 		ClientID:     c.ClientID,
 		Keepalive:    c.Keepalive,
 		WillTopic:    c.WillTopic,
@@ -168,7 +215,7 @@ func (c *ConnPacket) flags() byte {
 		}
 	}
 
-	if c.Password != "" {
+	if len(c.Password) > 0 {
 		flag |= 0x40
 	}
 
@@ -179,9 +226,12 @@ func (c *ConnPacket) flags() byte {
 	return flag
 }
 
-func (c *ConnPacket) payload() []byte {
+func (c *ConnPacket) payload() ([]byte, error) {
 	// client id
-	result := encodeStringWithLen(c.ClientID)
+	result, err := encodeStringWithLen(c.ClientID)
+	if err != nil {
+		return nil, err
+	}
 
 	if c.IsWill {
 		// will properties
@@ -189,28 +239,47 @@ func (c *ConnPacket) payload() []byte {
 			if c.WillProps == nil {
 				result = append(result, 0)
 			} else {
+				willProps, err := c.WillProps.props()
+				if err != nil {
+					return nil, err
+				}
+
 				buf := new(bytes.Buffer)
-				willProps := c.WillProps.props()
-				_ = writeVarInt(len(willProps), buf)
+				if err := writeVarInt(len(willProps), buf); err != nil {
+					return nil, err
+				}
 				result = append(result, buf.Bytes()...)
-				result = append(willProps)
+				result = append(result, willProps...)
 			}
 		}
 
 		// will topic and message
-		result = append(result, encodeStringWithLen(c.WillTopic)...)
-		result = append(result, encodeBytesWithLen(c.WillMessage)...)
+		if result, err = appendStringWithLen(result, c.WillTopic); err != nil {
+			return nil, err
+		}
+
+		willMessage, err := encodeBytesWithLen(c.WillMessage)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, willMessage...)
 	}
 
 	if c.Username != "" {
-		result = append(result, encodeStringWithLen(c.Username)...)
+		if result, err = appendStringWithLen(result, c.Username); err != nil {
+			return nil, err
+		}
 	}
 
-	if c.Password != "" {
-		result = append(result, encodeStringWithLen(c.Password)...)
+	if len(c.Password) > 0 {
+		password, err := encodeBytesWithLen(c.Password)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, password...)
 	}
 
-	return result
+	return result, nil
 }
 
 // ConnProps defines connect packet properties
@@ -266,9 +335,9 @@ type ConnProps struct {
 	mu sync.RWMutex
 }
 
-func (c *ConnProps) props() []byte {
+func (c *ConnProps) props() ([]byte, error) {
 	if c == nil {
-		return nil
+		return nil, nil
 	}
 
 	p := propertySet{}
@@ -284,22 +353,24 @@ func (c *ConnProps) props() []byte {
 	return p.bytes()
 }
 
+// hasAuth returns whether the authentication method or data is set
+func (c *ConnProps) hasAuth() bool {
+	return c != nil && (c.AuthMethod != "" || len(c.AuthData) > 0)
+}
+
 func (c *ConnProps) clone() *ConnProps {
 	if c == nil {
 		return nil
 	}
-	c.mu.RUnlock()
+	c.mu.RLock()
 	defer c.mu.RUnlock()
 
 	authDataCopy := make([]byte, len(c.AuthData))
 	_ = copy(authDataCopy, c.AuthData)
 
-	userPropsCopy := make(UserProps)
-	for k, v := range c.UserProps {
-		userPropsCopy[k] = make([]string, 0)
-		for _, val := range v {
-			userPropsCopy[k] = append(userPropsCopy[k], val)
-		}
+	var userPropsCopy UserProps
+	if c.UserProps != nil {
+		userPropsCopy = append(make(UserProps, 0, len(c.UserProps)), c.UserProps...)
 	}
 
 	return &ConnProps{
@@ -307,9 +378,9 @@ func (c *ConnProps) clone() *ConnProps {
 		MaxRecv:               c.MaxRecv,
 		MaxPacketSize:         c.MaxPacketSize,
 		MaxTopicAlias:         c.MaxTopicAlias,
-		ReqRespInfo:           c.ReqRespInfo,
-		ReqProblemInfo:        c.ReqProblemInfo,
-		UserProps:             c.UserProps,
+		ReqRespInfo:           cloneBool(c.ReqRespInfo),
+		ReqProblemInfo:        cloneBool(c.ReqProblemInfo),
+		UserProps:             userPropsCopy,
 		AuthMethod:            c.AuthMethod,
 		AuthData:              authDataCopy,
 	}
@@ -376,13 +447,8 @@ func (c *ConnAckPacket) Type() CtrlType {
 }
 
 func (c *ConnAckPacket) Bytes() []byte {
-	if c == nil {
-		return nil
-	}
-
-	w := new(bytes.Buffer)
-	_ = c.WriteTo(w)
-	return w.Bytes()
+	b, _ := c.MarshalBinary()
+	return b
 }
 
 func (c *ConnAckPacket) WriteTo(w BufferedWriter) error {
@@ -391,11 +457,15 @@ func (c *ConnAckPacket) WriteTo(w BufferedWriter) error {
 	}
 
 	switch c.Version() {
-	case V311:
+	case V31, V311:
 		_, err := w.Write([]byte{CtrlConnAck << 4, 2, boolToByte(c.Present), c.Code})
 		return err
 	case V5:
-		return c.writeV5(w, CtrlConnAck<<4, []byte{boolToByte(c.Present), c.Code}, c.Props.props(), nil)
+		props, err := c.Props.props()
+		if err != nil {
+			return err
+		}
+		return c.writeV5(w, CtrlConnAck<<4, []byte{boolToByte(c.Present), c.Code}, props, nil)
 	default:
 		return ErrUnsupportedVersion
 	}
@@ -415,6 +485,7 @@ type ConnAckProps struct {
 	// the Client might try to send
 	MaxRecv uint16
 
+	// MaxQos the maximum QoS the Server supports, Qos2 if not declared
 	MaxQos QosLevel
 
 	// Declares whether the Server supports retained messages.
@@ -482,9 +553,9 @@ type ConnAckProps struct {
 	AuthData []byte
 }
 
-func (c *ConnAckProps) props() []byte {
+func (c *ConnAckProps) props() ([]byte, error) {
 	if c == nil {
-		return nil
+		return nil, nil
 	}
 
 	p := propertySet{}
@@ -517,6 +588,7 @@ func (c *ConnAckProps) setProps(props map[byte][]byte) {
 		c.MaxRecv = getUint16(v)
 	}
 
+	c.MaxQos = Qos2
 	if v, ok := props[propKeyMaxQos]; ok && len(v) == 1 {
 		c.MaxQos = v[0]
 	}
@@ -588,13 +660,8 @@ func (d *DisconnPacket) Type() CtrlType {
 }
 
 func (d *DisconnPacket) Bytes() []byte {
-	if d == nil {
-		return nil
-	}
-
-	w := new(bytes.Buffer)
-	_ = d.WriteTo(w)
-	return w.Bytes()
+	b, _ := d.MarshalBinary()
+	return b
 }
 
 func (d *DisconnPacket) WriteTo(w BufferedWriter) error {
@@ -607,11 +674,15 @@ func (d *DisconnPacket) WriteTo(w BufferedWriter) error {
 	)
 
 	switch d.Version() {
-	case V311:
+	case V31, V311:
 		_, err = w.Write([]byte{CtrlDisConn << 4, 0})
 		return err
 	case V5:
-		return d.writeV5(w, CtrlDisConn<<4, nil, d.Props.props(), nil)
+		props, err := d.Props.props()
+		if err != nil {
+			return err
+		}
+		return d.writeV5Reason(w, CtrlDisConn<<4, d.Code, props)
 	default:
 		return ErrUnsupportedVersion
 	}
@@ -637,9 +708,16 @@ type DisconnProps struct {
 	ServerRef string
 }
 
-func (d *DisconnProps) props() []byte {
+func (d *DisconnProps) reason() string {
 	if d == nil {
-		return nil
+		return ""
+	}
+	return d.Reason
+}
+
+func (d *DisconnProps) props() ([]byte, error) {
+	if d == nil {
+		return nil, nil
 	}
 
 	p := &propertySet{}
@@ -18,6 +18,7 @@ package libmqtt
 
 import (
 	"bytes"
+	"reflect"
 	"testing"
 
 	std "github.com/eclipse/paho.mqtt.golang/packets"
@@ -48,7 +49,7 @@ var (
 	testConnWillMsg = &ConnPacket{
 		BasePacket:   BasePacket{ProtoVersion: testProtoVersion},
 		Username:     testUsername,
-		Password:     testPassword,
+		Password:     []byte(testPassword),
 		ClientID:     testClientID,
 		CleanSession: testCleanSession,
 		IsWill:       testWill,
@@ -63,7 +64,7 @@ var (
 	testConnMsg = &ConnPacket{
 		BasePacket:   BasePacket{ProtoVersion: testProtoVersion},
 		Username:     testUsername,
-		Password:     testPassword,
+		Password:     []byte(testPassword),
 		ClientID:     testClientID,
 		CleanSession: testCleanSession,
 		Keepalive:    testKeepalive,
@@ -101,7 +102,7 @@ var (
 			SessionExpiryInterval: 100,
 			Reason:                "MQTT",
 			ServerRef:             "MQTT",
-			UserProps:             UserProps{"MQ": []string{"TT"}},
+			UserProps:             UserProps{{Key: "MQ", Value: "TT"}},
 		},
 	}
 	testDisConnPropsBytes = []byte{
@@ -223,3 +224,170 @@ func TestDisConnProps_Props(t *testing.T) {
 func TestDisConnProps_SetProps(t *testing.T) {
 
 }
+
+func TestConnAckError(t *testing.T) {
+	for _, c := range []struct {
+		version ProtoVersion
+		code    byte
+		err     error
+	}{
+		{version: V311, code: CodeSuccess, err: nil},
+		{version: V311, code: CodeUnacceptableVersion, err: ErrConnBadProtocol},
+		{version: V311, code: CodeBadUsernameOrPassword, err: ErrConnBadAuth},
+		{version: V311, code: CodeUnspecifiedError, err: ErrConnUnspecified},
+		{version: V5, code: CodeSuccess, err: nil},
+		{version: V5, code: CodeUnsupportedProtoVersion, err: ErrConnBadProtocol},
+		{version: V5, code: CodeBadUserPass, err: ErrConnBadAuth},
+		{version: V5, code: CodeServerUnavail, err: ErrConnServerUnavailable},
+		{version: V5, code: CodeBanned, err: ErrConnBanned},
+		{version: V5, code: CodeBadUsernameOrPassword, err: ErrConnUnspecified},
+		{version: V5, code: CodeUnacceptableVersion, err: ErrConnBadProtocol},
+		{version: V31, code: CodeIdentifierRejected, err: ErrConnIDRejected},
+	} {
+		if err := ConnAckError(c.version, c.code); err != c.err {
+			t.Error("unexpected error of code =", c.code, "version =", c.version, "err =", err)
+		}
+	}
+
+	if isFatalConnErr(ErrConnServerBusy) || !isFatalConnErr(ErrConnBadAuth) {
+		t.Error("unexpected fatal connect errors")
+	}
+}
+
+func TestConnPacket_WillProps(t *testing.T) {
+	pkt := &ConnPacket{
+		ClientID:    "cid",
+		Username:    "user",
+		Password:    []byte{0, 1, 2},
+		Keepalive:   10,
+		IsWill:      true,
+		WillQos:     Qos1,
+		WillTopic:   "/will",
+		WillMessage: []byte("gone"),
+		WillProps: &WillProps{
+			WillDelayInterval:     30,
+			PayloadFormat:         1,
+			MessageExpiryInterval: 60,
+			ContentType:           "text/plain",
+			ResponseTopic:         "/resp",
+			CorrelationData:       []byte("corr"),
+			UserProps:             UserProps{{Key: "MQ", Value: "TT"}, {Key: "K", Value: "V"}, {Key: "MQ", Value: "T"}},
+		},
+		Props: &ConnProps{},
+	}
+	pkt.SetVersion(V5)
+
+	decoded, err := Decode(V5, bytes.NewReader(pkt.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, ok := decoded.(*ConnPacket)
+	if !ok {
+		t.Fatal("unexpected packet type =", decoded.Type())
+	}
+	if !reflect.DeepEqual(pkt.WillProps, p.WillProps) {
+		t.Errorf("unexpected will props = %+v", p.WillProps)
+	}
+	if p.Version() != V5 || p.WillTopic != pkt.WillTopic || string(p.WillMessage) != "gone" ||
+		p.ClientID != "cid" || p.Username != "user" || !bytes.Equal(p.Password, pkt.Password) {
+		t.Errorf("unexpected conn packet = %+v", p)
+	}
+
+	// will props not encoded with MQTT 3.1.1
+	pkt.SetVersion(V311)
+	decoded, err = Decode(V311, bytes.NewReader(pkt.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := decoded.(*ConnPacket); p.WillProps != nil || p.WillTopic != pkt.WillTopic {
+		t.Errorf("unexpected conn packet = %+v", p)
+	}
+}
+
+func TestConnProps_Auth(t *testing.T) {
+	pkt := &ConnPacket{
+		ClientID: "cid",
+		Props:    &ConnProps{AuthMethod: "token", AuthData: []byte{1, 2}},
+	}
+	pkt.SetVersion(V5)
+
+	expected := []byte{CtrlConn << 4, 29, 0, 4, 'M', 'Q', 'T', 'T', 5, 0, 0, 0,
+		13, propKeyAuthMethod, 0, 5, 't', 'o', 'k', 'e', 'n', propKeyAuthData, 0, 2, 1, 2,
+		0, 3, 'c', 'i', 'd'}
+	if !bytes.Equal(expected, pkt.Bytes()) {
+		t.Errorf("unexpected bytes = %v", pkt.Bytes())
+	}
+
+	decoded, err := Decode(V5, bytes.NewReader(expected))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := decoded.(*ConnPacket).Props; p.AuthMethod != "token" || !bytes.Equal(p.AuthData, []byte{1, 2}) {
+		t.Errorf("unexpected props = %+v", p)
+	}
+
+	if !pkt.Props.hasAuth() || (&ConnProps{}).hasAuth() || (*ConnProps)(nil).hasAuth() {
+		t.Error("unexpected hasAuth")
+	}
+}
+
+func TestConnPacket_V31(t *testing.T) {
+	pkt := &ConnPacket{ClientID: "id", CleanSession: true, Keepalive: 10}
+	pkt.SetVersion(V31)
+
+	target := []byte{CtrlConn << 4, 16, 0, 6, 'M', 'Q', 'I', 's', 'd', 'p', 3, 0x02, 0, 10, 0, 2, 'i', 'd'}
+	if b := pkt.Bytes(); !bytes.Equal(b, target) {
+		t.Fatalf("unexpected bytes\n got: %v\nwant: %v", b, target)
+	}
+
+	decoded, err := Decode(V31, bytes.NewReader(target))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, ok := decoded.(*ConnPacket)
+	if !ok || conn.ProtoName != "MQIsdp" || conn.Version() != V31 || conn.ClientID != "id" {
+		t.Error("unexpected decoded packet =", decoded)
+	}
+}
+
+func TestPackets_V31(t *testing.T) {
+	// wire format of packets other than Conn is the same as MQTT 3.1.1
+	for _, newPkt := range []func() Packet{
+		func() Packet { return &ConnAckPacket{Code: CodeIdentifierRejected} },
+		func() Packet {
+			return &PublishPacket{TopicName: "/foo", Qos: Qos1, PacketID: 1, Payload: []byte("bar")}
+		},
+		func() Packet { return &PubAckPacket{PacketID: 1} },
+		func() Packet { return &PubRecvPacket{PacketID: 1} },
+		func() Packet { return &PubRelPacket{PacketID: 1} },
+		func() Packet { return &PubCompPacket{PacketID: 1} },
+		func() Packet { return &SubscribePacket{PacketID: 1, Topics: []*Topic{{Name: "/foo", Qos: Qos1}}} },
+		func() Packet { return &SubAckPacket{PacketID: 1, Codes: []byte{SubOkMaxQos1}} },
+		func() Packet { return &UnsubPacket{PacketID: 1, TopicNames: []string{"/foo"}} },
+		func() Packet { return &UnsubAckPacket{PacketID: 1} },
+		func() Packet { return &DisconnPacket{} },
+	} {
+		v311, v31 := newPkt(), newPkt()
+		v311.SetVersion(V311)
+		v31.SetVersion(V31)
+
+		b := v31.Bytes()
+		if len(b) == 0 || !bytes.Equal(b, v311.Bytes()) {
+			t.Errorf("unexpected bytes of %T, got: %v, want: %v", v31, b, v311.Bytes())
+			continue
+		}
+
+		decoded, err := Decode(V31, bytes.NewReader(b))
+		if err != nil || decoded.Type() != v31.Type() || decoded.Version() != V31 {
+			t.Errorf("decode %T failed, err = %v", v31, err)
+		}
+	}
+
+	for _, p := range []Packet{PingReqPacket, PingRespPacket} {
+		if decoded, err := Decode(V31, bytes.NewReader(p.Bytes())); err != nil || decoded.Version() != V31 {
+			t.Errorf("decode %T failed, err = %v", p, err)
+		}
+	}
+}
@@ -16,8 +16,6 @@
 
 package libmqtt
 
-import "bytes"
-
 var (
 	PingReqPacket  = &pingReqPacket{}
 	PingRespPacket = &pingRespPacket{}
@@ -40,13 +38,8 @@ func (p *pingReqPacket) Type() CtrlType {
 }
 
 func (p *pingReqPacket) Bytes() []byte {
-	if p == nil {
-		return nil
-	}
-
-	w := new(bytes.Buffer)
-	_ = p.WriteTo(w)
-	return w.Bytes()
+	b, _ := p.MarshalBinary()
+	return b
 }
 
 func (p *pingReqPacket) WriteTo(w BufferedWriter) error {
@@ -55,7 +48,7 @@ func (p *pingReqPacket) WriteTo(w BufferedWriter) error {
 	}
 
 	switch p.Version() {
-	case V311, V5:
+	case V31, V311, V5:
 		_ = w.WriteByte(CtrlPingReq << 4)
 		return w.WriteByte(0x00)
 	default:
@@ -74,13 +67,8 @@ func (p *pingRespPacket) Type() CtrlType {
 }
 
 func (p *pingRespPacket) Bytes() []byte {
-	if p == nil {
-		return nil
-	}
-
-	w := new(bytes.Buffer)
-	_ = p.WriteTo(w)
-	return w.Bytes()
+	b, _ := p.MarshalBinary()
+	return b
 }
 
 func (p *pingRespPacket) WriteTo(w BufferedWriter) error {
@@ -89,7 +77,7 @@ func (p *pingRespPacket) WriteTo(w BufferedWriter) error {
 	}
 
 	switch p.Version() {
-	case V311, V5:
+	case V31, V311, V5:
 		_ = w.WriteByte(CtrlPingResp << 4)
 		return w.WriteByte(0x00)
 	default:
@@ -16,19 +16,177 @@
 
 package libmqtt
 
-import "bytes"
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
 
 // PublishPacket is sent from a Client to a Server or from Server to a Client
 // to transport an Application Message.
 type PublishPacket struct {
 	BasePacket
-	IsDup     bool
+	IsDup     bool // DUP flag, set on retransmitted QoS1/QoS2 packets
 	Qos       QosLevel
 	IsRetain  bool
 	TopicName string
 	Payload   []byte
 	PacketID  uint16
 	Props     *PublishProps
+
+	// PayloadReader is the alternative of Payload for large payloads, when
+	// set, PayloadLength bytes are streamed from it while encoding
+	//
+	// QoS1/QoS2 packets can only be persisted for resend if it's an
+	// io.ReadSeeker, which is read from the start on every encoding
+	PayloadReader io.Reader
+	// PayloadLength is the size of payload to read from PayloadReader
+	PayloadLength int64
+
+	// InvalidPayloadFormat is set on received packets failed the payload
+	// format validation (see WithPayloadFormatValidation)
+	InvalidPayloadFormat bool
+
+	// queued packet discarded once expired or canceled (see PubDeadline
+	// and PubContext)
+	deadline time.Time
+	ctx      context.Context
+
+	traceEnd func(err error) // ends the trace of the publish (see Tracer)
+	token    *PublishToken   // resolved once the publish finished (see PublishAsync)
+
+	ackConn   *clientConn // connection to send ack, set in manual ack mode
+	acked     bool        // guarded by ackConn.ackMu
+	ackCode   byte        // reason code of the ack, guarded by ackConn.ackMu
+	ackReason string      // reason string of the ack, guarded by ackConn.ackMu
+
+	server string    // server received from, set on received packets
+	recvAt time.Time // time received, set on received packets
+
+	pool     *publishPool // pool to put back after handled, nil if not pooled
+	buf      []byte       // decode buffer holding TopicName and Payload
+	retained uint32       // set by Retain, never put back to pool
+}
+
+// Retain the publish packet, the packet will not be reused by the client
+// (only required for pooled decode mode, see WithPooledDecode)
+//
+// MUST be called in the handler if the packet or payload is used after
+// the handler returned
+func (p *PublishPacket) Retain() {
+	atomic.StoreUint32(&p.retained, 1)
+}
+
+// Copy returns a copy of the publish packet with its own payload,
+// which is safe to use after the handler returned
+func (p *PublishPacket) Copy() *PublishPacket {
+	return &PublishPacket{
+		BasePacket: BasePacket{ProtoVersion: p.Version()},
+		IsDup:      p.IsDup,
+		Qos:        p.Qos,
+		IsRetain:   p.IsRetain,
+		TopicName:  p.TopicName,
+		Payload:    append([]byte(nil), p.Payload...),
+		PacketID:   p.PacketID,
+		Props:      p.Props,
+
+		InvalidPayloadFormat: p.InvalidPayloadFormat,
+
+		server: p.server,
+		recvAt: p.recvAt,
+	}
+}
+
+// PublishMeta is the metadata of the received publish packet
+type PublishMeta struct {
+	// Retain is the retain flag, true for retained messages sent by the
+	// server on subscribe
+	Retain bool
+	// Dup is the DUP flag, the message may have been delivered before
+	Dup bool
+	// PacketID is the packet id of QoS1/QoS2 messages, 0 for QoS0
+	PacketID uint16
+	// Server is the name of the server received from
+	Server string
+	// ReceivedAt is the time received, zero if restored from the
+	// persisted session (QoS2 messages received before restart)
+	ReceivedAt time.Time
+}
+
+// Meta returns the metadata of the received publish packet
+func (p *PublishPacket) Meta() PublishMeta {
+	return PublishMeta{
+		Retain:     p.IsRetain,
+		Dup:        p.IsDup,
+		PacketID:   p.PacketID,
+		Server:     p.server,
+		ReceivedAt: p.recvAt,
+	}
+}
+
+// dup returns a copy of the packet with DUP flag set for retransmission,
+// the payload is shared, the packet itself is not modified since it may be
+// persisted or shared by connections
+func (p *PublishPacket) dup() *PublishPacket {
+	return &PublishPacket{
+		BasePacket:    BasePacket{ProtoVersion: p.Version()},
+		IsDup:         true,
+		Qos:           p.Qos,
+		IsRetain:      p.IsRetain,
+		TopicName:     p.TopicName,
+		Payload:       p.Payload,
+		PacketID:      p.PacketID,
+		Props:         p.Props,
+		PayloadReader: p.PayloadReader,
+		PayloadLength: p.PayloadLength,
+
+		traceEnd: p.traceEnd,
+		token:    p.token,
+	}
+}
+
+// release puts the pooled packet back to its pool unless retained
+func (p *PublishPacket) release() {
+	if p == nil || p.pool == nil || atomic.LoadUint32(&p.retained) == 1 {
+		return
+	}
+
+	pool, buf := p.pool, p.buf
+	*p = PublishPacket{buf: buf}
+	pool.put(p)
+}
+
+// publishPool reuses publish packets and their decode buffers
+type publishPool struct {
+	pool sync.Pool
+}
+
+func newPublishPool() *publishPool {
+	return &publishPool{pool: sync.Pool{
+		New: func() interface{} { return new(PublishPacket) },
+	}}
+}
+
+// get a publish packet with decode buffer of size n
+func (pp *publishPool) get(n int) *PublishPacket {
+	p := pp.pool.Get().(*PublishPacket)
+	if cap(p.buf) < n {
+		p.buf = make([]byte, n)
+	}
+	p.buf = p.buf[:n]
+	p.pool = pp
+	return p
+}
+
+func (pp *publishPool) put(p *PublishPacket) {
+	if cap(p.buf) > maxPooledDecodeBufSize {
+		// do not hold large buffers
+		p.buf = nil
+	}
+	pp.pool.Put(p)
 }
 
 // Type of PublishPacket is CtrlPublish
@@ -37,13 +195,8 @@ func (p *PublishPacket) Type() CtrlType {
 }
 
 func (p *PublishPacket) Bytes() []byte {
-	if p == nil {
-		return nil
-	}
-
-	w := new(bytes.Buffer)
-	_ = p.WriteTo(w)
-	return w.Bytes()
+	b, _ := p.MarshalBinary()
+	return b
 }
 
 func (p *PublishPacket) WriteTo(w BufferedWriter) error {
@@ -51,26 +204,89 @@ func (p *PublishPacket) WriteTo(w BufferedWriter) error {
 		return ErrEncodeBadPacket
 	}
 
-	first := CtrlPublish<<4 | boolToByte(p.IsDup)<<3 | boolToByte(p.IsRetain) | p.Qos<<1
+	// DUP flag MUST be 0 for QoS0 packets
+	dup := p.IsDup && p.Qos > Qos0
+	first := CtrlPublish<<4 | boolToByte(dup)<<3 | boolToByte(p.IsRetain) | p.Qos<<1
 
-	varHeader := encodeStringWithLen(p.TopicName)
+	varHeader, err := appendStringWithLen(make([]byte, 0, 2+len(p.TopicName)+2), p.TopicName)
+	if err != nil {
+		return err
+	}
 	if p.Qos > Qos0 {
 		varHeader = append(varHeader, byte(p.PacketID>>8), byte(p.PacketID))
 	}
 
+	if p.PayloadReader != nil {
+		return p.writeStream(w, first, varHeader)
+	}
+
 	switch p.Version() {
-	case V311:
+	case V31, V311:
 		return p.write(w, first, varHeader, p.payload())
 	case V5:
-		return p.writeV5(w, first, varHeader, p.Props.props(), p.payload())
+		props, err := p.Props.props()
+		if err != nil {
+			return err
+		}
+		return p.writeV5(w, first, varHeader, props, p.payload())
+	default:
+		return ErrUnsupportedVersion
+	}
+}
+
+// writeStream writes the packet with payload streamed from PayloadReader
+func (p *PublishPacket) writeStream(w BufferedWriter, first byte, varHeader []byte) error {
+	if p.PayloadLength < 0 || p.PayloadLength > maxMsgSize {
+		return ErrEncodeLargePacket
+	}
+	length := int(p.PayloadLength)
+
+	if s, ok := p.PayloadReader.(io.Seeker); ok {
+		if _, err := s.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	switch p.Version() {
+	case V31, V311:
+		err = p.writeHeader(w, first, varHeader, length)
+	case V5:
+		var props []byte
+		if props, err = p.Props.props(); err != nil {
+			return err
+		}
+
+		err = withV5VarHeader(varHeader, props, func(v5VarHeader []byte) error {
+			return p.writeHeader(w, first, v5VarHeader, length)
+		})
 	default:
 		return ErrUnsupportedVersion
 	}
+	if err != nil {
+		return err
+	}
+
+	_, err = io.CopyN(w, p.PayloadReader, p.PayloadLength)
+	if err == io.EOF {
+		return ErrEncodeShortPayload
+	}
+	return err
+}
+
+// replayable returns whether the packet can be encoded again
+func (p *PublishPacket) replayable() bool {
+	if p.PayloadReader == nil {
+		return true
+	}
+
+	_, ok := p.PayloadReader.(io.Seeker)
+	return ok
 }
 
 func (p *PublishPacket) payload() []byte {
-	data := make([]byte, 0)
-	return append(data, p.Payload...)
+	// payload is only read when encoding, no copy required
+	return p.Payload
 }
 
 // PublishProps properties for PublishPacket
@@ -113,9 +329,9 @@ type PublishProps struct {
 	ContentType string
 }
 
-func (p *PublishProps) props() []byte {
+func (p *PublishProps) props() ([]byte, error) {
 	if p == nil {
-		return nil
+		return nil, nil
 	}
 
 	propSet := propertySet{}
@@ -190,13 +406,8 @@ func (p *PubAckPacket) Type() CtrlType {
 }
 
 func (p *PubAckPacket) Bytes() []byte {
-	if p == nil {
-		return nil
-	}
-
-	w := new(bytes.Buffer)
-	_ = p.WriteTo(w)
-	return w.Bytes()
+	b, _ := p.MarshalBinary()
+	return b
 }
 
 func (p *PubAckPacket) WriteTo(w BufferedWriter) error {
@@ -206,10 +417,14 @@ func (p *PubAckPacket) WriteTo(w BufferedWriter) error {
 
 	varHeader := []byte{byte(p.PacketID >> 8), byte(p.PacketID)}
 	switch p.Version() {
-	case V311:
+	case V31, V311:
 		return p.write(w, CtrlPubAck<<4, varHeader, nil)
 	case V5:
-		return p.writeV5(w, CtrlPubAck<<4, varHeader, p.Props.props(), nil)
+		props, err := p.Props.props()
+		if err != nil {
+			return err
+		}
+		return p.writeV5Ack(w, CtrlPubAck<<4, p.PacketID, p.Code, props)
 	default:
 		return ErrUnsupportedVersion
 	}
@@ -224,9 +439,16 @@ type PubAckProps struct {
 	UserProps UserProps
 }
 
-func (p *PubAckProps) props() []byte {
+func (p *PubAckProps) reason() string {
 	if p == nil {
-		return nil
+		return ""
+	}
+	return p.Reason
+}
+
+func (p *PubAckProps) props() ([]byte, error) {
+	if p == nil {
+		return nil, nil
 	}
 
 	propSet := propertySet{}
@@ -264,13 +486,8 @@ func (p *PubRecvPacket) Type() CtrlType {
 }
 
 func (p *PubRecvPacket) Bytes() []byte {
-	if p == nil {
-		return nil
-	}
-
-	w := new(bytes.Buffer)
-	_ = p.WriteTo(w)
-	return w.Bytes()
+	b, _ := p.MarshalBinary()
+	return b
 }
 
 func (p *PubRecvPacket) WriteTo(w BufferedWriter) error {
@@ -281,10 +498,14 @@ func (p *PubRecvPacket) WriteTo(w BufferedWriter) error {
 	const first = CtrlPubRecv << 4
 	varHeader := []byte{byte(p.PacketID >> 8), byte(p.PacketID)}
 	switch p.Version() {
-	case V311:
+	case V31, V311:
 		return p.write(w, first, varHeader, nil)
 	case V5:
-		return p.writeV5(w, first, varHeader, p.Props.props(), nil)
+		props, err := p.Props.props()
+		if err != nil {
+			return err
+		}
+		return p.writeV5Ack(w, first, p.PacketID, p.Code, props)
 	default:
 		return ErrUnsupportedVersion
 	}
@@ -299,9 +520,16 @@ type PubRecvProps struct {
 	UserProps UserProps
 }
 
-func (p *PubRecvProps) props() []byte {
+func (p *PubRecvProps) reason() string {
 	if p == nil {
-		return nil
+		return ""
+	}
+	return p.Reason
+}
+
+func (p *PubRecvProps) props() ([]byte, error) {
+	if p == nil {
+		return nil, nil
 	}
 
 	propSet := propertySet{}
@@ -339,13 +567,8 @@ func (p *PubRelPacket) Type() CtrlType {
 }
 
 func (p *PubRelPacket) Bytes() []byte {
-	if p == nil {
-		return nil
-	}
-
-	w := new(bytes.Buffer)
-	_ = p.WriteTo(w)
-	return w.Bytes()
+	b, _ := p.MarshalBinary()
+	return b
 }
 
 func (p *PubRelPacket) WriteTo(w BufferedWriter) error {
@@ -356,10 +579,14 @@ func (p *PubRelPacket) WriteTo(w BufferedWriter) error {
 	const first = CtrlPubRel<<4 | 0x02
 	varHeader := []byte{byte(p.PacketID >> 8), byte(p.PacketID)}
 	switch p.Version() {
-	case V311:
+	case V31, V311:
 		return p.write(w, first, varHeader, nil)
 	case V5:
-		return p.writeV5(w, first, varHeader, p.Props.props(), nil)
+		props, err := p.Props.props()
+		if err != nil {
+			return err
+		}
+		return p.writeV5Ack(w, first, p.PacketID, p.Code, props)
 	default:
 		return ErrUnsupportedVersion
 	}
@@ -374,9 +601,9 @@ type PubRelProps struct {
 	UserProps UserProps
 }
 
-func (p *PubRelProps) props() []byte {
+func (p *PubRelProps) props() ([]byte, error) {
 	if p == nil {
-		return nil
+		return nil, nil
 	}
 
 	propSet := propertySet{}
@@ -414,13 +641,8 @@ func (p *PubCompPacket) Type() CtrlType {
 }
 
 func (p *PubCompPacket) Bytes() []byte {
-	if p == nil {
-		return nil
-	}
-
-	w := new(bytes.Buffer)
-	_ = p.WriteTo(w)
-	return w.Bytes()
+	b, _ := p.MarshalBinary()
+	return b
 }
 
 func (p *PubCompPacket) WriteTo(w BufferedWriter) error {
@@ -430,10 +652,14 @@ func (p *PubCompPacket) WriteTo(w BufferedWriter) error {
 
 	varHeader := []byte{byte(p.PacketID >> 8), byte(p.PacketID)}
 	switch p.Version() {
-	case V311:
+	case V31, V311:
 		return p.write(w, CtrlPubComp<<4, varHeader, nil)
 	case V5:
-		return p.writeV5(w, CtrlPubComp<<4, varHeader, p.Props.props(), nil)
+		props, err := p.Props.props()
+		if err != nil {
+			return err
+		}
+		return p.writeV5Ack(w, CtrlPubComp<<4, p.PacketID, p.Code, props)
 	default:
 		return ErrUnsupportedVersion
 	}
@@ -448,9 +674,16 @@ type PubCompProps struct {
 	UserProps UserProps
 }
 
-func (p *PubCompProps) props() []byte {
+func (p *PubCompProps) reason() string {
+	if p == nil {
+		return ""
+	}
+	return p.Reason
+}
+
+func (p *PubCompProps) props() ([]byte, error) {
 	if p == nil {
-		return nil
+		return nil, nil
 	}
 
 	propSet := propertySet{}
@@ -21,6 +21,7 @@ import (
 	"testing"
 
 	std "github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/stretchr/testify/assert"
 )
 
 // pub test data
@@ -233,3 +234,197 @@ func TestPubCompProps_Props(t *testing.T) {
 func TestPubCompProps_SetProps(t *testing.T) {
 
 }
+
+func TestPublishPacket_PayloadReader(t *testing.T) {
+	payload := bytes.Repeat([]byte("foo"), 10000)
+	for _, version := range []ProtoVersion{V311, V5} {
+		target := &PublishPacket{
+			TopicName: "/foo",
+			Qos:       Qos1,
+			PacketID:  1,
+			Payload:   payload,
+			Props:     &PublishProps{ContentType: "text/plain"},
+		}
+		target.SetVersion(version)
+
+		streamed := &PublishPacket{
+			TopicName:     "/foo",
+			Qos:           Qos1,
+			PacketID:      1,
+			Props:         &PublishProps{ContentType: "text/plain"},
+			PayloadReader: bytes.NewReader(payload),
+			PayloadLength: int64(len(payload)),
+		}
+		streamed.SetVersion(version)
+
+		// io.ReadSeeker can be encoded multiple times
+		assert.Equal(t, target.Bytes(), streamed.Bytes())
+		assert.Equal(t, target.Bytes(), streamed.Bytes())
+		assert.True(t, streamed.replayable())
+	}
+
+	short := &PublishPacket{
+		TopicName:     "/foo",
+		PayloadReader: bytes.NewBufferString("foo"),
+		PayloadLength: 4,
+	}
+	assert.Equal(t, ErrEncodeShortPayload, short.WriteTo(new(bytes.Buffer)))
+	assert.False(t, short.replayable())
+
+	large := &PublishPacket{
+		TopicName:     "/foo",
+		PayloadReader: bytes.NewBufferString("foo"),
+		PayloadLength: maxMsgSize + 1,
+	}
+	assert.Equal(t, ErrEncodeLargePacket, large.WriteTo(new(bytes.Buffer)))
+}
+
+func TestClient_PublishNotReplayable(t *testing.T) {
+	c := defaultClient()
+	c.persist = NewMemPersist(&PersistStrategy{})
+
+	pkt := &PublishPacket{
+		TopicName:     "/foo",
+		Qos:           Qos1,
+		PayloadReader: bytes.NewBufferString("foo"),
+		PayloadLength: 3,
+	}
+	c.Publish(pkt)
+
+	msg := <-c.msgCh
+	assert.Equal(t, ErrPayloadNotReplayable, msg.err)
+	sent := (<-c.sendCh).(*PublishPacket)
+	assert.Equal(t, pkt.PayloadReader, sent.PayloadReader)
+	assert.NotZero(t, sent.PacketID)
+	assert.Zero(t, pkt.PacketID)
+
+	_, ok := c.persist.Load(sendKey("", sent.PacketID))
+	assert.False(t, ok)
+}
+
+func TestPublishPacket_Dup(t *testing.T) {
+	for _, version := range []ProtoVersion{V311, V5} {
+		for _, qos := range []QosLevel{Qos0, Qos1, Qos2} {
+			p := &PublishPacket{TopicName: "/foo", Qos: qos, PacketID: 1, Payload: []byte("bar"), Props: &PublishProps{}}
+			p.SetVersion(version)
+
+			for _, pkt := range []*PublishPacket{p, p.dup()} {
+				buf := new(bytes.Buffer)
+				if !assert.NoError(t, pkt.WriteTo(buf)) {
+					return
+				}
+
+				// DUP flag MUST be 0 for QoS0 packets
+				expectDup := pkt.IsDup && qos > Qos0
+				assert.Equal(t, expectDup, buf.Bytes()[0]&0x08 == 0x08, "version = %d, qos = %d", version, qos)
+
+				decoded, err := Decode(version, buf)
+				if !assert.NoError(t, err) {
+					return
+				}
+				assert.Equal(t, expectDup, decoded.(*PublishPacket).IsDup)
+				assert.Equal(t, qos, decoded.(*PublishPacket).Qos)
+			}
+
+			assert.False(t, p.IsDup, "original packet modified")
+		}
+	}
+}
+
+func TestPubAckPackets_ShortForm(t *testing.T) {
+	for _, c := range []struct {
+		pkt    Packet
+		first  byte
+		code   func(Packet) byte
+		failed Packet
+	}{
+		{
+			pkt:    &PubAckPacket{PacketID: 1},
+			failed: &PubAckPacket{PacketID: 1, Code: CodeNotAuthorized},
+			first:  CtrlPubAck << 4,
+			code:   func(p Packet) byte { return p.(*PubAckPacket).Code },
+		},
+		{
+			pkt:    &PubRecvPacket{PacketID: 1},
+			failed: &PubRecvPacket{PacketID: 1, Code: CodeQuotaExceeded},
+			first:  CtrlPubRecv << 4,
+			code:   func(p Packet) byte { return p.(*PubRecvPacket).Code },
+		},
+		{
+			pkt:    &PubRelPacket{PacketID: 1, Props: &PubRelProps{}},
+			failed: &PubRelPacket{PacketID: 1, Code: CodePacketIdentifierNotFound},
+			first:  CtrlPubRel<<4 | 0x02,
+			code:   func(p Packet) byte { return p.(*PubRelPacket).Code },
+		},
+		{
+			pkt:    &PubCompPacket{PacketID: 1},
+			failed: &PubCompPacket{PacketID: 1, Code: CodePacketIdentifierNotFound},
+			first:  CtrlPubComp << 4,
+			code:   func(p Packet) byte { return p.(*PubCompPacket).Code },
+		},
+	} {
+		c.pkt.SetVersion(V5)
+		c.failed.SetVersion(V5)
+
+		// reason code omitted if success without properties
+		assert.Equal(t, []byte{c.first, 2, 0, 1}, c.pkt.Bytes())
+		// property length omitted if no properties
+		assert.Equal(t, []byte{c.first, 3, 0, 1, c.code(c.failed)}, c.failed.Bytes())
+
+		for _, p := range []Packet{c.pkt, c.failed} {
+			decoded, err := Decode(V5, bytes.NewReader(p.Bytes()))
+			if assert.NoError(t, err) {
+				assert.Equal(t, c.code(p), c.code(decoded))
+			}
+		}
+	}
+}
+
+func TestPublishPacket_MultipleSubIDs(t *testing.T) {
+	for _, c := range []struct {
+		props  []byte
+		subIDs []int
+	}{
+		{
+			props:  []byte{propKeySubID, 0x01, propKeySubID, 0xc8, 0x01},
+			subIDs: []int{1, 200},
+		},
+		{
+			// not adjacent, with the max identifier
+			props: []byte{
+				propKeySubID, 0x02,
+				propKeyContentType, 0x00, 0x01, 'x',
+				propKeySubID, 0xff, 0xff, 0xff, 0x7f,
+				propKeySubID, 0x80, 0x01,
+			},
+			subIDs: []int{2, maxSubID, 128},
+		},
+	} {
+		body := []byte{0x00, 0x03, 'a', '/', 'b', byte(len(c.props))}
+		body = append(append(body, c.props...), 'h', 'i')
+		raw := append([]byte{CtrlPublish << 4, byte(len(body))}, body...)
+
+		pkt, err := Decode(V5, bytes.NewReader(raw))
+		if !assert.NoError(t, err) {
+			return
+		}
+		p := pkt.(*PublishPacket)
+		assert.Equal(t, "a/b", p.TopicName)
+		assert.Equal(t, []byte("hi"), p.Payload)
+		if !assert.NotNil(t, p.Props) {
+			return
+		}
+		assert.Equal(t, c.subIDs, p.Props.SubIDs)
+
+		// identifiers kept once encoded again
+		buf := new(bytes.Buffer)
+		p.SetVersion(V5)
+		if !assert.NoError(t, p.WriteTo(buf)) {
+			return
+		}
+		pkt, err = Decode(V5, buf)
+		if assert.NoError(t, err) {
+			assert.Equal(t, c.subIDs, pkt.(*PublishPacket).Props.SubIDs)
+		}
+	}
+}
@@ -0,0 +1,466 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// packets are described in one line as the packet name followed by
+// fields set (e.g. "PUBLISH id=17 qos=1 dup topic=a/b len=128 props{expiry=30s}"),
+// binary data is summarized as its length and leading bytes in hex, and
+// credentials are redacted
+
+// maxStringBytes is the max count of leading bytes of binary data
+const maxStringBytes = 8
+
+const redacted = "<redacted>"
+
+// pktString builds the description of packets
+type pktString struct {
+	b strings.Builder
+}
+
+func newPktString(name string) *pktString {
+	s := &pktString{}
+	s.b.WriteString(name)
+	return s
+}
+
+func (s *pktString) String() string {
+	return s.b.String()
+}
+
+// sep writes the separator before the next field
+func (s *pktString) sep() {
+	if s.b.Len() > 0 {
+		s.b.WriteByte(' ')
+	}
+}
+
+// flag writes the name if set
+func (s *pktString) flag(name string, set bool) {
+	if set {
+		s.sep()
+		s.b.WriteString(name)
+	}
+}
+
+// str writes the string field if not empty
+func (s *pktString) str(name, value string) {
+	if value != "" {
+		s.sep()
+		s.b.WriteString(name)
+		s.b.WriteByte('=')
+		s.b.WriteString(value)
+	}
+}
+
+// uint writes the number field if not zero
+func (s *pktString) uint(name string, value uint64) {
+	if value != 0 {
+		s.str(name, strconv.FormatUint(value, 10))
+	}
+}
+
+// seconds writes the time interval field in seconds if not zero
+func (s *pktString) seconds(name string, value uint32) {
+	if value != 0 {
+		s.str(name, (time.Duration(value) * time.Second).String())
+	}
+}
+
+// code writes the reason code field
+func (s *pktString) code(name string, code byte) {
+	s.str(name, codeString(code))
+}
+
+// bool writes the optional bool field if set
+func (s *pktString) bool(name string, value *bool) {
+	if value != nil {
+		s.str(name, strconv.FormatBool(*value))
+	}
+}
+
+// bytes writes the binary field summary if not empty
+func (s *pktString) bytes(name string, data []byte) {
+	if len(data) > 0 {
+		s.str(name, bytesString(data))
+	}
+}
+
+// secret writes the redacted field if not empty
+func (s *pktString) secret(name string, data []byte) {
+	if len(data) > 0 {
+		s.str(name, redacted)
+	}
+}
+
+// payload writes the payload length and summary, the summary is omitted
+// for empty payloads
+func (s *pktString) payload(data []byte) {
+	s.str("len", strconv.Itoa(len(data)))
+	s.bytes("data", data)
+}
+
+// userProps writes user properties if not empty
+func (s *pktString) userProps(props UserProps) {
+	if len(props) == 0 {
+		return
+	}
+
+	s.sep()
+	s.b.WriteString("user{")
+	for i, p := range props {
+		if i > 0 {
+			s.b.WriteByte(' ')
+		}
+		s.b.WriteString(p.Key)
+		s.b.WriteByte('=')
+		s.b.WriteString(p.Value)
+	}
+	s.b.WriteByte('}')
+}
+
+// group writes fields written by write in name{}, the group is omitted
+// if no field written
+func (s *pktString) group(name string, write func(s *pktString)) {
+	g := &pktString{}
+	write(g)
+	if g.b.Len() > 0 {
+		s.sep()
+		s.b.WriteString(name)
+		s.b.WriteByte('{')
+		s.b.WriteString(g.b.String())
+		s.b.WriteByte('}')
+	}
+}
+
+func codeString(code byte) string {
+	const digits = "0123456789abcdef"
+	return string([]byte{'0', 'x', digits[code>>4], digits[code&0x0f]})
+}
+
+// bytesString returns the hex of leading bytes, followed by ".." if
+// truncated
+func bytesString(data []byte) string {
+	if len(data) <= maxStringBytes {
+		return hex.EncodeToString(data)
+	}
+	return hex.EncodeToString(data[:maxStringBytes]) + ".."
+}
+
+func versionString(version ProtoVersion) string {
+	switch version {
+	case V31:
+		return "3.1"
+	case V311:
+		return "3.1.1"
+	case V5:
+		return "5"
+	}
+	return strconv.Itoa(int(version))
+}
+
+// String of ConnPacket, password and authentication data are redacted
+func (c *ConnPacket) String() string {
+	s := newPktString("CONNECT")
+	s.str("v", versionString(c.Version()))
+	s.str("client", strconv.Quote(c.ClientID))
+	s.flag("clean", c.CleanSession)
+	s.seconds("keepalive", uint32(c.Keepalive))
+	s.str("user", c.Username)
+	s.secret("password", c.Password)
+	if c.IsWill {
+		s.group("will", func(s *pktString) {
+			s.str("topic", c.WillTopic)
+			s.str("qos", strconv.Itoa(int(c.WillQos)))
+			s.flag("retain", c.WillRetain)
+			s.payload(c.WillMessage)
+			if c.WillProps != nil {
+				s.group("props", c.WillProps.writeString)
+			}
+		})
+	}
+	if c.Props != nil {
+		s.group("props", c.Props.writeString)
+	}
+	return s.String()
+}
+
+func (p *WillProps) writeString(s *pktString) {
+	s.seconds("delay", p.WillDelayInterval)
+	s.uint("format", uint64(p.PayloadFormat))
+	s.seconds("expiry", p.MessageExpiryInterval)
+	s.str("type", p.ContentType)
+	s.str("resp", p.ResponseTopic)
+	s.bytes("corr", p.CorrelationData)
+	s.userProps(p.UserProps)
+}
+
+func (p *ConnProps) writeString(s *pktString) {
+	s.seconds("session-expiry", p.SessionExpiryInterval)
+	s.uint("max-recv", uint64(p.MaxRecv))
+	s.uint("max-packet", uint64(p.MaxPacketSize))
+	s.uint("max-alias", uint64(p.MaxTopicAlias))
+	s.bool("req-resp-info", p.ReqRespInfo)
+	s.bool("req-problem-info", p.ReqProblemInfo)
+	s.str("auth-method", p.AuthMethod)
+	s.secret("auth-data", p.AuthData)
+	s.userProps(p.UserProps)
+}
+
+// String of ConnAckPacket, authentication data is redacted
+func (c *ConnAckPacket) String() string {
+	s := newPktString("CONNACK")
+	s.code("code", c.Code)
+	s.flag("present", c.Present)
+	if c.Props != nil {
+		s.group("props", c.Props.writeString)
+	}
+	return s.String()
+}
+
+func (p *ConnAckProps) writeString(s *pktString) {
+	s.seconds("session-expiry", p.SessionExpiryInterval)
+	s.uint("max-recv", uint64(p.MaxRecv))
+	s.uint("max-qos", uint64(p.MaxQos))
+	s.bool("retain-avail", p.RetainAvail)
+	s.uint("max-packet", uint64(p.MaxPacketSize))
+	s.str("client", p.AssignedClientID)
+	s.uint("max-alias", uint64(p.MaxTopicAlias))
+	s.str("reason", quote(p.Reason))
+	s.bool("wildcard-avail", p.WildcardSubAvail)
+	s.bool("sub-id-avail", p.SubIDAvail)
+	s.bool("shared-avail", p.SharedSubAvail)
+	s.seconds("keepalive", uint32(p.ServerKeepalive))
+	s.str("resp-info", p.RespInfo)
+	s.str("server-ref", p.ServerRef)
+	s.str("auth-method", p.AuthMethod)
+	s.secret("auth-data", p.AuthData)
+	s.userProps(p.UserProps)
+}
+
+// String of DisconnPacket
+func (d *DisconnPacket) String() string {
+	s := newPktString("DISCONNECT")
+	if d.Code != CodeSuccess {
+		s.code("code", d.Code)
+	}
+	if d.Props != nil {
+		s.group("props", func(s *pktString) {
+			s.seconds("session-expiry", d.Props.SessionExpiryInterval)
+			s.str("reason", quote(d.Props.Reason))
+			s.str("server-ref", d.Props.ServerRef)
+			s.userProps(d.Props.UserProps)
+		})
+	}
+	return s.String()
+}
+
+// String of AuthPacket, authentication data is redacted
+func (a *AuthPacket) String() string {
+	s := newPktString("AUTH")
+	if a.Code != CodeSuccess {
+		s.code("code", a.Code)
+	}
+	if a.Props != nil {
+		s.group("props", func(s *pktString) {
+			s.str("method", a.Props.AuthMethod)
+			s.secret("data", a.Props.AuthData)
+			s.str("reason", quote(a.Props.Reason))
+			s.userProps(a.Props.UserProps)
+		})
+	}
+	return s.String()
+}
+
+// String of pingReqPacket
+func (p *pingReqPacket) String() string {
+	return "PINGREQ"
+}
+
+// String of pingRespPacket
+func (p *pingRespPacket) String() string {
+	return "PINGRESP"
+}
+
+// String of PublishPacket, the payload is summarized, streamed payloads
+// are described with the length only
+func (p *PublishPacket) String() string {
+	s := newPktString("PUBLISH")
+	if p.Qos > Qos0 {
+		s.uint("id", uint64(p.PacketID))
+	}
+	s.str("qos", strconv.Itoa(int(p.Qos)))
+	s.flag("dup", p.IsDup)
+	s.flag("retain", p.IsRetain)
+	s.str("topic", p.TopicName)
+	if p.PayloadReader != nil {
+		s.str("len", strconv.FormatInt(p.PayloadLength, 10))
+		s.flag("stream", true)
+	} else {
+		s.payload(p.Payload)
+	}
+	if p.Props != nil {
+		s.group("props", p.Props.writeString)
+	}
+	return s.String()
+}
+
+func (p *PublishProps) writeString(s *pktString) {
+	s.uint("format", uint64(p.PayloadFormat))
+	s.seconds("expiry", p.MessageExpiryInterval)
+	s.uint("alias", uint64(p.TopicAlias))
+	s.str("resp", p.RespTopic)
+	s.bytes("corr", p.CorrelationData)
+	if len(p.SubIDs) > 0 {
+		ids := make([]string, len(p.SubIDs))
+		for i, id := range p.SubIDs {
+			ids[i] = strconv.Itoa(id)
+		}
+		s.str("sub-ids", "["+strings.Join(ids, " ")+"]")
+	}
+	s.str("type", p.ContentType)
+	s.userProps(p.UserProps)
+}
+
+// ackString describes the publish ack packets
+func ackString(name string, id uint16, code byte, reason string, userProps UserProps) string {
+	s := newPktString(name)
+	s.str("id", strconv.Itoa(int(id)))
+	if code != CodeSuccess {
+		s.code("code", code)
+	}
+	s.group("props", func(s *pktString) {
+		s.str("reason", quote(reason))
+		s.userProps(userProps)
+	})
+	return s.String()
+}
+
+// String of PubAckPacket
+func (p *PubAckPacket) String() string {
+	if p.Props == nil {
+		return ackString("PUBACK", p.PacketID, p.Code, "", nil)
+	}
+	return ackString("PUBACK", p.PacketID, p.Code, p.Props.Reason, p.Props.UserProps)
+}
+
+// String of PubRecvPacket
+func (p *PubRecvPacket) String() string {
+	if p.Props == nil {
+		return ackString("PUBREC", p.PacketID, p.Code, "", nil)
+	}
+	return ackString("PUBREC", p.PacketID, p.Code, p.Props.Reason, p.Props.UserProps)
+}
+
+// String of PubRelPacket
+func (p *PubRelPacket) String() string {
+	if p.Props == nil {
+		return ackString("PUBREL", p.PacketID, p.Code, "", nil)
+	}
+	return ackString("PUBREL", p.PacketID, p.Code, p.Props.Reason, p.Props.UserProps)
+}
+
+// String of PubCompPacket
+func (p *PubCompPacket) String() string {
+	if p.Props == nil {
+		return ackString("PUBCOMP", p.PacketID, p.Code, "", nil)
+	}
+	return ackString("PUBCOMP", p.PacketID, p.Code, p.Props.Reason, p.Props.UserProps)
+}
+
+// String of SubscribePacket, topics are described as name:qos
+func (s *SubscribePacket) String() string {
+	str := newPktString("SUBSCRIBE")
+	str.str("id", strconv.Itoa(int(s.PacketID)))
+	topics := make([]string, len(s.Topics))
+	for i, t := range s.Topics {
+		topics[i] = t.Name + ":" + strconv.Itoa(int(t.Qos))
+	}
+	str.str("topics", "["+strings.Join(topics, " ")+"]")
+	if s.Props != nil {
+		str.group("props", func(str *pktString) {
+			str.uint("sub-id", uint64(s.Props.SubID))
+			str.userProps(s.Props.UserProps)
+		})
+	}
+	return str.String()
+}
+
+// String of SubAckPacket
+func (s *SubAckPacket) String() string {
+	str := newPktString("SUBACK")
+	str.str("id", strconv.Itoa(int(s.PacketID)))
+	codes := make([]string, len(s.Codes))
+	for i, code := range s.Codes {
+		codes[i] = codeString(code)
+	}
+	str.str("codes", "["+strings.Join(codes, " ")+"]")
+	if s.Props != nil {
+		str.group("props", func(str *pktString) {
+			str.str("reason", quote(s.Props.Reason))
+			str.userProps(s.Props.UserProps)
+		})
+	}
+	return str.String()
+}
+
+// String of UnsubPacket
+func (s *UnsubPacket) String() string {
+	str := newPktString("UNSUBSCRIBE")
+	str.str("id", strconv.Itoa(int(s.PacketID)))
+	str.str("topics", "["+strings.Join(s.TopicNames, " ")+"]")
+	if s.Props != nil {
+		str.group("props", func(str *pktString) {
+			str.userProps(s.Props.UserProps)
+		})
+	}
+	return str.String()
+}
+
+// String of UnsubAckPacket
+func (s *UnsubAckPacket) String() string {
+	str := newPktString("UNSUBACK")
+	str.str("id", strconv.Itoa(int(s.PacketID)))
+	if len(s.Codes) > 0 {
+		codes := make([]string, len(s.Codes))
+		for i, code := range s.Codes {
+			codes[i] = codeString(code)
+		}
+		str.str("codes", "["+strings.Join(codes, " ")+"]")
+	}
+	if s.Props != nil {
+		str.group("props", func(str *pktString) {
+			str.str("reason", quote(s.Props.Reason))
+			str.userProps(s.Props.UserProps)
+		})
+	}
+	return str.String()
+}
+
+// quote the reason string if not empty
+func quote(s string) string {
+	if s == "" {
+		return ""
+	}
+	return strconv.Quote(s)
+}
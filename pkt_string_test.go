@@ -0,0 +1,184 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestPacket_String(t *testing.T) {
+	v5 := func(p Packet) Packet {
+		p.SetVersion(V5)
+		return p
+	}
+
+	for _, c := range []struct {
+		pkt    Packet
+		golden string
+	}{
+		{
+			pkt: &ConnPacket{
+				ClientID:     "foo",
+				CleanSession: true,
+				Keepalive:    60,
+				Username:     "admin",
+				Password:     []byte("public"),
+				IsWill:       true,
+				WillTopic:    "will",
+				WillQos:      Qos1,
+				WillRetain:   true,
+				WillMessage:  []byte("bye"),
+			},
+			golden: `CONNECT v=3.1.1 client="foo" clean keepalive=1m0s user=admin password=<redacted> will{topic=will qos=1 retain len=3 data=627965}`,
+		},
+		{
+			pkt: v5(&ConnPacket{
+				WillProps: &WillProps{WillDelayInterval: 10},
+				Props: &ConnProps{
+					SessionExpiryInterval: 3600,
+					MaxRecv:               10,
+					ReqProblemInfo:        False,
+					AuthMethod:            "SCRAM-SHA-1",
+					AuthData:              []byte("secret"),
+					UserProps:             testConstUserProps,
+				},
+			}),
+			golden: `CONNECT v=5 client="" props{session-expiry=1h0m0s max-recv=10 req-problem-info=false auth-method=SCRAM-SHA-1 auth-data=<redacted> user{MQ=TT}}`,
+		},
+		{
+			pkt:    &ConnAckPacket{Present: true, Code: CodeSuccess},
+			golden: `CONNACK code=0x00 present`,
+		},
+		{
+			pkt: v5(&ConnAckPacket{
+				Code:  CodeNotAuthorized,
+				Props: &ConnAckProps{MaxQos: Qos1, RetainAvail: False, ServerKeepalive: 30, Reason: "not allowed"},
+			}),
+			golden: `CONNACK code=0x87 props{max-qos=1 retain-avail=false reason="not allowed" keepalive=30s}`,
+		},
+		{
+			pkt:    &DisconnPacket{},
+			golden: `DISCONNECT`,
+		},
+		{
+			pkt:    v5(&DisconnPacket{Code: CodeServerShuttingDown, Props: &DisconnProps{ServerRef: "other"}}),
+			golden: `DISCONNECT code=0x8b props{server-ref=other}`,
+		},
+		{
+			pkt:    v5(&AuthPacket{Code: CodeContinueAuth, Props: &AuthProps{AuthMethod: "SCRAM-SHA-1", AuthData: []byte("secret")}}),
+			golden: `AUTH code=0x18 props{method=SCRAM-SHA-1 data=<redacted>}`,
+		},
+		{
+			pkt:    PingReqPacket,
+			golden: `PINGREQ`,
+		},
+		{
+			pkt:    PingRespPacket,
+			golden: `PINGRESP`,
+		},
+		{
+			pkt:    &PublishPacket{TopicName: "a/b", Payload: []byte("foo")},
+			golden: `PUBLISH qos=0 topic=a/b len=3 data=666f6f`,
+		},
+		{
+			pkt: v5(&PublishPacket{
+				PacketID:  17,
+				Qos:       Qos1,
+				IsDup:     true,
+				TopicName: "a/b",
+				Payload:   bytes.Repeat([]byte{0xab}, 128),
+				Props:     &PublishProps{MessageExpiryInterval: 30},
+			}),
+			golden: `PUBLISH id=17 qos=1 dup topic=a/b len=128 data=abababababababab.. props{expiry=30s}`,
+		},
+		{
+			pkt: v5(&PublishPacket{
+				PacketID:  1,
+				Qos:       Qos2,
+				IsRetain:  true,
+				TopicName: "a/b",
+				Props: &PublishProps{
+					PayloadFormat:   1,
+					TopicAlias:      2,
+					RespTopic:       "resp",
+					CorrelationData: []byte{1, 2},
+					SubIDs:          []int{1, 2},
+					ContentType:     "text/plain",
+				},
+			}),
+			golden: `PUBLISH id=1 qos=2 retain topic=a/b len=0 props{format=1 alias=2 resp=resp corr=0102 sub-ids=[1 2] type=text/plain}`,
+		},
+		{
+			pkt:    &PublishPacket{TopicName: "a/b", Qos: Qos1, PacketID: 2, PayloadReader: strings.NewReader(""), PayloadLength: 4096},
+			golden: `PUBLISH id=2 qos=1 topic=a/b len=4096 stream`,
+		},
+		{
+			pkt:    &PubAckPacket{PacketID: 1},
+			golden: `PUBACK id=1`,
+		},
+		{
+			pkt:    v5(&PubAckPacket{PacketID: 1, Code: CodeQuotaExceeded, Props: &PubAckProps{Reason: "quota"}}),
+			golden: `PUBACK id=1 code=0x97 props{reason="quota"}`,
+		},
+		{
+			pkt:    &PubRecvPacket{PacketID: 2},
+			golden: `PUBREC id=2`,
+		},
+		{
+			pkt:    v5(&PubRelPacket{PacketID: 2, Props: &PubRelProps{UserProps: testConstUserProps}}),
+			golden: `PUBREL id=2 props{user{MQ=TT}}`,
+		},
+		{
+			pkt:    &PubCompPacket{PacketID: 2},
+			golden: `PUBCOMP id=2`,
+		},
+		{
+			pkt:    &SubscribePacket{PacketID: 3, Topics: []*Topic{{Name: "a/#", Qos: Qos1}, {Name: "b", Qos: Qos0}}},
+			golden: `SUBSCRIBE id=3 topics=[a/#:1 b:0]`,
+		},
+		{
+			pkt:    v5(&SubscribePacket{PacketID: 3, Topics: []*Topic{{Name: "a"}}, Props: &SubscribeProps{SubID: 5}}),
+			golden: `SUBSCRIBE id=3 topics=[a:0] props{sub-id=5}`,
+		},
+		{
+			pkt:    &SubAckPacket{PacketID: 3, Codes: []byte{SubOkMaxQos0, SubOkMaxQos1, SubFail}},
+			golden: `SUBACK id=3 codes=[0x00 0x01 0x80]`,
+		},
+		{
+			pkt:    &UnsubPacket{PacketID: 4, TopicNames: []string{"a", "b"}},
+			golden: `UNSUBSCRIBE id=4 topics=[a b]`,
+		},
+		{
+			pkt:    v5(&UnsubAckPacket{PacketID: 4, Props: &UnsubAckProps{Reason: "ok"}}),
+			golden: `UNSUBACK id=4 props{reason="ok"}`,
+		},
+	} {
+		if s := fmt.Sprint(c.pkt); s != c.golden {
+			t.Errorf("String() of %T\n got: %s\nwant: %s", c.pkt, s, c.golden)
+		}
+	}
+}
+
+func TestPacket_StringRedacted(t *testing.T) {
+	pkt := &ConnPacket{Username: "admin", Password: []byte("public")}
+	if strings.Contains(pkt.String(), "public") {
+		t.Error("password not redacted", pkt)
+	}
+}
@@ -31,6 +31,8 @@ type SubscribePacket struct {
 	PacketID uint16
 	Topics   []*Topic
 	Props    *SubscribeProps
+
+	batch *subBatch // chunks of the subscribe split (see splitSubscribe)
 }
 
 // Type of SubscribePacket is CtrlSubscribe
@@ -39,13 +41,8 @@ func (s *SubscribePacket) Type() CtrlType {
 }
 
 func (s *SubscribePacket) Bytes() []byte {
-	if s == nil {
-		return nil
-	}
-
-	w := new(bytes.Buffer)
-	_ = s.WriteTo(w)
-	return w.Bytes()
+	b, _ := s.MarshalBinary()
+	return b
 }
 
 func (s *SubscribePacket) WriteTo(w BufferedWriter) error {
@@ -53,27 +50,57 @@ func (s *SubscribePacket) WriteTo(w BufferedWriter) error {
 		return ErrEncodeBadPacket
 	}
 
+	payload, err := s.payload()
+	if err != nil {
+		return err
+	}
+
 	const first = CtrlSubscribe<<4 | 0x02
 	varHeader := []byte{byte(s.PacketID >> 8), byte(s.PacketID)}
 	switch s.Version() {
-	case V311:
-		return s.write(w, first, varHeader, s.payload())
+	case V31, V311:
+		return s.write(w, first, varHeader, payload)
 	case V5:
-		return s.writeV5(w, first, varHeader, s.Props.props(), s.payload())
+		props, err := s.Props.props()
+		if err != nil {
+			return err
+		}
+		return s.writeV5(w, first, varHeader, props, payload)
 	default:
 		return ErrUnsupportedVersion
 	}
 }
 
-func (s *SubscribePacket) payload() []byte {
-	var result []byte
-	if s.Topics != nil {
-		for _, t := range s.Topics {
-			result = append(result, encodeStringWithLen(t.Name)...)
+func (s *SubscribePacket) payload() ([]byte, error) {
+	if s.Topics == nil {
+		return nil, nil
+	}
+
+	var err error
+	result := make([]byte, 0, s.payloadSize())
+	for _, t := range s.Topics {
+		if result, err = appendStringWithLen(result, t.Name); err != nil {
+			return nil, err
+		}
+
+		if s.Version() < V5 {
+			// subscription options are only available in MQTT 5
+			result = append(result, t.Qos&subOptionsQos)
+		} else {
 			result = append(result, t.Qos)
 		}
 	}
-	return result
+	return result, nil
+}
+
+// payloadSize is the size of encoded payload
+func (s *SubscribePacket) payloadSize() int {
+	size := 0
+	for _, t := range s.Topics {
+		// string length (2 bytes) + topic + qos (1 byte)
+		size += 2 + len(t.Name) + 1
+	}
+	return size
 }
 
 // SubscribeProps properties for SubscribePacket
@@ -84,23 +111,17 @@ type SubscribeProps struct {
 	UserProps UserProps
 }
 
-func (s *SubscribeProps) props() []byte {
+func (s *SubscribeProps) props() ([]byte, error) {
 	if s == nil {
-		return nil
+		return nil, nil
 	}
 
-	var result []byte
+	propSet := propertySet{}
 	if s.SubID != 0 {
-		subIDBytes, _ := varIntBytes(s.SubID)
-		result = append(result, propKeySubID)
-		result = append(result, subIDBytes...)
-	}
-
-	if s.UserProps != nil {
-		result = append(result, propKeyUserProps)
-		s.UserProps.encodeTo(result)
+		propSet.set(propKeySubID, s.SubID)
 	}
-	return result
+	propSet.set(propKeyUserProps, s.UserProps)
+	return propSet.bytes()
 }
 
 func (s *SubscribeProps) setProps(props map[byte][]byte) {
@@ -137,13 +158,8 @@ func (s *SubAckPacket) Type() CtrlType {
 }
 
 func (s *SubAckPacket) Bytes() []byte {
-	if s == nil {
-		return nil
-	}
-
-	w := new(bytes.Buffer)
-	_ = s.WriteTo(w)
-	return w.Bytes()
+	b, _ := s.MarshalBinary()
+	return b
 }
 
 func (s *SubAckPacket) WriteTo(w BufferedWriter) error {
@@ -154,10 +170,14 @@ func (s *SubAckPacket) WriteTo(w BufferedWriter) error {
 	const first = CtrlSubAck << 4
 	varHeader := []byte{byte(s.PacketID >> 8), byte(s.PacketID)}
 	switch s.Version() {
-	case V311:
+	case V31, V311:
 		return s.write(w, first, varHeader, s.payload())
 	case V5:
-		return s.writeV5(w, first, varHeader, s.Props.props(), s.payload())
+		props, err := s.Props.props()
+		if err != nil {
+			return err
+		}
+		return s.writeV5(w, first, varHeader, props, s.payload())
 	default:
 		return ErrUnsupportedVersion
 	}
@@ -176,9 +196,9 @@ type SubAckProps struct {
 	UserProps UserProps
 }
 
-func (p *SubAckProps) props() []byte {
+func (p *SubAckProps) props() ([]byte, error) {
 	if p == nil {
-		return nil
+		return nil, nil
 	}
 
 	propSet := propertySet{}
@@ -223,13 +243,8 @@ func (s *UnsubPacket) Type() CtrlType {
 }
 
 func (s *UnsubPacket) Bytes() []byte {
-	if s == nil {
-		return nil
-	}
-
-	w := new(bytes.Buffer)
-	_ = s.WriteTo(w)
-	return w.Bytes()
+	b, _ := s.MarshalBinary()
+	return b
 }
 
 func (s *UnsubPacket) WriteTo(w BufferedWriter) error {
@@ -237,26 +252,50 @@ func (s *UnsubPacket) WriteTo(w BufferedWriter) error {
 		return ErrEncodeBadPacket
 	}
 
+	payload, err := s.payload()
+	if err != nil {
+		return err
+	}
+
 	const first = CtrlUnSub<<4 | 0x02
 	varHeader := []byte{byte(s.PacketID >> 8), byte(s.PacketID)}
 	switch s.Version() {
-	case V311:
-		return s.write(w, first, varHeader, s.payload())
+	case V31, V311:
+		return s.write(w, first, varHeader, payload)
 	case V5:
-		return s.writeV5(w, first, varHeader, s.Props.props(), s.payload())
+		props, err := s.Props.props()
+		if err != nil {
+			return err
+		}
+		return s.writeV5(w, first, varHeader, props, payload)
 	default:
 		return ErrUnsupportedVersion
 	}
 }
 
-func (s *UnsubPacket) payload() []byte {
-	var result []byte
-	if s.TopicNames != nil {
-		for _, t := range s.TopicNames {
-			result = append(result, encodeStringWithLen(t)...)
+func (s *UnsubPacket) payload() ([]byte, error) {
+	if s.TopicNames == nil {
+		return nil, nil
+	}
+
+	var err error
+	result := make([]byte, 0, s.payloadSize())
+	for _, t := range s.TopicNames {
+		if result, err = appendStringWithLen(result, t); err != nil {
+			return nil, err
 		}
 	}
-	return result
+	return result, nil
+}
+
+// payloadSize is the size of encoded payload
+func (s *UnsubPacket) payloadSize() int {
+	size := 0
+	for _, t := range s.TopicNames {
+		// string length (2 bytes) + topic
+		size += 2 + len(t)
+	}
+	return size
 }
 
 type UnSubProps = UnsubProps
@@ -267,9 +306,9 @@ type UnsubProps struct {
 	UserProps UserProps
 }
 
-func (p *UnsubProps) props() []byte {
+func (p *UnsubProps) props() ([]byte, error) {
 	if p == nil {
-		return nil
+		return nil, nil
 	}
 
 	propSet := propertySet{}
@@ -296,7 +335,9 @@ type UnSubAckPacket = UnsubAckPacket
 type UnsubAckPacket struct {
 	BasePacket
 	PacketID uint16
-	Props    *UnsubAckProps
+	// Codes are reason codes of topics unsubscribed in order (MQTT 5)
+	Codes []byte
+	Props *UnsubAckProps
 }
 
 // Type of UnsubAckPacket is CtrlUnSubAck
@@ -305,13 +346,8 @@ func (s *UnsubAckPacket) Type() CtrlType {
 }
 
 func (s *UnsubAckPacket) Bytes() []byte {
-	if s == nil {
-		return nil
-	}
-
-	w := new(bytes.Buffer)
-	_ = s.WriteTo(w)
-	return w.Bytes()
+	b, _ := s.MarshalBinary()
+	return b
 }
 
 func (s *UnsubAckPacket) WriteTo(w BufferedWriter) error {
@@ -322,10 +358,14 @@ func (s *UnsubAckPacket) WriteTo(w BufferedWriter) error {
 	const first = CtrlUnSubAck << 4
 	varHeader := []byte{byte(s.PacketID >> 8), byte(s.PacketID)}
 	switch s.Version() {
-	case V311:
+	case V31, V311:
 		return s.write(w, first, varHeader, nil)
 	case V5:
-		return s.writeV5(w, first, varHeader, s.Props.props(), nil)
+		props, err := s.Props.props()
+		if err != nil {
+			return err
+		}
+		return s.writeV5(w, first, varHeader, props, s.Codes)
 	default:
 		return ErrUnsupportedVersion
 	}
@@ -342,9 +382,9 @@ type UnsubAckProps struct {
 	UserProps UserProps
 }
 
-func (p *UnsubAckProps) props() []byte {
+func (p *UnsubAckProps) props() ([]byte, error) {
 	if p == nil {
-		return nil
+		return nil, nil
 	}
 
 	propSet := propertySet{}
@@ -138,6 +138,26 @@ func TestSubscribePacket_Bytes(t *testing.T) {
 	}
 }
 
+func TestSubscribePacket_Options(t *testing.T) {
+	options := Qos1 | SubNoLocal | SubRetainAsPublished | SubRetainHandlingNone
+	for _, c := range []struct {
+		version ProtoVersion
+		options byte
+	}{
+		{V311, Qos1},
+		{V5, options},
+	} {
+		p := &SubscribePacket{BasePacket: BasePacket{ProtoVersion: c.version}, PacketID: 1, Topics: []*Topic{{Name: "/foo", Qos: options}}}
+		payload, err := p.payload()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if opt := payload[len(payload)-1]; opt != c.options {
+			t.Errorf("version %v subscription options = %#x, want %#x", c.version, opt, c.options)
+		}
+	}
+}
+
 func TestSubAckPacket_Bytes(t *testing.T) {
 	for i, p := range testSubAckMsgs {
 		testPacketBytes(V311, p, testSubAckMsgBytesV311[i], t)
@@ -18,6 +18,7 @@ package libmqtt
 
 import (
 	"regexp"
+	"strings"
 	"sync"
 )
 
@@ -27,10 +28,31 @@ type TopicRouter interface {
 	Name() string
 	// Handle defines how to register topic with handler
 	Handle(topic string, h TopicHandleFunc)
+	// Remove defines how to unregister all handlers of the topic
+	Remove(topic string)
 	// Dispatch defines the action to dispatch published packet
 	Dispatch(client Client, p *PublishPacket)
 }
 
+// MatchRouter is the TopicRouter which can report whether the published
+// packet matched any handler, packets matched none are sent to the handler
+// of HandleUnmatched, all routers in this package are MatchRouter, packets
+// dispatched by other routers are treated as matched
+type MatchRouter interface {
+	TopicRouter
+	// DispatchMatched dispatches the published packet as Dispatch,
+	// return false if the packet matched no handler
+	DispatchMatched(client Client, p *PublishPacket) bool
+}
+
+// PublishRouter is the TopicRouter which can route the full publish packet
+// to the handler, all routers in this package are PublishRouter
+type PublishRouter interface {
+	TopicRouter
+	// HandlePublish defines how to register topic with publish packet handler
+	HandlePublish(topic string, h PublishHandleFunc)
+}
+
 // NewStandardRouter will create a standard mqtt router
 func NewStandardRouter() *StandardRouter {
 	return &StandardRouter{m: new(sync.Map)}
@@ -54,11 +76,26 @@ func (s *StandardRouter) Handle(topic string, h TopicHandleFunc) {
 
 }
 
+// HandlePublish defines how to register topic with publish packet handler
+func (s *StandardRouter) HandlePublish(topic string, h PublishHandleFunc) {
+
+}
+
+// Remove defines how to unregister all handlers of the topic
+func (s *StandardRouter) Remove(topic string) {
+
+}
+
 // Dispatch defines the action to dispatch published packet
 func (s *StandardRouter) Dispatch(client Client, p *PublishPacket) {
 
 }
 
+// DispatchMatched dispatches the published packet, no packet is matched
+func (s *StandardRouter) DispatchMatched(client Client, p *PublishPacket) bool {
+	return false
+}
+
 // NewRegexRouter will create a regex router
 func NewRegexRouter() *RegexRouter {
 	return &RegexRouter{m: new(sync.Map)}
@@ -80,25 +117,53 @@ func (r *RegexRouter) Name() string {
 
 // Handle will register the topic with handler
 func (r *RegexRouter) Handle(topicRegex string, h TopicHandleFunc) {
+	r.HandlePublish(topicRegex, h.publishHandler())
+}
+
+// HandlePublish will register the topic with publish packet handler
+func (r *RegexRouter) HandlePublish(topicRegex string, h PublishHandleFunc) {
 	if r == nil || r.m == nil {
 		return
 	}
 	r.m.Store(regexp.MustCompile(topicRegex), h)
 }
 
+// Remove all handlers registered with the exact same regex
+func (r *RegexRouter) Remove(topicRegex string) {
+	if r == nil || r.m == nil {
+		return
+	}
+
+	r.m.Range(func(k, v interface{}) bool {
+		if k.(*regexp.Regexp).String() == topicRegex {
+			r.m.Delete(k)
+		}
+		return true
+	})
+}
+
 // Dispatch the received packet
 func (r *RegexRouter) Dispatch(client Client, p *PublishPacket) {
+	r.DispatchMatched(client, p)
+}
+
+// DispatchMatched dispatches the received packet, return false if no
+// regex matched the topic
+func (r *RegexRouter) DispatchMatched(client Client, p *PublishPacket) bool {
 	if r == nil || r.m == nil {
-		return
+		return false
 	}
 
+	matched := false
 	r.m.Range(func(k, v interface{}) bool {
 		if reg := k.(*regexp.Regexp); reg.MatchString(p.TopicName) {
-			handler := v.(TopicHandleFunc)
-			handler(client, p.TopicName, p.Qos, p.Payload)
+			handler := v.(PublishHandleFunc)
+			handler(client, p)
+			matched = true
 		}
 		return true
 	})
+	return matched
 }
 
 // NewTextRouter will create a text based router
@@ -123,6 +188,11 @@ func (r *TextRouter) Name() string {
 
 // Handle will register the topic with handler
 func (r *TextRouter) Handle(topic string, h TopicHandleFunc) {
+	r.HandlePublish(topic, h.publishHandler())
+}
+
+// HandlePublish will register the topic with publish packet handler
+func (r *TextRouter) HandlePublish(topic string, h PublishHandleFunc) {
 	if r == nil || r.m == nil {
 		return
 	}
@@ -130,14 +200,234 @@ func (r *TextRouter) Handle(topic string, h TopicHandleFunc) {
 	r.m.Store(topic, h)
 }
 
+// Remove the handler of the topic
+func (r *TextRouter) Remove(topic string) {
+	if r == nil || r.m == nil {
+		return
+	}
+
+	r.m.Delete(topic)
+}
+
 // Dispatch the received packet
 func (r *TextRouter) Dispatch(client Client, p *PublishPacket) {
+	r.DispatchMatched(client, p)
+}
+
+// DispatchMatched dispatches the received packet, return false if no
+// handler registered for the topic
+func (r *TextRouter) DispatchMatched(client Client, p *PublishPacket) bool {
 	if r == nil || r.m == nil {
+		return false
+	}
+
+	h, ok := r.m.Load(p.TopicName)
+	if ok {
+		handler := h.(PublishHandleFunc)
+		handler(client, p)
+	}
+	return ok
+}
+
+// NewWildcardRouter will create a router supports MQTT topic wildcards
+func NewWildcardRouter() *WildcardRouter {
+	return &WildcardRouter{root: newTopicNode()}
+}
+
+// WildcardRouter matches topic messages with MQTT topic filters,
+// (both `+` and `#` wildcards are supported) using a trie of topic levels
+//
+// this is the default router in client once a topic filter with wildcards
+// was registered, unless a router was set with WithRouter
+type WildcardRouter struct {
+	mu   sync.RWMutex
+	root *topicNode
+}
+
+type topicNode struct {
+	children map[string]*topicNode
+	handler  PublishHandleFunc
+	stream   StreamHandleFunc // stream handler of the topic filter, see AsyncClient.HandleStream
+}
+
+func newTopicNode() *topicNode {
+	return &topicNode{children: make(map[string]*topicNode)}
+}
+
+// Name of WildcardRouter is "WildcardRouter"
+func (r *WildcardRouter) Name() string {
+	if r == nil {
+		return "<nil>"
+	}
+
+	return "WildcardRouter"
+}
+
+// Handle will register the topic filter with handler
+func (r *WildcardRouter) Handle(topicFilter string, h TopicHandleFunc) {
+	r.HandlePublish(topicFilter, h.publishHandler())
+}
+
+// HandlePublish will register the topic filter with publish packet handler
+func (r *WildcardRouter) HandlePublish(topicFilter string, h PublishHandleFunc) {
+	if r == nil || r.root == nil {
 		return
 	}
 
-	if h, ok := r.m.Load(p.TopicName); ok {
-		handler := h.(TopicHandleFunc)
-		handler(client, p.TopicName, p.Qos, p.Payload)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.root.node(topicFilter).handler = h
+}
+
+// handleStream registers the topic filter with stream handler
+func (r *WildcardRouter) handleStream(topicFilter string, h StreamHandleFunc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.root.node(topicFilter).stream = h
+}
+
+// streamHandler returns the stream handler of the first topic filter
+// matched, nil if none matched
+func (r *WildcardRouter) streamHandler(topic string) StreamHandleFunc {
+	if r == nil || r.root == nil {
+		return nil
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, n := range r.root.match(strings.Split(topic, "/"), nil, true) {
+		if n.stream != nil {
+			return n.stream
+		}
+	}
+	return nil
+}
+
+// node returns the node of the topic filter, created if not exists
+func (n *topicNode) node(topicFilter string) *topicNode {
+	node := n
+	for _, level := range strings.Split(topicFilter, "/") {
+		next, ok := node.children[level]
+		if !ok {
+			next = newTopicNode()
+			node.children[level] = next
+		}
+		node = next
+	}
+	return node
+}
+
+// routed returns true if the node has any handler
+func (n *topicNode) routed() bool {
+	return n.handler != nil || n.stream != nil
+}
+
+// Remove the handler (and stream handler) of the topic filter
+func (r *WildcardRouter) Remove(topicFilter string) {
+	if r == nil || r.root == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	levels := strings.Split(topicFilter, "/")
+	path := make([]*topicNode, 0, len(levels)+1)
+
+	node := r.root
+	path = append(path, node)
+	for _, level := range levels {
+		next, ok := node.children[level]
+		if !ok {
+			return
+		}
+		node = next
+		path = append(path, node)
+	}
+	node.handler, node.stream = nil, nil
+
+	// prune nodes without handler and children
+	for i := len(levels); i > 0; i-- {
+		n := path[i]
+		if n.routed() || len(n.children) > 0 {
+			break
+		}
+		delete(path[i-1].children, levels[i-1])
+	}
+}
+
+// Dispatch the received packet to all handlers with matched topic filter
+func (r *WildcardRouter) Dispatch(client Client, p *PublishPacket) {
+	r.DispatchMatched(client, p)
+}
+
+// DispatchMatched dispatches the received packet to all handlers with
+// matched topic filter, return false if no topic filter matched
+func (r *WildcardRouter) DispatchMatched(client Client, p *PublishPacket) bool {
+	if r == nil || r.root == nil {
+		return false
 	}
+
+	r.mu.RLock()
+	var handlers []PublishHandleFunc
+	for _, n := range r.root.match(strings.Split(p.TopicName, "/"), nil, true) {
+		if n.handler != nil {
+			handlers = append(handlers, n.handler)
+		}
+	}
+	r.mu.RUnlock()
+
+	for _, h := range handlers {
+		h(client, p)
+	}
+	return len(handlers) > 0
+}
+
+// match returns the nodes with handlers of topic filters matched the topic
+func (n *topicNode) match(levels []string, result []*topicNode, first bool) []*topicNode {
+	// topics starting with `$` MUST NOT be matched by
+	// topic filters starting with a wildcard character
+	wildcardAllowed := !first || !strings.HasPrefix(levels[0], "$")
+
+	if wildcardAllowed {
+		// `#` matches any number of child levels
+		if next, ok := n.children["#"]; ok && next.routed() {
+			result = append(result, next)
+		}
+	}
+
+	if next, ok := n.children[levels[0]]; ok {
+		result = next.matchNext(levels[1:], result)
+	}
+
+	if wildcardAllowed {
+		if next, ok := n.children["+"]; ok {
+			result = next.matchNext(levels[1:], result)
+		}
+	}
+
+	return result
+}
+
+func (n *topicNode) matchNext(levels []string, result []*topicNode) []*topicNode {
+	if len(levels) == 0 {
+		if n.routed() {
+			result = append(result, n)
+		}
+
+		// `sport/#` also matches `sport`
+		if next, ok := n.children["#"]; ok && next.routed() {
+			result = append(result, next)
+		}
+		return result
+	}
+
+	return n.match(levels, result, false)
+}
+
+func isWildcardTopic(topic string) bool {
+	return strings.ContainsAny(topic, "+#")
 }
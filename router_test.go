@@ -17,8 +17,13 @@
 package libmqtt
 
 import (
+	"bytes"
+	"io"
 	"math/rand"
+	"reflect"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -104,3 +109,532 @@ func TestRegexRouter_Dispatch(t *testing.T) {
 func TestRestRouter_Dispatch(t *testing.T) {
 
 }
+
+func testRouterRemove(r TopicRouter, t *testing.T) {
+	var removedCount, keptCount int32
+	r.Handle("/removed", func(client Client, topic string, qos QosLevel, msg []byte) {
+		atomic.AddInt32(&removedCount, 1)
+	})
+	r.Handle("/kept", func(client Client, topic string, qos QosLevel, msg []byte) {
+		atomic.AddInt32(&keptCount, 1)
+	})
+
+	r.Dispatch(nil, &PublishPacket{TopicName: "/removed"})
+	r.Remove("/removed")
+
+	// dispatch and remove concurrently
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 100; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			r.Dispatch(nil, &PublishPacket{TopicName: "/removed"})
+			r.Dispatch(nil, &PublishPacket{TopicName: "/kept"})
+		}()
+		go func() {
+			defer wg.Done()
+			r.Remove("/removed")
+		}()
+	}
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&removedCount); n != 1 {
+		t.Error("removed handler called after removal, count =", n)
+	}
+
+	if n := atomic.LoadInt32(&keptCount); n != 100 {
+		t.Error("kept handler not called, count =", n)
+	}
+}
+
+func TestTextRouter_Remove(t *testing.T) {
+	testRouterRemove(NewTextRouter(), t)
+}
+
+func TestRegexRouter_Remove(t *testing.T) {
+	testRouterRemove(NewRegexRouter(), t)
+}
+
+func TestRouter_RemoveQueued(t *testing.T) {
+	c := defaultClient()
+	c.recvCh = make(chan *PublishPacket, 10)
+	c.unsubRemovesHandler = true
+
+	var count int32
+	c.HandleTopic("/test", func(client Client, topic string, qos QosLevel, msg []byte) {
+		atomic.AddInt32(&count, 1)
+	})
+
+	// messages already queued before the handler removal
+	for i := 0; i < cap(c.recvCh); i++ {
+		c.recvCh <- &PublishPacket{TopicName: "/test"}
+	}
+
+	c.Unsubscribe("/test")
+	<-c.sendCh
+
+	c.addWorker(c.handleTopicMsg)
+	for len(c.recvCh) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	c.Destroy(true)
+	c.Wait()
+
+	if n := atomic.LoadInt32(&count); n != 0 {
+		t.Error("removed handler called for queued messages, count =", n)
+	}
+}
+
+func TestWildcardRouter_Dispatch(t *testing.T) {
+	cases := []struct {
+		filter  string
+		topic   string
+		matched bool
+	}{
+		{"sport/tennis/player1", "sport/tennis/player1", true},
+		{"sport/tennis/player1", "sport/tennis/player2", false},
+		{"sport/tennis/player1/#", "sport/tennis/player1", true},
+		{"sport/tennis/player1/#", "sport/tennis/player1/ranking", true},
+		{"sport/tennis/player1/#", "sport/tennis/player1/score/wimbledon", true},
+		{"sport/#", "sport", true},
+		{"#", "sport/tennis", true},
+		{"#", "/", true},
+		{"sport/tennis/+", "sport/tennis/player1", true},
+		{"sport/tennis/+", "sport/tennis/player1/tournament", false},
+		{"sport/+", "sport", false},
+		{"sport/+", "sport/", true},
+		{"+/+", "/finance", true},
+		{"/+", "/finance", true},
+		{"+", "/finance", false},
+		{"+/tennis/#", "sport/tennis/player1", true},
+		{"#", "$SYS/broker/load", false},
+		{"+/broker/load", "$SYS/broker/load", false},
+		{"$SYS/#", "$SYS/broker/load", true},
+		{"$SYS/+/load", "$SYS/broker/load", true},
+	}
+
+	for _, c := range cases {
+		r := NewWildcardRouter()
+		matched := false
+		r.Handle(c.filter, func(client Client, topic string, qos QosLevel, msg []byte) {
+			if topic != c.topic {
+				t.Error("fail at topic =", topic, ", target topic =", c.topic)
+			}
+			matched = true
+		})
+		r.Dispatch(nil, &PublishPacket{TopicName: c.topic})
+
+		if matched != c.matched {
+			t.Errorf("filter = %q, topic = %q, matched = %v, target = %v", c.filter, c.topic, matched, c.matched)
+		}
+	}
+}
+
+func TestWildcardRouter_MultipleMatch(t *testing.T) {
+	r := NewWildcardRouter()
+	count := 0
+	for _, f := range []string{"a/b/c", "a/+/c", "a/#", "+/b/+", "#", "a/b/c/#", "b/#"} {
+		r.Handle(f, func(client Client, topic string, qos QosLevel, msg []byte) {
+			count++
+		})
+	}
+
+	r.Dispatch(nil, &PublishPacket{TopicName: "a/b/c"})
+	if count != 6 {
+		t.Error("dispatch failed, count =", count)
+	}
+
+	r.Remove("a/b/c/#")
+	r.Remove("not/registered")
+	count = 0
+	r.Dispatch(nil, &PublishPacket{TopicName: "a/b/c"})
+	if count != 5 {
+		t.Error("dispatch after remove failed, count =", count)
+	}
+}
+
+func TestWildcardRouter_Remove(t *testing.T) {
+	testRouterRemove(NewWildcardRouter(), t)
+
+	r := NewWildcardRouter()
+	r.Handle("a/+/c", func(client Client, topic string, qos QosLevel, msg []byte) {})
+	r.Remove("a/+/c")
+	if len(r.root.children) != 0 {
+		t.Error("empty topic nodes not pruned")
+	}
+
+	r.handleStream("a/#", func(client Client, topic string, qos QosLevel, r io.Reader) error { return nil })
+	r.Remove("a/#")
+	if r.streamHandler("a/b") != nil {
+		t.Error("stream handler not removed")
+	}
+	if len(r.root.children) != 0 {
+		t.Error("topic nodes of stream handler not pruned")
+	}
+}
+
+func TestClient_DefaultWildcardRouter(t *testing.T) {
+	c := defaultClient()
+	count := 0
+	c.HandleTopic("/foo", func(client Client, topic string, qos QosLevel, msg []byte) {
+		count++
+	})
+	if _, ok := c.getRouter().(*TextRouter); !ok {
+		t.Error("default router is not TextRouter")
+	}
+
+	c.HandleTopic("/bar/+", func(client Client, topic string, qos QosLevel, msg []byte) {
+		count++
+	})
+	if _, ok := c.getRouter().(*WildcardRouter); !ok {
+		t.Error("default router not switched to WildcardRouter")
+	}
+
+	c.getRouter().Dispatch(c, &PublishPacket{TopicName: "/foo"})
+	c.getRouter().Dispatch(c, &PublishPacket{TopicName: "/bar/baz"})
+	if count != 2 {
+		t.Error("dispatch failed, count =", count)
+	}
+
+	custom := defaultClient()
+	_ = WithRouter(NewTextRouter())(custom, &custom.options)
+	custom.HandleTopic("/bar/+", func(client Client, topic string, qos QosLevel, msg []byte) {})
+	if _, ok := custom.getRouter().(*TextRouter); !ok {
+		t.Error("custom router replaced")
+	}
+}
+
+func benchmarkRouterDispatch(b *testing.B, r TopicRouter, filter func(i int) string) {
+	const subCount = 10000
+	for i := 0; i < subCount; i++ {
+		r.Handle(filter(i), func(client Client, topic string, qos QosLevel, msg []byte) {})
+	}
+
+	pkt := &PublishPacket{TopicName: "sensors/" + strconv.Itoa(subCount/2) + "/temp"}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.Dispatch(nil, pkt)
+	}
+}
+
+func BenchmarkWildcardRouter_Dispatch(b *testing.B) {
+	benchmarkRouterDispatch(b, NewWildcardRouter(), func(i int) string {
+		return "sensors/" + strconv.Itoa(i) + "/+"
+	})
+}
+
+func BenchmarkRegexRouter_Dispatch(b *testing.B) {
+	benchmarkRouterDispatch(b, NewRegexRouter(), func(i int) string {
+		return `^sensors/` + strconv.Itoa(i) + `/[^/]*$`
+	})
+}
+
+func TestClient_HandleUnmatched(t *testing.T) {
+	c := defaultClient()
+	c.HandleTopic("/foo", func(client Client, topic string, qos QosLevel, msg []byte) {})
+
+	var unmatched []*PublishPacket
+	c.HandleUnmatched(func(client Client, topic string, qos QosLevel, msg []byte) {
+		unmatched = append(unmatched, &PublishPacket{TopicName: topic, Qos: qos, Payload: msg})
+	})
+
+	c.dispatch(&PublishPacket{TopicName: "/foo", Qos: Qos1, Payload: []byte("foo")})
+	c.dispatch(&PublishPacket{TopicName: "/bar", Qos: Qos2, Payload: []byte("bar")})
+
+	if n := c.Stats().UnmatchedMessages; n != 1 {
+		t.Error("unmatched message count =", n)
+	}
+
+	if len(unmatched) != 1 {
+		t.Fatal("unmatched handler count =", len(unmatched))
+	}
+
+	if p := unmatched[0]; p.TopicName != "/bar" || p.Qos != Qos2 || string(p.Payload) != "bar" {
+		t.Error("unexpected unmatched packet =", p)
+	}
+}
+
+// legacyRouter implements TopicRouter only
+type legacyRouter struct {
+	dispatched int
+}
+
+func (r *legacyRouter) Name() string                             { return "legacy" }
+func (r *legacyRouter) Handle(topic string, h TopicHandleFunc)   {}
+func (r *legacyRouter) Remove(topic string)                      {}
+func (r *legacyRouter) Dispatch(client Client, p *PublishPacket) { r.dispatched++ }
+
+func TestClient_LegacyRouter(t *testing.T) {
+	r := &legacyRouter{}
+	c, err := NewClient(WithRouter(r))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.HandleUnmatched(func(client Client, topic string, qos QosLevel, msg []byte) {
+		t.Error("unmatched handler called for router without match result")
+	})
+
+	c.dispatch(&PublishPacket{TopicName: "/foo"})
+	if r.dispatched != 1 || c.Stats().UnmatchedMessages != 0 {
+		t.Error("unexpected dispatch, dispatched =", r.dispatched, "unmatched =", c.Stats().UnmatchedMessages)
+	}
+}
+
+func TestClient_SubscribeHandle(t *testing.T) {
+	c := defaultClient()
+	var specific, generic int
+	c.SubscribeHandle(func(client Client, topic string, qos QosLevel, msg []byte) {
+		specific++
+	}, &Topic{Name: "sensors/+"})
+	<-c.sendCh
+	c.SubscribeHandle(func(client Client, topic string, qos QosLevel, msg []byte) {
+		generic++
+	}, &Topic{Name: "sensors/#"})
+	pkt := (<-c.sendCh).(*SubscribePacket)
+	if pkt.Props == nil || pkt.Props.SubID != 2 {
+		t.Fatal("unexpected subscription identifier, props =", pkt.Props)
+	}
+
+	// both subscriptions overlap, dispatch by subscription identifier
+	c.dispatch(&PublishPacket{TopicName: "sensors/1", Props: &PublishProps{SubIDs: []int{1}}})
+	if specific != 1 || generic != 0 {
+		t.Error("subscription identifier dispatch failed", specific, generic)
+	}
+
+	// no subscription identifier, fallback to topic matching
+	c.dispatch(&PublishPacket{TopicName: "sensors/1"})
+	if specific != 2 || generic != 1 {
+		t.Error("topic dispatch failed", specific, generic)
+	}
+
+	c.Unsubscribe("sensors/+")
+	<-c.sendCh
+	if _, ok := c.subIDRoutes[1]; ok {
+		t.Error("subscription identifier route not removed")
+	}
+}
+
+func TestClient_SubscribeHandleMultipleSubIDs(t *testing.T) {
+	c := defaultClient()
+	counts := make([]int, 3)
+	for i, topic := range []string{"sensors/+", "sensors/#", "+/1"} {
+		i := i
+		c.SubscribeHandle(func(client Client, topic string, qos QosLevel, msg []byte) {
+			counts[i]++
+		}, &Topic{Name: topic})
+		<-c.sendCh
+	}
+
+	for _, pub := range []struct {
+		raw    []byte
+		counts []int
+	}{
+		// two identifiers
+		{[]byte{propKeySubID, 0x01, propKeySubID, 0x02}, []int{1, 1, 0}},
+		// three identifiers
+		{[]byte{propKeySubID, 0x03, propKeySubID, 0x01, propKeySubID, 0x02}, []int{2, 2, 1}},
+		// identifier included more than once, dispatched once
+		{[]byte{propKeySubID, 0x02, propKeySubID, 0x02, propKeySubID, 0x03}, []int{2, 3, 2}},
+	} {
+		body := append([]byte{0x00, 0x09, 's', 'e', 'n', 's', 'o', 'r', 's', '/', '1', byte(len(pub.raw))}, pub.raw...)
+		pkt, err := Decode(V5, bytes.NewReader(append([]byte{CtrlPublish << 4, byte(len(body))}, body...)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c.dispatch(pkt.(*PublishPacket))
+		if !reflect.DeepEqual(counts, pub.counts) {
+			t.Error("unexpected handler calls =", counts, "want =", pub.counts)
+		}
+	}
+}
+
+func TestClient_HandlePublish(t *testing.T) {
+	c := defaultClient()
+	var topicCount int
+	c.HandleTopic("/foo", func(client Client, topic string, qos QosLevel, msg []byte) {
+		topicCount++
+	})
+
+	var received []*PublishPacket
+	c.HandlePublish("/bar/+", func(client Client, p *PublishPacket) {
+		received = append(received, p)
+	})
+
+	pkt := &PublishPacket{
+		TopicName: "/bar/baz",
+		Payload:   []byte("bar"),
+		Props: &PublishProps{
+			ContentType:           "text/plain",
+			RespTopic:             "/resp",
+			CorrelationData:       []byte("id"),
+			UserProps:             UserProps{{Key: "foo", Value: "bar"}},
+			MessageExpiryInterval: 10,
+		},
+	}
+	c.dispatch(&PublishPacket{TopicName: "/foo"})
+	c.dispatch(pkt)
+
+	if topicCount != 1 {
+		t.Error("topic handler not called after router switch, count =", topicCount)
+	}
+
+	if len(received) != 1 || received[0] != pkt {
+		t.Fatal("publish handler not called with the packet, received =", received)
+	}
+
+	regex := NewRegexRouter()
+	count := 0
+	regex.HandlePublish("^/bar/.*", func(client Client, p *PublishPacket) {
+		if p.Props.ContentType == "text/plain" {
+			count++
+		}
+	})
+	regex.Dispatch(nil, pkt)
+	if count != 1 {
+		t.Error("regex publish handler count =", count)
+	}
+}
+
+func TestClient_HandlerPanic(t *testing.T) {
+	c := defaultClient()
+	const count = 10
+
+	var panics int32
+	_ = WithHandlerPanicHandler(func(client Client, topic string, v interface{}, stack []byte) {
+		if topic == "/panic" && v == "foo" && len(stack) > 0 {
+			atomic.AddInt32(&panics, 1)
+		}
+	})(c, &c.options)
+
+	wg := new(sync.WaitGroup)
+	wg.Add(count)
+	c.HandleTopic("/panic", func(client Client, topic string, qos QosLevel, msg []byte) {
+		panic("foo")
+	})
+	c.HandleTopic("/ok", func(client Client, topic string, qos QosLevel, msg []byte) {
+		wg.Done()
+	})
+
+	go c.handleTopicMsg()
+	for i := 0; i < count; i++ {
+		c.recvCh <- &PublishPacket{TopicName: "/panic"}
+		c.recvCh <- &PublishPacket{TopicName: "/ok"}
+	}
+
+	wg.Wait()
+	c.workers.Wait()
+	c.exit()
+
+	if n := atomic.LoadInt32(&panics); n != count {
+		t.Error("recovered panic count =", n)
+	}
+}
+
+func TestClient_HandlerConcurrency(t *testing.T) {
+	for _, n := range []int{1, 4} {
+		c := defaultClient()
+		_ = WithHandlerConcurrency(n)(c, &c.options)
+		if depth := c.Stats().HandlerQueueDepth; len(depth) != n {
+			t.Fatal("handler queue count =", len(depth))
+		}
+
+		const count = 100
+		topics := []string{"/a", "/b", "/c", "/d"}
+		mu := new(sync.Mutex)
+		var all []string
+		received := make(map[string][]int)
+
+		wg := new(sync.WaitGroup)
+		wg.Add(count * len(topics))
+		for _, topic := range topics {
+			c.HandleTopic(topic, func(client Client, topic string, qos QosLevel, msg []byte) {
+				i, _ := strconv.Atoi(string(msg))
+				mu.Lock()
+				received[topic] = append(received[topic], i)
+				all = append(all, topic+string(msg))
+				mu.Unlock()
+				wg.Done()
+			})
+		}
+
+		go c.handleTopicMsg()
+		var sent []string
+		for i := 0; i < count; i++ {
+			for _, topic := range topics {
+				c.recvCh <- &PublishPacket{TopicName: topic, Payload: []byte(strconv.Itoa(i))}
+				sent = append(sent, topic+strconv.Itoa(i))
+			}
+		}
+		wg.Wait()
+		c.exit()
+
+		for topic, seq := range received {
+			for i, v := range seq {
+				if i != v {
+					t.Fatal("out of order, n =", n, "topic =", topic, "received =", seq)
+				}
+			}
+		}
+
+		if n == 1 {
+			for i := range sent {
+				if all[i] != sent[i] {
+					t.Fatal("out of order with single worker, received =", all)
+				}
+			}
+		}
+	}
+}
+
+func TestClient_StreamHandlerMatch(t *testing.T) {
+	for _, c := range []struct {
+		filter, topic string
+		match         bool
+	}{
+		{"sport/tennis", "sport/tennis", true},
+		{"sport/+", "sport/tennis", true},
+		{"sport/+", "sport/tennis/player", false},
+		{"sport/#", "sport", true},
+		{"sport/#", "sport/tennis/player", true},
+		{"#", "sport", true},
+		{"+/+", "/finance", true},
+		{"#", "$SYS/foo", false},
+		{"+/foo", "$SYS/foo", false},
+		{"$SYS/#", "$SYS/foo", true},
+		{"sport/tennis", "sport/golf", false},
+	} {
+		client := defaultClient()
+		client.HandleStream(c.filter, func(client Client, topic string, qos QosLevel, r io.Reader) error { return nil })
+		if match := client.streamMatcher()(c.topic); match != c.match {
+			t.Errorf("filter %q, topic %q: match = %v", c.filter, c.topic, match)
+		}
+	}
+}
+
+func TestClient_StreamHandlerPrecedence(t *testing.T) {
+	client := defaultClient()
+	if client.streamMatcher() != nil {
+		t.Error("stream matcher without stream handlers")
+	}
+
+	var called string
+	client.HandleStream("sport/#", func(client Client, topic string, qos QosLevel, r io.Reader) error {
+		called = "filter"
+		return nil
+	})
+	client.HandleStream("sport/tennis", func(client Client, topic string, qos QosLevel, r io.Reader) error {
+		called = "name"
+		return nil
+	})
+
+	_ = client.streamHandler("sport/tennis")(client, "sport/tennis", Qos0, nil)
+	if called != "name" {
+		t.Error("topic name handler not preferred, called =", called)
+	}
+
+	if n := testing.AllocsPerRun(100, func() { _ = client.streamMatcher() }); n != 0 {
+		t.Error("stream matcher allocated per call, allocs =", n)
+	}
+}
@@ -0,0 +1,336 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sort"
+)
+
+var (
+	// ErrBadSession used when the exported session data can not be decoded
+	ErrBadSession = errors.New("bad session data ")
+
+	// ErrUnsupportedSession used when the exported session data is of
+	// version newer than supported
+	ErrUnsupportedSession = errors.New("unsupported session version ")
+)
+
+// sessionVersion is the version of the exported session format, which
+// MUST be increased once the format of existing records changed
+//
+// the session data is the version byte followed by records, every record
+// is the record type byte, the length of the record body (big endian
+// uint32) and the record body, records of unknown types are ignored
+const sessionVersion byte = 1
+
+// session record types
+const (
+	// persisted packet: [key (length prefixed)][MQTT version][packet]
+	sessionRecordPersist byte = 1
+	// subscription: [server (length prefixed)][topic (length prefixed)]
+	// [granted QoS][subscription identifier (uint32)][requested options]
+	// the requested options byte is omitted if same as the granted QoS
+	sessionRecordSub byte = 2
+	// packet id in use by publish packet: [id (uint16)][MQTT version][packet]
+	sessionRecordPacketID byte = 3
+	// packet id allocator: [last generated id (uint16)]
+	sessionRecordLastID byte = 4
+)
+
+// sessionEntry is the persisted packet with key
+type sessionEntry struct {
+	key string
+	pkt Packet
+}
+
+// sessionState is the session exported from the client
+type sessionState struct {
+	persisted []*sessionEntry
+	subs      []*subscription
+	packetIDs map[uint16]*PublishPacket
+	lastID    uint16
+}
+
+// ExportSession exports the session state of the client, including the
+// persisted packets of the client, the subscriptions acked by servers and
+// the packet id allocator state, the data can be restored in another
+// process with WithImportedSession
+//
+// the session should be exported once the client stopped sending and
+// receiving (e.g. after Destroy), the data format is stable across
+// library versions
+func (c *AsyncClient) ExportSession() ([]byte, error) {
+	s := &sessionState{
+		packetIDs: make(map[uint16]*PublishPacket),
+		lastID:    c.idGen.lastID(),
+	}
+
+	seen := make(map[string]struct{})
+	c.rangeOwnPersisted(func(key, server string, send bool, id uint16, p Packet) {
+		seen[key] = struct{}{}
+		s.persisted = append(s.persisted, &sessionEntry{key: key, pkt: p})
+	})
+
+	c.qos2Mu.Lock()
+	for key, p := range c.qos2Recv {
+		if _, ok := seen[key]; !ok {
+			s.persisted = append(s.persisted, &sessionEntry{key: key, pkt: p})
+		}
+	}
+	c.qos2Mu.Unlock()
+
+	c.subsMu.RLock()
+	for _, sub := range c.subs {
+		s.subs = append(s.subs, sub)
+	}
+	c.subsMu.RUnlock()
+
+	for id, extra := range c.idGen.extras() {
+		if pub, ok := extra.(*PublishPacket); ok && pub.Qos > Qos0 {
+			if !pub.replayable() {
+				return nil, ErrPayloadNotReplayable
+			}
+			s.packetIDs[id] = pub
+		}
+	}
+
+	return s.encode(), nil
+}
+
+// importSession restores the exported session state
+func (c *AsyncClient) importSession(s *sessionState) error {
+	packets := make(map[string]Packet)
+	c.qos2Mu.Lock()
+	for _, e := range s.persisted {
+		packets[e.key] = e.pkt
+		if _, _, send, _, ok := parseKey(e.key); ok && !send {
+			if pub, isPub := e.pkt.(*PublishPacket); isPub {
+				c.qos2Recv[e.key] = pub
+			}
+		}
+	}
+	c.qos2Mu.Unlock()
+
+	if err := AsBatchPersist(c.persist).StoreBatch(packets); err != nil {
+		return err
+	}
+
+	c.subsMu.Lock()
+	for _, sub := range s.subs {
+		c.subs[subscriptionKey{server: sub.server, topic: sub.topic}] = sub
+	}
+	c.subsMu.Unlock()
+
+	extras := make(map[uint16]interface{})
+	for id, p := range s.packetIDs {
+		extras[id] = p
+	}
+	c.idGen.restore(s.lastID, extras)
+
+	c.log.i("CLI imported session, persisted =", len(s.persisted), "subscriptions =", len(s.subs), "packet ids =", len(s.packetIDs))
+	return nil
+}
+
+// encode the session state, records are sorted so the same state is
+// always encoded to the same data
+func (s *sessionState) encode() []byte {
+	buf := &bytes.Buffer{}
+	buf.WriteByte(sessionVersion)
+
+	writeRecord := func(typ byte, body []byte) {
+		header := [5]byte{typ}
+		binary.BigEndian.PutUint32(header[1:], uint32(len(body)))
+		buf.Write(header[:])
+		buf.Write(body)
+	}
+
+	sort.Slice(s.persisted, func(i, j int) bool { return s.persisted[i].key < s.persisted[j].key })
+	for _, e := range s.persisted {
+		body, err := appendStringWithLen(nil, e.key)
+		if err != nil {
+			// can not be decoded
+			continue
+		}
+		encoded, err := e.pkt.MarshalBinary()
+		if err != nil {
+			// can not be encoded
+			continue
+		}
+		body = append(body, byte(e.pkt.Version()))
+		writeRecord(sessionRecordPersist, append(body, encoded...))
+	}
+
+	sort.Slice(s.subs, func(i, j int) bool {
+		if s.subs[i].server != s.subs[j].server {
+			return s.subs[i].server < s.subs[j].server
+		}
+		return s.subs[i].topic < s.subs[j].topic
+	})
+	for _, sub := range s.subs {
+		body, err := appendStringWithLen(nil, sub.server)
+		if err == nil {
+			body, err = appendStringWithLen(body, sub.topic)
+		}
+		if err != nil {
+			// can not be decoded
+			continue
+		}
+		body = append(body, sub.qos, 0, 0, 0, 0)
+		putUint32(body[len(body)-4:], uint32(sub.subID))
+		if sub.options != sub.qos {
+			body = append(body, sub.options)
+		}
+		writeRecord(sessionRecordSub, body)
+	}
+
+	ids := make([]int, 0, len(s.packetIDs))
+	for id := range s.packetIDs {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		p := s.packetIDs[uint16(id)]
+		encoded, err := p.MarshalBinary()
+		if err != nil {
+			// can not be encoded
+			continue
+		}
+		body := []byte{byte(id >> 8), byte(id), byte(p.Version())}
+		writeRecord(sessionRecordPacketID, append(body, encoded...))
+	}
+
+	writeRecord(sessionRecordLastID, []byte{byte(s.lastID >> 8), byte(s.lastID)})
+	return buf.Bytes()
+}
+
+// decodeSession decodes the session data encoded by sessionState.encode
+func decodeSession(data []byte) (*sessionState, error) {
+	if len(data) < 1 {
+		return nil, ErrBadSession
+	}
+
+	if data[0] > sessionVersion || data[0] == 0 {
+		return nil, ErrUnsupportedSession
+	}
+
+	s := &sessionState{packetIDs: make(map[uint16]*PublishPacket)}
+	for next := data[1:]; len(next) > 0; {
+		if len(next) < 5 {
+			return nil, ErrBadSession
+		}
+
+		typ, size := next[0], getUint32(next[1:5])
+		if uint64(size) > uint64(len(next)-5) {
+			return nil, ErrBadSession
+		}
+		body := next[5 : 5+size]
+		next = next[5+size:]
+
+		var err error
+		switch typ {
+		case sessionRecordPersist:
+			err = s.decodePersisted(body)
+		case sessionRecordSub:
+			err = s.decodeSub(body)
+		case sessionRecordPacketID:
+			err = s.decodePacketID(body)
+		case sessionRecordLastID:
+			if len(body) < 2 {
+				return nil, ErrBadSession
+			}
+			s.lastID = getUint16(body)
+		}
+
+		if err != nil {
+			return nil, ErrBadSession
+		}
+	}
+	return s, nil
+}
+
+func (s *sessionState) decodePersisted(body []byte) error {
+	key, body, err := getStringData(body)
+	if err != nil {
+		return err
+	}
+
+	pkt, err := decodeSessionPacket(body)
+	if err != nil {
+		return err
+	}
+	s.persisted = append(s.persisted, &sessionEntry{key: key, pkt: pkt})
+	return nil
+}
+
+func (s *sessionState) decodeSub(body []byte) error {
+	server, body, err := getStringData(body)
+	if err != nil {
+		return err
+	}
+
+	topic, body, err := getStringData(body)
+	if err != nil {
+		return err
+	}
+
+	if len(body) < 5 {
+		return ErrBadSession
+	}
+
+	sub := &subscription{
+		server:  server,
+		topic:   topic,
+		qos:     body[0],
+		subID:   int(getUint32(body[1:])),
+		options: body[0],
+	}
+	if len(body) > 5 {
+		sub.options = body[5]
+	}
+	s.subs = append(s.subs, sub)
+	return nil
+}
+
+func (s *sessionState) decodePacketID(body []byte) error {
+	if len(body) < 2 {
+		return ErrBadSession
+	}
+
+	pkt, err := decodeSessionPacket(body[2:])
+	if err != nil {
+		return err
+	}
+
+	pub, ok := pkt.(*PublishPacket)
+	if !ok {
+		return ErrBadSession
+	}
+	s.packetIDs[getUint16(body)] = pub
+	return nil
+}
+
+// decodeSessionPacket decodes the MQTT version byte and the packet
+func decodeSessionPacket(data []byte) (Packet, error) {
+	if len(data) < 2 {
+		return nil, ErrBadSession
+	}
+
+	return Decode(ProtoVersion(data[0]), bytes.NewReader(data[1:]))
+}
@@ -0,0 +1,198 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testSessionFixture = "testdata/session-v1.bin"
+
+// testSessionState is the session state encoded in testSessionFixture
+func testSessionState() *sessionState {
+	ns := persistNamespace("cid", "fake")
+
+	recv := &PublishPacket{TopicName: "/recv", Qos: Qos2, PacketID: 7, Payload: []byte("foo")}
+	send := &PublishPacket{TopicName: "/foo", Qos: Qos1, PacketID: 1, Payload: []byte("bar"),
+		Props: &PublishProps{ContentType: "text/plain"}}
+	send.SetVersion(V5)
+	qos2 := &PublishPacket{TopicName: "/bar", Qos: Qos2, PacketID: 2, Payload: []byte("baz")}
+
+	return &sessionState{
+		persisted: []*sessionEntry{
+			{key: recvKey(ns, 7), pkt: recv},
+			{key: sendKey(ns, 1), pkt: send},
+			{key: sendKey(ns, 2), pkt: &PubRelPacket{PacketID: 2}},
+		},
+		subs: []*subscription{
+			{server: "fake", topic: "/a/#", qos: Qos1, subID: 3, options: Qos1},
+			{server: "fake", topic: "/b", qos: Qos0, options: Qos0},
+		},
+		packetIDs: map[uint16]*PublishPacket{1: send, 2: qos2},
+		lastID:    2,
+	}
+}
+
+func assertSessionState(t *testing.T, expected, actual *sessionState) {
+	if !assert.Len(t, actual.persisted, len(expected.persisted)) {
+		return
+	}
+	for i, e := range expected.persisted {
+		assert.Equal(t, e.key, actual.persisted[i].key)
+		assert.Equal(t, e.pkt.Version(), actual.persisted[i].pkt.Version())
+		assert.Equal(t, e.pkt.Bytes(), actual.persisted[i].pkt.Bytes())
+	}
+
+	assert.Equal(t, expected.subs, actual.subs)
+	assert.Equal(t, expected.lastID, actual.lastID)
+	if !assert.Len(t, actual.packetIDs, len(expected.packetIDs)) {
+		return
+	}
+	for id, p := range expected.packetIDs {
+		if assert.Contains(t, actual.packetIDs, id) {
+			assert.Equal(t, p.Bytes(), actual.packetIDs[id].Bytes())
+		}
+	}
+}
+
+func TestSession_Fixture(t *testing.T) {
+	data, err := ioutil.ReadFile(testSessionFixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := decodeSession(data)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assertSessionState(t, testSessionState(), s)
+
+	// format is stable
+	assert.Equal(t, data, testSessionState().encode())
+}
+
+func TestSession_Decode(t *testing.T) {
+	data := testSessionState().encode()
+
+	// records of unknown types are ignored
+	unknown := append(append([]byte{}, data...), 0xff, 0, 0, 0, 3, 1, 2, 3)
+	s, err := decodeSession(unknown)
+	if assert.NoError(t, err) {
+		assertSessionState(t, testSessionState(), s)
+	}
+
+	// requested options kept if different from granted QoS
+	opts := &sessionState{subs: []*subscription{{server: "fake", topic: "/c", qos: Qos0, options: Qos1 | subOptionNoLocal}}}
+	s, err = decodeSession(opts.encode())
+	if assert.NoError(t, err) {
+		assert.Equal(t, opts.subs, s.subs)
+	}
+
+	for i := 1; i < len(data); i++ {
+		if _, err := decodeSession(data[:i]); err != nil {
+			assert.Equal(t, ErrBadSession, err, "offset = %d", i)
+		}
+	}
+
+	_, err = decodeSession(nil)
+	assert.Equal(t, ErrBadSession, err)
+
+	_, err = decodeSession(append([]byte{sessionVersion + 1}, data[1:]...))
+	assert.Equal(t, ErrUnsupportedSession, err)
+
+	_, err = NewClient(WithImportedSession([]byte{sessionVersion, sessionRecordSub, 0, 0, 0, 1, 0}))
+	assert.Equal(t, ErrBadSession, err)
+}
+
+func TestClient_ExportSession(t *testing.T) {
+	expected := testSessionState()
+	persist := NewMemPersist(nil)
+
+	c, err := NewClient(WithPersist(persist), WithClientID("cid"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer c.Destroy(true)
+
+	for _, e := range expected.persisted {
+		if _, _, send, _, _ := parseKey(e.key); send {
+			assert.NoError(t, persist.Store(e.key, e.pkt))
+		} else {
+			c.storeQos2(persistNamespace("cid", "fake"), e.pkt.(*PublishPacket))
+		}
+	}
+	c.addSubscriptions("fake", []*Topic{{Name: "/a/#"}, {Name: "/c"}}, []byte{Qos1, Qos2}, []byte{SubOkMaxQos1, SubFail}, 3)
+	c.addSubscriptions("fake", []*Topic{{Name: "/b"}}, []byte{Qos0}, []byte{SubOkMaxQos0}, 0)
+	c.idGen.next(expected.packetIDs[1])
+	c.idGen.next(expected.packetIDs[2])
+	c.idGen.next(&SubscribePacket{})
+	c.idGen.markDone(3)
+
+	data, err := c.ExportSession()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	s, err := decodeSession(data)
+	if !assert.NoError(t, err) {
+		return
+	}
+	expected.lastID = 3
+	assertSessionState(t, expected, s)
+
+	// restore in another process
+	restored, err := NewClient(WithCleanSession(true), WithPersist(NewMemPersist(nil)), WithClientID("cid"), WithImportedSession(data))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer restored.Destroy(true)
+
+	assert.Equal(t, data, mustExportSession(t, restored), "session changed by import")
+	assert.False(t, restored.options.connPacket.CleanSession)
+	assert.False(t, restored.storeQos2(persistNamespace("cid", "fake"), &PublishPacket{Qos: Qos2, PacketID: 7}), "duplicate not detected")
+
+	pkt, ok := restored.persist.Load(sendKey(persistNamespace("cid", "fake"), 1))
+	if assert.True(t, ok) {
+		assert.Equal(t, V5, pkt.Version())
+		assert.Equal(t, "text/plain", pkt.(*PublishPacket).Props.ContentType)
+	}
+
+	extra, ok := restored.idGen.getExtra(2)
+	if assert.True(t, ok) {
+		assert.Equal(t, "/bar", extra.(*PublishPacket).TopicName)
+	}
+	assert.Equal(t, uint16(4), restored.idGen.next(&PublishPacket{}))
+
+	// sessions can be imported without persist
+	restored, err = NewClient(WithClientID("cid"), WithImportedSession(data))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer restored.Destroy(true)
+	assert.False(t, restored.storeQos2(persistNamespace("cid", "fake"), &PublishPacket{Qos: Qos2, PacketID: 7}), "duplicate not detected")
+}
+
+func mustExportSession(t *testing.T, c Client) []byte {
+	data, err := c.ExportSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
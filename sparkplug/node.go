@@ -0,0 +1,179 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sparkplug
+
+import (
+	"sync"
+	"time"
+
+	"github.com/goiiot/libmqtt"
+)
+
+// BdSeqMetric is the name of the birth/death sequence number metric of
+// NBIRTH and NDEATH messages
+const BdSeqMetric = "bdSeq"
+
+// now is replaced in tests
+var now = time.Now
+
+// EdgeNode builds the messages of the edge node and its devices, with the
+// sequence number (0 to 255, reset by NBIRTH) and the bdSeq (incremented
+// for every connect attempt) tracked
+type EdgeNode struct {
+	group string
+	id    string
+
+	mu       sync.Mutex
+	seq      uint64 // next sequence number
+	bdSeq    uint64 // bdSeq of the current connection
+	connects int    // connect attempts
+}
+
+// NewEdgeNode creates the edge node of the group, returns ErrBadID if the
+// ids are not valid topic levels
+func NewEdgeNode(group, id string) (*EdgeNode, error) {
+	if !validID(group) || !validID(id) {
+		return nil, ErrBadID
+	}
+	return &EdgeNode{group: group, id: id}, nil
+}
+
+// Topic of the message type of the edge node, device is ignored for edge
+// node message types
+func (n *EdgeNode) Topic(t MessageType, device string) string {
+	return Topic{Group: n.group, Type: t, EdgeNode: n.id, Device: device}.String()
+}
+
+// Options registers the NDEATH death certificate as the will message (QoS
+// 1, not retained), the bdSeq of the will is incremented for every connect
+// attempt (including reconnects) with a send interceptor, the NBIRTH
+// built by Birth after connected has the same bdSeq, options MUST be
+// passed to libmqtt.NewClient since send interceptors are client wide
+func (n *EdgeNode) Options() []libmqtt.Option {
+	return []libmqtt.Option{
+		libmqtt.WithWill(n.Topic(NDEATH, ""), libmqtt.Qos1, false, nil),
+		libmqtt.WithSendInterceptor(func(server string, pkt libmqtt.Packet) libmqtt.Packet {
+			conn, ok := pkt.(*libmqtt.ConnPacket)
+			if !ok || !conn.IsWill {
+				return pkt
+			}
+
+			n.mu.Lock()
+			if n.connects > 0 {
+				n.bdSeq = (n.bdSeq + 1) % 256
+			}
+			n.connects++
+			death, err := n.deathPayload()
+			n.mu.Unlock()
+
+			if err != nil {
+				return pkt
+			}
+
+			conn = conn.Clone().(*libmqtt.ConnPacket)
+			conn.WillMessage = death
+			return conn
+		}),
+	}
+}
+
+// Birth builds the NBIRTH message with metrics and the bdSeq metric of
+// the current connection, the sequence number is reset to 0, publish it
+// once connected (e.g. in the ConnHandleFunc) before other messages
+func (n *EdgeNode) Birth(metrics ...Metric) (*libmqtt.PublishPacket, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.seq = 0
+	metrics = append(append([]Metric(nil), metrics...), Metric{Name: BdSeqMetric, DataType: TypeUInt64, Value: n.bdSeq})
+	return n.message(n.Topic(NBIRTH, ""), metrics)
+}
+
+// Death builds the NDEATH message with the bdSeq of the current
+// connection, to be published before disconnecting intentionally
+func (n *EdgeNode) Death() (*libmqtt.PublishPacket, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	payload, err := n.deathPayload()
+	if err != nil {
+		return nil, err
+	}
+	return &libmqtt.PublishPacket{TopicName: n.Topic(NDEATH, ""), Qos: libmqtt.Qos1, Payload: payload}, nil
+}
+
+// Data builds the NDATA message with metrics
+func (n *EdgeNode) Data(metrics ...Metric) (*libmqtt.PublishPacket, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.message(n.Topic(NDATA, ""), metrics)
+}
+
+// DeviceBirth builds the DBIRTH message of the device with metrics
+func (n *EdgeNode) DeviceBirth(device string, metrics ...Metric) (*libmqtt.PublishPacket, error) {
+	return n.deviceMessage(DBIRTH, device, metrics)
+}
+
+// DeviceData builds the DDATA message of the device with metrics
+func (n *EdgeNode) DeviceData(device string, metrics ...Metric) (*libmqtt.PublishPacket, error) {
+	return n.deviceMessage(DDATA, device, metrics)
+}
+
+// DeviceDeath builds the DDEATH message of the device
+func (n *EdgeNode) DeviceDeath(device string) (*libmqtt.PublishPacket, error) {
+	return n.deviceMessage(DDEATH, device, nil)
+}
+
+func (n *EdgeNode) deviceMessage(t MessageType, device string, metrics []Metric) (*libmqtt.PublishPacket, error) {
+	if !validID(device) {
+		return nil, ErrBadID
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.message(n.Topic(t, device), metrics)
+}
+
+// message builds the QoS 0 message with the next sequence number, MUST be
+// called with n.mu held
+func (n *EdgeNode) message(topic string, metrics []Metric) (*libmqtt.PublishPacket, error) {
+	p := &Payload{Timestamp: timestamp(), Metrics: metrics, Seq: n.seq, HasSeq: true}
+	data, err := p.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	n.seq = (n.seq + 1) % 256
+	return &libmqtt.PublishPacket{TopicName: topic, Qos: libmqtt.Qos0, Payload: data}, nil
+}
+
+// deathPayload is the NDEATH payload (without sequence number), MUST be
+// called with n.mu held
+func (n *EdgeNode) deathPayload() ([]byte, error) {
+	p := &Payload{
+		Timestamp: timestamp(),
+		Metrics:   []Metric{{Name: BdSeqMetric, DataType: TypeUInt64, Value: n.bdSeq}},
+	}
+	return p.Marshal()
+}
+
+// timestamp is the current time in milliseconds since epoch
+func timestamp() uint64 {
+	return uint64(now().UnixNano() / int64(time.Millisecond))
+}
@@ -0,0 +1,187 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package sparkplug
+
+import (
+	"testing"
+	"time"
+
+	"github.com/goiiot/libmqtt"
+	"github.com/goiiot/libmqtt/mqtttest"
+)
+
+func decodePayload(t *testing.T, data []byte) *Payload {
+	t.Helper()
+
+	var p Payload
+	if err := p.Unmarshal(data); err != nil {
+		t.Fatal(err)
+	}
+	return &p
+}
+
+func bdSeq(p *Payload) (uint64, bool) {
+	for _, m := range p.Metrics {
+		if m.Name == BdSeqMetric {
+			v, ok := m.Value.(uint64)
+			return v, ok
+		}
+	}
+	return 0, false
+}
+
+func TestEdgeNode_Messages(t *testing.T) {
+	defer func() { now = time.Now }()
+	now = func() time.Time { return time.Unix(1700000000, 0) }
+
+	n, err := NewEdgeNode("plant", "node")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	temp, _ := NewMetric("temperature", 21.5)
+	birth, err := n.Birth(temp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if birth.TopicName != "spBv1.0/plant/NBIRTH/node" || birth.Qos != libmqtt.Qos0 || birth.IsRetain {
+		t.Error("unexpected NBIRTH =", birth)
+	}
+
+	p := decodePayload(t, birth.Payload)
+	if seq, ok := bdSeq(p); !ok || seq != 0 || p.Seq != 0 || !p.HasSeq || p.Timestamp != 1700000000000 || len(p.Metrics) != 2 {
+		t.Errorf("unexpected NBIRTH payload = %+v", p)
+	}
+
+	for i := 1; i < 300; i++ {
+		var (
+			msg *libmqtt.PublishPacket
+			err error
+		)
+		switch i % 3 {
+		case 0:
+			msg, err = n.Data(temp)
+		case 1:
+			msg, err = n.DeviceBirth("device", temp)
+		case 2:
+			msg, err = n.DeviceData("device", temp)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if seq := decodePayload(t, msg.Payload).Seq; seq != uint64(i%256) {
+			t.Fatal("unexpected seq =", seq, "want =", i%256)
+		}
+	}
+
+	death, err := n.DeviceDeath("device")
+	if err != nil || death.TopicName != "spBv1.0/plant/DDEATH/node/device" {
+		t.Error("unexpected DDEATH =", death, "err =", err)
+	}
+
+	// reset by NBIRTH
+	if birth, err = n.Birth(); err != nil || decodePayload(t, birth.Payload).Seq != 0 {
+		t.Error("seq not reset, err =", err)
+	}
+
+	death, err = n.Death()
+	if err != nil || death.TopicName != "spBv1.0/plant/NDEATH/node" || death.Qos != libmqtt.Qos1 {
+		t.Fatal("unexpected NDEATH =", death, "err =", err)
+	}
+	if p := decodePayload(t, death.Payload); p.HasSeq || len(p.Metrics) != 1 {
+		t.Errorf("unexpected NDEATH payload = %+v", p)
+	}
+
+	if _, err := n.DeviceData("dev/ice"); err != ErrBadID {
+		t.Error("unexpected error =", err)
+	}
+	if _, err := NewEdgeNode("plant", ""); err != ErrBadID {
+		t.Error("unexpected error =", err)
+	}
+}
+
+func TestEdgeNode_Will(t *testing.T) {
+	// closed once NBIRTH received, reconnected
+	b := mqtttest.NewTestBroker(mqtttest.WithCloseAfter(2))
+	defer func() { _ = b.Close() }()
+
+	n, err := NewEdgeNode("plant", "node")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	connected := make(chan error, 10)
+	client, err := libmqtt.NewClient(append(n.Options(),
+		libmqtt.WithCustomConnector(b.Connector()),
+		libmqtt.WithAutoReconnect(true),
+		libmqtt.WithBackoffStrategy(10*time.Millisecond, 10*time.Millisecond, 1),
+		libmqtt.WithConnHandleFunc(func(client libmqtt.Client, server string, code byte, err error) {
+			if err == nil {
+				birth, err := n.Birth()
+				if err != nil {
+					t.Error(err)
+				}
+				client.Publish(birth)
+			}
+			connected <- err
+		}),
+	)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Destroy(true)
+
+	if err := client.ConnectServer("broker"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-connected:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout")
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	var wills, births []uint64
+	for len(births) < 2 && time.Now().Before(deadline) {
+		wills, births = nil, nil
+		for _, pkt := range b.Received() {
+			switch p := pkt.(type) {
+			case *libmqtt.ConnPacket:
+				if !p.IsWill || p.WillTopic != "spBv1.0/plant/NDEATH/node" || p.WillQos != libmqtt.Qos1 || p.WillRetain {
+					t.Fatal("unexpected will =", p)
+				}
+				seq, _ := bdSeq(decodePayload(t, p.WillMessage))
+				wills = append(wills, seq)
+			case *libmqtt.PublishPacket:
+				seq, _ := bdSeq(decodePayload(t, p.Payload))
+				births = append(births, seq)
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// bdSeq of NBIRTH matches the will of the connection
+	if len(wills) < 2 || len(births) < 2 || wills[0] != 0 || wills[1] != 1 || births[0] != 0 || births[1] != 1 {
+		t.Error("unexpected bdSeq, wills =", wills, "births =", births)
+	}
+}
@@ -0,0 +1,521 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sparkplug
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"time"
+)
+
+var (
+	// ErrBadPayload is returned when decoding malformed payloads
+	ErrBadPayload = errors.New("sparkplug: bad payload ")
+	// ErrUnsupportedType is returned when encoding metrics of data types
+	// not supported (e.g. DataSet and Template) or values not matching the
+	// data type
+	ErrUnsupportedType = errors.New("sparkplug: unsupported metric type ")
+)
+
+// DataType of metric values
+type DataType uint32
+
+// Sparkplug B data types
+const (
+	TypeUnknown  DataType = 0
+	TypeInt8     DataType = 1
+	TypeInt16    DataType = 2
+	TypeInt32    DataType = 3
+	TypeInt64    DataType = 4
+	TypeUInt8    DataType = 5
+	TypeUInt16   DataType = 6
+	TypeUInt32   DataType = 7
+	TypeUInt64   DataType = 8
+	TypeFloat    DataType = 9
+	TypeDouble   DataType = 10
+	TypeBoolean  DataType = 11
+	TypeString   DataType = 12
+	TypeDateTime DataType = 13
+	TypeText     DataType = 14
+	TypeUUID     DataType = 15
+	TypeDataSet  DataType = 16
+	TypeBytes    DataType = 17
+	TypeFile     DataType = 18
+	TypeTemplate DataType = 19
+)
+
+// Payload is the Sparkplug B payload, it implements Marshal and Unmarshal
+// to be used with libmqtt.ProtobufCodec
+type Payload struct {
+	// Timestamp is the time in milliseconds since epoch, 0 if not set
+	Timestamp uint64
+	Metrics   []Metric
+	// Seq is the sequence number, only encoded if HasSeq
+	Seq    uint64
+	HasSeq bool
+	UUID   string
+	Body   []byte
+}
+
+// Metric of the payload
+type Metric struct {
+	Name string
+	// Alias is only encoded if HasAlias
+	Alias    uint64
+	HasAlias bool
+	// Timestamp is the time in milliseconds since epoch, 0 if not set
+	Timestamp uint64
+	// DataType of the value, inferred from the value if TypeUnknown when
+	// encoding
+	DataType     DataType
+	IsHistorical bool
+	IsTransient  bool
+	IsNull       bool
+
+	// Value of the metric, the Go type of data types:
+	//
+	//	TypeInt8 to TypeInt64     int8, int16, int32, int64
+	//	TypeUInt8 to TypeUInt64   uint8, uint16, uint32, uint64
+	//	TypeFloat, TypeDouble     float32, float64
+	//	TypeBoolean               bool
+	//	TypeString, Text, UUID    string
+	//	TypeDateTime              time.Time
+	//	TypeBytes, TypeFile       []byte
+	//
+	// values are converted to the data type when encoding (e.g. an int
+	// value of TypeInt16), nil if IsNull or not supported when decoding
+	Value interface{}
+}
+
+// NewMetric creates the metric with the data type of the value (int is
+// TypeInt64 and uint is TypeUInt64), returns ErrUnsupportedType if the
+// value has no data type
+func NewMetric(name string, value interface{}) (Metric, error) {
+	t := typeOf(value)
+	if t == TypeUnknown {
+		return Metric{}, ErrUnsupportedType
+	}
+	return Metric{Name: name, DataType: t, Value: value}, nil
+}
+
+func typeOf(v interface{}) DataType {
+	switch v.(type) {
+	case int8:
+		return TypeInt8
+	case int16:
+		return TypeInt16
+	case int32:
+		return TypeInt32
+	case int64, int:
+		return TypeInt64
+	case uint8:
+		return TypeUInt8
+	case uint16:
+		return TypeUInt16
+	case uint32:
+		return TypeUInt32
+	case uint64, uint:
+		return TypeUInt64
+	case float32:
+		return TypeFloat
+	case float64:
+		return TypeDouble
+	case bool:
+		return TypeBoolean
+	case string:
+		return TypeString
+	case time.Time:
+		return TypeDateTime
+	case []byte:
+		return TypeBytes
+	default:
+		return TypeUnknown
+	}
+}
+
+// field numbers of the Sparkplug B schema
+const (
+	fieldPayloadTimestamp = 1
+	fieldPayloadMetrics   = 2
+	fieldPayloadSeq       = 3
+	fieldPayloadUUID      = 4
+	fieldPayloadBody      = 5
+
+	fieldMetricName         = 1
+	fieldMetricAlias        = 2
+	fieldMetricTimestamp    = 3
+	fieldMetricDataType     = 4
+	fieldMetricIsHistorical = 5
+	fieldMetricIsTransient  = 6
+	fieldMetricIsNull       = 7
+	fieldMetricInt          = 10
+	fieldMetricLong         = 11
+	fieldMetricFloat        = 12
+	fieldMetricDouble       = 13
+	fieldMetricBoolean      = 14
+	fieldMetricString       = 15
+	fieldMetricBytes        = 16
+)
+
+// protobuf wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// Marshal the payload with the protobuf wire format
+func (p *Payload) Marshal() ([]byte, error) {
+	var buf []byte
+	if p.Timestamp != 0 {
+		buf = appendVarintField(buf, fieldPayloadTimestamp, p.Timestamp)
+	}
+
+	for i := range p.Metrics {
+		m, err := p.Metrics[i].marshal()
+		if err != nil {
+			return nil, err
+		}
+		buf = appendBytesField(buf, fieldPayloadMetrics, m)
+	}
+
+	if p.HasSeq {
+		buf = appendVarintField(buf, fieldPayloadSeq, p.Seq)
+	}
+	if p.UUID != "" {
+		buf = appendBytesField(buf, fieldPayloadUUID, []byte(p.UUID))
+	}
+	if p.Body != nil {
+		buf = appendBytesField(buf, fieldPayloadBody, p.Body)
+	}
+	return buf, nil
+}
+
+func (m *Metric) marshal() ([]byte, error) {
+	t := m.DataType
+	if t == TypeUnknown {
+		t = typeOf(m.Value)
+	}
+
+	var buf []byte
+	if m.Name != "" {
+		buf = appendBytesField(buf, fieldMetricName, []byte(m.Name))
+	}
+	if m.HasAlias {
+		buf = appendVarintField(buf, fieldMetricAlias, m.Alias)
+	}
+	if m.Timestamp != 0 {
+		buf = appendVarintField(buf, fieldMetricTimestamp, m.Timestamp)
+	}
+	buf = appendVarintField(buf, fieldMetricDataType, uint64(t))
+	if m.IsHistorical {
+		buf = appendVarintField(buf, fieldMetricIsHistorical, 1)
+	}
+	if m.IsTransient {
+		buf = appendVarintField(buf, fieldMetricIsTransient, 1)
+	}
+	if m.IsNull || m.Value == nil {
+		return appendVarintField(buf, fieldMetricIsNull, 1), nil
+	}
+
+	switch t {
+	case TypeInt8, TypeInt16, TypeInt32:
+		v, ok := toInt64(m.Value)
+		if !ok {
+			return nil, ErrUnsupportedType
+		}
+		// signed values are stored as two's complement in uint32
+		return appendVarintField(buf, fieldMetricInt, uint64(uint32(v))), nil
+	case TypeUInt8, TypeUInt16, TypeUInt32:
+		v, ok := toUint64(m.Value)
+		if !ok {
+			return nil, ErrUnsupportedType
+		}
+		return appendVarintField(buf, fieldMetricInt, uint64(uint32(v))), nil
+	case TypeInt64:
+		v, ok := toInt64(m.Value)
+		if !ok {
+			return nil, ErrUnsupportedType
+		}
+		return appendVarintField(buf, fieldMetricLong, uint64(v)), nil
+	case TypeUInt64:
+		v, ok := toUint64(m.Value)
+		if !ok {
+			return nil, ErrUnsupportedType
+		}
+		return appendVarintField(buf, fieldMetricLong, v), nil
+	case TypeDateTime:
+		v, ok := m.Value.(time.Time)
+		if !ok {
+			return nil, ErrUnsupportedType
+		}
+		return appendVarintField(buf, fieldMetricLong, uint64(v.UnixNano()/int64(time.Millisecond))), nil
+	case TypeFloat:
+		v, ok := toFloat64(m.Value)
+		if !ok {
+			return nil, ErrUnsupportedType
+		}
+		var b [4]byte
+		binary.LittleEndian.PutUint32(b[:], math.Float32bits(float32(v)))
+		return append(appendTag(buf, fieldMetricFloat, wireFixed32), b[:]...), nil
+	case TypeDouble:
+		v, ok := toFloat64(m.Value)
+		if !ok {
+			return nil, ErrUnsupportedType
+		}
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], math.Float64bits(v))
+		return append(appendTag(buf, fieldMetricDouble, wireFixed64), b[:]...), nil
+	case TypeBoolean:
+		v, ok := m.Value.(bool)
+		if !ok {
+			return nil, ErrUnsupportedType
+		}
+		var b uint64
+		if v {
+			b = 1
+		}
+		return appendVarintField(buf, fieldMetricBoolean, b), nil
+	case TypeString, TypeText, TypeUUID:
+		v, ok := m.Value.(string)
+		if !ok {
+			return nil, ErrUnsupportedType
+		}
+		return appendBytesField(buf, fieldMetricString, []byte(v)), nil
+	case TypeBytes, TypeFile:
+		v, ok := m.Value.([]byte)
+		if !ok {
+			return nil, ErrUnsupportedType
+		}
+		return appendBytesField(buf, fieldMetricBytes, v), nil
+	default:
+		return nil, ErrUnsupportedType
+	}
+}
+
+// Unmarshal the payload encoded with the protobuf wire format, unknown
+// fields are skipped
+func (p *Payload) Unmarshal(data []byte) error {
+	*p = Payload{}
+	return decodeFields(data, func(field int, wire int, v uint64, b []byte) error {
+		switch {
+		case field == fieldPayloadTimestamp && wire == wireVarint:
+			p.Timestamp = v
+		case field == fieldPayloadMetrics && wire == wireBytes:
+			var m Metric
+			if err := m.unmarshal(b); err != nil {
+				return err
+			}
+			p.Metrics = append(p.Metrics, m)
+		case field == fieldPayloadSeq && wire == wireVarint:
+			p.Seq, p.HasSeq = v, true
+		case field == fieldPayloadUUID && wire == wireBytes:
+			p.UUID = string(b)
+		case field == fieldPayloadBody && wire == wireBytes:
+			p.Body = append([]byte{}, b...)
+		}
+		return nil
+	})
+}
+
+func (m *Metric) unmarshal(data []byte) error {
+	var (
+		value    uint64
+		bytes    []byte
+		hasValue bool
+		wireType int
+	)
+
+	err := decodeFields(data, func(field int, wire int, v uint64, b []byte) error {
+		switch {
+		case field == fieldMetricName && wire == wireBytes:
+			m.Name = string(b)
+		case field == fieldMetricAlias && wire == wireVarint:
+			m.Alias, m.HasAlias = v, true
+		case field == fieldMetricTimestamp && wire == wireVarint:
+			m.Timestamp = v
+		case field == fieldMetricDataType && wire == wireVarint:
+			m.DataType = DataType(v)
+		case field == fieldMetricIsHistorical && wire == wireVarint:
+			m.IsHistorical = v != 0
+		case field == fieldMetricIsTransient && wire == wireVarint:
+			m.IsTransient = v != 0
+		case field == fieldMetricIsNull && wire == wireVarint:
+			m.IsNull = v != 0
+		case field >= fieldMetricInt && field <= fieldMetricBytes:
+			value, bytes, hasValue, wireType = v, b, true, wire
+		}
+		return nil
+	})
+	if err != nil || m.IsNull || !hasValue {
+		return err
+	}
+
+	switch m.DataType {
+	case TypeInt8:
+		m.Value = int8(uint32(value))
+	case TypeInt16:
+		m.Value = int16(uint32(value))
+	case TypeInt32:
+		m.Value = int32(uint32(value))
+	case TypeInt64:
+		m.Value = int64(value)
+	case TypeUInt8:
+		m.Value = uint8(value)
+	case TypeUInt16:
+		m.Value = uint16(value)
+	case TypeUInt32:
+		m.Value = uint32(value)
+	case TypeUInt64:
+		m.Value = value
+	case TypeDateTime:
+		m.Value = time.Unix(0, int64(value)*int64(time.Millisecond))
+	case TypeFloat:
+		if wireType != wireFixed32 {
+			return ErrBadPayload
+		}
+		m.Value = math.Float32frombits(uint32(value))
+	case TypeDouble:
+		if wireType != wireFixed64 {
+			return ErrBadPayload
+		}
+		m.Value = math.Float64frombits(value)
+	case TypeBoolean:
+		m.Value = value != 0
+	case TypeString, TypeText, TypeUUID:
+		m.Value = string(bytes)
+	case TypeBytes, TypeFile:
+		m.Value = append([]byte{}, bytes...)
+	}
+	return nil
+}
+
+func toInt64(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int8:
+		return int64(n), true
+	case int16:
+		return int64(n), true
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	case int:
+		return int64(n), true
+	default:
+		u, ok := toUint64(v)
+		return int64(u), ok
+	}
+}
+
+func toUint64(v interface{}) (uint64, bool) {
+	switch n := v.(type) {
+	case uint8:
+		return uint64(n), true
+	case uint16:
+		return uint64(n), true
+	case uint32:
+		return uint64(n), true
+	case uint64:
+		return n, true
+	case uint:
+		return uint64(n), true
+	case int8, int16, int32, int64, int:
+		i, _ := toInt64(v)
+		return uint64(i), true
+	default:
+		return 0, false
+	}
+}
+
+func toFloat64(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float32:
+		return float64(n), true
+	case float64:
+		return n, true
+	default:
+		return 0, false
+	}
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	return append(buf, b[:binary.PutUvarint(b[:], v)]...)
+}
+
+func appendTag(buf []byte, field, wire int) []byte {
+	return appendUvarint(buf, uint64(field<<3|wire))
+}
+
+func appendVarintField(buf []byte, field int, v uint64) []byte {
+	return appendUvarint(appendTag(buf, field, wireVarint), v)
+}
+
+func appendBytesField(buf []byte, field int, b []byte) []byte {
+	buf = appendUvarint(appendTag(buf, field, wireBytes), uint64(len(b)))
+	return append(buf, b...)
+}
+
+// decodeFields calls f with every field of the message, v is the value
+// of varint and fixed fields, b is the data of length-delimited fields
+func decodeFields(data []byte, f func(field int, wire int, v uint64, b []byte) error) error {
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 || tag>>3 == 0 {
+			return ErrBadPayload
+		}
+		data = data[n:]
+
+		var (
+			v uint64
+			b []byte
+		)
+		switch wire := int(tag & 0x07); wire {
+		case wireVarint:
+			if v, n = binary.Uvarint(data); n <= 0 {
+				return ErrBadPayload
+			}
+			data = data[n:]
+		case wireFixed64:
+			if len(data) < 8 {
+				return ErrBadPayload
+			}
+			v, data = binary.LittleEndian.Uint64(data), data[8:]
+		case wireFixed32:
+			if len(data) < 4 {
+				return ErrBadPayload
+			}
+			v, data = uint64(binary.LittleEndian.Uint32(data)), data[4:]
+		case wireBytes:
+			size, n := binary.Uvarint(data)
+			if n <= 0 || size > uint64(len(data)-n) {
+				return ErrBadPayload
+			}
+			b, data = data[n:n+int(size)], data[n+int(size):]
+		default:
+			return ErrBadPayload
+		}
+
+		if err := f(int(tag>>3), int(tag&0x07), v, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package sparkplug
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/goiiot/libmqtt"
+)
+
+func TestPayload_Marshal(t *testing.T) {
+	p := &Payload{
+		Timestamp: 1,
+		Metrics:   []Metric{{Name: "a", DataType: TypeInt8, Value: int8(-1)}},
+		Seq:       2,
+		HasSeq:    true,
+	}
+
+	data, err := p.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// timestamp, metric (name, datatype, int_value) and seq
+	expected := []byte{0x08, 0x01, 0x12, 0x0b, 0x0a, 0x01, 'a', 0x20, 0x01, 0x50, 0xff, 0xff, 0xff, 0xff, 0x0f, 0x18, 0x02}
+	if !bytes.Equal(data, expected) {
+		t.Errorf("unexpected payload = % x", data)
+	}
+}
+
+func TestPayload_RoundTrip(t *testing.T) {
+	ts := time.Unix(1700000000, 123*int64(time.Millisecond))
+	p := &Payload{
+		Timestamp: 1700000000123,
+		Seq:       255,
+		HasSeq:    true,
+		UUID:      "uuid",
+		Body:      []byte("body"),
+		Metrics: []Metric{
+			{Name: "int8", DataType: TypeInt8, Value: int8(math.MinInt8)},
+			{Name: "int16", DataType: TypeInt16, Value: int16(math.MinInt16)},
+			{Name: "int32", DataType: TypeInt32, Value: int32(math.MinInt32)},
+			{Name: "int64", DataType: TypeInt64, Value: int64(math.MinInt64)},
+			{Name: "uint8", DataType: TypeUInt8, Value: uint8(math.MaxUint8)},
+			{Name: "uint16", DataType: TypeUInt16, Value: uint16(math.MaxUint16)},
+			{Name: "uint32", DataType: TypeUInt32, Value: uint32(math.MaxUint32)},
+			{Name: "uint64", DataType: TypeUInt64, Value: uint64(math.MaxUint64)},
+			{Name: "float", DataType: TypeFloat, Value: float32(1.5)},
+			{Name: "double", DataType: TypeDouble, Value: 2.5},
+			{Name: "bool", DataType: TypeBoolean, Value: true},
+			{Name: "string", DataType: TypeString, Value: "foo"},
+			{Name: "text", DataType: TypeText, Value: "bar"},
+			{Name: "datetime", DataType: TypeDateTime, Value: ts},
+			{Name: "bytes", DataType: TypeBytes, Value: []byte{1, 2}},
+			{Name: "null", DataType: TypeInt32, IsNull: true},
+			{Alias: 0, HasAlias: true, Timestamp: 1, DataType: TypeBoolean, IsHistorical: true, IsTransient: true, Value: false},
+		},
+	}
+
+	data, err := p.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded Payload
+	if err := decoded.Unmarshal(data); err != nil {
+		t.Fatal(err)
+	}
+
+	datetime := decoded.Metrics[13].Value.(time.Time)
+	if !datetime.Equal(ts) {
+		t.Error("unexpected datetime =", datetime)
+	}
+	decoded.Metrics[13].Value = ts
+
+	if !reflect.DeepEqual(&decoded, p) {
+		t.Errorf("unexpected payload decoded = %+v", decoded)
+	}
+}
+
+func TestPayload_Unmarshal(t *testing.T) {
+	// metric with metadata (field 8) skipped, and unknown field 6 of payload
+	data := []byte{0x12, 0x09, 0x0a, 0x01, 'a', 0x20, 0x0b, 0x42, 0x00, 0x70, 0x01, 0x32, 0x01, 0x00}
+
+	var p Payload
+	if err := p.Unmarshal(data); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Metrics) != 1 || p.Metrics[0].Name != "a" || p.Metrics[0].Value != true || p.HasSeq {
+		t.Errorf("unexpected payload = %+v", p)
+	}
+
+	for _, data := range [][]byte{
+		{0x08},                               // varint missing
+		{0x12, 0x05, 0x0a},                   // length exceeded
+		{0x00, 0x01},                         // field 0
+		{0x0b},                               // group wire type
+		{0x12, 0x04, 0x20, 0x0a, 0x60, 0x01}, // double as varint
+	} {
+		if err := p.Unmarshal(data); err != ErrBadPayload {
+			t.Errorf("unexpected error = %v, data = % x", err, data)
+		}
+	}
+}
+
+func TestNewMetric(t *testing.T) {
+	for value, expected := range map[interface{}]DataType{
+		1:       TypeInt64,
+		uint(1): TypeUInt64,
+		"foo":   TypeString,
+		1.0:     TypeDouble,
+	} {
+		m, err := NewMetric("m", value)
+		if err != nil || m.DataType != expected {
+			t.Error("unexpected metric =", m, "err =", err)
+		}
+	}
+
+	if _, err := NewMetric("m", struct{}{}); err != ErrUnsupportedType {
+		t.Error("unexpected error =", err)
+	}
+
+	// values converted to the data type, or not matching the type
+	p := &Payload{Metrics: []Metric{{Name: "m", DataType: TypeInt16, Value: 7}}}
+	data, err := p.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Unmarshal(data); err != nil || p.Metrics[0].Value != int16(7) {
+		t.Error("unexpected metric =", p.Metrics, "err =", err)
+	}
+
+	for _, m := range []Metric{
+		{DataType: TypeInt16, Value: "7"},
+		{DataType: TypeDataSet, Value: 7},
+		{Value: struct{}{}},
+	} {
+		if _, err := (&Payload{Metrics: []Metric{m}}).Marshal(); err != ErrUnsupportedType {
+			t.Error("unexpected error =", err, "metric =", m)
+		}
+	}
+}
+
+func TestPayload_ProtobufCodec(t *testing.T) {
+	codec := libmqtt.ProtobufCodec{}
+	data, err := codec.Marshal(&Payload{Seq: 1, HasSeq: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var p *Payload
+	if err := codec.Unmarshal(data, &p); err != nil || p.Seq != 1 {
+		t.Error("unexpected payload =", p, "err =", err)
+	}
+}
@@ -0,0 +1,140 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package sparkplug implements the topics and payloads of Sparkplug B
+// (spBv1.0), and the sequence number and bdSeq bookkeeping of edge nodes
+//
+// payloads are encoded with the protobuf wire format of the Sparkplug B
+// schema directly, without protobuf runtime dependency, metadata,
+// properties, data sets and templates are not supported (skipped when
+// decoding)
+package sparkplug
+
+import (
+	"errors"
+	"strings"
+)
+
+var (
+	// ErrBadTopic is returned by ParseTopic if the topic is not in the
+	// Sparkplug B namespace
+	ErrBadTopic = errors.New("sparkplug: bad topic ")
+	// ErrBadID is returned if a group, edge node, device or host id is
+	// empty or has characters not allowed in topic levels
+	ErrBadID = errors.New("sparkplug: bad id ")
+)
+
+// Namespace is the first topic level of Sparkplug B topics
+const Namespace = "spBv1.0"
+
+// MessageType is the message type level of Sparkplug B topics
+type MessageType string
+
+// Sparkplug B message types
+const (
+	NBIRTH MessageType = "NBIRTH"
+	NDEATH MessageType = "NDEATH"
+	DBIRTH MessageType = "DBIRTH"
+	DDEATH MessageType = "DDEATH"
+	NDATA  MessageType = "NDATA"
+	DDATA  MessageType = "DDATA"
+	NCMD   MessageType = "NCMD"
+	DCMD   MessageType = "DCMD"
+	STATE  MessageType = "STATE"
+)
+
+// device returns true if the message type is of devices
+func (t MessageType) device() bool {
+	return t == DBIRTH || t == DDEATH || t == DDATA || t == DCMD
+}
+
+func (t MessageType) valid() bool {
+	switch t {
+	case NBIRTH, NDEATH, DBIRTH, DDEATH, NDATA, DDATA, NCMD, DCMD, STATE:
+		return true
+	default:
+		return false
+	}
+}
+
+// Topic is a topic of the Sparkplug B namespace:
+//
+//	spBv1.0/{Group}/{Type}/{EdgeNode}[/{Device}]
+//	spBv1.0/STATE/{HostID}
+type Topic struct {
+	Group    string
+	Type     MessageType
+	EdgeNode string
+	// Device is only set for device message types (e.g. DDATA)
+	Device string
+	// HostID is only set for STATE
+	HostID string
+}
+
+// String returns the topic name, the topic is not validated
+func (t Topic) String() string {
+	if t.Type == STATE {
+		return Namespace + "/" + string(STATE) + "/" + t.HostID
+	}
+
+	topic := Namespace + "/" + t.Group + "/" + string(t.Type) + "/" + t.EdgeNode
+	if t.Type.device() {
+		topic += "/" + t.Device
+	}
+	return topic
+}
+
+// ParseTopic parses the topic name in the Sparkplug B namespace
+func ParseTopic(topic string) (Topic, error) {
+	levels := strings.Split(topic, "/")
+	if len(levels) < 3 || levels[0] != Namespace {
+		return Topic{}, ErrBadTopic
+	}
+
+	if levels[1] == string(STATE) && len(levels) == 3 {
+		if !validID(levels[2]) {
+			return Topic{}, ErrBadTopic
+		}
+		return Topic{Type: STATE, HostID: levels[2]}, nil
+	}
+
+	t := Topic{Group: levels[1], Type: MessageType(levels[2])}
+	if !t.Type.valid() || t.Type == STATE {
+		return Topic{}, ErrBadTopic
+	}
+
+	switch {
+	case t.Type.device() && len(levels) == 5:
+		t.EdgeNode, t.Device = levels[3], levels[4]
+		if !validID(t.Device) {
+			return Topic{}, ErrBadTopic
+		}
+	case !t.Type.device() && len(levels) == 4:
+		t.EdgeNode = levels[3]
+	default:
+		return Topic{}, ErrBadTopic
+	}
+
+	if !validID(t.Group) || !validID(t.EdgeNode) {
+		return Topic{}, ErrBadTopic
+	}
+	return t, nil
+}
+
+// validID checks the id is a valid topic level without wildcards
+func validID(id string) bool {
+	return id != "" && !strings.ContainsAny(id, "/+#")
+}
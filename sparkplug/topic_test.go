@@ -0,0 +1,58 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package sparkplug
+
+import (
+	"testing"
+)
+
+func TestTopic(t *testing.T) {
+	for expected, topic := range map[string]Topic{
+		"spBv1.0/plant/NBIRTH/node":       {Group: "plant", Type: NBIRTH, EdgeNode: "node"},
+		"spBv1.0/plant/NDATA/node":        {Group: "plant", Type: NDATA, EdgeNode: "node"},
+		"spBv1.0/plant/NCMD/node":         {Group: "plant", Type: NCMD, EdgeNode: "node"},
+		"spBv1.0/plant/DDATA/node/device": {Group: "plant", Type: DDATA, EdgeNode: "node", Device: "device"},
+		"spBv1.0/plant/DCMD/node/device":  {Group: "plant", Type: DCMD, EdgeNode: "node", Device: "device"},
+		"spBv1.0/STATE/scada":             {Type: STATE, HostID: "scada"},
+	} {
+		if s := topic.String(); s != expected {
+			t.Error("unexpected topic =", s, "want =", expected)
+		}
+
+		parsed, err := ParseTopic(expected)
+		if err != nil || parsed != topic {
+			t.Error("unexpected parsed topic =", parsed, "err =", err)
+		}
+	}
+
+	for _, topic := range []string{
+		"",
+		"spAv1.0/plant/NDATA/node",
+		"spBv1.0/plant/NDATA",
+		"spBv1.0/plant/NDATA/node/device",
+		"spBv1.0/plant/DDATA/node",
+		"spBv1.0/plant/UNKNOWN/node",
+		"spBv1.0/plant/STATE/node",
+		"spBv1.0/STATE/scada/extra",
+		"spBv1.0//NDATA/node",
+		"spBv1.0/plant/DDATA/node/",
+		"spBv1.0/plant/NDATA/+",
+	} {
+		if _, err := ParseTopic(topic); err != ErrBadTopic {
+			t.Error("unexpected error =", err, "topic =", topic)
+		}
+	}
+}
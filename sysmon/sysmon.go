@@ -0,0 +1,409 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package sysmon monitors broker statistics published to $SYS topics,
+// payloads are parsed into a typed snapshot according to the mapping of
+// the broker (see Mosquitto and EMQX)
+package sysmon
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goiiot/libmqtt"
+)
+
+var (
+	// ErrNilClient is returned by NewSysMonitor if the client is nil
+	ErrNilClient = errors.New("sysmon: nil client ")
+	// ErrBadMapping is returned by NewSysMonitor if the mapping is empty,
+	// has a filter not under $SYS/ or an unknown statistic
+	ErrBadMapping = errors.New("sysmon: bad mapping ")
+)
+
+// Stat is a statistic of the Snapshot
+type Stat int
+
+// statistics of the Snapshot
+const (
+	StatVersion Stat = iota + 1
+	StatUptime
+	StatClientsConnected
+	StatClientsTotal
+	StatClientsMax
+	StatSubscriptions
+	StatMessagesReceived
+	StatMessagesSent
+	StatBytesReceived
+	StatBytesSent
+	StatLoadMessagesReceived1
+	StatLoadMessagesReceived5
+	StatLoadMessagesReceived15
+	StatLoadMessagesSent1
+	StatLoadMessagesSent5
+	StatLoadMessagesSent15
+	StatLoadBytesReceived1
+	StatLoadBytesReceived5
+	StatLoadBytesReceived15
+	StatLoadBytesSent1
+	StatLoadBytesSent5
+	StatLoadBytesSent15
+
+	statCount
+)
+
+var statNames = [...]string{
+	StatVersion:                "version",
+	StatUptime:                 "uptime",
+	StatClientsConnected:       "clients/connected",
+	StatClientsTotal:           "clients/total",
+	StatClientsMax:             "clients/maximum",
+	StatSubscriptions:          "subscriptions",
+	StatMessagesReceived:       "messages/received",
+	StatMessagesSent:           "messages/sent",
+	StatBytesReceived:          "bytes/received",
+	StatBytesSent:              "bytes/sent",
+	StatLoadMessagesReceived1:  "load/messages/received/1min",
+	StatLoadMessagesReceived5:  "load/messages/received/5min",
+	StatLoadMessagesReceived15: "load/messages/received/15min",
+	StatLoadMessagesSent1:      "load/messages/sent/1min",
+	StatLoadMessagesSent5:      "load/messages/sent/5min",
+	StatLoadMessagesSent15:     "load/messages/sent/15min",
+	StatLoadBytesReceived1:     "load/bytes/received/1min",
+	StatLoadBytesReceived5:     "load/bytes/received/5min",
+	StatLoadBytesReceived15:    "load/bytes/received/15min",
+	StatLoadBytesSent1:         "load/bytes/sent/1min",
+	StatLoadBytesSent5:         "load/bytes/sent/5min",
+	StatLoadBytesSent15:        "load/bytes/sent/15min",
+}
+
+func (s Stat) String() string {
+	if s > 0 && s < statCount {
+		return statNames[s]
+	}
+	return "unknown"
+}
+
+// Mapping maps $SYS topic filters of the broker to statistics, filters
+// may have '+' for levels varying by broker (e.g. EMQX node names)
+type Mapping map[string]Stat
+
+var (
+	// Mosquitto is the mapping of $SYS topics of mosquitto
+	Mosquitto = Mapping{
+		"$SYS/broker/version":                      StatVersion,
+		"$SYS/broker/uptime":                       StatUptime,
+		"$SYS/broker/clients/connected":            StatClientsConnected,
+		"$SYS/broker/clients/active":               StatClientsConnected, // before mosquitto 1.4
+		"$SYS/broker/clients/total":                StatClientsTotal,
+		"$SYS/broker/clients/maximum":              StatClientsMax,
+		"$SYS/broker/subscriptions/count":          StatSubscriptions,
+		"$SYS/broker/messages/received":            StatMessagesReceived,
+		"$SYS/broker/messages/sent":                StatMessagesSent,
+		"$SYS/broker/bytes/received":               StatBytesReceived,
+		"$SYS/broker/bytes/sent":                   StatBytesSent,
+		"$SYS/broker/load/messages/received/1min":  StatLoadMessagesReceived1,
+		"$SYS/broker/load/messages/received/5min":  StatLoadMessagesReceived5,
+		"$SYS/broker/load/messages/received/15min": StatLoadMessagesReceived15,
+		"$SYS/broker/load/messages/sent/1min":      StatLoadMessagesSent1,
+		"$SYS/broker/load/messages/sent/5min":      StatLoadMessagesSent5,
+		"$SYS/broker/load/messages/sent/15min":     StatLoadMessagesSent15,
+		"$SYS/broker/load/bytes/received/1min":     StatLoadBytesReceived1,
+		"$SYS/broker/load/bytes/received/5min":     StatLoadBytesReceived5,
+		"$SYS/broker/load/bytes/received/15min":    StatLoadBytesReceived15,
+		"$SYS/broker/load/bytes/sent/1min":         StatLoadBytesSent1,
+		"$SYS/broker/load/bytes/sent/5min":         StatLoadBytesSent5,
+		"$SYS/broker/load/bytes/sent/15min":        StatLoadBytesSent15,
+	}
+
+	// EMQX is the mapping of $SYS topics of EMQX, statistics of all nodes
+	// subscribed are merged (the last one received wins), connect to a
+	// single node or replace '+' with the node name to monitor one node
+	EMQX = Mapping{
+		"$SYS/brokers/+/version":                   StatVersion,
+		"$SYS/brokers/+/uptime":                    StatUptime,
+		"$SYS/brokers/+/stats/connections/count":   StatClientsConnected,
+		"$SYS/brokers/+/stats/connections/max":     StatClientsMax,
+		"$SYS/brokers/+/stats/subscriptions/count": StatSubscriptions,
+		"$SYS/brokers/+/metrics/messages/received": StatMessagesReceived,
+		"$SYS/brokers/+/metrics/messages/sent":     StatMessagesSent,
+		"$SYS/brokers/+/metrics/bytes/received":    StatBytesReceived,
+		"$SYS/brokers/+/metrics/bytes/sent":        StatBytesSent,
+	}
+)
+
+// Load is the load average over 1, 5 and 15 minutes
+type Load struct {
+	Min1, Min5, Min15 float64
+}
+
+// Snapshot of broker statistics, statistics not received are zero
+type Snapshot struct {
+	Version string
+	Uptime  time.Duration
+
+	ClientsConnected uint64
+	ClientsTotal     uint64
+	ClientsMax       uint64
+	Subscriptions    uint64
+
+	MessagesReceived uint64
+	MessagesSent     uint64
+	BytesReceived    uint64
+	BytesSent        uint64
+
+	MessagesReceivedLoad Load
+	MessagesSentLoad     Load
+	BytesReceivedLoad    Load
+	BytesSentLoad        Load
+
+	// Updated is the time of the last statistic received
+	Updated time.Time
+}
+
+// UpdateHandleFunc is called with the snapshot once the statistic updated
+type UpdateHandleFunc func(snapshot Snapshot, stat Stat)
+
+// SysMonitor keeps the snapshot of broker statistics received
+type SysMonitor struct {
+	client  libmqtt.Client
+	mapping Mapping
+	filters []string
+	handler UpdateHandleFunc
+
+	mu       sync.RWMutex
+	snapshot Snapshot
+	closed   bool
+}
+
+// NewSysMonitor creates the monitor of the broker connected by the client,
+// handlers of mapping filters are registered to the client (replacing
+// handlers registered with the same filter), h (optional) is called for
+// every statistic updated
+//
+// subscriptions are made once the client connected, use HandleConn as (or
+// call it in) the ConnHandleFunc of the client, payloads not parsed (e.g.
+// of a broker version with different formats) are ignored
+func NewSysMonitor(client libmqtt.Client, mapping Mapping, h UpdateHandleFunc) (*SysMonitor, error) {
+	if client == nil {
+		return nil, ErrNilClient
+	}
+
+	if len(mapping) == 0 {
+		return nil, ErrBadMapping
+	}
+
+	m := &SysMonitor{client: client, mapping: make(Mapping, len(mapping)), handler: h}
+	for filter, stat := range mapping {
+		if !strings.HasPrefix(filter, "$SYS/") || stat <= 0 || stat >= statCount {
+			return nil, ErrBadMapping
+		}
+
+		if err := libmqtt.ValidateTopicFilter(filter); err != nil {
+			return nil, err
+		}
+
+		m.mapping[filter] = stat
+		m.filters = append(m.filters, filter)
+	}
+	sort.Strings(m.filters)
+
+	for _, filter := range m.filters {
+		stat := m.mapping[filter]
+		client.HandleTopic(filter, func(client libmqtt.Client, topic string, qos libmqtt.QosLevel, msg []byte) {
+			m.update(stat, string(msg))
+		})
+	}
+	return m, nil
+}
+
+// HandleConn subscribes the mapping filters once the client connected to
+// the server, filters already subscribed (session resumed) are skipped
+func (m *SysMonitor) HandleConn(client libmqtt.Client, server string, code byte, err error) {
+	if err != nil || code != libmqtt.CodeSuccess || client != m.client || m.isClosed() {
+		return
+	}
+
+	subscribed := make(map[string]struct{})
+	for _, sub := range client.Subscriptions() {
+		if sub.Server == server {
+			subscribed[sub.Topic] = struct{}{}
+		}
+	}
+
+	var topics []*libmqtt.Topic
+	for _, filter := range m.filters {
+		if _, ok := subscribed[filter]; !ok {
+			topics = append(topics, &libmqtt.Topic{Name: filter, Qos: libmqtt.Qos0})
+		}
+	}
+
+	if len(topics) > 0 {
+		client.Subscribe(topics...)
+	}
+}
+
+// Snapshot returns the statistics received
+func (m *SysMonitor) Snapshot() Snapshot {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.snapshot
+}
+
+// Close removes the handlers of the mapping filters, the filters are not
+// subscribed again by HandleConn
+func (m *SysMonitor) Close() {
+	m.mu.Lock()
+	m.closed = true
+	m.mu.Unlock()
+
+	for _, filter := range m.filters {
+		m.client.RemoveTopic(filter)
+	}
+}
+
+func (m *SysMonitor) isClosed() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.closed
+}
+
+// update the statistic with the payload, payloads not parsed are ignored
+func (m *SysMonitor) update(stat Stat, payload string) {
+	payload = strings.TrimSpace(payload)
+
+	m.mu.Lock()
+	s := &m.snapshot
+	var ok bool
+	switch stat {
+	case StatVersion:
+		s.Version, ok = payload, payload != ""
+	case StatUptime:
+		s.Uptime, ok = parseUptime(payload, s.Uptime)
+	case StatClientsConnected:
+		s.ClientsConnected, ok = parseCount(payload, s.ClientsConnected)
+	case StatClientsTotal:
+		s.ClientsTotal, ok = parseCount(payload, s.ClientsTotal)
+	case StatClientsMax:
+		s.ClientsMax, ok = parseCount(payload, s.ClientsMax)
+	case StatSubscriptions:
+		s.Subscriptions, ok = parseCount(payload, s.Subscriptions)
+	case StatMessagesReceived:
+		s.MessagesReceived, ok = parseCount(payload, s.MessagesReceived)
+	case StatMessagesSent:
+		s.MessagesSent, ok = parseCount(payload, s.MessagesSent)
+	case StatBytesReceived:
+		s.BytesReceived, ok = parseCount(payload, s.BytesReceived)
+	case StatBytesSent:
+		s.BytesSent, ok = parseCount(payload, s.BytesSent)
+	case StatLoadMessagesReceived1, StatLoadMessagesReceived5, StatLoadMessagesReceived15:
+		ok = parseLoad(payload, &s.MessagesReceivedLoad, int(stat-StatLoadMessagesReceived1))
+	case StatLoadMessagesSent1, StatLoadMessagesSent5, StatLoadMessagesSent15:
+		ok = parseLoad(payload, &s.MessagesSentLoad, int(stat-StatLoadMessagesSent1))
+	case StatLoadBytesReceived1, StatLoadBytesReceived5, StatLoadBytesReceived15:
+		ok = parseLoad(payload, &s.BytesReceivedLoad, int(stat-StatLoadBytesReceived1))
+	case StatLoadBytesSent1, StatLoadBytesSent5, StatLoadBytesSent15:
+		ok = parseLoad(payload, &s.BytesSentLoad, int(stat-StatLoadBytesSent1))
+	}
+
+	if !ok {
+		m.mu.Unlock()
+		return
+	}
+
+	s.Updated = time.Now()
+	snapshot := *s
+	m.mu.Unlock()
+
+	if m.handler != nil {
+		m.handler(snapshot, stat)
+	}
+}
+
+// parseCount parses the counter (e.g. 42 or 42.0), old is returned if not
+// parsed
+func parseCount(payload string, old uint64) (uint64, bool) {
+	if v, err := strconv.ParseUint(payload, 10, 64); err == nil {
+		return v, true
+	}
+
+	if v, err := strconv.ParseFloat(payload, 64); err == nil && v >= 0 {
+		return uint64(v), true
+	}
+	return old, false
+}
+
+// parseLoad parses the load average of the window (0 for 1min, 1 for 5min
+// and 2 for 15min)
+func parseLoad(payload string, load *Load, window int) bool {
+	v, err := strconv.ParseFloat(payload, 64)
+	if err != nil {
+		return false
+	}
+
+	switch window {
+	case 0:
+		load.Min1 = v
+	case 1:
+		load.Min5 = v
+	case 2:
+		load.Min15 = v
+	}
+	return true
+}
+
+// uptime units of parseUptime
+var uptimeUnits = map[string]time.Duration{
+	"second":  time.Second,
+	"seconds": time.Second,
+	"minute":  time.Minute,
+	"minutes": time.Minute,
+	"hour":    time.Hour,
+	"hours":   time.Hour,
+	"day":     24 * time.Hour,
+	"days":    24 * time.Hour,
+}
+
+// parseUptime parses seconds (mosquitto: 3600 seconds, or 3600) or the
+// durations of units (EMQX: 1 days, 2 hours, 3 minutes, 4 seconds), old
+// is returned if not parsed
+func parseUptime(payload string, old time.Duration) (time.Duration, bool) {
+	fields := strings.Fields(strings.Replace(payload, ",", " ", -1))
+	if len(fields) == 1 {
+		fields = append(fields, "seconds")
+	}
+
+	if len(fields) == 0 || len(fields)%2 != 0 {
+		return old, false
+	}
+
+	var uptime time.Duration
+	for i := 0; i < len(fields); i += 2 {
+		n, err := strconv.ParseUint(fields[i], 10, 32)
+		unit, ok := uptimeUnits[fields[i+1]]
+		if err != nil || !ok {
+			return old, false
+		}
+		uptime += time.Duration(n) * unit
+	}
+	return uptime, true
+}
@@ -0,0 +1,178 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sysmon
+
+import (
+	"testing"
+	"time"
+
+	"github.com/goiiot/libmqtt"
+	"github.com/goiiot/libmqtt/mqtttest"
+)
+
+func TestParseUptime(t *testing.T) {
+	for payload, expected := range map[string]time.Duration{
+		"3600 seconds":                          time.Hour,
+		"3600":                                  time.Hour,
+		"1 days, 2 hours, 3 minutes, 4 seconds": 26*time.Hour + 3*time.Minute + 4*time.Second,
+		"7 hours, 1 minutes":                    7*time.Hour + time.Minute,
+	} {
+		if uptime, ok := parseUptime(payload, 0); !ok || uptime != expected {
+			t.Errorf("unexpected uptime of %q = %v, expected = %v", payload, uptime, expected)
+		}
+	}
+
+	for _, payload := range []string{"", "forever", "1 fortnight", "1 days, 2"} {
+		if uptime, ok := parseUptime(payload, time.Second); ok || uptime != time.Second {
+			t.Errorf("uptime of %q parsed = %v", payload, uptime)
+		}
+	}
+}
+
+func TestSysMonitor_Update(t *testing.T) {
+	c, err := libmqtt.NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy(true)
+
+	var stats []Stat
+	m, err := NewSysMonitor(c, Mosquitto, func(snapshot Snapshot, stat Stat) {
+		stats = append(stats, stat)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for stat, payload := range map[Stat]string{
+		StatVersion:               "mosquitto version 2.0.15",
+		StatUptime:                "120 seconds",
+		StatClientsConnected:      "3",
+		StatMessagesReceived:      "42.0",
+		StatBytesSent:             "1024\n",
+		StatLoadMessagesReceived5: "1.5",
+		StatLoadBytesSent15:       "2.25",
+	} {
+		m.update(stat, payload)
+	}
+
+	// ignored
+	m.update(StatClientsTotal, "many")
+	m.update(StatLoadBytesSent1, "")
+
+	s := m.Snapshot()
+	if s.Version != "mosquitto version 2.0.15" || s.Uptime != 2*time.Minute || s.ClientsConnected != 3 ||
+		s.MessagesReceived != 42 || s.BytesSent != 1024 || s.ClientsTotal != 0 ||
+		s.MessagesReceivedLoad != (Load{Min5: 1.5}) || s.BytesSentLoad != (Load{Min15: 2.25}) || s.Updated.IsZero() {
+		t.Errorf("unexpected snapshot %+v", s)
+	}
+
+	if len(stats) != 7 {
+		t.Error("unexpected updates", stats)
+	}
+}
+
+func TestNewSysMonitor(t *testing.T) {
+	c, err := libmqtt.NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy(true)
+
+	if _, err := NewSysMonitor(nil, Mosquitto, nil); err != ErrNilClient {
+		t.Error("unexpected error", err)
+	}
+
+	for _, mapping := range []Mapping{
+		nil,
+		{"broker/uptime": StatUptime},
+		{"$SYS/uptime": Stat(0)},
+		{"$SYS/uptime": statCount},
+	} {
+		if _, err := NewSysMonitor(c, mapping, nil); err != ErrBadMapping {
+			t.Error("unexpected error of mapping", mapping, err)
+		}
+	}
+
+	if _, err := NewSysMonitor(c, Mapping{"$SYS/#/uptime": StatUptime}, nil); err != libmqtt.ErrTopicBadWildcard {
+		t.Error("unexpected error of bad filter", err)
+	}
+}
+
+func TestSysMonitor_Broker(t *testing.T) {
+	b := mqtttest.NewTestBroker()
+	defer func() { _ = b.Close() }()
+
+	var m *SysMonitor
+	subscribed, updated := make(chan error, 1), make(chan Stat, 10)
+	c, err := libmqtt.NewClient(
+		libmqtt.WithCustomConnector(b.Connector()),
+		libmqtt.WithConnHandleFunc(func(client libmqtt.Client, server string, code byte, err error) {
+			m.HandleConn(client, server, code, err)
+		}),
+		libmqtt.WithSubHandleFunc(func(client libmqtt.Client, topics []*libmqtt.Topic, err error) {
+			subscribed <- err
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy(true)
+
+	m, err = NewSysMonitor(c, EMQX, func(snapshot Snapshot, stat Stat) {
+		updated <- stat
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.ConnectServer("broker"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-subscribed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("subscribe timeout")
+	}
+
+	c.Publish(
+		&libmqtt.PublishPacket{TopicName: "$SYS/brokers/emqx@127.0.0.1/uptime", Payload: []byte("1 days, 5 seconds")},
+		&libmqtt.PublishPacket{TopicName: "$SYS/brokers/emqx@127.0.0.1/unknown", Payload: []byte("1")},
+		&libmqtt.PublishPacket{TopicName: "$SYS/brokers/emqx@127.0.0.1/stats/connections/count", Payload: []byte("5")},
+	)
+
+	stats := make(map[Stat]bool)
+	for i := 0; i < 2; i++ {
+		select {
+		case stat := <-updated:
+			stats[stat] = true
+		case <-time.After(5 * time.Second):
+			t.Fatal("statistic not updated, got", stats)
+		}
+	}
+	if !stats[StatUptime] || !stats[StatClientsConnected] {
+		t.Error("unexpected statistics updated", stats)
+	}
+
+	if s := m.Snapshot(); s.Uptime != 24*time.Hour+5*time.Second || s.ClientsConnected != 5 {
+		t.Errorf("unexpected snapshot %+v", s)
+	}
+}
@@ -0,0 +1,104 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package testutil provides connection wrappers (see libmqtt.WithConnWrapper)
+// for diagnosing and testing
+package testutil
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HexDumpTimeFormat is the time format of HexDump, use with
+// `text2pcap -t "%H:%M:%S."`
+const HexDumpTimeFormat = "15:04:05.000000"
+
+// HexDump returns the connection wrapper writing all bytes read from and
+// written to the connection to w, the output is accepted by text2pcap
+// (e.g. `text2pcap -D -t "%H:%M:%S." -T 50000,1883 dump.txt dump.pcap`)
+//
+// every read or write is dumped as a frame: the comment line with the
+// connection name, the direction (I for bytes read, O for bytes written)
+// with the time, and the bytes in lines of 16 bytes with offsets
+//
+// 	# broker.example.com:1883
+// 	O 15:04:05.000000
+// 	000000 10 0c 00 04 4d 51 54 54 04 02 00 3c 00 00
+//
+// the wrapper can be shared by connections, frames are never interleaved
+func HexDump(w io.Writer) func(name string, conn net.Conn) net.Conn {
+	d := &hexDumper{w: w}
+	return func(name string, conn net.Conn) net.Conn {
+		return &hexDumpConn{Conn: conn, name: name, d: d}
+	}
+}
+
+type hexDumper struct {
+	mu  sync.Mutex
+	w   io.Writer
+	buf strings.Builder
+}
+
+func (d *hexDumper) dump(name string, dir byte, data []byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.buf.Reset()
+	fmt.Fprintf(&d.buf, "# %s\n%c %s\n", name, dir, time.Now().Format(HexDumpTimeFormat))
+	for off := 0; off < len(data); off += 16 {
+		end := off + 16
+		if end > len(data) {
+			end = len(data)
+		}
+
+		fmt.Fprintf(&d.buf, "%06x", off)
+		for _, b := range data[off:end] {
+			fmt.Fprintf(&d.buf, " %02x", b)
+		}
+		d.buf.WriteByte('\n')
+	}
+	d.buf.WriteByte('\n')
+
+	_, _ = io.WriteString(d.w, d.buf.String())
+}
+
+// hexDumpConn dumps bytes read and written with hexDumper
+type hexDumpConn struct {
+	net.Conn
+	name string
+	d    *hexDumper
+}
+
+func (c *hexDumpConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.d.dump(c.name, 'I', b[:n])
+	}
+	return n, err
+}
+
+func (c *hexDumpConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.d.dump(c.name, 'O', b[:n])
+	}
+	return n, err
+}
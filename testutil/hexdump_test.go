@@ -0,0 +1,65 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package testutil
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"regexp"
+	"testing"
+)
+
+func TestHexDump(t *testing.T) {
+	client, server := net.Pipe()
+	defer func() { _ = server.Close() }()
+
+	dump := &bytes.Buffer{}
+	conn := HexDump(dump)("foo", client)
+	defer func() { _ = conn.Close() }()
+
+	data := make([]byte, 18)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	go func() {
+		_, _ = server.Read(make([]byte, len(data)))
+		_, _ = server.Write([]byte{0xd0, 0x00})
+	}()
+
+	if _, err := conn.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := regexp.MustCompile(`^# foo
+O \d{2}:\d{2}:\d{2}\.\d{6}
+000000 00 01 02 03 04 05 06 07 08 09 0a 0b 0c 0d 0e 0f
+000010 10 11
+
+# foo
+I \d{2}:\d{2}:\d{2}\.\d{6}
+000000 d0 00
+
+$`)
+	if !expected.Match(dump.Bytes()) {
+		t.Errorf("unexpected dump:\n%s", dump.String())
+	}
+}
@@ -0,0 +1,250 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"errors"
+	"strings"
+	"unicode/utf8"
+)
+
+// errors of topic validation (see ValidateTopicName, ValidateTopicFilter)
+var (
+	// ErrTopicEmpty used when the topic name or filter is empty
+	ErrTopicEmpty = errors.New("topic is empty ")
+
+	// ErrTopicTooLong used when the topic is longer than 65535 bytes
+	ErrTopicTooLong = errors.New("topic longer than 65535 bytes ")
+
+	// ErrTopicNotUTF8 used when the topic is not well formed UTF-8
+	ErrTopicNotUTF8 = errors.New("topic not UTF-8 encoded ")
+
+	// ErrTopicNullChar used when the topic contains U+0000
+	ErrTopicNullChar = errors.New("topic contains null character ")
+
+	// ErrTopicWildcard used when the topic name contains wildcards
+	ErrTopicWildcard = errors.New("topic name contains wildcard ")
+
+	// ErrTopicBadWildcard used when the wildcard in topic filter is not
+	// in legal position ('#' as the last level, '+' as a whole level)
+	ErrTopicBadWildcard = errors.New("topic filter wildcard in illegal position ")
+
+	// ErrTopicBadShare used when the shared subscription has no share name
+	// or the share name contains wildcards
+	ErrTopicBadShare = errors.New("topic filter invalid shared subscription ")
+
+	// ErrTopicBadPrefix used when the topic prefix (see WithTopicPrefix) is
+	// not a topic name ending with '/'
+	ErrTopicBadPrefix = errors.New("topic prefix invalid ")
+)
+
+const (
+	maxTopicLen = 65535
+	sharePrefix = "$share/"
+
+	// absoluteTopicMarker marks topics not prefixed, null character is
+	// not allowed in topics so the marker never reaches the server
+	absoluteTopicMarker = "\x00"
+)
+
+// AbsoluteTopic marks the topic name or filter to be sent as is, without
+// the topic prefix of the client (see WithTopicPrefix), e.g. to subscribe
+// $SYS/#, messages received out of the prefix are delivered with the
+// marked topic name, so handlers of them are registered with the marked
+// topic filter as well
+func AbsoluteTopic(topic string) string {
+	return absoluteTopicMarker + topic
+}
+
+// ValidateTopicName validates the topic name to publish
+func ValidateTopicName(name string) error {
+	if err := validateTopic(name); err != nil {
+		return err
+	}
+
+	if strings.ContainsAny(name, "#+") {
+		return ErrTopicWildcard
+	}
+	return nil
+}
+
+// ValidateTopicFilter validates the topic filter to subscribe or
+// unsubscribe, including shared subscriptions ($share/{name}/{filter})
+func ValidateTopicFilter(filter string) error {
+	if err := validateTopic(filter); err != nil {
+		return err
+	}
+
+	if strings.HasPrefix(filter, sharePrefix) {
+		parts := strings.SplitN(filter[len(sharePrefix):], "/", 2)
+		if len(parts) != 2 || parts[0] == "" || strings.ContainsAny(parts[0], "#+") || parts[1] == "" {
+			return ErrTopicBadShare
+		}
+		filter = parts[1]
+	}
+
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		switch {
+		case level == "#" && i == len(levels)-1, level == "+":
+		case strings.ContainsAny(level, "#+"):
+			return ErrTopicBadWildcard
+		}
+	}
+	return nil
+}
+
+func validateTopic(topic string) error {
+	switch {
+	case topic == "":
+		return ErrTopicEmpty
+	case len(topic) > maxTopicLen:
+		return ErrTopicTooLong
+	case !utf8.ValidString(topic):
+		return ErrTopicNotUTF8
+	case strings.IndexByte(topic, 0) >= 0:
+		return ErrTopicNullChar
+	}
+	return nil
+}
+
+// validateTopicFilters validates topic filters (with the topic prefix)
+// unless validation disabled
+func (c *AsyncClient) validateTopicFilters(filters ...string) error {
+	if c.skipTopicValidation {
+		return nil
+	}
+
+	for _, f := range filters {
+		if err := ValidateTopicFilter(c.prefixFilter(f)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prefixTopic prepends the topic prefix to the topic name, the absolute
+// topic marker is removed instead if marked
+func (c *AsyncClient) prefixTopic(topic string) string {
+	if strings.HasPrefix(topic, absoluteTopicMarker) {
+		return topic[len(absoluteTopicMarker):]
+	}
+	return c.topicPrefix + topic
+}
+
+// prefixFilter prepends the topic prefix to the topic filter, the prefix
+// of shared subscriptions is added after the share name
+// ($share/{name}/{prefix}{filter})
+func (c *AsyncClient) prefixFilter(filter string) string {
+	if strings.HasPrefix(filter, sharePrefix) {
+		if parts := strings.SplitN(filter[len(sharePrefix):], "/", 2); len(parts) == 2 {
+			return sharePrefix + parts[0] + "/" + c.prefixTopic(parts[1])
+		}
+	}
+	return c.prefixTopic(filter)
+}
+
+// stripTopic removes the topic prefix from the topic name received, the
+// topic is marked absolute if not prefixed
+func (c *AsyncClient) stripTopic(topic string) string {
+	if c.topicPrefix == "" || topic == "" {
+		return topic
+	}
+
+	if strings.HasPrefix(topic, c.topicPrefix) {
+		return topic[len(c.topicPrefix):]
+	}
+	return absoluteTopicMarker + topic
+}
+
+// prefixPacket returns the packet to write with topics prefixed (or
+// with the absolute topic marker removed), the packet itself is not
+// modified since it's persisted and resent (and prefixed again) by the
+// client
+func (c *AsyncClient) prefixPacket(pkt Packet) Packet {
+	switch p := pkt.(type) {
+	case *PublishPacket:
+		prefixResp := p.Props != nil && p.Props.RespTopic != "" && c.hasPrefix(p.Props.RespTopic)
+		if !prefixResp && (p.TopicName == "" || !c.hasPrefix(p.TopicName)) {
+			return pkt
+		}
+
+		props, topic := p.Props, p.TopicName
+		if prefixResp {
+			props = props.clone()
+			props.RespTopic = c.prefixTopic(props.RespTopic)
+		}
+		if topic != "" {
+			topic = c.prefixTopic(topic)
+		}
+
+		return &PublishPacket{
+			BasePacket:    BasePacket{ProtoVersion: p.Version()},
+			IsDup:         p.IsDup,
+			Qos:           p.Qos,
+			IsRetain:      p.IsRetain,
+			TopicName:     topic,
+			Payload:       p.Payload,
+			PacketID:      p.PacketID,
+			Props:         props,
+			PayloadReader: p.PayloadReader,
+			PayloadLength: p.PayloadLength,
+		}
+	case *SubscribePacket:
+		s := p.Clone().(*SubscribePacket)
+		for _, t := range s.Topics {
+			if t != nil {
+				t.Name = c.prefixFilter(t.Name)
+			}
+		}
+		return s
+	case *UnsubPacket:
+		u := p.Clone().(*UnsubPacket)
+		for i, t := range u.TopicNames {
+			u.TopicNames[i] = c.prefixFilter(t)
+		}
+		return u
+	case *ConnPacket:
+		if !p.IsWill || c.topicPrefix == "" && !strings.HasPrefix(p.WillTopic, absoluteTopicMarker) {
+			return pkt
+		}
+
+		conn := p.Clone().(*ConnPacket)
+		conn.WillTopic = c.prefixTopic(conn.WillTopic)
+		if conn.WillProps != nil && conn.WillProps.ResponseTopic != "" {
+			conn.WillProps.ResponseTopic = c.prefixTopic(conn.WillProps.ResponseTopic)
+		}
+		return conn
+	}
+	return pkt
+}
+
+// hasPrefix returns true if the topic is changed by prefixTopic
+func (c *AsyncClient) hasPrefix(topic string) bool {
+	return c.topicPrefix != "" || strings.HasPrefix(topic, absoluteTopicMarker)
+}
+
+// stripPacket removes the topic prefix from topics of the publish packet
+// received
+func (c *AsyncClient) stripPacket(pkt Packet) {
+	if p, ok := pkt.(*PublishPacket); ok && c.topicPrefix != "" {
+		p.TopicName = c.stripTopic(p.TopicName)
+		if p.Props != nil && p.Props.RespTopic != "" {
+			p.Props.RespTopic = c.stripTopic(p.Props.RespTopic)
+		}
+	}
+}
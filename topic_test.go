@@ -0,0 +1,190 @@
+/*
+ * Copyright Go-IIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateTopicName(t *testing.T) {
+	for topic, expected := range map[string]error{
+		"/foo/bar":                 nil,
+		"foo":                      nil,
+		"/":                        nil,
+		"$SYS/foo":                 nil,
+		"":                         ErrTopicEmpty,
+		strings.Repeat("a", 65536): ErrTopicTooLong,
+		strings.Repeat("a", 65535): nil,
+		"foo\xff":                  ErrTopicNotUTF8,
+		"foo\x00bar":               ErrTopicNullChar,
+		"/foo/+":                   ErrTopicWildcard,
+		"/foo/#":                   ErrTopicWildcard,
+		"foo#":                     ErrTopicWildcard,
+		"中文/\U0001F600":            nil,
+		"$share/group/foo":         nil,
+		strings.Repeat("中", 21846): ErrTopicTooLong,
+		strings.Repeat("中", 21845): nil,
+	} {
+		if err := ValidateTopicName(topic); err != expected {
+			t.Errorf("unexpected error of topic %.20q, err = %v, expected = %v", topic, err, expected)
+		}
+	}
+}
+
+func TestValidateTopicFilter(t *testing.T) {
+	for filter, expected := range map[string]error{
+		"/foo/bar":           nil,
+		"#":                  nil,
+		"+":                  nil,
+		"/#":                 nil,
+		"/foo/+/bar":         nil,
+		"+/+/#":              nil,
+		"/foo/+/":            nil,
+		"":                   ErrTopicEmpty,
+		"foo\x00":            ErrTopicNullChar,
+		"/foo#":              ErrTopicBadWildcard,
+		"/foo/#/bar":         ErrTopicBadWildcard,
+		"/fo+o":              ErrTopicBadWildcard,
+		"/foo/++":            ErrTopicBadWildcard,
+		"$share/group/foo/#": nil,
+		"$share/group/+":     nil,
+		"$share//foo":        ErrTopicBadShare,
+		"$share/gr+oup/foo":  ErrTopicBadShare,
+		"$share/group":       ErrTopicBadShare,
+		"$share/group/":      ErrTopicBadShare,
+		"$share/group/fo#":   ErrTopicBadWildcard,
+		"$sharefoo/#":        nil,
+	} {
+		if err := ValidateTopicFilter(filter); err != expected {
+			t.Errorf("unexpected error of filter %q, err = %v, expected = %v", filter, err, expected)
+		}
+	}
+}
+
+func TestClient_TopicValidation(t *testing.T) {
+	var (
+		pubErrs   = make(chan error, 10)
+		subErrs   = make(chan error, 10)
+		unsubErrs = make(chan error, 10)
+	)
+	c, err := NewClient(
+		WithPubHandleFunc(func(client Client, topic string, err error) { pubErrs <- err }),
+		WithSubHandleFunc(func(client Client, topics []*Topic, err error) { subErrs <- err }),
+		WithUnsubHandleFunc(func(client Client, topics []string, err error) { unsubErrs <- err }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy(true)
+
+	c.Publish(&PublishPacket{TopicName: "/foo/#", Qos: Qos1})
+	c.Subscribe(&Topic{Name: "/foo"}, &Topic{Name: "/fo#o"})
+	c.SubscribeHandle(func(client Client, topic string, qos QosLevel, msg []byte) {}, &Topic{Name: ""})
+	c.UnSubscribe("/foo/#/bar")
+
+	for _, ch := range []struct {
+		errs     chan error
+		expected []error
+	}{
+		{errs: pubErrs, expected: []error{ErrTopicWildcard}},
+		{errs: subErrs, expected: []error{ErrTopicBadWildcard, ErrTopicEmpty}},
+		{errs: unsubErrs, expected: []error{ErrTopicBadWildcard}},
+	} {
+		// handlers may be called in any order
+		errs := make(map[error]int)
+		for range ch.expected {
+			errs[<-ch.errs]++
+		}
+		for _, expected := range ch.expected {
+			if errs[expected]--; errs[expected] < 0 {
+				t.Error("expected error not notified =", expected, "errors =", errs)
+			}
+		}
+	}
+
+	if len(c.idGen.extras()) != 0 {
+		t.Error("packet ids allocated for invalid topics")
+	}
+	if err := c.PublishWith("/foo/+", nil); err != ErrTopicWildcard {
+		t.Error("unexpected error =", err)
+	}
+
+	// validation disabled
+	c, err = NewClient(WithoutTopicValidation())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy(true)
+
+	if _, err := c.newPublish("/foo/+", nil); err != nil {
+		t.Error("unexpected error =", err)
+	}
+}
+
+func TestClient_TopicPrefix(t *testing.T) {
+	for _, prefix := range []string{"", "tenants", "tenants/+/", "tenants/#/", "tenants\x00/"} {
+		if _, err := NewClient(WithTopicPrefix(prefix)); err != ErrTopicBadPrefix {
+			t.Errorf("unexpected error of prefix %q, err = %v", prefix, err)
+		}
+	}
+
+	c := defaultClient()
+	if err := WithTopicPrefix("tenants/a/")(c, &c.options); err != nil {
+		t.Fatal(err)
+	}
+
+	for filter, expected := range map[string]string{
+		"foo":                                  "tenants/a/foo",
+		"#":                                    "tenants/a/#",
+		"/foo/+":                               "tenants/a//foo/+",
+		"$share/group/foo/#":                   "$share/group/tenants/a/foo/#",
+		AbsoluteTopic("$SYS/#"):                "$SYS/#",
+		"$share/group/" + AbsoluteTopic("foo"): "$share/group/foo",
+	} {
+		if f := c.prefixFilter(filter); f != expected {
+			t.Errorf("unexpected prefixed filter of %q = %q, expected = %q", filter, f, expected)
+		}
+	}
+
+	for topic, expected := range map[string]string{
+		"tenants/a/foo": "foo",
+		"tenants/b/foo": AbsoluteTopic("tenants/b/foo"),
+		"$SYS/foo":      AbsoluteTopic("$SYS/foo"),
+	} {
+		if s := c.stripTopic(topic); s != expected {
+			t.Errorf("unexpected stripped topic of %q = %q, expected = %q", topic, s, expected)
+		}
+	}
+
+	p := &PublishPacket{TopicName: "foo", Props: &PublishProps{RespTopic: "resp"}}
+	if wire := c.prefixPacket(p).(*PublishPacket); wire.TopicName != "tenants/a/foo" || wire.Props.RespTopic != "tenants/a/resp" {
+		t.Error("unexpected prefixed packet =", wire, wire.Props)
+	}
+	if p.TopicName != "foo" || p.Props.RespTopic != "resp" {
+		t.Error("packet modified when prefixed =", p, p.Props)
+	}
+
+	// absolute topics without prefix
+	c = defaultClient()
+	if wire := c.prefixPacket(&PublishPacket{TopicName: AbsoluteTopic("foo")}).(*PublishPacket); wire.TopicName != "foo" {
+		t.Error("absolute topic marker not removed =", wire)
+	}
+	if s := c.stripTopic("foo"); s != "foo" {
+		t.Error("topic stripped without prefix =", s)
+	}
+}
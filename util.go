@@ -22,8 +22,10 @@ import (
 	"fmt"
 	"io"
 	"math"
+	"net/url"
+	"strconv"
+	"strings"
 	"sync"
-	"sync/atomic"
 )
 
 // BufferedWriter buffered writer, e.g. bufio.Writer, bytes.Buffer
@@ -45,24 +47,137 @@ func boolToByte(flag bool) byte {
 	return 0
 }
 
-func recvKey(packetID uint16) string {
-	return fmt.Sprintf("%s%d", "R", packetID)
+const (
+	recvKeyDir = "recv/"
+	sendKeyDir = "send/"
+
+	// key prefixes of versions without namespace, e.g. "S1234"
+	legacyRecvKeyPrefix = "R"
+	legacySendKeyPrefix = "S"
+)
+
+// persistNamespace is the key prefix of packets persisted by the client
+// with clientID connected to the server, e.g. "cid/server/", so clients
+// sharing one persist method never collide
+func persistNamespace(clientID, server string) string {
+	return url.PathEscape(clientID) + "/" + url.PathEscape(server) + "/"
+}
+
+// queueNamespace is the persist namespace of publish packets queued by the
+// client with clientID but not sent to any server yet, e.g. "cid//", the
+// packets are moved to the namespace of the server once sent
+func queueNamespace(clientID string) string {
+	return persistNamespace(clientID, "")
+}
+
+// namespaceClientID returns the client id of the persist namespace
+func namespaceClientID(ns string) string {
+	clientID, _ := url.PathUnescape(ns[:strings.IndexByte(ns, '/')])
+	return clientID
+}
+
+func recvKey(ns string, packetID uint16) string {
+	return fmt.Sprintf("%s%s%d", ns, recvKeyDir, packetID)
+}
+
+func sendKey(ns string, packetID uint16) string {
+	return fmt.Sprintf("%s%s%d", ns, sendKeyDir, packetID)
+}
+
+// sequencedSendKey is the key of the sent packet persisted with the send
+// sequence, e.g. "cid/server/send/1234/1600000000000000000"
+func sequencedSendKey(ns string, packetID uint16, seq uint64) string {
+	return fmt.Sprintf("%s%s%d/%d", ns, sendKeyDir, packetID, seq)
+}
+
+// keySeq returns the send sequence of the key of sequencedSendKey, return
+// false if the key has no sequence
+func keySeq(key string) (uint64, bool) {
+	parts := strings.Split(key, "/")
+	if len(parts) != 5 {
+		return 0, false
+	}
+
+	seq, err := strconv.ParseUint(parts[4], 10, 64)
+	return seq, err == nil
+}
+
+// seqBefore reports whether the send sequence a is before b, sequences are
+// compared with serial number arithmetic, so the order is kept once wrapped
+func seqBefore(a, b uint64) bool {
+	return int64(a-b) < 0
 }
 
-func sendKey(packetID uint16) string {
-	return fmt.Sprintf("%s%d", "S", packetID)
+// parseKey parses the persist key of recvKey, sendKey or sequencedSendKey,
+// return false if the key is not in any namespace
+func parseKey(key string) (clientID, server string, send bool, packetID uint16, ok bool) {
+	parts := strings.Split(key, "/")
+	switch {
+	case len(parts) == 4 && (parts[2]+"/" == sendKeyDir || parts[2]+"/" == recvKeyDir):
+	case len(parts) == 5 && parts[2]+"/" == sendKeyDir:
+		if _, err := strconv.ParseUint(parts[4], 10, 64); err != nil {
+			return "", "", false, 0, false
+		}
+	default:
+		return "", "", false, 0, false
+	}
+
+	id, err := strconv.ParseUint(parts[3], 10, 16)
+	if err != nil {
+		return "", "", false, 0, false
+	}
+
+	if clientID, err = url.PathUnescape(parts[0]); err != nil {
+		return "", "", false, 0, false
+	}
+
+	if server, err = url.PathUnescape(parts[1]); err != nil {
+		return "", "", false, 0, false
+	}
+
+	return clientID, server, parts[2]+"/" == sendKeyDir, uint16(id), true
 }
 
+// namespacedKey converts the legacy key to the key in namespace, return
+// false if not a legacy key
+func namespacedKey(ns, key string) (string, bool) {
+	if len(key) < 2 {
+		return "", false
+	}
+
+	id, err := strconv.ParseUint(key[1:], 10, 16)
+	if err != nil || strconv.FormatUint(id, 10) != key[1:] {
+		return "", false
+	}
+
+	switch key[:1] {
+	case legacyRecvKeyPrefix:
+		return recvKey(ns, uint16(id)), true
+	case legacySendKeyPrefix:
+		return sendKey(ns, uint16(id)), true
+	}
+	return "", false
+}
+
+// idEntry is the state of a packet id in use
+type idEntry struct {
+	extra interface{}
+	done  bool // packet completed, the id is waiting to be reclaimed
+}
+
+// idGenerator generates packet ids, an id is released in two phases, it's
+// marked done once the packet completed (acked), and reclaimed for reuse
+// after all state of the packet (e.g. persisted packet) has been cleaned up
 type idGenerator struct {
-	nextID  uint32
-	usedIDs map[uint16]interface{}
+	nextID  uint16
+	usedIDs map[uint16]*idEntry
 	mu      *sync.RWMutex
 }
 
 func newIDGenerator() *idGenerator {
 	return &idGenerator{
 		nextID:  0,
-		usedIDs: make(map[uint16]interface{}),
+		usedIDs: make(map[uint16]*idEntry),
 		mu:      new(sync.RWMutex),
 	}
 }
@@ -75,51 +190,119 @@ func (g *idGenerator) used(id uint16) bool {
 	return loaded
 }
 
-func (g *idGenerator) setUsed(id uint16, data interface{}) {
+func (g *idGenerator) next(extra interface{}) uint16 {
 	g.mu.Lock()
 	defer g.mu.Unlock()
 
-	g.usedIDs[id] = data
+	for i := 0; i < math.MaxUint16; i++ {
+		g.nextID++
+		if g.nextID == 0 {
+			g.nextID = 1
+		}
+
+		if _, used := g.usedIDs[g.nextID]; !used {
+			g.usedIDs[g.nextID] = &idEntry{extra: extra}
+			return g.nextID
+		}
+	}
+
+	// id running out, caller should try some time later
+	return 0
 }
 
-func (g *idGenerator) next(extra interface{}) uint16 {
-	id := uint16(atomic.AddUint32(&g.nextID, 1))
-	if id == 0 {
-		atomic.StoreUint32(&g.nextID, 1)
-		id = 1
+// markDone marks the packet id as completed, the id is not reusable until
+// reclaimed, return false if the id is not in use or already done
+func (g *idGenerator) markDone(id uint16) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	e, ok := g.usedIDs[id]
+	if !ok || e.done {
+		return false
 	}
 
-	if used := g.used(id); used {
-		for i := 0; used; id = uint16(atomic.AddUint32(&g.nextID, 1)) {
-			if i == math.MaxUint16 {
-				// id running out, caller should try some time later
-				return 0
-			}
+	e.done = true
+	return true
+}
+
+// reclaim makes the packet id reusable
+func (g *idGenerator) reclaim(id uint16) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	delete(g.usedIDs, id)
+}
+
+// getExtra returns the extra data of the packet id not completed
+func (g *idGenerator) getExtra(id uint16) (interface{}, bool) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	e, ok := g.usedIDs[id]
+	if !ok || e.done {
+		return nil, false
+	}
+	return e.extra, true
+}
 
-			used = g.used(id)
-			i++
+// setExtra replaces the extra data of the packet id not completed
+func (g *idGenerator) setExtra(id uint16, extra interface{}) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if e, ok := g.usedIDs[id]; ok && !e.done {
+		e.extra = extra
+	}
+}
+
+// extras returns the extra data of all packet ids not completed
+func (g *idGenerator) extras() map[uint16]interface{} {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	ret := make(map[uint16]interface{})
+	for id, e := range g.usedIDs {
+		if !e.done {
+			ret[id] = e.extra
 		}
 	}
+	return ret
+}
+
+// restore marks the packet id in use with the extra data and continues
+// generating ids after lastID, used to restore the exported session
+func (g *idGenerator) restore(lastID uint16, extras map[uint16]interface{}) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
 
-	if id > 0 {
-		g.setUsed(id, extra)
+	g.nextID = lastID
+	for id, extra := range extras {
+		if id != 0 {
+			g.usedIDs[id] = &idEntry{extra: extra}
+		}
 	}
-	return id
 }
 
-func (g *idGenerator) free(id uint16) {
+// reserve marks the packet id in use with the extra data if not in use,
+// return the extra data of the packet id
+func (g *idGenerator) reserve(id uint16, extra interface{}) interface{} {
 	g.mu.Lock()
 	defer g.mu.Unlock()
 
-	delete(g.usedIDs, id)
+	if e, ok := g.usedIDs[id]; ok && !e.done {
+		return e.extra
+	}
+
+	g.usedIDs[id] = &idEntry{extra: extra}
+	return extra
 }
 
-func (g *idGenerator) getExtra(id uint16) (interface{}, bool) {
+// lastID returns the last generated packet id
+func (g *idGenerator) lastID() uint16 {
 	g.mu.RLock()
 	defer g.mu.RUnlock()
 
-	data, ok := g.usedIDs[id]
-	return data, ok
+	return g.nextID
 }
 
 func putUint16(d []byte, v uint16) {
@@ -130,14 +313,33 @@ func putUint32(d []byte, v uint32) {
 	binary.BigEndian.PutUint32(d[:], v)
 }
 
-func encodeStringWithLen(str string) []byte {
-	return encodeBytesWithLen([]byte(str))
+// maxStringLen is the max length of UTF-8 strings and binary data
+// encoded with the two bytes length prefix
+const maxStringLen = 65535
+
+func encodeStringWithLen(str string) ([]byte, error) {
+	return appendStringWithLen(nil, str)
 }
 
-func encodeBytesWithLen(data []byte) []byte {
+func encodeBytesWithLen(data []byte) ([]byte, error) {
 	l := len(data)
+	if l > maxStringLen {
+		return nil, ErrStringTooLong
+	}
+
 	result := []byte{byte(l >> 8), byte(l)}
-	return append(result, data...)
+	return append(result, data...), nil
+}
+
+// appendStringWithLen appends the length prefixed string to dst
+func appendStringWithLen(dst []byte, str string) ([]byte, error) {
+	l := len(str)
+	if l > maxStringLen {
+		return dst, ErrStringTooLong
+	}
+
+	dst = append(dst, byte(l>>8), byte(l))
+	return append(dst, str...), nil
 }
 
 func varIntBytes(n int) ([]byte, error) {
@@ -197,13 +399,13 @@ func getStringData(data []byte) (string, []byte, error) {
 func getBinaryData(data []byte) ([]byte, []byte, error) {
 	dataLen := len(data)
 	if dataLen < 2 {
-		return nil, nil, ErrDecodeBadPacket
+		return nil, nil, malformed("length of string or binary data truncated")
 	}
 
 	end := int(getUint16(data)) + 2
 	if end > dataLen {
 		// out of bounds
-		return nil, nil, ErrDecodeBadPacket
+		return nil, nil, malformed("string or binary data exceeds the remaining length")
 	}
 	return data[2:end], data[end:], nil
 }
@@ -236,98 +438,126 @@ func getUint32(d []byte) uint32 {
 // | prop length |
 // | prop body.. |
 // |   payload   |
+//
+// only User Property and Subscription Identifier can be included more
+// than once, values of the same property are concatenated
 func getRawProps(data []byte) (props map[byte][]byte, next []byte, err error) {
-	defer func() {
-		e := recover()
-		if e != nil {
-			err = ErrDecodeBadPacket
-		}
-	}()
-
 	propsLen, byteLen := getRemainLength(bytes.NewReader(data))
-	propsBytes := data[byteLen : propsLen+byteLen]
-	next = data[propsLen+byteLen:]
+	if byteLen > 4 || propsLen > len(data)-byteLen {
+		return nil, nil, &MalformedPacketError{Code: CodeMalformedPacket, Reason: "properties truncated"}
+	}
+
+	propsBytes := data[byteLen : byteLen+propsLen]
+	next = data[byteLen+propsLen:]
 	props = make(map[byte][]byte)
+	for len(propsBytes) > 0 {
+		key := propsBytes[0]
+		n, err := propValueLen(key, propsBytes[1:])
+		if err != nil {
+			return nil, nil, err
+		}
 
-	for i := 0; i < propsLen; {
-		var p []byte
-		switch propsBytes[0] {
-		case propKeyPayloadFormatIndicator:
-			p = propsBytes[1:2]
-		case propKeyMessageExpiryInterval:
-			p = propsBytes[1:5]
-		case propKeyContentType:
-			p = propsBytes[1 : 3+getUint16(propsBytes[1:3])]
-		case propKeyRespTopic:
-			p = propsBytes[1 : 3+getUint16(propsBytes[1:3])]
-		case propKeyCorrelationData:
-			p = propsBytes[1 : 3+getUint16(propsBytes[1:3])]
-		case propKeySubID:
-			_, byteLen := getRemainLength(bytes.NewReader(propsBytes[1:]))
-			p = propsBytes[1 : 1+byteLen]
-		case propKeySessionExpiryInterval:
-			p = propsBytes[1:5]
-		case propKeyAssignedClientID:
-			p = propsBytes[1 : 3+getUint16(propsBytes[1:3])]
-		case propKeyServerKeepalive:
-			p = propsBytes[1:3]
-		case propKeyAuthMethod:
-			p = propsBytes[1 : 3+getUint16(propsBytes[1:3])]
-		case propKeyAuthData:
-			p = propsBytes[1 : 3+getUint16(propsBytes[1:3])]
-		case propKeyReqProblemInfo:
-			p = propsBytes[1:2]
-		case propKeyWillDelayInterval:
-			p = propsBytes[1:5]
-		case propKeyReqRespInfo:
-			p = propsBytes[1:2]
-		case propKeyRespInfo:
-			p = propsBytes[1 : 3+getUint16(propsBytes[1:3])]
-		case propKeyServerRef:
-			p = propsBytes[1 : 3+getUint16(propsBytes[1:3])]
-		case propKeyReasonString:
-			p = propsBytes[1 : 3+getUint16(propsBytes[1:3])]
-		case propKeyMaxRecv:
-			p = propsBytes[1:3]
-		case propKeyMaxTopicAlias:
-			p = propsBytes[1:3]
-		case propKeyTopicAlias:
-			p = propsBytes[1:3]
-		case propKeyMaxQos:
-			p = propsBytes[1:2]
-		case propKeyRetainAvail:
-			p = propsBytes[1:2]
-		case propKeyUserProps:
-			keyEnd := 2 + getUint16(propsBytes[1:3])
-			valEnd := 2 + keyEnd + getUint16(propsBytes[keyEnd+1:keyEnd+3])
-			p = propsBytes[1 : valEnd+1]
-		case propKeyMaxPacketSize:
-			p = propsBytes[1:5]
-		case propKeyWildcardSubAvail:
-			p = propsBytes[1:2]
-		case propKeySubIDAvail:
-			p = propsBytes[1:2]
-		case propKeySharedSubAvail:
-			p = propsBytes[1:2]
-		default:
-			err = ErrDecodeBadPacket
-			return
+		if _, ok := props[key]; ok && key != propKeyUserProps && key != propKeySubID {
+			return nil, nil, &MalformedPacketError{
+				Code:   CodeProtoError,
+				Reason: fmt.Sprintf("property %d included more than once", key),
+			}
 		}
-		props[propsBytes[0]] = append(props[propsBytes[0]], p...)
-		propsBytes = propsBytes[1+len(p):]
-		i += 1 + len(p)
+
+		props[key] = append(props[key], propsBytes[1:1+n]...)
+		propsBytes = propsBytes[1+n:]
+	}
+
+	return props, next, nil
+}
+
+// propValueLen returns the length of the property value at the beginning
+// of data
+func propValueLen(key byte, data []byte) (int, error) {
+	n := 0
+	switch key {
+	case propKeyPayloadFormatIndicator, propKeyReqProblemInfo, propKeyReqRespInfo,
+		propKeyMaxQos, propKeyRetainAvail, propKeyWildcardSubAvail, propKeySubIDAvail, propKeySharedSubAvail:
+		n = 1
+	case propKeyServerKeepalive, propKeyMaxRecv, propKeyMaxTopicAlias, propKeyTopicAlias:
+		n = 2
+	case propKeyMessageExpiryInterval, propKeySessionExpiryInterval, propKeyWillDelayInterval, propKeyMaxPacketSize:
+		n = 4
+	case propKeyContentType, propKeyRespTopic, propKeyCorrelationData, propKeyAssignedClientID,
+		propKeyAuthMethod, propKeyAuthData, propKeyRespInfo, propKeyServerRef, propKeyReasonString:
+		if _, next, err := getBinaryData(data); err == nil {
+			n = len(data) - len(next)
+		}
+	case propKeyUserProps:
+		// key value string pair
+		if _, next, err := getBinaryData(data); err == nil {
+			if _, next, err = getBinaryData(next); err == nil {
+				n = len(data) - len(next)
+			}
+		}
+	case propKeySubID:
+		// variable byte integer takes at most 4 bytes
+		for i := 0; i < len(data) && i < 4; i++ {
+			if data[i]&128 == 0 {
+				n = i + 1
+				break
+			}
+		}
+	default:
+		return 0, &MalformedPacketError{Code: CodeMalformedPacket, Reason: fmt.Sprintf("unknown property %d", key)}
 	}
 
-	return
+	if n == 0 || n > len(data) {
+		return 0, &MalformedPacketError{Code: CodeMalformedPacket, Reason: fmt.Sprintf("property %d truncated", key)}
+	}
+	return n, nil
 }
 
+// getPacketProps decodes properties with getRawProps and checks all of
+// them are allowed in the packet type (ctrlWill for will properties)
+func getPacketProps(data []byte, in CtrlType) (map[byte][]byte, []byte, error) {
+	props, next, err := getRawProps(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for key := range props {
+		if propPackets[key]&(1<<in) == 0 {
+			return nil, nil, &MalformedPacketError{
+				Code:   CodeMalformedPacket,
+				Reason: fmt.Sprintf("property %d not allowed in packet type %d", key, in),
+			}
+		}
+	}
+
+	if v, ok := props[propKeySubID]; ok && in == CtrlSubscribe {
+		if _, n := getRemainLength(bytes.NewReader(v)); n != len(v) {
+			return nil, nil, &MalformedPacketError{
+				Code:   CodeProtoError,
+				Reason: fmt.Sprintf("property %d included more than once", propKeySubID),
+			}
+		}
+	}
+
+	return props, next, nil
+}
+
+// getUserProps decodes the concatenated user properties in order
 func getUserProps(data []byte) UserProps {
-	props := make(UserProps)
-	strKey, next, _ := getStringData(data)
-	for ; next != nil; strKey, next, _ = getStringData(next) {
-		var val string
-		val, next, _ = getStringData(next)
-		props[strKey] = append(props[strKey], val)
+	var props UserProps
+	for len(data) > 0 {
+		key, next, err := getStringData(data)
+		if err != nil {
+			break
+		}
+
+		val, next, err := getStringData(next)
+		if err != nil {
+			break
+		}
+
+		props = append(props, UserProp{Key: key, Value: val})
+		data = next
 	}
 	return props
 }
@@ -19,6 +19,7 @@ package libmqtt
 import (
 	"bytes"
 	"math"
+	"math/rand"
 	"testing"
 )
 
@@ -61,7 +62,8 @@ func BenchmarkIdGenerator_next(b *testing.B) {
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		id := gen.next(pkt)
-		gen.free(id)
+		gen.markDone(id)
+		gen.reclaim(id)
 	}
 }
 
@@ -369,10 +371,10 @@ func TestGetRawProps(t *testing.T) {
 
 	if v, ok := rawProps[propKeyUserProps]; ok {
 		uProps := getUserProps(v)
-		if mq, ok := uProps["MQ"]; !ok || len(mq) != 2 {
+		if mq := uProps.Values("MQ"); len(mq) != 2 {
 			t.Error(mq)
 		}
-		if tt, ok := uProps["TT"]; !ok || len(tt) != 1 {
+		if tt := uProps.Values("TT"); len(tt) != 1 {
 			t.Error(tt)
 		}
 	} else {
@@ -411,3 +413,149 @@ func TestGetRawProps(t *testing.T) {
 		t.Error("propKeySharedSubAvail not decoded")
 	}
 }
+
+func TestGetPacketProps(t *testing.T) {
+	for _, c := range []struct {
+		props []byte
+		in    CtrlType
+		code  byte // 0 if valid
+	}{
+		{props: []byte{0}, in: CtrlPubAck},
+		{props: []byte{4, propKeyReasonString, 0, 1, 'a'}, in: CtrlPubAck},
+		{props: []byte{11, propKeyUserProps, 0, 1, 'a', 0, 0, propKeyUserProps, 0, 0, 0, 0}, in: CtrlPubAck},
+		{props: []byte{4, propKeySubID, 1, propKeySubID, 2}, in: CtrlPublish},
+		{props: []byte{5, propKeyWillDelayInterval, 0, 0, 0, 1}, in: ctrlWill},
+		// not allowed in packet type
+		{props: []byte{5, propKeyWillDelayInterval, 0, 0, 0, 1}, in: CtrlConn, code: CodeMalformedPacket},
+		{props: []byte{3, propKeyTopicAlias, 0, 1}, in: CtrlSubscribe, code: CodeMalformedPacket},
+		// duplicate
+		{props: []byte{4, propKeySubID, 1, propKeySubID, 2}, in: CtrlSubscribe, code: CodeProtoError},
+		{props: []byte{4, propKeyMaxQos, 1, propKeyMaxQos, 1}, in: CtrlConnAck, code: CodeProtoError},
+		// unknown property
+		{props: []byte{2, 0x7f, 0}, in: CtrlPubAck, code: CodeMalformedPacket},
+		// truncated
+		{props: []byte{5, propKeyReasonString, 0, 1}, in: CtrlPubAck, code: CodeMalformedPacket},
+		{props: []byte{3, propKeyReasonString, 0, 2, 'a'}, in: CtrlPubAck, code: CodeMalformedPacket},
+		{props: []byte{2, propKeyMessageExpiryInterval, 0}, in: CtrlPublish, code: CodeMalformedPacket},
+		{props: []byte{6, propKeyUserProps, 0, 1, 'a', 0, 1}, in: CtrlPubAck, code: CodeMalformedPacket},
+		{props: []byte{5, propKeySubID, 0x80, 0x80, 0x80, 0x80}, in: CtrlPublish, code: CodeMalformedPacket},
+		{props: []byte{0x80, 0x80, 0x80, 0x80, 0x01}, in: CtrlPublish, code: CodeMalformedPacket},
+	} {
+		_, _, err := getPacketProps(c.props, c.in)
+		if c.code == 0 {
+			if err != nil {
+				t.Error("unexpected error =", err, "props =", c.props)
+			}
+			continue
+		}
+
+		if e, ok := err.(*MalformedPacketError); !ok || e.Code != c.code {
+			t.Error("unexpected error =", err, "expected code =", c.code, "props =", c.props)
+		}
+	}
+}
+
+func TestGetPacketProps_Mutated(t *testing.T) {
+	valid := &PublishProps{
+		PayloadFormat:         1,
+		MessageExpiryInterval: 10,
+		TopicAlias:            1,
+		RespTopic:             "/resp",
+		CorrelationData:       []byte{1, 2},
+		UserProps:             UserProps{{Key: "k", Value: "v1"}, {Key: "k", Value: "v2"}},
+		SubIDs:                []int{1, 200},
+		ContentType:           "text/plain",
+	}
+	props, err := valid.props()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seed := new(bytes.Buffer)
+	_ = writeVarInt(len(props), seed)
+	seed.Write(props)
+
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		data := append([]byte(nil), seed.Bytes()...)
+		for n := r.Intn(4); n >= 0; n-- {
+			switch r.Intn(3) {
+			case 0:
+				data[r.Intn(len(data))] = byte(r.Intn(256))
+			case 1:
+				data = data[:r.Intn(len(data))]
+			case 2:
+				at := r.Intn(len(data) + 1)
+				data = append(data[:at], append([]byte{byte(r.Intn(256))}, data[at:]...)...)
+			}
+			if len(data) == 0 {
+				break
+			}
+		}
+
+		decoded, next, err := getPacketProps(data, CtrlPublish)
+		if err != nil {
+			if _, ok := err.(*MalformedPacketError); !ok {
+				t.Fatal("unexpected error type", err)
+			}
+			continue
+		}
+
+		p := &PublishProps{}
+		p.setProps(decoded)
+		if len(next) > len(data) {
+			t.Fatal("bad remaining data", data)
+		}
+	}
+}
+
+func TestNamespacedKey(t *testing.T) {
+	ns := persistNamespace("cid", "ws://localhost/mqtt")
+	if ns != "cid/ws:%2F%2Flocalhost%2Fmqtt/" {
+		t.Error("unexpected namespace =", ns)
+	}
+
+	for key, expected := range map[string]string{
+		"S1":     ns + "send/1",
+		"R65535": ns + "recv/65535",
+		"S65536": "",
+		"S01":    "",
+		"Sfoo":   "",
+		"T1":     "",
+		"S":      "",
+	} {
+		k, ok := namespacedKey(ns, key)
+		if ok != (expected != "") || k != expected {
+			t.Error("unexpected namespaced key =", k, "legacy key =", key)
+		}
+	}
+}
+
+func TestSeqBefore(t *testing.T) {
+	for _, c := range []struct {
+		a, b   uint64
+		before bool
+	}{
+		{a: 1, b: 2, before: true},
+		{a: 2, b: 1, before: false},
+		{a: 1, b: 1, before: false},
+		// wrapped
+		{a: math.MaxUint64 - 1, b: 1, before: true},
+		{a: 1, b: math.MaxUint64, before: false},
+	} {
+		if seqBefore(c.a, c.b) != c.before {
+			t.Error("unexpected order, a =", c.a, "b =", c.b)
+		}
+	}
+
+	key := sequencedSendKey("cid/server/", 1234, math.MaxUint64)
+	if seq, ok := keySeq(key); !ok || seq != math.MaxUint64 {
+		t.Error("unexpected sequence of key =", key)
+	}
+	if _, _, send, id, ok := parseKey(key); !ok || !send || id != 1234 {
+		t.Error("sequenced key not parsed =", key)
+	}
+	if _, ok := keySeq(sendKey("cid/server/", 1234)); ok {
+		t.Error("sequence of key without sequence")
+	}
+}